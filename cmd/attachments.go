@@ -0,0 +1,141 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"text/template"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	migrateAttachmentsFileName string = "migrateattachments.go"
+	gcAttachmentsFileName      string = "gcattachments.go"
+)
+
+var migrateAttachmentsCmd = &cobra.Command{
+	Use:   "migrate-attachments [projectDir]",
+	Short: "Migrate attachments to another storage backend",
+	Long: `Copy the contents of all attachments from the 'attachment-migrate-from' store to the 'attachment-store' store.
+
+The server can keep running during the migration if it has been started with
+the same 'attachment-store' and 'attachment-migrate-from' flags. Once the
+migration is complete, restart the server without 'attachment-migrate-from'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		projectDir := "."
+		if len(args) > 0 {
+			projectDir = args[0]
+		}
+		generateAndRunFile(projectDir, migrateAttachmentsFileName, migrateAttachmentsTemplate)
+	},
+}
+
+var gcAttachmentsCmd = &cobra.Command{
+	Use:   "gc-attachments [projectDir]",
+	Short: "Delete unreferenced attachment contents",
+	Long: `Delete the contents of the 'attachment-store' store that are not referenced by any attachment anymore.
+
+Contents that have been stored less than 'gc-grace-period' ago are kept, since
+they may belong to transactions that are not committed yet.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		projectDir := "."
+		if len(args) > 0 {
+			projectDir = args[0]
+		}
+		generateAndRunFile(projectDir, gcAttachmentsFileName, gcAttachmentsTemplate)
+	},
+}
+
+// MigrateAttachments copies the contents of all attachments from the store
+// to migrate from to the configured attachment store. It is meant to be
+// called from a project start file which imports all the project's module.
+func MigrateAttachments(config map[string]interface{}) {
+	setupConfig(config)
+	if viper.GetString("Attachments.MigrateFrom") == "" {
+		log.Panic("No store to migrate attachments from. Set the 'attachment-migrate-from' flag")
+	}
+	connectToDB()
+	models.BootStrap()
+	from := newAttachmentStore(viper.GetString("Attachments.MigrateFrom"))
+	to := newAttachmentStore(viper.GetString("Attachments.Store"))
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		count, err := models.MigrateAttachments(env, from, to)
+		if err != nil {
+			log.Panic("Error while migrating attachments", "migrated", count, "error", err)
+		}
+		log.Info("Attachments migrated successfully", "count", count)
+	})
+	if err != nil {
+		log.Panic("Attachments migration failed", "error", err)
+	}
+}
+
+// CollectAttachmentGarbage deletes the contents of the configured attachment
+// store that are not referenced anymore. It is meant to be called from a
+// project start file which imports all the project's module.
+func CollectAttachmentGarbage(config map[string]interface{}) {
+	setupConfig(config)
+	connectToDB()
+	models.BootStrap()
+	store, ok := newAttachmentStore(viper.GetString("Attachments.Store")).(models.CollectableStore)
+	if !ok {
+		log.Panic("Attachment store does not support garbage collection", "store", viper.GetString("Attachments.Store"))
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		report, err := models.CollectAttachmentGarbage(env, store, viper.GetDuration("Attachments.GCGracePeriod"))
+		if err != nil {
+			log.Panic("Error while collecting attachments garbage", "report", report.String(), "error", err)
+		}
+		log.Info("Attachments garbage collected", "scanned", report.Scanned, "referenced", report.Referenced,
+			"deleted", report.Deleted, "reclaimed", report.Reclaimed)
+	})
+	if err != nil {
+		log.Panic("Attachments garbage collection failed", "error", err)
+	}
+}
+
+func initMigrateAttachments() {
+	YEPCmd.AddCommand(migrateAttachmentsCmd)
+	gcAttachmentsCmd.Flags().Duration("gc-grace-period", 24*time.Hour, "Minimum age of unreferenced contents to delete")
+	viper.BindPFlag("Attachments.GCGracePeriod", gcAttachmentsCmd.Flags().Lookup("gc-grace-period"))
+	YEPCmd.AddCommand(gcAttachmentsCmd)
+}
+
+var migrateAttachmentsTemplate = template.Must(template.New("").Parse(`
+// This file is autogenerated by yep-server
+// DO NOT MODIFY THIS FILE - ANY CHANGES WILL BE OVERWRITTEN
+
+package main
+
+import (
+	"github.com/npiganeau/yep/cmd"
+{{ range .Imports }}	_ "{{ . }}"
+{{ end }}
+)
+
+func main() {
+	cmd.MigrateAttachments({{ .Config }})
+}
+`))
+
+var gcAttachmentsTemplate = template.Must(template.New("").Parse(`
+// This file is autogenerated by yep-server
+// DO NOT MODIFY THIS FILE - ANY CHANGES WILL BE OVERWRITTEN
+
+package main
+
+import (
+	"github.com/npiganeau/yep/cmd"
+{{ range .Imports }}	_ "{{ . }}"
+{{ end }}
+)
+
+func main() {
+	cmd.CollectAttachmentGarbage({{ .Config }})
+}
+`))
@@ -0,0 +1,122 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/template"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const explainFileName string = "explain.go"
+
+var explainCmd = &cobra.Command{
+	Use:   "explain MODEL FIELD ID [projectDir]",
+	Short: "Explain the computation of a computed field of a record",
+	Long: `Explain the computation of the given computed field for the record with the given ID:
+its depends paths, the fields whose modification triggers its recomputation, the
+current values of its sources and the result of the replay of its compute method.
+
+The compute method is replayed in a transaction that is rolled back.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 3 {
+			fmt.Println("Please specify the model, the field and the record ID to explain")
+			os.Exit(1)
+		}
+		id, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid record ID: %s\n", args[2])
+			os.Exit(1)
+		}
+		viper.Set("Explain.Model", args[0])
+		viper.Set("Explain.Field", args[1])
+		viper.Set("Explain.ID", id)
+		projectDir := "."
+		if len(args) > 3 {
+			projectDir = args[3]
+		}
+		generateAndRunFile(projectDir, explainFileName, explainTemplate)
+	},
+}
+
+// Explain prints the explanation of the computed field given by the
+// 'Explain.Model', 'Explain.Field' and 'Explain.ID' configuration keys.
+// It is meant to be called from a project start file which imports all
+// the project's module.
+func Explain(config map[string]interface{}) {
+	setupConfig(config)
+	connectToDB()
+	models.BootStrap()
+	setupEncryption()
+	err := models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		rs := env.Pool(viper.GetString("Explain.Model"))
+		rs = rs.Search(rs.Model().Field("ID").Equals(viper.GetInt64("Explain.ID")))
+		printComputeExplanation(os.Stdout, rs.ExplainCompute(viper.GetString("Explain.Field")))
+	})
+	if err != nil {
+		log.Panic("Unable to explain computed field", "error", err)
+	}
+}
+
+// printComputeExplanation writes the given explanation to w
+func printComputeExplanation(w io.Writer, expl models.ComputeExplanation) {
+	fmt.Fprintf(w, "Field: %s.%s (compute: %s, stored: %t)\n", expl.Model, expl.Field, expl.Compute, expl.Stored)
+
+	fmt.Fprintln(w, "\nDepends:")
+	for _, dep := range expl.Depends {
+		fmt.Fprintf(w, "  %s\n", dep)
+	}
+
+	fmt.Fprintln(w, "\nRecomputed when modifying:")
+	for _, trigger := range expl.Triggers {
+		if trigger.Path == "" {
+			fmt.Fprintf(w, "  %s.%s of the record itself\n", trigger.Model, trigger.Field)
+			continue
+		}
+		fmt.Fprintf(w, "  %s.%s of the records reached by %s\n", trigger.Model, trigger.Field, trigger.Path)
+	}
+
+	fmt.Fprintln(w, "\nSources:")
+	for _, source := range expl.Sources {
+		var computed string
+		if source.Computed {
+			computed = " (computed)"
+		}
+		fmt.Fprintf(w, "  %s%s = %v\n", source.Path, computed, source.Values)
+	}
+
+	fmt.Fprintf(w, "\nCurrent value:  %v\n", expl.Value)
+	fmt.Fprintf(w, "Computed value: %v\n", expl.ComputedValue)
+	if expl.Stale {
+		fmt.Fprintln(w, "The current value is STALE: the field has not been recomputed after a modification of its sources.")
+	}
+}
+
+func initExplain() {
+	YEPCmd.AddCommand(explainCmd)
+}
+
+var explainTemplate = template.Must(template.New("").Parse(`
+// This file is autogenerated by yep-server
+// DO NOT MODIFY THIS FILE - ANY CHANGES WILL BE OVERWRITTEN
+
+package main
+
+import (
+	"github.com/npiganeau/yep/cmd"
+{{ range .Imports }}	_ "{{ . }}"
+{{ end }}
+)
+
+func main() {
+	cmd.Explain({{ .Config }})
+}
+`))
@@ -0,0 +1,177 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/npiganeau/yep/yep/actions"
+	"github.com/npiganeau/yep/yep/menus"
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+	"github.com/npiganeau/yep/yep/views"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const inspectFileName string = "inspect.go"
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect MODEL [projectDir]",
+	Short: "Print the registry summary of a model",
+	Long: `Print the summary of the given model after bootstrap of all the project's modules:
+its fields with their resolved types and dependencies, the override stack of its
+methods, its views after inheritance and the actions and menus referencing it.
+
+The database is not accessed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Println("Please specify the model to inspect")
+			os.Exit(1)
+		}
+		viper.Set("Inspect.Model", args[0])
+		projectDir := "."
+		if len(args) > 1 {
+			projectDir = args[1]
+		}
+		generateAndRunFile(projectDir, inspectFileName, inspectTemplate)
+	},
+}
+
+// Inspect prints the registry summary of the model given by the
+// 'Inspect.Model' configuration key. It is meant to be called from
+// a project start file which imports all the project's module.
+func Inspect(config map[string]interface{}) {
+	setupConfig(config)
+	models.BootStrap()
+	server.LoadInternalResources()
+	views.BootStrap()
+	actions.BootStrap()
+	menus.BootStrap()
+	printModelInspection(os.Stdout, viper.GetString("Inspect.Model"))
+}
+
+// printModelInspection writes the registry summary of the given model to w
+func printModelInspection(w io.Writer, modelName string) {
+	insp := models.InspectModel(modelName)
+	fmt.Fprintf(w, "Model: %s (table %q)\n", insp.Name, insp.Table)
+	fmt.Fprintf(w, "Mixins: %s\n", strings.Join(insp.Mixins, ", "))
+
+	fmt.Fprintln(w, "\nFields:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tJSON\tTYPE\tGO TYPE\tDETAILS")
+	for _, fi := range insp.Fields {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", fi.Name, fi.JSON, fi.Type, fi.GoType, fieldDetails(fi))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nMethods (last override first):")
+	for _, meth := range insp.Methods {
+		fmt.Fprintf(w, "  %s\n", meth.Name)
+		for i, layer := range meth.Layers {
+			if layer == "" {
+				layer = "<unknown>"
+			}
+			fmt.Fprintf(w, "    %d. %s\n", i+1, layer)
+		}
+	}
+
+	fmt.Fprintln(w, "\nViews:")
+	modelViews := views.Registry.GetAllViewsForModel(modelName)
+	sort.Sort(viewsByID(modelViews))
+	for _, view := range modelViews {
+		fmt.Fprintf(w, "  %s (%s, priority %d)\n", view.ID, view.Type, view.Priority)
+		for _, line := range strings.Split(strings.TrimSpace(view.Arch), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+
+	fmt.Fprintln(w, "\nActions:")
+	for _, action := range actions.Registry.GetActionsForModel(modelName) {
+		fmt.Fprintf(w, "  %s (%s) %q\n", action.ID, action.Type, action.Name)
+	}
+	for _, action := range actions.Registry.GetActionLinksForModel(modelName) {
+		fmt.Fprintf(w, "  %s (%s, linked) %q\n", action.ID, action.Type, action.Name)
+	}
+
+	fmt.Fprintln(w, "\nMenus:")
+	printModelMenus(w, menus.Registry, modelName, nil)
+}
+
+// fieldDetails returns the relation, computation and origin details of the
+// given field as a single line.
+func fieldDetails(fi models.FieldInspection) string {
+	var details []string
+	if fi.Relation != "" {
+		details = append(details, "-> "+fi.Relation)
+	}
+	if fi.Stored {
+		details = append(details, "stored")
+	}
+	if fi.Compute != "" {
+		details = append(details, "compute: "+fi.Compute)
+	}
+	if fi.Related != "" {
+		details = append(details, "related: "+fi.Related)
+	}
+	if len(fi.Depends) > 0 {
+		details = append(details, "depends: "+strings.Join(fi.Depends, ", "))
+	}
+	if len(fi.Recomputes) > 0 {
+		details = append(details, "recomputes: "+strings.Join(fi.Recomputes, ", "))
+	}
+	if len(fi.Mixins) > 0 {
+		details = append(details, "from: "+strings.Join(fi.Mixins, ", "))
+	}
+	return strings.Join(details, "; ")
+}
+
+// printModelMenus writes the path of the menus of the given collection and
+// their children whose action opens the given model.
+func printModelMenus(w io.Writer, collection *menus.Collection, modelName string, path []string) {
+	if collection == nil {
+		return
+	}
+	for _, menu := range collection.Menus {
+		menuPath := append(append([]string{}, path...), menu.Name)
+		if menu.Action != nil && menu.Action.Model == modelName {
+			fmt.Fprintf(w, "  %s (%s) -> %s\n", strings.Join(menuPath, " / "), menu.ID, menu.Action.ID)
+		}
+		printModelMenus(w, menu.Children, modelName, menuPath)
+	}
+}
+
+// viewsByID sorts views by id
+type viewsByID []*views.View
+
+func (v viewsByID) Len() int           { return len(v) }
+func (v viewsByID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v viewsByID) Less(i, j int) bool { return v[i].ID < v[j].ID }
+
+func initInspect() {
+	YEPCmd.AddCommand(inspectCmd)
+}
+
+var inspectTemplate = template.Must(template.New("").Parse(`
+// This file is autogenerated by yep-server
+// DO NOT MODIFY THIS FILE - ANY CHANGES WILL BE OVERWRITTEN
+
+package main
+
+import (
+	"github.com/npiganeau/yep/cmd"
+{{ range .Imports }}	_ "{{ . }}"
+{{ end }}
+)
+
+func main() {
+	cmd.Inspect({{ .Config }})
+}
+`))
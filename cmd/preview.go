@@ -0,0 +1,175 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/server"
+	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/views"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const previewFileName string = "preview.go"
+
+var previewCmd = &cobra.Command{
+	Use:   "preview VIEW [projectDir]",
+	Short: "Print the processed arch and an HTML rendering of a view",
+	Long: `Print the arch of the given view after inheritance and bootstrap, followed by a
+basic HTML rendering of the view for a record.
+
+VIEW is either the ID of a view of the project's modules or the path of an XML
+file defining views, which are loaded after those of the modules. In the latter
+case, the last view of the file is previewed, or the view it inherits from.
+
+The record is read from the database if its ID is given with --record.
+Otherwise, the view is rendered with generated sample data and the database
+is not accessed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Println("Please specify the view to preview")
+			os.Exit(1)
+		}
+		view := args[0]
+		if strings.HasSuffix(view, ".xml") {
+			absPath, err := filepath.Abs(view)
+			if err != nil {
+				fmt.Printf("Invalid view file: %s\n", view)
+				os.Exit(1)
+			}
+			viper.Set("Preview.File", absPath)
+		} else {
+			viper.Set("Preview.View", view)
+		}
+		projectDir := "."
+		if len(args) > 1 {
+			projectDir = args[1]
+		}
+		generateAndRunFile(projectDir, previewFileName, previewTemplate)
+	},
+}
+
+// Preview prints the processed arch and the HTML rendering of the view given
+// by the 'Preview.View' or 'Preview.File' configuration keys. It is meant to
+// be called from a project start file which imports all the project's module.
+func Preview(config map[string]interface{}) {
+	setupConfig(config)
+	models.BootStrap()
+	server.LoadInternalResources()
+	viewID := viper.GetString("Preview.View")
+	if file := viper.GetString("Preview.File"); file != "" {
+		viewID = loadPreviewFile(file)
+	}
+	views.BootStrap()
+	view := views.Registry.GetByID(viewID)
+	if view == nil {
+		fmt.Printf("Unknown view: %s\n", viewID)
+		os.Exit(1)
+	}
+	record := views.SampleRecord(view.Model)
+	if id := viper.GetInt64("Preview.Record"); id != 0 {
+		record = readPreviewRecord(view, id)
+	}
+	html := view.RenderHTML(record)
+	if output := viper.GetString("Preview.Output"); output != "" {
+		if err := ioutil.WriteFile(output, []byte(html), 0644); err != nil {
+			log.Panic("Unable to write HTML rendering", "file", output, "error", err)
+		}
+		html = ""
+	}
+	printViewPreview(os.Stdout, view, html)
+}
+
+// loadPreviewFile loads the views defined in the given XML file into the
+// views registry and returns the ID of the view to preview.
+func loadPreviewFile(fileName string) string {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(fileName); err != nil {
+		log.Panic("Error loading XML view file", "file", fileName, "error", err)
+	}
+	var viewID string
+	for _, elem := range doc.FindElements("//view") {
+		views.LoadFromEtree(elem)
+		viewID = elem.SelectAttrValue("id", elem.SelectAttrValue("inherit_id", ""))
+	}
+	if viewID == "" {
+		log.Panic("No view found in file", "file", fileName)
+	}
+	return viewID
+}
+
+// readPreviewRecord reads the values of the fields of the given view for the
+// record with the given id in the database.
+func readPreviewRecord(view *views.View, id int64) models.FieldMap {
+	connectToDB()
+	setupEncryption()
+	var res models.FieldMap
+	err := models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		rs := env.Pool(view.Model)
+		rs = rs.Search(rs.Model().Field("ID").Equals(id))
+		fields := make([]string, len(view.Fields))
+		for i, f := range view.Fields {
+			fields[i] = string(f)
+		}
+		records := rs.Call("Read", fields).([]models.FieldMap)
+		if len(records) == 0 {
+			log.Panic("Record not found", "model", view.Model, "id", id)
+		}
+		res = records[0]
+	})
+	if err != nil {
+		log.Panic("Unable to read record", "model", view.Model, "id", id, "error", err)
+	}
+	return res
+}
+
+// printViewPreview writes the processed arch of the given view and
+// the given HTML rendering, if not empty, to w.
+func printViewPreview(w io.Writer, view *views.View, html string) {
+	fmt.Fprintf(w, "View: %s (%s, model %s, priority %d)\n", view.ID, view.Type, view.Model, view.Priority)
+	fmt.Fprintln(w, "\nArch:")
+	for _, line := range strings.Split(strings.TrimSpace(view.Arch), "\n") {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+	if html == "" {
+		return
+	}
+	fmt.Fprintln(w, "\nHTML:")
+	fmt.Fprint(w, html)
+}
+
+func initPreview() {
+	previewCmd.Flags().Int64("record", 0, "ID of the record to render. Sample data is rendered if not set.")
+	viper.BindPFlag("Preview.Record", previewCmd.Flags().Lookup("record"))
+	previewCmd.Flags().String("output", "", "Write the HTML rendering to this file instead of the standard output")
+	viper.BindPFlag("Preview.Output", previewCmd.Flags().Lookup("output"))
+	YEPCmd.AddCommand(previewCmd)
+}
+
+var previewTemplate = template.Must(template.New("").Parse(`
+// This file is autogenerated by yep-server
+// DO NOT MODIFY THIS FILE - ANY CHANGES WILL BE OVERWRITTEN
+
+package main
+
+import (
+	"github.com/npiganeau/yep/cmd"
+{{ range .Imports }}	_ "{{ . }}"
+{{ end }}
+)
+
+func main() {
+	cmd.Preview({{ .Config }})
+}
+`))
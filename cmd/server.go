@@ -15,12 +15,18 @@
 package cmd
 
 import (
+	"encoding/base64"
 	"fmt"
 	"go/build"
+	"io/ioutil"
+	"net"
+	"net/smtp"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/npiganeau/yep/yep/actions"
@@ -29,7 +35,9 @@ import (
 	"github.com/npiganeau/yep/yep/models"
 	"github.com/npiganeau/yep/yep/server"
 	"github.com/npiganeau/yep/yep/tools/generate"
+	"github.com/npiganeau/yep/yep/tools/i18n"
 	"github.com/npiganeau/yep/yep/tools/logging"
+	"github.com/npiganeau/yep/yep/tools/taxid"
 	"github.com/npiganeau/yep/yep/views"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -80,8 +88,18 @@ func generateAndRunFile(projectDir, fileName string, tmpl *template.Template) {
 func StartServer(config map[string]interface{}) {
 	setupConfig(config)
 	connectToDB()
-	models.BootStrap()
+	setupAttachmentStore()
+	setupAntivirus()
+	setupEncryption()
+	setupSecurityAlerts()
+	setupTaxIDs()
+	setupMethodAccess()
+	setupSMS()
+	setupPush()
+	server.SetMaxConcurrentDownloads(viper.GetInt("MaxDownloads"))
 	server.LoadInternalResources()
+	checkRegistries()
+	models.BootStrap()
 	views.BootStrap()
 	actions.BootStrap()
 	controllers.BootStrap()
@@ -100,13 +118,267 @@ func setupConfig(config map[string]interface{}) {
 	}
 	if !viper.GetBool("Debug") {
 		gin.SetMode(gin.ReleaseMode)
+	} else {
+		// pseudo-localization to spot untranslated strings
+		i18n.Registry.EnablePseudoLanguage()
 	}
 	logging.Initialize()
 	log = logging.GetLogger("init")
 }
 
+// checkRegistries checks the declarations of the models, views and actions
+// registries and logs all the problems found. Unless the RegistryCheck
+// setting is 'warn', it panics with the consolidated report if there is any.
+func checkRegistries() {
+	var report models.RegistryReport
+	report.Extend(models.CheckRegistry())
+	report.Extend(views.CheckRegistry())
+	report.Extend(actions.CheckRegistry())
+	if len(report) == 0 {
+		return
+	}
+	for _, problem := range report {
+		log.Warn(problem.Message, "object", problem.Object)
+	}
+	switch viper.GetString("RegistryCheck") {
+	case "warn":
+		return
+	case "fail":
+	default:
+		log.Panic("Unknown registry check mode", "mode", viper.GetString("RegistryCheck"))
+	}
+	fmt.Fprintf(os.Stderr, "%d problems found in declarations:\n%s\n", len(report), report)
+	log.Panic("Inconsistent declarations in registries", "problems", len(report))
+}
+
+// setupAttachmentStore sets the attachment store of the current database
+// from the configuration. If a store to migrate from is configured, contents
+// that are not found in the configured store are read from it.
+func setupAttachmentStore() {
+	store := newAttachmentStore(viper.GetString("Attachments.Store"))
+	if from := viper.GetString("Attachments.MigrateFrom"); from != "" {
+		store = models.MigratingStore{
+			From: newAttachmentStore(from),
+			To:   store,
+		}
+	}
+	models.Attachments = store
+}
+
+// newAttachmentStore returns a new AttachmentStore of the given kind
+// for the current database, configured from the viper configuration.
+// setupAntivirus sets the scanner of uploaded files and the policy
+// applied to infected files from the configuration.
+func setupAntivirus() {
+	timeout := viper.GetDuration("Antivirus.Timeout")
+	switch viper.GetString("Antivirus.Scanner") {
+	case "":
+		return
+	case "clamd":
+		network := "tcp"
+		if path.IsAbs(viper.GetString("Antivirus.Address")) {
+			network = "unix"
+		}
+		models.Antivirus = models.ClamdScanner{
+			Network: network,
+			Address: viper.GetString("Antivirus.Address"),
+			Timeout: timeout,
+		}
+	case "icap":
+		models.Antivirus = models.ICAPScanner{
+			Address: viper.GetString("Antivirus.Address"),
+			Service: viper.GetString("Antivirus.ICAPService"),
+			Timeout: timeout,
+		}
+	default:
+		log.Panic("Unknown antivirus scanner", "scanner", viper.GetString("Antivirus.Scanner"))
+	}
+	switch viper.GetString("Antivirus.InfectedFiles") {
+	case "", "reject":
+		models.InfectedFiles = models.InfectedFilesReject
+	case "quarantine":
+		dataDir := viper.GetString("DataDir")
+		if dataDir == "" {
+			dataDir = path.Join(os.TempDir(), "yep")
+		}
+		models.InfectedFiles = models.InfectedFilesQuarantine
+		models.Quarantine = models.FileSystemStore{
+			Dir: path.Join(dataDir, "quarantine", viper.GetString("DB.Name")),
+		}
+	default:
+		log.Panic("Unknown infected files policy", "policy", viper.GetString("Antivirus.InfectedFiles"))
+	}
+}
+
+// setupEncryption sets the key used to encrypt the values of encrypted
+// fields from the configuration. The key is base64 encoded.
+func setupEncryption() {
+	encodedKey := viper.GetString("Encryption.Key")
+	if keyFile := viper.GetString("Encryption.KeyFile"); keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Panic("Unable to read encryption key file", "file", keyFile, "error", err)
+		}
+		encodedKey = strings.TrimSpace(string(data))
+	}
+	if encodedKey == "" {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		log.Panic("Encryption key is not base64 encoded", "error", err)
+	}
+	models.SetEncryptionKeyProvider(models.StaticKey(key))
+}
+
+// setupTaxIDs sets the online verifier of tax ids and
+// the policy applied to invalid tax ids from the configuration.
+func setupTaxIDs() {
+	switch viper.GetString("TaxID.Verifier") {
+	case "":
+	case "vies":
+		models.TaxIDVerifier = taxid.NewCache(taxid.VIES{
+			Timeout: viper.GetDuration("TaxID.Timeout"),
+		}, viper.GetDuration("TaxID.CacheDuration"))
+	default:
+		log.Panic("Unknown tax id verifier", "verifier", viper.GetString("TaxID.Verifier"))
+	}
+	switch viper.GetString("TaxID.Invalid") {
+	case "", "reject":
+		models.InvalidTaxIDs = models.InvalidTaxIDsReject
+	case "warn":
+		models.InvalidTaxIDs = models.InvalidTaxIDsWarn
+	default:
+		log.Panic("Unknown invalid tax ids policy", "policy", viper.GetString("TaxID.Invalid"))
+	}
+}
+
+// setupMethodAccess sets which method calls are checked against
+// execution permissions from the configuration.
+func setupMethodAccess() {
+	switch viper.GetString("MethodAccess") {
+	case "", "all":
+		models.MethodAccess = models.CheckAllMethodCalls
+	case "client":
+		models.MethodAccess = models.CheckClientMethodCalls
+	default:
+		log.Panic("Unknown method access policy", "policy", viper.GetString("MethodAccess"))
+	}
+}
+
+// setupSMS sets the gateway with which text messages are sent from the configuration
+func setupSMS() {
+	switch viper.GetString("SMS.Provider") {
+	case "":
+	case "twilio":
+		models.SMSGateway = models.TwilioSMS{
+			AccountSID:     viper.GetString("SMS.Account"),
+			AuthToken:      viper.GetString("SMS.Token"),
+			From:           viper.GetString("SMS.From"),
+			StatusCallback: viper.GetString("SMS.StatusURL"),
+			URL:            viper.GetString("SMS.URL"),
+			Timeout:        viper.GetDuration("SMS.Timeout"),
+		}
+	case "http":
+		if viper.GetString("SMS.URL") == "" {
+			log.Panic("The HTTP SMS provider requires a URL")
+		}
+		models.SMSGateway = models.HTTPSMS{
+			URL:     viper.GetString("SMS.URL"),
+			Token:   viper.GetString("SMS.Token"),
+			From:    viper.GetString("SMS.From"),
+			Timeout: viper.GetDuration("SMS.Timeout"),
+		}
+	default:
+		log.Panic("Unknown SMS provider", "provider", viper.GetString("SMS.Provider"))
+	}
+}
+
+// setupSecurityAlerts sets the alert rule on login failures and
+// the sender of security alerts from the configuration.
+func setupSecurityAlerts() {
+	failures := viper.GetInt("SecurityAlerts.Failures")
+	if failures <= 0 {
+		return
+	}
+	models.AddSecurityAlertRule(models.SecurityAlertRule{
+		Name:       "Repeated login failures",
+		EventType:  models.EventLoginFailure,
+		Threshold:  failures,
+		Period:     viper.GetDuration("SecurityAlerts.Period"),
+		Recipients: viper.GetStringSlice("SecurityAlerts.Recipients"),
+	})
+	address := viper.GetString("SMTP.Address")
+	sender := models.MailAlertSender{
+		Address: address,
+		From:    viper.GetString("SMTP.From"),
+	}
+	if user := viper.GetString("SMTP.User"); user != "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			log.Panic("Invalid SMTP server address", "address", address, "error", err)
+		}
+		sender.Auth = smtp.PlainAuth("", user, viper.GetString("SMTP.Password"), host)
+	}
+	models.SecurityAlerts = sender
+}
+
+func newAttachmentStore(kind string) models.AttachmentStore {
+	switch kind {
+	case "", "filesystem":
+		dataDir := viper.GetString("DataDir")
+		if dataDir == "" {
+			dataDir = path.Join(os.TempDir(), "yep")
+		}
+		return models.FileSystemStore{
+			Dir: path.Join(dataDir, "filestore", viper.GetString("DB.Name")),
+		}
+	case "s3":
+		prefix := viper.GetString("S3.Prefix")
+		if prefix == "" {
+			prefix = viper.GetString("DB.Name")
+		}
+		return models.S3Store{
+			Endpoint:  viper.GetString("S3.Endpoint"),
+			Region:    viper.GetString("S3.Region"),
+			Bucket:    viper.GetString("S3.Bucket"),
+			Prefix:    prefix,
+			AccessKey: viper.GetString("S3.AccessKey"),
+			SecretKey: viper.GetString("S3.SecretKey"),
+			SSE:       viper.GetString("S3.SSE"),
+		}
+	case "database":
+		return models.DBStore{}
+	}
+	log.Panic("Unknown attachment store", "store", kind)
+	return nil
+}
+
 // connectToDB creates the connection to the database
 func connectToDB() {
+	var connectString string
+	switch viper.GetString("DB.Driver") {
+	case "mysql":
+		connectString = mysqlConnectString()
+	case "sqlite3":
+		connectString = sqliteConnectString(viper.GetString("DB.Name"))
+	default:
+		connectString = postgresConnectString()
+	}
+	models.DBConnect(viper.GetString("DB.Driver"), connectString)
+	models.StatementTimeouts = map[models.RequestClass]time.Duration{
+		models.InteractiveRequest: viper.GetDuration("DB.Timeouts.Interactive"),
+		models.CronRequest:        viper.GetDuration("DB.Timeouts.Cron"),
+		models.ReportRequest:      viper.GetDuration("DB.Timeouts.Report"),
+	}
+	models.ClientQueryGuard = models.QueryGuard{
+		RejectUnbounded: viper.GetBool("DB.Guard.RejectUnbounded"),
+		MaxOffset:       viper.GetInt("DB.Guard.MaxOffset"),
+	}
+}
+
+// postgresConnectString returns the connection string to the PostgreSQL database
+func postgresConnectString() string {
 	connectString := fmt.Sprintf("dbname=%s sslmode=disable", viper.GetString("DB.Name"))
 	if viper.GetString("DB.User") != "" {
 		connectString += fmt.Sprintf(" user=%s", viper.GetString("DB.User"))
@@ -120,7 +392,36 @@ func connectToDB() {
 	if viper.GetString("DB.Port") != "5432" {
 		connectString += fmt.Sprintf(" port=%s", viper.GetString("DB.Port"))
 	}
-	models.DBConnect(viper.GetString("DB.Driver"), connectString)
+	return connectString
+}
+
+// mysqlConnectString returns the data source name of the MySQL database.
+// The default PostgreSQL port is replaced by the default MySQL port.
+func mysqlConnectString() string {
+	var credentials string
+	if viper.GetString("DB.User") != "" {
+		credentials = viper.GetString("DB.User")
+		if viper.GetString("DB.Password") != "" {
+			credentials += ":" + viper.GetString("DB.Password")
+		}
+		credentials += "@"
+	}
+	address := "unix(/var/run/mysqld/mysqld.sock)"
+	if viper.GetString("DB.Host") != "" {
+		port := viper.GetString("DB.Port")
+		if port == "5432" {
+			port = "3306"
+		}
+		address = fmt.Sprintf("tcp(%s:%s)", viper.GetString("DB.Host"), port)
+	}
+	return fmt.Sprintf("%s%s/%s?parseTime=true", credentials, address, viper.GetString("DB.Name"))
+}
+
+// sqliteConnectString returns the data source name of the SQLite database
+// stored in the given file. Foreign keys are enforced and write transactions
+// wait for each other instead of failing with a locked database error.
+func sqliteConnectString(fileName string) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000", fileName)
 }
 
 func initServer() {
@@ -143,3 +444,56 @@ func main() {
 	cmd.StartServer({{ .Config }})
 }
 `))
+
+// setupPush sets the providers with which notifications are pushed
+// to the devices of the users from the configuration. If any, chatter
+// and approval notifications are pushed to the devices.
+func setupPush() {
+	timeout := viper.GetDuration("Push.Timeout")
+	if file := viper.GetString("Push.FCMCredentials"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Panic("Unable to read FCM credentials", "file", file, "error", err)
+		}
+		fcm, err := models.NewFCMPush(data)
+		if err != nil {
+			log.Panic("Invalid FCM credentials", "file", file, "error", err)
+		}
+		fcm.Timeout = timeout
+		models.PushProviders[models.PushFCM] = fcm
+	}
+	if file := viper.GetString("Push.APNsKey"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Panic("Unable to read APNs signing key", "file", file, "error", err)
+		}
+		apns, err := models.NewAPNsPush(data, viper.GetString("Push.APNsKeyID"), viper.GetString("Push.APNsTeamID"),
+			viper.GetString("Push.APNsTopic"))
+		if err != nil {
+			log.Panic("Invalid APNs signing key", "file", file, "error", err)
+		}
+		if viper.GetBool("Push.APNsSandbox") {
+			apns.URL = models.APNsSandboxURL
+		}
+		apns.Timeout = timeout
+		models.PushProviders[models.PushAPNs] = apns
+	}
+	if file := viper.GetString("Push.VAPIDKey"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Panic("Unable to read VAPID key", "file", file, "error", err)
+		}
+		webPush, err := models.NewWebPush(data, viper.GetString("Push.VAPIDSubject"))
+		if err != nil {
+			log.Panic("Invalid VAPID key", "file", file, "error", err)
+		}
+		webPush.Timeout = timeout
+		models.PushProviders[models.PushWeb] = webPush
+	}
+	if len(models.PushProviders) == 0 {
+		return
+	}
+	notifier := models.PushNotifier{Chatter: models.ChatterNotifications, Approvals: models.ApprovalNotifications}
+	models.ChatterNotifications = notifier
+	models.ApprovalNotifications = notifier
+}
@@ -4,11 +4,13 @@
 package cmd
 
 import (
+	"fmt"
 	"text/template"
 
 	"github.com/npiganeau/yep/yep/models"
 	"github.com/npiganeau/yep/yep/server"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 const updateDBFileName string = "updatedb.go"
@@ -31,13 +33,23 @@ var updateDBCmd = &cobra.Command{
 func UpdateDB(config map[string]interface{}) {
 	setupConfig(config)
 	connectToDB()
+	checkRegistries()
 	models.BootStrap()
+	if viper.GetBool("UpdateDB.DryRun") {
+		for _, query := range models.PlanDatabaseSync() {
+			fmt.Println(query)
+		}
+		return
+	}
 	models.SyncDatabase()
+	setupEncryption()
 	server.LoadDataRecords()
 	log.Info("Database updated successfully")
 }
 
 func initUpdateDB() {
+	updateDBCmd.Flags().Bool("dry-run", false, "Print the statements that would be executed without modifying the database")
+	viper.BindPFlag("UpdateDB.DryRun", updateDBCmd.Flags().Lookup("dry-run"))
 	YEPCmd.AddCommand(updateDBCmd)
 }
 
@@ -15,6 +15,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -37,8 +39,102 @@ func init() {
 	viper.BindPFlag("LogFile", YEPCmd.PersistentFlags().Lookup("log-file"))
 	YEPCmd.PersistentFlags().BoolP("log-stdout", "o", false, "Enable stdout logging. Use for development or debugging.")
 	viper.BindPFlag("LogStdout", YEPCmd.PersistentFlags().Lookup("log-stdout"))
-	YEPCmd.PersistentFlags().Bool("debug", false, "Enable server debug mode for development")
+	YEPCmd.PersistentFlags().Bool("debug", false, "Enable server debug mode for development, including the pseudo-localization language")
 	viper.BindPFlag("Debug", YEPCmd.PersistentFlags().Lookup("debug"))
+	YEPCmd.PersistentFlags().String("data-dir", "", "Directory in which attachments are stored. Defaults to the system temporary directory")
+	viper.BindPFlag("DataDir", YEPCmd.PersistentFlags().Lookup("data-dir"))
+	YEPCmd.PersistentFlags().String("attachment-store", "filesystem", "Storage backend of attachments. Should be one of 'filesystem', 'database' or 's3'")
+	viper.BindPFlag("Attachments.Store", YEPCmd.PersistentFlags().Lookup("attachment-store"))
+	YEPCmd.PersistentFlags().String("attachment-migrate-from", "", "Storage backend from which attachments are being migrated. Attachments not found in attachment-store are read from it")
+	viper.BindPFlag("Attachments.MigrateFrom", YEPCmd.PersistentFlags().Lookup("attachment-migrate-from"))
+	YEPCmd.PersistentFlags().String("s3-endpoint", "https://s3.amazonaws.com", "URL of the S3 compatible object storage service")
+	viper.BindPFlag("S3.Endpoint", YEPCmd.PersistentFlags().Lookup("s3-endpoint"))
+	YEPCmd.PersistentFlags().String("s3-region", "us-east-1", "Region of the S3 bucket")
+	viper.BindPFlag("S3.Region", YEPCmd.PersistentFlags().Lookup("s3-region"))
+	YEPCmd.PersistentFlags().String("s3-bucket", "", "Name of the S3 bucket in which attachments are stored")
+	viper.BindPFlag("S3.Bucket", YEPCmd.PersistentFlags().Lookup("s3-bucket"))
+	YEPCmd.PersistentFlags().String("s3-prefix", "", "Prefix of the keys of attachments in the S3 bucket. Defaults to the database name")
+	viper.BindPFlag("S3.Prefix", YEPCmd.PersistentFlags().Lookup("s3-prefix"))
+	YEPCmd.PersistentFlags().String("s3-access-key", "", "Access key of the S3 bucket")
+	viper.BindPFlag("S3.AccessKey", YEPCmd.PersistentFlags().Lookup("s3-access-key"))
+	YEPCmd.PersistentFlags().String("s3-secret-key", "", "Secret key of the S3 bucket")
+	viper.BindPFlag("S3.SecretKey", YEPCmd.PersistentFlags().Lookup("s3-secret-key"))
+	YEPCmd.PersistentFlags().String("s3-sse", "", "Server side encryption of S3 objects ('AES256' or 'aws:kms'). Leave empty for no encryption")
+	viper.BindPFlag("S3.SSE", YEPCmd.PersistentFlags().Lookup("s3-sse"))
+	YEPCmd.PersistentFlags().String("antivirus", "", "Antivirus scanning uploaded files. Should be one of 'clamd' or 'icap'. Leave empty for no scanning")
+	viper.BindPFlag("Antivirus.Scanner", YEPCmd.PersistentFlags().Lookup("antivirus"))
+	YEPCmd.PersistentFlags().String("antivirus-address", "localhost:3310", "Address of the antivirus daemon. May be a unix socket path for clamd")
+	viper.BindPFlag("Antivirus.Address", YEPCmd.PersistentFlags().Lookup("antivirus-address"))
+	YEPCmd.PersistentFlags().String("antivirus-icap-service", "avscan", "Name of the ICAP antivirus service")
+	viper.BindPFlag("Antivirus.ICAPService", YEPCmd.PersistentFlags().Lookup("antivirus-icap-service"))
+	YEPCmd.PersistentFlags().Duration("antivirus-timeout", time.Minute, "Maximum duration of the scan of a file")
+	viper.BindPFlag("Antivirus.Timeout", YEPCmd.PersistentFlags().Lookup("antivirus-timeout"))
+	YEPCmd.PersistentFlags().String("infected-files", "reject", "Policy for infected files. Should be one of 'reject' or 'quarantine'")
+	viper.BindPFlag("Antivirus.InfectedFiles", YEPCmd.PersistentFlags().Lookup("infected-files"))
+	YEPCmd.PersistentFlags().String("method-access", "all", "Method calls checked against execution permissions. Should be one of 'all' or 'client' for the methods called directly by clients only")
+	viper.BindPFlag("MethodAccess", YEPCmd.PersistentFlags().Lookup("method-access"))
+	YEPCmd.PersistentFlags().String("tax-id-verifier", "", "Online verifier of tax ids. Should be 'vies' or empty for checksum validation only")
+	viper.BindPFlag("TaxID.Verifier", YEPCmd.PersistentFlags().Lookup("tax-id-verifier"))
+	YEPCmd.PersistentFlags().Duration("tax-id-timeout", 10*time.Second, "Maximum duration of the online verification of a tax id")
+	viper.BindPFlag("TaxID.Timeout", YEPCmd.PersistentFlags().Lookup("tax-id-timeout"))
+	YEPCmd.PersistentFlags().Duration("tax-id-cache-duration", 24*time.Hour, "Duration during which the results of online tax id verifications are kept")
+	viper.BindPFlag("TaxID.CacheDuration", YEPCmd.PersistentFlags().Lookup("tax-id-cache-duration"))
+	YEPCmd.PersistentFlags().String("invalid-tax-ids", "reject", "Policy for invalid tax ids. Should be one of 'reject' or 'warn'")
+	viper.BindPFlag("TaxID.Invalid", YEPCmd.PersistentFlags().Lookup("invalid-tax-ids"))
+	YEPCmd.PersistentFlags().String("sms-provider", "", "Provider of the SMS gateway. Should be one of 'twilio', 'http' or empty for no text messages")
+	viper.BindPFlag("SMS.Provider", YEPCmd.PersistentFlags().Lookup("sms-provider"))
+	YEPCmd.PersistentFlags().String("sms-url", "", "Endpoint of the SMS gateway. Defaults to the Twilio API for the twilio provider")
+	viper.BindPFlag("SMS.URL", YEPCmd.PersistentFlags().Lookup("sms-url"))
+	YEPCmd.PersistentFlags().String("sms-account", "", "Account SID of the Twilio SMS provider")
+	viper.BindPFlag("SMS.Account", YEPCmd.PersistentFlags().Lookup("sms-account"))
+	YEPCmd.PersistentFlags().String("sms-token", "", "Auth token of the Twilio SMS provider or bearer token of the HTTP SMS provider")
+	viper.BindPFlag("SMS.Token", YEPCmd.PersistentFlags().Lookup("sms-token"))
+	YEPCmd.PersistentFlags().String("sms-from", "", "Phone number or name of the sender of text messages")
+	viper.BindPFlag("SMS.From", YEPCmd.PersistentFlags().Lookup("sms-from"))
+	YEPCmd.PersistentFlags().String("sms-status-url", "", "Public URL of the /sms/status endpoint to which Twilio reports delivery statuses")
+	viper.BindPFlag("SMS.StatusURL", YEPCmd.PersistentFlags().Lookup("sms-status-url"))
+	YEPCmd.PersistentFlags().Duration("sms-timeout", 10*time.Second, "Maximum duration of the requests to the SMS gateway")
+	viper.BindPFlag("SMS.Timeout", YEPCmd.PersistentFlags().Lookup("sms-timeout"))
+	YEPCmd.PersistentFlags().String("push-fcm-credentials", "", "Service account JSON file of the Firebase project with which notifications are pushed to Android devices")
+	viper.BindPFlag("Push.FCMCredentials", YEPCmd.PersistentFlags().Lookup("push-fcm-credentials"))
+	YEPCmd.PersistentFlags().String("push-apns-key", "", "Signing key file (.p8) with which notifications are pushed to Apple devices")
+	viper.BindPFlag("Push.APNsKey", YEPCmd.PersistentFlags().Lookup("push-apns-key"))
+	YEPCmd.PersistentFlags().String("push-apns-key-id", "", "Id of the APNs signing key")
+	viper.BindPFlag("Push.APNsKeyID", YEPCmd.PersistentFlags().Lookup("push-apns-key-id"))
+	YEPCmd.PersistentFlags().String("push-apns-team-id", "", "Id of the Apple developer team of the APNs signing key")
+	viper.BindPFlag("Push.APNsTeamID", YEPCmd.PersistentFlags().Lookup("push-apns-team-id"))
+	YEPCmd.PersistentFlags().String("push-apns-topic", "", "Bundle id of the application receiving APNs notifications")
+	viper.BindPFlag("Push.APNsTopic", YEPCmd.PersistentFlags().Lookup("push-apns-topic"))
+	YEPCmd.PersistentFlags().Bool("push-apns-sandbox", false, "Push APNs notifications through the development environment")
+	viper.BindPFlag("Push.APNsSandbox", YEPCmd.PersistentFlags().Lookup("push-apns-sandbox"))
+	YEPCmd.PersistentFlags().String("push-vapid-key", "", "PEM file of the ECDSA P-256 key (VAPID key) with which notifications are pushed to browsers")
+	viper.BindPFlag("Push.VAPIDKey", YEPCmd.PersistentFlags().Lookup("push-vapid-key"))
+	YEPCmd.PersistentFlags().String("push-vapid-subject", "", "Contact given to web push services, e.g. 'mailto:admin@example.com'")
+	viper.BindPFlag("Push.VAPIDSubject", YEPCmd.PersistentFlags().Lookup("push-vapid-subject"))
+	YEPCmd.PersistentFlags().Duration("push-timeout", 10*time.Second, "Maximum duration of the requests to push services")
+	viper.BindPFlag("Push.Timeout", YEPCmd.PersistentFlags().Lookup("push-timeout"))
+	YEPCmd.PersistentFlags().String("encryption-key", "", "Base64 encoded AES key (16, 24 or 32 bytes) used to encrypt the values of encrypted fields")
+	viper.BindPFlag("Encryption.Key", YEPCmd.PersistentFlags().Lookup("encryption-key"))
+	YEPCmd.PersistentFlags().String("encryption-key-file", "", "File holding the base64 encoded encryption key. Takes precedence over encryption-key")
+	viper.BindPFlag("Encryption.KeyFile", YEPCmd.PersistentFlags().Lookup("encryption-key-file"))
+	YEPCmd.PersistentFlags().Int("security-alert-failures", 0, "Number of login failures of a user within security-alert-period that raises an alert. Set to 0 for no alert")
+	viper.BindPFlag("SecurityAlerts.Failures", YEPCmd.PersistentFlags().Lookup("security-alert-failures"))
+	YEPCmd.PersistentFlags().Duration("security-alert-period", 15*time.Minute, "Period within which login failures are counted for security alerts")
+	viper.BindPFlag("SecurityAlerts.Period", YEPCmd.PersistentFlags().Lookup("security-alert-period"))
+	YEPCmd.PersistentFlags().StringSlice("security-alert-recipients", []string{}, "Email addresses to which security alerts are sent")
+	viper.BindPFlag("SecurityAlerts.Recipients", YEPCmd.PersistentFlags().Lookup("security-alert-recipients"))
+	YEPCmd.PersistentFlags().String("smtp-address", "localhost:25", "Address of the SMTP server used to send emails")
+	viper.BindPFlag("SMTP.Address", YEPCmd.PersistentFlags().Lookup("smtp-address"))
+	YEPCmd.PersistentFlags().String("smtp-from", "", "Sender address of the emails sent by the server")
+	viper.BindPFlag("SMTP.From", YEPCmd.PersistentFlags().Lookup("smtp-from"))
+	YEPCmd.PersistentFlags().String("smtp-user", "", "User name for the SMTP server authentication. Leave empty for no authentication")
+	viper.BindPFlag("SMTP.User", YEPCmd.PersistentFlags().Lookup("smtp-user"))
+	YEPCmd.PersistentFlags().String("smtp-password", "", "Password for the SMTP server authentication")
+	viper.BindPFlag("SMTP.Password", YEPCmd.PersistentFlags().Lookup("smtp-password"))
+	YEPCmd.PersistentFlags().Int("max-downloads", 4, "Maximum number of reports or exports generated concurrently. Set to 0 for no limit")
+	viper.BindPFlag("MaxDownloads", YEPCmd.PersistentFlags().Lookup("max-downloads"))
+	YEPCmd.PersistentFlags().String("registry-check", "fail", "Behaviour when inconsistent declarations are found at startup. Should be one of 'fail' or 'warn'")
+	viper.BindPFlag("RegistryCheck", YEPCmd.PersistentFlags().Lookup("registry-check"))
 
 	YEPCmd.PersistentFlags().String("db-driver", "postgres", "Database driver to use")
 	viper.BindPFlag("DB.Driver", YEPCmd.PersistentFlags().Lookup("db-driver"))
@@ -52,9 +148,23 @@ func init() {
 	viper.BindPFlag("DB.Password", YEPCmd.PersistentFlags().Lookup("db-password"))
 	YEPCmd.PersistentFlags().String("db-name", "yep", "Database name. Defaults to 'yep'")
 	viper.BindPFlag("DB.Name", YEPCmd.PersistentFlags().Lookup("db-name"))
+	YEPCmd.PersistentFlags().Duration("db-timeout-interactive", 0, "Maximum duration of SQL statements of client requests. Set to 0 for no limit")
+	viper.BindPFlag("DB.Timeouts.Interactive", YEPCmd.PersistentFlags().Lookup("db-timeout-interactive"))
+	YEPCmd.PersistentFlags().Duration("db-timeout-cron", 0, "Maximum duration of SQL statements of scheduled jobs. Set to 0 for no limit")
+	viper.BindPFlag("DB.Timeouts.Cron", YEPCmd.PersistentFlags().Lookup("db-timeout-cron"))
+	YEPCmd.PersistentFlags().Duration("db-timeout-report", 0, "Maximum duration of SQL statements of reports and exports. Set to 0 for no limit")
+	viper.BindPFlag("DB.Timeouts.Report", YEPCmd.PersistentFlags().Lookup("db-timeout-report"))
+	YEPCmd.PersistentFlags().Bool("db-reject-unbounded", false, "Reject queries of client requests on whole tables without limit")
+	viper.BindPFlag("DB.Guard.RejectUnbounded", YEPCmd.PersistentFlags().Lookup("db-reject-unbounded"))
+	YEPCmd.PersistentFlags().Int("db-max-offset", 0, "Maximum offset of queries of client requests. Set to 0 for no limit")
+	viper.BindPFlag("DB.Guard.MaxOffset", YEPCmd.PersistentFlags().Lookup("db-max-offset"))
 
 	initVersion()
 	initGenerate()
 	initServer()
 	initUpdateDB()
+	initMigrateAttachments()
+	initInspect()
+	initExplain()
+	initPreview()
 }
@@ -20,10 +20,14 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/models/types"
 	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/tools/i18n"
 	"github.com/npiganeau/yep/yep/tools/xmlutils"
 	"github.com/npiganeau/yep/yep/views"
 )
@@ -33,10 +37,50 @@ type ActionType string
 
 // Action types
 const (
-	ActionActWindow ActionType = "ir.actions.act_window"
-	ActionServer    ActionType = "ir.actions.server"
+	ActionActWindow   ActionType = "ir.actions.act_window"
+	ActionCloseWindow ActionType = "ir.actions.act_window_close"
+	ActionServer      ActionType = "ir.actions.server"
+	ActionClient      ActionType = "ir.actions.client"
 )
 
+// Client action tags
+const (
+	// TagReload makes the client reload the current view
+	TagReload = "reload"
+)
+
+// An ActionTarget defines where the views of a window action are opened
+type ActionTarget string
+
+// Action targets
+const (
+	// TargetCurrent opens the action in the main content area
+	TargetCurrent ActionTarget = "current"
+	// TargetNew opens the action in a modal dialog,
+	// without adding it to the breadcrumbs.
+	TargetNew ActionTarget = "new"
+	// TargetInline opens the action in the main content area
+	// in edit mode, without adding it to the breadcrumbs.
+	TargetInline ActionTarget = "inline"
+)
+
+// An ActionSize is a hint for the client about the size of the
+// dialog in which an action with target "new" is opened.
+type ActionSize string
+
+// Action sizes
+const (
+	SizeSmall  ActionSize = "small"
+	SizeMedium ActionSize = "medium"
+	SizeLarge  ActionSize = "large"
+)
+
+// dialogViewTypes are the view types that can be opened in a dialog
+var dialogViewTypes = map[views.ViewType]bool{
+	views.VIEW_TYPE_FORM:   true,
+	views.VIEW_TYPE_SEARCH: true,
+}
+
 // ActionViewType defines the type of view of an action
 type ActionViewType string
 
@@ -131,6 +175,28 @@ func (ar *Collection) GetActionLinksForModel(modelName string) []*BaseAction {
 	return ar.links[modelName]
 }
 
+// GetActionsForModel returns the list of actions that open
+// or call the model with the given name, sorted by id
+func (ar *Collection) GetActionsForModel(modelName string) []*BaseAction {
+	ar.RLock()
+	defer ar.RUnlock()
+	var res []*BaseAction
+	for _, a := range ar.actions {
+		if a.Model == modelName {
+			res = append(res, a)
+		}
+	}
+	sort.Sort(actionsByID(res))
+	return res
+}
+
+// actionsByID sorts actions by id
+type actionsByID []*BaseAction
+
+func (a actionsByID) Len() int           { return len(a) }
+func (a actionsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a actionsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
 // A BaseAction is the definition of an action. Actions define the
 // behavior of the system in response to user requests.
 type BaseAction struct {
@@ -153,7 +219,10 @@ type BaseAction struct {
 	ActViewType  ActionViewType    `json:"-" xml:"-"`
 	ViewMode     string            `json:"view_mode" xml:"view_mode,attr"`
 	Multi        bool              `json:"multi" xml:"multi,attr"`
-	Target       string            `json:"target" xml:"target,attr"`
+	Target       ActionTarget      `json:"target" xml:"target,attr"`
+	Tag          string            `json:"tag,omitempty" xml:"tag,attr"`
+	Size         ActionSize        `json:"size,omitempty" xml:"size,attr"`
+	Next         *BaseAction       `json:"next,omitempty" xml:"-"`
 	AutoSearch   bool              `json:"auto_search" xml:"auto_search,attr"`
 	Filter       bool              `json:"filter" xml:"filter,attr"`
 	Limit        int64             `json:"limit" xml:"limit,attr"`
@@ -161,6 +230,103 @@ type BaseAction struct {
 	//Flags interface{}`json:"flags"`
 }
 
+// Translated returns a copy of this action whose name and help
+// are translated in the given language through the i18n registry.
+func (a *BaseAction) Translated(lang string) *BaseAction {
+	res := *a
+	res.Name = i18n.Registry.Translate(lang, a.Name)
+	res.Help = i18n.Registry.Translate(lang, a.Help)
+	return &res
+}
+
+// ForClient returns a copy of this action whose views are the views
+// served to the given client. Views the user is not allowed to see are
+// replaced by the next view of the same type by priority, and mobile
+// clients get the mobile variant of each view if there is one.
+func (a *BaseAction) ForClient(client views.Client) *BaseAction {
+	res := *a
+	res.Views = make([]views.ViewTuple, 0, len(a.Views))
+	for _, vt := range a.Views {
+		view := views.Registry.GetByIDForClient(vt.ID, client)
+		if view == nil {
+			continue
+		}
+		res.Views = append(res.Views, views.ViewTuple{ID: view.ID, Type: view.Type})
+	}
+	res.View = viewRefForClient(a.View, client)
+	res.SearchView = viewRefForClient(a.SearchView, client)
+	return &res
+}
+
+// viewRefForClient returns the reference to the view served to the given
+// client instead of the view of the given reference.
+func viewRefForClient(ref views.ViewRef, client views.Client) views.ViewRef {
+	if ref[0] == "" {
+		return ref
+	}
+	view := views.Registry.GetByIDForClient(ref[0], client)
+	if view == nil {
+		return views.ViewRef{}
+	}
+	return views.MakeViewRef(view.ID)
+}
+
+// CloseDialog returns an action that closes the current dialog. If next is
+// not nil, the client opens it once the dialog is closed, e.g. a wizard that
+// returns the window action of the records it created.
+func CloseDialog(next *BaseAction) *BaseAction {
+	return &BaseAction{
+		Type: ActionCloseWindow,
+		Next: next,
+	}
+}
+
+// Reload returns a client action that reloads the current view,
+// e.g. after a wizard modified the records it was opened on.
+func Reload() *BaseAction {
+	return &BaseAction{
+		Type: ActionClient,
+		Tag:  TagReload,
+	}
+}
+
+// OpenRecords returns a window action that opens the records of the
+// given model with the given ids. A single record is opened in a form
+// view, several records in a list view.
+func OpenRecords(model string, ids []int64) *BaseAction {
+	action := BaseAction{
+		Type:     ActionActWindow,
+		Model:    model,
+		Target:   TargetCurrent,
+		ViewMode: "tree,form",
+	}
+	if len(ids) == 1 {
+		action.ResID = ids[0]
+		action.ViewMode = "form"
+		return &action
+	}
+	idsStr := make([]string, len(ids))
+	for i, id := range ids {
+		idsStr[i] = fmt.Sprintf("%d", id)
+	}
+	action.Domain = fmt.Sprintf("[('id', 'in', [%s])]", strings.Join(idsStr, ", "))
+	return &action
+}
+
+// SecurityDashboard returns a window action that opens the security
+// events, such as logins and impersonations, for administrators.
+func SecurityDashboard() *BaseAction {
+	return &BaseAction{
+		Type:     ActionActWindow,
+		Name:     "Security Events",
+		Model:    "SecurityEvent",
+		Target:   TargetCurrent,
+		ViewMode: "tree,form",
+		Groups:   []string{security.GroupAdminID},
+		Limit:    80,
+	}
+}
+
 // LoadFromEtree reads the action given etree.Element, creates or updates the action
 // and adds it to the action registry if it not already.
 func LoadFromEtree(element *etree.Element) {
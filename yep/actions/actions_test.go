@@ -17,7 +17,10 @@ package actions
 import (
 	"testing"
 
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/i18n"
 	"github.com/npiganeau/yep/yep/tools/xmlutils"
+	"github.com/npiganeau/yep/yep/views"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -25,6 +28,16 @@ var actionDef1 string = `
 <action id="my_action" name="My Action" type="form" model="Partner" view_mode="tree,form"/>
 `
 
+var actionDef2 string = `
+<action id="my_smart_action" name="Partner Invoices" type="ir.actions.act_window" model="Invoice"
+	view_mode="tree,form" domain="[('partner_id', '=', active_id), ('partner_id', 'in', active_ids), ('origin', '=', 'active_id')]"/>
+`
+
+var actionDef3 string = `
+<action id="my_wizard_action" name="My Wizard" type="ir.actions.act_window" model="Wizard"
+	view_mode="form" target="new" size="large"/>
+`
+
 func TestActions(t *testing.T) {
 	Convey("Creating Action 1", t, func() {
 		LoadFromEtree(xmlutils.XMLToElement(actionDef1))
@@ -36,4 +49,88 @@ func TestActions(t *testing.T) {
 		So(action.Model, ShouldEqual, "Partner")
 		So(action.ViewMode, ShouldEqual, "tree,form")
 	})
+	Convey("Opening an action from records", t, func() {
+		LoadFromEtree(xmlutils.XMLToElement(actionDef2))
+		action := Registry.GetById("my_smart_action")
+		resolved := action.WithActiveRecords("Partner", []int64{3, 5})
+		So(resolved.Domain, ShouldEqual, "[('partner_id', '=', 3), ('partner_id', 'in', [3, 5]), ('origin', '=', 'active_id')]")
+		So(resolved.Context.Get(ActiveIDKey), ShouldEqual, int64(3))
+		So(resolved.Context.Get(ActiveIDsKey), ShouldResemble, []int64{3, 5})
+		So(resolved.Context.Get(ActiveModelKey), ShouldEqual, "Partner")
+		So(action.Domain, ShouldContainSubstring, "active_id")
+		So(action.WithActiveRecords("Partner", nil).Domain, ShouldStartWith, "[('partner_id', '=', False)")
+	})
+	Convey("Translating actions", t, func() {
+		action := Registry.GetById("my_action")
+		i18n.Registry.Add("fr_FR", "My Action", "Mon action")
+		So(action.Translated("fr_FR").Name, ShouldEqual, "Mon action")
+		So(action.Translated("de_DE").Name, ShouldEqual, "My Action")
+		So(action.Name, ShouldEqual, "My Action")
+	})
+	Convey("Dialog actions", t, func() {
+		LoadFromEtree(xmlutils.XMLToElement(actionDef3))
+		action := Registry.GetById("my_wizard_action")
+		So(action.Target, ShouldEqual, TargetNew)
+		So(action.Size, ShouldEqual, SizeLarge)
+		So(func() { checkWindowActionTarget(action) }, ShouldNotPanic)
+		So(func() { checkWindowActionTarget(&BaseAction{Target: "popup"}) }, ShouldPanic)
+		So(func() { checkWindowActionTarget(&BaseAction{Target: TargetCurrent, Size: SizeSmall}) }, ShouldPanic)
+		closeAction := CloseDialog(Registry.GetById("my_action"))
+		So(closeAction.Type, ShouldEqual, ActionCloseWindow)
+		So(closeAction.Next.ID, ShouldEqual, "my_action")
+	})
+	Convey("Wizard result actions", t, func() {
+		So(Reload().Type, ShouldEqual, ActionClient)
+		So(Reload().Tag, ShouldEqual, TagReload)
+		single := OpenRecords("Partner", []int64{4})
+		So(single.ViewMode, ShouldEqual, "form")
+		So(single.ResID, ShouldEqual, 4)
+		multi := OpenRecords("Partner", []int64{4, 7})
+		So(multi.ViewMode, ShouldEqual, "tree,form")
+		So(multi.Domain, ShouldEqual, "[('id', 'in', [4, 7])]")
+		So(CloseDialog(Reload()).Next.Tag, ShouldEqual, TagReload)
+	})
+	Convey("Serving actions to clients", t, func() {
+		managers := security.Registry.NewGroup("customer_managers", "Customer Managers")
+		security.Registry.AddMembership(2, managers)
+		views.Registry.Add(&views.View{ID: "customer_form", Model: "Customer", Type: views.VIEW_TYPE_FORM, Priority: 16})
+		views.Registry.Add(&views.View{ID: "customer_tree", Model: "Customer", Type: views.VIEW_TYPE_TREE, Priority: 16})
+		views.Registry.Add(&views.View{ID: "customer_form_mobile", Model: "Customer", Type: views.VIEW_TYPE_FORM,
+			Priority: 12, Mobile: true})
+		views.Registry.Add(&views.View{ID: "customer_form_manager", Model: "Customer", Type: views.VIEW_TYPE_FORM,
+			Priority: 8, Groups: []*security.Group{managers}})
+		action := &BaseAction{
+			Type:  ActionActWindow,
+			Model: "Customer",
+			Views: []views.ViewTuple{
+				{ID: "customer_form_manager", Type: views.VIEW_TYPE_FORM},
+				{ID: "customer_tree", Type: views.VIEW_TYPE_TREE},
+				{ID: "unknown_view", Type: views.VIEW_TYPE_GRAPH},
+			},
+			View: views.ViewRef{"customer_form_manager", "Manager Form"},
+		}
+		manager := action.ForClient(views.Client{UID: 2})
+		So(manager.Views, ShouldResemble, []views.ViewTuple{
+			{ID: "customer_form_manager", Type: views.VIEW_TYPE_FORM},
+			{ID: "customer_tree", Type: views.VIEW_TYPE_TREE},
+		})
+		So(manager.View[0], ShouldEqual, "customer_form_manager")
+		So(manager.SearchView, ShouldResemble, views.ViewRef{})
+		user := action.ForClient(views.Client{UID: 3})
+		So(user.Views[0].ID, ShouldEqual, "customer_form")
+		So(user.View[0], ShouldEqual, "customer_form")
+		mobile := action.ForClient(views.Client{UID: 3, Mobile: true})
+		So(mobile.Views[0].ID, ShouldEqual, "customer_form_mobile")
+		So(mobile.Views[1].ID, ShouldEqual, "customer_tree")
+		So(mobile.View[0], ShouldEqual, "customer_form_mobile")
+		So(action.Views[0].ID, ShouldEqual, "customer_form_manager")
+	})
+	Convey("Checking actions registry", t, func() {
+		report := CheckRegistry().String()
+		// Test models and views are not declared in this package
+		So(report, ShouldContainSubstring, "action my_smart_action: unknown model 'Invoice'")
+		So(report, ShouldContainSubstring, "action my_smart_action: no tree view for model 'Invoice'")
+		So(report, ShouldContainSubstring, "action my_wizard_action: no form view for model 'Wizard'")
+		So(report, ShouldNotContainSubstring, "action my_action:")
+	})
 }
@@ -0,0 +1,69 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package actions
+
+import (
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/tools/xmlutils"
+	"github.com/npiganeau/yep/yep/views"
+)
+
+// CheckRegistry checks all the window actions of the Registry and returns
+// a report of the problems found: actions on unknown models, references to
+// unknown views and view modes for which the model has no view.
+//
+// CheckRegistry can be called before views.BootStrap and BootStrap.
+func CheckRegistry() models.RegistryReport {
+	var report models.RegistryReport
+	for _, a := range Registry.actions {
+		if a.Type != ActionActWindow {
+			continue
+		}
+		object := "action " + a.ID
+		if _, ok := models.Registry.Get(a.Model); !ok {
+			report.Add(object, "unknown model '%s'", a.Model)
+		}
+		viewTypes := make(map[views.ViewType]bool)
+		for _, viewID := range []string{a.View[0], a.SearchView[0]} {
+			if viewID != "" && views.Registry.GetByID(viewID) == nil {
+				report.Add(object, "unknown view '%s'", viewID)
+			}
+		}
+		if view := views.Registry.GetByID(a.View[0]); view != nil {
+			viewTypes[viewType(view)] = true
+		}
+		for _, vt := range a.Views {
+			if vt.ID == "" {
+				continue
+			}
+			if views.Registry.GetByID(vt.ID) == nil {
+				report.Add(object, "unknown view '%s'", vt.ID)
+			}
+			viewTypes[vt.Type] = true
+		}
+		for _, view := range views.Registry.GetAllViewsForModel(a.Model) {
+			if !view.Mobile {
+				viewTypes[viewType(view)] = true
+			}
+		}
+		for _, mode := range strings.Split(a.ViewMode, ",") {
+			mode = strings.TrimSpace(mode)
+			if mode != "" && !viewTypes[views.ViewType(mode)] {
+				report.Add(object, "no %s view for model '%s'", mode, a.Model)
+			}
+		}
+	}
+	return report
+}
+
+// viewType returns the type of the given view, reading it
+// from its arch if the views have not been bootstrapped yet.
+func viewType(view *views.View) views.ViewType {
+	if view.Type != "" {
+		return view.Type
+	}
+	return views.ViewType(xmlutils.XMLToElement(view.Arch).Tag)
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package actions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// Context keys set on actions opened from records
+const (
+	ActiveIDKey    = "active_id"
+	ActiveIDsKey   = "active_ids"
+	ActiveModelKey = "active_model"
+)
+
+// activeVarsRegexp matches the active_xxx variables of a domain
+// string as well as quoted strings so that they can be skipped.
+var activeVarsRegexp = regexp.MustCompile(`'[^']*'|"[^"]*"|\bactive_(ids|id|model)\b`)
+
+// WithActiveRecords returns a copy of this action opened from the records with
+// the given activeIDs of activeModel, as when clicking on a smart button.
+//
+// The active_id, active_ids and active_model variables of the domain of the
+// returned action are replaced by their values and the corresponding keys
+// are added to its context.
+func (a *BaseAction) WithActiveRecords(activeModel string, activeIDs []int64) *BaseAction {
+	res := *a
+	var activeID interface{}
+	if len(activeIDs) > 0 {
+		activeID = activeIDs[0]
+	}
+	ctx := types.NewContext()
+	if a.Context != nil {
+		ctx = a.Context.Copy()
+	}
+	res.Context = ctx.WithKey(ActiveIDKey, activeID).
+		WithKey(ActiveIDsKey, activeIDs).
+		WithKey(ActiveModelKey, activeModel)
+	res.Domain = activeVarsRegexp.ReplaceAllStringFunc(a.Domain, func(match string) string {
+		switch match {
+		case ActiveIDKey:
+			if activeID == nil {
+				return "False"
+			}
+			return fmt.Sprintf("%d", activeID)
+		case ActiveIDsKey:
+			ids := make([]string, len(activeIDs))
+			for i, id := range activeIDs {
+				ids[i] = fmt.Sprintf("%d", id)
+			}
+			return fmt.Sprintf("[%s]", strings.Join(ids, ", "))
+		case ActiveModelKey:
+			return fmt.Sprintf("'%s'", activeModel)
+		}
+		// Quoted string
+		return match
+	})
+	return &res
+}
@@ -5,6 +5,7 @@ package actions
 
 import (
 	"strings"
+	"time"
 
 	"github.com/npiganeau/yep/yep/tools/logging"
 	"github.com/npiganeau/yep/yep/views"
@@ -15,12 +16,14 @@ var log *logging.Logger
 // BootStrap actions.
 // This function must be called prior to any access to the actions Registry.
 func BootStrap() {
+	start := time.Now()
 	for _, a := range Registry.actions {
 		switch a.Type {
 		case ActionActWindow:
 			bootStrapWindowAction(a)
 		}
 	}
+	log.Debug("Actions bootstrapped", "actions", len(Registry.actions), "duration", time.Since(start))
 }
 
 // bootStrapWindowAction makes the necessary updates to action definitions. In particular:
@@ -30,8 +33,9 @@ func BootStrap() {
 func bootStrapWindowAction(a *BaseAction) {
 	// Set a few default values
 	if a.Target == "" {
-		a.Target = "current"
+		a.Target = TargetCurrent
 	}
+	checkWindowActionTarget(a)
 	a.AutoSearch = !a.ManualSearch
 	if a.ActViewType == "" {
 		a.ActViewType = ActionViewTypeForm
@@ -72,6 +76,8 @@ modeLoop:
 			}
 		}
 		// No view defined for mode, we need to find it.
+		// This is the default view: it is resolved for each client
+		// with ForClient when the action is served.
 		view := views.Registry.GetFirstViewForModel(a.Model, views.ViewType(mode))
 		newRef := views.ViewTuple{
 			ID:   view.ID,
@@ -82,6 +88,33 @@ modeLoop:
 
 	// Fixes
 	fixViewModes(a)
+
+	// Dialogs can only display some view types
+	if a.Target == TargetNew {
+		for _, view := range a.Views {
+			if !dialogViewTypes[view.Type] {
+				log.Panic("View type cannot be opened in a dialog", "action", a.ID, "view", view.ID, "type", view.Type)
+			}
+		}
+	}
+}
+
+// checkWindowActionTarget checks that the target and size of the given
+// window action are valid. It panics otherwise.
+func checkWindowActionTarget(a *BaseAction) {
+	switch a.Target {
+	case TargetCurrent, TargetNew, TargetInline:
+	default:
+		log.Panic("Unknown action target", "action", a.ID, "target", a.Target)
+	}
+	switch a.Size {
+	case "", SizeSmall, SizeMedium, SizeLarge:
+	default:
+		log.Panic("Unknown action size", "action", a.ID, "size", a.Size)
+	}
+	if a.Size != "" && a.Target != TargetNew {
+		log.Panic("Size can only be set on actions with target 'new'", "action", a.ID, "target", a.Target)
+	}
 }
 
 //For OpenERP historical reasons, tree views are called 'list' when
@@ -0,0 +1,42 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/npiganeau/yep/yep/actions"
+	"github.com/npiganeau/yep/yep/server"
+	"github.com/npiganeau/yep/yep/views"
+)
+
+// ActiveRecordsParams is the args struct of the ActiveRecordsController
+type ActiveRecordsParams struct {
+	ActionID    string  `json:"action_id"`
+	ActiveModel string  `json:"active_model"`
+	ActiveIDs   []int64 `json:"active_ids"`
+}
+
+// ActiveRecordsController is the handler of the endpoint returning the action
+// given in the JSON-RPC params resolved for the given active records and
+// translated in the language of the user. The views of the action are the
+// ones the user is allowed to see, in their mobile variant for mobile clients.
+func ActiveRecordsController(ctx *server.Context) {
+	var params ActiveRecordsParams
+	ctx.BindRPCParams(&params)
+	uid, ok := sessionUID(ctx)
+	if !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	action := actions.Registry.GetById(params.ActionID)
+	if action == nil {
+		ctx.RPC(http.StatusNotFound, nil, errors.New("Unknown action"))
+		return
+	}
+	client := views.Client{UID: uid, Mobile: ctx.IsMobileClient()}
+	ctx.RPC(http.StatusOK, action.Translated(ctx.Lang()).ForClient(client).
+		WithActiveRecords(params.ActiveModel, params.ActiveIDs))
+}
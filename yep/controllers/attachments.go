@@ -0,0 +1,91 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// attachmentStatus returns the HTTP status of the response
+// to an attachment request that failed with the given error.
+func attachmentStatus(err error) int {
+	switch err.(type) {
+	case models.AccessError:
+		return http.StatusForbidden
+	case models.InfectedFileError, models.ReadOnlyError:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// UploadAttachmentController is the handler of the attachment upload endpoint.
+// It attaches the file of the "ufile" form field to the record of the "model"
+// model with the "id" id and returns the id of the attachment.
+func UploadAttachmentController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	modelName := ctx.PostForm("model")
+	id, err := strconv.ParseInt(ctx.PostForm("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	file, header, err := ctx.Request.FormFile("ufile")
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	defer file.Close()
+	if _, ok := models.Registry.Get(modelName); !ok {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("Unknown model"))
+		return
+	}
+	var attachment models.AttachmentInfo
+	err = models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		records := env.Pool(modelName).Search(env.Pool(modelName).Model().Field("ID").Equals(id))
+		attachment = records.Attach(header.Filename, file)
+	})
+	if err != nil {
+		ctx.AbortWithError(attachmentStatus(err), err)
+		return
+	}
+	ctx.JSON(http.StatusOK, map[string]int64{"id": attachment.ID})
+}
+
+// DownloadAttachmentController is the handler of the attachment download
+// endpoint. It sends the content of the attachment with the "id" id.
+func DownloadAttachmentController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Query("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	var (
+		attachment models.AttachmentInfo
+		reader     io.ReadCloser
+	)
+	err = models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		attachment, reader = models.OpenAttachment(env, id)
+	})
+	if err != nil {
+		ctx.AbortWithError(attachmentStatus(err), err)
+		return
+	}
+	defer reader.Close()
+	ctx.StreamFile(attachment.Name, attachment.MimeType, reader)
+}
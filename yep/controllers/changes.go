@@ -0,0 +1,49 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// A ChangesPage is the result of the ChangesController. Next is the
+// cursor to pass as since parameter to get the following events.
+type ChangesPage struct {
+	Events []models.ChangeEvent `json:"events"`
+	Next   string               `json:"next"`
+}
+
+// defaultChangesLimit is the number of events returned by the
+// ChangesController when no limit is given
+const defaultChangesLimit = 500
+
+// ChangesController is the handler of the change feed endpoint. It returns
+// the events of the change feed after the cursor given in the since query
+// parameter. It is restricted to administrators.
+func ChangesController(ctx *server.Context) {
+	uid, ok := sessionUID(ctx)
+	if !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	if !security.Registry.HasMembership(uid, security.GroupAdmin) {
+		ctx.RPC(http.StatusForbidden, nil, errors.New("Only administrators can read the change feed"))
+		return
+	}
+	limit := defaultChangesLimit
+	if l, err := strconv.Atoi(ctx.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	var res ChangesPage
+	err := models.ExecuteInReadOnlyEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		res.Events, res.Next = models.ChangesSince(env, ctx.Query("since"), limit)
+	})
+	ctx.RPC(http.StatusOK, res, err)
+}
@@ -4,6 +4,8 @@
 package controllers
 
 import (
+	"net/http"
+
 	"github.com/npiganeau/yep/yep/server"
 	"github.com/npiganeau/yep/yep/tools/logging"
 )
@@ -19,4 +21,19 @@ func BootStrap() {
 func init() {
 	log = logging.GetLogger("controllers")
 	Registry = newGroup("/")
+	Registry.AddController(http.MethodPost, "/views/form_spec", FormSpecController)
+	Registry.AddController(http.MethodPost, "/actions/active_records", ActiveRecordsController)
+	Registry.AddController(http.MethodPost, "/views/onchange", OnchangeController)
+	Registry.AddController(http.MethodPost, "/views/lang_params", LangParamsController)
+	Registry.AddController(http.MethodPost, "/views/search_page", SearchPageController)
+	Registry.AddController(http.MethodGet, "/changes", ChangesController)
+	Registry.AddController(http.MethodPost, "/attachments/upload", UploadAttachmentController)
+	Registry.AddController(http.MethodGet, "/attachments/download", DownloadAttachmentController)
+	Registry.AddController(http.MethodPost, "/sms/status", SMSStatusController)
+	Registry.AddController(http.MethodPost, "/push/devices/register", RegisterPushDeviceController)
+	Registry.AddController(http.MethodPost, "/push/devices/unregister", UnregisterPushDeviceController)
+	Registry.AddController(http.MethodPost, "/push/preferences", PushPreferenceController)
+	Registry.AddController(http.MethodGet, "/push/vapid-key", VAPIDKeyController)
+	Registry.AddController(http.MethodPost, "/presence", PresenceController)
+	Registry.AddController(http.MethodPost, "/presence/typing", TypingController)
 }
@@ -0,0 +1,42 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// OnchangeRequestParams is the args struct of the OnchangeController.
+// IDs is the record being edited in the form, or empty for a new record.
+type OnchangeRequestParams struct {
+	Model string  `json:"model"`
+	IDs   []int64 `json:"ids"`
+	models.OnchangeParams
+}
+
+// OnchangeController is the handler of the endpoint called by form views when
+// the value of a field with an on_change attribute is modified. It returns the
+// values of the other fields that must be updated before saving.
+func OnchangeController(ctx *server.Context) {
+	var params OnchangeRequestParams
+	ctx.BindRPCParams(&params)
+	uid, ok := sessionUID(ctx)
+	if !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	var res models.FieldMap
+	err := models.SimulateInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		rs := env.Pool(params.Model)
+		if len(params.IDs) > 0 {
+			rs = rs.Search(rs.Model().Field("ID").In(params.IDs))
+		}
+		res = rs.Call("Onchange", params.OnchangeParams).(models.FieldMap)
+	})
+	ctx.RPC(http.StatusOK, res, err)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// PresenceController is the handler of the endpoint to which connected
+// clients send heartbeats, at least every models.PresenceTimeout. The
+// "inactivity" form field is the number of milliseconds since the last
+// activity of the user.
+func PresenceController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	var inactivity int64
+	if value := ctx.PostForm("inactivity"); value != "" {
+		var err error
+		if inactivity, err = strconv.ParseInt(value, 10, 64); err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	err := models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		env.UpdatePresence(time.Duration(inactivity) * time.Millisecond)
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// TypingController is the handler of the endpoint with which clients tell
+// whether the current user is typing in the "channel" form field, according
+// to the "typing" form field.
+func TypingController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	channel := ctx.PostForm("channel")
+	if channel == "" {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("No channel"))
+		return
+	}
+	typing, err := strconv.ParseBool(ctx.PostForm("typing"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	err = models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		env.SetTyping(channel, typing)
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// RegisterPushDeviceController is the handler of the endpoint with which
+// clients register the device of the current user to receive push
+// notifications. It takes the "platform", "token" and "name" form fields
+// and returns the id of the device.
+func RegisterPushDeviceController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	platform := models.PushPlatform(ctx.PostForm("platform"))
+	if _, ok := models.PushProviders[platform]; !ok {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("Unsupported push platform"))
+		return
+	}
+	token := ctx.PostForm("token")
+	if strings.TrimSpace(token) == "" {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("No push token"))
+		return
+	}
+	var id int64
+	err := models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		id = env.RegisterPushDevice(platform, token, ctx.PostForm("name"))
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, map[string]int64{"id": id})
+}
+
+// UnregisterPushDeviceController is the handler of the endpoint with which
+// clients stop push notifications to the device with the "token" form field.
+func UnregisterPushDeviceController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	err := models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		env.UnregisterPushDevice(ctx.PostForm("token"))
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// PushPreferenceController is the handler of the endpoint with which users
+// choose whether the notifications of the "kind" form field are pushed to
+// their devices, according to the "push" form field.
+func PushPreferenceController(ctx *server.Context) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	if !ok {
+		ctx.AbortWithError(http.StatusUnauthorized, errors.New("Not logged in"))
+		return
+	}
+	kind := models.NotificationKind(ctx.PostForm("kind"))
+	switch kind {
+	case models.NotificationChatter, models.NotificationApproval:
+	default:
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("Unknown notification kind"))
+		return
+	}
+	enabled, err := strconv.ParseBool(ctx.PostForm("push"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	err = models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		env.SetPushPreference(kind, enabled)
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// VAPIDKeyController is the handler of the endpoint that returns the VAPID
+// public key with which browsers subscribe to web push notifications.
+func VAPIDKeyController(ctx *server.Context) {
+	webPush, ok := models.PushProviders[models.PushWeb].(*models.WebPush)
+	if !ok {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("No web push provider"))
+		return
+	}
+	ctx.JSON(http.StatusOK, map[string]string{"key": webPush.PublicKey()})
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// SearchPageParams is the args struct of the SearchPageController.
+//
+// Records are paginated with Limit and Offset, or with Cursor if it is set or
+// if UseCursor is true. Cursor pagination should be preferred by clients that
+// walk through many records: set UseCursor to get the first page and then pass
+// the Next cursor of each page to get the following one.
+type SearchPageParams struct {
+	Model     string   `json:"model"`
+	Fields    []string `json:"fields"`
+	Order     []string `json:"order"`
+	Limit     int      `json:"limit"`
+	Offset    int      `json:"offset"`
+	Cursor    string   `json:"cursor"`
+	UseCursor bool     `json:"use_cursor"`
+}
+
+// A SearchPage is the result of the SearchPageController. Next is the
+// cursor of the next page, or empty if this is the last page or if the
+// records were paginated with an offset.
+type SearchPage struct {
+	Records []models.FieldMap `json:"records"`
+	Next    string            `json:"next"`
+}
+
+// defaultPageSize is the number of records of a page when no limit is given
+const defaultPageSize = 80
+
+// SearchPageController is the handler of the endpoint returning the given
+// fields of a page of the records of a model.
+func SearchPageController(ctx *server.Context) {
+	var params SearchPageParams
+	ctx.BindRPCParams(&params)
+	uid, ok := sessionUID(ctx)
+	if !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	if params.Limit <= 0 {
+		params.Limit = defaultPageSize
+	}
+	var res SearchPage
+	err := models.ExecuteInReadOnlyEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		rs := env.Pool(params.Model).FetchAll()
+		if len(params.Order) > 0 {
+			rs = rs.OrderBy(params.Order...)
+		}
+		if params.Cursor != "" || params.UseCursor {
+			rs, res.Next = rs.Page(params.Cursor, params.Limit)
+		} else {
+			rs = rs.Limit(params.Limit).Offset(params.Offset)
+		}
+		res.Records = rs.Call("Read", params.Fields).([]models.FieldMap)
+	})
+	ctx.RPC(http.StatusOK, res, err)
+}
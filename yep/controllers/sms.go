@@ -0,0 +1,40 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/server"
+)
+
+// SMSStatusController is the handler of the endpoint with which the SMS
+// provider reports the delivery status of the messages it sent.
+func SMSStatusController(ctx *server.Context) {
+	if models.SMSGateway == nil {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("No SMS gateway"))
+		return
+	}
+	update, err := models.SMSGateway.ParseStatusCallback(ctx.Request)
+	if err != nil {
+		log.Warn("Invalid SMS status callback", "remote", ctx.Request.RemoteAddr, "error", err)
+		ctx.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	var found bool
+	err = models.ExecuteInNewEnvironmentWithContext(ctx.GoContext(), security.SuperUserID, func(env models.Environment) {
+		found = models.UpdateSMSStatus(env, update)
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		log.Debug("SMS status callback for unknown message", "provider_id", update.ProviderID)
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/server"
+	"github.com/npiganeau/yep/yep/tools/i18n"
+	"github.com/npiganeau/yep/yep/views"
+)
+
+// FormSpecParams is the args struct of the FormSpecController.
+// If ViewID is not set, the first form view of Model is used.
+type FormSpecParams struct {
+	ViewID string `json:"view_id"`
+	Model  string `json:"model"`
+}
+
+// FormSpecController is the handler of the form specification endpoint.
+// It returns the FormSpec of the form view given in the JSON-RPC params.
+// Mobile views are served to clients that identify as mobile clients.
+// Labels are translated in the language of the user and the direction of this
+// language is given in the returned spec.
+func FormSpecController(ctx *server.Context) {
+	var params FormSpecParams
+	ctx.BindRPCParams(&params)
+	uid, ok := sessionUID(ctx)
+	if !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	client := views.Client{UID: uid, Mobile: ctx.IsMobileClient()}
+	var view *views.View
+	if params.ViewID != "" {
+		view = views.Registry.GetByIDForClient(params.ViewID, client)
+	} else {
+		view = views.Registry.GetFirstViewForModelForClient(params.Model, views.VIEW_TYPE_FORM, client)
+	}
+	if view == nil {
+		ctx.RPC(http.StatusNotFound, nil, errors.New("Unknown view"))
+		return
+	}
+	var spec *views.FormSpec
+	err := models.ExecuteInReadOnlyEnvironmentWithContext(ctx.GoContext(), uid, func(env models.Environment) {
+		fInfos := env.Pool(view.Model).Call("FieldsGet", models.FieldsGetArgs{}).(map[string]*models.FieldInfo)
+		spec = view.Translated(ctx.Lang()).WithFeatures(env.IsFeatureEnabled).FormSpec(fInfos)
+		spec.Direction = i18n.Registry.LangParameters(ctx.Lang()).Direction
+	})
+	ctx.RPC(http.StatusOK, spec, err)
+}
+
+// sessionUID returns the uid of the user logged in the session of ctx.
+// The second returned value is false if no user is logged in.
+func sessionUID(ctx *server.Context) (int64, bool) {
+	uid, ok := ctx.Session().Get("uid").(int64)
+	return uid, ok
+}
+
+// LangParamsController is the handler of the language parameters endpoint.
+// It returns the direction and the number and date formats of the language
+// of the user, so that clients render right-to-left locales correctly.
+func LangParamsController(ctx *server.Context) {
+	if _, ok := sessionUID(ctx); !ok {
+		ctx.RPC(http.StatusUnauthorized, nil, errors.New("Not logged in"))
+		return
+	}
+	ctx.RPC(http.StatusOK, i18n.Registry.LangParameters(ctx.Lang()))
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+const (
+	// activeFieldName is the name of the field added by AddActiveField
+	activeFieldName = "Active"
+	// activeTestContextKey is the context key which, when set to false,
+	// disables the filtering of archived records in searches.
+	activeTestContextKey = "active_test"
+)
+
+// AddActiveField adds to this model an Active boolean field, true by default.
+// Records whose Active field is false are archived: they are excluded from the
+// searches on this model unless the context has active_test set to false or
+// the search condition explicitly filters on the Active field.
+//
+// Records can be archived and unarchived with the Archive and Unarchive methods.
+func (m *Model) AddActiveField(params SimpleFieldParams) *Field {
+	if params.Default == nil {
+		params.Default = func(Environment, FieldMap) interface{} {
+			return true
+		}
+	}
+	params.Index = true
+	fi := m.AddBooleanField(activeFieldName, params)
+	fi.activeTest = true
+	return fi
+}
+
+// activeField returns the Active field of the records of this model
+// if it has been added with AddActiveField. The second returned value
+// is false if the model has none.
+func (m *Model) activeField() (*Field, bool) {
+	fi, ok := m.fields.get(activeFieldName)
+	if !ok || !fi.activeTest {
+		return nil, false
+	}
+	return fi, true
+}
+
+// addActiveCondition returns a copy of rc whose query excludes archived
+// records, unless rc has already been fetched, the context of rc has
+// active_test set to false or the query already filters on the Active field.
+func (rc RecordCollection) addActiveCondition() RecordCollection {
+	if rc.fetched {
+		return rc
+	}
+	fi, ok := rc.model.activeField()
+	if !ok {
+		return rc
+	}
+	if rc.env.context != nil && !rc.env.context.GetBool(activeTestContextKey, true) {
+		return rc
+	}
+	for _, exprs := range rc.query.cond.getAllExpressions(rc.model) {
+		if len(exprs) == 1 && exprs[0] == fi.json {
+			return rc
+		}
+	}
+	return rc.Search(rc.model.Field(activeFieldName).Equals(true))
+}
+
+// fetchWithArchived is the same as Fetch but does not exclude archived
+// records. It is used to re-fetch the records of a RecordCollection inside
+// methods such as Write or Unlink, so that they also apply to the archived
+// records that the caller explicitly selected.
+func (rc RecordCollection) fetchWithArchived() RecordCollection {
+	if rc.fetched || rc.query.isEmpty() {
+		return rc
+	}
+	return rc.WithContext(activeTestContextKey, false).Fetch().WithEnv(*rc.env)
+}
+
+// setActive writes the given value in the Active field of the records of rc.
+// It panics if the model of rc has no Active field.
+func (rc RecordCollection) setActive(value bool) bool {
+	if _, ok := rc.model.activeField(); !ok {
+		log.Panic("Archive and Unarchive can only be called on models with an Active field", "model", rc.model)
+	}
+	return rc.Call("Write", FieldMap{activeFieldName: value}).(bool)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/address"
+)
+
+// addressFields are the fields of AddressMixin from which the formatted address is computed
+var addressFields = []string{"Street", "Street2", "Zip", "City", "State", "CountryCode"}
+
+// declareAddressMixin creates the AddressMixin which adds a postal
+// address formatted and validated according to its country.
+func declareAddressMixin() {
+	addressMixin := NewMixinModel("AddressMixin")
+	addressMixin.AddCharField("Street", StringFieldParams{JSON: "street", Constraint: "checkAddress"})
+	addressMixin.AddCharField("Street2", StringFieldParams{JSON: "street2", Constraint: "checkAddress"})
+	addressMixin.AddCharField("Zip", StringFieldParams{JSON: "zip", Constraint: "checkAddress"})
+	addressMixin.AddCharField("City", StringFieldParams{JSON: "city", Constraint: "checkAddress"})
+	addressMixin.AddCharField("State", StringFieldParams{JSON: "state", Constraint: "checkAddress"})
+	addressMixin.AddCharField("CountryCode", StringFieldParams{JSON: "country_code", Size: 2,
+		Constraint: "checkAddress", Help: "ISO 3166-1 alpha-2 code of the country"})
+	addressMixin.AddTextField("FormattedAddress", StringFieldParams{JSON: "formatted_address",
+		Compute: "ComputeFormattedAddress", Depends: addressFields})
+
+	addressMixin.AddMethod("Address",
+		`Address returns the postal address of this record.`,
+		func(rc RecordCollection) address.Address {
+			return rc.postalAddress()
+		}).AllowGroup(security.GroupEveryone)
+
+	addressMixin.AddMethod("ComputeFormattedAddress",
+		`ComputeFormattedAddress updates the FormattedAddress field with the
+		address of the record laid out according to its country.`,
+		func(rc RecordCollection) FieldMap {
+			return FieldMap{"FormattedAddress": rc.postalAddress().String()}
+		}).AllowGroup(security.GroupEveryone)
+
+	addressMixin.AddMethod("checkAddress",
+		`checkAddress returns an error if the address of one of the records of
+		this RecordSet has a country and is invalid for this country.`,
+		func(rc RecordCollection) error {
+			for _, rec := range rc.Records() {
+				addr := rec.postalAddress()
+				if addr.Country == "" {
+					continue
+				}
+				if err := address.Validate(addr); err != nil {
+					return fmt.Errorf("invalid address: %s", err)
+				}
+			}
+			return nil
+		})
+}
+
+// postalAddress returns the address of this singleton
+func (rc RecordCollection) postalAddress() address.Address {
+	rc.EnsureOne()
+	return address.Address{
+		Street:  rc.Get("Street").(string),
+		Street2: rc.Get("Street2").(string),
+		Zip:     rc.Get("Zip").(string),
+		City:    rc.Get("City").(string),
+		State:   rc.Get("State").(string),
+		Country: rc.Get("CountryCode").(string),
+	}
+}
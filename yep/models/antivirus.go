@@ -0,0 +1,301 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// scanChunkSize is the size of the chunks in which contents are sent to scanners.
+const scanChunkSize = 32 * 1024
+
+// A VirusScanner scans contents for viruses and other malware.
+type VirusScanner interface {
+	// Scan reads the content from r and returns the name of the threat
+	// found in it, or an empty string if the content is clean.
+	Scan(r io.Reader) (threat string, err error)
+}
+
+// InfectedFilePolicy defines what happens to uploaded files in which
+// the Antivirus has found a threat.
+type InfectedFilePolicy int8
+
+const (
+	// InfectedFilesReject rejects infected files.
+	InfectedFilesReject InfectedFilePolicy = iota
+	// InfectedFilesQuarantine rejects infected files and keeps
+	// a copy of them in the Quarantine store for inspection.
+	InfectedFilesQuarantine
+)
+
+var (
+	// Antivirus is the VirusScanner that scans the contents of attachment
+	// fields and uploaded files. Contents are not scanned if it is nil.
+	Antivirus VirusScanner
+	// InfectedFiles is the policy applied to infected files.
+	InfectedFiles = InfectedFilesReject
+	// Quarantine is the AttachmentStore in which infected files are kept
+	// when InfectedFiles is InfectedFilesQuarantine.
+	Quarantine AttachmentStore
+)
+
+// An InfectedFileError is raised when the Antivirus finds a threat in
+// an uploaded file. Its message is meant to be displayed to the end user.
+type InfectedFileError struct {
+	Model    string
+	Field    string
+	FileName string
+	Threat   string
+}
+
+// Error returns the message of this InfectedFileError
+func (e InfectedFileError) Error() string {
+	return fmt.Sprintf("The file has been rejected because it is infected by %s", e.Threat)
+}
+
+// ScanFile scans the uploaded file read from r with the Antivirus and returns
+// an InfectedFileError if a threat is found. Upload handlers, such as those of
+// import files, must call it before processing the file. The reader is
+// rewound after the scan.
+func ScanFile(fileName string, r io.ReadSeeker) error {
+	return scanUpload(InfectedFileError{FileName: fileName}, r)
+}
+
+// scanUpload scans the content read from r with the Antivirus and applies
+// the InfectedFiles policy if a threat is found. Contents that could not be
+// scanned are rejected. The reader is rewound after the scan.
+func scanUpload(info InfectedFileError, r io.ReadSeeker) error {
+	if Antivirus == nil {
+		return nil
+	}
+	threat, err := Antivirus.Scan(r)
+	if err != nil {
+		log.Warn("Unable to scan uploaded file", "model", info.Model, "field", info.Field, "file", info.FileName, "error", err)
+		return fmt.Errorf("unable to scan uploaded file: %s", err)
+	}
+	if _, err := r.Seek(0, 0); err != nil {
+		return err
+	}
+	if threat == "" {
+		return nil
+	}
+	info.Threat = threat
+	log.Warn("Infected file rejected", "model", info.Model, "field", info.Field, "file", info.FileName, "threat", threat)
+	if InfectedFiles == InfectedFilesQuarantine && Quarantine != nil {
+		key, _, err := Quarantine.Store(r)
+		if err != nil {
+			log.Warn("Unable to quarantine infected file", "file", info.FileName, "error", err)
+			return info
+		}
+		log.Warn("Infected file quarantined", "model", info.Model, "field", info.Field, "file", info.FileName, "key", key)
+	}
+	return info
+}
+
+// scanAttachment spools the content read from r to a temporary file and scans
+// it with the Antivirus. It returns a reader on the scanned content and a
+// function to call to release the temporary file. It panics with the given
+// InfectedFileError if a threat is found.
+func (rc RecordCollection) scanAttachment(info InfectedFileError, r io.Reader) (io.Reader, func()) {
+	if Antivirus == nil {
+		return r, func() {}
+	}
+	tmpFile, err := ioutil.TempFile("", "yep-scan")
+	if err != nil {
+		log.Panic("Unable to create temporary file", "error", err)
+	}
+	release := func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		release()
+		log.Panic("Unable to read attachment", "model", rc.ModelName(), "field", info.Field, "error", err)
+	}
+	if _, err := tmpFile.Seek(0, 0); err != nil {
+		release()
+		log.Panic("Unable to read attachment", "model", rc.ModelName(), "field", info.Field, "error", err)
+	}
+	if err := scanUpload(info, tmpFile); err != nil {
+		release()
+		if _, ok := err.(InfectedFileError); ok {
+			panic(err)
+		}
+		log.Panic("Unable to scan attachment", "model", rc.ModelName(), "field", info.Field, "error", err)
+	}
+	return tmpFile, release
+}
+
+// A ClamdScanner is a VirusScanner that sends contents to a
+// clamd daemon with the INSTREAM command.
+type ClamdScanner struct {
+	// Network is the network of the daemon, "tcp" or "unix".
+	Network string
+	// Address is the address of the daemon, e.g. "localhost:3310"
+	// or "/var/run/clamav/clamd.ctl".
+	Address string
+	// Timeout is the maximum duration of a scan. 0 means no timeout.
+	Timeout time.Duration
+}
+
+var _ VirusScanner = ClamdScanner{}
+
+// Scan reads the content from r and returns the name of the threat
+// found in it, or an empty string if the content is clean.
+func (s ClamdScanner) Scan(r io.Reader) (string, error) {
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, s.Address, dialTimeout(s.Timeout))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, scanChunkSize)
+	for {
+		n, rErr := r.Read(buf)
+		if n > 0 {
+			if err := binary.Write(conn, binary.BigEndian, uint32(n)); err != nil {
+				return "", err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return "", rErr
+		}
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return "", err
+	}
+	resp, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && resp == "" {
+		return "", err
+	}
+	resp = strings.TrimPrefix(strings.TrimSuffix(resp, "\x00"), "stream: ")
+	switch {
+	case strings.HasSuffix(resp, " FOUND"):
+		return strings.TrimSuffix(resp, " FOUND"), nil
+	case resp == "OK":
+		return "", nil
+	}
+	return "", fmt.Errorf("clamd error: %s", resp)
+}
+
+// dialTimeout returns the timeout to use to connect to a scanner
+// whose scan timeout is the given timeout.
+func dialTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return 30 * time.Second
+}
+
+// An ICAPScanner is a VirusScanner that sends contents to an ICAP
+// server (RFC 3507) with RESPMOD requests.
+type ICAPScanner struct {
+	// Address is the address of the ICAP server, e.g. "localhost:1344".
+	Address string
+	// Service is the name of the antivirus service of the server, e.g. "avscan".
+	Service string
+	// Timeout is the maximum duration of a scan. 0 means no timeout.
+	Timeout time.Duration
+}
+
+var _ VirusScanner = ICAPScanner{}
+
+// icapThreatRegexp extracts the threat name of an X-Infection-Found header
+var icapThreatRegexp = regexp.MustCompile(`Threat=([^;]+)`)
+
+// Scan reads the content from r and returns the name of the threat
+// found in it, or an empty string if the content is clean.
+func (s ICAPScanner) Scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.Address, dialTimeout(s.Timeout))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	resHeader := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD icap://%s/%s ICAP/1.0\r\n", s.Address, s.Service)
+	fmt.Fprintf(w, "Host: %s\r\n", s.Address)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHeader))
+	w.WriteString(resHeader)
+	buf := make([]byte, scanChunkSize)
+	for {
+		n, rErr := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return "", rErr
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	var (
+		proto  string
+		status int
+	)
+	if _, err := fmt.Sscanf(statusLine, "%s %d", &proto, &status); err != nil {
+		return "", fmt.Errorf("invalid ICAP response: %s", statusLine)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	switch status {
+	case 204:
+		return "", nil
+	case 200:
+		if infection := header.Get("X-Infection-Found"); infection != "" {
+			if match := icapThreatRegexp.FindStringSubmatch(infection); match != nil {
+				return strings.TrimSpace(match[1]), nil
+			}
+			return infection, nil
+		}
+		if virusID := header.Get("X-Virus-ID"); virusID != "" {
+			return virusID, nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("ICAP error: %s", statusLine)
+}
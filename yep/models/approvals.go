@@ -0,0 +1,311 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/expr"
+)
+
+// Statuses of approvals
+const (
+	approvalApproved = "approved"
+	approvalRefused  = "refused"
+)
+
+// An ApprovalLevel is a sign-off required before calling a method on the
+// records that satisfy its condition. Levels of a method are approved in
+// the order in which they are given to Method.RequireApprovals.
+type ApprovalLevel struct {
+	Name string
+	// Condition is an expression (see the tools/expr package) that records
+	// must satisfy for this level to be required, such as
+	// "amount_total >= 10000". The level is required for all records if
+	// it is empty.
+	Condition string
+	// Group is the group whose members can approve this level
+	Group     *security.Group
+	condition *expr.Program
+}
+
+// An ApprovalNotifier notifies users that records wait for their approval
+type ApprovalNotifier interface {
+	// NotifyApprovers notifies the users with the given uids that the given
+	// records wait for their approval at the given level before method can
+	// be called on them.
+	NotifyApprovers(rc RecordCollection, method string, level ApprovalLevel, uids []int64) error
+}
+
+// ApprovalNotifications is the ApprovalNotifier of the application.
+// Approvers are not notified if it is nil.
+var ApprovalNotifications ApprovalNotifier
+
+// An approvalLine is the status of a level of approval of a record
+type approvalLine struct {
+	Level  string
+	Status string
+}
+
+// declareApprovalModels creates the system models in which approvals
+// and delegations of approvals are stored.
+func declareApprovalModels() {
+	approval := createModel("Approval", SystemModel)
+	approval.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	approval.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	approval.AddCharField("Method", StringFieldParams{JSON: "method", Required: true})
+	approval.AddCharField("Level", StringFieldParams{JSON: "level", Required: true})
+	approval.AddSelectionField("Status", SelectionFieldParams{JSON: "status", Required: true,
+		Selection: types.Selection{
+			approvalApproved: "Approved",
+			approvalRefused:  "Refused",
+		}})
+	approval.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true})
+	approval.AddIntegerField("OnBehalfOfUID", SimpleFieldParams{JSON: "on_behalf_of_uid"})
+	approval.AddTextField("Comment", StringFieldParams{JSON: "comment"})
+	approval.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true})
+	approval.InheritModel(Registry.MustGet("CommonMixin"))
+
+	delegation := createModel("ApprovalDelegation", SystemModel)
+	delegation.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true, Index: true})
+	delegation.AddIntegerField("DelegateUID", SimpleFieldParams{JSON: "delegate_uid", Required: true, Index: true})
+	delegation.AddDateTimeField("DateFrom", SimpleFieldParams{JSON: "date_from", Required: true})
+	delegation.AddDateTimeField("DateTo", SimpleFieldParams{JSON: "date_to", Required: true})
+	delegation.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// RequireApprovals sets the levels of approval required before calling this
+// method on a record. Calling the method on records for which a level is not
+// approved panics with an ApprovalError.
+//
+// It panics if the condition of a level is not a valid expression.
+func (m *Method) RequireApprovals(levels ...ApprovalLevel) *Method {
+	m.Lock()
+	defer m.Unlock()
+	m.approvalLevels = make([]*ApprovalLevel, len(levels))
+	for i := range levels {
+		level := levels[i]
+		if level.Group == nil {
+			log.Panic("Approval level without group", "model", m.model.name, "method", m.name, "level", level.Name)
+		}
+		if level.Condition != "" {
+			program, err := expr.Compile(level.Condition)
+			if err != nil {
+				log.Panic("Invalid approval level condition", "model", m.model.name, "method", m.name,
+					"level", level.Name, "error", err)
+			}
+			level.condition = program
+		}
+		m.approvalLevels[i] = &level
+	}
+	return m
+}
+
+// checkApprovalConditions checks that the conditions of the approval levels
+// of all methods are valid for their model. It panics otherwise.
+func checkApprovalConditions() {
+	for _, mi := range Registry.registryByName {
+		for _, method := range mi.methods.registry {
+			for _, level := range method.approvalLevels {
+				if level.condition == nil {
+					continue
+				}
+				if err := mi.CheckExpr(level.condition); err != nil {
+					log.Panic("Invalid approval level condition", "model", mi.name, "method", method.name,
+						"level", level.Name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// DelegateApprovals lets the user with uid delegateUID approve on behalf
+// of the current user between from and to, e.g. during an absence.
+func (env Environment) DelegateApprovals(delegateUID int64, from, to types.DateTime) {
+	if env.readOnly {
+		panic(ReadOnlyError{Model: "ApprovalDelegation", Operation: "create"})
+	}
+	query := `INSERT INTO approval_delegation (uid, delegate_uid, date_from, date_to) VALUES (?, ?, ?, ?)`
+	env.Cr().Execute(query, env.uid, delegateUID, from, to)
+}
+
+// delegators returns the uids of the users on behalf of
+// whom the current user can approve at the given date.
+func (env Environment) delegators(date time.Time) []int64 {
+	var uids []int64
+	query := `SELECT uid FROM approval_delegation WHERE delegate_uid = ? AND date_from <= ? AND date_to >= ? ORDER BY id`
+	env.Cr().Select(&uids, query, env.uid, date, date)
+	return uids
+}
+
+// delegates returns the uids of the users that can approve
+// on behalf of the given users at the given date.
+func (env Environment) delegates(uids []int64, date time.Time) []int64 {
+	var res []int64
+	query := `SELECT delegate_uid FROM approval_delegation WHERE uid = ? AND date_from <= ? AND date_to >= ? ORDER BY id`
+	for _, uid := range uids {
+		var delegates []int64
+		env.Cr().Select(&delegates, query, uid, date, date)
+		res = append(res, delegates...)
+	}
+	return res
+}
+
+// approvalStatuses returns the current status of each level
+// of approval of the given method for this singleton.
+func (rc RecordCollection) approvalStatuses(method *Method) map[string]string {
+	var lines []approvalLine
+	query := `SELECT level, status FROM approval WHERE res_model = ? AND res_id = ? AND method = ? ORDER BY id`
+	rc.env.Cr().Select(&lines, query, rc.model.name, rc.ids[0], method.name)
+	res := make(map[string]string)
+	for _, line := range lines {
+		res[line.Level] = line.Status
+	}
+	return res
+}
+
+// pendingApproval returns the first level of approval of the given method
+// that this singleton requires and that is not approved, with its status,
+// or nil if the method can be called on this record.
+func (rc RecordCollection) pendingApproval(method *Method) (*ApprovalLevel, string) {
+	statuses := rc.approvalStatuses(method)
+	for _, level := range method.approvalLevels {
+		if level.condition != nil && !expr.Truth(rc.EvalExpr(level.condition)) {
+			continue
+		}
+		if statuses[level.Name] != approvalApproved {
+			return level, statuses[level.Name]
+		}
+	}
+	return nil, ""
+}
+
+// checkApprovals panics with an ApprovalError if the given method
+// cannot be called on the records of rc because they lack an approval.
+func (rc RecordCollection) checkApprovals(method *Method) {
+	if len(method.approvalLevels) == 0 {
+		return
+	}
+	for _, rec := range rc.Records() {
+		if level, status := rec.pendingApproval(method); level != nil {
+			panic(ApprovalError{
+				Model:   rc.model.name,
+				Method:  method.name,
+				ID:      rec.ids[0],
+				Level:   level.Name,
+				Refused: status == approvalRefused,
+			})
+		}
+	}
+}
+
+// PendingApprovals returns the name of the next level of approval required
+// before calling the given method on each record of this RecordCollection.
+// Records that require no more approval are not in the returned map.
+func (rc RecordCollection) PendingApprovals(methName string) map[int64]string {
+	method := rc.model.methods.MustGet(methName)
+	res := make(map[int64]string)
+	for _, rec := range rc.Records() {
+		if level, _ := rec.pendingApproval(method); level != nil {
+			res[rec.ids[0]] = level.Name
+		}
+	}
+	return res
+}
+
+// Approve approves the next level of approval of the given method for each
+// record of this RecordCollection and notifies the approvers of the following
+// level, if any.
+//
+// It panics with an AccessError if the current user is neither a member of
+// the group of the level nor a delegate of a member.
+func (rc RecordCollection) Approve(methName, comment string) {
+	rc.setApproval(methName, approvalApproved, comment)
+	rc.RequestApprovals(methName)
+}
+
+// Refuse refuses the next level of approval of the given method for each
+// record of this RecordCollection. The method cannot be called on them until
+// another approver of the level approves it.
+//
+// It panics with an AccessError if the current user is neither a member of
+// the group of the level nor a delegate of a member.
+func (rc RecordCollection) Refuse(methName, comment string) {
+	rc.setApproval(methName, approvalRefused, comment)
+}
+
+// setApproval records the given status for the next level of
+// approval of the given method of each record of rc.
+func (rc RecordCollection) setApproval(methName, status, comment string) {
+	method := rc.model.methods.MustGet(methName)
+	now := time.Now()
+	query := `INSERT INTO approval (res_model, res_id, method, level, status, uid, on_behalf_of_uid, comment, date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, rec := range rc.Records() {
+		level, _ := rec.pendingApproval(method)
+		if level == nil {
+			continue
+		}
+		onBehalfOf, ok := rc.env.approverFor(level, now)
+		if !ok {
+			panic(AccessError{
+				Model:   rc.model.name,
+				Message: fmt.Sprintf("You are not allowed to approve '%s' of %s records", level.Name, rc.model.name),
+			})
+		}
+		rc.env.Cr().Execute(query, rc.model.name, rec.ids[0], method.name, level.Name, status, rc.env.uid,
+			onBehalfOf, comment, now)
+	}
+}
+
+// approverFor returns true if the current user can approve the given level at
+// the given date, with the uid of the user on behalf of whom the current user
+// approves as a delegate, or 0 if the current user is a member of the group.
+func (env Environment) approverFor(level *ApprovalLevel, date time.Time) (int64, bool) {
+	if security.Registry.HasMembership(env.uid, level.Group) {
+		return 0, true
+	}
+	for _, uid := range env.delegators(date) {
+		if security.Registry.HasMembership(uid, level.Group) {
+			return uid, true
+		}
+	}
+	return 0, false
+}
+
+// RequestApprovals notifies the approvers of the next level of approval
+// of the given method for each record of this RecordCollection, that is
+// the members of the group of the level and their current delegates.
+func (rc RecordCollection) RequestApprovals(methName string) {
+	if ApprovalNotifications == nil {
+		return
+	}
+	method := rc.model.methods.MustGet(methName)
+	for _, rec := range rc.Records() {
+		level, _ := rec.pendingApproval(method)
+		if level == nil {
+			continue
+		}
+		members := security.Registry.Members(level.Group)
+		uids := append(members, rc.env.delegates(members, time.Now())...)
+		if err := ApprovalNotifications.NotifyApprovers(rec, method.name, *level, uids); err != nil {
+			log.Warn("Unable to notify approvers", "model", rc.model.name, "id", rec.ids[0], "method", method.name,
+				"level", level.Name, "error", err)
+		}
+	}
+}
+
+// ResetApprovals removes the approvals of the given method for the records of
+// this RecordCollection, so that they must be approved again, for instance
+// after they have been modified.
+func (rc RecordCollection) ResetApprovals(methName string) {
+	method := rc.model.methods.MustGet(methName)
+	query := `DELETE FROM approval WHERE res_model = ? AND res_id = ? AND method = ?`
+	for _, id := range rc.Ids() {
+		rc.env.Cr().Execute(query, rc.model.name, id, method.name)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+)
+
+// An AttachmentStore stores the contents of the binary fields that are
+// declared with SetAttachment(true) and of the attachments of records.
+type AttachmentStore interface {
+	// Open returns a reader on the content stored with the given key.
+	Open(key string) (io.ReadCloser, error)
+	// Store stores the content read from r and returns its key and size.
+	Store(r io.Reader) (key string, size int64, err error)
+}
+
+// A FileSystemStore is an AttachmentStore that stores contents in files of
+// the Dir directory. Contents are addressed by their SHA1 checksum so that
+// identical contents are only stored once.
+type FileSystemStore struct {
+	Dir string
+}
+
+// Open returns a reader on the content stored with the given key.
+func (fs FileSystemStore) Open(key string) (io.ReadCloser, error) {
+	return os.Open(fs.path(key))
+}
+
+// Store stores the content read from r and returns its key and size.
+func (fs FileSystemStore) Store(r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(fs.Dir, 0755); err != nil {
+		return "", 0, err
+	}
+	tmpFile, err := ioutil.TempFile(fs.Dir, "tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if cErr := tmpFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+	if err := os.MkdirAll(filepath.Dir(fs.path(key)), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmpFile.Name(), fs.path(key)); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// path returns the path of the file holding the content with the given key
+func (fs FileSystemStore) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(fs.Dir, key)
+	}
+	return filepath.Join(fs.Dir, key[:2], key)
+}
+
+var _ AttachmentStore = FileSystemStore{}
+
+// A MigratingStore is an AttachmentStore used while moving contents from one
+// store to another. New contents are stored in the To store and contents are
+// read from the To store, or from the From store if they have not been
+// migrated yet. This allows to run MigrateAttachments without downtime.
+type MigratingStore struct {
+	From AttachmentStore
+	To   AttachmentStore
+}
+
+// Open returns a reader on the content stored with the given key.
+func (ms MigratingStore) Open(key string) (io.ReadCloser, error) {
+	reader, err := ms.To.Open(key)
+	if err == nil {
+		return reader, nil
+	}
+	return ms.From.Open(key)
+}
+
+// Store stores the content read from r and returns its key and size.
+func (ms MigratingStore) Store(r io.Reader) (string, int64, error) {
+	return ms.To.Store(r)
+}
+
+var _ AttachmentStore = MigratingStore{}
+
+// MigrateAttachments copies all the contents referenced by attachments from
+// the from store to the to store and returns the number of copied contents.
+// Contents are not removed from the from store.
+//
+// While the migration is running, Attachments should be set to a
+// MigratingStore so that contents remain available to users.
+func MigrateAttachments(env Environment, from, to AttachmentStore) (int, error) {
+	var keys []string
+	env.Cr().Select(&keys, `SELECT DISTINCT store_fname FROM attachment ORDER BY store_fname`)
+	for i, key := range keys {
+		if err := migrateAttachment(key, from, to); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// migrateAttachment copies the content with the given key from the from
+// store to the to store and checks that its key has not changed.
+func migrateAttachment(key string, from, to AttachmentStore) error {
+	reader, err := from.Open(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	newKey, _, err := to.Store(reader)
+	if err != nil {
+		return err
+	}
+	if newKey != key {
+		return fmt.Errorf("content %s has been stored with key %s", key, newKey)
+	}
+	return nil
+}
+
+// Attachments is the AttachmentStore in which the contents of attachment
+// binary fields are stored. It defaults to a FileSystemStore in the
+// temporary directory and should be set before the server is started.
+var Attachments AttachmentStore = FileSystemStore{Dir: filepath.Join(os.TempDir(), "yep", "filestore")}
+
+// An attachmentLine is the reference to the content of an
+// attachment binary field as stored in the database.
+type attachmentLine struct {
+	StoreFname string
+}
+
+// An AttachmentInfo describes a file attached to a record
+type AttachmentInfo struct {
+	ID         int64  `db:"id" json:"id"`
+	ResModel   string `db:"res_model" json:"res_model"`
+	ResID      int64  `db:"res_id" json:"res_id"`
+	Name       string `db:"name" json:"name"`
+	MimeType   string `db:"mimetype" json:"mimetype"`
+	FileSize   int64  `db:"file_size" json:"file_size"`
+	Checksum   string `db:"checksum" json:"checksum"`
+	StoreFname string `db:"store_fname" json:"-"`
+}
+
+// attachmentInfoColumns are the columns of the attachment table read into AttachmentInfo
+const attachmentInfoColumns = `id, res_model, res_id, name, mimetype, file_size, checksum, store_fname`
+
+// declareAttachmentModel creates the system model in which the references
+// to the contents of attachment binary fields and of the files attached to
+// records are stored. The Field of the latter is empty.
+func declareAttachmentModel() {
+	attachment := createModel("Attachment", SystemModel)
+	attachment.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	attachment.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	attachment.AddCharField("Field", StringFieldParams{JSON: "field"})
+	attachment.AddCharField("Name", StringFieldParams{JSON: "name"})
+	attachment.AddCharField("MimeType", StringFieldParams{JSON: "mimetype"})
+	attachment.AddCharField("StoreFname", StringFieldParams{JSON: "store_fname", Required: true})
+	attachment.AddIntegerField("FileSize", SimpleFieldParams{JSON: "file_size"})
+	attachment.AddCharField("Checksum", StringFieldParams{JSON: "checksum", Index: true})
+	attachment.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// isAttachmentField returns true if this field's values are stored
+// in the AttachmentStore instead of a column of the model's table.
+func (f *Field) isAttachmentField() bool {
+	return f.attachment
+}
+
+// attachmentKey returns the key in the AttachmentStore of the content of
+// the attachment field fi of this singleton, or an empty string if not set.
+func (rc RecordCollection) attachmentKey(fi *Field) string {
+	var lines []attachmentLine
+	query := `SELECT store_fname FROM attachment WHERE res_model = ? AND field = ? AND res_id = ?`
+	rc.env.Cr().Select(&lines, query, rc.model.name, fi.json, rc.ids[0])
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0].StoreFname
+}
+
+// getAttachment returns the value of the attachment field fi of this singleton.
+func (rc RecordCollection) getAttachment(fi *Field) interface{} {
+	reader := rc.openAttachment(fi)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Panic("Unable to read attachment", "model", rc.ModelName(), "field", fi.name, "error", err)
+	}
+	return string(data)
+}
+
+// openAttachment returns a reader on the content of the attachment
+// field fi of this singleton.
+func (rc RecordCollection) openAttachment(fi *Field) io.ReadCloser {
+	key := rc.attachmentKey(fi)
+	if key == "" {
+		return ioutil.NopCloser(strings.NewReader(""))
+	}
+	reader, err := Attachments.Open(key)
+	if err != nil {
+		log.Panic("Unable to open attachment", "model", rc.ModelName(), "field", fi.name, "key", key, "error", err)
+	}
+	return reader
+}
+
+// setAttachment stores the content read from r as the value of the
+// attachment field fi of all the records of rc. The content is scanned by
+// the Antivirus before being stored.
+func (rc RecordCollection) setAttachment(fi *Field, r io.Reader) {
+	r, release := rc.scanAttachment(InfectedFileError{Model: rc.model.name, Field: fi.name}, r)
+	defer release()
+	key, size, err := Attachments.Store(r)
+	if err != nil {
+		log.Panic("Unable to store attachment", "model", rc.ModelName(), "field", fi.name, "error", err)
+	}
+	delQuery := `DELETE FROM attachment WHERE res_model = ? AND field = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(delQuery, rc.model.name, fi.json, rc.ids)
+	if size == 0 {
+		return
+	}
+	insQuery := `INSERT INTO attachment (res_model, res_id, field, store_fname, file_size) VALUES (?, ?, ?, ?, ?)`
+	for _, id := range rc.ids {
+		rc.env.Cr().Execute(insQuery, rc.model.name, id, fi.json, key, size)
+	}
+}
+
+// updateAttachmentFields writes the values of the attachment fields
+// of the given FieldMap for all records of rc.
+func (rc RecordCollection) updateAttachmentFields(fMap FieldMap) {
+	if rc.IsEmpty() {
+		return
+	}
+	for fName, value := range fMap {
+		fi, ok := rc.model.fields.get(fName)
+		if !ok || !fi.isAttachmentField() {
+			continue
+		}
+		if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+			continue
+		}
+		data, _ := value.(string)
+		rc.setAttachment(fi, strings.NewReader(data))
+	}
+}
+
+// deleteAttachments deletes the references to the attachments of the records of rc.
+// It must be called when the records are deleted. The contents are kept in the
+// AttachmentStore since they may be shared with other records.
+func (rc RecordCollection) deleteAttachments() {
+	if len(rc.ids) == 0 {
+		return
+	}
+	query := `DELETE FROM attachment WHERE res_model = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(query, rc.model.name, rc.ids)
+}
+
+// OpenBinary returns a reader on the value of the given binary field of this
+// singleton. The reader must be closed by the caller. Values of attachment
+// fields are streamed from the AttachmentStore.
+func (rc RecordCollection) OpenBinary(fieldName string) io.ReadCloser {
+	rSet := rc.Fetch()
+	rSet.EnsureOne()
+	fi := rSet.binaryField(fieldName)
+	if !checkFieldPermission(fi, rSet.env.uid, security.Read) {
+		log.Panic("You are not allowed to read this field", "model", rSet.ModelName(), "field", fieldName)
+	}
+	if !fi.isAttachmentField() {
+		return ioutil.NopCloser(strings.NewReader(rSet.Get(fi.name).(string)))
+	}
+	return rSet.openAttachment(fi)
+}
+
+// WriteBinary sets the value of the given binary field of all the records of
+// this RecordCollection to the content read from r. Values of attachment
+// fields are streamed to the AttachmentStore.
+func (rc RecordCollection) WriteBinary(fieldName string, r io.Reader) {
+	fi := rc.binaryField(fieldName)
+	if !fi.isAttachmentField() {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			log.Panic("Unable to read binary value", "model", rc.ModelName(), "field", fieldName, "error", err)
+		}
+		rc.Call("Write", FieldMap{fi.json: string(data)})
+		return
+	}
+	rc.checkNotAsOf()
+	rc.checkWritable("write")
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write).Fetch()
+	if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+		log.Panic("You are not allowed to modify this field", "model", rc.ModelName(), "field", fieldName)
+	}
+	if rSet.IsEmpty() {
+		return
+	}
+	rSet.setAttachment(fi, r)
+	rSet.updateStoredFields(FieldMap{fi.json: nil})
+}
+
+// binaryField returns the binary field with the given name or panics.
+func (rc RecordCollection) binaryField(fieldName string) *Field {
+	fi := rc.model.fields.MustGet(fieldName)
+	if fi.fieldType != fieldtype.Binary {
+		log.Panic("Field is not a binary field", "model", rc.ModelName(), "field", fieldName)
+	}
+	return fi
+}
+
+// Attach stores the content read from r as a file with the given name attached
+// to this singleton and returns it. The content is scanned by the Antivirus
+// before being stored. Attaching the same content with the same name twice
+// to a record returns the existing attachment.
+//
+// It panics with an AccessError if the current user cannot modify the record.
+func (rc RecordCollection) Attach(fileName string, r io.Reader) AttachmentInfo {
+	rc.checkNotAsOf()
+	rc.checkWritable("write")
+	rc.checkExecutionPermission(rc.model.methods.MustGet("Write"))
+	rc.EnsureOne()
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write).Fetch()
+	if rSet.IsEmpty() {
+		panic(AccessError{
+			Model:   rc.model.name,
+			Message: fmt.Sprintf("You are not allowed to attach files to this %s record", rc.model.name),
+		})
+	}
+	r, release := rSet.scanAttachment(InfectedFileError{Model: rc.model.name, FileName: fileName}, r)
+	defer release()
+	hash := sha1.New()
+	key, size, err := Attachments.Store(io.TeeReader(r, hash))
+	if err != nil {
+		log.Panic("Unable to store attachment", "model", rc.ModelName(), "file", fileName, "error", err)
+	}
+	info := AttachmentInfo{
+		ResModel:   rc.model.name,
+		ResID:      rSet.ids[0],
+		Name:       fileName,
+		MimeType:   mime.TypeByExtension(filepath.Ext(fileName)),
+		FileSize:   size,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		StoreFname: key,
+	}
+	if info.MimeType == "" {
+		info.MimeType = "application/octet-stream"
+	}
+	if existing, ok := rSet.findAttachment(info); ok {
+		return existing
+	}
+	insQuery := `INSERT INTO attachment (res_model, res_id, field, name, mimetype, store_fname, file_size, checksum)
+		VALUES (?, ?, '', ?, ?, ?, ?, ?)`
+	rc.env.Cr().Execute(insQuery, info.ResModel, info.ResID, info.Name, info.MimeType, info.StoreFname,
+		info.FileSize, info.Checksum)
+	info, _ = rSet.findAttachment(info)
+	return info
+}
+
+// findAttachment returns the file attached to this singleton with the
+// name and checksum of the given attachment, if any.
+func (rc RecordCollection) findAttachment(info AttachmentInfo) (AttachmentInfo, bool) {
+	var res []AttachmentInfo
+	query := fmt.Sprintf(`SELECT %s FROM attachment WHERE res_model = ? AND res_id = ? AND field = ''
+		AND checksum = ? AND name = ? ORDER BY id LIMIT 1`, attachmentInfoColumns)
+	rc.env.Cr().Select(&res, query, rc.model.name, rc.ids[0], info.Checksum, info.Name)
+	if len(res) == 0 {
+		return info, false
+	}
+	return res[0], true
+}
+
+// Attachments returns the files attached to the records of this
+// RecordCollection that the current user can read, ordered by creation.
+// The files stored in attachment binary fields are not returned.
+func (rc RecordCollection) Attachments() []AttachmentInfo {
+	rSet := rc.Fetch()
+	if rSet.IsEmpty() {
+		return nil
+	}
+	var res []AttachmentInfo
+	query := fmt.Sprintf(`SELECT %s FROM attachment WHERE res_model = ? AND res_id IN (?) AND field = ''
+		ORDER BY id`, attachmentInfoColumns)
+	rSet.env.Cr().Select(&res, query, rSet.model.name, rSet.ids)
+	return res
+}
+
+// OpenAttachment returns the attachment with the given id and a reader on its
+// content, which must be closed by the caller.
+//
+// It panics with an AccessError if the attachment does not exist or if the
+// current user cannot read the record it is attached to.
+func OpenAttachment(env Environment, id int64) (AttachmentInfo, io.ReadCloser) {
+	var infos []AttachmentInfo
+	query := fmt.Sprintf(`SELECT %s FROM attachment WHERE id = ? AND field = ''`, attachmentInfoColumns)
+	env.Cr().Select(&infos, query, id)
+	if len(infos) == 0 {
+		panic(AccessError{Model: "Attachment", Message: "This attachment does not exist or has been deleted"})
+	}
+	info := infos[0]
+	mi, ok := Registry.Get(info.ResModel)
+	if !ok || env.Pool(mi.name).Search(mi.Field("ID").Equals(info.ResID)).Fetch().IsEmpty() {
+		panic(AccessError{
+			Model:   info.ResModel,
+			Message: fmt.Sprintf("You are not allowed to read the attachments of this %s record", info.ResModel),
+		})
+	}
+	reader, err := Attachments.Open(info.StoreFname)
+	if err != nil {
+		log.Panic("Unable to open attachment", "id", id, "key", info.StoreFname, "error", err)
+	}
+	return info, reader
+}
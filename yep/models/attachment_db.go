@@ -0,0 +1,88 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A DBStore is an AttachmentStore that stores contents in the database, in
+// the AttachmentContent system model. Contents are addressed by their SHA1
+// checksum so that identical contents are only stored once.
+//
+// Contents are stored outside of the transactions, like with the other
+// stores, so that they can be shared by attachments of several transactions.
+// It is meant for small deployments where the database is the only storage.
+type DBStore struct{}
+
+// An attachmentContent is a content of the DBStore
+type attachmentContent struct {
+	StoreKey string
+	Data     []byte
+	FileSize int64
+	Date     time.Time
+}
+
+// declareAttachmentContentModel creates the system model
+// in which the contents of the DBStore are stored.
+func declareAttachmentContentModel() {
+	content := createModel("AttachmentContent", SystemModel)
+	content.AddCharField("StoreKey", StringFieldParams{JSON: "store_key", Required: true, Index: true})
+	content.AddBinaryField("Data", SimpleFieldParams{JSON: "data"})
+	content.AddIntegerField("FileSize", SimpleFieldParams{JSON: "file_size"})
+	content.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true})
+	content.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// Open returns a reader on the content stored with the given key.
+func (s DBStore) Open(key string) (io.ReadCloser, error) {
+	var contents []attachmentContent
+	dbSelectNoTx(&contents, `SELECT data FROM attachment_content WHERE store_key = ? LIMIT 1`, key)
+	if len(contents) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents[0].Data)), nil
+}
+
+// Store stores the content read from r and returns its key and size.
+func (s DBStore) Store(r io.Reader) (string, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := sha1.Sum(data)
+	key := hex.EncodeToString(sum[:])
+	var count int
+	dbGetNoTx(&count, `SELECT COUNT(*) FROM attachment_content WHERE store_key = ?`, key)
+	if count == 0 {
+		dbExecuteNoTx(`INSERT INTO attachment_content (store_key, data, file_size, date) VALUES (?, ?, ?, ?)`,
+			key, data, len(data), time.Now())
+	}
+	return key, int64(len(data)), nil
+}
+
+// List returns all the contents of the store
+func (s DBStore) List() ([]StoredContent, error) {
+	var contents []attachmentContent
+	dbSelectNoTx(&contents, `SELECT store_key, file_size, date FROM attachment_content ORDER BY store_key`)
+	res := make([]StoredContent, len(contents))
+	for i, content := range contents {
+		res[i] = StoredContent{Key: content.StoreKey, Size: content.FileSize, ModTime: content.Date}
+	}
+	return res, nil
+}
+
+// Delete removes the content with the given key from the store
+func (s DBStore) Delete(key string) error {
+	dbExecuteNoTx(`DELETE FROM attachment_content WHERE store_key = ?`, key)
+	return nil
+}
+
+var _ CollectableStore = DBStore{}
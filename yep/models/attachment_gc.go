@@ -0,0 +1,203 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A StoredContent describes a content of an AttachmentStore
+type StoredContent struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// A CollectableStore is an AttachmentStore whose contents can be listed
+// and deleted, so that unreferenced contents can be garbage collected.
+type CollectableStore interface {
+	AttachmentStore
+	// List returns all the contents of the store
+	List() ([]StoredContent, error)
+	// Delete removes the content with the given key from the store
+	Delete(key string) error
+}
+
+// An AttachmentGCReport is the result of an attachment garbage collection
+type AttachmentGCReport struct {
+	// Scanned is the number of contents found in the store
+	Scanned int
+	// Referenced is the number of contents still referenced by attachments
+	Referenced int
+	// Deleted is the number of deleted contents
+	Deleted int
+	// Reclaimed is the total size in bytes of the deleted contents
+	Reclaimed int64
+}
+
+// String returns a human readable summary of this report
+func (r AttachmentGCReport) String() string {
+	return fmt.Sprintf("%d contents scanned, %d referenced, %d deleted, %d bytes reclaimed",
+		r.Scanned, r.Referenced, r.Deleted, r.Reclaimed)
+}
+
+// CollectAttachmentGarbage deletes from the given store the contents that
+// are not referenced by any attachment and returns a report of the
+// reclaimed space.
+//
+// Since identical contents are stored once and shared by attachments, a
+// content is only deleted if no attachment references it anymore. Contents
+// modified less than gracePeriod ago are never deleted, because they may
+// have been stored by a transaction that is not committed yet.
+func CollectAttachmentGarbage(env Environment, store CollectableStore, gracePeriod time.Duration) (AttachmentGCReport, error) {
+	var report AttachmentGCReport
+	contents, err := store.List()
+	if err != nil {
+		return report, err
+	}
+	var keys []string
+	env.Cr().Select(&keys, `SELECT DISTINCT store_fname FROM attachment`)
+	referenced := make(map[string]bool)
+	for _, key := range keys {
+		referenced[key] = true
+	}
+	limit := time.Now().Add(-gracePeriod)
+	for _, content := range contents {
+		report.Scanned++
+		if referenced[content.Key] {
+			report.Referenced++
+			continue
+		}
+		if content.ModTime.After(limit) {
+			continue
+		}
+		if err := store.Delete(content.Key); err != nil {
+			return report, err
+		}
+		log.Debug("Deleted unreferenced attachment content", "key", content.Key, "size", content.Size)
+		report.Deleted++
+		report.Reclaimed += content.Size
+	}
+	return report, nil
+}
+
+var _ CollectableStore = FileSystemStore{}
+
+// List returns all the contents of the store. Temporary files of
+// contents being stored are not returned.
+func (fs FileSystemStore) List() ([]StoredContent, error) {
+	var res []StoredContent
+	err := filepath.Walk(fs.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == fs.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !isContentKey(info.Name()) {
+			return nil
+		}
+		res = append(res, StoredContent{
+			Key:     info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return res, err
+}
+
+// Delete removes the content with the given key from the store
+func (fs FileSystemStore) Delete(key string) error {
+	return os.Remove(fs.path(key))
+}
+
+// isContentKey returns true if the given name is a valid content key,
+// i.e. the hexadecimal representation of a SHA1 checksum.
+func isContentKey(name string) bool {
+	if len(name) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+var _ CollectableStore = S3Store{}
+
+// s3ListResult is the result of a ListObjectsV2 request
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+// List returns all the contents of the store, i.e. the objects of the
+// bucket whose key starts with the store's prefix.
+func (s S3Store) List() ([]StoredContent, error) {
+	var res []StoredContent
+	prefix := strings.TrimPrefix(path.Join(s.Prefix, "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		resp, err := s.request(http.MethodGet, s.Bucket, query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to list objects of bucket %s: %s", s.Bucket, resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			key := strings.TrimPrefix(obj.Key, prefix)
+			if !isContentKey(key) {
+				continue
+			}
+			res = append(res, StoredContent{
+				Key:     key,
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return res, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Delete removes the content with the given key from the store
+func (s S3Store) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to delete object %s: %s", key, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is the payload hash used to sign requests without
+// hashing their body, which allows to stream uploads.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// An S3Store is an AttachmentStore that stores contents as objects of a bucket
+// of an S3 compatible object storage, such as Amazon S3, Google Cloud Storage
+// (in interoperability mode) or MinIO. Objects are addressed by the SHA1
+// checksum of their content so that identical contents are only stored once.
+type S3Store struct {
+	// Endpoint is the base URL of the object storage service,
+	// e.g. "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string
+	// Region is the region of the bucket, e.g. "eu-west-1".
+	Region string
+	// Bucket is the name of the bucket in which objects are stored.
+	Bucket string
+	// Prefix is prepended to the keys of the objects (e.g. "yep/mydb").
+	Prefix string
+	// AccessKey and SecretKey are the credentials used to sign requests.
+	AccessKey string
+	SecretKey string
+	// SSE is the server side encryption algorithm to request for stored
+	// objects ("AES256" or "aws:kms"). Leave empty for no encryption.
+	SSE string
+	// Client is the http client used for requests.
+	// http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+var _ AttachmentStore = S3Store{}
+
+// Open returns a reader on the content stored with the given key.
+func (s S3Store) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to get object %s: %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Store stores the content read from r and returns its key and size.
+//
+// The content is first spooled to a temporary file to compute its checksum.
+// It is not uploaded if an object with the same key already exists.
+func (s S3Store) Store(r io.Reader) (string, int64, error) {
+	tmpFile, err := ioutil.TempFile("", "yep-attachment")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if err != nil {
+		return "", 0, err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+	exists, err := s.exists(key)
+	if err != nil || exists {
+		return key, size, err
+	}
+	if _, err := tmpFile.Seek(0, 0); err != nil {
+		return "", 0, err
+	}
+	resp, err := s.do(http.MethodPut, key, tmpFile, size)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unable to put object %s: %s", key, resp.Status)
+	}
+	return key, size, nil
+}
+
+// exists returns true if an object with the given key exists in the bucket.
+func (s S3Store) exists(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to check object %s: %s", key, resp.Status)
+}
+
+// do sends a signed request with the given method and body for the object
+// with the given key and returns the response.
+func (s S3Store) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	return s.request(method, path.Join(s.Bucket, s.Prefix, key), nil, body, size)
+}
+
+// request sends a signed request with the given method, query and body
+// to the given path of the endpoint and returns the response.
+func (s S3Store) request(method, reqPath string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	reqURL, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	reqURL.Path = path.Join("/", reqURL.Path, reqPath)
+	// Signature V4 requires spaces to be encoded as %20 in the query
+	reqURL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, reqURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if method == http.MethodPut && s.SSE != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption", s.SSE)
+	}
+	s.sign(req, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds to req the headers of an AWS Signature Version 4
+// authentication made at time t.
+func (s S3Store) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", t.Format("20060102"), s.Region)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lName := strings.ToLower(name); strings.HasPrefix(lName, "x-amz-") {
+			headers[lName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders string
+	for _, name := range headerNames {
+		canonicalHeaders += fmt.Sprintf("%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// sha256Sum returns the SHA256 checksum of data
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with the given key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
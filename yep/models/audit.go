@@ -0,0 +1,313 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"sort"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// asOfContextKey is the context key holding the date of
+// a RecordCollection in "as of" mode.
+const asOfContextKey = "yep_as_of_date"
+
+// Operations recorded in the audit trail
+const (
+	auditCreate = "create"
+	auditWrite  = "write"
+	auditUnlink = "unlink"
+)
+
+// A TrackVisibility sets how the modifications of a field
+// are recorded in the audit trail.
+type TrackVisibility string
+
+const (
+	// TrackNone means that the field is not audited
+	TrackNone TrackVisibility = ""
+	// TrackOnChange means that the modifications of the field are recorded
+	TrackOnChange TrackVisibility = "onchange"
+	// TrackAlways means that the value of the field is recorded with each
+	// modification of the record, even if the field itself is not modified,
+	// so that it is displayed in all the entries of the audit trail.
+	TrackAlways TrackVisibility = "always"
+)
+
+// An auditLine is a single modification of a field of a record
+// as stored in the audit trail.
+type auditLine struct {
+	OldValue string
+	Date     time.Time
+}
+
+// An auditTrailLine is a line of the audit trail of a record
+type auditTrailLine struct {
+	Field     string
+	OldValue  *string
+	NewValue  *string
+	Operation *string
+	Date      time.Time
+	UID       int64
+}
+
+// An AuditEntry is an operation on a record as recorded in the audit trail
+type AuditEntry struct {
+	Date      types.DateTime `json:"date"`
+	UID       int64          `json:"uid"`
+	Operation string         `json:"operation"`
+	Changes   []AuditChange  `json:"changes"`
+}
+
+// An AuditChange is the modification of a field in an AuditEntry. The values
+// of the fields tracked with TrackAlways are given as unchanged values.
+type AuditChange struct {
+	Field    string      `json:"field"`
+	OldValue interface{} `json:"old_value"`
+	NewValue interface{} `json:"new_value"`
+}
+
+// declareAuditLogModel creates the system model in which the
+// modifications of audited fields are recorded.
+func declareAuditLogModel() {
+	auditLog := createModel("AuditLog", SystemModel)
+	auditLog.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	auditLog.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	auditLog.AddCharField("Field", StringFieldParams{JSON: "field", Required: true})
+	auditLog.AddTextField("OldValue", StringFieldParams{JSON: "old_value"})
+	auditLog.AddTextField("NewValue", StringFieldParams{JSON: "new_value"})
+	auditLog.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true, Index: true})
+	auditLog.AddIntegerField("UID", SimpleFieldParams{JSON: "uid"})
+	auditLog.AddSelectionField("Operation", SelectionFieldParams{JSON: "operation",
+		Selection: types.Selection{
+			auditCreate: "Creation",
+			auditWrite:  "Modification",
+			auditUnlink: "Deletion",
+		}})
+	auditLog.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// auditedValues returns a FieldMap with the values of the audited fields
+// of the given FieldMap that the current user is allowed to write.
+// Keys of the returned FieldMap are the fields JSON names.
+func (rc RecordCollection) auditedValues(fMap FieldMap) FieldMap {
+	res := make(FieldMap)
+	for fName, value := range fMap {
+		fi, ok := rc.model.fields.get(fName)
+		if !ok || !fi.audited || !checkFieldPermission(fi, rc.env.uid, security.Write) {
+			continue
+		}
+		res[fi.json] = value
+	}
+	return res
+}
+
+// logAuditTrail records in the audit trail the modifications of audited fields
+// that are about to be written with the given FieldMap on the records of rc.
+// It must be called before the records are updated.
+func (rc RecordCollection) logAuditTrail(fMap FieldMap) {
+	values := rc.auditedValues(fMap)
+	if len(values) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, rec := range rc.Records() {
+		var changed bool
+		for fJSON, value := range values {
+			oldValue := encodeFieldValue(rec.get(fJSON, true))
+			newValue := encodeFieldValue(value)
+			if oldValue == newValue {
+				continue
+			}
+			rec.insertAuditLine(fJSON, auditWrite, oldValue, newValue, now)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		for _, fi := range rc.model.alwaysTrackedFields() {
+			if _, ok := values[fi.json]; ok {
+				continue
+			}
+			value := encodeFieldValue(rec.get(fi.json, true))
+			rec.insertAuditLine(fi.json, auditWrite, value, value, now)
+		}
+	}
+}
+
+// logAuditCreation records in the audit trail the values
+// of the audited fields of the records of rc, just created.
+func (rc RecordCollection) logAuditCreation() {
+	fields := rc.model.auditedFields()
+	if len(fields) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, rec := range rc.Records() {
+		for _, fi := range fields {
+			rec.insertAuditLine(fi.json, auditCreate, nil, encodeFieldValue(rec.get(fi.json, true)), now)
+		}
+	}
+}
+
+// logAuditDeletion records in the audit trail the values of the
+// audited fields of the records of rc, about to be deleted.
+func (rc RecordCollection) logAuditDeletion() {
+	fields := rc.model.auditedFields()
+	if len(fields) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, rec := range rc.Records() {
+		for _, fi := range fields {
+			rec.insertAuditLine(fi.json, auditUnlink, encodeFieldValue(rec.get(fi.json, true)), nil, now)
+		}
+	}
+}
+
+// insertAuditLine inserts a line in the audit trail of this singleton for
+// the given field. Values are nil before creation and after deletion.
+func (rc RecordCollection) insertAuditLine(fJSON, operation string, oldValue, newValue interface{}, date time.Time) {
+	query := `INSERT INTO audit_log (res_model, res_id, field, old_value, new_value, operation, date, uid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	rc.env.Cr().Execute(query, rc.model.name, rc.ids[0], fJSON, oldValue, newValue, operation, date, rc.env.uid)
+}
+
+// auditedFields returns the audited fields of this model sorted by JSON name
+func (m *Model) auditedFields() []*Field {
+	var res []*Field
+	for _, fi := range m.fields.registryByJSON {
+		if fi.audited {
+			res = append(res, fi)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].json < res[j].json })
+	return res
+}
+
+// alwaysTrackedFields returns the fields of this model whose value is
+// recorded with each modification of a record (see TrackAlways).
+func (m *Model) alwaysTrackedFields() []*Field {
+	var res []*Field
+	for _, fi := range m.auditedFields() {
+		if fi.trackVisibility == TrackAlways {
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
+// AuditTrail returns the operations recorded in the audit trail of this
+// singleton, from the most recent to the oldest, to be displayed for instance
+// below the form of the record like a chatter. Only the fields that the
+// current user can read are returned.
+func (rc RecordCollection) AuditTrail() []AuditEntry {
+	rc.EnsureOne()
+	var lines []auditTrailLine
+	query := `SELECT field, old_value, new_value, operation, date, uid FROM audit_log
+		WHERE res_model = ? AND res_id = ? ORDER BY id DESC`
+	rc.env.Cr().Select(&lines, query, rc.model.name, rc.ids[0])
+	var res []AuditEntry
+	for _, line := range lines {
+		fi, ok := rc.model.fields.get(line.Field)
+		if !ok || !checkFieldPermission(fi, rc.env.uid, security.Read) {
+			continue
+		}
+		operation := auditWrite
+		if line.Operation != nil && *line.Operation != "" {
+			operation = *line.Operation
+		}
+		date := types.DateTime(line.Date)
+		if len(res) == 0 || !time.Time(res[len(res)-1].Date).Equal(line.Date) ||
+			res[len(res)-1].UID != line.UID || res[len(res)-1].Operation != operation {
+			res = append(res, AuditEntry{Date: date, UID: line.UID, Operation: operation})
+		}
+		entry := &res[len(res)-1]
+		entry.Changes = append(entry.Changes, AuditChange{
+			Field:    fi.json,
+			OldValue: rc.auditValue(fi, line.OldValue),
+			NewValue: rc.auditValue(fi, line.NewValue),
+		})
+	}
+	for _, entry := range res {
+		changes := entry.Changes
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	}
+	return res
+}
+
+// auditValue returns the value of field fi serialized in the audit trail
+// as data, which is nil before creation and after deletion. Sensitive
+// values are masked if the current user cannot see them.
+func (rc RecordCollection) auditValue(fi *Field, data *string) interface{} {
+	if data == nil {
+		return nil
+	}
+	if fi.isSensitive() && !rc.canSeeSensitiveHistory() {
+		return fi.maskedValue()
+	}
+	return rc.model.decodeFieldValue(fi, *data)
+}
+
+// AsOf returns a read-only copy of this RecordCollection in which the
+// values of audited fields are those they had at the given date.
+// Non audited fields return their current value.
+//
+// Calling Create, Write or Unlink on the returned RecordCollection panics.
+func (rc RecordCollection) AsOf(date types.DateTime) RecordCollection {
+	return rc.WithContext(asOfContextKey, date)
+}
+
+// asOfDate returns the date of this RecordCollection if it is
+// in "as of" mode. The second returned value is false otherwise.
+func (rc RecordCollection) asOfDate() (types.DateTime, bool) {
+	if rc.env.context == nil || !rc.env.context.HasKey(asOfContextKey) {
+		return types.DateTime{}, false
+	}
+	return rc.env.context.Get(asOfContextKey).(types.DateTime), true
+}
+
+// checkNotAsOf panics if this RecordCollection is in "as of" mode
+// since such a RecordCollection is read-only.
+func (rc RecordCollection) checkNotAsOf() {
+	if date, ok := rc.asOfDate(); ok {
+		log.Panic("Trying to modify a RecordSet in 'as of' mode", "model", rc.ModelName(), "date", date)
+	}
+}
+
+// ValuesAsOf returns the values of the audited fields of this singleton
+// at the given date, reconstructed from the audit trail.
+func (rc RecordCollection) ValuesAsOf(date types.DateTime) FieldMap {
+	rSet := rc.Fetch()
+	rSet.EnsureOne()
+	res := make(FieldMap)
+	for _, fi := range rSet.model.fields.registryByJSON {
+		if !fi.audited {
+			continue
+		}
+		res[fi.name] = rSet.valueAsOf(fi, date)
+	}
+	return res
+}
+
+// valueAsOf returns the raw value of the audited field fi of this singleton
+// at the given date. This is the old value of the first modification that
+// happened after date or the current value if the field has not been
+// modified since.
+func (rc RecordCollection) valueAsOf(fi *Field, date types.DateTime) interface{} {
+	var lines []auditLine
+	query := `SELECT old_value, date FROM audit_log
+		WHERE res_model = ? AND res_id = ? AND field = ? AND date > ? AND old_value IS NOT NULL
+		ORDER BY date, id LIMIT 1`
+	rc.env.Cr().Select(&lines, query, rc.model.name, rc.ids[0], fi.json, time.Time(date))
+	if len(lines) == 0 {
+		return rc.get(fi.json, true)
+	}
+	if fi.isSensitive() && !rc.canSeeSensitiveHistory() {
+		return fi.maskedValue()
+	}
+	return rc.model.decodeFieldValue(fi, lines[0].OldValue)
+}
@@ -0,0 +1,469 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/expr"
+)
+
+// An AutomationTrigger is the operation on records that triggers an automation
+type AutomationTrigger string
+
+// Automation triggers
+const (
+	TriggerOnCreate        AutomationTrigger = "on_create"
+	TriggerOnWrite         AutomationTrigger = "on_write"
+	TriggerOnCreateOrWrite AutomationTrigger = "on_create_or_write"
+	TriggerOnUnlink        AutomationTrigger = "on_unlink"
+)
+
+// An AutomationAction is the kind of action run by an automation
+type AutomationAction string
+
+// Automation actions
+const (
+	ActionMethod AutomationAction = "method"
+	ActionWrite  AutomationAction = "write"
+	ActionEmail  AutomationAction = "email"
+	ActionSMS    AutomationAction = "sms"
+)
+
+// Statuses of the executions of automations
+const (
+	automationSuccess = "success"
+	automationFailure = "failure"
+)
+
+// automationsContextKey is the context key holding the ids of the automations
+// whose action is running, so that an automation never triggers itself.
+const automationsContextKey = "yep_running_automations"
+
+// templateExprRegexp matches the expressions of the email templates of automations
+var templateExprRegexp = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+// An automationRule is an automation as stored in the automation table
+type automationRule struct {
+	ID            int64  `db:"id"`
+	Name          string `db:"name"`
+	ResModel      string `db:"res_model"`
+	TriggerType   string `db:"trigger_type"`
+	TriggerFields string `db:"trigger_fields"`
+	Condition     string `db:"condition_expr"`
+	Action        string `db:"action"`
+	Method        string `db:"method"`
+	WriteValues   string `db:"write_values"`
+	EmailTo       string `db:"email_to"`
+	EmailSubject  string `db:"email_subject"`
+	EmailBody     string `db:"email_body"`
+	SMSTemplateID int64  `db:"sms_template_id"`
+}
+
+// automationColumns are the columns of the automation table read into automationRule
+const automationColumns = `id, name, res_model, trigger_type, trigger_fields, condition_expr, action, method,
+	write_values, email_to, email_subject, email_body, COALESCE(sms_template_id, 0) AS sms_template_id`
+
+// declareAutomationModels creates the system models in which automations
+// and the log of their executions are stored.
+func declareAutomationModels() {
+	automation := createModel("Automation", SystemModel)
+	automation.AddCharField("Name", StringFieldParams{JSON: "name", Required: true})
+	automation.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true,
+		Constraint: "checkAutomation"})
+	automation.AddActiveField(SimpleFieldParams{JSON: "active"})
+	automation.AddIntegerField("Sequence", SimpleFieldParams{JSON: "sequence"})
+	automation.AddSelectionField("TriggerType", SelectionFieldParams{JSON: "trigger_type", Required: true,
+		Constraint: "checkAutomation",
+		Selection: types.Selection{
+			string(TriggerOnCreate):        "On Creation",
+			string(TriggerOnWrite):         "On Update",
+			string(TriggerOnCreateOrWrite): "On Creation & Update",
+			string(TriggerOnUnlink):        "On Deletion",
+			string(TriggerOnSLABreach):     "On SLA Breach",
+		}})
+	automation.AddCharField("TriggerFields", StringFieldParams{JSON: "trigger_fields", Constraint: "checkAutomation"})
+	automation.AddTextField("Condition", StringFieldParams{JSON: "condition_expr", Constraint: "checkAutomation"})
+	automation.AddSelectionField("Action", SelectionFieldParams{JSON: "action", Required: true,
+		Constraint: "checkAutomation",
+		Selection: types.Selection{
+			string(ActionMethod): "Call a Method",
+			string(ActionWrite):  "Update the Record",
+			string(ActionEmail):  "Send an Email",
+			string(ActionSMS):    "Send an SMS",
+		}})
+	automation.AddCharField("Method", StringFieldParams{JSON: "method", Constraint: "checkAutomation"})
+	automation.AddTextField("WriteValues", StringFieldParams{JSON: "write_values", Constraint: "checkAutomation"})
+	automation.AddCharField("EmailTo", StringFieldParams{JSON: "email_to", Constraint: "checkAutomation"})
+	automation.AddCharField("EmailSubject", StringFieldParams{JSON: "email_subject", Constraint: "checkAutomation"})
+	automation.AddTextField("EmailBody", StringFieldParams{JSON: "email_body", Constraint: "checkAutomation"})
+	automation.AddIntegerField("SMSTemplateID", SimpleFieldParams{JSON: "sms_template_id", Constraint: "checkAutomation"})
+	automation.InheritModel(Registry.MustGet("CommonMixin"))
+
+	automation.AddMethod("checkAutomation",
+		`checkAutomation returns an error if one of the automations of this
+		RecordSet cannot be run on its model.`,
+		func(rc RecordCollection) error {
+			for _, id := range rc.Ids() {
+				var rules []automationRule
+				query := fmt.Sprintf(`SELECT %s FROM automation WHERE id = ?`, automationColumns)
+				rc.env.Cr().Select(&rules, query, id)
+				for _, rule := range rules {
+					if err := rule.check(); err != nil {
+						return fmt.Errorf("invalid automation '%s': %s", rule.Name, err)
+					}
+					if AutomationAction(rule.Action) != ActionSMS {
+						continue
+					}
+					tmpl, ok := getSMSTemplate(rc.env, rule.SMSTemplateID)
+					if !ok {
+						return fmt.Errorf("invalid automation '%s': unknown SMS template %d", rule.Name, rule.SMSTemplateID)
+					}
+					if tmpl.ResModel != rule.ResModel {
+						return fmt.Errorf("invalid automation '%s': SMS template '%s' is bound to model '%s'",
+							rule.Name, tmpl.Name, tmpl.ResModel)
+					}
+				}
+			}
+			return nil
+		})
+
+	automationLog := createModel("AutomationLog", SystemModel)
+	automationLog.AddIntegerField("AutomationID", SimpleFieldParams{JSON: "automation_id", Required: true, Index: true})
+	automationLog.AddCharField("Name", StringFieldParams{JSON: "name"})
+	automationLog.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true})
+	automationLog.AddTextField("ResIDs", StringFieldParams{JSON: "res_ids"})
+	automationLog.AddSelectionField("Status", SelectionFieldParams{JSON: "status", Required: true,
+		Selection: types.Selection{
+			automationSuccess: "Success",
+			automationFailure: "Failure",
+		}})
+	automationLog.AddTextField("Message", StringFieldParams{JSON: "message"})
+	automationLog.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true, Index: true})
+	automationLog.AddIntegerField("UID", SimpleFieldParams{JSON: "uid"})
+	automationLog.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// check returns an error if this automation cannot be run on its model
+func (ar automationRule) check() error {
+	mi, ok := Registry.Get(ar.ResModel)
+	if !ok || mi.isSystem() || mi.isMixin() {
+		return fmt.Errorf("unknown model '%s'", ar.ResModel)
+	}
+	if AutomationTrigger(ar.TriggerType) == TriggerOnSLABreach && !mi.hasSLA() {
+		return fmt.Errorf("model '%s' does not inherit %s", ar.ResModel, slaMixinName)
+	}
+	for _, fName := range ar.triggerFields() {
+		if _, ok := mi.fields.get(fName); !ok {
+			return fmt.Errorf("unknown trigger field '%s'", fName)
+		}
+	}
+	if ar.Condition != "" {
+		program, err := expr.Compile(ar.Condition)
+		if err != nil {
+			return err
+		}
+		if err = mi.CheckExpr(program); err != nil {
+			return err
+		}
+	}
+	switch AutomationAction(ar.Action) {
+	case ActionMethod:
+		method, ok := mi.methods.get(ar.Method)
+		if !ok {
+			return fmt.Errorf("unknown method '%s'", ar.Method)
+		}
+		if method.methodType.NumIn() > 2 || method.methodType.NumIn() == 2 && !method.methodType.IsVariadic() {
+			return fmt.Errorf("method '%s' must not take arguments", ar.Method)
+		}
+	case ActionWrite:
+		values, err := ar.writeValues()
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("no values to write")
+		}
+		for fName, src := range values {
+			if _, ok := mi.fields.get(fName); !ok {
+				return fmt.Errorf("unknown field '%s' in values", fName)
+			}
+			program, err := expr.Compile(src)
+			if err != nil {
+				return err
+			}
+			if err = mi.CheckExpr(program); err != nil {
+				return err
+			}
+		}
+	case ActionEmail:
+		if strings.TrimSpace(ar.EmailTo) == "" {
+			return fmt.Errorf("no email recipients")
+		}
+		for _, tmpl := range []string{ar.EmailTo, ar.EmailSubject, ar.EmailBody} {
+			if err := mi.checkTemplate(tmpl); err != nil {
+				return err
+			}
+		}
+	case ActionSMS:
+		if ar.SMSTemplateID == 0 {
+			return fmt.Errorf("no SMS template")
+		}
+	}
+	return nil
+}
+
+// triggerFields returns the names of the trigger fields of this automation
+func (ar automationRule) triggerFields() []string {
+	var res []string
+	for _, fName := range strings.Split(ar.TriggerFields, ",") {
+		if fName = strings.TrimSpace(fName); fName != "" {
+			res = append(res, fName)
+		}
+	}
+	return res
+}
+
+// writeValues returns the expressions of the values to write
+// by this automation, by field name.
+func (ar automationRule) writeValues() (map[string]string, error) {
+	var res map[string]string
+	if err := json.Unmarshal([]byte(ar.WriteValues), &res); err != nil {
+		return nil, fmt.Errorf("values must be a JSON object of expressions: %s", err)
+	}
+	return res, nil
+}
+
+// matches returns true if this automation is triggered by the given
+// operation on the given fields. fields are JSON names and are only
+// given for TriggerOnWrite.
+func (ar automationRule) matches(mi *Model, trigger AutomationTrigger, fields []string) bool {
+	switch AutomationTrigger(ar.TriggerType) {
+	case trigger:
+	case TriggerOnCreateOrWrite:
+		if trigger != TriggerOnCreate && trigger != TriggerOnWrite {
+			return false
+		}
+	default:
+		return false
+	}
+	triggerFields := ar.triggerFields()
+	if trigger != TriggerOnWrite || len(triggerFields) == 0 {
+		return true
+	}
+	for _, fName := range triggerFields {
+		for _, field := range fields {
+			if mi.JSONizeFieldName(fName) == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// automationRules returns the active automations of the model of this
+// RecordCollection, in the order in which they must be run.
+func (rc RecordCollection) automationRules() []automationRule {
+	var rules []automationRule
+	query := fmt.Sprintf(`SELECT %s FROM automation WHERE res_model = ? AND active = ? ORDER BY sequence, id`,
+		automationColumns)
+	rc.env.Cr().Select(&rules, query, rc.model.name, true)
+	return rules
+}
+
+// runningAutomations returns the ids of the automations whose action
+// is running in the environment of this RecordCollection.
+func (rc RecordCollection) runningAutomations() []int64 {
+	if rc.env.context == nil || !rc.env.context.HasKey(automationsContextKey) {
+		return nil
+	}
+	return rc.env.context.Get(automationsContextKey).([]int64)
+}
+
+// runAutomations runs the automations of the model of rc that are triggered
+// by the given operation on the given fields of the records of rc. It must be
+// called after the records are created or updated, and before they are
+// deleted.
+//
+// Automations are not run on system models, and an automation is not run
+// from its own action, directly or through other automations, so that
+// automations cannot loop.
+func (rc RecordCollection) runAutomations(trigger AutomationTrigger, fieldNames []string) {
+	if rc.model.isSystem() || len(rc.ids) == 0 {
+		return
+	}
+	var fields []string
+	if trigger == TriggerOnWrite {
+		fields = rc.model.changedFields(fieldNames)
+		if len(fields) == 0 {
+			return
+		}
+	}
+	running := rc.runningAutomations()
+	for _, rule := range rc.automationRules() {
+		if !rule.matches(rc.model, trigger, fields) || isRunningAutomation(running, rule.ID) {
+			continue
+		}
+		chain := append(append([]int64{}, running...), rule.ID)
+		rule.run(rc.WithContext(automationsContextKey, chain))
+	}
+}
+
+// isRunningAutomation returns true if id is in the given running automations
+func isRunningAutomation(running []int64, id int64) bool {
+	for _, r := range running {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the action of this automation on the records of rc that satisfy
+// its condition and logs its execution. If the action fails, the failure is
+// logged outside of the transaction and the panic is propagated so that the
+// transaction is rolled back.
+func (ar automationRule) run(rc RecordCollection) {
+	var ids []int64
+	defer func() {
+		if r := recover(); r != nil {
+			ar.logFailure(rc, ids, r)
+			panic(r)
+		}
+	}()
+	records := ar.filter(rc)
+	ids = records.ids
+	if len(ids) == 0 {
+		return
+	}
+	switch AutomationAction(ar.Action) {
+	case ActionMethod:
+		records.Call(ar.Method)
+	case ActionWrite:
+		values, err := ar.writeValues()
+		if err != nil {
+			log.Panic("Invalid automation values", "automation", ar.Name, "error", err)
+		}
+		for _, rec := range records.Records() {
+			fMap := make(FieldMap)
+			for fName, src := range values {
+				fi := rec.model.fields.MustGet(fName)
+				fMap[fi.name] = expr.Value(rec.EvalExpr(expr.MustCompile(src)))
+			}
+			rec.Call("Write", fMap)
+		}
+	case ActionEmail:
+		for _, rec := range records.Records() {
+			ar.sendEmail(rec)
+		}
+	case ActionSMS:
+		records.QueueSMSTemplate(ar.SMSTemplateID)
+	}
+	query := `INSERT INTO automation_log (automation_id, name, res_model, res_ids, status, date, uid)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	rc.env.Cr().Execute(query, ar.ID, ar.Name, rc.model.name, formatIDs(ids), automationSuccess, time.Now(), rc.env.uid)
+}
+
+// filter returns the records of rc that satisfy the condition of this automation
+func (ar automationRule) filter(rc RecordCollection) RecordCollection {
+	if ar.Condition == "" {
+		return rc
+	}
+	program, err := expr.Compile(ar.Condition)
+	if err != nil {
+		log.Panic("Invalid automation condition", "automation", ar.Name, "error", err)
+	}
+	var ids []int64
+	for _, rec := range rc.Records() {
+		if expr.Truth(rec.EvalExpr(program)) {
+			ids = append(ids, rec.ids[0])
+		}
+	}
+	return rc.withIds(ids)
+}
+
+// sendEmail sends the email of this automation for the given record
+// with AutomationMails. The email is only logged if it is nil.
+func (ar automationRule) sendEmail(rec RecordCollection) {
+	var to []string
+	for _, address := range strings.Split(renderTemplate(rec, ar.EmailTo), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	subject := renderTemplate(rec, ar.EmailSubject)
+	if AutomationMails == nil {
+		log.Info("Automation email not sent", "automation", ar.Name, "to", to, "subject", subject)
+		return
+	}
+	if err := AutomationMails.SendMail(to, subject, renderTemplate(rec, ar.EmailBody)); err != nil {
+		log.Panic("Unable to send automation email", "automation", ar.Name, "to", to, "error", err)
+	}
+}
+
+// logFailure records the failure of this automation on the records with the
+// given ids outside of the current transaction, which is about to be rolled
+// back. Errors while logging are only reported in the logs, so that they do
+// not hide the failure.
+func (ar automationRule) logFailure(rc RecordCollection, ids []int64, failure interface{}) {
+	log.Warn("Automation failed", "automation", ar.Name, "model", rc.model.name, "ids", ids, "error", failure)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Unable to log automation failure", "automation", ar.Name, "error", r)
+		}
+	}()
+	query := `INSERT INTO automation_log (automation_id, name, res_model, res_ids, status, message, date, uid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	dbExecuteNoTx(query, ar.ID, ar.Name, rc.model.name, formatIDs(ids), automationFailure, fmt.Sprint(failure),
+		time.Now(), rc.env.uid)
+}
+
+// formatIDs returns the given ids separated by commas
+func formatIDs(ids []int64) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprintf("%d", id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// renderTemplate returns the given template in which each {{ expression }}
+// is replaced by its value for the given record.
+func renderTemplate(rec RecordCollection, tmpl string) string {
+	return templateExprRegexp.ReplaceAllStringFunc(tmpl, func(match string) string {
+		src := templateExprRegexp.FindStringSubmatch(match)[1]
+		switch value := expr.Value(rec.EvalExpr(expr.MustCompile(src))).(type) {
+		case nil:
+			return ""
+		case time.Time:
+			return value.Format("2006-01-02 15:04:05")
+		default:
+			return fmt.Sprint(value)
+		}
+	})
+}
+
+// checkTemplate returns an error if one of the expressions
+// of the given template is not valid for this model.
+func (m *Model) checkTemplate(tmpl string) error {
+	for _, match := range templateExprRegexp.FindAllStringSubmatch(tmpl, -1) {
+		program, err := expr.Compile(match[1])
+		if err != nil {
+			return err
+		}
+		if err = m.CheckExpr(program); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AutomationMails is the MailSender of the emails of automations.
+// Emails are only logged if it is nil.
+var AutomationMails MailSender
@@ -0,0 +1,130 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/bank"
+)
+
+// A bankFormat is the kind of bank account identifier held by a char field
+type bankFormat int8
+
+const (
+	noBankFormat bankFormat = iota
+	ibanFormat
+	bicFormat
+)
+
+// AddIBANField adds an IBAN field with the given name to this Model.
+// IBAN fields are sensitive char fields whose values are stored in electronic
+// format and validated with their check digits. They are read by clients in
+// print format, masked for users that are not administrators or members of
+// the groups set with SetUnmaskedGroups.
+func (m *Model) AddIBANField(name string, params StringFieldParams) *Field {
+	if params.Size == 0 {
+		params.Size = 34
+	}
+	params.Sensitive = true
+	fi := m.AddCharField(name, params)
+	fi.bankFormat = ibanFormat
+	return fi
+}
+
+// AddBICField adds a BIC field with the given name to this Model.
+// BIC fields are char fields whose values are stored in upper case
+// and validated.
+func (m *Model) AddBICField(name string, params StringFieldParams) *Field {
+	if params.Size == 0 {
+		params.Size = 11
+	}
+	fi := m.AddCharField(name, params)
+	fi.bankFormat = bicFormat
+	return fi
+}
+
+// SetUnmaskedGroups sets the groups whose members read the values
+// of this IBAN field in full, in addition to administrators.
+func (f *Field) SetUnmaskedGroups(value []string) *Field {
+	if f.bankFormat != ibanFormat {
+		log.Panic("Only IBAN fields can have unmasked groups", "model", f.model.name, "field", f.name)
+	}
+	f.unmaskedGroups = value
+	return f
+}
+
+// canSeeFullIBAN returns true if the given user can read the
+// values of this IBAN field without mask.
+func (f *Field) canSeeFullIBAN(uid int64) bool {
+	if uid == security.SuperUserID || security.Registry.HasMembership(uid, security.GroupAdmin) {
+		return true
+	}
+	for _, groupID := range f.unmaskedGroups {
+		group := security.Registry.GetGroup(groupID)
+		if group != nil && security.Registry.HasMembership(uid, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBankValues normalizes the values of the IBAN and BIC fields of the
+// given FieldMap and checks them. Empty values are always accepted since they
+// mean that the field is unset. It panics with a ValidationError if a value
+// is not valid.
+func (m *Model) checkBankValues(fMap FieldMap) {
+	for colName, value := range fMap {
+		fi := m.getRelatedFieldInfo(colName)
+		if fi.fieldType != fieldtype.Char || fi.bankFormat == noBankFormat {
+			continue
+		}
+		val, ok := value.(string)
+		if !ok || val == "" {
+			continue
+		}
+		var err error
+		switch fi.bankFormat {
+		case ibanFormat:
+			val = bank.NormalizeIBAN(val)
+			err = bank.ValidateIBAN(val)
+		case bicFormat:
+			val = bank.NormalizeBIC(val)
+			err = bank.ValidateBIC(val)
+		}
+		fMap[colName] = val
+		if err != nil {
+			log.Debug("Invalid value for bank field", "model", m.name, "field", fi.name, "error", err)
+			panic(ValidationError{
+				Model:   m.name,
+				Field:   fi.name,
+				Value:   val,
+				Message: fmt.Sprintf("The value of field '%s' is invalid: %s", fi.description, err),
+			})
+		}
+	}
+}
+
+// displayIBANValues replaces the values of the IBAN fields of the given
+// FieldMaps read by a client with their print format, masked if the
+// current user cannot see them in full.
+func (rc RecordCollection) displayIBANValues(fields []string, fMaps []FieldMap) {
+	for _, field := range fields {
+		fi := rc.model.getRelatedFieldInfo(field)
+		if fi.bankFormat != ibanFormat {
+			continue
+		}
+		display := bank.FormatIBAN
+		if !fi.canSeeFullIBAN(rc.env.uid) {
+			display = bank.MaskIBAN
+		}
+		for _, fMap := range fMaps {
+			if val, ok := fMap[field].(string); ok && val != "" {
+				fMap[field] = display(val)
+			}
+		}
+	}
+}
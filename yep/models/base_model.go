@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/operator"
 	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/models/types"
 )
@@ -38,8 +39,24 @@ const (
 	ManualModel
 	// SystemModel is a model that is used internally by the YEP Framework
 	SystemModel
+	// Concurrency means that writes on the records of this model fail with a
+	// ConcurrentUpdateError if the records have been modified since the client
+	// read them (see SetConcurrency).
+	Concurrency
+	// NoLogAccess means that the records of this model do not have the
+	// CreateDate, CreateUID, WriteDate and WriteUID fields (see SetLogAccess).
+	NoLogAccess
 )
 
+// logAccessFields are the fields of BaseMixin that are maintained by the ORM
+// with the user and the date of the creation and of the last modification.
+var logAccessFields = map[string]bool{
+	"CreateDate": true,
+	"CreateUID":  true,
+	"WriteDate":  true,
+	"WriteUID":   true,
+}
+
 //  declareCommonMixin creates the common mixin that is needed for all models
 func declareCommonMixin() {
 	NewMixinModel("CommonMixin")
@@ -67,7 +84,7 @@ func declareModelMixin() {
 	modelMixin := NewMixinModel("ModelMixin")
 	modelMixin.AddCharField("YEPExternalID", StringFieldParams{Unique: true, Index: true, NoCopy: true,
 		Default: func(env Environment, values FieldMap) interface{} {
-			return fmt.Sprintf("__yep_external_id__%d", idSeq.NextValue())
+			return fmt.Sprintf("__yep_external_id__%d", idSeq.NextValueInEnv(env))
 		},
 	})
 	modelMixin.AddIntegerField("YEPVersion", SimpleFieldParams{GoType: new(int)})
@@ -90,10 +107,12 @@ func declareBaseComputeMethods() {
 		`ComputeLastUpdate returns the last datetime at which the record has been updated.`,
 		func(rc RecordCollection) FieldMap {
 			lastUpdate := types.DateTime(time.Now())
+			if !rc.model.hasLogAccess() {
+				return FieldMap{"LastUpdate": lastUpdate}
+			}
 			if !rc.Get("WriteDate").(types.DateTime).IsNull() {
 				lastUpdate = rc.Get("WriteDate").(types.DateTime)
-			}
-			if !rc.Get("CreateDate").(types.DateTime).IsNull() {
+			} else if !rc.Get("CreateDate").(types.DateTime).IsNull() {
 				lastUpdate = rc.Get("CreateDate").(types.DateTime)
 			}
 			return FieldMap{"LastUpdate": lastUpdate}
@@ -122,12 +141,22 @@ func declareCRUDMethods() {
 			return rc.create(data)
 		})
 
+	commonMixin.AddMethod("CreateMulti",
+		`CreateMulti inserts a record in the database for each of the given data
+		in a single query. Returns the created RecordCollection, in the order of data.`,
+		func(rc RecordCollection, data []FieldMap) RecordCollection {
+			return rc.createMulti(data)
+		})
+
 	commonMixin.AddMethod("Read",
 		`Read reads the database and returns a slice of FieldMap of the given model`,
 		func(rc RecordCollection, fields []string) []FieldMap {
 			res := make([]FieldMap, rc.Len())
 			// Check if we have id in fields, and add it otherwise
 			fields = addIDIfNotPresent(fields)
+			// Drop the fields we are not allowed to read
+			rc.checkFieldsAccess(fields, security.Read)
+			fields = filterOnAuthorizedFields(rc.model, rc.env.uid, fields, security.Read)
 			// Do the actual reading
 			for i, rec := range rc.Records() {
 				res[i] = make(FieldMap)
@@ -135,6 +164,7 @@ func declareCRUDMethods() {
 					res[i][fName] = rec.Get(fName)
 				}
 			}
+			rc.displayIBANValues(fields, res)
 			return res
 		})
 
@@ -163,25 +193,44 @@ func declareCRUDMethods() {
 		})
 
 	commonMixin.AddMethod("Copy",
-		`Copy duplicates the given record
+		`Copy duplicates the given record and returns the new record.
+
+		Values of overrides replace those of the copied record. Fields declared
+		with NoCopy are not copied, the name is suffixed with " (copy)" and the
+		lines of one2many fields are duplicated with their own Copy method.
 		It panics if rs is not a singleton`,
-		func(rc RecordCollection) RecordCollection {
+		func(rc RecordCollection, overrides FieldMapper) RecordCollection {
 			rc.EnsureOne()
-
-			var fields []string
-			for _, fi := range rc.model.fields.registryByName {
-				if !fi.noCopy {
-					fields = append(fields, fi.json)
-				}
+			rSet := rc.Fetch()
+			var fMap FieldMap
+			if overrides != nil {
+				fMap = overrides.FieldMap()
 			}
+			newRs := rSet.Call("Create", rSet.copyData(fMap)).(RecordSet).Collection()
+			rSet.copyLines(newRs)
+			return newRs
+		})
 
-			rc.Load(fields...)
+	commonMixin.AddMethod("Resequence",
+		`Resequence sets the Sequence field of the records with the given ids
+		to their position in ids, so that the records of models ordered by
+		Sequence follow the order of ids, e.g. after a drag and drop.`,
+		func(rc RecordCollection, ids []int64) {
+			rc.resequence(ids)
+		})
 
-			fMap := rc.env.cache.getRecord(rc.ModelName(), rc.Get("id").(int64))
-			delete(fMap, "ID")
-			delete(fMap, "id")
-			newRs := rc.Call("Create", fMap).(RecordSet).Collection()
-			return newRs
+	commonMixin.AddMethod("Archive",
+		`Archive sets the Active field of the records to false, so that they
+		are excluded from searches. It panics if the model has no Active field.`,
+		func(rc RecordCollection) bool {
+			return rc.setActive(false)
+		})
+
+	commonMixin.AddMethod("Unarchive",
+		`Unarchive sets the Active field of the records to true, so that they
+		are returned by searches again. It panics if the model has no Active field.`,
+		func(rc RecordCollection) bool {
+			return rc.setActive(true)
 		})
 
 }
@@ -193,13 +242,7 @@ func declareRecordSetMethods() {
 	commonMixin.AddMethod("NameGet",
 		`NameGet retrieves the human readable name of this record.`,
 		func(rc RecordCollection) string {
-			if _, nameExists := rc.model.fields.get("name"); nameExists {
-				if !rc.env.cache.checkIfInCache(rc.model, rc.ids, []string{"name"}) {
-					rc.Load("name")
-				}
-				return rc.Get("name").(string)
-			}
-			return rc.String()
+			return rc.nameGet()
 		}).AllowGroup(security.GroupEveryone)
 
 	commonMixin.AddMethod("FieldsGet",
@@ -225,15 +268,23 @@ func declareRecordSetMethods() {
 					relation = fInfo.relatedModel.name
 				}
 				res[fInfo.json] = &FieldInfo{
-					Help:       fInfo.help,
-					Searchable: true,
-					Depends:    fInfo.depends,
-					Sortable:   true,
-					Type:       fInfo.fieldType,
-					Store:      fInfo.isStored(),
-					String:     fInfo.description,
-					Relation:   relation,
-					Required:   fInfo.required,
+					Help:             fInfo.help,
+					Searchable:       true,
+					Depends:          fInfo.depends,
+					Sortable:         true,
+					Type:             fInfo.fieldType,
+					Store:            fInfo.isStored(),
+					String:           fInfo.description,
+					Relation:         relation,
+					Required:         fInfo.required,
+					CompanyDependent: fInfo.isPropertyField(),
+					OnChange:         fInfo.HasOnChange(),
+				}
+				if fInfo.fieldType == fieldtype.Selection {
+					res[fInfo.json].Selection = fInfo.options()
+					if fInfo.selectionFunc != "" {
+						res[fInfo.json].Selection = fInfo.selectionValues(rc.Env()).Options()
+					}
 				}
 			}
 			return res
@@ -249,19 +300,32 @@ func declareRecordSetMethods() {
 			return rc.Call("FieldsGet", args).(map[string]*FieldInfo)[string(field.FieldName())]
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("SelectionGet",
+		`SelectionGet returns the allowed values of the given selection field
+		for the current environment.`,
+		func(rc RecordCollection, field FieldNamer) types.Selection {
+			fi := rc.model.fields.MustGet(string(field.FieldName()))
+			if fi.fieldType != fieldtype.Selection {
+				log.Panic("Field is not a selection field", "model", rc.ModelName(), "field", fi.name)
+			}
+			return fi.selectionValues(rc.Env())
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("DefaultGet",
 		`DefaultGet returns a Params map with the default values for the model.`,
 		func(rc RecordCollection) FieldMap {
-			// TODO Implement DefaultGet
-			return make(FieldMap)
+			res := make(FieldMap)
+			for fName, value := range rc.computeDefaults(make(FieldMap)) {
+				res[rc.model.fields.MustGet(fName).json] = value
+			}
+			return res
 		}).AllowGroup(security.GroupEveryone)
 
 	commonMixin.AddMethod("Onchange",
 		`Onchange returns the values that must be modified in the pseudo-record
 		given as params.Values`,
 		func(rc RecordCollection, params OnchangeParams) FieldMap {
-			// TODO Implement Onchange
-			return make(FieldMap)
+			return rc.onchange(params)
 		}).AllowGroup(security.GroupEveryone)
 }
 
@@ -275,6 +339,18 @@ func declareSearchMethods() {
 			return rc.Search(cond)
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("NameSearch",
+		`NameSearch searches for records that have a display name matching the given
+		"name" pattern when compared with the given "operator", while also
+		matching the optional search condition ("args").
+
+		This is used for example to provide suggestions based on a partial
+		value for a relational field. Sometimes be seen as the inverse
+		function of NameGet but it is not guaranteed to be.`,
+		func(rc RecordCollection, params NameSearchParams) RecordCollection {
+			return rc.nameSearch(params)
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Fetch",
 		`Fetch query the database with the current filter and returns a RecordSet
 		with the queries ids. Fetch is lazy and only return ids. Use Load() instead
@@ -296,6 +372,19 @@ func declareSearchMethods() {
 			return rc.GroupBy(exprs...)
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("ReadGroup",
+		`ReadGroup returns the aggregated values of the given fields of the records
+		matching the given condition, grouped by the given group by expressions.
+		Date and datetime fields can be grouped by day, week or month with expressions
+		such as "Birthday:month".`,
+		func(rc RecordCollection, params ReadGroupParams) []GroupAggregateRow {
+			fields := make([]FieldNamer, len(params.Fields))
+			for i, f := range params.Fields {
+				fields[i] = f
+			}
+			return rc.ReadGroup(params.Condition, fields, params.GroupBy)
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Limit",
 		`Limit returns a new RecordSet with only the first 'limit' records.`,
 		func(rc RecordCollection, limit int) RecordCollection {
@@ -320,6 +409,20 @@ func declareSearchMethods() {
 		func(rc RecordCollection, other RecordCollection) RecordCollection {
 			return rc.Union(other)
 		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("Subtract",
+		`Subtract returns a new RecordSet with the records of this RecordSet
+		that are not in the given "other" RecordSet.`,
+		func(rc RecordCollection, other RecordCollection) RecordCollection {
+			return rc.Subtract(other)
+		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("Intersect",
+		`Intersect returns a new RecordSet with the records of this RecordSet
+		that are also in the given "other" RecordSet.`,
+		func(rc RecordCollection, other RecordCollection) RecordCollection {
+			return rc.Intersect(other)
+		}).AllowGroup(security.GroupEveryone)
 }
 
 func declareEnvironmentMethods() {
@@ -351,6 +454,34 @@ func declareEnvironmentMethods() {
 		func(rc RecordCollection, userID ...int64) RecordCollection {
 			return rc.Sudo(userID...)
 		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("AsOf",
+		`AsOf returns a read-only copy of the current RecordSet in which
+		audited fields have the value they had at the given date.`,
+		func(rc RecordCollection, date types.DateTime) RecordCollection {
+			return rc.AsOf(date)
+		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("ValuesAsOf",
+		`ValuesAsOf returns the values of the audited fields of this
+		record at the given date.`,
+		func(rc RecordCollection, date types.DateTime) FieldMap {
+			return rc.ValuesAsOf(date)
+		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("AuditTrail",
+		`AuditTrail returns the operations recorded in the audit trail
+		of this record, from the most recent to the oldest.`,
+		func(rc RecordCollection) []AuditEntry {
+			return rc.AuditTrail()
+		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("SetPropertyDefault",
+		`SetPropertyDefault sets the default value of the given property field
+		for the current value of its context key.`,
+		func(rc RecordCollection, fieldName string, value interface{}) {
+			rc.SetPropertyDefault(fieldName, value)
+		}).AllowGroup(security.GroupEveryone)
 }
 
 // ConvertLimitToInt converts the given limit as interface{} to an int
@@ -385,6 +516,8 @@ type FieldInfo struct {
 	String           string                 `json:"string"`
 	Domain           *Condition             `json:"domain"`
 	Relation         string                 `json:"relation"`
+	Selection        types.SelectionOptions `json:"selection"`
+	OnChange         bool                   `json:"onchange"`
 }
 
 // FieldsGetArgs is the args struct for the FieldsGet method
@@ -393,6 +526,14 @@ type FieldsGetArgs struct {
 	Fields []FieldName `json:"allfields"`
 }
 
+// NameSearchParams is the args struct for the NameSearch function
+type NameSearchParams struct {
+	Args     *Condition        `json:"args"`
+	Name     string            `json:"name"`
+	Operator operator.Operator `json:"operator"`
+	Limit    interface{}       `json:"limit"`
+}
+
 // OnchangeParams is the args struct of the Onchange function
 type OnchangeParams struct {
 	Values   FieldMap          `json:"values"`
@@ -16,8 +16,15 @@ package models
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/npiganeau/yep/yep/models/fieldtype"
 	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/parallel"
+	"github.com/npiganeau/yep/yep/tools/strutils"
 )
 
 // A modelCouple holds a model and one of its mixin
@@ -40,20 +47,57 @@ func BootStrap() {
 
 	Registry.bootstrapped = true
 
-	createModelLinks()
-	inflateMixIns()
-	inflateEmbeddings()
-	syncRelatedFieldInfo()
-	bootStrapMethods()
-	processDepends()
-	checkComputeMethodsSignature()
-	setupSecurity()
+	start := time.Now()
+	runBootstrapPhase("model links", createModelLinks)
+	runBootstrapPhase("method layers", sortMethodLayers)
+	runBootstrapPhase("mixins", inflateMixIns)
+	runBootstrapPhase("embeddings", inflateEmbeddings)
+	runBootstrapPhase("related fields", syncRelatedFieldInfo)
+	runBootstrapPhase("methods", bootStrapMethods)
+	runBootstrapPhase("depends", processDepends)
+	runBootstrapPhase("compute order", sortComputeMethods)
+	runBootstrapPhase("checks", func() {
+		// Checks only read the registry, so that they can run concurrently.
+		checks := []func(){
+			checkComputeMethodsSignature,
+			checkSelectionMethodsSignature,
+			checkOnChangeMethodsSignature,
+			checkConstraintMethodsSignature,
+			checkMonetaryFields,
+			checkRecNames,
+			checkParentNames,
+			checkDefaultOrders,
+			checkRecordRuleDomains,
+			checkApprovalConditions,
+		}
+		parallel.Run(len(checks), func(i int) {
+			checks[i]()
+		})
+	})
+	runBootstrapPhase("security", setupSecurity)
+	log.Info("Models bootstrapped", "models", len(Registry.registryByName), "duration", time.Since(start))
+}
+
+// runBootstrapPhase runs the given bootstrap phase and logs its duration.
+func runBootstrapPhase(name string, phase func()) {
+	start := time.Now()
+	phase()
+	log.Debug("Bootstrap phase done", "phase", name, "duration", time.Since(start))
+}
+
+// forEachModel calls fnct concurrently for each model of the registry and
+// returns when all calls are done. fnct must only modify the given model.
+func forEachModel(fnct func(*Model)) {
+	models := Registry.all()
+	parallel.Run(len(models), func(i int) {
+		fnct(models[i])
+	})
 }
 
 // createModelLinks create links with related Model
 // where applicable.
 func createModelLinks() {
-	for _, mi := range Registry.registryByName {
+	forEachModel(func(mi *Model) {
 		for _, fi := range mi.fields.registryByName {
 			var (
 				relatedMI *Model
@@ -68,6 +112,16 @@ func createModelLinks() {
 			fi.relatedModel = relatedMI
 		}
 		mi.fields.bootstrapped = true
+	})
+}
+
+// sortMethodLayers orders the layers of all methods by the load order
+// of the modules that defined them.
+func sortMethodLayers() {
+	for _, mi := range Registry.registryByName {
+		for _, method := range mi.methods.registry {
+			method.sortLayers()
+		}
 	}
 }
 
@@ -82,6 +136,20 @@ func inflateMixIns() {
 			injectMixInModel(mixInMI, mi)
 		}
 	}
+	// Link models of the many2many fields of mixins have no table since
+	// each model mixing them in has its own link model.
+	for name, mi := range Registry.registryByName {
+		if !mi.isM2MLink() {
+			continue
+		}
+		for _, fi := range mi.fields.registryByName {
+			if fi.relatedModel != nil && fi.relatedModel.isMixin() {
+				delete(Registry.registryByName, name)
+				delete(Registry.registryByTableName, mi.tableName)
+				break
+			}
+		}
+	}
 }
 
 // injectMixInModel injects fields and methods of mixInMI in model
@@ -99,10 +167,15 @@ func injectMixInModel(mixInMI, mi *Model) {
 			// since the target model should always override mixins.
 			continue
 		}
+		if logAccessFields[fName] && mi.options&NoLogAccess > 0 {
+			continue
+		}
 		newFI := *fi
 		newFI.model = mi
 		newFI.acl = security.NewAccessControlList()
-		// TODO handle M2M fields
+		if fi.fieldType == fieldtype.Many2Many && fi.m2mOurField.relatedModelName == mixInMI.name {
+			newFI.m2mRelModel, newFI.m2mOurField, newFI.m2mTheirField = mixedM2MRelModelInfo(fi, mixInMI, mi)
+		}
 		mi.fields.add(&newFI)
 		// We add the permissions of the mixin to the target model
 		for group, perm := range fi.acl.Permissions() {
@@ -131,6 +204,8 @@ func injectMixInModel(mixInMI, mi *Model) {
 					funcValue: wrapFunctionForMethodLayer(lf.funcValue),
 					mixedIn:   true,
 					method:    emi,
+					skipKeys:  lf.skipKeys,
+					origin:    lf.origin,
 				}
 				emi.nextLayer[&ml] = firstMixedLayer
 				firstMixedLayer = &ml
@@ -139,7 +214,8 @@ func injectMixInModel(mixInMI, mi *Model) {
 		} else {
 			newMethInfo := copyMethod(mi, methInfo)
 			for i := 0; i < len(layersInv); i++ {
-				newMethInfo.addMethodLayer(layersInv[i].funcValue, layersInv[i].doc)
+				newMethInfo.addMethodLayer(layersInv[i].funcValue, layersInv[i].doc, layersInv[i].skipKeys...)
+				newMethInfo.topLayer.origin = layersInv[i].origin
 			}
 			mi.methods.set(methName, newMethInfo)
 		}
@@ -151,6 +227,28 @@ func injectMixInModel(mixInMI, mi *Model) {
 	mixed[modelCouple{model: mi, mixIn: mixInMI}] = true
 }
 
+// mixedM2MRelModelInfo returns the link model and its fields of the
+// many2many field fi of mixInMI once mixed in mi, creating them if needed.
+//
+// The link model is named as if the field was declared on mi, or is
+// prefixed with the name of mi if the mixin's field has a custom link model.
+func mixedM2MRelModelInfo(fi *Field, mixInMI, mi *Model) (*Model, *Field, *Field) {
+	their := fi.m2mTheirField.name
+	mixInNames := []string{mixInMI.name, their}
+	sort.Strings(mixInNames)
+	relModelName := mi.name + fi.m2mRelModel.name
+	if fi.m2mRelModel.name == fmt.Sprintf("%s%sRel", mixInNames[0], mixInNames[1]) {
+		modelNames := []string{mi.name, their}
+		sort.Strings(modelNames)
+		relModelName = fmt.Sprintf("%s%sRel", modelNames[0], modelNames[1])
+	}
+	relMI, ourField, theirField := createM2MRelModelInfo(relModelName, mi.name, their)
+	ourField.relatedModel = mi
+	theirField.relatedModel = fi.m2mTheirField.relatedModel
+	relMI.fields.bootstrapped = true
+	return relMI, ourField, theirField
+}
+
 // inflateEmbeddings creates related fields for all fields of embedded models.
 func inflateEmbeddings() {
 	for _, mi := range Registry.registryByName {
@@ -195,6 +293,9 @@ func syncRelatedFieldInfo() {
 			newFI.stored = fi.stored
 			newFI.model = mi
 			newFI.noCopy = true
+			// The constraint is checked on the target model when
+			// the related field is written, not on this model.
+			newFI.constraint = ""
 			*fi = newFI
 		}
 	}
@@ -214,18 +315,26 @@ func SyncDatabase() {
 			// Don't create table for manual models
 			continue
 		}
+		renameLegacyDBTable(model, dbTables)
 		if _, ok := dbTables[tableName]; !ok {
-			createDBTable(model.tableName)
+			createDBTable(model)
 		}
 		updateDBColumns(model)
+		renameLegacyDBIndexes(model)
 		updateDBIndexes(model)
+		updateDBUniqueConstraints(model)
+		updateDBSQLConstraints(model)
+		updateDBSQLIndexes(model)
+		updateDBSelectionValues(model)
 	}
-	// Setup foreign key constraints
+	// Setup foreign key constraints and the primary keys of link tables,
+	// whose duplicate links can only be removed once all tables exist.
 	for _, model := range Registry.registryByTableName {
 		if model.isMixin() {
 			continue
 		}
 		updateDBForeignKeyConstraints(model)
+		updateDBM2MPrimaryKey(model)
 	}
 	// Drop DB tables that are not in the models
 	for dbTable := range adapter.tables() {
@@ -274,21 +383,126 @@ func updateDBSequences() {
 
 // createDBTable creates a table in the database from the given Model
 // It only creates the primary key. Call updateDBColumns to create columns.
-func createDBTable(tableName string) {
+//
+// Tables of many2many link models are created with their link columns only,
+// since their primary key is made of both link columns (see updateDBM2MPrimaryKey).
+func createDBTable(m *Model) {
 	adapter := adapters[db.DriverName()]
 	query := fmt.Sprintf(`
 	CREATE TABLE %s (
-		id serial NOT NULL PRIMARY KEY
+		id %s
 	)
-	`, adapter.quoteTableName(tableName))
-	dbExecuteNoTx(query)
+	`, adapter.quoteTableName(m.tableName), adapter.primaryKeySQL())
+	if m.isM2MLink() {
+		var cols []string
+		for colName, fi := range m.fields.registryByJSON {
+			cols = append(cols, fmt.Sprintf("%s %s", colName, adapter.columnSQLDefinition(fi)))
+		}
+		sort.Strings(cols)
+		query = fmt.Sprintf(`
+		CREATE TABLE %s (%s)
+		`, adapter.quoteTableName(m.tableName), strings.Join(cols, ", "))
+	}
+	syncExecute(query)
+}
+
+// renameLegacyDBTable renames the table of the given many2many link model if
+// it has been created before table names were shortened with dbIdentifier.
+// dbTables is updated accordingly.
+func renameLegacyDBTable(m *Model, dbTables map[string]bool) {
+	if !m.isM2MLink() || dbTables[m.tableName] {
+		return
+	}
+	legacyName := legacyDBIdentifier(strutils.SnakeCaseString(m.name))
+	if legacyName == m.tableName || !dbTables[legacyName] {
+		return
+	}
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`
+		ALTER TABLE %s RENAME TO %s
+	`, adapter.quoteTableName(legacyName), adapter.quoteTableName(m.tableName))
+	syncExecute(query)
+	delete(dbTables, legacyName)
+	dbTables[m.tableName] = true
+	// Constraints and indexes keep their name when the table is renamed
+	for colName := range m.fields.registryByJSON {
+		renameDBConstraint(m.tableName, legacyDBIdentifier(fmt.Sprintf("%s_%s_fkey", legacyName, colName)),
+			fkConstraintName(m.tableName, colName))
+		renameDBIndex(m.tableName, legacyDBIdentifier(fmt.Sprintf("%s_%s_index", legacyName, colName)),
+			columnIndexName(m.tableName, colName))
+	}
+}
+
+// renameLegacyDBIndexes renames the indexes and foreign key constraints of the
+// given Model that have been created before their names were shortened with
+// dbIdentifier and that have therefore been truncated by the database.
+func renameLegacyDBIndexes(m *Model) {
+	for colName := range m.fields.registryByJSON {
+		renameDBConstraint(m.tableName, legacyDBIdentifier(fmt.Sprintf("%s_%s_fkey", m.tableName, colName)),
+			fkConstraintName(m.tableName, colName))
+		renameDBIndex(m.tableName, legacyDBIdentifier(fmt.Sprintf("%s_%s_index", m.tableName, colName)),
+			columnIndexName(m.tableName, colName))
+	}
+}
+
+// renameDBConstraint renames the constraint oldName of the given table
+// to newName if it exists and if both names are different.
+func renameDBConstraint(tableName, oldName, newName string) {
+	adapter := adapters[db.DriverName()]
+	if oldName == newName || !adapter.constraintExists(oldName) {
+		return
+	}
+	if query := adapter.renameConstraintSQL(tableName, oldName, newName); query != "" {
+		syncExecute(query)
+	}
+}
+
+// renameDBIndex renames the index oldName of the given table
+// to newName if it exists and if both names are different.
+func renameDBIndex(tableName, oldName, newName string) {
+	adapter := adapters[db.DriverName()]
+	if oldName == newName || !adapter.indexExists(tableName, oldName) {
+		return
+	}
+	if query := adapter.renameIndexSQL(tableName, oldName, newName); query != "" {
+		syncExecute(query)
+	}
+}
+
+// updateDBM2MPrimaryKey creates the primary key of the given many2many link
+// model on both link columns if it does not exist yet. The primary key of
+// legacy link tables on their id column is dropped and duplicate links that
+// would prevent the creation of the new one are removed first.
+// It does nothing if the given Model is not a many2many link model.
+func updateDBM2MPrimaryKey(m *Model) {
+	if !m.isM2MLink() {
+		return
+	}
+	adapter := adapters[db.DriverName()]
+	pkName := dbIdentifier(fmt.Sprintf("%s_pkey", m.tableName))
+	var cols []string
+	for colName := range m.fields.registryByJSON {
+		cols = append(cols, colName)
+	}
+	sort.Strings(cols)
+	dbCols := adapter.constraintColumns(m.tableName, pkName)
+	if strings.Join(dbCols, ", ") == strings.Join(cols, ", ") {
+		return
+	}
+	if len(dbCols) > 0 {
+		dropDBConstraint(m.tableName, pkName)
+	}
+	if query := adapter.deleteDuplicateLinksSQL(m.tableName, cols[0], cols[1]); query != "" {
+		syncExecute(query)
+	}
+	createDBConstraint(m.tableName, pkName, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(cols, ", ")))
 }
 
 // dropDBTable drops the given table in the database
 func dropDBTable(tableName string) {
 	adapter := adapters[db.DriverName()]
 	query := fmt.Sprintf(`DROP TABLE %s`, adapter.quoteTableName(tableName))
-	dbExecuteNoTx(query)
+	syncExecute(query)
 }
 
 // updateDBColumns synchronizes the colums of the database with the
@@ -302,10 +516,19 @@ func updateDBColumns(mi *Model) {
 			continue
 		}
 		dbColData, ok := dbColumns[colName]
+		if !ok && fi.previousName != "" {
+			dbColData, ok = dbColumns[fi.previousName]
+			if ok {
+				renameDBColumn(mi.tableName, fi.previousName, colName)
+				delete(dbColumns, fi.previousName)
+				dbColumns[colName] = dbColData
+			}
+		}
 		if !ok {
 			createDBColumn(fi)
+			continue
 		}
-		if dbColData.DataType != adapter.typeSQL(fi) {
+		if adapter.columnTypeSQL(dbColData) != adapter.typeSQL(fi) {
 			updateDBColumnDataType(fi)
 		}
 		if (dbColData.IsNullable == "NO" && !adapter.fieldIsNotNull(fi)) ||
@@ -320,6 +543,8 @@ func updateDBColumns(mi *Model) {
 	// drop columns that no longer exist
 	for colName := range dbColumns {
 		if _, ok := mi.fields.registryByJSON[colName]; !ok {
+			log.Warn("Dropping column of removed field. Use SetPreviousName on renamed fields to keep their data.",
+				"model", mi.name, "column", colName)
 			dropDBColumn(mi.tableName, colName)
 		}
 	}
@@ -335,52 +560,35 @@ func createDBColumn(fi *Field) {
 		ALTER TABLE %s
 		ADD COLUMN %s %s
 	`, adapter.quoteTableName(fi.model.tableName), fi.json, adapter.columnSQLDefinition(fi))
-	dbExecuteNoTx(query)
+	syncExecute(query)
 }
 
-// updateDBColumnDataType updates the data type in database for the given Field
+// updateDBColumnDataType updates the data type in database for the given Field.
+// Existing values are cast to the new type and the update fails if a value
+// cannot be cast. The default value of the column is dropped during the update
+// since it may not be castable, and set again afterwards.
 func updateDBColumnDataType(fi *Field) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s
-		ALTER COLUMN %s SET DATA TYPE %s
-	`, adapter.quoteTableName(fi.model.tableName), fi.json, adapter.typeSQL(fi))
-	dbExecuteNoTx(query)
+	for _, query := range adapter.alterColumnTypeSQL(fi) {
+		syncExecute(query)
+	}
+	updateDBColumnDefault(fi)
 }
 
 // updateDBColumnNullable updates the NULL/NOT NULL data in database for the given Field
 func updateDBColumnNullable(fi *Field) {
 	adapter := adapters[db.DriverName()]
-	var verb string
-	if adapter.fieldIsNotNull(fi) {
-		verb = "SET"
-	} else {
-		verb = "DROP"
+	if query := adapter.alterColumnNullableSQL(fi); query != "" {
+		syncExecute(query)
 	}
-	query := fmt.Sprintf(`
-		ALTER TABLE %s
-		ALTER COLUMN %s %s NOT NULL
-	`, adapter.quoteTableName(fi.model.tableName), fi.json, verb)
-	dbExecuteNoTx(query)
 }
 
 // updateDBColumnDefault updates the default value in database for the given Field
 func updateDBColumnDefault(fi *Field) {
 	adapter := adapters[db.DriverName()]
-	defValue := adapter.fieldSQLDefault(fi)
-	var query string
-	if defValue == "" {
-		query = fmt.Sprintf(`
-			ALTER TABLE %s
-			ALTER COLUMN %s DROP DEFAULT
-		`, adapter.quoteTableName(fi.model.tableName), fi.json)
-	} else {
-		query = fmt.Sprintf(`
-			ALTER TABLE %s
-			ALTER COLUMN %s SET DEFAULT %s
-		`, adapter.quoteTableName(fi.model.tableName), fi.json, adapter.fieldSQLDefault(fi))
+	if query := adapter.alterColumnDefaultSQL(fi); query != "" {
+		syncExecute(query)
 	}
-	dbExecuteNoTx(query)
 }
 
 // dropDBColumn drops the column colName from table tableName in database
@@ -390,7 +598,7 @@ func dropDBColumn(tableName, colName string) {
 		ALTER TABLE %s
 		DROP COLUMN %s
 	`, adapter.quoteTableName(tableName), colName)
-	dbExecuteNoTx(query)
+	syncExecute(query)
 }
 
 // updateDBForeignKeyConstraints creates or updates fk constraints
@@ -398,11 +606,15 @@ func dropDBColumn(tableName, colName string) {
 func updateDBForeignKeyConstraints(m *Model) {
 	adapter := adapters[db.DriverName()]
 	for colName, fi := range m.fields.registryByJSON {
-		fkContraintInDB := adapter.constraintExists(fmt.Sprintf("%s_%s_fkey", m.tableName, colName))
+		constraintName := fkConstraintName(m.tableName, colName)
+		fkContraintInDB := adapter.constraintExists(constraintName)
 		fieldIsFK := fi.fieldType.IsFKRelationType() && fi.isStored()
 		switch {
 		case fieldIsFK && !fkContraintInDB:
 			createFKConstraint(m.tableName, colName, fi.relatedModel.tableName, string(fi.onDelete))
+		case fieldIsFK && adapter.foreignKeyOnDelete(constraintName) != fi.onDelete:
+			dropFKConstraint(m.tableName, colName)
+			createFKConstraint(m.tableName, colName, fi.relatedModel.tableName, string(fi.onDelete))
 		case !fieldIsFK && fkContraintInDB:
 			dropFKConstraint(m.tableName, colName)
 		}
@@ -412,19 +624,21 @@ func updateDBForeignKeyConstraints(m *Model) {
 // createFKConstraint creates an FK constraint for the given column that references the given targetTable
 func createFKConstraint(tableName, colName, targetTable, ondelete string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s ON DELETE %s
-	`, adapter.quoteTableName(tableName), fmt.Sprintf("%s_%s_fkey", tableName, colName), colName, adapter.quoteTableName(targetTable), ondelete)
-	dbExecuteNoTx(query)
+	createDBConstraint(tableName, fkConstraintName(tableName, colName), fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s (id) ON DELETE %s",
+		colName, adapter.quoteTableName(targetTable), ondelete))
 }
 
 // dropFKConstraint drops an FK constraint for colName in the given table
 func dropFKConstraint(tableName, colName string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s
-	`, adapter.quoteTableName(tableName), fmt.Sprintf("%s_%s_fkey", tableName, colName))
-	dbExecuteNoTx(query)
+	if query := adapter.dropConstraintSQL(tableName, fkConstraintName(tableName, colName)); query != "" {
+		syncExecute(query)
+	}
+}
+
+// fkConstraintName returns the name of the FK constraint of colName in the given table
+func fkConstraintName(tableName, colName string) string {
+	return dbIdentifier(fmt.Sprintf("%s_%s_fkey", tableName, colName))
 }
 
 // updateDBIndexes creates or updates indexes based on the data of
@@ -432,7 +646,12 @@ func dropFKConstraint(tableName, colName string) {
 func updateDBIndexes(m *Model) {
 	adapter := adapters[db.DriverName()]
 	for colName, fi := range m.fields.registryByJSON {
-		indexInDB := adapter.indexExists(m.tableName, fmt.Sprintf("%s_%s_index", m.tableName, colName))
+		if !fi.isStored() {
+			// Related fields of embedded models copy the index of their
+			// target but have no column to index.
+			continue
+		}
+		indexInDB := adapter.indexExists(m.tableName, columnIndexName(m.tableName, colName))
 		switch {
 		case fi.index && !indexInDB:
 			createColumnIndex(m.tableName, colName)
@@ -445,18 +664,156 @@ func updateDBIndexes(m *Model) {
 // createColumnIndex creates an column index for colName in the given table
 func createColumnIndex(tableName, colName string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		CREATE INDEX %s ON %s (%s)
-	`, fmt.Sprintf("%s_%s_index", tableName, colName), adapter.quoteTableName(tableName), colName)
-	dbExecuteNoTx(query)
+	for _, query := range adapter.createIndexSQL(false, columnIndexName(tableName, colName), tableName, []string{colName}, "", "") {
+		syncExecute(query)
+	}
 }
 
 // dropColumnIndex drops a column index for colName in the given table
 func dropColumnIndex(tableName, colName string) {
-	query := fmt.Sprintf(`
-		DROP INDEX IF EXISTS %s
-	`, fmt.Sprintf("%s_%s_index", tableName, colName))
-	dbExecuteNoTx(query)
+	adapter := adapters[db.DriverName()]
+	if query := adapter.dropIndexSQL(tableName, columnIndexName(tableName, colName)); query != "" {
+		syncExecute(query)
+	}
+}
+
+// columnIndexName returns the name of the index of colName in the given table
+func columnIndexName(tableName, colName string) string {
+	return dbIdentifier(fmt.Sprintf("%s_%s_index", tableName, colName))
+}
+
+// updateDBUniqueConstraints creates or drops the UNIQUE constraints
+// of the columns of the given Model.
+func updateDBUniqueConstraints(m *Model) {
+	adapter := adapters[db.DriverName()]
+	for colName, fi := range m.fields.registryByJSON {
+		if colName == "id" {
+			continue
+		}
+		constraintName := uniqueConstraintName(m.tableName, colName)
+		constraintInDB := adapter.constraintExists(constraintName)
+		fieldIsUnique := fi.isUnique() && fi.isStored()
+		switch {
+		case fieldIsUnique && !constraintInDB:
+			createDBConstraint(m.tableName, constraintName, fmt.Sprintf("UNIQUE (%s)", colName))
+		case !fieldIsUnique && constraintInDB:
+			dropDBConstraint(m.tableName, constraintName)
+		}
+	}
+}
+
+// uniqueConstraintName returns the name of the UNIQUE constraint of colName in the given table
+func uniqueConstraintName(tableName, colName string) string {
+	return dbIdentifier(fmt.Sprintf("%s_%s_key", tableName, colName))
+}
+
+// updateDBSelectionValues migrates the values of the selection fields of the given
+// Model and creates or updates the CHECK constraints on selection columns.
+func updateDBSelectionValues(m *Model) {
+	adapter := adapters[db.DriverName()]
+	tableInDB := adapter.tables()[m.tableName]
+	for colName, fi := range m.fields.registryByJSON {
+		if fi.fieldType != fieldtype.Selection || !fi.isStored() {
+			continue
+		}
+		if fi.selectionFunc != "" {
+			// Allowed values depend on the environment
+			continue
+		}
+		values := []string{""}
+		for value := range fi.selection {
+			values = append(values, value)
+		}
+		constraintName := dbIdentifier(fmt.Sprintf("%s_%s_check", m.tableName, colName))
+		if definition := adapter.checkConstraintDefinition(constraintName); definition != "" {
+			if fi.selectionCheck && checkConstraintAllows(definition, values) {
+				// Values that are not allowed, including the ones to migrate, cannot be in the table
+				continue
+			}
+			// The constraint is dropped before migrating values, which it may not allow
+			dropDBConstraint(m.tableName, constraintName)
+		}
+		for oldValue, newValue := range fi.selectionMigrations {
+			query := fmt.Sprintf(`
+				UPDATE %s SET %s = ? WHERE %s = ?
+			`, adapter.quoteTableName(m.tableName), adapter.quoteTableName(colName), adapter.quoteTableName(colName))
+			syncExecute(query, newValue, oldValue)
+		}
+		if !tableInDB {
+			// The table is only created in the plan of the sync
+			if fi.selectionCheck {
+				createSelectionCheckConstraint(m.tableName, colName, constraintName, values)
+			}
+			continue
+		}
+		var orphans int
+		query := fmt.Sprintf(`
+			SELECT COUNT(*) FROM %s WHERE %s NOT IN (?)
+		`, adapter.quoteTableName(m.tableName), adapter.quoteTableName(colName))
+		dbGetNoTx(&orphans, query, values)
+		if orphans > 0 {
+			log.Warn("Orphan values in selection field. Use MigrateSelectionValue to remap them.", "model", m.name,
+				"field", fi.name, "count", orphans)
+			continue
+		}
+		if fi.selectionCheck {
+			createSelectionCheckConstraint(m.tableName, colName, constraintName, values)
+		}
+	}
+}
+
+// sqlStringLiteralRegexp matches the string literals of an SQL expression
+var sqlStringLiteralRegexp = regexp.MustCompile(`'((?:[^']|'')*)'`)
+
+// checkConstraintAllows returns true if the values of the string literals
+// of the given CHECK constraint definition are exactly the given values.
+func checkConstraintAllows(definition string, values []string) bool {
+	allowed := make(map[string]bool)
+	for _, matches := range sqlStringLiteralRegexp.FindAllStringSubmatch(definition, -1) {
+		allowed[strings.Replace(matches[1], "''", "'", -1)] = true
+	}
+	if len(allowed) != len(values) {
+		return false
+	}
+	for _, value := range values {
+		if !allowed[value] {
+			return false
+		}
+	}
+	return true
+}
+
+// createSelectionCheckConstraint creates a CHECK constraint with the given name
+// on colName so that its values can only be one of the given values.
+func createSelectionCheckConstraint(tableName, colName, constraintName string, values []string) {
+	adapter := adapters[db.DriverName()]
+	quotedValues := make([]string, len(values))
+	for i, value := range values {
+		quotedValues[i] = fmt.Sprintf("'%s'", strings.Replace(value, "'", "''", -1))
+	}
+	createDBConstraint(tableName, constraintName, fmt.Sprintf("CHECK (%s IN (%s))", adapter.quoteTableName(colName),
+		strings.Join(quotedValues, ", ")))
+}
+
+// createDBConstraint adds the constraint with the given name and definition
+// to the given table, if the database can add it to an existing table.
+func createDBConstraint(tableName, constraintName, definition string) {
+	adapter := adapters[db.DriverName()]
+	query := adapter.addConstraintSQL(tableName, constraintName, definition)
+	if query == "" {
+		log.Warn("Constraint not supported by the database", "table", tableName, "constraint", constraintName,
+			"definition", definition)
+		return
+	}
+	syncExecute(query)
+}
+
+// dropDBConstraint drops the constraint with the given name in the given table
+func dropDBConstraint(tableName, constraintName string) {
+	adapter := adapters[db.DriverName()]
+	if query := adapter.dropConstraintSQL(tableName, constraintName); query != "" {
+		syncExecute(query)
+	}
 }
 
 // bootStrapMethods freezes the methods of the models.
@@ -467,11 +824,13 @@ func bootStrapMethods() {
 }
 
 // setupSecurity adds execution permission to the
-// admin group for all methods
+// admin group for all methods and restricts the access
+// to the fields declared with Groups.
 func setupSecurity() {
 	for _, model := range Registry.registryByName {
 		for _, meth := range model.methods.registry {
 			meth.groups[security.GroupAdmin] = true
 		}
 	}
+	setupFieldGroups()
 }
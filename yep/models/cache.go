@@ -15,6 +15,7 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
 	"sync"
@@ -25,6 +26,21 @@ import (
 type cache struct {
 	sync.RWMutex
 	data map[RecordRef]FieldMap
+	// prefetch holds by model name the ids of the records
+	// to load with the next record of the model to load.
+	prefetch map[string]map[int64]bool
+	// computed holds the values of non stored computed fields
+	computed map[computedRef]interface{}
+}
+
+// A computedRef identifies the value of a non stored computed field of a
+// record. Since compute methods may depend on the user or on the context,
+// values are cached separately for each of them.
+type computedRef struct {
+	RecordRef
+	field   string
+	uid     int64
+	context string
 }
 
 // addEntry to the cache. fieldName must be a simple field name (no path)
@@ -70,7 +86,88 @@ func (c *cache) addRecord(mi *Model, ID int64, fMap FieldMap) {
 func (c *cache) invalidateRecord(mi *Model, ID int64) {
 	c.Lock()
 	defer c.Unlock()
-	delete(c.data, RecordRef{ModelName: mi.name, ID: ID})
+	ref := RecordRef{ModelName: mi.name, ID: ID}
+	delete(c.data, ref)
+	for cRef := range c.computed {
+		if cRef.RecordRef == ref {
+			delete(c.computed, cRef)
+		}
+	}
+}
+
+// clear removes all the values from the cache
+func (c *cache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.data = make(map[RecordRef]FieldMap)
+	c.computed = make(map[computedRef]interface{})
+}
+
+// invalidateFields removes the given fields of the records of the given
+// model with the given ids from the cache. If ids is nil, the fields are
+// removed for all the records of the model.
+func (c *cache) invalidateFields(mi *Model, ids []int64, jsonNames ...string) {
+	if len(jsonNames) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	fields := make(map[string]bool)
+	for _, jsonName := range jsonNames {
+		fields[jsonName] = true
+	}
+	records := make(map[int64]bool)
+	for _, id := range ids {
+		records[id] = true
+	}
+	matches := func(ref RecordRef) bool {
+		return ref.ModelName == mi.name && (ids == nil || records[ref.ID])
+	}
+	for ref, fMap := range c.data {
+		if !matches(ref) {
+			continue
+		}
+		for jsonName := range fields {
+			delete(fMap, jsonName)
+		}
+	}
+	for cRef := range c.computed {
+		if matches(cRef.RecordRef) && fields[cRef.field] {
+			delete(c.computed, cRef)
+		}
+	}
+}
+
+// addComputed adds the value of a non stored computed field to the cache
+func (c *cache) addComputed(ref computedRef, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.computed[ref] = value
+}
+
+// getComputed returns the cached value of a non stored computed field
+// and true, or false if it is not in cache.
+func (c *cache) getComputed(ref computedRef) (interface{}, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	value, ok := c.computed[ref]
+	return value, ok
+}
+
+// newComputedRef returns the computedRef of the given field of the
+// record with the given ID in the given Environment.
+func newComputedRef(env *Environment, mi *Model, ID int64, jsonName string) computedRef {
+	var ctxKey string
+	if env.context != nil && !env.context.IsEmpty() {
+		data, _ := json.Marshal(env.context)
+		ctxKey = string(data)
+	}
+	return computedRef{
+		RecordRef: RecordRef{ModelName: mi.name, ID: ID},
+		field:     jsonName,
+		uid:       env.uid,
+		context:   ctxKey,
+	}
 }
 
 // get returns the cache value of the given fieldName
@@ -123,7 +220,9 @@ func (c *cache) getRelatedRef(mi *Model, ID int64, path string) (RecordRef, stri
 // newCache creates a pointer to a new cache instance.
 func newCache() *cache {
 	res := cache{
-		data: make(map[RecordRef]FieldMap),
+		data:     make(map[RecordRef]FieldMap),
+		prefetch: make(map[string]map[int64]bool),
+		computed: make(map[computedRef]interface{}),
 	}
 	return &res
 }
@@ -0,0 +1,384 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// maxCalendarDays is the maximum number of days searched for working
+// time before giving up, so that calendars without working hours do not
+// loop forever.
+const maxCalendarDays = 3660
+
+// WorkingHours are the hours between HourFrom and HourTo during which
+// people work on the given day of the week. Hours are given as floats, so
+// that 13.5 means 13:30.
+type WorkingHours struct {
+	Weekday  time.Weekday
+	HourFrom float64
+	HourTo   float64
+}
+
+// A Leave is a period during which nobody works, such as a public holiday
+type Leave struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// A Calendar defines the working time of a resource, i.e. its working hours
+// of each day of the week minus its leaves. Calendars can be built directly
+// or loaded from the ResourceCalendar model with LoadCalendar.
+type Calendar struct {
+	Name string
+	// Location is the time zone of the working hours. Times given to the
+	// methods of the calendar are used in their own location if it is nil.
+	Location *time.Location
+	Hours    []WorkingHours
+	Leaves   []Leave
+}
+
+// A workInterval is an interval of working time
+type workInterval struct {
+	from time.Time
+	to   time.Time
+}
+
+// A calendarLine is a line of the resource_calendar table
+type calendarLine struct {
+	Name     string
+	Timezone string
+}
+
+// An attendanceLine is a line of the resource_calendar_attendance table
+type attendanceLine struct {
+	DayOfWeek int64
+	HourFrom  float64
+	HourTo    float64
+}
+
+// A leaveLine is a line of the resource_calendar_leave table
+type leaveLine struct {
+	Name     string
+	DateFrom time.Time
+	DateTo   time.Time
+}
+
+// declareCalendarModels creates the system models in
+// which calendars, their working hours and leaves are stored.
+func declareCalendarModels() {
+	calendar := createModel("ResourceCalendar", SystemModel)
+	calendar.AddCharField("Name", StringFieldParams{JSON: "name", Required: true})
+	calendar.AddCharField("Timezone", StringFieldParams{JSON: "timezone", Constraint: "checkTimezone"})
+	calendar.InheritModel(Registry.MustGet("CommonMixin"))
+
+	calendar.AddMethod("checkTimezone",
+		`checkTimezone returns an error if the time zone of
+		one of the calendars of this RecordSet is unknown.`,
+		func(rc RecordCollection) error {
+			for _, rec := range rc.Records() {
+				if _, err := time.LoadLocation(rec.Get("Timezone").(string)); err != nil {
+					return fmt.Errorf("invalid time zone of calendar '%s': %s", rec.Get("Name"), err)
+				}
+			}
+			return nil
+		})
+
+	attendance := createModel("ResourceCalendarAttendance", SystemModel)
+	attendance.AddIntegerField("CalendarID", SimpleFieldParams{JSON: "calendar_id", Required: true, Index: true})
+	attendance.AddIntegerField("DayOfWeek", SimpleFieldParams{JSON: "day_of_week", Constraint: "checkAttendance"})
+	attendance.AddFloatField("HourFrom", FloatFieldParams{JSON: "hour_from", Constraint: "checkAttendance"})
+	attendance.AddFloatField("HourTo", FloatFieldParams{JSON: "hour_to", Required: true, Constraint: "checkAttendance"})
+	attendance.InheritModel(Registry.MustGet("CommonMixin"))
+
+	attendance.AddMethod("checkAttendance",
+		`checkAttendance returns an error if the working hours
+		of one of the lines of this RecordSet are invalid.`,
+		func(rc RecordCollection) error {
+			for _, rec := range rc.Records() {
+				hours := WorkingHours{
+					Weekday:  time.Weekday(rec.Get("DayOfWeek").(int64)),
+					HourFrom: rec.Get("HourFrom").(float64),
+					HourTo:   rec.Get("HourTo").(float64),
+				}
+				if err := hours.check(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+	leave := createModel("ResourceCalendarLeave", SystemModel)
+	leave.AddIntegerField("CalendarID", SimpleFieldParams{JSON: "calendar_id", Index: true})
+	leave.AddCharField("Name", StringFieldParams{JSON: "name"})
+	leave.AddDateTimeField("DateFrom", SimpleFieldParams{JSON: "date_from", Required: true, Constraint: "checkLeave"})
+	leave.AddDateTimeField("DateTo", SimpleFieldParams{JSON: "date_to", Required: true, Constraint: "checkLeave"})
+	leave.InheritModel(Registry.MustGet("CommonMixin"))
+
+	leave.AddMethod("checkLeave",
+		`checkLeave returns an error if one of the leaves
+		of this RecordSet ends before it starts.`,
+		func(rc RecordCollection) error {
+			for _, rec := range rc.Records() {
+				from := rec.Get("DateFrom").(types.DateTime)
+				to := rec.Get("DateTo").(types.DateTime)
+				if !time.Time(to).After(time.Time(from)) {
+					return fmt.Errorf("leave '%s' ends before it starts", rec.Get("Name"))
+				}
+			}
+			return nil
+		})
+}
+
+// LoadCalendar returns the calendar with the given id of the ResourceCalendar
+// model, with its working hours and leaves. Leaves without calendar, such as
+// public holidays, apply to all calendars.
+//
+// It panics if the calendar does not exist or is invalid.
+func LoadCalendar(env Environment, id int64) Calendar {
+	var lines []calendarLine
+	env.Cr().Select(&lines, `SELECT name, COALESCE(timezone, '') AS timezone FROM resource_calendar WHERE id = ?`, id)
+	if len(lines) == 0 {
+		log.Panic("Unknown calendar", "id", id)
+	}
+	res := Calendar{Name: lines[0].Name}
+	if lines[0].Timezone != "" {
+		loc, err := time.LoadLocation(lines[0].Timezone)
+		if err != nil {
+			log.Panic("Invalid calendar time zone", "calendar", res.Name, "error", err)
+		}
+		res.Location = loc
+	}
+	var attendances []attendanceLine
+	env.Cr().Select(&attendances, `SELECT day_of_week, hour_from, hour_to FROM resource_calendar_attendance
+		WHERE calendar_id = ? ORDER BY day_of_week, hour_from`, id)
+	for _, line := range attendances {
+		res.Hours = append(res.Hours, WorkingHours{Weekday: time.Weekday(line.DayOfWeek), HourFrom: line.HourFrom,
+			HourTo: line.HourTo})
+	}
+	var leaves []leaveLine
+	env.Cr().Select(&leaves, `SELECT COALESCE(name, '') AS name, date_from, date_to FROM resource_calendar_leave
+		WHERE calendar_id = ? OR calendar_id IS NULL OR calendar_id = 0 ORDER BY date_from`, id)
+	for _, line := range leaves {
+		res.Leaves = append(res.Leaves, Leave{Name: line.Name, From: line.DateFrom, To: line.DateTo})
+	}
+	if err := res.Check(); err != nil {
+		log.Panic("Invalid calendar", "calendar", res.Name, "error", err)
+	}
+	return res
+}
+
+// check returns an error if these working hours are invalid
+func (h WorkingHours) check() error {
+	if h.Weekday < time.Sunday || h.Weekday > time.Saturday {
+		return fmt.Errorf("invalid day of week %d", h.Weekday)
+	}
+	if h.HourFrom < 0 || h.HourTo > 24 || h.HourFrom >= h.HourTo {
+		return fmt.Errorf("invalid working hours %g-%g", h.HourFrom, h.HourTo)
+	}
+	return nil
+}
+
+// Check returns an error if this calendar is invalid
+func (c Calendar) Check() error {
+	for _, hours := range c.Hours {
+		if err := hours.check(); err != nil {
+			return err
+		}
+	}
+	for _, leave := range c.Leaves {
+		if !leave.To.After(leave.From) {
+			return fmt.Errorf("leave '%s' ends before it starts", leave.Name)
+		}
+	}
+	return nil
+}
+
+// in returns t in the location of this calendar
+func (c Calendar) in(t time.Time) time.Time {
+	if c.Location == nil {
+		return t
+	}
+	return t.In(c.Location)
+}
+
+// startOfDay returns the midnight of the day of t in its location
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// atHour returns the time of the given day at the given hour.
+func atHour(day time.Time, hour float64) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, int(hour*3600), 0, day.Location())
+}
+
+// dayIntervals returns the sorted working intervals of the given day,
+// which must be a midnight in the location of this calendar.
+func (c Calendar) dayIntervals(day time.Time) []workInterval {
+	var res []workInterval
+	for _, hours := range c.Hours {
+		if hours.Weekday != day.Weekday() {
+			continue
+		}
+		res = append(res, workInterval{from: atHour(day, hours.HourFrom), to: atHour(day, hours.HourTo)})
+	}
+	for _, leave := range c.Leaves {
+		var kept []workInterval
+		for _, iv := range res {
+			if !leave.From.Before(iv.to) || !leave.To.After(iv.from) {
+				kept = append(kept, iv)
+				continue
+			}
+			if leave.From.After(iv.from) {
+				kept = append(kept, workInterval{from: iv.from, to: leave.From.In(day.Location())})
+			}
+			if leave.To.Before(iv.to) {
+				kept = append(kept, workInterval{from: leave.To.In(day.Location()), to: iv.to})
+			}
+		}
+		res = kept
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].from.Before(res[j].from)
+	})
+	return res
+}
+
+// IsWorkingDay returns true if there is working time on the day of t
+func (c Calendar) IsWorkingDay(t time.Time) bool {
+	return len(c.dayIntervals(startOfDay(c.in(t)))) > 0
+}
+
+// AddHours returns the time at which the given number of working hours
+// have elapsed since t. Working hours are subtracted if hours is negative.
+func (c Calendar) AddHours(t time.Time, hours float64) time.Time {
+	if hours < 0 {
+		return c.subtractHours(t, -hours)
+	}
+	t = c.in(t)
+	remaining := time.Duration(hours * float64(time.Hour))
+	day := startOfDay(t)
+	for i := 0; i < maxCalendarDays; i++ {
+		for _, iv := range c.dayIntervals(day) {
+			if !iv.to.After(t) {
+				continue
+			}
+			from := iv.from
+			if t.After(from) {
+				from = t
+			}
+			available := iv.to.Sub(from)
+			if remaining <= available {
+				return from.Add(remaining)
+			}
+			remaining -= available
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	log.Panic("No working time found in calendar", "calendar", c.Name, "start", t)
+	return time.Time{}
+}
+
+// subtractHours returns the time at which the given number
+// of working hours have to elapse to reach t.
+func (c Calendar) subtractHours(t time.Time, hours float64) time.Time {
+	t = c.in(t)
+	remaining := time.Duration(hours * float64(time.Hour))
+	day := startOfDay(t)
+	for i := 0; i < maxCalendarDays; i++ {
+		intervals := c.dayIntervals(day)
+		for j := len(intervals) - 1; j >= 0; j-- {
+			iv := intervals[j]
+			if !iv.from.Before(t) {
+				continue
+			}
+			to := iv.to
+			if t.Before(to) {
+				to = t
+			}
+			available := to.Sub(iv.from)
+			if remaining <= available {
+				return to.Add(-remaining)
+			}
+			remaining -= available
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	log.Panic("No working time found in calendar", "calendar", c.Name, "end", t)
+	return time.Time{}
+}
+
+// WorkingDuration returns the working time between from and to.
+// It is negative if to is before from.
+func (c Calendar) WorkingDuration(from, to time.Time) time.Duration {
+	if to.Before(from) {
+		return -c.WorkingDuration(to, from)
+	}
+	from, to = c.in(from), c.in(to)
+	var res time.Duration
+	for day := startOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, iv := range c.dayIntervals(day) {
+			start, end := iv.from, iv.to
+			if from.After(start) {
+				start = from
+			}
+			if to.Before(end) {
+				end = to
+			}
+			if end.After(start) {
+				res += end.Sub(start)
+			}
+		}
+	}
+	return res
+}
+
+// NextWorkingSlot returns the start and the end of the first working
+// interval at or after t. If t is in working time, the slot starts at t.
+// The last returned value is false if no working time has been found.
+func (c Calendar) NextWorkingSlot(t time.Time) (time.Time, time.Time, bool) {
+	t = c.in(t)
+	day := startOfDay(t)
+	for i := 0; i < maxCalendarDays; i++ {
+		for _, iv := range c.dayIntervals(day) {
+			if !iv.to.After(t) {
+				continue
+			}
+			if t.After(iv.from) {
+				return t, iv.to, true
+			}
+			return iv.from, iv.to, true
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// AddWorkingDays returns the time of the given number of working days after
+// t, at the same time of the day. Working days are subtracted if days is
+// negative.
+func (c Calendar) AddWorkingDays(t time.Time, days int) time.Time {
+	t = c.in(t)
+	step := 1
+	if days < 0 {
+		step, days = -1, -days
+	}
+	day := startOfDay(t)
+	for i := 0; days > 0; i++ {
+		if i >= maxCalendarDays {
+			log.Panic("No working day found in calendar", "calendar", c.Name, "start", t)
+		}
+		day = day.AddDate(0, 0, step)
+		if c.IsWorkingDay(day) {
+			days--
+		}
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(),
+		day.Location())
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// A ChangeOperation is the kind of modification of a record
+// recorded in the change feed.
+type ChangeOperation string
+
+// Change feed operations
+const (
+	ChangeCreate ChangeOperation = "create"
+	ChangeWrite  ChangeOperation = "write"
+	ChangeUnlink ChangeOperation = "unlink"
+)
+
+// A ChangeEvent is a committed modification of a record of a model
+// with the change feed enabled.
+type ChangeEvent struct {
+	ID        int64           `json:"id"`
+	Model     string          `json:"model"`
+	ResID     int64           `json:"res_id"`
+	Operation ChangeOperation `json:"operation"`
+	// Fields are the JSON names of the modified fields.
+	// It is empty for unlink events.
+	Fields []string  `json:"fields"`
+	TxID   int64     `json:"tx_id"`
+	Date   time.Time `json:"date"`
+	UID    int64     `json:"uid"`
+}
+
+// A changeEventRow is a row of the change_event table
+type changeEventRow struct {
+	ID        int64     `db:"id"`
+	ResModel  string    `db:"res_model"`
+	ResID     int64     `db:"res_id"`
+	Operation string    `db:"operation"`
+	Fields    string    `db:"fields"`
+	TxID      float64   `db:"tx_id"`
+	Date      time.Time `db:"date"`
+	UID       int64     `db:"uid"`
+}
+
+// declareChangeEventModel creates the system model in which the
+// modifications of the records of models with the change feed
+// enabled are recorded.
+//
+// TxID is a float field because integer fields are 32 bits while
+// transaction ids are 64 bits.
+func declareChangeEventModel() {
+	changeEvent := createModel("ChangeEvent", SystemModel)
+	changeEvent.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	changeEvent.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true})
+	changeEvent.AddSelectionField("Operation", SelectionFieldParams{JSON: "operation", Required: true,
+		Selection: types.Selection{
+			string(ChangeCreate): "Create",
+			string(ChangeWrite):  "Write",
+			string(ChangeUnlink): "Unlink",
+		}})
+	changeEvent.AddTextField("Fields", StringFieldParams{JSON: "fields"})
+	changeEvent.AddFloatField("TxID", FloatFieldParams{JSON: "tx_id", Required: true, Index: true})
+	changeEvent.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true})
+	changeEvent.AddIntegerField("UID", SimpleFieldParams{JSON: "uid"})
+	changeEvent.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// SetChangeFeed sets whether the creations, modifications and deletions of
+// the records of this model are recorded in the change feed, to be read
+// with ChangesSince.
+func (m *Model) SetChangeFeed(enabled bool) *Model {
+	m.changeFeed = enabled
+	return m
+}
+
+// logChanges records in the change feed the given operation on the
+// given fields for each record of rc, if the change feed is enabled
+// on its model. Events are inserted in the transaction of rc so that
+// they are only visible once it is committed.
+func (rc RecordCollection) logChanges(op ChangeOperation, fieldNames []string) {
+	if !rc.model.changeFeed {
+		return
+	}
+	fields := rc.model.changedFields(fieldNames)
+	if op == ChangeWrite && len(fields) == 0 {
+		return
+	}
+	query := fmt.Sprintf(`INSERT INTO change_event (res_model, res_id, operation, fields, tx_id, date, uid)
+		VALUES (?, ?, ?, ?, %s, ?, ?)`, adapters[db.DriverName()].currentTxIDSQL())
+	now := time.Now()
+	for _, id := range rc.ids {
+		rc.env.Cr().Execute(query, rc.model.name, id, string(op), strings.Join(fields, ","), now, rc.env.uid)
+	}
+}
+
+// changedFields returns the sorted JSON names of the given fields of m,
+// without ID and the access fields which change on every write.
+func (m *Model) changedFields(fieldNames []string) []string {
+	done := make(map[string]bool)
+	res := make([]string, 0, len(fieldNames))
+	for _, fName := range fieldNames {
+		jsonName := m.JSONizeFieldName(fName)
+		switch jsonName {
+		case "id", "write_date", "write_uid":
+			continue
+		}
+		if done[jsonName] {
+			continue
+		}
+		done[jsonName] = true
+		res = append(res, jsonName)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ChangesSince returns at most limit events of the change feed that come
+// after the given cursor, and the cursor to pass to get the next events.
+// An empty cursor returns the events from the beginning of the feed.
+//
+// Events are ordered by transaction and only the events of transactions
+// that are older than all running transactions are returned, so that
+// events committed by a long transaction are never skipped by consumers.
+// As a consequence, a long running transaction delays the feed.
+func ChangesSince(env Environment, cursor string, limit int) ([]ChangeEvent, string) {
+	if limit <= 0 {
+		log.Panic("Change feed limit must be positive", "limit", limit)
+	}
+	txID, id := decodeChangeCursor(cursor)
+	query := fmt.Sprintf(`SELECT id, res_model, res_id, operation, fields, tx_id, date, uid
+		FROM change_event
+		WHERE (tx_id, id) > (?, ?) AND tx_id < %s
+		ORDER BY tx_id, id
+		LIMIT ?`, adapters[db.DriverName()].oldestRunningTxIDSQL())
+	var rows []changeEventRow
+	env.Cr().Select(&rows, query, txID, id, limit)
+	res := make([]ChangeEvent, len(rows))
+	for i, row := range rows {
+		var fields []string
+		if row.Fields != "" {
+			fields = strings.Split(row.Fields, ",")
+		}
+		res[i] = ChangeEvent{
+			ID:        row.ID,
+			Model:     row.ResModel,
+			ResID:     row.ResID,
+			Operation: ChangeOperation(row.Operation),
+			Fields:    fields,
+			TxID:      int64(row.TxID),
+			Date:      row.Date,
+			UID:       row.UID,
+		}
+	}
+	if len(res) == 0 {
+		return res, cursor
+	}
+	last := res[len(res)-1]
+	return res, fmt.Sprintf("%d-%d", last.TxID, last.ID)
+}
+
+// decodeChangeCursor returns the transaction id and event id of the
+// given change feed cursor. It panics if the cursor is invalid.
+func decodeChangeCursor(cursor string) (int64, int64) {
+	if cursor == "" {
+		return 0, 0
+	}
+	var txID, id int64
+	if _, err := fmt.Sscanf(cursor, "%d-%d", &txID, &id); err != nil {
+		log.Panic("Invalid change feed cursor", "cursor", cursor, "error", err)
+	}
+	return txID, id
+}
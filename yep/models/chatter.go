@@ -0,0 +1,376 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// chatterMixinName is the name of the mixin adding messages and followers to a model
+const chatterMixinName = "ChatterMixin"
+
+// Types of chatter messages
+const (
+	// MessageComment is a message posted by a user
+	MessageComment = "comment"
+	// MessageNotification is a message posted automatically,
+	// e.g. when tracked fields are modified.
+	MessageNotification = "notification"
+)
+
+// A ChatterMessage is a message posted on a record of a model inheriting ChatterMixin
+type ChatterMessage struct {
+	ID          int64           `json:"id"`
+	ResModel    string          `json:"res_model"`
+	ResID       int64           `json:"res_id"`
+	AuthorUID   int64           `json:"author_uid"`
+	Body        string          `json:"body"`
+	MessageType string          `json:"message_type"`
+	Date        types.DateTime  `json:"date"`
+	Tracking    []TrackingValue `json:"tracking"`
+}
+
+// A TrackingValue is the modification of a tracked field
+// reported in a notification message.
+type TrackingValue struct {
+	Field    string      `json:"field"`
+	OldValue interface{} `json:"old_value"`
+	NewValue interface{} `json:"new_value"`
+}
+
+// A ChatterNotifier notifies the followers of a record of its new messages
+type ChatterNotifier interface {
+	// NotifyFollowers notifies the users with the given uids that
+	// the given message has been posted on the given record.
+	NotifyFollowers(rc RecordCollection, message ChatterMessage, uids []int64) error
+}
+
+// ChatterNotifications is the ChatterNotifier of the application.
+// Followers are not notified if it is nil.
+var ChatterNotifications ChatterNotifier
+
+// A messageLine is a message as stored in the chatter_message table
+type messageLine struct {
+	ID          int64
+	ResID       int64
+	AuthorUID   int64
+	Body        *string
+	MessageType string
+	Date        time.Time
+	Tracking    *string
+}
+
+// A trackingLine is the modification of a tracked field as stored in the
+// tracking column of the chatter_message table. Values are serialized with
+// encodeFieldValue.
+type trackingLine struct {
+	Field    string          `json:"field"`
+	OldValue json.RawMessage `json:"old_value"`
+	NewValue json.RawMessage `json:"new_value"`
+}
+
+// declareChatterModels creates the ChatterMixin and the system
+// models in which messages and followers are stored.
+func declareChatterModels() {
+	message := createModel("ChatterMessage", SystemModel)
+	message.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	message.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	message.AddIntegerField("AuthorUID", SimpleFieldParams{JSON: "author_uid"})
+	message.AddTextField("Body", StringFieldParams{JSON: "body"})
+	message.AddSelectionField("MessageType", SelectionFieldParams{JSON: "message_type", Required: true,
+		Selection: types.Selection{
+			MessageComment:      "Comment",
+			MessageNotification: "Notification",
+		}})
+	message.AddTextField("Tracking", StringFieldParams{JSON: "tracking"})
+	message.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true})
+	message.InheritModel(Registry.MustGet("CommonMixin"))
+
+	follower := createModel("ChatterFollower", SystemModel)
+	follower.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	follower.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	follower.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true, Index: true})
+	follower.InheritModel(Registry.MustGet("CommonMixin"))
+
+	chatterMixin := NewMixinModel(chatterMixinName)
+
+	chatterMixin.AddMethod("Messages",
+		`Messages returns the messages posted on this record,
+		from the most recent to the oldest.`,
+		func(rc RecordCollection) []ChatterMessage {
+			return rc.Messages()
+		}).AllowGroup(security.GroupEveryone)
+
+	chatterMixin.AddMethod("Followers",
+		`Followers returns the uids of the users following this record.`,
+		func(rc RecordCollection) []int64 {
+			return rc.Followers()
+		}).AllowGroup(security.GroupEveryone)
+
+	chatterMixin.AddMethod("PostMessage",
+		`PostMessage posts the given message on the records of this RecordSet
+		and notifies their followers. The author follows the records afterwards.`,
+		func(rc RecordCollection, body string) {
+			rc.PostMessage(body)
+		}).AllowGroup(security.GroupEveryone)
+
+	chatterMixin.AddMethod("AddFollowers",
+		`AddFollowers subscribes the users with the given uids to the messages
+		of the records of this RecordSet.`,
+		func(rc RecordCollection, uids []int64) {
+			rc.AddFollowers(uids...)
+		}).AllowGroup(security.GroupEveryone)
+
+	chatterMixin.AddMethod("RemoveFollowers",
+		`RemoveFollowers unsubscribes the users with the given uids from
+		the messages of the records of this RecordSet.`,
+		func(rc RecordCollection, uids []int64) {
+			rc.RemoveFollowers(uids...)
+		}).AllowGroup(security.GroupEveryone)
+}
+
+// hasChatter returns true if this model inherits ChatterMixin
+func (m *Model) hasChatter() bool {
+	if m.isMixin() {
+		return false
+	}
+	for _, mixin := range m.allMixins() {
+		if mixin.name == chatterMixinName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChatterModel panics if the model of rc does not inherit ChatterMixin
+func (rc RecordCollection) checkChatterModel() {
+	if !rc.model.hasChatter() {
+		log.Panic("Model does not inherit ChatterMixin", "model", rc.model.name)
+	}
+}
+
+// Messages returns the messages posted on this singleton, from the most
+// recent to the oldest. Tracking values of the fields that the current
+// user cannot read are not returned.
+func (rc RecordCollection) Messages() []ChatterMessage {
+	rc.checkChatterModel()
+	rc.EnsureOne()
+	var lines []messageLine
+	query := `SELECT id, res_id, author_uid, body, message_type, date, tracking FROM chatter_message
+		WHERE res_model = ? AND res_id = ? ORDER BY id DESC`
+	rc.env.Cr().Select(&lines, query, rc.model.name, rc.ids[0])
+	res := make([]ChatterMessage, len(lines))
+	for i, line := range lines {
+		res[i] = ChatterMessage{
+			ID:          line.ID,
+			ResModel:    rc.model.name,
+			ResID:       line.ResID,
+			AuthorUID:   line.AuthorUID,
+			MessageType: line.MessageType,
+			Date:        types.DateTime(line.Date),
+		}
+		if line.Body != nil {
+			res[i].Body = *line.Body
+		}
+		if line.Tracking != nil {
+			res[i].Tracking = rc.trackingValues(*line.Tracking)
+		}
+	}
+	return res
+}
+
+// trackingValues returns the tracking values serialized as data
+// that the current user is allowed to read.
+func (rc RecordCollection) trackingValues(data string) []TrackingValue {
+	var lines []trackingLine
+	if err := json.Unmarshal([]byte(data), &lines); err != nil {
+		log.Panic("Unable to read tracking values", "model", rc.model.name, "error", err)
+	}
+	var res []TrackingValue
+	for _, line := range lines {
+		fi, ok := rc.model.fields.get(line.Field)
+		if !ok || !checkFieldPermission(fi, rc.env.uid, security.Read) {
+			continue
+		}
+		oldValue, newValue := string(line.OldValue), string(line.NewValue)
+		res = append(res, TrackingValue{
+			Field:    fi.json,
+			OldValue: rc.auditValue(fi, &oldValue),
+			NewValue: rc.auditValue(fi, &newValue),
+		})
+	}
+	return res
+}
+
+// Followers returns the uids of the users following this singleton
+func (rc RecordCollection) Followers() []int64 {
+	rc.checkChatterModel()
+	rc.EnsureOne()
+	var uids []int64
+	query := `SELECT uid FROM chatter_follower WHERE res_model = ? AND res_id = ? ORDER BY uid`
+	rc.env.Cr().Select(&uids, query, rc.model.name, rc.ids[0])
+	return uids
+}
+
+// AddFollowers subscribes the users with the given uids to the messages of
+// the records of this RecordCollection. Users already following a record
+// are ignored.
+func (rc RecordCollection) AddFollowers(uids ...int64) {
+	rc.checkChatterModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("follow")
+	query := `INSERT INTO chatter_follower (res_model, res_id, uid) VALUES (?, ?, ?)`
+	for _, rec := range rc.Records() {
+		followers := make(map[int64]bool)
+		for _, uid := range rec.Followers() {
+			followers[uid] = true
+		}
+		for _, uid := range uids {
+			if followers[uid] {
+				continue
+			}
+			rc.env.Cr().Execute(query, rc.model.name, rec.ids[0], uid)
+			followers[uid] = true
+		}
+	}
+}
+
+// RemoveFollowers unsubscribes the users with the given uids
+// from the messages of the records of this RecordCollection.
+func (rc RecordCollection) RemoveFollowers(uids ...int64) {
+	rc.checkChatterModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("unfollow")
+	rSet := rc.Fetch()
+	if rSet.IsEmpty() || len(uids) == 0 {
+		return
+	}
+	query := `DELETE FROM chatter_follower WHERE res_model = ? AND res_id IN (?) AND uid IN (?)`
+	rc.env.Cr().Execute(query, rc.model.name, rSet.ids, uids)
+}
+
+// PostMessage posts the given message on the records of this RecordCollection
+// on behalf of the current user and notifies their followers. The current
+// user follows the records afterwards.
+func (rc RecordCollection) PostMessage(body string) {
+	rc.checkChatterModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("post")
+	for _, rec := range rc.Records() {
+		rec.postMessage(MessageComment, body, nil)
+		rec.AddFollowers(rc.env.uid)
+	}
+}
+
+// postMessage stores a message of the given type with the given body and
+// tracking values for this singleton and notifies the followers of the record
+// except its author.
+func (rc RecordCollection) postMessage(messageType, body string, tracking []trackingLine) {
+	var trackingData interface{}
+	if len(tracking) > 0 {
+		data, err := json.Marshal(tracking)
+		if err != nil {
+			log.Panic("Unable to serialize tracking values", "model", rc.model.name, "error", err)
+		}
+		trackingData = string(data)
+	}
+	query := `INSERT INTO chatter_message (res_model, res_id, author_uid, body, message_type, date, tracking)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	rc.env.Cr().Execute(query, rc.model.name, rc.ids[0], rc.env.uid, body, messageType, time.Now(), trackingData)
+	if ChatterNotifications == nil {
+		return
+	}
+	var uids []int64
+	for _, uid := range rc.Followers() {
+		if uid != rc.env.uid {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+	messages := rc.Messages()
+	if err := ChatterNotifications.NotifyFollowers(rc, messages[0], uids); err != nil {
+		log.Warn("Unable to notify followers", "model", rc.model.name, "id", rc.ids[0], "error", err)
+	}
+}
+
+// trackedValues returns the current values, serialized with encodeFieldValue,
+// of the tracked fields about to be written with the given FieldMap on the
+// records of rc, by record id. It must be called before the records are
+// updated and its result given to postTrackingMessages afterwards.
+func (rc RecordCollection) trackedValues(fMap FieldMap) map[int64]map[string]string {
+	if !rc.model.hasChatter() {
+		return nil
+	}
+	values := rc.auditedValues(fMap)
+	if len(values) == 0 {
+		return nil
+	}
+	res := make(map[int64]map[string]string)
+	for _, rec := range rc.Records() {
+		res[rec.ids[0]] = make(map[string]string)
+		for fJSON := range values {
+			res[rec.ids[0]][fJSON] = encodeFieldValue(rec.get(fJSON, true))
+		}
+	}
+	return res
+}
+
+// postTrackingMessages posts a notification message on each record of rc
+// whose tracked fields have been modified, given their values before the
+// update as returned by trackedValues.
+func (rc RecordCollection) postTrackingMessages(oldValues map[int64]map[string]string) {
+	if len(oldValues) == 0 {
+		return
+	}
+	for _, rec := range rc.Records() {
+		var tracking []trackingLine
+		for _, fi := range rc.model.auditedFields() {
+			oldValue, ok := oldValues[rec.ids[0]][fi.json]
+			if !ok {
+				continue
+			}
+			newValue := encodeFieldValue(rec.get(fi.json, true))
+			if newValue == oldValue {
+				continue
+			}
+			tracking = append(tracking, trackingLine{
+				Field:    fi.json,
+				OldValue: json.RawMessage(oldValue),
+				NewValue: json.RawMessage(newValue),
+			})
+		}
+		if len(tracking) == 0 {
+			continue
+		}
+		rec.postMessage(MessageNotification, "", tracking)
+	}
+}
+
+// subscribeCreator makes the current user follow the records of rc,
+// which have just been created.
+func (rc RecordCollection) subscribeCreator() {
+	if !rc.model.hasChatter() {
+		return
+	}
+	rc.AddFollowers(rc.env.uid)
+}
+
+// deleteChatter deletes the messages and followers of the records of rc.
+// It must be called when the records are deleted.
+func (rc RecordCollection) deleteChatter() {
+	if !rc.model.hasChatter() || len(rc.ids) == 0 {
+		return
+	}
+	for _, table := range []string{"chatter_message", "chatter_follower"} {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE res_model = ? AND res_id IN (?)`, table)
+		rc.env.Cr().Execute(query, rc.model.name, rc.ids)
+	}
+}
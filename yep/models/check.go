@@ -0,0 +1,207 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A RegistryProblem is an inconsistency found in the declarations of a
+// registry, such as a computed field whose method does not exist.
+type RegistryProblem struct {
+	// Object describes the faulty declaration, e.g. "model User, field Age"
+	Object  string
+	Message string
+}
+
+// String returns the problem as a single line
+func (rp RegistryProblem) String() string {
+	return fmt.Sprintf("%s: %s", rp.Object, rp.Message)
+}
+
+// A RegistryReport is the list of problems found when checking registries
+type RegistryReport []RegistryProblem
+
+// Add appends to this report a problem of the given object. The message
+// is formatted with the given args as in fmt.Sprintf.
+func (rr *RegistryReport) Add(object, format string, args ...interface{}) {
+	*rr = append(*rr, RegistryProblem{Object: object, Message: fmt.Sprintf(format, args...)})
+}
+
+// Extend appends all the problems of other to this report
+func (rr *RegistryReport) Extend(other RegistryReport) {
+	*rr = append(*rr, other...)
+}
+
+// String returns the problems of this report sorted by object, one per line.
+func (rr RegistryReport) String() string {
+	lines := make([]string, len(rr))
+	for i, problem := range rr {
+		lines[i] = problem.String()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// CheckRegistry checks the declarations of all models and returns a report
+// of all the problems found, such as relation fields to unknown models,
+// missing compute, onchange or constraint methods and broken related paths.
+//
+// CheckRegistry is meant to be called before BootStrap, which panics on the
+// first problem it finds, so that all problems can be fixed at once. It can
+// also be called on a bootstrapped registry.
+func CheckRegistry() RegistryReport {
+	var report RegistryReport
+	for _, mi := range Registry.registryByName {
+		if mi.isMixin() {
+			// Mixin fields are checked in the models they are injected into.
+			continue
+		}
+		checkModel(mi, &report)
+	}
+	return report
+}
+
+// checkModel adds to report the problems of the declarations of the given model.
+func checkModel(mi *Model, report *RegistryReport) {
+	for _, fi := range mi.declaredFields() {
+		object := fmt.Sprintf("model %s, field %s", mi.name, fi.name)
+		if fi.fieldType.IsRelationType() {
+			if _, ok := Registry.Get(fi.relatedModelName); !ok {
+				report.Add(object, "unknown related model '%s'", fi.relatedModelName)
+			}
+		}
+		for _, meth := range []struct {
+			kind string
+			name string
+		}{
+			{kind: "compute", name: fi.compute},
+			{kind: "onchange", name: fi.onChange},
+			{kind: "constraint", name: fi.constraint},
+			{kind: "selection", name: fi.selectionFunc},
+		} {
+			if meth.name != "" && !mi.declaresMethod(meth.name) {
+				report.Add(object, "unknown %s method '%s'", meth.kind, meth.name)
+			}
+		}
+		if fi.relatedPath != "" {
+			if msg := mi.checkRelatedPath(fi.relatedPath); msg != "" {
+				report.Add(object, "invalid related path '%s': %s", fi.relatedPath, msg)
+			}
+		}
+	}
+	if mi.recName != "" {
+		if _, ok := mi.declaredField(mi.recName); !ok {
+			report.Add("model "+mi.name, "unknown rec name field '%s'", mi.recName)
+		}
+	}
+	if mi.parentName != "" {
+		if _, ok := mi.declaredField(mi.parentName); !ok {
+			report.Add("model "+mi.name, "unknown parent field '%s'", mi.parentName)
+		}
+	}
+	for _, rule := range mi.rulesRegistry.rulesByName {
+		if rule.domain == nil {
+			continue
+		}
+		if err := mi.checkDomain(rule.domain); err != nil {
+			report.Add(fmt.Sprintf("model %s, record rule %s", mi.name, rule.Name), "%s", err)
+		}
+	}
+	for _, method := range mi.methods.registry {
+		for _, level := range method.approvalLevels {
+			if level.condition == nil {
+				continue
+			}
+			if err := mi.CheckExpr(level.condition); err != nil {
+				report.Add(fmt.Sprintf("model %s, approval level %s of %s", mi.name, level.Name, method.name), "%s", err)
+			}
+		}
+	}
+}
+
+// declaredFields returns the fields declared on this model and on its mixins,
+// the former shadowing the latter.
+func (m *Model) declaredFields() []*Field {
+	var res []*Field
+	seen := make(map[string]bool)
+	for _, model := range append([]*Model{m}, m.allMixins()...) {
+		for fName, fi := range model.fields.registryByName {
+			if seen[fName] {
+				continue
+			}
+			seen[fName] = true
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
+// declaredField returns the field with the given name or JSON name that is
+// declared on this model, on one of its mixins or on a model embedded in it.
+// Contrary to m.fields.get, it can be called before bootstrap.
+func (m *Model) declaredField(name string) (*Field, bool) {
+	if fi, ok := m.fields.get(name); ok {
+		return fi, true
+	}
+	for _, mixin := range m.allMixins() {
+		if fi, ok := mixin.fields.get(name); ok {
+			return fi, true
+		}
+	}
+	for _, fi := range m.declaredFields() {
+		if !fi.embed {
+			continue
+		}
+		if embedded, ok := Registry.Get(fi.relatedModelName); ok && embedded != m {
+			if rfi, ok := embedded.declaredField(name); ok {
+				return rfi, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// DeclaresField returns true if a field with the given name or JSON name
+// is declared on this model, on one of its mixins or on a model embedded
+// in it. It can be called before bootstrap.
+func (m *Model) DeclaresField(name string) bool {
+	_, ok := m.declaredField(name)
+	return ok
+}
+
+// declaresMethod returns true if a method with the given name is declared
+// on this model or on one of its mixins.
+func (m *Model) declaresMethod(name string) bool {
+	if _, ok := m.methods.get(name); ok {
+		return true
+	}
+	_, ok := m.findMethodInMixin(name)
+	return ok
+}
+
+// checkRelatedPath returns a message describing why the given related path
+// is not valid from this model, or an empty string if it is valid.
+func (m *Model) checkRelatedPath(path string) string {
+	model := m
+	exprs := strings.Split(path, ExprSep)
+	for i, expr := range exprs {
+		fi, ok := model.declaredField(expr)
+		if !ok {
+			return fmt.Sprintf("unknown field '%s' in model '%s'", expr, model.name)
+		}
+		if i == len(exprs)-1 {
+			break
+		}
+		if !fi.fieldType.IsRelationType() {
+			return fmt.Sprintf("field '%s' of model '%s' is not a relation field", expr, model.name)
+		}
+		if model, ok = Registry.Get(fi.relatedModelName); !ok {
+			return fmt.Sprintf("unknown related model '%s'", fi.relatedModelName)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// lastUpdateContextKey is the context key holding the versions of the records
+// as read by the client, i.e. the values of their LastUpdate field, by
+// "Model,id" key.
+const lastUpdateContextKey = "__last_update"
+
+// versionLayout is the layout of record versions as sent by the client
+const versionLayout = "2006-01-02 15:04:05"
+
+// SetConcurrency sets whether writes on the records of this model are checked
+// against concurrent updates. If enabled, Write fails with a
+// ConcurrentUpdateError when the version of a record given in the
+// __last_update context key is older than its LastUpdate field.
+func (m *Model) SetConcurrency(enabled bool) *Model {
+	if enabled {
+		m.options |= Concurrency
+	} else {
+		m.options &^= Concurrency
+	}
+	return m
+}
+
+// hasConcurrencyCheck returns true if writes on the records of
+// this model are checked against concurrent updates.
+func (m *Model) hasConcurrencyCheck() bool {
+	if m.options&Concurrency == 0 {
+		return false
+	}
+	_, ok := m.fields.get("LastUpdate")
+	return ok
+}
+
+// versionKey returns the key of the given record in the map
+// of the __last_update context key.
+func (m *Model) versionKey(id int64) string {
+	return fmt.Sprintf("%s,%d", m.name, id)
+}
+
+// Versions returns the versions of the records of this RecordCollection,
+// to be given in the __last_update context key when writing them later on:
+//
+//	versions := rs.Versions()
+//	// ... in another transaction
+//	rs.WithContext("__last_update", versions).Call("Write", data)
+func (rc RecordCollection) Versions() map[string]interface{} {
+	res := make(map[string]interface{})
+	if _, ok := rc.model.fields.get("LastUpdate"); !ok {
+		return res
+	}
+	for _, rec := range rc.Records() {
+		res[rc.model.versionKey(rec.ids[0])] = rec.Get("LastUpdate")
+	}
+	return res
+}
+
+// checkConcurrency panics with a ConcurrentUpdateError if records of rc have
+// been modified since the version given for them in the __last_update context
+// key. Versions are compared to the second, as the client reads them.
+//
+// The version of a record is only checked once per transaction, so that
+// records can be written several times by the same operation.
+func (rc RecordCollection) checkConcurrency() {
+	if !rc.model.hasConcurrencyCheck() || rc.env.context == nil || !rc.env.context.HasKey(lastUpdateContextKey) {
+		return
+	}
+	versions, ok := rc.env.context.Get(lastUpdateContextKey).(map[string]interface{})
+	if !ok {
+		log.Panic("Invalid __last_update context value", "model", rc.model.name,
+			"value", rc.env.context.Get(lastUpdateContextKey))
+	}
+	var conflicts []int64
+	for _, rec := range rc.Records() {
+		key := rc.model.versionKey(rec.ids[0])
+		version, ok := versions[key]
+		if !ok || rc.env.checkedVersions[key] {
+			continue
+		}
+		readVersion, ok := formatVersion(version, rc.env.Location())
+		if !ok {
+			log.Panic("Invalid record version", "model", rc.model.name, "id", rec.ids[0], "version", version)
+		}
+		rc.env.checkedVersions[key] = true
+		lastUpdate, _ := formatVersion(rec.Get("LastUpdate"), rc.env.Location())
+		if lastUpdate > readVersion {
+			conflicts = append(conflicts, rec.ids[0])
+		}
+	}
+	if len(conflicts) > 0 {
+		panic(ConcurrentUpdateError{Model: rc.model.name, IDs: conflicts})
+	}
+}
+
+// formatVersion returns the given record version, which can be a DateTime,
+// a time.Time or a string as sent by the client in the given location, as a
+// "YYYY-MM-DD HH:MM:SS" string in UTC so that versions can be compared to the
+// second.
+func formatVersion(version interface{}, loc *time.Location) (string, bool) {
+	switch v := version.(type) {
+	case types.DateTime:
+		return time.Time(v).UTC().Format(versionLayout), true
+	case time.Time:
+		return v.UTC().Format(versionLayout), true
+	case string:
+		t, err := time.ParseInLocation(versionLayout, v, loc)
+		if err != nil {
+			return "", false
+		}
+		return t.UTC().Format(versionLayout), true
+	}
+	return "", false
+}
@@ -129,12 +129,35 @@ func (cs ConditionStart) Field(name string) *ConditionField {
 
 // FilteredOn adds a condition with a table join on the given field and
 // filters the result with the given condition
+//
+// The filtered condition is added between brackets with the logical
+// operator of this ConditionStart: c.Or().FilteredOn(f, cond) => c OR (f.cond)
 func (cs ConditionStart) FilteredOn(field string, condition *Condition) *Condition {
 	res := cs.cond
-	for i, p := range condition.predicates {
-		condition.predicates[i].exprs = append([]string{field}, p.exprs...)
+	res.predicates = append(res.predicates, predicate{
+		cond:   condition.filteredOn(field),
+		isCond: true,
+		isOr:   cs.nextIsOr,
+		isNot:  cs.nextIsNot,
+	})
+	return &res
+}
+
+// filteredOn returns a copy of this condition in which the field paths of
+// all predicates, including those of nested conditions, are prefixed with
+// the given field.
+func (c Condition) filteredOn(field string) *Condition {
+	res := Condition{predicates: make([]predicate, len(c.predicates))}
+	for i, p := range c.predicates {
+		if p.isCond {
+			if p.cond != nil {
+				p.cond = p.cond.filteredOn(field)
+			}
+		} else {
+			p.exprs = append([]string{field}, p.exprs...)
+		}
+		res.predicates[i] = p
 	}
-	res.predicates = append(res.predicates, condition.predicates...)
 	return &res
 }
 
@@ -271,17 +294,23 @@ func (c ConditionField) ChildOf(data interface{}) *Condition {
 	return c.AddOperator(operator.ChildOf, data)
 }
 
+// ParentOf appends the 'parent of' operator to the current Condition
+func (c ConditionField) ParentOf(data interface{}) *Condition {
+	return c.AddOperator(operator.ParentOf, data)
+}
+
 // IsEmpty check the condition arguments are empty or not.
+// A condition whose predicates are only empty nested conditions is empty.
 func (c *Condition) IsEmpty() bool {
-	switch {
-	case c == nil:
+	if c == nil {
 		return false
-	case len(c.predicates) == 0:
-		return true
-	case len(c.predicates) == 1 && c.predicates[0].cond.IsEmpty():
-		return true
 	}
-	return false
+	for _, p := range c.predicates {
+		if !p.isCond || (p.cond != nil && !p.cond.IsEmpty()) {
+			return false
+		}
+	}
+	return true
 }
 
 // getAllExpressions returns a list of all exprs used in this condition,
@@ -0,0 +1,64 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"strings"
+	"sync"
+)
+
+// defaultContextKeyPrefix is the prefix of the context keys giving the default
+// value of a field, e.g. "default_partner_id" for the PartnerID field.
+const defaultContextKeyPrefix = "default_"
+
+// nonPropagatedContextKeys is the deny-list of context keys that are not
+// forwarded to sub-operations. Keys ending with an underscore are prefixes.
+var nonPropagatedContextKeys = struct {
+	sync.RWMutex
+	keys []string
+}{
+	keys: []string{
+		defaultContextKeyPrefix,
+		activeIDContextKey,
+		activeIDsContextKey,
+		activeModelContextKey,
+	},
+}
+
+// AddNonPropagatedContextKey adds the given key to the list of context keys
+// that are not forwarded to sub-operations, such as the creation of embedded
+// records or of the lines of a one2many field. If key ends with an underscore,
+// all the keys starting with key are concerned.
+//
+// Modules should namespace their own context keys with their name
+// (e.g. "sale_xxx") to avoid clashes with other modules.
+func AddNonPropagatedContextKey(key string) {
+	nonPropagatedContextKeys.Lock()
+	defer nonPropagatedContextKeys.Unlock()
+	nonPropagatedContextKeys.keys = append(nonPropagatedContextKeys.keys, key)
+}
+
+// isNonPropagatedContextKey returns true if the given context key must
+// not be forwarded to sub-operations.
+func isNonPropagatedContextKey(key string) bool {
+	nonPropagatedContextKeys.RLock()
+	defer nonPropagatedContextKeys.RUnlock()
+	for _, k := range nonPropagatedContextKeys.keys {
+		if k == key || (strings.HasSuffix(k, "_") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// subOperationEnv returns a copy of this Environment to be used for the
+// sub-operations of a method, with the non propagated keys removed from its
+// context. The cursor, user and cache are shared with this Environment.
+func (env Environment) subOperationEnv() Environment {
+	if env.context == nil {
+		return env
+	}
+	env.context = env.context.WithoutKeys(isNonPropagatedContextKey)
+	return env
+}
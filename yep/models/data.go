@@ -16,6 +16,10 @@ import (
 )
 
 // LoadCSVDataFile loads the data of the given file into the database.
+//
+// Files named "<Model>_defaults.csv" do not hold records but the default
+// values of the fields of the model on their first line. These defaults
+// override the default functions of the fields when creating records.
 func LoadCSVDataFile(fileName string) {
 	csvFile, err := os.Open(fileName)
 	defer csvFile.Close()
@@ -26,8 +30,9 @@ func LoadCSVDataFile(fileName string) {
 	elements := strings.Split(path.Base(fileName), "_")
 	modelName := strings.Split(elements[0], ".")[0]
 	var (
-		update  bool
-		version int
+		update   bool
+		defaults bool
+		version  int
 	)
 	if len(elements) == 2 {
 		mod := strings.Split(elements[1], ".")[0]
@@ -35,6 +40,8 @@ func LoadCSVDataFile(fileName string) {
 		switch {
 		case strings.ToLower(mod) == "update":
 			update = true
+		case strings.ToLower(mod) == "defaults":
+			defaults = true
 		case err == nil:
 			version = ver
 		}
@@ -45,6 +52,10 @@ func LoadCSVDataFile(fileName string) {
 	if err != nil {
 		log.Panic("Unable to read CSV headers in data file", "error", err, "fileName", fileName)
 	}
+	if defaults {
+		loadCSVDefaults(modelName, headers, r, fileName)
+		return
+	}
 
 	err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
 		rc := env.Pool(modelName)
@@ -83,6 +94,33 @@ func LoadCSVDataFile(fileName string) {
 	}
 }
 
+// loadCSVDefaults stores the values of the first line of a defaults data file
+// as the default values of the fields of the given model. Empty values are
+// ignored.
+func loadCSVDefaults(modelName string, headers []string, r *csv.Reader, fileName string) {
+	record, err := r.Read()
+	if err != nil {
+		log.Panic("Unable to read default values in data file", "error", err, "fileName", fileName)
+	}
+	err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		rc := env.Pool(modelName)
+		var fields, values []string
+		for i, header := range headers {
+			if record[i] == "" {
+				continue
+			}
+			fields = append(fields, rc.Model().JSONizeFieldName(header))
+			values = append(values, record[i])
+		}
+		for field, value := range getRecordValuesMap(fields, modelName, values, env, 1) {
+			rc.setDataDefault(rc.model.fields.MustGet(field), value)
+		}
+	})
+	if err != nil {
+		log.Panic("Error while loading default values", "error", err, "fileName", fileName)
+	}
+}
+
 func getRecordValuesMap(headers []string, modelName string, record []string, env Environment, line int) FieldMap {
 	values := make(map[string]interface{})
 	for i := 0; i < len(headers); i++ {
@@ -99,7 +137,7 @@ func getRecordValuesMap(headers []string, modelName string, record []string, env
 			if err != nil {
 				log.Panic("Error while converting integer", "line", line, "field", headers[i], "value", record[i], "error", err)
 			}
-		case fi.fieldType == fieldtype.Float:
+		case fi.fieldType == fieldtype.Float, fi.fieldType == fieldtype.Monetary:
 			val, err = strconv.ParseFloat(record[i], 64)
 			if err != nil {
 				log.Panic("Error while converting float", "line", line, "field", headers[i], "value", record[i], "error", err)
@@ -0,0 +1,84 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/i18n"
+)
+
+// autoNowValue returns the current value of the given AutoNow or AutoNowAdd
+// field: the current date in the time zone of the user of rc for date
+// fields and the current time for datetime fields.
+func (rc RecordCollection) autoNowValue(fi *Field) interface{} {
+	if fi.fieldType == fieldtype.Date {
+		return rc.env.Today()
+	}
+	return types.Now()
+}
+
+// addAutoNowCreateData sets the AutoNow and AutoNowAdd fields
+// of the given FieldMap of a record to create to the current date or time.
+func (rc RecordCollection) addAutoNowCreateData(fMap *FieldMap) {
+	for _, fi := range rc.model.fields.registryByName {
+		if fi.autoNow || fi.autoNowAdd {
+			removeFieldFromMap(fMap, fi)
+			(*fMap)[fi.name] = rc.autoNowValue(fi)
+		}
+	}
+}
+
+// addAutoNowUpdateData sets the AutoNow fields of the given FieldMap of the
+// records to update to the current date or time. AutoNowAdd fields are
+// removed from it since they cannot be modified.
+func (rc RecordCollection) addAutoNowUpdateData(fMap *FieldMap) {
+	for _, fi := range rc.model.fields.registryByName {
+		switch {
+		case fi.autoNow:
+			removeFieldFromMap(fMap, fi)
+			(*fMap)[fi.name] = rc.autoNowValue(fi)
+		case fi.autoNowAdd:
+			removeFieldFromMap(fMap, fi)
+		}
+	}
+}
+
+// removeFieldFromMap removes the value of the given field from
+// the given FieldMap, whether it is keyed by name or by JSON name.
+func removeFieldFromMap(fMap *FieldMap, fi *Field) {
+	delete(*fMap, fi.name)
+	delete(*fMap, fi.json)
+}
+
+// formatter returns the i18n Formatter of the language of the user of this Environment
+func (env Environment) formatter() i18n.Formatter {
+	lang := ""
+	if env.context != nil {
+		lang = env.context.GetString(langContextKey, "")
+	}
+	return i18n.Registry.Formatter(lang)
+}
+
+// FormatDate returns the given date in the date format of the
+// language of the user of this Environment, or an empty string
+// if it is null.
+func (env Environment) FormatDate(date types.Date) string {
+	if date.IsNull() {
+		return ""
+	}
+	return env.formatter().Date(time.Time(date))
+}
+
+// FormatDateTime returns the given datetime in the time zone and in the
+// date and time formats of the language of the user of this Environment,
+// or an empty string if it is null.
+func (env Environment) FormatDateTime(dateTime types.DateTime) string {
+	if dateTime.IsNull() {
+		return ""
+	}
+	return env.formatter().DateTime(time.Time(dateTime).In(env.Location()))
+}
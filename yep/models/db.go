@@ -15,10 +15,15 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"github.com/npiganeau/yep/yep/models/operator"
 )
 
@@ -33,13 +38,29 @@ type ColumnData struct {
 	DataType      string
 	IsNullable    string
 	ColumnDefault sql.NullString
+	// CharacterMaximumLength is the size of varchar columns
+	CharacterMaximumLength sql.NullInt64
+	// NumericPrecision and NumericScale are the digits of numeric columns
+	NumericPrecision sql.NullInt64
+	NumericScale     sql.NullInt64
 }
 
 type dbAdapter interface {
 	// operatorSQL returns the sql string and placeholders for the given DomainOperator
 	operatorSQL(operator.Operator, interface{}) (string, interface{})
-	// typeSQL returns the SQL type string, including columns constraints if any
+	// hierarchySQL returns the sql string and placeholder selecting the
+	// descendants (child_of) or ancestors (parent_of) of the given ids in the
+	// given table, following the given parent column recursively.
+	hierarchySQL(op operator.Operator, table, parentColumn string) string
+	// parentPathSQL returns the sql string and placeholder selecting the
+	// descendants (child_of) or ancestors (parent_of) of the given ids in the
+	// given table, using the materialized paths of the given path column.
+	parentPathSQL(op operator.Operator, table, pathColumn string) string
+	// typeSQL returns the SQL type string, including its size or precision if any
 	typeSQL(fi *Field) string
+	// columnTypeSQL returns the SQL type string of the given column in
+	// the same format as typeSQL
+	columnTypeSQL(col ColumnData) string
 	// columnSQLDefinition returns the SQL type string, including columns constraints if any
 	columnSQLDefinition(fi *Field) string
 	// fieldSQLDefault returns the SQL default value of the Field
@@ -53,59 +74,219 @@ type dbAdapter interface {
 	fieldIsNotNull(fi *Field) bool
 	// quoteTableName returns the given table name with sql quotes
 	quoteTableName(string) string
+	// dateTruncSQL returns the SQL expression truncating the
+	// given date expression to the given granularity
+	dateTruncSQL(granularity DateGranularity, expr string) string
 	// indexExists returns true if an index with the given name exists in the given table
 	indexExists(table string, name string) bool
+	// indexComment returns the comment of the index with the given
+	// name, or an empty string if it has none
+	indexComment(name string) string
 	// constraintExists returns true if a constraint with the given name exists
 	constraintExists(name string) bool
+	// checkConstraintDefinition returns the definition of the CHECK constraint
+	// with the given name, or an empty string if it does not exist
+	checkConstraintDefinition(name string) string
+	// constraintColumns returns the sorted columns of the constraint with
+	// the given name of the given table, or nil if it does not exist
+	constraintColumns(table, name string) []string
+	// foreignKeyOnDelete returns the ON DELETE action of the
+	// foreign key constraint with the given name
+	foreignKeyOnDelete(name string) OnDeleteAction
+	// txOptions returns the options with which transactions are started
+	txOptions() *sql.TxOptions
 	// setTransactionIsolation returns the SQL string to set the transaction isolation
-	// level to serializable
+	// level to serializable, or an empty string if it is set by txOptions
 	setTransactionIsolation() string
+	// setStatementTimeout returns the SQL string to set the maximum
+	// duration of the statements of the current transaction, or an
+	// empty string if statements cannot be timed out.
+	setStatementTimeout(timeout time.Duration) string
+	// setTimeZone returns the SQL string to set the time zone of the current
+	// transaction to the given IANA time zone, or to the default time zone of
+	// the database if name is empty. It returns an empty string if the time
+	// zone cannot be set for a single transaction.
+	setTimeZone(name string) string
+	// setTransactionReadOnly returns the SQL string to make the current
+	// transaction read-only, or an empty string if the database cannot
+	// change the access mode of a started transaction
+	setTransactionReadOnly() string
 	// createSequence creates a DB sequence with the given name
 	createSequence(name string)
 	// dropSequence drop the DB sequence with the given name
 	dropSequence(name string)
-	// nextSequenceValue returns the next value of the given given sequence
-	nextSequenceValue(name string) int64
+	// nextSequenceValue returns the next value of the given given sequence.
+	// Queries are executed in the transaction of the given cursor, or
+	// outside of any transaction if cr is nil.
+	nextSequenceValue(cr *Cursor, name string) int64
 	// sequences returns a list of all sequences matching the given SQL pattern
 	sequences(pattern string) []string
+	// primaryKeySQL returns the SQL definition of an auto-incremented id column
+	primaryKeySQL() string
+	// supportsReturning returns true if INSERT queries can return the
+	// ids of the inserted rows with a RETURNING clause. If not, ids are
+	// retrieved with the LastInsertId of the query result.
+	supportsReturning() bool
+	// concatSQL returns the SQL expression concatenating the given expressions
+	concatSQL(exprs ...string) string
+	// alterColumnTypeSQL returns the SQL queries to change the data type
+	// of the column of the given Field, casting its existing values.
+	// No query is returned if columns cannot be altered.
+	alterColumnTypeSQL(fi *Field) []string
+	// alterColumnNullableSQL returns the SQL query to set the NULL/NOT NULL
+	// constraint of the column of the given Field, or an empty string if
+	// columns cannot be altered.
+	alterColumnNullableSQL(fi *Field) string
+	// alterColumnDefaultSQL returns the SQL query to set the default value
+	// of the column of the given Field, or an empty string if columns
+	// cannot be altered.
+	alterColumnDefaultSQL(fi *Field) string
+	// addConstraintSQL returns the SQL query adding a constraint with the given
+	// name and definition to the given table, or an empty string if such a
+	// constraint cannot be added to an existing table.
+	addConstraintSQL(table, name, definition string) string
+	// renameConstraintSQL returns the SQL query to rename a constraint of the
+	// given table, or an empty string if constraints cannot be renamed.
+	renameConstraintSQL(table, oldName, newName string) string
+	// renameIndexSQL returns the SQL query to rename an index of the
+	// given table, or an empty string if indexes cannot be renamed.
+	renameIndexSQL(table, oldName, newName string) string
+	// createIndexSQL returns the SQL queries to create an index on the given
+	// columns of the given table, with the given WHERE clause and comment
+	// if they are not empty.
+	createIndexSQL(unique bool, name, table string, cols []string, where, comment string) []string
+	// dropIndexSQL returns the SQL query to drop the index with the given
+	// name of the given table if it exists. It may return an empty string
+	// if the index does not exist.
+	dropIndexSQL(table, name string) string
+	// dropConstraintSQL returns the SQL query to drop the constraint with
+	// the given name of the given table if it exists. It may return an
+	// empty string if the constraint does not exist.
+	dropConstraintSQL(table, name string) string
+	// deleteDuplicateLinksSQL returns the SQL query deleting the duplicate
+	// rows of the given many2many link table, or an empty string if rows
+	// cannot be told apart.
+	deleteDuplicateLinksSQL(table, col1, col2 string) string
+	// currentTxIDSQL returns the SQL expression of the id of the current transaction
+	currentTxIDSQL() string
+	// oldestRunningTxIDSQL returns the SQL expression of the id of the
+	// oldest transaction that is still running
+	oldestRunningTxIDSQL() string
+	// constraintViolation returns the details of the given database error if it
+	// is an integrity constraint violation. The second returned value is false
+	// for any other value.
+	constraintViolation(r interface{}) (dbConstraintViolation, bool)
+	// isSerializationFailure returns true if the given database error means
+	// that the transaction must be rolled back and retried.
+	isSerializationFailure(r interface{}) bool
 }
 
+// A dbConstraintViolation holds the details of an
+// integrity constraint violation reported by the database
+type dbConstraintViolation struct {
+	kind       constraintViolationKind
+	table      string
+	constraint string
+	column     string
+	value      string
+	// referenced is true when a foreign key violation is due to the
+	// record being still referenced by another table
+	referenced bool
+	err        error
+}
+
+// A constraintViolationKind is a kind of integrity constraint violation
+type constraintViolationKind int
+
+// Kinds of integrity constraint violations
+const (
+	notNullViolation constraintViolationKind = iota
+	foreignKeyViolation
+	uniqueViolation
+	checkViolation
+)
+
 // registerDBAdapter adds a adapter to the adapters registry
 // name of the adapter should match the database/sql driver name
 func registerDBAdapter(name string, adapter dbAdapter) {
 	adapters[name] = adapter
 }
 
-// Cursor is a wrapper around a database transaction
+// Cursor is a wrapper around a database transaction.
+//
+// The queries of a Cursor are bound to the context.Context given when opening
+// it: if this context is canceled or reaches its deadline, the running query
+// is canceled in the database and the transaction is rolled back.
 type Cursor struct {
-	tx *sqlx.Tx
+	tx  *sqlx.Tx
+	ctx context.Context
+	// savepoints is the number of savepoints created in the transaction
+	savepoints int
+	// timeZone is the time zone of the session set by setTimeZone
+	timeZone string
 }
 
 // Execute a query without returning any rows. It panics in case of error.
 // The args are for any placeholder parameters in the query.
 func (c *Cursor) Execute(query string, args ...interface{}) sql.Result {
-	return dbExecute(c.tx, query, args...)
+	return dbExecute(c.ctx, c.tx, query, args...)
 }
 
 // Get queries a row into the database and maps the result into dest.
 // The query must return only one row. Get panics on errors
 func (c *Cursor) Get(dest interface{}, query string, args ...interface{}) {
-	dbGet(c.tx, dest, query, args...)
+	dbGet(c.ctx, c.tx, dest, query, args...)
 }
 
 // Select queries multiple rows and map the result into dest which must be a slice.
 // Select panics on errors.
 func (c *Cursor) Select(dest interface{}, query string, args ...interface{}) {
-	dbSelect(c.tx, dest, query, args...)
+	dbSelect(c.ctx, c.tx, dest, query, args...)
+}
+
+// savepoint creates a new savepoint in the transaction and returns its name
+func (c *Cursor) savepoint() string {
+	c.savepoints++
+	name := fmt.Sprintf("yep_savepoint_%d", c.savepoints)
+	c.Execute("SAVEPOINT " + name)
+	return name
+}
+
+// rollbackToSavepoint rolls back the changes made since the savepoint
+// with the given name was created.
+func (c *Cursor) rollbackToSavepoint(name string) {
+	c.Execute("ROLLBACK TO SAVEPOINT " + name)
+	// The session time zone may have been set after the savepoint
+	c.timeZone = unknownTimeZone
+}
+
+// releaseSavepoint destroys the savepoint with the given name,
+// keeping the changes made since it was created.
+func (c *Cursor) releaseSavepoint(name string) {
+	c.Execute("RELEASE SAVEPOINT " + name)
+}
+
+// query queries multiple rows and returns them. It panics on errors.
+func (c *Cursor) query(query string, args ...interface{}) *sqlx.Rows {
+	return dbQuery(c.ctx, c.tx, query, args...)
 }
 
-// newCursor returns a new db cursor on the given database
-func newCursor(db *sqlx.DB) *Cursor {
+// newCursor returns a new db cursor on the given database,
+// whose queries are bound to the given context.
+func newCursor(ctx context.Context, db *sqlx.DB) *Cursor {
 	adapter := adapters[db.DriverName()]
-	tx := db.MustBegin()
-	dbExecute(tx, adapter.setTransactionIsolation())
+	tx := db.MustBeginTx(ctx, adapter.txOptions())
+	if query := adapter.setTransactionIsolation(); query != "" {
+		dbExecute(ctx, tx, query)
+	}
+	if timeout := StatementTimeouts[RequestClassOf(ctx)]; timeout > 0 {
+		if query := adapter.setStatementTimeout(timeout); query != "" {
+			dbExecute(ctx, tx, query)
+		}
+	}
 	return &Cursor{
-		tx: tx,
+		tx:  tx,
+		ctx: ctx,
 	}
 }
 
@@ -126,10 +307,10 @@ func DBClose() {
 
 // dbExecute is a wrapper around sqlx.MustExec
 // It executes a query that returns no row
-func dbExecute(cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
+func dbExecute(ctx context.Context, cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	res := cr.MustExec(query, args...)
+	res := cr.MustExecContext(ctx, query, unmaskArgs(args)...)
 	logSQLResult(nil, t, query, args...)
 	return res
 }
@@ -138,7 +319,7 @@ func dbExecute(cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
 func dbExecuteNoTx(query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	res := db.MustExec(query, args...)
+	res := db.MustExec(query, unmaskArgs(args)...)
 	logSQLResult(nil, t, query, args...)
 	return res
 }
@@ -146,10 +327,10 @@ func dbExecuteNoTx(query string, args ...interface{}) sql.Result {
 // dbGet is a wrapper around sqlx.Get
 // It gets the value of a single row found by the given query and arguments
 // It panics in case of error
-func dbGet(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbGet(ctx context.Context, cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	err := cr.Get(dest, query, args...)
+	err := cr.GetContext(ctx, dest, query, unmaskArgs(args)...)
 	logSQLResult(err, t, query, args)
 }
 
@@ -159,17 +340,17 @@ func dbGet(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 func dbGetNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	err := db.Get(dest, query, args...)
+	err := db.Get(dest, query, unmaskArgs(args)...)
 	logSQLResult(err, t, query, args)
 }
 
 // dbSelect is a wrapper around sqlx.Select
 // It gets the value of a multiple rows found by the given query and arguments
 // dest must be a slice. It panics in case of error
-func dbSelect(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbSelect(ctx context.Context, cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	err := cr.Select(dest, query, args...)
+	err := cr.SelectContext(ctx, dest, query, unmaskArgs(args)...)
 	logSQLResult(err, t, query, args)
 }
 
@@ -179,17 +360,17 @@ func dbSelect(cr *sqlx.Tx, dest interface{}, query string, args ...interface{})
 func dbSelectNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	err := db.Select(dest, query, args...)
+	err := db.Select(dest, query, unmaskArgs(args)...)
 	logSQLResult(err, t, query, args)
 }
 
 // dbQuery is a wrapper around sqlx.Queryx
 // It returns a sqlx.Rowsx found by the given query and arguments
 // It panics in case of error
-func dbQuery(cr *sqlx.Tx, query string, args ...interface{}) *sqlx.Rows {
+func dbQuery(ctx context.Context, cr *sqlx.Tx, query string, args ...interface{}) *sqlx.Rows {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
-	rows, err := cr.Queryx(query, args...)
+	rows, err := cr.QueryxContext(ctx, query, unmaskArgs(args)...)
 	logSQLResult(err, t, query, args)
 	return rows
 }
@@ -202,13 +383,43 @@ func sanitizeQuery(query string, args ...interface{}) (string, []interface{}) {
 		log.Panic("Unable to expand 'IN' statement", "error", err, "query", query, "args", args)
 	}
 	q = sqlx.Rebind(sqlx.BindType(db.DriverName()), q)
-	return q, args
+	return q, utcTimeArgs(args)
+}
+
+// utcTimeArgs returns the given query args with their time.Time values in
+// UTC, since datetimes are stored in UTC in columns without time zone.
+func utcTimeArgs(args []interface{}) []interface{} {
+	var res []interface{}
+	for i, arg := range args {
+		t, ok := arg.(time.Time)
+		if !ok || t.Location() == time.UTC {
+			if res != nil {
+				res[i] = arg
+			}
+			continue
+		}
+		if res == nil {
+			res = make([]interface{}, len(args))
+			copy(res, args[:i])
+		}
+		res[i] = t.UTC()
+	}
+	if res == nil {
+		return args
+	}
+	return res
 }
 
 // Log the result of the given sql query started at start time with the
 // given args, and error. This function panics after logging if error is not nil.
 func logSQLResult(err error, start time.Time, query string, args ...interface{}) {
 	logCtx := log.New("query", query, "args", args, "duration", time.Now().Sub(start))
+	switch err.(type) {
+	case *pq.Error, *mysql.MySQLError, sqlite3.Error:
+		// We panic with the driver error itself so that it can be handled by the caller
+		logCtx.Error("Error while executing query", "error", err, "query", query, "args", args)
+		panic(err)
+	}
 	if err != nil {
 		logCtx.Panic("Error while executing query", "error", err, "query", query, "args", args)
 	}
@@ -0,0 +1,655 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/operator"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// mysqlAdapter is the dbAdapter of MySQL and MariaDB databases.
+//
+// It requires MySQL 8.0.19 or MariaDB 10.5 at least for recursive queries,
+// expression defaults and check constraints, and the parseTime=true option
+// in the connection string so that dates are scanned as time values.
+type mysqlAdapter struct{}
+
+// MySQL error numbers
+const (
+	myLockWaitTimeout      uint16 = 1205
+	myDeadlock             uint16 = 1213
+	myNotNullViolation     uint16 = 1048
+	myNoDefaultValue       uint16 = 1364
+	myUniqueViolation      uint16 = 1062
+	myRowIsReferenced      uint16 = 1451
+	myNoReferencedRow      uint16 = 1452
+	myCheckViolation       uint16 = 3819
+	myCheckViolationLegacy uint16 = 4025
+)
+
+var (
+	// myDuplicateRegexp extracts the value and key name from the message of
+	// a duplicate entry error, e.g. "Duplicate entry 'jsmith' for key 'user.user_login_key'"
+	myDuplicateRegexp = regexp.MustCompile(`^Duplicate entry '(.*)' for key '(?:[^']*\.)?([^'.]*)'`)
+	// myForeignKeyRegexp extracts the table, constraint and column names
+	// from the message of a foreign key error
+	myForeignKeyRegexp = regexp.MustCompile("\\(`[^`]*`\\.`([^`]*)`, CONSTRAINT `([^`]*)` FOREIGN KEY \\(`([^`]*)`\\)")
+	// myColumnRegexp extracts the column name from the message of a not null error
+	myColumnRegexp = regexp.MustCompile(`^(?:Column|Field) '([^']*)'`)
+	// myCheckRegexp extracts the constraint name from the message of a check error
+	myCheckRegexp = regexp.MustCompile(`(?:Check constraint|CONSTRAINT) [` + "`" + `']([^` + "`" + `']*)[` + "`" + `']`)
+)
+
+var myOperators = map[operator.Operator]string{
+	operator.Equals:         "= ?",
+	operator.NotEquals:      "!= ?",
+	operator.Like:           "LIKE BINARY ?",
+	operator.NotLike:        "NOT LIKE BINARY ?",
+	operator.LikePattern:    "LIKE BINARY ?",
+	operator.ILike:          "LIKE ?",
+	operator.NotILike:       "NOT LIKE ?",
+	operator.ILikePattern:   "LIKE ?",
+	operator.In:             "IN (?)",
+	operator.NotIn:          "NOT IN (?)",
+	operator.Lower:          "< ?",
+	operator.LowerOrEqual:   "<= ?",
+	operator.Greater:        "> ?",
+	operator.GreaterOrEqual: ">= ?",
+}
+
+var myTypes = map[fieldtype.Type]string{
+	fieldtype.Boolean:   "tinyint(1)",
+	fieldtype.Char:      "varchar",
+	fieldtype.Text:      "longtext",
+	fieldtype.Date:      "date",
+	fieldtype.DateTime:  "datetime",
+	fieldtype.Integer:   "int",
+	fieldtype.Float:     "double",
+	fieldtype.Monetary:  "decimal(65, 30)",
+	fieldtype.HTML:      "longtext",
+	fieldtype.Binary:    "longblob",
+	fieldtype.Selection: "varchar",
+	fieldtype.Many2One:  "int",
+	fieldtype.One2One:   "int",
+}
+
+// myDefaultVarcharSize is the size of varchar columns of fields without size.
+const myDefaultVarcharSize = 255
+
+// myDefaultValues are the default values of columns. Text and blob columns
+// only accept expressions as default values.
+var myDefaultValues = map[fieldtype.Type]string{
+	fieldtype.Boolean:   "FALSE",
+	fieldtype.Char:      "''",
+	fieldtype.Text:      "('')",
+	fieldtype.Date:      "'0001-01-01'",
+	fieldtype.DateTime:  "'0001-01-01 00:00:00'",
+	fieldtype.Integer:   "0",
+	fieldtype.Float:     "0",
+	fieldtype.Monetary:  "0",
+	fieldtype.HTML:      "('')",
+	fieldtype.Binary:    "('')",
+	fieldtype.Selection: "''",
+}
+
+// myDateFormats are the formats of DATE_FORMAT truncating dates to a granularity
+var myDateFormats = map[DateGranularity]string{
+	GranularityDay:   "%Y-%m-%d",
+	GranularityMonth: "%Y-%m-01",
+}
+
+// operatorSQL returns the sql string and placeholders for the given DomainOperator
+// Also modifies the given args to match the syntax of the operator.
+func (d *mysqlAdapter) operatorSQL(do operator.Operator, arg interface{}) (string, interface{}) {
+	op := myOperators[do]
+	switch do {
+	case operator.Like, operator.ILike, operator.NotLike, operator.NotILike:
+		arg = fmt.Sprintf("%%%s%%", arg)
+	}
+	return op, arg
+}
+
+// hierarchySQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, following the given parent column recursively.
+// The given ids are included in the result.
+func (d *mysqlAdapter) hierarchySQL(op operator.Operator, table, parentColumn string) string {
+	if op == operator.ParentOf {
+		return fmt.Sprintf(`IN (WITH RECURSIVE tree(id, parent) AS (SELECT id, %[2]s FROM %[1]s WHERE id IN (?) `+
+			`UNION SELECT t.id, t.%[2]s FROM %[1]s t INNER JOIN tree ON t.id = tree.parent) SELECT id FROM tree)`,
+			d.quoteTableName(table), parentColumn)
+	}
+	return fmt.Sprintf(`IN (WITH RECURSIVE tree(id) AS (SELECT id FROM %[1]s WHERE id IN (?) `+
+		`UNION SELECT t.id FROM %[1]s t INNER JOIN tree ON t.%[2]s = tree.id) SELECT id FROM tree)`,
+		d.quoteTableName(table), parentColumn)
+}
+
+// parentPathSQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, using the materialized paths of the given path column.
+// The given ids are included in the result.
+func (d *mysqlAdapter) parentPathSQL(op operator.Operator, table, pathColumn string) string {
+	selected, given := "t", "p"
+	if op == operator.ParentOf {
+		selected, given = "p", "t"
+	}
+	return fmt.Sprintf(`IN (SELECT %[3]s.id FROM %[1]s t INNER JOIN %[1]s p ON t.%[2]s LIKE %[5]s WHERE %[4]s.id IN (?))`,
+		d.quoteTableName(table), pathColumn, selected, given, d.concatSQL("p."+pathColumn, "'%'"))
+}
+
+// typeSQL returns the sql type string for the given Field,
+// including its size or precision if any
+func (d *mysqlAdapter) typeSQL(fi *Field) string {
+	typ, ok := myTypes[fi.fieldType]
+	if !ok {
+		log.Panic("Unknown column type", "type", fi.fieldType, "model", fi.model.name, "field", fi.name)
+	}
+	switch fi.fieldType {
+	case fieldtype.Char, fieldtype.Selection:
+		switch {
+		case fi.isEncrypted():
+			// Encrypted values are longer than plain values
+			typ = "text"
+		case fi.size > 0:
+			typ = fmt.Sprintf("%s(%d)", typ, fi.size)
+		default:
+			typ = fmt.Sprintf("%s(%d)", typ, myDefaultVarcharSize)
+		}
+	case fieldtype.Float:
+		emptyD := types.Digits{}
+		if fi.digits != emptyD {
+			typ = fmt.Sprintf("decimal(%d, %d)", fi.digits.Precision, fi.digits.Scale)
+		}
+	}
+	return typ
+}
+
+// columnTypeSQL returns the sql type string of the given column in the same
+// format as typeSQL, so that both can be compared.
+func (d *mysqlAdapter) columnTypeSQL(col ColumnData) string {
+	typ := col.DataType
+	switch {
+	case typ == "tinyint":
+		typ = "tinyint(1)"
+	case typ == "varchar" && col.CharacterMaximumLength.Valid:
+		typ = fmt.Sprintf("%s(%d)", typ, col.CharacterMaximumLength.Int64)
+	case typ == "decimal" && col.NumericPrecision.Valid:
+		typ = fmt.Sprintf("%s(%d, %d)", typ, col.NumericPrecision.Int64, col.NumericScale.Int64)
+	}
+	return typ
+}
+
+// columnSQLDefinition returns the SQL type string, including columns constraints if any
+func (d *mysqlAdapter) columnSQLDefinition(fi *Field) string {
+	res := d.typeSQL(fi)
+	if d.fieldIsNotNull(fi) {
+		res += " NOT NULL"
+	}
+
+	defValue := d.fieldSQLDefault(fi)
+	if defValue != "" && !fi.required {
+		res += fmt.Sprintf(" DEFAULT %v", defValue)
+	}
+	return res
+}
+
+// fieldIsNull returns true if the given Field results in a
+// NOT NULL column in database.
+func (d *mysqlAdapter) fieldIsNotNull(fi *Field) bool {
+	if fi.fieldType.IsFKRelationType() {
+		return fi.required
+	}
+	return true
+}
+
+// fieldSQLDefault returns the SQL default value of the Field
+func (d *mysqlAdapter) fieldSQLDefault(fi *Field) string {
+	if fi.isEncrypted() {
+		return "('')"
+	}
+	return myDefaultValues[fi.fieldType]
+}
+
+// tables returns a map of table names of the database.
+// Tables emulating sequences are not returned.
+func (d *mysqlAdapter) tables() map[string]bool {
+	var resList []string
+	query := `SELECT table_name AS table_name FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_schema = DATABASE() AND table_name NOT LIKE '%\_manseq'`
+	if err := db.Select(&resList, query); err != nil {
+		log.Panic("Unable to get list of tables from database", "error", err)
+	}
+	res := make(map[string]bool, len(resList))
+	for _, tableName := range resList {
+		res[tableName] = true
+	}
+	return res
+}
+
+// quoteTableName returns the given table name with sql quotes
+func (d *mysqlAdapter) quoteTableName(tableName string) string {
+	return fmt.Sprintf("`%s`", tableName)
+}
+
+// dateTruncSQL returns the SQL expression truncating the
+// given date expression to the given granularity
+func (d *mysqlAdapter) dateTruncSQL(granularity DateGranularity, expr string) string {
+	if granularity == GranularityWeek {
+		// Weeks begin on monday
+		return fmt.Sprintf("CAST(DATE_SUB(DATE(%[1]s), INTERVAL WEEKDAY(%[1]s) DAY) AS DATETIME)", expr)
+	}
+	return fmt.Sprintf("CAST(DATE_FORMAT(%s, '%s') AS DATETIME)", expr, myDateFormats[granularity])
+}
+
+// columns returns a list of ColumnData for the given tableName.
+// Default values are returned in the same format as fieldSQLDefault.
+func (d *mysqlAdapter) columns(tableName string) map[string]ColumnData {
+	query := `
+		SELECT column_name AS column_name, data_type AS data_type, is_nullable AS is_nullable,
+			column_default AS column_default, character_maximum_length AS character_maximum_length,
+			numeric_precision AS numeric_precision, numeric_scale AS numeric_scale
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?
+	`
+	var colData []ColumnData
+	if err := db.Select(&colData, query, tableName); err != nil {
+		log.Panic("Unable to get list of columns for table", "table", tableName, "error", err)
+	}
+	res := make(map[string]ColumnData, len(colData))
+	for _, col := range colData {
+		col.ColumnDefault = d.columnDefault(col)
+		res[col.ColumnName] = col
+	}
+	return res
+}
+
+// columnDefault returns the default value of the given column as returned
+// by information_schema in the same format as fieldSQLDefault.
+func (d *mysqlAdapter) columnDefault(col ColumnData) sql.NullString {
+	if !col.ColumnDefault.Valid {
+		return col.ColumnDefault
+	}
+	def := col.ColumnDefault.String
+	switch col.DataType {
+	case "tinyint":
+		if def == "0" {
+			def = "FALSE"
+		} else {
+			def = "TRUE"
+		}
+	case "int", "bigint", "double", "decimal":
+		if val, err := strconv.ParseFloat(def, 64); err == nil {
+			def = strconv.FormatFloat(val, 'g', -1, 64)
+		}
+	case "text", "longtext", "blob", "longblob":
+		def = "('')"
+	default:
+		def = fmt.Sprintf("'%s'", strings.Replace(def, "'", "''", -1))
+	}
+	return sql.NullString{String: def, Valid: true}
+}
+
+// indexExists returns true if an index with the given name exists in the given table
+func (d *mysqlAdapter) indexExists(table string, name string) bool {
+	query := `SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`
+	var cnt int
+	dbGetNoTx(&cnt, query, table, name)
+	return cnt > 0
+}
+
+// indexComment returns the comment of the index with the given
+// name, or an empty string if it has none
+func (d *mysqlAdapter) indexComment(name string) string {
+	query := `SELECT COALESCE(MAX(index_comment), '') FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND index_name = ?`
+	var comment string
+	dbGetNoTx(&comment, query, name)
+	return comment
+}
+
+// constraintExists returns true if a constraint with the given name exists.
+// Since the primary key of a table is always named PRIMARY in MySQL, primary
+// key names are matched with the table name.
+func (d *mysqlAdapter) constraintExists(name string) bool {
+	query, args := d.constraintExistsQuery(name)
+	var cnt int
+	dbGetNoTx(&cnt, query, args...)
+	return cnt > 0
+}
+
+// constraintExistsQuery returns the query and its arguments counting
+// the constraints with the given name.
+func (d *mysqlAdapter) constraintExistsQuery(name string) (string, []interface{}) {
+	if strings.HasSuffix(name, "_pkey") {
+		return `SELECT COUNT(*) FROM information_schema.table_constraints
+			WHERE constraint_schema = DATABASE() AND constraint_type = 'PRIMARY KEY' AND table_name = ?`,
+			[]interface{}{strings.TrimSuffix(name, "_pkey")}
+	}
+	return `SELECT COUNT(*) FROM information_schema.table_constraints
+		WHERE constraint_schema = DATABASE() AND constraint_name = ?`, []interface{}{name}
+}
+
+// checkConstraintDefinition returns the definition of the CHECK constraint
+// with the given name, or an empty string if it does not exist
+func (d *mysqlAdapter) checkConstraintDefinition(name string) string {
+	query := `SELECT COALESCE(MAX(check_clause), '') FROM information_schema.check_constraints
+		WHERE constraint_schema = DATABASE() AND constraint_name = ?`
+	var definition string
+	dbGetNoTx(&definition, query, name)
+	return definition
+}
+
+// constraintColumns returns the sorted columns of the constraint with
+// the given name of the given table, or nil if it does not exist.
+// Primary key names are matched with the PRIMARY key of the table.
+func (d *mysqlAdapter) constraintColumns(table, name string) []string {
+	if strings.HasSuffix(name, "_pkey") {
+		name = "PRIMARY"
+	}
+	query := `SELECT column_name FROM information_schema.key_column_usage
+		WHERE constraint_schema = DATABASE() AND table_name = ? AND constraint_name = ?
+		ORDER BY column_name`
+	var res []string
+	dbSelectNoTx(&res, query, table, name)
+	return res
+}
+
+// foreignKeyOnDelete returns the ON DELETE action of the
+// foreign key constraint with the given name
+func (d *mysqlAdapter) foreignKeyOnDelete(name string) OnDeleteAction {
+	query := `SELECT delete_rule FROM information_schema.referential_constraints
+		WHERE constraint_schema = DATABASE() AND constraint_name = ?`
+	var action string
+	dbGetNoTx(&action, query, name)
+	switch action {
+	case "CASCADE":
+		return Cascade
+	case "SET NULL":
+		return SetNull
+	}
+	return Restrict
+}
+
+// createSequence creates a table emulating a DB sequence with the given name
+func (d *mysqlAdapter) createSequence(name string) {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY)", d.quoteTableName(name))
+	syncExecute(query)
+}
+
+// dropSequence drops the table emulating the DB sequence with the given name
+func (d *mysqlAdapter) dropSequence(name string) {
+	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", d.quoteTableName(name))
+	syncExecute(query)
+}
+
+// nextSequenceValue returns the next value of the given given sequence.
+// A row is inserted in the table emulating the sequence to get its
+// next id, and older rows are removed.
+func (d *mysqlAdapter) nextSequenceValue(cr *Cursor, name string) int64 {
+	execute := dbExecuteNoTx
+	if cr != nil {
+		execute = cr.Execute
+	}
+	res := execute(fmt.Sprintf("INSERT INTO %s () VALUES ()", d.quoteTableName(name)))
+	val, err := res.LastInsertId()
+	if err != nil {
+		log.Panic("Unable to get next sequence value", "sequence", name, "error", err)
+	}
+	execute(fmt.Sprintf("DELETE FROM %s WHERE id < ?", d.quoteTableName(name)), val)
+	return val
+}
+
+// sequences returns a list of all sequences matching the given SQL pattern
+func (d *mysqlAdapter) sequences(pattern string) []string {
+	query := `SELECT table_name AS table_name FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name LIKE ?`
+	var res []string
+	dbSelectNoTx(&res, query, pattern)
+	return res
+}
+
+// txOptions returns the options with which transactions are started.
+// MySQL cannot change the isolation level of a started transaction.
+func (d *mysqlAdapter) txOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelSerializable}
+}
+
+// setTransactionIsolation returns an empty string since the
+// isolation level is set by txOptions.
+func (d *mysqlAdapter) setTransactionIsolation() string {
+	return ""
+}
+
+// setStatementTimeout returns the SQL string to set the maximum duration
+// of the statements of the current session. Only SELECT statements are
+// interrupted by MySQL.
+func (d *mysqlAdapter) setStatementTimeout(timeout time.Duration) string {
+	return fmt.Sprintf("SET SESSION max_execution_time = %d", timeout/time.Millisecond)
+}
+
+// setTimeZone returns an empty string since the MySQL time zone can only be
+// set for the whole session, which outlives the transaction.
+func (d *mysqlAdapter) setTimeZone(name string) string {
+	return ""
+}
+
+// setTransactionReadOnly returns an empty string since MySQL cannot change
+// the access mode of a started transaction. Read-only environments are
+// still enforced by the ORM.
+func (d *mysqlAdapter) setTransactionReadOnly() string {
+	return ""
+}
+
+// primaryKeySQL returns the SQL definition of an auto-incremented id column
+func (d *mysqlAdapter) primaryKeySQL() string {
+	return "int NOT NULL AUTO_INCREMENT PRIMARY KEY"
+}
+
+// supportsReturning returns false since MySQL has no RETURNING clause.
+// The ids of multi-row inserts are consecutive as long as the
+// innodb_autoinc_lock_mode setting is 0 or 1.
+func (d *mysqlAdapter) supportsReturning() bool {
+	return false
+}
+
+// concatSQL returns the SQL expression concatenating the given expressions
+func (d *mysqlAdapter) concatSQL(exprs ...string) string {
+	return fmt.Sprintf("CONCAT(%s)", strings.Join(exprs, ", "))
+}
+
+// alterColumnTypeSQL returns the SQL queries to change the data type
+// of the column of the given Field, casting its existing values.
+// The whole column definition is given, so that it also updates the
+// NOT NULL constraint and the default value of the column.
+func (d *mysqlAdapter) alterColumnTypeSQL(fi *Field) []string {
+	return []string{fmt.Sprintf(`
+		ALTER TABLE %s
+		MODIFY COLUMN %s %s
+	`, d.quoteTableName(fi.model.tableName), fi.json, d.columnSQLDefinition(fi))}
+}
+
+// alterColumnNullableSQL returns the SQL query to set the NULL/NOT NULL
+// constraint of the column of the given Field.
+func (d *mysqlAdapter) alterColumnNullableSQL(fi *Field) string {
+	return d.alterColumnTypeSQL(fi)[0]
+}
+
+// alterColumnDefaultSQL returns the SQL query to set the default
+// value of the column of the given Field.
+func (d *mysqlAdapter) alterColumnDefaultSQL(fi *Field) string {
+	defValue := d.fieldSQLDefault(fi)
+	if defValue == "" {
+		return fmt.Sprintf(`
+			ALTER TABLE %s
+			ALTER COLUMN %s DROP DEFAULT
+		`, d.quoteTableName(fi.model.tableName), fi.json)
+	}
+	return fmt.Sprintf(`
+		ALTER TABLE %s
+		ALTER COLUMN %s SET DEFAULT %s
+	`, d.quoteTableName(fi.model.tableName), fi.json, defValue)
+}
+
+// addConstraintSQL returns the SQL query adding a constraint with
+// the given name and definition to the given table.
+func (d *mysqlAdapter) addConstraintSQL(table, name, definition string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s ADD CONSTRAINT %s %s
+	`, d.quoteTableName(table), name, definition)
+}
+
+// renameConstraintSQL returns the SQL query to rename a unique constraint of
+// the given table. Other constraints cannot be renamed in MySQL and an empty
+// string is returned for them.
+func (d *mysqlAdapter) renameConstraintSQL(table, oldName, newName string) string {
+	if !d.indexExists(table, oldName) {
+		return ""
+	}
+	return d.renameIndexSQL(table, oldName, newName)
+}
+
+// renameIndexSQL returns the SQL query to rename an index of the given table
+func (d *mysqlAdapter) renameIndexSQL(table, oldName, newName string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s RENAME INDEX %s TO %s
+	`, d.quoteTableName(table), d.quoteTableName(oldName), d.quoteTableName(newName))
+}
+
+// createIndexSQL returns the SQL queries to create an index on the given
+// columns of the given table, with the given comment if it is not empty.
+// It panics if a WHERE clause is given since MySQL has no partial indexes.
+func (d *mysqlAdapter) createIndexSQL(unique bool, name, table string, cols []string, where, comment string) []string {
+	if where != "" {
+		log.Panic("Partial indexes are not supported by MySQL", "index", name, "table", table)
+	}
+	var uniqueSQL string
+	if unique {
+		uniqueSQL = "UNIQUE"
+	}
+	query := fmt.Sprintf(`
+		CREATE %s INDEX %s ON %s (%s)
+	`, uniqueSQL, name, d.quoteTableName(table), strings.Join(cols, ", "))
+	if comment != "" {
+		query += fmt.Sprintf("COMMENT '%s'", strings.Replace(comment, "'", "''", -1))
+	}
+	return []string{query}
+}
+
+// dropIndexSQL returns the SQL query to drop the index with the given name of
+// the given table, or an empty string if it does not exist since MySQL has no
+// DROP INDEX IF EXISTS.
+func (d *mysqlAdapter) dropIndexSQL(table, name string) string {
+	if !d.indexExists(table, name) {
+		return ""
+	}
+	return fmt.Sprintf(`
+		DROP INDEX %s ON %s
+	`, name, d.quoteTableName(table))
+}
+
+// dropConstraintSQL returns the SQL query to drop the constraint with the
+// given name of the given table, or an empty string if it does not exist.
+func (d *mysqlAdapter) dropConstraintSQL(table, name string) string {
+	if !d.constraintExists(name) {
+		return ""
+	}
+	return d.dropExistingConstraintSQL(table, name)
+}
+
+// dropExistingConstraintSQL returns the SQL query to drop the constraint
+// with the given name of the given table, which must exist. Primary keys
+// are dropped with DROP PRIMARY KEY since they are always named PRIMARY.
+func (d *mysqlAdapter) dropExistingConstraintSQL(table, name string) string {
+	if strings.HasSuffix(name, "_pkey") {
+		return fmt.Sprintf(`
+		ALTER TABLE %s DROP PRIMARY KEY
+	`, d.quoteTableName(table))
+	}
+	return fmt.Sprintf(`
+		ALTER TABLE %s DROP CONSTRAINT %s
+	`, d.quoteTableName(table), name)
+}
+
+// deleteDuplicateLinksSQL returns an empty string since the rows of a
+// link table cannot be told apart in MySQL. Link tables are created
+// with their primary key, so that they cannot hold duplicates.
+func (d *mysqlAdapter) deleteDuplicateLinksSQL(table, col1, col2 string) string {
+	return ""
+}
+
+// currentTxIDSQL returns the SQL expression of the id of the current transaction.
+// InnoDB only assigns an id to transactions once they have written data.
+func (d *mysqlAdapter) currentTxIDSQL() string {
+	return "(SELECT trx_id FROM information_schema.innodb_trx WHERE trx_mysql_thread_id = CONNECTION_ID())"
+}
+
+// oldestRunningTxIDSQL returns the SQL expression of the id of the
+// oldest transaction that is still running
+func (d *mysqlAdapter) oldestRunningTxIDSQL() string {
+	return "(SELECT COALESCE(MIN(CAST(trx_id AS UNSIGNED)), ~0) FROM information_schema.innodb_trx)"
+}
+
+// constraintViolation returns the details of the given database error if it
+// is an integrity constraint violation. The second returned value is false
+// for any other value.
+//
+// MySQL errors do not give the table of not null and check violations.
+func (d *mysqlAdapter) constraintViolation(r interface{}) (dbConstraintViolation, bool) {
+	myErr, ok := r.(*mysql.MySQLError)
+	if !ok {
+		return dbConstraintViolation{}, false
+	}
+	res := dbConstraintViolation{err: myErr}
+	switch myErr.Number {
+	case myNotNullViolation, myNoDefaultValue:
+		res.kind = notNullViolation
+		if matches := myColumnRegexp.FindStringSubmatch(myErr.Message); len(matches) == 2 {
+			res.column = matches[1]
+		}
+	case myUniqueViolation:
+		res.kind = uniqueViolation
+		if matches := myDuplicateRegexp.FindStringSubmatch(myErr.Message); len(matches) == 3 {
+			res.value = matches[1]
+			res.constraint = matches[2]
+		}
+	case myRowIsReferenced, myNoReferencedRow:
+		res.kind = foreignKeyViolation
+		res.referenced = myErr.Number == myRowIsReferenced
+		if matches := myForeignKeyRegexp.FindStringSubmatch(myErr.Message); len(matches) == 4 {
+			res.table = matches[1]
+			res.constraint = matches[2]
+			res.column = matches[3]
+		}
+	case myCheckViolation, myCheckViolationLegacy:
+		res.kind = checkViolation
+		if matches := myCheckRegexp.FindStringSubmatch(myErr.Message); len(matches) == 2 {
+			res.constraint = matches[1]
+		}
+	default:
+		return dbConstraintViolation{}, false
+	}
+	return res, true
+}
+
+// isSerializationFailure returns true if the given database
+// error is a deadlock or a lock wait timeout.
+func (d *mysqlAdapter) isSerializationFailure(r interface{}) bool {
+	myErr, ok := r.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	return myErr.Number == myDeadlock || myErr.Number == myLockWaitTimeout
+}
+
+var _ dbAdapter = new(mysqlAdapter)
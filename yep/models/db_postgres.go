@@ -15,8 +15,13 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/npiganeau/yep/yep/models/fieldtype"
 	"github.com/npiganeau/yep/yep/models/operator"
 	"github.com/npiganeau/yep/yep/models/types"
@@ -24,6 +29,27 @@ import (
 
 type postgresAdapter struct{}
 
+// PostgreSQL error codes of integrity constraint violations
+const (
+	pqNotNullViolation    pq.ErrorCode = "23502"
+	pqForeignKeyViolation pq.ErrorCode = "23503"
+	pqUniqueViolation     pq.ErrorCode = "23505"
+	pqCheckViolation      pq.ErrorCode = "23514"
+)
+
+// pqViolationKinds maps the PostgreSQL error codes of
+// integrity constraint violations to their kind
+var pqViolationKinds = map[pq.ErrorCode]constraintViolationKind{
+	pqNotNullViolation:    notNullViolation,
+	pqForeignKeyViolation: foreignKeyViolation,
+	pqUniqueViolation:     uniqueViolation,
+	pqCheckViolation:      checkViolation,
+}
+
+// pqDetailRegexp extracts the column and value from the detail
+// of a PostgreSQL error, e.g. "Key (email)=(jsmith@example.com) already exists."
+var pqDetailRegexp = regexp.MustCompile(`^Key \((.*)\)=\((.*)\)`)
+
 var pgOperators = map[operator.Operator]string{
 	operator.Equals:         "= ?",
 	operator.NotEquals:      "!= ?",
@@ -36,7 +62,7 @@ var pgOperators = map[operator.Operator]string{
 	operator.In:             "IN (?)",
 	operator.NotIn:          "NOT IN (?)",
 	operator.Lower:          "< ?",
-	operator.LowerOrEqual:   "< ?",
+	operator.LowerOrEqual:   "<= ?",
 	operator.Greater:        "> ?",
 	operator.GreaterOrEqual: ">= ?",
 	//OPERATOR_CHILD_OF: "",
@@ -50,6 +76,7 @@ var pgTypes = map[fieldtype.Type]string{
 	fieldtype.DateTime:  "timestamp without time zone",
 	fieldtype.Integer:   "integer",
 	fieldtype.Float:     "double precision",
+	fieldtype.Monetary:  "numeric",
 	fieldtype.HTML:      "text",
 	fieldtype.Binary:    "bytea",
 	fieldtype.Selection: "varchar",
@@ -65,6 +92,7 @@ var pgDefaultValues = map[fieldtype.Type]string{
 	fieldtype.DateTime:  "'0001-01-01 00:00:00'",
 	fieldtype.Integer:   "0",
 	fieldtype.Float:     "0.0",
+	fieldtype.Monetary:  "0.0",
 	fieldtype.HTML:      "''",
 	fieldtype.Binary:    "''",
 	fieldtype.Selection: "''",
@@ -81,31 +109,82 @@ func (d *postgresAdapter) operatorSQL(do operator.Operator, arg interface{}) (st
 	return op, arg
 }
 
-// typeSQL returns the sql type string for the given Field
-func (d *postgresAdapter) typeSQL(fi *Field) string {
-	typ, _ := pgTypes[fi.fieldType]
-	return typ
+// hierarchySQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, following the given parent column recursively.
+// The given ids are included in the result.
+func (d *postgresAdapter) hierarchySQL(op operator.Operator, table, parentColumn string) string {
+	if op == operator.ParentOf {
+		return fmt.Sprintf(`IN (WITH RECURSIVE tree(id, parent) AS (SELECT id, %[2]s FROM %[1]s WHERE id IN (?) `+
+			`UNION SELECT t.id, t.%[2]s FROM %[1]s t INNER JOIN tree ON t.id = tree.parent) SELECT id FROM tree)`,
+			d.quoteTableName(table), parentColumn)
+	}
+	return fmt.Sprintf(`IN (WITH RECURSIVE tree(id) AS (SELECT id FROM %[1]s WHERE id IN (?) `+
+		`UNION SELECT t.id FROM %[1]s t INNER JOIN tree ON t.%[2]s = tree.id) SELECT id FROM tree)`,
+		d.quoteTableName(table), parentColumn)
 }
 
-// columnSQLDefinition returns the SQL type string, including columns constraints if any
-func (d *postgresAdapter) columnSQLDefinition(fi *Field) string {
-	var res string
+// parentPathSQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, using the materialized paths of the given path column.
+// The given ids are included in the result.
+func (d *postgresAdapter) parentPathSQL(op operator.Operator, table, pathColumn string) string {
+	selected, given := "t", "p"
+	if op == operator.ParentOf {
+		selected, given = "p", "t"
+	}
+	return fmt.Sprintf(`IN (SELECT %[3]s.id FROM %[1]s t INNER JOIN %[1]s p ON t.%[2]s LIKE %[5]s WHERE %[4]s.id IN (?))`,
+		d.quoteTableName(table), pathColumn, selected, given, d.concatSQL("p."+pathColumn, "'%'"))
+}
+
+// typeSQL returns the sql type string for the given Field,
+// including its size or precision if any
+func (d *postgresAdapter) typeSQL(fi *Field) string {
 	typ, ok := pgTypes[fi.fieldType]
-	res = typ
 	if !ok {
 		log.Panic("Unknown column type", "type", fi.fieldType, "model", fi.model.name, "field", fi.name)
 	}
 	switch fi.fieldType {
 	case fieldtype.Char:
-		if fi.size > 0 {
-			res = fmt.Sprintf("%s(%d)", res, fi.size)
+		// Encrypted values are longer than plain values
+		if fi.size > 0 && !fi.isEncrypted() {
+			typ = fmt.Sprintf("%s(%d)", typ, fi.size)
 		}
 	case fieldtype.Float:
 		emptyD := types.Digits{}
 		if fi.digits != emptyD {
-			res = fmt.Sprintf("numeric(%d, %d)", fi.digits.Precision, fi.digits.Scale)
+			typ = fmt.Sprintf("numeric(%d, %d)", fi.digits.Precision, fi.digits.Scale)
 		}
 	}
+	return typ
+}
+
+// pgTypeAliases maps the data types of information_schema
+// to the type names used in pgTypes.
+var pgTypeAliases = map[string]string{
+	"boolean":           "bool",
+	"character varying": "varchar",
+}
+
+// columnTypeSQL returns the sql type string of the given column in the same
+// format as typeSQL, so that both can be compared.
+func (d *postgresAdapter) columnTypeSQL(col ColumnData) string {
+	typ := col.DataType
+	if alias, ok := pgTypeAliases[typ]; ok {
+		typ = alias
+	}
+	switch {
+	case typ == "varchar" && col.CharacterMaximumLength.Valid:
+		typ = fmt.Sprintf("%s(%d)", typ, col.CharacterMaximumLength.Int64)
+	case typ == "numeric" && col.NumericPrecision.Valid:
+		typ = fmt.Sprintf("%s(%d, %d)", typ, col.NumericPrecision.Int64, col.NumericScale.Int64)
+	}
+	return typ
+}
+
+// columnSQLDefinition returns the SQL type string, including columns constraints if any
+func (d *postgresAdapter) columnSQLDefinition(fi *Field) string {
+	res := d.typeSQL(fi)
 	if d.fieldIsNotNull(fi) {
 		res += " NOT NULL"
 	}
@@ -114,10 +193,6 @@ func (d *postgresAdapter) columnSQLDefinition(fi *Field) string {
 	if defValue != "" && !fi.required {
 		res += fmt.Sprintf(" DEFAULT %v", defValue)
 	}
-
-	if fi.unique || fi.fieldType == fieldtype.One2One {
-		res += " UNIQUE"
-	}
 	return res
 }
 
@@ -157,10 +232,17 @@ func (d *postgresAdapter) quoteTableName(tableName string) string {
 	return fmt.Sprintf(`"%s"`, tableName)
 }
 
+// dateTruncSQL returns the SQL expression truncating the
+// given date expression to the given granularity
+func (d *postgresAdapter) dateTruncSQL(granularity DateGranularity, expr string) string {
+	return fmt.Sprintf("date_trunc('%s', %s)", granularity, expr)
+}
+
 // columns returns a list of ColumnData for the given tableName
 func (d *postgresAdapter) columns(tableName string) map[string]ColumnData {
 	query := fmt.Sprintf(`
-		SELECT column_name, data_type, is_nullable, column_default
+		SELECT column_name, data_type, is_nullable, column_default,
+			character_maximum_length, numeric_precision, numeric_scale
 		FROM information_schema.columns
 		WHERE table_schema NOT IN ('pg_catalog', 'information_schema') AND table_name = '%s'
 	`, tableName)
@@ -183,6 +265,15 @@ func (d *postgresAdapter) indexExists(table string, name string) bool {
 	return cnt > 0
 }
 
+// indexComment returns the comment of the index with the given
+// name, or an empty string if it has none
+func (d *postgresAdapter) indexComment(name string) string {
+	query := fmt.Sprintf("SELECT COALESCE(obj_description(to_regclass('%s'), 'pg_class'), '')", name)
+	var comment string
+	dbGetNoTx(&comment, query)
+	return comment
+}
+
 // constraintExists returns true if a constraint with the given name exists in the given table
 func (d *postgresAdapter) constraintExists(name string) bool {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM pg_constraint WHERE conname = '%s'", name)
@@ -191,23 +282,65 @@ func (d *postgresAdapter) constraintExists(name string) bool {
 	return cnt > 0
 }
 
+// checkConstraintDefinition returns the definition of the CHECK constraint
+// with the given name, or an empty string if it does not exist
+func (d *postgresAdapter) checkConstraintDefinition(name string) string {
+	query := `SELECT COALESCE(MAX(pg_get_constraintdef(oid)), '') FROM pg_constraint
+		WHERE conname = ? AND contype = 'c'`
+	var definition string
+	dbGetNoTx(&definition, query, name)
+	return definition
+}
+
+// constraintColumns returns the sorted columns of the constraint with
+// the given name of the given table, or nil if it does not exist
+func (d *postgresAdapter) constraintColumns(table, name string) []string {
+	query := `SELECT a.attname FROM pg_constraint c
+		INNER JOIN pg_class t ON t.oid = c.conrelid
+		INNER JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY(c.conkey)
+		WHERE t.relname = ? AND c.conname = ?
+		ORDER BY a.attname`
+	var res []string
+	dbSelectNoTx(&res, query, table, name)
+	return res
+}
+
+// foreignKeyOnDelete returns the ON DELETE action of the
+// foreign key constraint with the given name
+func (d *postgresAdapter) foreignKeyOnDelete(name string) OnDeleteAction {
+	query := fmt.Sprintf("SELECT confdeltype FROM pg_constraint WHERE conname = '%s'", name)
+	var action string
+	dbGetNoTx(&action, query)
+	switch action {
+	case "c":
+		return Cascade
+	case "n":
+		return SetNull
+	}
+	return Restrict
+}
+
 // createSequence creates a DB sequence with the given name
 func (d *postgresAdapter) createSequence(name string) {
 	query := fmt.Sprintf("CREATE SEQUENCE %s", name)
-	dbExecuteNoTx(query)
+	syncExecute(query)
 }
 
 // dropSequence drops the DB sequence with the given name
 func (d *postgresAdapter) dropSequence(name string) {
 	query := fmt.Sprintf("DROP SEQUENCE IF EXISTS %s", name)
-	dbExecuteNoTx(query)
+	syncExecute(query)
 }
 
 // nextSequenceValue returns the next value of the given given sequence
-func (d *postgresAdapter) nextSequenceValue(name string) int64 {
+func (d *postgresAdapter) nextSequenceValue(cr *Cursor, name string) int64 {
 	query := fmt.Sprintf("SELECT nextval('%s')", name)
 	var val int64
-	dbGetNoTx(&val, query)
+	if cr == nil {
+		dbGetNoTx(&val, query)
+		return val
+	}
+	cr.Get(&val, query)
 	return val
 }
 
@@ -219,10 +352,209 @@ func (d *postgresAdapter) sequences(pattern string) []string {
 	return res
 }
 
+// txOptions returns the options with which transactions are started
+func (d *postgresAdapter) txOptions() *sql.TxOptions {
+	return nil
+}
+
 // setTransactionIsolation returns the SQL string to set the
 // transaction isolation level to serializable
 func (d *postgresAdapter) setTransactionIsolation() string {
 	return "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE"
 }
 
+// setStatementTimeout returns the SQL string to set the maximum
+// duration of the statements of the current transaction
+func (d *postgresAdapter) setStatementTimeout(timeout time.Duration) string {
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout/time.Millisecond)
+}
+
+// setTimeZone returns the SQL string to set the time zone of the current
+// transaction, which is used by date functions such as now() or CURRENT_DATE.
+func (d *postgresAdapter) setTimeZone(name string) string {
+	if name == "" {
+		return "SET LOCAL TIME ZONE DEFAULT"
+	}
+	return fmt.Sprintf("SET LOCAL TIME ZONE '%s'", strings.Replace(name, "'", "''", -1))
+}
+
+// setTransactionReadOnly returns the SQL string to make the current
+// transaction read-only
+func (d *postgresAdapter) setTransactionReadOnly() string {
+	return "SET TRANSACTION READ ONLY"
+}
+
+// primaryKeySQL returns the SQL definition of an auto-incremented id column
+func (d *postgresAdapter) primaryKeySQL() string {
+	return "serial NOT NULL PRIMARY KEY"
+}
+
+// supportsReturning returns true since PostgreSQL supports RETURNING clauses
+func (d *postgresAdapter) supportsReturning() bool {
+	return true
+}
+
+// concatSQL returns the SQL expression concatenating the given expressions
+func (d *postgresAdapter) concatSQL(exprs ...string) string {
+	return strings.Join(exprs, " || ")
+}
+
+// alterColumnTypeSQL returns the SQL queries to change the data type
+// of the column of the given Field, casting its existing values.
+// The default value of the column is dropped since it may not be castable.
+func (d *postgresAdapter) alterColumnTypeSQL(fi *Field) []string {
+	return []string{fmt.Sprintf(`
+		ALTER TABLE %[1]s
+		ALTER COLUMN %[2]s DROP DEFAULT,
+		ALTER COLUMN %[2]s SET DATA TYPE %[3]s USING %[2]s::%[3]s
+	`, d.quoteTableName(fi.model.tableName), fi.json, d.typeSQL(fi))}
+}
+
+// alterColumnNullableSQL returns the SQL query to set the NULL/NOT NULL
+// constraint of the column of the given Field.
+func (d *postgresAdapter) alterColumnNullableSQL(fi *Field) string {
+	verb := "DROP"
+	if d.fieldIsNotNull(fi) {
+		verb = "SET"
+	}
+	return fmt.Sprintf(`
+		ALTER TABLE %s
+		ALTER COLUMN %s %s NOT NULL
+	`, d.quoteTableName(fi.model.tableName), fi.json, verb)
+}
+
+// alterColumnDefaultSQL returns the SQL query to set the default
+// value of the column of the given Field.
+func (d *postgresAdapter) alterColumnDefaultSQL(fi *Field) string {
+	defValue := d.fieldSQLDefault(fi)
+	if defValue == "" {
+		return fmt.Sprintf(`
+			ALTER TABLE %s
+			ALTER COLUMN %s DROP DEFAULT
+		`, d.quoteTableName(fi.model.tableName), fi.json)
+	}
+	return fmt.Sprintf(`
+		ALTER TABLE %s
+		ALTER COLUMN %s SET DEFAULT %s
+	`, d.quoteTableName(fi.model.tableName), fi.json, defValue)
+}
+
+// addConstraintSQL returns the SQL query adding a constraint with
+// the given name and definition to the given table.
+func (d *postgresAdapter) addConstraintSQL(table, name, definition string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s ADD CONSTRAINT %s %s
+	`, d.quoteTableName(table), name, definition)
+}
+
+// renameConstraintSQL returns the SQL query to rename a constraint of the given table
+func (d *postgresAdapter) renameConstraintSQL(table, oldName, newName string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s RENAME CONSTRAINT %s TO %s
+	`, d.quoteTableName(table), d.quoteTableName(oldName), d.quoteTableName(newName))
+}
+
+// renameIndexSQL returns the SQL query to rename an index of the given table
+func (d *postgresAdapter) renameIndexSQL(table, oldName, newName string) string {
+	return fmt.Sprintf(`
+		ALTER INDEX %s RENAME TO %s
+	`, d.quoteTableName(oldName), d.quoteTableName(newName))
+}
+
+// createIndexSQL returns the SQL queries to create an index on the given
+// columns of the given table, with the given WHERE clause and comment
+// if they are not empty.
+func (d *postgresAdapter) createIndexSQL(unique bool, name, table string, cols []string, where, comment string) []string {
+	var uniqueSQL string
+	if unique {
+		uniqueSQL = "UNIQUE"
+	}
+	query := fmt.Sprintf(`
+		CREATE %s INDEX %s ON %s (%s)
+	`, uniqueSQL, name, d.quoteTableName(table), strings.Join(cols, ", "))
+	if where != "" {
+		query += fmt.Sprintf("WHERE %s", where)
+	}
+	res := []string{query}
+	if comment != "" {
+		res = append(res, fmt.Sprintf(`COMMENT ON INDEX %s IS '%s'`, name, strings.Replace(comment, "'", "''", -1)))
+	}
+	return res
+}
+
+// dropIndexSQL returns the SQL query to drop the index with
+// the given name of the given table if it exists
+func (d *postgresAdapter) dropIndexSQL(table, name string) string {
+	return fmt.Sprintf(`
+		DROP INDEX IF EXISTS %s
+	`, name)
+}
+
+// dropConstraintSQL returns the SQL query to drop the constraint with
+// the given name of the given table if it exists
+func (d *postgresAdapter) dropConstraintSQL(table, name string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s
+	`, d.quoteTableName(table), name)
+}
+
+// deleteDuplicateLinksSQL returns the SQL query deleting the duplicate
+// rows of the given many2many link table.
+func (d *postgresAdapter) deleteDuplicateLinksSQL(table, col1, col2 string) string {
+	return fmt.Sprintf(`
+		DELETE FROM %[1]s a USING %[1]s b
+		WHERE a.ctid < b.ctid AND a.%[2]s = b.%[2]s AND a.%[3]s = b.%[3]s
+	`, d.quoteTableName(table), col1, col2)
+}
+
+// currentTxIDSQL returns the SQL expression of the id of the current transaction
+func (d *postgresAdapter) currentTxIDSQL() string {
+	return "txid_current()"
+}
+
+// oldestRunningTxIDSQL returns the SQL expression of the id of the
+// oldest transaction that is still running
+func (d *postgresAdapter) oldestRunningTxIDSQL() string {
+	return "txid_snapshot_xmin(txid_current_snapshot())"
+}
+
+// constraintViolation returns the details of the given database error if it
+// is an integrity constraint violation. The second returned value is false
+// for any other value.
+func (d *postgresAdapter) constraintViolation(r interface{}) (dbConstraintViolation, bool) {
+	pqErr, ok := r.(*pq.Error)
+	if !ok {
+		return dbConstraintViolation{}, false
+	}
+	kind, ok := pqViolationKinds[pqErr.Code]
+	if !ok {
+		return dbConstraintViolation{}, false
+	}
+	res := dbConstraintViolation{
+		kind:       kind,
+		table:      pqErr.Table,
+		constraint: pqErr.Constraint,
+		column:     pqErr.Column,
+		referenced: strings.Contains(pqErr.Detail, "is still referenced"),
+		err:        pqErr,
+	}
+	if matches := pqDetailRegexp.FindStringSubmatch(pqErr.Detail); len(matches) == 3 {
+		if res.column == "" && !strings.Contains(matches[1], ",") {
+			res.column = matches[1]
+		}
+		res.value = matches[2]
+	}
+	return res, true
+}
+
+// isSerializationFailure returns true if the given database error
+// belongs to the transaction rollback class of PostgreSQL errors.
+func (d *postgresAdapter) isSerializationFailure(r interface{}) bool {
+	pqErr, ok := r.(*pq.Error)
+	if !ok {
+		return false
+	}
+	return pqErr.Code.Class() == "40"
+}
+
 var _ dbAdapter = new(postgresAdapter)
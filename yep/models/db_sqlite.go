@@ -0,0 +1,563 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/operator"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// sqliteAdapter is the dbAdapter of SQLite databases, meant for tests and
+// small embedded deployments. It requires SQLite 3.35 at least for RETURNING
+// clauses and DROP COLUMN.
+//
+// Since SQLite cannot alter columns nor add constraints to existing tables,
+// the schema synchronization degrades as follows:
+//   - the type, nullability and default value of existing columns are not updated,
+//   - foreign keys are only created with their column,
+//   - unique constraints are created as unique indexes,
+//   - check constraints are not created.
+type sqliteAdapter struct{}
+
+var sqliteOperators = map[operator.Operator]string{
+	operator.Equals:         "= ?",
+	operator.NotEquals:      "!= ?",
+	operator.Like:           "LIKE ?",
+	operator.NotLike:        "NOT LIKE ?",
+	operator.LikePattern:    "LIKE ?",
+	operator.ILike:          "LIKE ?",
+	operator.NotILike:       "NOT LIKE ?",
+	operator.ILikePattern:   "LIKE ?",
+	operator.In:             "IN (?)",
+	operator.NotIn:          "NOT IN (?)",
+	operator.Lower:          "< ?",
+	operator.LowerOrEqual:   "<= ?",
+	operator.Greater:        "> ?",
+	operator.GreaterOrEqual: ">= ?",
+}
+
+var sqliteTypes = map[fieldtype.Type]string{
+	fieldtype.Boolean:   "boolean",
+	fieldtype.Char:      "varchar",
+	fieldtype.Text:      "text",
+	fieldtype.Date:      "date",
+	fieldtype.DateTime:  "datetime",
+	fieldtype.Integer:   "integer",
+	fieldtype.Float:     "double precision",
+	fieldtype.Monetary:  "numeric",
+	fieldtype.HTML:      "text",
+	fieldtype.Binary:    "blob",
+	fieldtype.Selection: "varchar",
+	fieldtype.Many2One:  "integer",
+	fieldtype.One2One:   "integer",
+}
+
+var sqliteDefaultValues = map[fieldtype.Type]string{
+	fieldtype.Boolean:   "FALSE",
+	fieldtype.Char:      "''",
+	fieldtype.Text:      "''",
+	fieldtype.Date:      "'0001-01-01'",
+	fieldtype.DateTime:  "'0001-01-01 00:00:00'",
+	fieldtype.Integer:   "0",
+	fieldtype.Float:     "0.0",
+	fieldtype.Monetary:  "0.0",
+	fieldtype.HTML:      "''",
+	fieldtype.Binary:    "''",
+	fieldtype.Selection: "''",
+}
+
+// sqliteDateFormats are the strftime formats truncating dates to a granularity
+var sqliteDateFormats = map[DateGranularity]string{
+	GranularityDay:   "%Y-%m-%d",
+	GranularityMonth: "%Y-%m-01",
+}
+
+var (
+	// sqliteConstraintRegexp extracts the columns from the message of a constraint
+	// error, e.g. "UNIQUE constraint failed: user.email, user.login"
+	sqliteConstraintRegexp = regexp.MustCompile(`constraint failed: (.*)$`)
+	// sqliteOnDeleteRegexp extracts the ON DELETE action of a named
+	// foreign key from the SQL definition of a table
+	sqliteOnDeleteRegexp = `CONSTRAINT %s REFERENCES \S+ \(id\) ON DELETE (SET NULL|CASCADE|RESTRICT)`
+)
+
+// operatorSQL returns the sql string and placeholders for the given DomainOperator
+// Also modifies the given args to match the syntax of the operator.
+// LIKE is case insensitive for ASCII characters in SQLite.
+func (d *sqliteAdapter) operatorSQL(do operator.Operator, arg interface{}) (string, interface{}) {
+	op := sqliteOperators[do]
+	switch do {
+	case operator.Like, operator.ILike, operator.NotLike, operator.NotILike:
+		arg = fmt.Sprintf("%%%s%%", arg)
+	}
+	return op, arg
+}
+
+// hierarchySQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, following the given parent column recursively.
+// The given ids are included in the result.
+func (d *sqliteAdapter) hierarchySQL(op operator.Operator, table, parentColumn string) string {
+	if op == operator.ParentOf {
+		return fmt.Sprintf(`IN (WITH RECURSIVE tree(id, parent) AS (SELECT id, %[2]s FROM %[1]s WHERE id IN (?) `+
+			`UNION SELECT t.id, t.%[2]s FROM %[1]s t INNER JOIN tree ON t.id = tree.parent) SELECT id FROM tree)`,
+			d.quoteTableName(table), parentColumn)
+	}
+	return fmt.Sprintf(`IN (WITH RECURSIVE tree(id) AS (SELECT id FROM %[1]s WHERE id IN (?) `+
+		`UNION SELECT t.id FROM %[1]s t INNER JOIN tree ON t.%[2]s = tree.id) SELECT id FROM tree)`,
+		d.quoteTableName(table), parentColumn)
+}
+
+// parentPathSQL returns the sql string and placeholder selecting the
+// descendants (child_of) or ancestors (parent_of) of the given ids in the
+// given table, using the materialized paths of the given path column.
+// The given ids are included in the result.
+func (d *sqliteAdapter) parentPathSQL(op operator.Operator, table, pathColumn string) string {
+	selected, given := "t", "p"
+	if op == operator.ParentOf {
+		selected, given = "p", "t"
+	}
+	return fmt.Sprintf(`IN (SELECT %[3]s.id FROM %[1]s t INNER JOIN %[1]s p ON t.%[2]s LIKE %[5]s WHERE %[4]s.id IN (?))`,
+		d.quoteTableName(table), pathColumn, selected, given, d.concatSQL("p."+pathColumn, "'%'"))
+}
+
+// typeSQL returns the sql type string for the given Field,
+// including its size or precision if any. SQLite does not enforce
+// sizes, which are only kept to document the schema.
+func (d *sqliteAdapter) typeSQL(fi *Field) string {
+	typ, ok := sqliteTypes[fi.fieldType]
+	if !ok {
+		log.Panic("Unknown column type", "type", fi.fieldType, "model", fi.model.name, "field", fi.name)
+	}
+	switch fi.fieldType {
+	case fieldtype.Char:
+		if fi.size > 0 && !fi.isEncrypted() {
+			typ = fmt.Sprintf("%s(%d)", typ, fi.size)
+		}
+	case fieldtype.Float:
+		emptyD := types.Digits{}
+		if fi.digits != emptyD {
+			typ = fmt.Sprintf("numeric(%d, %d)", fi.digits.Precision, fi.digits.Scale)
+		}
+	}
+	return typ
+}
+
+// columnTypeSQL returns the sql type string of the given column in the same
+// format as typeSQL, so that both can be compared. SQLite returns the
+// type as it has been declared.
+func (d *sqliteAdapter) columnTypeSQL(col ColumnData) string {
+	return strings.ToLower(col.DataType)
+}
+
+// columnSQLDefinition returns the SQL type string, including columns constraints if any.
+// Foreign keys are declared with the column, since they cannot be added afterwards.
+func (d *sqliteAdapter) columnSQLDefinition(fi *Field) string {
+	res := d.typeSQL(fi)
+	if d.fieldIsNotNull(fi) {
+		res += " NOT NULL"
+	}
+
+	defValue := d.fieldSQLDefault(fi)
+	if defValue != "" && !fi.required {
+		res += fmt.Sprintf(" DEFAULT %v", defValue)
+	}
+	if fi.fieldType.IsFKRelationType() {
+		res += fmt.Sprintf(" CONSTRAINT %s REFERENCES %s (id) ON DELETE %s", fkConstraintName(fi.model.tableName, fi.json),
+			d.quoteTableName(fi.relatedModel.tableName), fi.onDelete)
+	}
+	return res
+}
+
+// fieldIsNull returns true if the given Field results in a NOT NULL column in
+// database. Foreign key columns are always nullable, since SQLite cannot add
+// a NOT NULL column without a default value.
+func (d *sqliteAdapter) fieldIsNotNull(fi *Field) bool {
+	return !fi.fieldType.IsFKRelationType()
+}
+
+// fieldSQLDefault returns the SQL default value of the Field
+func (d *sqliteAdapter) fieldSQLDefault(fi *Field) string {
+	return sqliteDefaultValues[fi.fieldType]
+}
+
+// tables returns a map of table names of the database.
+// Internal tables and tables emulating sequences are not returned.
+func (d *sqliteAdapter) tables() map[string]bool {
+	var resList []string
+	query := `SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE '%\_manseq' ESCAPE '\'`
+	if err := db.Select(&resList, query); err != nil {
+		log.Panic("Unable to get list of tables from database", "error", err)
+	}
+	res := make(map[string]bool, len(resList))
+	for _, tableName := range resList {
+		res[tableName] = true
+	}
+	return res
+}
+
+// quoteTableName returns the given table name with sql quotes
+func (d *sqliteAdapter) quoteTableName(tableName string) string {
+	return fmt.Sprintf(`"%s"`, tableName)
+}
+
+// dateTruncSQL returns the SQL expression truncating the
+// given date expression to the given granularity
+func (d *sqliteAdapter) dateTruncSQL(granularity DateGranularity, expr string) string {
+	if granularity == GranularityWeek {
+		// Weeks begin on monday: we go to the next sunday and back 6 days
+		return fmt.Sprintf("datetime(date(%s, 'weekday 0', '-6 days'))", expr)
+	}
+	return fmt.Sprintf("datetime(strftime('%s', %s))", sqliteDateFormats[granularity], expr)
+}
+
+// columns returns a list of ColumnData for the given tableName
+func (d *sqliteAdapter) columns(tableName string) map[string]ColumnData {
+	var colData []struct {
+		CID       int64          `db:"cid"`
+		Name      string         `db:"name"`
+		Type      string         `db:"type"`
+		NotNull   bool           `db:"notnull"`
+		DfltValue sql.NullString `db:"dflt_value"`
+		PK        int64          `db:"pk"`
+	}
+	if err := db.Select(&colData, fmt.Sprintf("PRAGMA table_info(%s)", d.quoteTableName(tableName))); err != nil {
+		log.Panic("Unable to get list of columns for table", "table", tableName, "error", err)
+	}
+	res := make(map[string]ColumnData, len(colData))
+	for _, col := range colData {
+		isNullable := "YES"
+		if col.NotNull {
+			isNullable = "NO"
+		}
+		res[col.Name] = ColumnData{
+			ColumnName:    col.Name,
+			DataType:      col.Type,
+			IsNullable:    isNullable,
+			ColumnDefault: col.DfltValue,
+		}
+	}
+	return res
+}
+
+// indexExists returns true if an index with the given name exists in the given table
+func (d *sqliteAdapter) indexExists(table string, name string) bool {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+	var cnt int
+	dbGetNoTx(&cnt, query, table, name)
+	return cnt > 0
+}
+
+// sqliteIndexCommentRegexp extracts the comment
+// from the SQL definition of an index
+var sqliteIndexCommentRegexp = regexp.MustCompile(`/\* (.*) \*/`)
+
+// indexComment returns the comment of the index with the given name, or an
+// empty string if it has none. SQLite has no comments on indexes: they are
+// stored in the SQL definition of the index, which is kept as is.
+func (d *sqliteAdapter) indexComment(name string) string {
+	query := "SELECT COALESCE(MAX(sql), '') FROM sqlite_master WHERE type = 'index' AND name = ?"
+	var definition string
+	dbGetNoTx(&definition, query, name)
+	if matches := sqliteIndexCommentRegexp.FindStringSubmatch(definition); len(matches) == 2 {
+		return strings.Replace(matches[1], "* /", "*/", -1)
+	}
+	return ""
+}
+
+// constraintExists returns true if a constraint with the given name exists.
+// Unique constraints and primary keys added to existing tables are
+// unique indexes, and foreign keys are named in the table definition.
+func (d *sqliteAdapter) constraintExists(name string) bool {
+	query := `SELECT COUNT(*) FROM sqlite_master
+		WHERE (type = 'index' AND name = ?) OR (type = 'table' AND sql LIKE ?)`
+	var cnt int
+	dbGetNoTx(&cnt, query, name, fmt.Sprintf("%%CONSTRAINT %s %%", name))
+	return cnt > 0
+}
+
+// checkConstraintDefinition returns an empty string since
+// CHECK constraints cannot be added to existing SQLite tables.
+func (d *sqliteAdapter) checkConstraintDefinition(name string) string {
+	return ""
+}
+
+// constraintColumns returns the sorted columns of the unique index
+// implementing the constraint with the given name of the given table,
+// or nil if it does not exist.
+func (d *sqliteAdapter) constraintColumns(table, name string) []string {
+	if !d.indexExists(table, name) {
+		return nil
+	}
+	var res []string
+	dbSelectNoTx(&res, "SELECT name FROM pragma_index_info(?) ORDER BY name", name)
+	return res
+}
+
+// foreignKeyOnDelete returns the ON DELETE action of the
+// foreign key constraint with the given name
+func (d *sqliteAdapter) foreignKeyOnDelete(name string) OnDeleteAction {
+	query := "SELECT COALESCE(MAX(sql), '') FROM sqlite_master WHERE type = 'table' AND sql LIKE ?"
+	var definition string
+	dbGetNoTx(&definition, query, fmt.Sprintf("%%CONSTRAINT %s %%", name))
+	onDeleteRegexp := regexp.MustCompile(fmt.Sprintf("(?i)"+sqliteOnDeleteRegexp, regexp.QuoteMeta(name)))
+	matches := onDeleteRegexp.FindStringSubmatch(definition)
+	if len(matches) != 2 {
+		return Restrict
+	}
+	switch strings.ToLower(matches[1]) {
+	case "cascade":
+		return Cascade
+	case "set null":
+		return SetNull
+	}
+	return Restrict
+}
+
+// txOptions returns the options with which transactions are started
+func (d *sqliteAdapter) txOptions() *sql.TxOptions {
+	return nil
+}
+
+// setTransactionIsolation returns an empty string since
+// SQLite transactions are always serializable.
+func (d *sqliteAdapter) setTransactionIsolation() string {
+	return ""
+}
+
+// setStatementTimeout returns an empty string
+// since SQLite statements cannot be timed out.
+func (d *sqliteAdapter) setStatementTimeout(timeout time.Duration) string {
+	return ""
+}
+
+// setTimeZone returns an empty string since SQLite has no time zone setting
+func (d *sqliteAdapter) setTimeZone(name string) string {
+	return ""
+}
+
+// setTransactionReadOnly returns an empty string since SQLite cannot
+// make a single transaction read-only. Read-only environments are still
+// enforced by the ORM.
+func (d *sqliteAdapter) setTransactionReadOnly() string {
+	return ""
+}
+
+// createSequence creates a table emulating a DB sequence with the given name
+func (d *sqliteAdapter) createSequence(name string) {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY AUTOINCREMENT)", d.quoteTableName(name))
+	syncExecute(query)
+}
+
+// dropSequence drops the table emulating the DB sequence with the given name
+func (d *sqliteAdapter) dropSequence(name string) {
+	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", d.quoteTableName(name))
+	syncExecute(query)
+}
+
+// nextSequenceValue returns the next value of the given given sequence.
+// A row is inserted in the table emulating the sequence to get its
+// next id, and older rows are removed.
+func (d *sqliteAdapter) nextSequenceValue(cr *Cursor, name string) int64 {
+	execute := dbExecuteNoTx
+	if cr != nil {
+		execute = cr.Execute
+	}
+	res := execute(fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", d.quoteTableName(name)))
+	val, err := res.LastInsertId()
+	if err != nil {
+		log.Panic("Unable to get next sequence value", "sequence", name, "error", err)
+	}
+	execute(fmt.Sprintf("DELETE FROM %s WHERE id < ?", d.quoteTableName(name)), val)
+	return val
+}
+
+// sequences returns a list of all sequences matching the given SQL pattern
+func (d *sqliteAdapter) sequences(pattern string) []string {
+	query := "SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE ?"
+	var res []string
+	dbSelectNoTx(&res, query, pattern)
+	return res
+}
+
+// primaryKeySQL returns the SQL definition of an auto-incremented id column
+func (d *sqliteAdapter) primaryKeySQL() string {
+	return "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT"
+}
+
+// supportsReturning returns true since SQLite supports RETURNING clauses
+func (d *sqliteAdapter) supportsReturning() bool {
+	return true
+}
+
+// concatSQL returns the SQL expression concatenating the given expressions
+func (d *sqliteAdapter) concatSQL(exprs ...string) string {
+	return strings.Join(exprs, " || ")
+}
+
+// alterColumnTypeSQL returns no query since SQLite cannot alter columns.
+// Since SQLite columns accept values of any type, existing values are
+// kept and new values are stored with the new type.
+func (d *sqliteAdapter) alterColumnTypeSQL(fi *Field) []string {
+	log.Warn("Column type cannot be updated in SQLite", "model", fi.model.name, "field", fi.name)
+	return nil
+}
+
+// alterColumnNullableSQL returns an empty string since SQLite cannot alter columns
+func (d *sqliteAdapter) alterColumnNullableSQL(fi *Field) string {
+	return ""
+}
+
+// alterColumnDefaultSQL returns an empty string since SQLite cannot alter columns
+func (d *sqliteAdapter) alterColumnDefaultSQL(fi *Field) string {
+	return ""
+}
+
+// addConstraintSQL returns the SQL query creating a unique index for
+// unique constraints and primary keys, and an empty string for other
+// constraints since SQLite cannot add them to existing tables.
+func (d *sqliteAdapter) addConstraintSQL(table, name, definition string) string {
+	for _, prefix := range []string{"UNIQUE ", "PRIMARY KEY "} {
+		if strings.HasPrefix(definition, prefix) {
+			return fmt.Sprintf(`
+				CREATE UNIQUE INDEX %s ON %s %s
+			`, name, d.quoteTableName(table), strings.TrimPrefix(definition, prefix))
+		}
+	}
+	return ""
+}
+
+// renameConstraintSQL returns an empty string since
+// SQLite constraints cannot be renamed.
+func (d *sqliteAdapter) renameConstraintSQL(table, oldName, newName string) string {
+	return ""
+}
+
+// renameIndexSQL returns an empty string since SQLite indexes cannot be renamed
+func (d *sqliteAdapter) renameIndexSQL(table, oldName, newName string) string {
+	return ""
+}
+
+// createIndexSQL returns the SQL queries to create an index on the given
+// columns of the given table, with the given WHERE clause and comment
+// if they are not empty. The comment is kept in the index definition.
+func (d *sqliteAdapter) createIndexSQL(unique bool, name, table string, cols []string, where, comment string) []string {
+	var uniqueSQL string
+	if unique {
+		uniqueSQL = "UNIQUE"
+	}
+	var commentSQL string
+	if comment != "" {
+		commentSQL = fmt.Sprintf("/* %s */ ", strings.Replace(comment, "*/", "* /", -1))
+	}
+	query := fmt.Sprintf(`
+		CREATE %s INDEX %s ON %s %s(%s)
+	`, uniqueSQL, name, d.quoteTableName(table), commentSQL, strings.Join(cols, ", "))
+	if where != "" {
+		query += fmt.Sprintf("WHERE %s", where)
+	}
+	return []string{query}
+}
+
+// dropIndexSQL returns the SQL query to drop the index with
+// the given name of the given table if it exists
+func (d *sqliteAdapter) dropIndexSQL(table, name string) string {
+	return fmt.Sprintf(`
+		DROP INDEX IF EXISTS %s
+	`, name)
+}
+
+// dropConstraintSQL returns the SQL query to drop the unique index
+// implementing the constraint with the given name, or an empty string
+// if there is no such index since constraints cannot be dropped.
+func (d *sqliteAdapter) dropConstraintSQL(table, name string) string {
+	if !d.indexExists(table, name) {
+		return ""
+	}
+	return d.dropIndexSQL(table, name)
+}
+
+// deleteDuplicateLinksSQL returns the SQL query deleting the duplicate
+// rows of the given many2many link table.
+func (d *sqliteAdapter) deleteDuplicateLinksSQL(table, col1, col2 string) string {
+	return fmt.Sprintf(`
+		DELETE FROM %[1]s WHERE rowid NOT IN (SELECT MIN(rowid) FROM %[1]s GROUP BY %[2]s, %[3]s)
+	`, d.quoteTableName(table), col1, col2)
+}
+
+// currentTxIDSQL returns a constant since SQLite transactions have no id.
+// Write transactions are serialized in SQLite, so that change events
+// are committed in the order of their ids.
+func (d *sqliteAdapter) currentTxIDSQL() string {
+	return "0"
+}
+
+// oldestRunningTxIDSQL returns a constant greater than the transaction id
+// of all the events since they are committed in the order of their ids.
+func (d *sqliteAdapter) oldestRunningTxIDSQL() string {
+	return "1"
+}
+
+// constraintViolation returns the details of the given database error if it
+// is an integrity constraint violation. The second returned value is false
+// for any other value.
+//
+// SQLite errors give the table and columns of unique and not null violations,
+// but not the constraint name.
+func (d *sqliteAdapter) constraintViolation(r interface{}) (dbConstraintViolation, bool) {
+	sqliteErr, ok := r.(sqlite3.Error)
+	if !ok || sqliteErr.Code != sqlite3.ErrConstraint {
+		return dbConstraintViolation{}, false
+	}
+	res := dbConstraintViolation{err: sqliteErr}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintNotNull:
+		res.kind = notNullViolation
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		res.kind = uniqueViolation
+	case sqlite3.ErrConstraintForeignKey:
+		res.kind = foreignKeyViolation
+	case sqlite3.ErrConstraintCheck:
+		res.kind = checkViolation
+	default:
+		return dbConstraintViolation{}, false
+	}
+	matches := sqliteConstraintRegexp.FindStringSubmatch(sqliteErr.Error())
+	if len(matches) != 2 {
+		return res, true
+	}
+	if res.kind == checkViolation {
+		res.constraint = matches[1]
+		return res, true
+	}
+	columns := strings.Split(matches[1], ", ")
+	if tableCol := strings.SplitN(columns[0], ".", 2); len(tableCol) == 2 {
+		res.table = tableCol[0]
+		if len(columns) == 1 {
+			res.column = tableCol[1]
+		}
+	}
+	return res, true
+}
+
+// isSerializationFailure returns true if the given database
+// error means that the database is locked by another connection.
+func (d *sqliteAdapter) isSerializationFailure(r interface{}) bool {
+	sqliteErr, ok := r.(sqlite3.Error)
+	if !ok {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+var _ dbAdapter = new(sqliteAdapter)
@@ -0,0 +1,198 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/npiganeau/yep/yep/models/operator"
+)
+
+// encryptedValuePrefix marks the values of encrypted fields in the database.
+// Values without this prefix have been stored before the field was encrypted
+// and are returned as is.
+const encryptedValuePrefix = "enc1:"
+
+// An EncryptionMode defines how the values of an encrypted field are encrypted.
+type EncryptionMode string
+
+const (
+	// RandomEncryption encrypts values with a random nonce so that equal values
+	// have different encrypted values. Such fields cannot be searched.
+	RandomEncryption EncryptionMode = "random"
+	// DeterministicEncryption always encrypts a value the same way, so that the
+	// field can be searched with the =, !=, IN and NOT IN operators. It reveals
+	// which records have equal values.
+	DeterministicEncryption EncryptionMode = "deterministic"
+)
+
+// A KeyProvider provides the key with which the values of encrypted
+// fields are encrypted, for instance from a key management service.
+type KeyProvider interface {
+	// EncryptionKey returns the AES key to use, which must be 16, 24 or 32 bytes long.
+	EncryptionKey() ([]byte, error)
+}
+
+// A StaticKey is a KeyProvider that returns itself,
+// e.g. a key read from the configuration.
+type StaticKey []byte
+
+// EncryptionKey returns the AES key to use
+func (k StaticKey) EncryptionKey() ([]byte, error) {
+	return k, nil
+}
+
+var _ KeyProvider = StaticKey{}
+
+// fieldCipher holds the cipher used to encrypt field values.
+// It is created from the KeyProvider on first use.
+var fieldCipher struct {
+	sync.Mutex
+	provider KeyProvider
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// SetEncryptionKeyProvider sets the KeyProvider of the key used to encrypt
+// the values of encrypted fields. It must be called before the server is
+// started and the key must not be changed afterwards, since values encrypted
+// with another key cannot be decrypted.
+func SetEncryptionKeyProvider(provider KeyProvider) {
+	fieldCipher.Lock()
+	defer fieldCipher.Unlock()
+	fieldCipher.provider = provider
+	fieldCipher.aead = nil
+	fieldCipher.nonceKey = nil
+}
+
+// encryptionCipher returns the AEAD with which field values are encrypted and
+// the key from which the nonces of deterministic encryption are derived.
+func encryptionCipher() (cipher.AEAD, []byte) {
+	fieldCipher.Lock()
+	defer fieldCipher.Unlock()
+	if fieldCipher.aead != nil {
+		return fieldCipher.aead, fieldCipher.nonceKey
+	}
+	if fieldCipher.provider == nil {
+		log.Panic("No encryption key set for encrypted fields")
+	}
+	key, err := fieldCipher.provider.EncryptionKey()
+	if err != nil {
+		log.Panic("Unable to get encryption key", "error", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panic("Invalid encryption key", "error", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Panic("Unable to create cipher", "error", err)
+	}
+	nonceKey := sha256.Sum256(append([]byte("yep-field-encryption-nonce"), key...))
+	fieldCipher.aead = aead
+	fieldCipher.nonceKey = nonceKey[:]
+	return fieldCipher.aead, fieldCipher.nonceKey
+}
+
+// isEncrypted returns true if the values of this field are encrypted in the database
+func (f *Field) isEncrypted() bool {
+	return f.encrypted != ""
+}
+
+// encryptValue returns the encrypted value of the given value of this field
+// as stored in the database. Null and empty values are not encrypted.
+func (f *Field) encryptValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	plain := reflect.ValueOf(value).String()
+	if plain == "" {
+		return plain
+	}
+	aead, nonceKey := encryptionCipher()
+	nonce := make([]byte, aead.NonceSize())
+	switch f.encrypted {
+	case DeterministicEncryption:
+		mac := hmac.New(sha256.New, nonceKey)
+		mac.Write([]byte(plain))
+		copy(nonce, mac.Sum(nil))
+	default:
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			log.Panic("Unable to generate nonce", "model", f.model.name, "field", f.name, "error", err)
+		}
+	}
+	data := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(data)
+}
+
+// decryptValue returns the plain value of the given database value of this field.
+func (f *Field) decryptValue(value interface{}) interface{} {
+	var data string
+	switch val := value.(type) {
+	case string:
+		data = val
+	case []byte:
+		data = string(val)
+	default:
+		return value
+	}
+	if !strings.HasPrefix(data, encryptedValuePrefix) {
+		return value
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(data, encryptedValuePrefix))
+	aead, _ := encryptionCipher()
+	if err != nil || len(raw) < aead.NonceSize() {
+		log.Panic("Invalid encrypted value", "model", f.model.name, "field", f.name)
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		log.Panic("Unable to decrypt value", "model", f.model.name, "field", f.name, "error", err)
+	}
+	return string(plain)
+}
+
+// decryptAggregates decrypts the values of encrypted fields in vals,
+// which are the values of a row of a grouped query.
+func (rc RecordCollection) decryptAggregates(vals map[string]interface{}) {
+	for key, value := range vals {
+		if fi, ok := rc.model.fields.get(key); ok && fi.isEncrypted() {
+			vals[key] = fi.decryptValue(value)
+		}
+	}
+}
+
+// encryptedSearchArg returns the argument with which to search this encrypted
+// field with the given operator. It panics if the field cannot be searched with
+// this operator.
+func (f *Field) encryptedSearchArg(op operator.Operator, arg interface{}) interface{} {
+	if f.encrypted != DeterministicEncryption {
+		log.Panic("Fields with random encryption cannot be searched", "model", f.model.name, "field", f.name)
+	}
+	switch op {
+	case operator.Equals, operator.NotEquals:
+		return f.encryptValue(arg)
+	case operator.In, operator.NotIn:
+		values := reflect.ValueOf(arg)
+		if values.Kind() != reflect.Slice {
+			return f.encryptValue(arg)
+		}
+		res := make([]interface{}, values.Len())
+		for i := 0; i < values.Len(); i++ {
+			res[i] = f.encryptValue(values.Index(i).Interface())
+		}
+		return res
+	}
+	log.Panic("Encrypted fields can only be searched with =, !=, IN and NOT IN operators", "model", f.model.name,
+		"field", f.name, "operator", op)
+	return nil
+}
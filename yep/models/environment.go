@@ -15,7 +15,12 @@
 package models
 
 import (
-	"github.com/lib/pq"
+	"context"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/models/types"
 	"github.com/npiganeau/yep/yep/tools/logging"
 )
@@ -25,22 +30,58 @@ import (
 // be retried.
 const DBSerializationMaxRetries uint8 = 5
 
+// A NestedTransactionPolicy defines what to do when a new Environment is
+// requested from code that is already executing inside a transaction.
+type NestedTransactionPolicy int8
+
+const (
+	// NestedTransactionFail panics with the current call stack
+	NestedTransactionFail NestedTransactionPolicy = iota
+	// NestedTransactionReuse executes the function in the current transaction.
+	// It fails if the Go context of the current Environment is not given.
+	NestedTransactionReuse
+	// NestedTransactionAllow opens a new transaction after logging a warning.
+	// This may lead to deadlocks if both transactions modify the same records.
+	NestedTransactionAllow
+)
+
+// NestedTransactions is the policy applied when a new Environment is
+// requested from code that is already executing inside a transaction.
+var NestedTransactions = NestedTransactionAllow
+
+// activeEnvironmentKey is the key of the Environment
+// in the Go context of its transaction.
+type activeEnvironmentKey struct{}
+
+// environmentFuncName is the name of runInEnvironment as it appears in the
+// frames of the call stack.
+var environmentFuncName = runtime.FuncForPC(reflect.ValueOf(runInEnvironment).Pointer()).Name()
+
 // An Environment stores various contextual data used by the models:
 // - the database cursor (current open transaction),
 // - the current user ID (for access rights checking)
 // - the current context (for storing arbitrary metadata).
 // The Environment also stores caches.
 type Environment struct {
-	cr        *Cursor
-	uid       int64
-	context   *types.Context
-	cache     *cache
-	callStack []*methodLayer
-	retries   uint8
+	cr             *Cursor
+	uid            int64
+	context        *types.Context
+	cache          *cache
+	callStack      []*methodLayer
+	retries        uint8
+	recomputeQueue *recomputeQueue
+	readOnly       bool
+	// checkedVersions holds the keys of the records whose version given in
+	// the __last_update context key has already been checked in this transaction.
+	checkedVersions map[string]bool
 }
 
-// Cr returns a pointer to the Cursor of the Environment
+// Cr returns a pointer to the Cursor of the Environment. The time zone of
+// the database session is set to the one of the context of the Environment,
+// so that date functions such as now() are evaluated in the user's time zone.
+// RecordCollections get their cursor from Cr for each query for this reason.
 func (env Environment) Cr() *Cursor {
+	env.syncTimeZone()
 	return env.cr
 }
 
@@ -54,13 +95,33 @@ func (env Environment) Context() *types.Context {
 	return env.context
 }
 
-// commit the transaction of this environment.
+// GoContext returns the context.Context to which the transaction of this
+// Environment is bound. Long running operations should check it regularly
+// and stop when it is done.
+func (env Environment) GoContext() context.Context {
+	return env.cr.ctx
+}
+
+// IsFeatureEnabled returns true if the feature flag with the given ID is
+// enabled for the user of this Environment and the current company, as
+// given by the company_id key of the context.
+func (env Environment) IsFeatureEnabled(featureID string) bool {
+	var companyID int64
+	if env.context != nil {
+		companyID = env.context.GetInt(companyContextKey, 0)
+	}
+	return security.Features.IsEnabled(featureID, env.uid, companyID)
+}
+
+// commit the transaction of this environment. It returns an error if
+// the transaction cannot be committed, for instance because its
+// context.Context has been canceled.
 //
 // WARNING: Do NOT call Commit on Environment instances that you
 // did not create yourself with NewEnvironment. The framework will
 // automatically commit the Environment.
-func (env Environment) commit() {
-	env.cr.tx.Commit()
+func (env Environment) commit() error {
+	return env.cr.tx.Commit()
 }
 
 // rollback the transaction of this environment.
@@ -73,21 +134,23 @@ func (env Environment) rollback() {
 }
 
 // newEnvironment returns a new Environment with the given parameters
-// in a new DB transaction.
+// in a new DB transaction bound to ctx.
 //
 // WARNING: Callers to NewEnvironment should ensure to either call Commit()
 // or Rollback() on the returned Environment after operation to release
 // the database connection.
-func newEnvironment(uid int64, context ...types.Context) Environment {
-	var ctx types.Context
-	if len(context) > 0 {
-		ctx = context[0]
+func newEnvironment(ctx context.Context, uid int64, contexts ...types.Context) Environment {
+	var typesCtx types.Context
+	if len(contexts) > 0 {
+		typesCtx = contexts[0]
 	}
 	env := Environment{
-		cr:      newCursor(db),
-		uid:     uid,
-		context: &ctx,
-		cache:   newCache(),
+		cr:              newCursor(ctx, db),
+		uid:             uid,
+		context:         &typesCtx,
+		cache:           newCache(),
+		recomputeQueue:  newRecomputeQueue(),
+		checkedVersions: make(map[string]bool),
 	}
 	return env
 }
@@ -100,47 +163,262 @@ func newEnvironment(uid int64, context ...types.Context) Environment {
 // errors are automatically retried several times before returning an
 // error if they still occur.
 func ExecuteInNewEnvironment(uid int64, fnct func(Environment)) (rError error) {
-	env := newEnvironment(uid)
+	return ExecuteInNewEnvironmentWithContext(context.Background(), uid, fnct)
+}
+
+// ExecuteInNewEnvironmentWithContext is the same as ExecuteInNewEnvironment
+// except that the transaction is bound to ctx. If ctx is canceled or reaches
+// its deadline, the running query is canceled, the transaction is rolled back
+// and ctx.Err() is returned.
+//
+// Use it with the context of HTTP requests so that the queries of canceled
+// requests are stopped, or with a context with a deadline for long jobs.
+func ExecuteInNewEnvironmentWithContext(ctx context.Context, uid int64, fnct func(Environment)) (rError error) {
+	if env, reuse := checkNestedEnvironment(ctx, uid, true); reuse {
+		fnct(env)
+		return
+	}
+	return executeInNewEnvironment(ctx, uid, fnct)
+}
+
+// executeInNewEnvironment executes fnct in a new Environment bound to ctx and
+// retries it on serialization failures. It does not check for nested
+// transactions, since retries are executed while the call stack still holds
+// the failed transaction.
+func executeInNewEnvironment(ctx context.Context, uid int64, fnct func(Environment)) (rError error) {
+	env := newEnvironment(ctx, uid)
 	defer func() {
 		if r := recover(); r != nil {
 			env.rollback()
-			if err, ok := r.(pq.Error); ok && err.Code.Class() == "40" {
+			if err := ctx.Err(); err != nil {
+				log.Warn("Transaction aborted", "uid", uid, "error", err)
+				rError = err
+				return
+			}
+			if adapters[db.DriverName()].isSerializationFailure(r) {
 				// Transaction error
 				env.retries++
 				if env.retries < DBSerializationMaxRetries {
-					if ExecuteInNewEnvironment(uid, fnct) == nil {
+					if executeInNewEnvironment(ctx, uid, fnct) == nil {
 						rError = nil
 						return
 					}
 				}
 			}
-			rError = logging.LogPanicData(r)
+			rError = panicError(r)
 			return
 		}
-		env.commit()
+		if err := env.commit(); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			log.Warn("Unable to commit transaction", "uid", uid, "error", err)
+			rError = err
+		}
 	}()
-	fnct(env)
+	runInEnvironment(env, fnct)
 	return
 }
 
+// panicError returns the error to return for the given panic data. User errors
+// are returned as is so that the client can display them, other panics are
+// logged with their stack.
+func panicError(r interface{}) error {
+	switch err := r.(type) {
+	case ValidationError, AccessError, MethodAccessError, InfectedFileError, QueryGuardError,
+		ReadOnlyError, ConcurrentUpdateError, ApprovalError, X2ManyConflictError:
+		return err.(error)
+	}
+	return logging.LogPanicData(r)
+}
+
+// ExecuteInSavepoint executes the given fnct in a savepoint of the transaction
+// of this Environment. If fnct returns an error or panics, the changes it made
+// are rolled back and the error is returned, while the transaction can go on.
+// Otherwise, the changes are kept and nil is returned.
+//
+// Savepoints can be nested. Panics due to the cancellation of the context of
+// the transaction or to serialization failures are not recovered, since the
+// whole transaction must be rolled back.
+func (env Environment) ExecuteInSavepoint(fnct func(Environment) error) (rError error) {
+	name := env.cr.savepoint()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if adapters[db.DriverName()].isSerializationFailure(r) || env.cr.ctx.Err() != nil {
+			panic(r)
+		}
+		env.rollbackToSavepoint(name)
+		rError = panicError(r)
+	}()
+	if err := fnct(env); err != nil {
+		env.rollbackToSavepoint(name)
+		return err
+	}
+	env.cr.releaseSavepoint(name)
+	return nil
+}
+
+// rollbackToSavepoint rolls back the transaction of this Environment to the
+// savepoint with the given name and clears the cache, which may hold values
+// written after the savepoint.
+func (env Environment) rollbackToSavepoint(name string) {
+	env.cr.rollbackToSavepoint(name)
+	env.cache.clear()
+}
+
+// ExecuteInReadOnlyEnvironment executes the given fnct in a new Environment
+// within a new read-only transaction, which is rolled back at the end.
+// Trying to create, write or unlink records in this Environment panics with
+// a ReadOnlyError, and other writes are rejected by the database.
+//
+// It returns an error if fnct panicked during its execution. Use it for
+// code that must not modify the database, such as report rendering.
+func ExecuteInReadOnlyEnvironment(uid int64, fnct func(Environment)) (rError error) {
+	return ExecuteInReadOnlyEnvironmentWithContext(context.Background(), uid, fnct)
+}
+
+// ExecuteInReadOnlyEnvironmentWithContext is the same as ExecuteInReadOnlyEnvironment
+// except that the transaction is bound to ctx. If ctx is canceled or reaches
+// its deadline, the running query is canceled and ctx.Err() is returned.
+func ExecuteInReadOnlyEnvironmentWithContext(ctx context.Context, uid int64, fnct func(Environment)) (rError error) {
+	if env, reuse := checkNestedEnvironment(ctx, uid, true); reuse {
+		env.readOnly = true
+		fnct(env)
+		return
+	}
+	env := newEnvironment(ctx, uid)
+	env.readOnly = true
+	defer func() {
+		env.rollback()
+		if r := recover(); r != nil {
+			if err := ctx.Err(); err != nil {
+				rError = err
+				return
+			}
+			rError = panicError(r)
+		}
+	}()
+	if query := adapters[db.DriverName()].setTransactionReadOnly(); query != "" {
+		env.Cr().Execute(query)
+	}
+	runInEnvironment(env, fnct)
+	return
+}
+
+// IsReadOnly returns true if this Environment has been
+// opened with ExecuteInReadOnlyEnvironment.
+func (env Environment) IsReadOnly() bool {
+	return env.readOnly
+}
+
+// checkWritable panics with a ReadOnlyError if the Environment of rc is
+// read-only. operation is the name of the attempted write, e.g. "create".
+func (rc RecordCollection) checkWritable(operation string) {
+	if rc.env.readOnly {
+		panic(ReadOnlyError{Model: rc.model.name, Operation: operation})
+	}
+}
+
 // SimulateInNewEnvironment executes the given fnct in a new Environment
 // within a new transaction and rolls back the transaction at the end.
 //
 // This function always rolls back the transaction but returns an error
 // only if fnct panicked during its execution.
 func SimulateInNewEnvironment(uid int64, fnct func(Environment)) (rError error) {
-	env := newEnvironment(uid)
+	return SimulateInNewEnvironmentWithContext(context.Background(), uid, fnct)
+}
+
+// SimulateInNewEnvironmentWithContext is the same as SimulateInNewEnvironment
+// except that the transaction is bound to ctx. If ctx is canceled or reaches
+// its deadline, the running query is canceled and ctx.Err() is returned.
+func SimulateInNewEnvironmentWithContext(ctx context.Context, uid int64, fnct func(Environment)) (rError error) {
+	checkNestedEnvironment(ctx, uid, false)
+	env := newEnvironment(ctx, uid)
 	defer func() {
 		env.rollback()
 		if r := recover(); r != nil {
+			if err := ctx.Err(); err != nil {
+				rError = err
+				return
+			}
 			rError = logging.LogPanicData(r)
 			return
 		}
 	}()
-	fnct(env)
+	runInEnvironment(env, fnct)
 	return
 }
 
+// checkNestedEnvironment checks whether the caller is already executing inside
+// a transaction, either because ctx is the Go context of an Environment or
+// because the current goroutine is running the function of an Environment,
+// and applies the NestedTransactions policy if so.
+//
+// It returns an Environment for the given uid in the current transaction and true
+// if this transaction must be reused. canReuse must be false if the caller cannot
+// reuse the current transaction, in which case NestedTransactionReuse policy fails.
+// The current transaction can only be reused if ctx is its Go context.
+func checkNestedEnvironment(ctx context.Context, uid int64, canReuse bool) (Environment, bool) {
+	current, ok := ctx.Value(activeEnvironmentKey{}).(Environment)
+	if !ok && !inEnvironment() {
+		return Environment{}, false
+	}
+	canReuse = canReuse && ok
+	switch {
+	case NestedTransactions == NestedTransactionReuse && canReuse:
+		log.Warn("Reusing current transaction for nested environment", "uid", uid, "stack", string(debug.Stack()))
+		env := current
+		env.uid = uid
+		env.callStack = nil
+		return env, true
+	case NestedTransactions == NestedTransactionAllow:
+		log.Warn("Opening a new transaction inside an existing one", "uid", uid, "stack", string(debug.Stack()))
+		return Environment{}, false
+	}
+	log.Panic("Opening a new transaction inside an existing one", "uid", uid, "stack", string(debug.Stack()))
+	return Environment{}, false
+}
+
+// registerEnvironment stores env in the Go context of its transaction,
+// so that environments requested with this context are detected as nested.
+func registerEnvironment(env Environment) {
+	env.cr.ctx = context.WithValue(env.cr.ctx, activeEnvironmentKey{}, env)
+}
+
+// runInEnvironment registers env and executes fnct in it. Its frame marks
+// the call stack of the goroutines executing inside a transaction, so that
+// nested environments are detected even without the Go context of env.
+//
+//go:noinline
+func runInEnvironment(env Environment, fnct func(Environment)) {
+	registerEnvironment(env)
+	fnct(env)
+}
+
+// inEnvironment returns true if the current goroutine
+// is executing the function of an Environment.
+func inEnvironment() bool {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	for n == len(pcs) {
+		pcs = make([]uintptr, 2*len(pcs))
+		n = runtime.Callers(2, pcs)
+	}
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == environmentFuncName {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
 // Pool returns an empty RecordCollection for the given modelName
 func (env Environment) Pool(modelName string) RecordCollection {
 	return newRecordCollection(env, modelName)
@@ -0,0 +1,230 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ValidationError is raised when data cannot be written to the database
+// because it does not satisfy a constraint of the model.
+// Its message is meant to be displayed to the end user.
+type ValidationError struct {
+	Model   string
+	Field   string
+	Value   string
+	Message string
+}
+
+// Error returns the message of this ValidationError
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// An AccessError is raised when the current user tries to read or write
+// a field they have no access rights on and the UnauthorizedFields
+// policy is UnauthorizedFieldsFail.
+type AccessError struct {
+	Model   string
+	Field   string
+	Message string
+}
+
+// Error returns the message of this AccessError
+func (e AccessError) Error() string {
+	return e.Message
+}
+
+// A MethodAccessError is raised when the current user is not allowed to
+// execute a method. Groups are the IDs of the groups whose members are
+// allowed to execute it from the current caller.
+type MethodAccessError struct {
+	Model  string
+	Method string
+	Groups []string
+}
+
+// Error returns the message of this MethodAccessError with the groups
+// of which the user should be a member.
+func (e MethodAccessError) Error() string {
+	return fmt.Sprintf("You are not allowed to execute method '%s' of '%s'. It requires membership of one of these groups: %s",
+		e.Method, e.Model, strings.Join(e.Groups, ", "))
+}
+
+// A QueryGuardError is raised when a query of an interactive request is
+// rejected by the ClientQueryGuard.
+type QueryGuardError struct {
+	Model   string
+	Message string
+}
+
+// Error returns the message of this QueryGuardError
+func (e QueryGuardError) Error() string {
+	return e.Message
+}
+
+// A ReadOnlyError is raised when trying to modify records in
+// a read-only Environment.
+type ReadOnlyError struct {
+	Model     string
+	Operation string
+}
+
+// Error returns the message of this ReadOnlyError
+func (e ReadOnlyError) Error() string {
+	return fmt.Sprintf("Cannot %s '%s' records in a read-only environment", e.Operation, e.Model)
+}
+
+// A ConcurrentUpdateError is raised when writing on records of a model with
+// the Concurrency option that have been modified since the client read them.
+type ConcurrentUpdateError struct {
+	Model string
+	IDs   []int64
+}
+
+// Error returns the message of this ConcurrentUpdateError
+func (e ConcurrentUpdateError) Error() string {
+	return fmt.Sprintf("The '%s' records %v have been modified by another user since you read them", e.Model, e.IDs)
+}
+
+// An ApprovalError is raised when calling a method on a record
+// before all the levels of approval it requires are approved.
+type ApprovalError struct {
+	Model   string
+	Method  string
+	ID      int64
+	Level   string
+	Refused bool
+}
+
+// Error returns the message of this ApprovalError
+func (e ApprovalError) Error() string {
+	if e.Refused {
+		return fmt.Sprintf("'%s' of %s record %d has been refused at level '%s'", e.Method, e.Model, e.ID, e.Level)
+	}
+	return fmt.Sprintf("'%s' of %s record %d waits for approval at level '%s'", e.Method, e.Model, e.ID, e.Level)
+}
+
+// A RecordSetError is raised when a RecordSet does not satisfy an
+// assertion, such as being a singleton. It holds the model and the
+// ids of the records involved.
+type RecordSetError struct {
+	Model   string
+	IDs     []int64
+	Message string
+}
+
+// Error returns the message of this RecordSetError with its model and ids
+func (e RecordSetError) Error() string {
+	return fmt.Sprintf("%s (model: %s, ids: %v)", e.Message, e.Model, e.IDs)
+}
+
+// convertDBErrors converts database integrity errors into ValidationError
+// with a message in the language of the user of rc. It is meant to be
+// deferred in functions writing to the database and re-panics with the
+// original value for any other error.
+func (rc RecordCollection) convertDBErrors() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	cv, ok := adapters[db.DriverName()].constraintViolation(r)
+	if !ok {
+		panic(r)
+	}
+	mi := constraintViolationModel(cv)
+	if mi == nil {
+		panic(r)
+	}
+	env := rc.env
+	if c := mi.sqlConstraintByDBName(cv.constraint); c != nil {
+		log.Debug("SQL constraint violation", "model", mi.name, "constraint", c.name, "error", cv.err)
+		panic(ValidationError{
+			Model:   mi.name,
+			Message: env.translate(c.errorMsg),
+		})
+	}
+	if idx := mi.sqlIndexByDBName(cv.constraint); idx != nil && cv.kind == uniqueViolation {
+		log.Debug("Unique index violation", "model", mi.name, "index", idx.name, "error", cv.err)
+		msg := env.translate(idx.options.ErrorMsg)
+		if msg == "" {
+			msg = fmt.Sprintf(env.translate("The values of fields %s are already used by another record"),
+				strings.Join(idx.fields, ", "))
+		}
+		panic(ValidationError{
+			Model:   mi.name,
+			Message: msg,
+		})
+	}
+	fi := findConstraintField(mi, cv)
+	if fi == nil {
+		panic(r)
+	}
+	vErr := ValidationError{
+		Model: mi.name,
+		Field: fi.name,
+		Value: cv.value,
+	}
+	description := env.translate(fi.description)
+	switch cv.kind {
+	case uniqueViolation:
+		vErr.Message = fmt.Sprintf(env.translate("The value '%s' of field '%s' is already used by another record"),
+			vErr.Value, description)
+	case foreignKeyViolation:
+		if cv.referenced {
+			vErr.Message = fmt.Sprintf(env.translate("This record is still referenced by field '%s' of '%s'"),
+				description, mi.name)
+		} else {
+			vErr.Message = fmt.Sprintf(env.translate("The record referenced by field '%s' does not exist"), description)
+		}
+	case notNullViolation:
+		vErr.Message = fmt.Sprintf(env.translate("Field '%s' is required"), description)
+	case checkViolation:
+		vErr.Message = fmt.Sprintf(env.translate("Invalid value for field '%s'"), description)
+	default:
+		panic(r)
+	}
+	log.Debug("Database constraint violation", "model", mi.name, "field", fi.name, "error", cv.err)
+	panic(vErr)
+}
+
+// constraintViolationModel returns the model whose table is concerned by the
+// given constraint violation, or nil if it cannot be found. If the database
+// does not report the table, it is deduced from the constraint name, which
+// is prefixed by the table name.
+func constraintViolationModel(cv dbConstraintViolation) *Model {
+	if cv.table != "" {
+		return Registry.registryByTableName[cv.table]
+	}
+	var res *Model
+	for tableName, mi := range Registry.registryByTableName {
+		if !strings.HasPrefix(cv.constraint, tableName+"_") {
+			continue
+		}
+		if res == nil || len(tableName) > len(res.tableName) {
+			res = mi
+		}
+	}
+	return res
+}
+
+// findConstraintField returns the field of the given model that is concerned by
+// the given constraint violation, or nil if it cannot be found.
+func findConstraintField(mi *Model, cv dbConstraintViolation) *Field {
+	if cv.column != "" {
+		if fi, ok := mi.fields.get(cv.column); ok {
+			return fi
+		}
+	}
+	// Constraints are named <table>_<column>_<suffix>
+	colName := strings.TrimPrefix(cv.constraint, mi.tableName+"_")
+	for _, suffix := range []string{"_key", "_fkey", "_check"} {
+		colName = strings.TrimSuffix(colName, suffix)
+	}
+	if fi, ok := mi.fields.get(colName); ok {
+		return fi
+	}
+	return nil
+}
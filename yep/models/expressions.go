@@ -0,0 +1,315 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/operator"
+	"github.com/npiganeau/yep/yep/tools/expr"
+)
+
+// exprVarNames are the names of the variables given to all expressions
+// evaluated by the ORM (see ExprVars). They shadow the fields of the record.
+var exprVarNames = []string{"uid", "user", "context"}
+
+// exprUserModel is the name of the model of the 'user' variable of expressions
+const exprUserModel = "User"
+
+// An exprRecord wraps a RecordCollection so that the values of its
+// fields can be read in expressions.
+type exprRecord struct {
+	rc RecordCollection
+}
+
+// Attr returns the value of the field with the given name or JSON name.
+// The fields of an empty record are null.
+func (r exprRecord) Attr(name string) (interface{}, error) {
+	if _, ok := r.rc.model.fields.get(name); !ok {
+		return nil, fmt.Errorf("unknown field '%s' in model '%s'", name, r.rc.model.name)
+	}
+	switch r.rc.Len() {
+	case 0:
+		return nil, nil
+	case 1:
+		return exprValue(r.rc.Get(name)), nil
+	}
+	return nil, fmt.Errorf("cannot read field '%s' of several '%s' records", name, r.rc.model.name)
+}
+
+// ExprValue returns the id of this record, null if it is empty
+// or the list of ids if there are several records.
+func (r exprRecord) ExprValue() interface{} {
+	switch r.rc.Len() {
+	case 0:
+		return nil
+	case 1:
+		return r.rc.ids[0]
+	}
+	return r.rc.Ids()
+}
+
+// exprValue returns the given field value so that
+// it can be used in expressions
+func exprValue(value interface{}) interface{} {
+	if rs, ok := value.(RecordSet); ok {
+		return exprRecord{rc: rs.Collection()}
+	}
+	return value
+}
+
+// A recordExprEnv is the environment of an expression evaluated for a record.
+// Names are first looked up in the variables, then in the fields of the record.
+type recordExprEnv struct {
+	record RecordCollection
+	vars   expr.Vars
+}
+
+// Lookup returns the value of the given name and true,
+// or false if the name is not defined.
+func (e recordExprEnv) Lookup(name string) (interface{}, bool) {
+	if val, ok := e.vars[name]; ok {
+		return val, true
+	}
+	if _, ok := e.record.model.fields.get(name); !ok {
+		return nil, false
+	}
+	// The record is a singleton or empty (see EvalExpr) so that Attr cannot fail
+	val, _ := exprRecord{rc: e.record}.Attr(name)
+	return val, true
+}
+
+// ExprVars returns the variables available in the expressions
+// evaluated in the given Environment:
+//
+//   - uid is the id of the current user,
+//   - user is the current user record, if a User model exists,
+//   - context is the map of the context of the environment.
+func ExprVars(env *Environment) expr.Vars {
+	res := expr.Vars{
+		"uid":     env.uid,
+		"context": env.context.ToMap(),
+	}
+	if _, ok := Registry.Get(exprUserModel); ok {
+		res["user"] = exprRecord{rc: env.Pool(exprUserModel).withIds([]int64{env.uid})}
+	}
+	return res
+}
+
+// EvalExpr evaluates the given expression for this record and returns its
+// result. The fields of this record can be used in the expression as well as
+// the variables returned by ExprVars, which shadow them.
+//
+// Field values are given as is, except for relation fields which are
+// records whose fields can be read, e.g. "user_id.name". Records are
+// compared by id.
+//
+// This RecordCollection must be empty or a singleton. EvalExpr panics if the
+// expression cannot be evaluated.
+func (rc RecordCollection) EvalExpr(program *expr.Program) interface{} {
+	if rc.Len() > 1 {
+		log.Panic("Expression must be evaluated on a single record", "model", rc.model.name, "expr", program)
+	}
+	res, err := program.Eval(recordExprEnv{record: rc, vars: ExprVars(rc.env)})
+	if err != nil {
+		log.Panic("Error while evaluating expression", "model", rc.model.name, "expr", program, "error", err)
+	}
+	return res
+}
+
+// CheckExpr returns an error if the given expression uses a name which is
+// neither a variable returned by ExprVars nor a valid field path of this
+// model. The field paths of the 'user' variable are checked as well.
+//
+// CheckExpr can be called before bootstrap.
+func (m *Model) CheckExpr(program *expr.Program) error {
+	for _, path := range program.Names() {
+		if msg := m.checkExprPath(path); msg != "" {
+			return fmt.Errorf("invalid expression '%s': %s", program, msg)
+		}
+	}
+	return nil
+}
+
+// checkExprPath returns a message describing why the given path of
+// an expression is not valid for this model, or an empty string if it
+// is valid.
+func (m *Model) checkExprPath(path string) string {
+	exprs := strings.SplitN(path, ExprSep, 2)
+	switch exprs[0] {
+	case "uid", "context":
+		return ""
+	case "user":
+		userModel, ok := Registry.Get(exprUserModel)
+		if !ok || len(exprs) == 1 {
+			return ""
+		}
+		return userModel.checkRelatedPath(strings.TrimSuffix(exprs[1], ExprSep+"id"))
+	}
+	return m.checkRelatedPath(strings.TrimSuffix(path, ExprSep+"id"))
+}
+
+// domainOperators are the Condition operators of the comparisons of
+// domain expressions, and reversedOperators those to use when the field
+// is on the right hand side.
+var (
+	domainOperators = map[string]operator.Operator{
+		"==":     operator.Equals,
+		"!=":     operator.NotEquals,
+		"<":      operator.Lower,
+		"<=":     operator.LowerOrEqual,
+		">":      operator.Greater,
+		">=":     operator.GreaterOrEqual,
+		"in":     operator.In,
+		"not in": operator.NotIn,
+	}
+	reversedOperators = map[string]operator.Operator{
+		"==": operator.Equals,
+		"!=": operator.NotEquals,
+		"<":  operator.Greater,
+		"<=": operator.GreaterOrEqual,
+		">":  operator.Lower,
+		">=": operator.LowerOrEqual,
+		"in": operator.Equals,
+	}
+)
+
+// A domainTranslator converts a domain expression of a
+// model into a Condition, evaluating its dynamic parts.
+type domainTranslator struct {
+	model   *Model
+	program *expr.Program
+	env     expr.Env
+}
+
+// domainCondition returns the Condition of the given domain expression on
+// the given model. Dynamic values are evaluated in the given Environment.
+//
+// A domain expression is a combination with 'and', 'or' and 'not' of
+// comparisons between a field path of the model and a value that does
+// not depend on the record, such as:
+//
+//	company_id == user.company_id.id and (state in ['draft', 'sent'] or amount < 1000)
+//
+// A field path alone is true if the field is true.
+func domainCondition(mi *Model, program *expr.Program, env *Environment) *Condition {
+	dt := domainTranslator{model: mi, program: program, env: ExprVars(env)}
+	cond, err := dt.translate(program.Root())
+	if err != nil {
+		log.Panic("Invalid domain expression", "model", mi.name, "domain", program, "error", err)
+	}
+	return cond
+}
+
+// checkDomain returns an error if the given domain expression
+// cannot be converted into a Condition for this model.
+func (m *Model) checkDomain(program *expr.Program) error {
+	if err := m.CheckExpr(program); err != nil {
+		return err
+	}
+	dt := domainTranslator{model: m, program: program}
+	_, err := dt.translate(program.Root())
+	return err
+}
+
+// translate returns the Condition of the given node. Values are only
+// evaluated if dt has an environment, so that the domain can be checked.
+func (dt domainTranslator) translate(node expr.Node) (*Condition, error) {
+	switch n := node.(type) {
+	case *expr.Binary:
+		switch n.Op {
+		case "and", "or":
+			x, err := dt.translate(n.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := dt.translate(n.Y)
+			if err != nil {
+				return nil, err
+			}
+			if n.Op == "or" {
+				return newCondition().AndCond(x).OrCond(y), nil
+			}
+			return newCondition().AndCond(x).AndCond(y), nil
+		}
+		return dt.comparison(n)
+	case *expr.Unary:
+		if n.Op == "not" {
+			x, err := dt.translate(n.X)
+			if err != nil {
+				return nil, err
+			}
+			return newCondition().AndNotCond(x), nil
+		}
+	}
+	if path, ok := dt.fieldPath(node); ok {
+		return dt.model.Field(path).Equals(true), nil
+	}
+	return nil, dt.error(node, "expected a comparison between a field and a value")
+}
+
+// comparison returns the Condition of the given comparison node
+func (dt domainTranslator) comparison(n *expr.Binary) (*Condition, error) {
+	path, op, valueNode := "", operator.Operator(""), expr.Node(nil)
+	if p, ok := dt.fieldPath(n.X); ok && !dt.dependsOnRecord(n.Y) {
+		path, op, valueNode = p, domainOperators[n.Op], n.Y
+	} else if p, ok := dt.fieldPath(n.Y); ok && !dt.dependsOnRecord(n.X) {
+		path, op, valueNode = p, reversedOperators[n.Op], n.X
+	}
+	if path == "" || op == "" {
+		return nil, dt.error(n, "expected a comparison between a field and a value")
+	}
+	if dt.env == nil {
+		return dt.model.Field(path).AddOperator(op, nil), nil
+	}
+	value, err := expr.Eval(dt.program.String(), valueNode, dt.env)
+	if err != nil {
+		return nil, err
+	}
+	return dt.model.Field(path).AddOperator(op, expr.Value(value)), nil
+}
+
+// fieldPath returns the field path of the given node and true if it is a
+// field path of the record, such as company_id.name. A trailing ".id" is
+// removed from the path.
+func (dt domainTranslator) fieldPath(node expr.Node) (string, bool) {
+	path, ok := expr.PathOf(node)
+	if !ok || dt.isVariable(path) {
+		return "", false
+	}
+	return strings.TrimSuffix(path, ExprSep+"id"), true
+}
+
+// dependsOnRecord returns true if the given node uses a field of the record
+func (dt domainTranslator) dependsOnRecord(node expr.Node) bool {
+	var res bool
+	expr.Walk(node, func(n expr.Node) bool {
+		if path, ok := expr.PathOf(n); ok {
+			res = res || !dt.isVariable(path)
+			return false
+		}
+		return true
+	})
+	return res
+}
+
+// isVariable returns true if the given path starts with a variable name
+func (dt domainTranslator) isVariable(path string) bool {
+	name := strings.SplitN(path, ExprSep, 2)[0]
+	for _, v := range exprVarNames {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
+
+// error returns an expression error at the position of the given node
+func (dt domainTranslator) error(node expr.Node, msg string) error {
+	return &expr.Error{Source: dt.program.String(), Offset: node.Pos(), Msg: msg}
+}
+
+var _ expr.Object = exprRecord{}
+var _ expr.Valuer = exprRecord{}
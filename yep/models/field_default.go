@@ -0,0 +1,49 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+// A fieldDefaultLine is a default value of a field
+// declared in a data file as stored in the database.
+type fieldDefaultLine struct {
+	Field string
+	Value string
+}
+
+// declareFieldDefaultModel creates the system model in which the
+// default values of fields declared in data files are stored.
+func declareFieldDefaultModel() {
+	fieldDefault := createModel("FieldDefault", SystemModel)
+	fieldDefault.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	fieldDefault.AddCharField("Field", StringFieldParams{JSON: "field", Required: true})
+	fieldDefault.AddTextField("Value", StringFieldParams{JSON: "value"})
+	fieldDefault.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// setDataDefault sets value as the default value of the field fi
+// of this RecordCollection's model.
+func (rc RecordCollection) setDataDefault(fi *Field, value interface{}) {
+	delQuery := `DELETE FROM field_default WHERE res_model = ? AND field = ?`
+	rc.env.Cr().Execute(delQuery, rc.model.name, fi.json)
+	insQuery := `INSERT INTO field_default (res_model, field, value) VALUES (?, ?, ?)`
+	rc.env.Cr().Execute(insQuery, rc.model.name, fi.json, encodeFieldValue(value))
+}
+
+// dataDefaults returns the default values of the fields of this
+// RecordCollection's model that have been declared in data files,
+// with field names as keys.
+func (rc RecordCollection) dataDefaults() FieldMap {
+	var lines []fieldDefaultLine
+	query := `SELECT field, value FROM field_default WHERE res_model = ?`
+	rc.env.Cr().Select(&lines, query, rc.model.name)
+	res := make(FieldMap)
+	for _, line := range lines {
+		fi, ok := rc.model.fields.get(line.Field)
+		if !ok {
+			// The field has been removed since the data file was loaded
+			continue
+		}
+		res[fi.name] = rc.model.decodeFieldValue(fi, line.Value)
+	}
+	return res
+}
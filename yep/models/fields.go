@@ -22,6 +22,7 @@ import (
 	"github.com/npiganeau/yep/yep/models/fieldtype"
 	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/parallel"
 	"github.com/npiganeau/yep/yep/tools/strutils"
 )
 
@@ -73,6 +74,13 @@ func (fc *FieldsCollection) get(name string) (fi *Field, ok bool) {
 	return
 }
 
+// Get returns the Field of the field with the given name.
+// name can be either the name of the field or its JSON name.
+// The second returned value is false if there is no such field.
+func (fc *FieldsCollection) Get(name string) (*Field, bool) {
+	return fc.get(name)
+}
+
 // MustGet returns the Field of the field with the given name or panics
 // name can be either the name of the field or its JSON name.
 func (fc *FieldsCollection) MustGet(name string) *Field {
@@ -83,6 +91,17 @@ func (fc *FieldsCollection) MustGet(name string) *Field {
 	return fi
 }
 
+// propertyFields returns the property fields of this collection
+func (fc *FieldsCollection) propertyFields() []*Field {
+	var res []*Field
+	for _, fi := range fc.registryByName {
+		if fi.isPropertyField() {
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
 // storedFieldNames returns a slice with the names of all the stored fields
 // If fields are given, return only names in the list
 func (fc *FieldsCollection) storedFieldNames(fieldNames ...string) []string {
@@ -200,37 +219,59 @@ func (fc *FieldsCollection) register(fInfo *Field) {
 
 // Field holds the meta information about a field
 type Field struct {
-	model            *Model
-	acl              *security.AccessControlList
-	name             string
-	json             string
-	description      string
-	help             string
-	stored           bool
-	required         bool
-	unique           bool
-	index            bool
-	compute          string
-	depends          []string
-	relatedModelName string
-	relatedModel     *Model
-	reverseFK        string
-	m2mRelModel      *Model
-	m2mOurField      *Field
-	m2mTheirField    *Field
-	selection        types.Selection
-	fieldType        fieldtype.Type
-	groupOperator    string
-	size             int
-	digits           types.Digits
-	structField      reflect.StructField
-	relatedPath      string
-	dependencies     []computeData
-	embed            bool
-	noCopy           bool
-	defaultFunc      func(Environment, FieldMap) interface{}
-	onDelete         OnDeleteAction
-	translate        bool
+	model               *Model
+	acl                 *security.AccessControlList
+	name                string
+	json                string
+	description         string
+	help                string
+	stored              bool
+	required            bool
+	unique              bool
+	index               bool
+	compute             string
+	depends             []string
+	relatedModelName    string
+	relatedModel        *Model
+	reverseFK           string
+	m2mRelModel         *Model
+	m2mOurField         *Field
+	m2mTheirField       *Field
+	selection           types.Selection
+	selectionOptions    types.SelectionOptions
+	selectionFunc       string
+	selectionCheck      bool
+	selectionMigrations map[string]string
+	fieldType           fieldtype.Type
+	groupOperator       string
+	size                int
+	digits              types.Digits
+	structField         reflect.StructField
+	relatedPath         string
+	dependencies        []computeData
+	embed               bool
+	noCopy              bool
+	defaultFunc         func(Environment, FieldMap) interface{}
+	defaultDepends      []string
+	onChange            string
+	constraint          string
+	onDelete            OnDeleteAction
+	translate           bool
+	audited             bool
+	trackVisibility     TrackVisibility
+	contexts            []string
+	attachment          bool
+	currencyField       string
+	groups              []string
+	sensitive           bool
+	encrypted           EncryptionMode
+	previousName        string
+	activeTest          bool
+	taxID               bool
+	bankFormat          bankFormat
+	unmaskedGroups      []string
+	autoNow             bool
+	autoNowAdd          bool
 }
 
 // isComputedField returns true if this field is computed
@@ -243,6 +284,35 @@ func (f *Field) isRelatedField() bool {
 	return f.relatedPath != ""
 }
 
+// HasOnChange returns true if this field has an OnChange method
+// that must be called when its value is modified in the client.
+func (f *Field) HasOnChange() bool {
+	return f.onChange != ""
+}
+
+// constraintMethods returns the names of the constraint methods
+// to run when one of the given fields is modified. fieldNames
+// can be either field names or JSON names.
+func (fc *FieldsCollection) constraintMethods(fieldNames []string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, fName := range fieldNames {
+		fi, ok := fc.get(fName)
+		if !ok || fi.constraint == "" || seen[fi.constraint] {
+			continue
+		}
+		seen[fi.constraint] = true
+		res = append(res, fi.constraint)
+	}
+	return res
+}
+
+// isUnique returns true if this field's values must be unique.
+// This is always the case for one2one fields.
+func (f *Field) isUnique() bool {
+	return f.unique || f.fieldType == fieldtype.One2One
+}
+
 // isRelationField returns true if this field points to another model
 func (f *Field) isRelationField() bool {
 	// We check on relatedModelName and not relatedModel to be able
@@ -250,12 +320,44 @@ func (f *Field) isRelationField() bool {
 	return f.relatedModelName != ""
 }
 
+// options returns the ordered options of this selection field.
+// Options are sorted by value if no order has been declared.
+func (f *Field) options() types.SelectionOptions {
+	if len(f.selectionOptions) > 0 {
+		return f.selectionOptions
+	}
+	return f.selection.Options()
+}
+
+// selectionValues returns the allowed values of this selection field
+// in the given Environment, calling its selection method if any.
+func (f *Field) selectionValues(env Environment) types.Selection {
+	if f.selectionFunc != "" {
+		return env.Pool(f.model.name).Call(f.selectionFunc).(types.Selection)
+	}
+	return f.selection
+}
+
+// isPropertyField returns true if this field's values are stored
+// as properties depending on context keys
+func (f *Field) isPropertyField() bool {
+	return len(f.contexts) > 0
+}
+
 // isStored returns true if this field is stored in database
 func (f *Field) isStored() bool {
 	if f.fieldType.IsNonStoredRelationType() {
 		// reverse fields are not stored
 		return false
 	}
+	if f.isPropertyField() {
+		// property fields are stored in the property table
+		return false
+	}
+	if f.isAttachmentField() {
+		// attachment fields are stored in the AttachmentStore
+		return false
+	}
 	if (f.isComputedField() || f.isRelatedField()) && !f.stored {
 		// Computed and related non stored fields are not stored
 		return false
@@ -305,6 +407,7 @@ func snakeCaseFieldName(fName string, typ fieldtype.Type) string {
 // for the m2m relation defined between model1 and model2.
 // It returns the Model of the intermediate model, the Field of that model
 // pointing to our model, and the Field pointing to the other model.
+// The table name of the model is shortened if it is too long for the database.
 func createM2MRelModelInfo(relModelName, model1, model2 string) (*Model, *Field, *Field) {
 	if relMI, exists := Registry.Get(relModelName); exists {
 		var m1, m2 *Field
@@ -319,12 +422,15 @@ func createM2MRelModelInfo(relModelName, model1, model2 string) (*Model, *Field,
 	}
 
 	newMI := &Model{
-		name:      relModelName,
-		acl:       security.NewAccessControlList(),
-		tableName: strutils.SnakeCaseString(relModelName),
-		fields:    newFieldsCollection(),
-		methods:   newMethodsCollection(),
-		options:   Many2ManyLinkModel,
+		name:           relModelName,
+		acl:            security.NewAccessControlList(),
+		tableName:      dbIdentifier(strutils.SnakeCaseString(relModelName)),
+		fields:         newFieldsCollection(),
+		methods:        newMethodsCollection(),
+		options:        Many2ManyLinkModel,
+		rulesRegistry:  newRecordRuleRegistry(),
+		sqlConstraints: make(map[string]*sqlConstraint),
+		sqlIndexes:     make(map[string]*sqlIndex),
 	}
 	ourField := &Field{
 		name:             model1,
@@ -367,27 +473,147 @@ func createM2MRelModelInfo(relModelName, model1, model2 string) (*Model, *Field,
 
 // processDepends populates the dependencies of each Field from the depends strings of
 // each Field instances.
+//
+// For a depends string such as "Lines.Product.Price", a dependency is added to
+// each field of the path (i.e. Price, Product and Lines) so that changing the
+// relation itself triggers the recomputation. When the path goes through a
+// one2many field, a dependency is also added to the reverse foreign key field
+// of the related model, so that moving a line from a parent to another one
+// triggers the recomputation of both parents.
 func processDepends() {
-	for _, mi := range Registry.registryByTableName {
-		for _, fInfo := range mi.fields.registryByJSON {
-			var refName string
-			for _, depString := range fInfo.depends {
-				if depString != "" {
-					tokens := jsonizeExpr(mi, strings.Split(depString, ExprSep))
-					refName = tokens[len(tokens)-1]
-					path := strings.Join(tokens[:len(tokens)-1], ExprSep)
-					targetComputeData := computeData{
-						modelInfo: mi,
+	models := Registry.all()
+	// Dependencies are resolved concurrently for each model, but added
+	// sequentially since they are set on the fields of other models.
+	deps := make([][]fieldDependency, len(models))
+	parallel.Run(len(models), func(i int) {
+		deps[i] = models[i].fieldDependencies()
+	})
+	for _, modelDeps := range deps {
+		for _, dep := range modelDeps {
+			dep.field.addDependency(dep.data)
+		}
+	}
+}
+
+// A fieldDependency is a computeData to add to the dependencies of a field
+type fieldDependency struct {
+	field *Field
+	data  computeData
+}
+
+// fieldDependencies returns the dependencies to add to the fields of all
+// models from the depends strings of the fields of this model.
+func (m *Model) fieldDependencies() []fieldDependency {
+	var res []fieldDependency
+	for _, fInfo := range m.fields.registryByJSON {
+		for _, depString := range fInfo.depends {
+			if depString == "" {
+				continue
+			}
+			tokens := jsonizeExpr(m, strings.Split(depString, ExprSep))
+			for i := range tokens {
+				path := strings.Join(tokens[:i], ExprSep)
+				refModelInfo := m.getRelatedModelInfo(path)
+				refField := refModelInfo.fields.MustGet(tokens[i])
+				res = append(res, fieldDependency{
+					field: refField,
+					data: computeData{
+						modelInfo: m,
 						compute:   fInfo.compute,
 						path:      path,
-					}
-					refModelInfo := mi.getRelatedModelInfo(path)
-					refField := refModelInfo.fields.MustGet(refName)
-					refField.dependencies = append(refField.dependencies, targetComputeData)
+					},
+				})
+				if i == len(tokens)-1 || refField.fieldType != fieldtype.One2Many {
+					continue
 				}
+				reverseField := refField.relatedModel.fields.MustGet(refField.reverseFK)
+				res = append(res, fieldDependency{
+					field: reverseField,
+					data: computeData{
+						modelInfo: m,
+						compute:   fInfo.compute,
+						path:      strings.Join(tokens[:i+1], ExprSep),
+					},
+				})
 			}
 		}
 	}
+	return res
+}
+
+// addDependency adds the given computeData to the dependencies of this field
+// if it is not already present.
+func (f *Field) addDependency(cData computeData) {
+	for _, dep := range f.dependencies {
+		if dep == cData {
+			return
+		}
+	}
+	f.dependencies = append(f.dependencies, cData)
+}
+
+// A computeKey identifies a compute method of a model
+type computeKey struct {
+	modelInfo *Model
+	compute   string
+}
+
+// computeRanks holds the rank of each compute method in the topological
+// order of the dependency graph of computed fields. A compute method has a
+// higher rank than all the compute methods of the fields it depends on.
+var computeRanks map[computeKey]int
+
+// sortComputeMethods sets the computeRanks of all compute methods from the
+// dependencies of the fields. It panics if there is a circular dependency
+// between computed fields.
+//
+// processDepends must have been run before calling this function.
+func sortComputeMethods() {
+	graph := make(map[computeKey][]computeKey)
+	for _, mi := range Registry.registryByName {
+		for _, fi := range mi.fields.registryByName {
+			if !fi.isComputedField() {
+				continue
+			}
+			src := computeKey{modelInfo: mi, compute: fi.compute}
+			if _, exists := graph[src]; !exists {
+				graph[src] = nil
+			}
+			for _, cData := range fi.dependencies {
+				graph[src] = append(graph[src], computeKey{modelInfo: cData.modelInfo, compute: cData.compute})
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[computeKey]int)
+	var order []computeKey
+	var visit func(key computeKey)
+	visit = func(key computeKey) {
+		switch state[key] {
+		case visiting:
+			log.Panic("Circular dependency between computed fields", "model", key.modelInfo.name, "method", key.compute)
+		case visited:
+			return
+		}
+		state[key] = visiting
+		for _, next := range graph[key] {
+			visit(next)
+		}
+		state[key] = visited
+		order = append(order, key)
+	}
+	for key := range graph {
+		visit(key)
+	}
+	computeRanks = make(map[computeKey]int)
+	for i, key := range order {
+		// order is a reversed topological order
+		computeRanks[key] = len(order) - i
+	}
 }
 
 // checkComputeMethodsSignature checks all methods used in computed
@@ -425,3 +651,59 @@ func checkComputeMethodsSignature() {
 		}
 	}
 }
+
+// checkOnChangeMethodsSignature checks all methods used as OnChange
+// of fields and check their signature. It panics if it is not the case.
+func checkOnChangeMethodsSignature() {
+	fMapType := reflect.TypeOf(FieldMap{})
+	for _, mi := range Registry.registryByName {
+		for _, fi := range mi.fields.registryByName {
+			if fi.onChange == "" {
+				continue
+			}
+			method := mi.methods.MustGet(fi.onChange)
+			methType := method.methodType
+			if methType.NumIn() != 2 || methType.In(1) != fMapType || methType.NumOut() != 1 || methType.Out(0) != fMapType {
+				log.Panic("OnChange methods should take a models.FieldMap as argument and return a models.FieldMap",
+					"model", mi.name, "field", fi.name, "method", method.name)
+			}
+		}
+	}
+}
+
+// checkConstraintMethodsSignature checks all methods used as Constraint
+// of fields and check their signature. It panics if it is not the case.
+func checkConstraintMethodsSignature() {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	for _, mi := range Registry.registryByName {
+		for _, fi := range mi.fields.registryByName {
+			if fi.constraint == "" {
+				continue
+			}
+			method := mi.methods.MustGet(fi.constraint)
+			methType := method.methodType
+			if methType.NumIn() != 1 || methType.NumOut() != 1 || methType.Out(0) != errorType {
+				log.Panic("Constraint methods should have no arguments and return an error",
+					"model", mi.name, "field", fi.name, "method", method.name)
+			}
+		}
+	}
+}
+
+// checkSelectionMethodsSignature checks all methods used as SelectionFunc
+// of selection fields and check their signature. It panics if it is not the case.
+func checkSelectionMethodsSignature() {
+	for _, mi := range Registry.registryByName {
+		for _, fi := range mi.fields.registryByName {
+			if fi.selectionFunc == "" {
+				continue
+			}
+			method := mi.methods.MustGet(fi.selectionFunc)
+			methType := method.methodType
+			if methType.NumIn() != 1 || methType.NumOut() != 1 || methType.Out(0) != reflect.TypeOf(types.Selection{}) {
+				log.Panic("Selection methods should have no arguments and return a types.Selection",
+					"model", mi.name, "field", fi.name, "method", method.name)
+			}
+		}
+	}
+}
@@ -31,6 +31,13 @@ type SimpleFieldParams struct {
 	GoType        interface{}
 	Translate     bool
 	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
+	Contexts      []string
+	AutoNow       bool
+	AutoNowAdd    bool
 }
 
 // A FloatFieldParams holds all the possible options for a float field
@@ -51,6 +58,36 @@ type FloatFieldParams struct {
 	GoType        interface{}
 	Translate     bool
 	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
+	Contexts      []string
+}
+
+// A MonetaryFieldParams holds all the possible options for a monetary field
+type MonetaryFieldParams struct {
+	JSON          string
+	String        string
+	Help          string
+	Stored        bool
+	Required      bool
+	Unique        bool
+	Index         bool
+	Compute       string
+	Depends       []string
+	Related       string
+	GroupOperator string
+	NoCopy        bool
+	CurrencyField string
+	GoType        interface{}
+	Translate     bool
+	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
+	Contexts      []string
 }
 
 // A StringFieldParams holds all the possible options for a string field
@@ -71,24 +108,38 @@ type StringFieldParams struct {
 	GoType        interface{}
 	Translate     bool
 	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
+	Contexts      []string
+	Encrypted     EncryptionMode
 }
 
 // A SelectionFieldParams holds all the possible options for a selection field
 type SelectionFieldParams struct {
-	JSON      string
-	String    string
-	Help      string
-	Stored    bool
-	Required  bool
-	Unique    bool
-	Index     bool
-	Compute   string
-	Depends   []string
-	Related   string
-	NoCopy    bool
-	Selection types.Selection
-	Translate bool
-	Default   func(Environment, FieldMap) interface{}
+	JSON            string
+	String          string
+	Help            string
+	Stored          bool
+	Required        bool
+	Unique          bool
+	Index           bool
+	Compute         string
+	Depends         []string
+	Related         string
+	NoCopy          bool
+	Selection       types.Selection
+	Options         types.SelectionOptions
+	SelectionFunc   string
+	CheckConstraint bool
+	Translate       bool
+	Default         func(Environment, FieldMap) interface{}
+	OnChange        string
+	Constraint      string
+	Groups          []string
+	Sensitive       bool
+	Contexts        []string
 }
 
 // A ForeignKeyFieldParams holds all the possible options for a many2one or one2one field
@@ -108,6 +159,11 @@ type ForeignKeyFieldParams struct {
 	Translate     bool
 	OnDelete      OnDeleteAction
 	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
+	Contexts      []string
 }
 
 // A ReverseFieldParams holds all the possible options for a one2many or rev2one field
@@ -126,6 +182,10 @@ type ReverseFieldParams struct {
 	ReverseFK     string
 	Translate     bool
 	Default       func(Environment, FieldMap) interface{}
+	OnChange      string
+	Constraint    string
+	Groups        []string
+	Sensitive     bool
 }
 
 // A Many2ManyFieldParams holds all the possible options for a many2many field
@@ -146,6 +206,10 @@ type Many2ManyFieldParams struct {
 	M2MTheirField    string
 	Translate        bool
 	Default          func(Environment, FieldMap) interface{}
+	OnChange         string
+	Constraint       string
+	Groups           []string
+	Sensitive        bool
 }
 
 // getJSONAndString computes the default json and description fields for the
@@ -190,8 +254,19 @@ func (m *Model) addSimpleField(name string, params SimpleFieldParams, fieldType
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   params.Default,
+		onChange:      params.OnChange,
+		constraint:    params.Constraint,
+		groups:        params.Groups,
+		sensitive:     params.Sensitive,
+		contexts:      params.Contexts,
 		translate:     params.Translate,
 	}
+	if params.AutoNow {
+		fInfo.SetAutoNow(true)
+	}
+	if params.AutoNowAdd {
+		fInfo.SetAutoNowAdd(true)
+	}
 	m.fields.add(fInfo)
 	return fInfo
 }
@@ -226,7 +301,13 @@ func (m *Model) addStringField(name string, params StringFieldParams, fieldType
 		size:          params.Size,
 		fieldType:     fieldType,
 		defaultFunc:   params.Default,
+		onChange:      params.OnChange,
+		constraint:    params.Constraint,
+		groups:        params.Groups,
+		sensitive:     params.Sensitive,
+		contexts:      params.Contexts,
 		translate:     params.Translate,
+		encrypted:     params.Encrypted,
 	}
 	m.fields.add(fInfo)
 	return fInfo
@@ -270,6 +351,11 @@ func (m *Model) addForeignKeyField(name string, params ForeignKeyFieldParams, fi
 		fieldType:        fieldType,
 		onDelete:         onDelete,
 		defaultFunc:      params.Default,
+		onChange:         params.OnChange,
+		constraint:       params.Constraint,
+		groups:           params.Groups,
+		sensitive:        params.Sensitive,
+		contexts:         params.Contexts,
 		translate:        params.Translate,
 	}
 	m.fields.add(fInfo)
@@ -302,6 +388,10 @@ func (m *Model) addReverseField(name string, params ReverseFieldParams, fieldTyp
 		reverseFK:        params.ReverseFK,
 		fieldType:        fieldType,
 		defaultFunc:      params.Default,
+		onChange:         params.OnChange,
+		constraint:       params.Constraint,
+		groups:           params.Groups,
+		sensitive:        params.Sensitive,
 		translate:        params.Translate,
 	}
 	m.fields.add(fInfo)
@@ -370,6 +460,58 @@ func (m *Model) AddFloatField(name string, params FloatFieldParams) *Field {
 		digits:        params.Digits,
 		fieldType:     fieldtype.Float,
 		defaultFunc:   params.Default,
+		onChange:      params.OnChange,
+		constraint:    params.Constraint,
+		groups:        params.Groups,
+		sensitive:     params.Sensitive,
+		contexts:      params.Contexts,
+		translate:     params.Translate,
+	}
+	m.fields.add(fInfo)
+	return fInfo
+}
+
+// AddMonetaryField adds a monetary field with the given name to this Model.
+// Monetary fields are mapped to go float64 type and stored as numeric in database.
+//
+// The currency of the amount is given by the many2one field CurrencyField
+// (defaults to "Currency"). Values are rounded on write with the number of
+// decimal places of this currency.
+func (m *Model) AddMonetaryField(name string, params MonetaryFieldParams) *Field {
+	typ := reflect.TypeOf(*new(float64))
+	if params.GoType != nil {
+		typ = reflect.TypeOf(params.GoType).Elem()
+	}
+	structField := reflect.StructField{
+		Name: name,
+		Type: typ,
+	}
+	json, str := getJSONAndString(name, fieldtype.Monetary, params.JSON, params.String)
+	fInfo := &Field{
+		model:         m,
+		acl:           security.NewAccessControlList(),
+		name:          name,
+		json:          json,
+		description:   str,
+		help:          params.Help,
+		stored:        params.Stored,
+		required:      params.Required,
+		unique:        params.Unique,
+		index:         params.Index,
+		compute:       params.Compute,
+		depends:       params.Depends,
+		relatedPath:   params.Related,
+		groupOperator: strutils.GetDefaultString(params.GroupOperator, "sum"),
+		noCopy:        params.NoCopy,
+		structField:   structField,
+		currencyField: strutils.GetDefaultString(params.CurrencyField, defaultCurrencyField),
+		fieldType:     fieldtype.Monetary,
+		defaultFunc:   params.Default,
+		onChange:      params.OnChange,
+		constraint:    params.Constraint,
+		groups:        params.Groups,
+		sensitive:     params.Sensitive,
+		contexts:      params.Contexts,
 		translate:     params.Translate,
 	}
 	m.fields.add(fInfo)
@@ -437,6 +579,10 @@ func (m *Model) AddMany2ManyField(name string, params Many2ManyFieldParams) *Fie
 		m2mTheirField:    m2mTheirField,
 		fieldType:        fieldtype.Many2Many,
 		defaultFunc:      params.Default,
+		onChange:         params.OnChange,
+		constraint:       params.Constraint,
+		groups:           params.Groups,
+		sensitive:        params.Sensitive,
 		translate:        params.Translate,
 	}
 	m.fields.add(fInfo)
@@ -457,6 +603,8 @@ func (m *Model) AddOne2ManyField(name string, params ReverseFieldParams) *Field
 func (m *Model) AddOne2OneField(name string, params ForeignKeyFieldParams) *Field {
 	fInfo := m.addForeignKeyField(name, params, fieldtype.One2One, reflect.TypeOf(*new(int64)))
 	fInfo.unique = true
+	// Copying the value would break uniqueness
+	fInfo.noCopy = true
 	return fInfo
 }
 
@@ -472,26 +620,44 @@ func (m *Model) AddSelectionField(name string, params SelectionFieldParams) *Fie
 		Type: reflect.TypeOf(*new(types.Selection)),
 	}
 	json, str := getJSONAndString(name, fieldtype.Float, params.JSON, params.String)
+	selection := params.Selection
+	if len(params.Options) > 0 {
+		if len(params.Selection) > 0 {
+			log.Panic("Selection and Options parameters cannot be both set", "model", m.name, "field", name)
+		}
+		selection = params.Options.Selection()
+	}
+	if params.SelectionFunc != "" && len(selection) > 0 {
+		log.Panic("SelectionFunc cannot be set with Selection or Options parameters", "model", m.name, "field", name)
+	}
 	fInfo := &Field{
-		model:       m,
-		acl:         security.NewAccessControlList(),
-		name:        name,
-		json:        json,
-		description: str,
-		help:        params.Help,
-		stored:      params.Stored,
-		required:    params.Required,
-		unique:      params.Unique,
-		index:       params.Index,
-		compute:     params.Compute,
-		depends:     params.Depends,
-		relatedPath: params.Related,
-		noCopy:      params.NoCopy,
-		structField: structField,
-		selection:   params.Selection,
-		fieldType:   fieldtype.Selection,
-		defaultFunc: params.Default,
-		translate:   params.Translate,
+		model:            m,
+		acl:              security.NewAccessControlList(),
+		name:             name,
+		json:             json,
+		description:      str,
+		help:             params.Help,
+		stored:           params.Stored,
+		required:         params.Required,
+		unique:           params.Unique,
+		index:            params.Index,
+		compute:          params.Compute,
+		depends:          params.Depends,
+		relatedPath:      params.Related,
+		noCopy:           params.NoCopy,
+		structField:      structField,
+		selection:        selection,
+		selectionOptions: params.Options,
+		selectionFunc:    params.SelectionFunc,
+		selectionCheck:   params.CheckConstraint,
+		fieldType:        fieldtype.Selection,
+		defaultFunc:      params.Default,
+		onChange:         params.OnChange,
+		constraint:       params.Constraint,
+		groups:           params.Groups,
+		sensitive:        params.Sensitive,
+		contexts:         params.Contexts,
+		translate:        params.Translate,
 	}
 	m.fields.add(fInfo)
 	return fInfo
@@ -576,8 +742,188 @@ func (f *Field) SetTranslate(value bool) *Field {
 	return f
 }
 
+// SetAudited sets whether the modifications of this Field are recorded in
+// the audit trail. Only stored fields that are not one2many or many2many
+// fields can be audited.
+//
+// SetAudited(true) is the same as SetTrackVisibility(TrackOnChange).
+func (f *Field) SetAudited(value bool) *Field {
+	if value {
+		return f.SetTrackVisibility(TrackOnChange)
+	}
+	return f.SetTrackVisibility(TrackNone)
+}
+
+// SetTrackVisibility sets how the modifications of this Field are recorded
+// in the audit trail. Fields are audited unless value is TrackNone.
+func (f *Field) SetTrackVisibility(value TrackVisibility) *Field {
+	switch value {
+	case TrackNone, TrackOnChange, TrackAlways:
+	default:
+		log.Panic("Unknown track visibility", "model", f.model.name, "field", f.name, "value", value)
+	}
+	if value != TrackNone && f.fieldType.Is2ManyRelationType() {
+		log.Panic("Only fields with a column in the database can be audited", "model", f.model.name, "field", f.name)
+	}
+	f.audited = value != TrackNone
+	f.trackVisibility = value
+	return f
+}
+
+// SetDefaultDepends sets the fields whose default values must be computed
+// before the default value of this Field. The default function of this Field
+// will receive these values in its FieldMap argument.
+func (f *Field) SetDefaultDepends(value []string) *Field {
+	f.defaultDepends = value
+	return f
+}
+
+// SetPropertyKey makes this Field a property field, whose value depends on
+// the value of the given context key (e.g. "company_id") instead of being
+// stored in a column of the model's table. Property fields cannot be
+// one2many or many2many fields.
+func (f *Field) SetPropertyKey(key string) *Field {
+	return f.SetContexts([]string{key})
+}
+
+// SetContexts overrides the value of the Contexts parameter of this Field.
+// If not empty, this Field is a property field whose value depends on the
+// values of all the given context keys (e.g. "company_id" and "date").
+func (f *Field) SetContexts(keys []string) *Field {
+	if len(keys) > 0 && f.fieldType.Is2ManyRelationType() {
+		log.Panic("x2many fields cannot be property fields", "model", f.model.name, "field", f.name)
+	}
+	f.contexts = keys
+	return f
+}
+
+// SetAttachment overrides the value of the Attachment parameter of this Field.
+// If true, the values of this binary field are stored in the AttachmentStore
+// instead of a column of the model's table.
+func (f *Field) SetAttachment(value bool) *Field {
+	if f.fieldType != fieldtype.Binary {
+		log.Panic("Only binary fields can be stored as attachments", "model", f.model.name, "field", f.name)
+	}
+	f.attachment = value
+	return f
+}
+
+// SetCurrencyField overrides the value of the CurrencyField parameter of this Field
+func (f *Field) SetCurrencyField(value string) *Field {
+	if f.fieldType != fieldtype.Monetary {
+		log.Panic("Only monetary fields can have a currency field", "model", f.model.name, "field", f.name)
+	}
+	f.currencyField = value
+	return f
+}
+
+// SetAutoNow overrides the value of the AutoNow parameter of this Field.
+// Date and datetime fields with AutoNow are set to the current date or time
+// each time their record is created or modified.
+func (f *Field) SetAutoNow(value bool) *Field {
+	if f.fieldType != fieldtype.Date && f.fieldType != fieldtype.DateTime {
+		log.Panic("Only date and datetime fields can be set automatically", "model", f.model.name, "field", f.name)
+	}
+	f.autoNow = value
+	return f
+}
+
+// SetAutoNowAdd overrides the value of the AutoNowAdd parameter of this Field.
+// Date and datetime fields with AutoNowAdd are set to the current date or time
+// when their record is created and cannot be modified afterwards.
+func (f *Field) SetAutoNowAdd(value bool) *Field {
+	if f.fieldType != fieldtype.Date && f.fieldType != fieldtype.DateTime {
+		log.Panic("Only date and datetime fields can be set automatically", "model", f.model.name, "field", f.name)
+	}
+	f.autoNowAdd = value
+	return f
+}
+
+// SetGroups overrides the value of the Groups parameter of this Field.
+// If set, only the members of the groups with the given IDs can read or
+// write this Field.
+func (f *Field) SetGroups(value []string) *Field {
+	f.groups = value
+	return f
+}
+
+// SetSensitive overrides the value of the Sensitive parameter of this Field.
+// Values of sensitive fields are masked in SQL logs, panic messages and in the
+// audit trail shown to non administrators.
+func (f *Field) SetSensitive(value bool) *Field {
+	f.sensitive = value
+	return f
+}
+
+// SetEncrypted overrides the value of the Encrypted parameter of this Field.
+// Only char, text and HTML fields can be encrypted.
+func (f *Field) SetEncrypted(value EncryptionMode) *Field {
+	switch f.fieldType {
+	case fieldtype.Char, fieldtype.Text, fieldtype.HTML:
+	default:
+		log.Panic("Only char, text and HTML fields can be encrypted", "model", f.model.name, "field", f.name)
+	}
+	f.encrypted = value
+	return f
+}
+
+// SetConstraint overrides the value of the Constraint parameter of this Field
+func (f *Field) SetConstraint(value string) *Field {
+	f.constraint = value
+	return f
+}
+
+// SetOnChange overrides the value of the OnChange parameter of this Field
+func (f *Field) SetOnChange(value string) *Field {
+	f.onChange = value
+	return f
+}
+
 // SetDefault overrides the value of the Default parameter of this Field
 func (f *Field) SetDefault(value func(Environment, FieldMap) interface{}) *Field {
 	f.defaultFunc = value
 	return f
 }
+
+// SetSelection overrides the value of the Selection parameter of this Field.
+// It removes the declared order of the options, if any.
+func (f *Field) SetSelection(value types.Selection) *Field {
+	f.selection = value
+	f.selectionOptions = nil
+	f.selectionFunc = ""
+	return f
+}
+
+// SetSelectionOptions overrides the value of the Options parameter of this Field
+func (f *Field) SetSelectionOptions(value types.SelectionOptions) *Field {
+	f.selection = value.Selection()
+	f.selectionOptions = value
+	f.selectionFunc = ""
+	return f
+}
+
+// SetSelectionFunc overrides the value of the SelectionFunc parameter of this Field
+func (f *Field) SetSelectionFunc(value string) *Field {
+	f.selection = nil
+	f.selectionOptions = nil
+	f.selectionFunc = value
+	return f
+}
+
+// SetCheckConstraint overrides the value of the CheckConstraint parameter of this Field
+func (f *Field) SetCheckConstraint(value bool) *Field {
+	f.selectionCheck = value
+	return f
+}
+
+// MigrateSelectionValue registers a migration of the existing oldValue of this
+// selection field in database to newValue. Migrations are applied at database
+// synchronization, so that removing or renaming an option in a module update
+// does not leave orphan values. Use an empty newValue to unset orphan values.
+func (f *Field) MigrateSelectionValue(oldValue, newValue string) *Field {
+	if f.selectionMigrations == nil {
+		f.selectionMigrations = make(map[string]string)
+	}
+	f.selectionMigrations[oldValue] = newValue
+	return f
+}
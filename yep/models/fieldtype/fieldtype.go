@@ -25,6 +25,7 @@ const (
 	Integer   Type = "integer"
 	Many2Many Type = "many2many"
 	Many2One  Type = "many2one"
+	Monetary  Type = "monetary"
 	One2Many  Type = "one2many"
 	One2One   Type = "one2one"
 	Rev2One   Type = "rev2one"
@@ -81,7 +82,7 @@ func (t Type) DefaultGoType() reflect.Type {
 		return reflect.TypeOf(*new(types.Date))
 	case DateTime:
 		return reflect.TypeOf(*new(types.DateTime))
-	case Float:
+	case Float, Monetary:
 		return reflect.TypeOf(*new(float64))
 	case Integer, Many2One, One2One, Rev2One:
 		return reflect.TypeOf(*new(int64))
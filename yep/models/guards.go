@@ -0,0 +1,82 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A RequestClass identifies the kind of work done in a transaction, so that
+// different statement timeouts and query guards can be applied to them.
+type RequestClass string
+
+// Available request classes
+const (
+	// InteractiveRequest is the class of transactions of client requests
+	// waiting for a response, such as RPC calls.
+	InteractiveRequest RequestClass = "interactive"
+	// CronRequest is the class of transactions of scheduled jobs
+	CronRequest RequestClass = "cron"
+	// ReportRequest is the class of transactions generating reports and exports
+	ReportRequest RequestClass = "report"
+)
+
+// requestClassKey is the context.Context key of the RequestClass
+type requestClassKey struct{}
+
+// WithRequestClass returns a copy of ctx for transactions of the given class.
+// Environments created with ExecuteInNewEnvironmentWithContext and the returned
+// context get the statement timeout of this class.
+func WithRequestClass(ctx context.Context, class RequestClass) context.Context {
+	return context.WithValue(ctx, requestClassKey{}, class)
+}
+
+// RequestClassOf returns the RequestClass of the given context, or an empty
+// RequestClass if none has been set.
+func RequestClassOf(ctx context.Context) RequestClass {
+	class, _ := ctx.Value(requestClassKey{}).(RequestClass)
+	return class
+}
+
+// StatementTimeouts holds the maximum duration of each SQL statement for each
+// RequestClass. The database cancels statements running for longer and the
+// transaction is rolled back. Classes without a positive duration have no
+// timeout.
+var StatementTimeouts = map[RequestClass]time.Duration{}
+
+// A QueryGuard rejects obviously unbounded search queries.
+type QueryGuard struct {
+	// RejectUnbounded rejects queries on a whole table without limit,
+	// e.g. rs.FetchAll() without rs.Limit().
+	RejectUnbounded bool
+	// MaxOffset is the maximum offset of queries. 0 means no maximum.
+	MaxOffset int
+}
+
+// ClientQueryGuard is the QueryGuard applied to the search queries of the
+// transactions of the InteractiveRequest class. It rejects nothing by default.
+var ClientQueryGuard QueryGuard
+
+// checkQueryGuard panics with a QueryGuardError if the search query of rc is
+// rejected by the ClientQueryGuard.
+func (rc RecordCollection) checkQueryGuard() {
+	if RequestClassOf(rc.env.GoContext()) != InteractiveRequest {
+		return
+	}
+	q := rc.query
+	if ClientQueryGuard.MaxOffset > 0 && q.offset > ClientQueryGuard.MaxOffset {
+		panic(QueryGuardError{
+			Model:   rc.model.name,
+			Message: fmt.Sprintf("Offset %d is greater than the maximum offset %d", q.offset, ClientQueryGuard.MaxOffset),
+		})
+	}
+	if ClientQueryGuard.RejectUnbounded && q.cond.IsEmpty() && q.limit == 0 {
+		panic(QueryGuardError{
+			Model:   rc.model.name,
+			Message: fmt.Sprintf("Searching all '%s' records without limit is not allowed", rc.model.name),
+		})
+	}
+}
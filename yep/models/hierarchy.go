@@ -0,0 +1,168 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/operator"
+)
+
+const (
+	// defaultParentName is the name of the field used as parent
+	// of models that do not set one with SetParentName.
+	defaultParentName = "parent_id"
+	// parentFieldName is the name of the parent field added by AddParentField
+	parentFieldName = "Parent"
+	// parentPathFieldName is the name of the field holding
+	// the materialized path of the records of a model.
+	parentPathFieldName = "ParentPath"
+	// parentPathSep terminates each id of a materialized path
+	parentPathSep = "/"
+)
+
+// AddParentField adds to this model a Parent many2one field pointing to the
+// model itself and a ParentPath field holding the materialized path of each
+// record, that is the ids of its ancestors followed by its own id, such as
+// "1/5/12/". The path is maintained on create and write, and is used by the
+// child_of and parent_of operators instead of recursive queries.
+//
+// Setting the parent of a record to one of its descendants panics with a
+// ValidationError. If params.OnDelete is not set, deleting a record that has
+// children is restricted.
+func (m *Model) AddParentField(params ForeignKeyFieldParams) *Field {
+	params.RelationModel = m.name
+	if params.OnDelete == "" {
+		params.OnDelete = Restrict
+	}
+	params.Index = true
+	fi := m.AddMany2OneField(parentFieldName, params)
+	m.AddCharField(parentPathFieldName, StringFieldParams{Index: true, NoCopy: true})
+	m.parentName = parentFieldName
+	m.parentPath = true
+	return fi
+}
+
+// SetParentName sets the many2one field pointing to the parent record of
+// the records of this model. It is followed by the child_of and parent_of
+// operators and defaults to the "Parent" field if the model has one.
+func (m *Model) SetParentName(fieldName string) *Model {
+	m.parentName = fieldName
+	return m
+}
+
+// parentField returns the field pointing to the parent record of the
+// records of this model. The second returned value is false if the model
+// has none.
+func (m *Model) parentField() (*Field, bool) {
+	if m.parentName == "" {
+		return m.fields.get(defaultParentName)
+	}
+	return m.fields.get(m.parentName)
+}
+
+// checkParentNames checks that the parent field of all models is a many2one
+// field pointing to the model itself. It panics if it is not the case.
+func checkParentNames() {
+	for _, mi := range Registry.registryByName {
+		if mi.parentName == "" {
+			continue
+		}
+		fi, ok := mi.fields.get(mi.parentName)
+		if !ok {
+			log.Panic("Unknown parent field", "model", mi.name, "field", mi.parentName)
+		}
+		if fi.fieldType != fieldtype.Many2One || fi.relatedModel != mi {
+			log.Panic("Parent field must be a many2one field to the model itself", "model", mi.name, "field", mi.parentName)
+		}
+	}
+}
+
+// hierarchySQL returns the SQL string and placeholder of the given
+// hierarchical operator applied to the given field. fi must be the ID field
+// of a model or a many2one field, and the model it points to must have a
+// parent field.
+func (q *Query) hierarchySQL(fi *Field, op operator.Operator) string {
+	model := fi.model
+	switch {
+	case fi.fieldType.IsFKRelationType():
+		model = fi.relatedModel
+	case fi.json != "id":
+		log.Panic("Hierarchical operators can only be used on ID and many2one fields", "model", fi.model, "field", fi.name, "operator", op)
+	}
+	parentFI, ok := model.parentField()
+	if !ok {
+		log.Panic("Hierarchical operators can only be used on models with a parent field", "model", model, "field", fi.name, "operator", op)
+	}
+	adapter := adapters[db.DriverName()]
+	if model.parentPath {
+		pathFI := model.fields.MustGet(parentPathFieldName)
+		return adapter.parentPathSQL(op, model.tableName, pathFI.json)
+	}
+	return adapter.hierarchySQL(op, model.tableName, parentFI.json)
+}
+
+// updateParentPaths updates the materialized path of the records of rc and
+// of their descendants if the parent field is in the given FieldMap. It panics
+// with a ValidationError if a record would become its own ancestor.
+func (rc RecordCollection) updateParentPaths(fMap FieldMap) {
+	if !rc.model.parentPath {
+		return
+	}
+	parentFI, _ := rc.model.parentField()
+	var parentChanged bool
+	for fName := range fMap {
+		if rc.model.getRelatedFieldInfo(fName) == parentFI {
+			parentChanged = true
+			break
+		}
+	}
+	if !parentChanged {
+		return
+	}
+	pathCol := rc.model.fields.MustGet(parentPathFieldName).json
+	adapter := adapters[db.DriverName()]
+	table := adapter.quoteTableName(rc.model.tableName)
+	for _, id := range rc.Ids() {
+		var paths []struct {
+			Path       string  `db:"path"`
+			ParentPath *string `db:"parent_path"`
+		}
+		query := fmt.Sprintf(`SELECT COALESCE(t.%[2]s, '') AS path, p.%[2]s AS parent_path
+			FROM %[1]s t LEFT JOIN %[1]s p ON p.id = t.%[3]s WHERE t.id = ?`, table, pathCol, parentFI.json)
+		rc.env.Cr().Select(&paths, query, id)
+		if len(paths) == 0 {
+			continue
+		}
+		var newPath string
+		if paths[0].ParentPath != nil {
+			newPath = *paths[0].ParentPath
+		}
+		oldPath := paths[0].Path
+		if oldPath != "" && strings.HasPrefix(newPath, oldPath) {
+			panic(ValidationError{
+				Model:   rc.model.name,
+				Field:   parentFI.name,
+				Message: fmt.Sprintf("Field '%s' cannot be set to the record itself or one of its descendants", parentFI.description),
+			})
+		}
+		newPath += strconv.FormatInt(id, 10) + parentPathSep
+		if oldPath == "" {
+			rc.env.Cr().Execute(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, table, pathCol), newPath, id)
+			rc.env.cache.invalidateRecord(rc.model, id)
+			continue
+		}
+		var ids []int64
+		rc.env.Cr().Select(&ids, fmt.Sprintf(`SELECT id FROM %s WHERE %s LIKE ?`, table, pathCol), oldPath+"%")
+		rc.env.Cr().Execute(fmt.Sprintf(`UPDATE %[1]s SET %[2]s = %[3]s WHERE %[2]s LIKE ?`, table, pathCol,
+			adapter.concatSQL("?", fmt.Sprintf("substr(%s, ?)", pathCol))),
+			newPath, len(oldPath)+1, oldPath+"%")
+		for _, descID := range ids {
+			rc.env.cache.invalidateRecord(rc.model, descID)
+		}
+	}
+}
@@ -28,10 +28,31 @@ func init() {
 	// DB drivers
 	adapters = make(map[string]dbAdapter)
 	registerDBAdapter("postgres", new(postgresAdapter))
+	registerDBAdapter("mysql", new(mysqlAdapter))
+	registerDBAdapter("sqlite3", new(sqliteAdapter))
 	// model registry
 	Registry = newModelCollection()
 	// declare base and common mixins
 	declareCommonMixin()
 	declareBaseMixin()
 	declareModelMixin()
+	// declare system models
+	declareAuditLogModel()
+	declarePropertyModel()
+	declareAttachmentModel()
+	declareAttachmentContentModel()
+	declareFieldDefaultModel()
+	declareSecurityEventModel()
+	declareTranslationModel()
+	declareChangeEventModel()
+	declareAutomationModels()
+	declareApprovalModels()
+	declareCalendarModels()
+	declareSLAModels()
+	declareChatterModels()
+	declareRecurrenceModels()
+	declareAddressMixin()
+	declareSMSModels()
+	declarePushModels()
+	declarePresenceModels()
 }
@@ -0,0 +1,265 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+)
+
+// A ModelInspection describes a bootstrapped model for debugging purposes
+type ModelInspection struct {
+	Name    string
+	Table   string
+	Mixins  []string
+	Fields  []FieldInspection
+	Methods []MethodInspection
+}
+
+// A FieldInspection describes a field of a bootstrapped model
+type FieldInspection struct {
+	Name     string
+	JSON     string
+	Type     fieldtype.Type
+	GoType   string
+	Relation string
+	Stored   bool
+	Compute  string
+	Related  string
+	Depends  []string
+	// Recomputes lists the fields that are recomputed when this field
+	// changes, as "Model.computeMethod" strings.
+	Recomputes []string
+	// Mixins lists the mixins of the model that declare this field
+	Mixins []string
+}
+
+// A MethodInspection describes a method of a bootstrapped model
+type MethodInspection struct {
+	Name string
+	// Layers are the source locations of the implementations of this
+	// method, from the last override to the base implementation.
+	Layers []string
+}
+
+// InspectModel returns the description of the model with the given name,
+// including its fields and the override stack of its methods. It is meant
+// to be called on a bootstrapped registry. It panics if the model does
+// not exist.
+func InspectModel(name string) ModelInspection {
+	mi := Registry.MustGet(name)
+	res := ModelInspection{
+		Name:  mi.name,
+		Table: mi.tableName,
+	}
+	mixins := mi.allMixins()
+	for _, mixin := range mixins {
+		res.Mixins = append(res.Mixins, mixin.name)
+	}
+	for _, fi := range mi.fields.registryByName {
+		fInsp := FieldInspection{
+			Name:     fi.name,
+			JSON:     fi.json,
+			Type:     fi.fieldType,
+			GoType:   fi.structField.Type.String(),
+			Relation: fi.relatedModelName,
+			Stored:   fi.isStored(),
+			Compute:  fi.compute,
+			Related:  fi.relatedPath,
+			Depends:  fi.depends,
+		}
+		for _, dep := range fi.dependencies {
+			fInsp.Recomputes = append(fInsp.Recomputes, dep.modelInfo.name+"."+dep.compute)
+		}
+		for _, mixin := range mixins {
+			if _, ok := mixin.fields.registryByName[fi.name]; ok {
+				fInsp.Mixins = append(fInsp.Mixins, mixin.name)
+			}
+		}
+		res.Fields = append(res.Fields, fInsp)
+	}
+	sort.Sort(fieldInspectionsByName(res.Fields))
+	for _, meth := range mi.methods.registry {
+		mInsp := MethodInspection{Name: meth.name}
+		for ml := meth.topLayer; ml != nil; ml = meth.getNextLayer(ml) {
+			mInsp.Layers = append(mInsp.Layers, ml.origin)
+		}
+		res.Methods = append(res.Methods, mInsp)
+	}
+	sort.Sort(methodInspectionsByName(res.Methods))
+	return res
+}
+
+// allMixins returns the mixins of this model and, recursively, their own
+// mixins, in the order in which they are injected.
+func (m *Model) allMixins() []*Model {
+	var res []*Model
+	seen := make(map[*Model]bool)
+	for _, mixin := range m.mixins {
+		for _, mm := range append(mixin.allMixins(), mixin) {
+			if !seen[mm] {
+				res = append(res, mm)
+				seen[mm] = true
+			}
+		}
+	}
+	return res
+}
+
+// fieldInspectionsByName sorts FieldInspections by field name
+type fieldInspectionsByName []FieldInspection
+
+func (f fieldInspectionsByName) Len() int           { return len(f) }
+func (f fieldInspectionsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fieldInspectionsByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+
+// methodInspectionsByName sorts MethodInspections by method name
+type methodInspectionsByName []MethodInspection
+
+func (m methodInspectionsByName) Len() int           { return len(m) }
+func (m methodInspectionsByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m methodInspectionsByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+
+// A ComputeExplanation describes how a computed field of a record is computed,
+// to debug fields that are not updated as expected.
+type ComputeExplanation struct {
+	Model   string
+	Field   string
+	Compute string
+	Stored  bool
+	// Depends are the depends paths of the field, as declared
+	Depends []string
+	// Triggers are the fields whose modification triggers the
+	// recomputation of the field
+	Triggers []ComputeTrigger
+	// Sources are the current values of each step of the depends paths
+	Sources []ComputeSource
+	// Value is the current value of the field. For stored fields, this
+	// is the value stored in the database.
+	Value interface{}
+	// ComputedValue is the value returned by the compute method when
+	// replaying it on the record
+	ComputedValue interface{}
+	// Stale is true if Value differs from ComputedValue, i.e. if the
+	// stored field has not been recomputed after a modification.
+	Stale bool
+}
+
+// A ComputeTrigger is a field whose modification triggers the recomputation
+// of a computed field.
+type ComputeTrigger struct {
+	Model string
+	Field string
+	// Path is the path from the computed record to the modified records,
+	// or empty if the modified records are the computed records themselves.
+	Path string
+}
+
+// A ComputeSource is the value of a step of a depends path of a record
+type ComputeSource struct {
+	Path string
+	// Computed is true if the field of this step is itself a computed field,
+	// which may be explained in turn.
+	Computed bool
+	// Values are the values of the field for each record reached by the
+	// path. Relation fields values are given as ids.
+	Values []interface{}
+}
+
+// ExplainCompute returns the explanation of the computation of the given
+// computed field for this singleton: its dependencies, the fields that
+// trigger its recomputation, the current values of its sources and the
+// result of the replay of its compute method.
+//
+// The compute method is called on the record, so that ExplainCompute should
+// be called in an Environment that is rolled back.
+func (rc RecordCollection) ExplainCompute(fieldName string) ComputeExplanation {
+	rSet := rc.Fetch()
+	rSet.EnsureOne()
+	fi := rSet.model.fields.MustGet(fieldName)
+	if !fi.isComputedField() {
+		log.Panic("Field is not a computed field", "model", rSet.model.name, "field", fieldName)
+	}
+	res := ComputeExplanation{
+		Model:   rSet.model.name,
+		Field:   fi.name,
+		Compute: fi.compute,
+		Stored:  fi.isStored(),
+		Depends: fi.depends,
+	}
+	for _, mi := range Registry.registryByName {
+		for _, dfi := range mi.fields.registryByName {
+			for _, cData := range dfi.dependencies {
+				if cData.modelInfo != rSet.model || cData.compute != fi.compute {
+					continue
+				}
+				res.Triggers = append(res.Triggers, ComputeTrigger{Model: mi.name, Field: dfi.name, Path: cData.path})
+			}
+		}
+	}
+	sort.Sort(computeTriggersByName(res.Triggers))
+	for _, depString := range fi.depends {
+		res.Sources = append(res.Sources, rSet.dependsSources(depString)...)
+	}
+	res.Value = rSet.Get(fi.name)
+	computed := rSet.Call(fi.compute).(FieldMapper).FieldMap()
+	for fName, value := range computed {
+		if cfi, ok := rSet.model.fields.get(fName); ok && cfi == fi {
+			res.ComputedValue = value
+		}
+	}
+	res.Stale = encodeFieldValue(res.Value) != encodeFieldValue(res.ComputedValue)
+	return res
+}
+
+// dependsSources returns the ComputeSource of each step of the
+// given depends path for the records of rc.
+func (rc RecordCollection) dependsSources(depString string) []ComputeSource {
+	var res []ComputeSource
+	tokens := strings.Split(depString, ExprSep)
+	recs := rc
+	for i, token := range tokens {
+		fi := recs.model.fields.MustGet(token)
+		source := ComputeSource{
+			Path:     strings.Join(tokens[:i+1], ExprSep),
+			Computed: fi.isComputedField(),
+		}
+		var related RecordCollection
+		if fi.relatedModel != nil {
+			related = recs.env.Pool(fi.relatedModel.name).withIds([]int64{})
+		}
+		for _, rec := range recs.Records() {
+			value := rec.Get(fi.name)
+			if relRecs, ok := value.(RecordCollection); ok {
+				related = related.Union(relRecs)
+				source.Values = append(source.Values, relRecs.Ids())
+				continue
+			}
+			source.Values = append(source.Values, value)
+		}
+		res = append(res, source)
+		if fi.relatedModel == nil {
+			break
+		}
+		recs = related
+	}
+	return res
+}
+
+// computeTriggersByName sorts ComputeTriggers by model and field name
+type computeTriggersByName []ComputeTrigger
+
+func (c computeTriggersByName) Len() int      { return len(c) }
+func (c computeTriggersByName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c computeTriggersByName) Less(i, j int) bool {
+	if c[i].Model != c[j].Model {
+		return c[i].Model < c[j].Model
+	}
+	if c[i].Field != c[j].Field {
+		return c[i].Field < c[j].Field
+	}
+	return c[i].Path < c[j].Path
+}
@@ -15,10 +15,15 @@
 package models
 
 import (
+	"fmt"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
 )
 
 // MethodsCollection is the Method collection
@@ -83,16 +88,24 @@ type Method struct {
 	nextLayer     map[*methodLayer]*methodLayer
 	groups        map[*security.Group]bool
 	groupsCallers map[callerGroup]bool
+	// approvalLevels are the levels of approval required
+	// before calling this method (see RequireApprovals)
+	approvalLevels []*ApprovalLevel
 }
 
 // addMethodLayer adds the given layer to this Method.
-func (m *Method) addMethodLayer(val reflect.Value, doc string) {
+// If skipKeys are given, the layer is skipped when any of
+// these keys is set in the context.
+func (m *Method) addMethodLayer(val reflect.Value, doc string, skipKeys ...string) {
 	m.Lock()
 	defer m.Unlock()
 	ml := methodLayer{
 		funcValue: wrapFunctionForMethodLayer(val),
 		method:    m,
 		doc:       doc,
+		skipKeys:  skipKeys,
+		origin:    funcOrigin(val),
+		pkg:       funcPackage(val),
 	}
 	m.nextLayer[&ml] = m.topLayer
 	m.topLayer = &ml
@@ -102,6 +115,17 @@ func (m *Method) getNextLayer(methodLayer *methodLayer) *methodLayer {
 	return m.nextLayer[methodLayer]
 }
 
+// getActiveLayer returns the first layer starting from the given one
+// that is not skipped in the given context.
+func (m *Method) getActiveLayer(methodLayer *methodLayer, ctx *types.Context) *methodLayer {
+	for ml := methodLayer; ml != nil; ml = m.getNextLayer(ml) {
+		if !ml.isSkipped(ctx) {
+			return ml
+		}
+	}
+	return nil
+}
+
 // invertedLayers returns the list of method layers starting
 // from the base methods and going up all inherited layers
 func (m *Method) invertedLayers() []*methodLayer {
@@ -128,6 +152,24 @@ func (m *Method) AllowGroup(group *security.Group, callers ...*Method) *Method {
 	return m
 }
 
+// allowedGroups returns the sorted IDs of the groups allowed to
+// execute this method when called from the given caller.
+func (m *Method) allowedGroups(caller *Method) []string {
+	m.RLock()
+	defer m.RUnlock()
+	var res []string
+	for group := range m.groups {
+		res = append(res, group.ID)
+	}
+	for cg := range m.groupsCallers {
+		if caller != nil && cg.caller == caller && !m.groups[cg.group] {
+			res = append(res, cg.group.ID)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
 // RevokeGroup revokes the execution permission on the method to the given group
 // if it has been given previously, otherwise does nothing.
 // Note that this methods revokes all permissions, whatever the caller.
@@ -149,6 +191,26 @@ type methodLayer struct {
 	mixedIn   bool
 	funcValue reflect.Value
 	doc       string
+	skipKeys  []string
+	origin    string
+	// pkg is the go package in which the function of this layer is defined
+	pkg string
+	// base is true for the layer with which the method has been created
+	base bool
+}
+
+// isSkipped returns true if one of the skip keys of this layer
+// is set in the given context.
+func (ml *methodLayer) isSkipped(ctx *types.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	for _, key := range ml.skipKeys {
+		if ctx.HasKey(key) {
+			return true
+		}
+	}
+	return false
 }
 
 // newMethod creates a new method ref with the given func value as first layer.
@@ -171,6 +233,8 @@ func newMethod(m *Model, methodName, doc string, val reflect.Value) *Method {
 		funcValue: wrapFunctionForMethodLayer(val),
 		method:    &method,
 		doc:       doc,
+		pkg:       funcPackage(val),
+		base:      true,
 	}
 	return &method
 }
@@ -188,6 +252,115 @@ func copyMethod(m *Model, method *Method) *Method {
 	}
 }
 
+// funcOrigin returns the source location and name of the given function,
+// or an empty string if it is already wrapped for a method layer.
+func funcOrigin(fnctVal reflect.Value) string {
+	if fnctVal.Type() == reflect.TypeOf(func(RecordCollection, ...interface{}) []interface{} { return nil }) {
+		return ""
+	}
+	fnct := runtime.FuncForPC(fnctVal.Pointer())
+	if fnct == nil {
+		return ""
+	}
+	file, line := fnct.FileLine(fnct.Entry())
+	return fmt.Sprintf("%s:%d (%s)", file, line, fnct.Name())
+}
+
+// funcPackage returns the import path of the go package in which the given
+// function is defined, or an empty string if it is already wrapped for a
+// method layer.
+func funcPackage(fnctVal reflect.Value) string {
+	if fnctVal.Type() == reflect.TypeOf(func(RecordCollection, ...interface{}) []interface{} { return nil }) {
+		return ""
+	}
+	fnct := runtime.FuncForPC(fnctVal.Pointer())
+	if fnct == nil {
+		return ""
+	}
+	return PackageOfFunc(fnct.Name())
+}
+
+// PackageOfFunc returns the import path of the go package of the function
+// with the given full name, as returned by runtime.FuncForPC, e.g.
+// "github.com/foo/sale" for "github.com/foo/sale.declareModels.func1".
+func PackageOfFunc(name string) string {
+	lastSlash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[lastSlash+1:], "."); dot >= 0 {
+		return name[:lastSlash+1+dot]
+	}
+	return name
+}
+
+// modulePackages are the go packages of the loaded modules by load order
+var modulePackages = make(map[string]int)
+
+// RegisterModulePackage declares that the module with the given go package
+// is loaded after the modules already registered. At bootstrap, the layers
+// of each method are ordered by the load order of the modules that defined
+// them, so that the layers of a module always extend the layers of the modules
+// loaded before it, whatever the order in which the layers have been added.
+//
+// This function is called by server.RegisterModule.
+func RegisterModulePackage(pkgPath string) {
+	if _, exists := modulePackages[pkgPath]; exists {
+		return
+	}
+	modulePackages[pkgPath] = len(modulePackages)
+}
+
+// moduleRank returns the load order of the module defining this layer,
+// or -1 if it is not defined in a module.
+func (ml *methodLayer) moduleRank() int {
+	if rank, ok := modulePackages[ml.pkg]; ok {
+		return rank
+	}
+	return -1
+}
+
+// sortLayers orders the layers of this method by the load order of the
+// modules that defined them, keeping the order in which the layers of a same
+// module have been added. Layers that are not defined in a module stay above
+// the layer they have been added on.
+//
+// It panics if a layer is defined in a module loaded before the module that
+// created the method, since this layer would never be called.
+func (m *Method) sortLayers() {
+	type rankedLayer struct {
+		layer *methodLayer
+		rank  int
+	}
+	var layers []rankedLayer
+	rank := -1
+	for _, layer := range m.invertedLayers() {
+		if layerRank := layer.moduleRank(); layerRank >= 0 {
+			rank = layerRank
+		}
+		layers = append(layers, rankedLayer{layer: layer, rank: rank})
+	}
+	if len(layers) < 2 {
+		return
+	}
+	if baseLayer := layers[0]; baseLayer.layer.base {
+		for _, rl := range layers[1:] {
+			if rl.rank < baseLayer.rank {
+				log.Panic("Method extended by a module loaded before the module that created it", "model",
+					m.model.name, "method", m.name, "layer", rl.layer.origin, "module", rl.layer.pkg,
+					"base", baseLayer.layer.pkg)
+			}
+		}
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].rank < layers[j].rank
+	})
+	m.nextLayer = make(map[*methodLayer]*methodLayer)
+	var next *methodLayer
+	for _, rl := range layers {
+		m.nextLayer[rl.layer] = next
+		next = rl.layer
+	}
+	m.topLayer = next
+}
+
 // wrapFunctionForMethodLayer take the given fnct Value and wrap it in a
 // func(RecordCollection, args...) function Value suitable for use in a
 // methodLayer.
@@ -250,6 +423,26 @@ func (m *Model) AddMethod(methodName, doc string, fnct interface{}) *Method {
 // Extend adds the given fnct function as a new layer on this method.
 // fnct must be of the same signature as the first layer of this method.
 func (m *Method) Extend(doc string, fnct interface{}) *Method {
+	return m.extend(doc, fnct)
+}
+
+// ExtendUnless adds the given fnct function as a new layer on this method
+// that is skipped when any of the given context keys is set. In this case,
+// the call goes directly to the next layer as if this one did not exist.
+//
+// This allows a flow (e.g. data import or migration) to disable specific
+// overrides by setting a key in the context with WithContext.
+func (m *Method) ExtendUnless(contextKeys []string, doc string, fnct interface{}) *Method {
+	if len(contextKeys) == 0 {
+		log.Panic("ExtendUnless must be given at least one context key", "model", m.model.name, "method", m.name)
+	}
+	return m.extend(doc, fnct, contextKeys...)
+}
+
+// extend adds the given fnct function as a new layer on this method
+// after checking its signature. The layer is skipped if any of the
+// given skipKeys is set in the context.
+func (m *Method) extend(doc string, fnct interface{}, skipKeys ...string) *Method {
 	m.checkMethodAndFnctType(fnct)
 	methInfo := m
 	val := reflect.ValueOf(fnct)
@@ -269,7 +462,7 @@ func (m *Method) Extend(doc string, fnct interface{}) *Method {
 		log.Panic("Variadic mismatch", "model", m.name, "method", m.name,
 			"base_is_variadic", methInfo.methodType.IsVariadic(), "ext_is_variadic", val.Type().IsVariadic())
 	}
-	methInfo.addMethodLayer(val, doc)
+	methInfo.addMethodLayer(val, doc, skipKeys...)
 	return methInfo
 }
 
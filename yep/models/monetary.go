@@ -0,0 +1,165 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"reflect"
+	"strconv"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/tools/nbutils"
+)
+
+const (
+	// defaultCurrencyField is the name of the currency field
+	// of monetary fields if none is given.
+	defaultCurrencyField = "Currency"
+	// currencyDecimalPlacesField is the name of the integer field of currency
+	// models that gives the number of decimal places of amounts.
+	currencyDecimalPlacesField = "DecimalPlaces"
+	// currencyRoundingMethodField is the name of the optional char field of
+	// currency models that gives the nbutils.RoundingMethod of amounts.
+	currencyRoundingMethodField = "RoundingMethod"
+)
+
+// checkMonetaryFields checks that the currency field of all monetary fields
+// is a many2one field to a model with a DecimalPlaces field. It panics if
+// it is not the case.
+func checkMonetaryFields() {
+	for _, mi := range Registry.registryByName {
+		if mi.isMixin() {
+			continue
+		}
+		for _, fi := range mi.fields.registryByName {
+			if fi.fieldType != fieldtype.Monetary {
+				continue
+			}
+			curFI, ok := mi.fields.get(fi.currencyField)
+			if !ok || curFI.fieldType != fieldtype.Many2One {
+				log.Panic("Currency field of monetary field must be a many2one field", "model", mi.name,
+					"field", fi.name, "currencyField", fi.currencyField)
+			}
+			if _, ok := curFI.relatedModel.fields.get(currencyDecimalPlacesField); !ok {
+				log.Panic("Currency model has no DecimalPlaces field", "model", mi.name,
+					"field", fi.name, "currencyModel", curFI.relatedModelName)
+			}
+		}
+	}
+}
+
+// monetaryFieldsToRound returns the stored monetary fields that must be
+// rounded when the given fields are modified, i.e. the monetary fields of
+// the list and those whose currency field is in the list.
+func (fc *FieldsCollection) monetaryFieldsToRound(fieldNames []string) []*Field {
+	modified := make(map[string]bool)
+	for _, fName := range fieldNames {
+		if fi, ok := fc.get(fName); ok {
+			modified[fi.name] = true
+		}
+	}
+	var res []*Field
+	for _, fi := range fc.registryByName {
+		if fi.fieldType != fieldtype.Monetary || !fi.isStored() || fi.isRelatedField() {
+			continue
+		}
+		if modified[fi.name] || modified[fc.MustGet(fi.currencyField).name] {
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
+// roundMonetaryFields rounds the values of the monetary fields of the
+// records of rc that are impacted by the modification of the given fields
+// with the rounding policy of the currency of each record.
+func (rc RecordCollection) roundMonetaryFields(fieldNames []string) {
+	fields := rc.model.fields.monetaryFieldsToRound(fieldNames)
+	if len(fields) == 0 {
+		return
+	}
+	for _, rec := range rc.Records() {
+		fMap := make(FieldMap)
+		for _, fi := range fields {
+			policy, ok := rec.currencyRoundingPolicy(fi)
+			if !ok {
+				continue
+			}
+			value := reflect.ValueOf(rec.Get(fi.name)).Float()
+			if rounded := policy.Round(value); rounded != value {
+				fMap[fi.json] = rounded
+			}
+		}
+		if len(fMap) == 0 {
+			continue
+		}
+		sql, args := rec.query.updateQuery(fMap)
+		rec.env.Cr().Execute(sql, args...)
+		rec.env.cache.invalidateRecord(rec.model, rec.ids[0])
+	}
+}
+
+// currencyRoundingPolicy returns the rounding policy of the currency of the
+// monetary field fi for this singleton. Its scale is the number of decimal
+// places of the currency, and its method is the rounding method of the
+// currency, or else the one of the company of the Environment. The second
+// returned value is false if the record has no currency.
+func (rc RecordCollection) currencyRoundingPolicy(fi *Field) (nbutils.RoundingPolicy, bool) {
+	currency := rc.Get(fi.currencyField).(RecordCollection)
+	if currency.IsEmpty() {
+		return nbutils.RoundingPolicy{}, false
+	}
+	policy := rc.env.RoundingPolicy()
+	if _, ok := currency.model.fields.get(currencyRoundingMethodField); ok {
+		if method, _ := currency.Get(currencyRoundingMethodField).(string); method != "" {
+			policy.Method = nbutils.RoundingMethod(method)
+		}
+	}
+	policy.Scale = int8(reflect.ValueOf(currency.Get(currencyDecimalPlacesField)).Int())
+	return policy, true
+}
+
+// addCurrencyGroups adds to the groups of this RecordCollection's query
+// the currency fields of the monetary fields of the given list, so that
+// amounts in different currencies are not aggregated together. It returns
+// the grouped RecordCollection and the fields with the currency fields added.
+func (rc RecordCollection) addCurrencyGroups(fields []string) (RecordCollection, []string) {
+	groups := make(map[string]bool)
+	for _, g := range rc.query.groups {
+		groups[rc.model.JSONizeFieldName(g)] = true
+	}
+	for _, fName := range fields {
+		fi, ok := rc.model.fields.get(fName)
+		if !ok || fi.fieldType != fieldtype.Monetary {
+			continue
+		}
+		curFI := rc.model.fields.MustGet(fi.currencyField)
+		if groups[curFI.json] {
+			continue
+		}
+		groups[curFI.json] = true
+		rc = rc.GroupBy(FieldName(curFI.json))
+		fields = append(fields, curFI.json)
+	}
+	return rc, fields
+}
+
+// convertMonetaryAggregates converts to float64 the values of monetary
+// fields in vals, which are returned by the database as numeric strings.
+func (rc RecordCollection) convertMonetaryAggregates(vals map[string]interface{}) {
+	for key, value := range vals {
+		fi, ok := rc.model.fields.get(key)
+		if !ok || fi.fieldType != fieldtype.Monetary {
+			continue
+		}
+		data, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+		res, err := strconv.ParseFloat(string(data), 64)
+		if err != nil {
+			log.Panic("Unable to convert monetary value", "model", rc.ModelName(), "field", fi.name, "value", string(data))
+		}
+		vals[key] = res
+	}
+}
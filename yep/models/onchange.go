@@ -0,0 +1,37 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+// onchange calls the OnChange methods of the fields given in params.Fields
+// with the values of the pseudo-record params.Values and returns the values
+// that must be modified in the client, keyed by field JSON names.
+//
+// Fields modified by an OnChange method have their own OnChange method
+// called in turn, each method being called at most once.
+func (rc RecordCollection) onchange(params OnchangeParams) FieldMap {
+	values := make(FieldMap)
+	for fName, value := range params.Values {
+		if fi, ok := rc.model.fields.get(fName); ok {
+			values[fi.name] = value
+		}
+	}
+	res := make(FieldMap)
+	done := make(map[string]bool)
+	toCall := params.Fields
+	for len(toCall) > 0 {
+		fi, ok := rc.model.fields.get(toCall[0])
+		toCall = toCall[1:]
+		if !ok || fi.onChange == "" || done[fi.onChange] {
+			continue
+		}
+		done[fi.onChange] = true
+		for fName, value := range rc.Call(fi.onChange, values).(FieldMap) {
+			modFI := rc.model.fields.MustGet(fName)
+			values[modFI.name] = value
+			res[modFI.json] = value
+			toCall = append(toCall, modFI.name)
+		}
+	}
+	return res
+}
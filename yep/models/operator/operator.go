@@ -23,6 +23,7 @@ const (
 	In             Operator = "in"
 	NotIn          Operator = "not in"
 	ChildOf        Operator = "child_of"
+	ParentOf       Operator = "parent_of"
 )
 
 var allowedOperators = map[Operator]bool{
@@ -41,11 +42,19 @@ var allowedOperators = map[Operator]bool{
 	In:             true,
 	NotIn:          true,
 	ChildOf:        true,
+	ParentOf:       true,
 }
 
 var multiOperator = map[Operator]bool{
-	In:    true,
-	NotIn: true,
+	In:       true,
+	NotIn:    true,
+	ChildOf:  true,
+	ParentOf: true,
+}
+
+var hierarchyOperator = map[Operator]bool{
+	ChildOf:  true,
+	ParentOf: true,
 }
 
 // IsMulti returns true if the operator expects a array as arguments
@@ -53,6 +62,12 @@ func (o Operator) IsMulti() bool {
 	return multiOperator[o]
 }
 
+// IsHierarchical returns true if the operator searches the records
+// of a tree structure, such as child_of and parent_of.
+func (o Operator) IsHierarchical() bool {
+	return hierarchyOperator[o]
+}
+
 // IsValid returns true if o is a known operator.
 func (o Operator) IsValid() bool {
 	_, res := allowedOperators[o]
@@ -0,0 +1,109 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+)
+
+// sequenceFieldName is the name of the integer field
+// holding the position of the records for Resequence.
+const sequenceFieldName = "Sequence"
+
+// SetDefaultOrder sets the ORDER BY expressions used for the searches on this
+// model that are not explicitly ordered with OrderBy, such as "Sequence" or
+// "Name DESC". Searches on models without default order are ordered by id.
+func (m *Model) SetDefaultOrder(exprs ...string) *Model {
+	m.defaultOrder = exprs
+	return m
+}
+
+// checkDefaultOrders checks that the default order expressions of all models
+// are valid. It panics if it is not the case.
+func checkDefaultOrders() {
+	for _, mi := range Registry.registryByName {
+		for _, order := range mi.defaultOrder {
+			mi.resolveOrderExpr(order)
+		}
+	}
+}
+
+// resolveOrderExpr checks the given ORDER BY expression of this model and
+// returns the path of the ordered field, with related non stored fields
+// replaced by their target path, and the direction of the order if any.
+//
+// It panics if the expression is not a path of many2one or one2one fields
+// ending with a stored field, optionally followed by ASC or DESC.
+func (m *Model) resolveOrderExpr(expr string) (string, string) {
+	tokens := strings.Fields(expr)
+	if len(tokens) == 0 || len(tokens) > 2 {
+		log.Panic("Invalid order expression", "model", m.name, "order", expr)
+	}
+	var direction string
+	if len(tokens) == 2 {
+		direction = strings.ToUpper(tokens[1])
+		if direction != "ASC" && direction != "DESC" {
+			log.Panic("Invalid direction in order expression", "model", m.name, "order", expr)
+		}
+	}
+	return m.resolveOrderPath(tokens[0], expr), direction
+}
+
+// resolveOrderPath returns the given field path of an order expression
+// with related non stored fields replaced by their target path.
+// It panics if the path cannot be used for ordering.
+func (m *Model) resolveOrderPath(path, expr string) string {
+	names := strings.SplitN(path, ExprSep, 2)
+	fi, ok := m.fields.get(names[0])
+	if !ok {
+		log.Panic("Unknown field in order expression", "model", m.name, "field", names[0], "order", expr)
+	}
+	if fi.isRelatedField() && !fi.stored {
+		target := fi.relatedPath
+		if len(names) > 1 {
+			target += ExprSep + names[1]
+		}
+		return m.resolveOrderPath(target, expr)
+	}
+	if len(names) == 1 {
+		if !fi.isStored() {
+			log.Panic("Order expression must end with a stored field", "model", m.name, "field", fi.name, "order", expr)
+		}
+		return fi.name
+	}
+	if fi.fieldType != fieldtype.Many2One && fi.fieldType != fieldtype.One2One {
+		log.Panic("Order expression can only follow many2one and one2one fields", "model", m.name,
+			"field", fi.name, "order", expr)
+	}
+	return fi.name + ExprSep + fi.relatedModel.resolveOrderPath(names[1], expr)
+}
+
+// orderExprs returns the ORDER BY expressions of this Query, or the default
+// order of its model if none have been given. Returned expressions are
+// resolved by resolveOrderExpr.
+func (q *Query) orderExprs() []string {
+	orders := q.orders
+	if len(orders) == 0 {
+		orders = q.recordSet.model.defaultOrder
+	}
+	res := make([]string, len(orders))
+	for i, order := range orders {
+		path, direction := q.recordSet.model.resolveOrderExpr(order)
+		res[i] = strings.TrimSpace(path + " " + direction)
+	}
+	return res
+}
+
+// resequence sets the Sequence field of the records with the given ids to
+// their position in ids. It panics if the model has no Sequence field.
+func (rc RecordCollection) resequence(ids []int64) {
+	if _, ok := rc.model.fields.get(sequenceFieldName); !ok {
+		log.Panic("Resequence can only be called on models with a Sequence field", "model", rc.model)
+	}
+	for i, id := range ids {
+		rc.withIds([]int64{id}).Call("Write", FieldMap{sequenceFieldName: int64(i)})
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+)
+
+// A pageKey is a field of the keyset on which a query is paginated
+type pageKey struct {
+	field *Field
+	desc  bool
+}
+
+// String returns the order expression of this pageKey
+func (pk pageKey) String() string {
+	if pk.desc {
+		return fmt.Sprintf("%s desc", pk.field.json)
+	}
+	return pk.field.json
+}
+
+// A pageCursor is the content of the opaque tokens returned by Page.
+type pageCursor struct {
+	Orders []string      `json:"o"`
+	Values []interface{} `json:"v"`
+}
+
+// Page returns at most size records of rc that come after the record given by
+// cursor in the order of rc, and the cursor of the last returned record to get
+// the next page. The returned cursor is empty if there are no more records.
+// An empty cursor returns the first page.
+//
+// Contrary to Offset, pages are selected with a condition on the ordered fields
+// (keyset pagination), so that getting a page does not get slower as the pages
+// go by and records created or deleted by concurrent transactions do not make
+// records be skipped or returned twice.
+//
+// The order of rc must only use stored fields of the model itself. The ID is
+// added to the order to make it unique. Records whose ordered fields are NULL
+// are not returned.
+func (rc RecordCollection) Page(cursor string, size int) (RecordCollection, string) {
+	if size <= 0 {
+		log.Panic("Page size must be positive", "model", rc.model.name, "size", size)
+	}
+	keys := rc.pageKeys()
+	orders := make([]string, len(keys))
+	for i, key := range keys {
+		orders[i] = key.String()
+	}
+	rSet := rc
+	if cursor != "" {
+		values := decodePageCursor(cursor, orders)
+		rSet = rSet.Search(keysetCondition(rc.model, keys, values))
+	}
+	rSet = rSet.OrderBy(orders...).Limit(size).Fetch()
+	if rSet.Len() < size {
+		return rSet, ""
+	}
+	last := rSet.Record(rSet.Len() - 1)
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		value := last.Get(key.field.name)
+		if rel, ok := value.(RecordCollection); ok {
+			var id int64
+			if !rel.IsEmpty() {
+				id = rel.ids[0]
+			}
+			value = id
+		}
+		values[i] = value
+	}
+	return rSet, encodePageCursor(pageCursor{Orders: orders, Values: values})
+}
+
+// pageKeys returns the keyset on which rc is paginated, i.e. the fields of
+// its order followed by the ID. It panics if the order of rc cannot be used
+// for keyset pagination.
+func (rc RecordCollection) pageKeys() []pageKey {
+	var (
+		res   []pageKey
+		hasID bool
+	)
+	for _, order := range rc.query.orderExprs() {
+		tokens := strings.Fields(order)
+		fi, ok := rc.model.fields.get(tokens[0])
+		if !ok || !fi.isStored() || fi.fieldType.IsNonStoredRelationType() ||
+			(fi.fieldType == fieldtype.Selection && len(fi.selectionOptions) > 0) {
+			log.Panic("Order expression cannot be used for pagination", "model", rc.model.name, "order", order)
+		}
+		res = append(res, pageKey{
+			field: fi,
+			desc:  len(tokens) > 1 && strings.ToLower(tokens[1]) == "desc",
+		})
+		if fi.json == "id" {
+			hasID = true
+			break
+		}
+	}
+	if !hasID {
+		res = append(res, pageKey{field: rc.model.fields.MustGet("ID")})
+	}
+	return res
+}
+
+// keysetCondition returns the condition selecting the records of the given
+// model that come after the given values of the given keys, i.e.
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+func keysetCondition(mi *Model, keys []pageKey, values []interface{}) *Condition {
+	var res *Condition
+	for i, key := range keys {
+		field := mi.Field(key.field.name)
+		cond := field.Greater(values[i])
+		if key.desc {
+			cond = field.Lower(values[i])
+		}
+		for j := 0; j < i; j++ {
+			cond = cond.AndCond(mi.Field(keys[j].field.name).Equals(values[j]))
+		}
+		if res == nil {
+			res = cond
+			continue
+		}
+		res = res.OrCond(cond)
+	}
+	return res
+}
+
+// encodePageCursor returns the opaque token of the given pageCursor
+func encodePageCursor(pc pageCursor) string {
+	data, err := json.Marshal(pc)
+	if err != nil {
+		log.Panic("Unable to encode page cursor", "error", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageCursor returns the values of the given cursor token.
+// It panics if the cursor is invalid or if it has not been returned
+// by a query with the given orders.
+func decodePageCursor(cursor string, orders []string) []interface{} {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		log.Panic("Invalid page cursor", "cursor", cursor, "error", err)
+	}
+	var pc pageCursor
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&pc); err != nil {
+		log.Panic("Invalid page cursor", "cursor", cursor, "error", err)
+	}
+	if strings.Join(pc.Orders, ",") != strings.Join(orders, ",") || len(pc.Values) != len(orders) {
+		log.Panic("Page cursor does not match the order of the query", "cursor", cursor, "orders", orders)
+	}
+	for i, value := range pc.Values {
+		num, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if intVal, err := num.Int64(); err == nil {
+			pc.Values[i] = intVal
+			continue
+		}
+		pc.Values[i], _ = num.Float64()
+	}
+	return pc.Values
+}
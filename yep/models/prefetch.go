@@ -0,0 +1,90 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import "strings"
+
+// prefetchMax is the maximum number of records that are loaded
+// at once when a record is loaded with the records to prefetch.
+const prefetchMax = 1000
+
+// addPrefetch adds the given ids to the records of the given model that
+// will be loaded together with the next record of this model to load.
+func (c *cache) addPrefetch(mi *Model, ids ...int64) {
+	c.Lock()
+	defer c.Unlock()
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		if c.prefetch[mi.name] == nil {
+			c.prefetch[mi.name] = make(map[int64]bool)
+		}
+		c.prefetch[mi.name][id] = true
+	}
+}
+
+// prefetchedIds returns the given ids of the given model followed by the ids
+// of the records to prefetch of this model whose fieldName is not in cache,
+// up to prefetchMax ids. Returned ids are removed from the records to prefetch.
+func (c *cache) prefetchedIds(mi *Model, ids []int64, fieldName string) []int64 {
+	c.Lock()
+	defer c.Unlock()
+	res := make([]int64, len(ids), len(ids)+len(c.prefetch[mi.name]))
+	copy(res, ids)
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		seen[id] = true
+		delete(c.prefetch[mi.name], id)
+	}
+	jsonName := mi.fields.MustGet(fieldName).json
+	for id := range c.prefetch[mi.name] {
+		if len(res) >= prefetchMax {
+			break
+		}
+		delete(c.prefetch[mi.name], id)
+		if seen[id] {
+			continue
+		}
+		if _, ok := c.data[RecordRef{ModelName: mi.name, ID: id}][jsonName]; ok {
+			continue
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+// addRelationsToPrefetch adds the records referenced by the many2one and
+// one2one fields of the given loaded records to the records to prefetch,
+// so that reading these fields on each record does not query the database
+// once per record.
+func (rc RecordCollection) addRelationsToPrefetch(lines []FieldMap) {
+	for _, line := range lines {
+		for fName, value := range line {
+			if strings.Contains(fName, ExprSep) {
+				continue
+			}
+			fi, ok := rc.model.fields.get(fName)
+			if !ok || !fi.fieldType.IsFKRelationType() || fi.relatedModel == nil {
+				continue
+			}
+			if id, ok := value.(int64); ok {
+				rc.env.cache.addPrefetch(fi.relatedModel, id)
+			}
+		}
+	}
+}
+
+// withPrefetch returns a RecordCollection of the records of rc and of the
+// records of the same model to prefetch, for loading the given stored field.
+func (rc RecordCollection) withPrefetch(fieldName string) RecordCollection {
+	if strings.Contains(fieldName, ExprSep) {
+		return rc
+	}
+	ids := rc.env.cache.prefetchedIds(rc.model, rc.ids, fieldName)
+	if len(ids) == len(rc.ids) {
+		return rc
+	}
+	return newRecordCollection(*rc.env, rc.ModelName()).withIds(ids)
+}
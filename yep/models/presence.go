@@ -0,0 +1,213 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// A PresenceStatus tells whether a user is connected and active
+type PresenceStatus string
+
+// Presence statuses
+const (
+	// PresenceOnline users are connected and have been active recently
+	PresenceOnline PresenceStatus = "online"
+	// PresenceAway users are connected but have been inactive for PresenceAwayDelay
+	PresenceAway PresenceStatus = "away"
+	// PresenceOffline users have not sent any heartbeat for PresenceTimeout
+	PresenceOffline PresenceStatus = "offline"
+)
+
+var (
+	// PresenceTimeout is the duration without heartbeat
+	// after which a user is considered offline.
+	PresenceTimeout = time.Minute
+	// PresenceAwayDelay is the duration without activity
+	// after which a connected user is considered away.
+	PresenceAwayDelay = 30 * time.Minute
+	// TypingTimeout is the duration after which a user who
+	// stopped sending typing notifications is not typing anymore.
+	TypingTimeout = 10 * time.Second
+)
+
+// A PresenceNotifier broadcasts the presence of users and their typing
+// indicators, for instance to the clients subscribed to a channel of a bus.
+type PresenceNotifier interface {
+	// NotifyPresence notifies that the user with the given uid has a new status
+	NotifyPresence(uid int64, status PresenceStatus) error
+	// NotifyTyping notifies that the user with the given uid
+	// started or stopped typing in the given channel.
+	NotifyTyping(channel string, uid int64, typing bool) error
+}
+
+// PresenceNotifications is the PresenceNotifier of the application.
+// Presence changes are not broadcast if it is nil.
+var PresenceNotifications PresenceNotifier
+
+// A userPresence is the presence of a user as stored in the user_presence table
+type userPresence struct {
+	UID          int64     `db:"uid"`
+	LastPoll     time.Time `db:"last_poll"`
+	LastPresence time.Time `db:"last_presence"`
+}
+
+// status returns the status of this presence at the given time
+func (p userPresence) status(now time.Time) PresenceStatus {
+	switch {
+	case now.Sub(p.LastPoll) > PresenceTimeout:
+		return PresenceOffline
+	case now.Sub(p.LastPresence) > PresenceAwayDelay:
+		return PresenceAway
+	}
+	return PresenceOnline
+}
+
+// typingUsers holds the users typing in each channel with the
+// time after which they are not typing anymore.
+var typingUsers = struct {
+	sync.Mutex
+	channels map[string]map[int64]time.Time
+}{
+	channels: make(map[string]map[int64]time.Time),
+}
+
+// declarePresenceModels creates the system model in which the presence
+// of users is stored and the PresenceMixin adding it to user models.
+func declarePresenceModels() {
+	presence := createModel("UserPresence", SystemModel)
+	presence.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true, Unique: true})
+	presence.AddDateTimeField("LastPoll", SimpleFieldParams{JSON: "last_poll", Required: true})
+	presence.AddDateTimeField("LastPresence", SimpleFieldParams{JSON: "last_presence", Required: true})
+	presence.InheritModel(Registry.MustGet("CommonMixin"))
+
+	presenceMixin := NewMixinModel("PresenceMixin")
+	presenceMixin.AddSelectionField("IMStatus", SelectionFieldParams{JSON: "im_status", Compute: "ComputeIMStatus",
+		Help: "Presence of the user whose uid is the id of the record",
+		Selection: types.Selection{
+			string(PresenceOnline):  "Online",
+			string(PresenceAway):    "Away",
+			string(PresenceOffline): "Offline",
+		}})
+
+	presenceMixin.AddMethod("ComputeIMStatus",
+		`ComputeIMStatus updates the IMStatus field with the presence of the
+		user whose uid is the id of the record.`,
+		func(rc RecordCollection) FieldMap {
+			return FieldMap{"IMStatus": string(PresenceStatuses(rc.env, rc.ids[0])[rc.ids[0]])}
+		}).AllowGroup(security.GroupEveryone)
+}
+
+// UpdatePresence records a heartbeat of the user of this Environment, sent
+// by a connected client whose user has been inactive for the given duration.
+// The new status of the user is broadcast with PresenceNotifications if it
+// has changed.
+func (env Environment) UpdatePresence(inactivity time.Duration) {
+	now := time.Now()
+	if inactivity < 0 {
+		inactivity = 0
+	}
+	previous, ok := env.presences(env.uid)[env.uid]
+	current := userPresence{UID: env.uid, LastPoll: now, LastPresence: now.Add(-inactivity)}
+	if ok {
+		if previous.LastPresence.After(current.LastPresence) {
+			// Another client of the user reported a more recent activity
+			current.LastPresence = previous.LastPresence
+		}
+		env.Cr().Execute(`UPDATE user_presence SET last_poll = ?, last_presence = ? WHERE uid = ?`,
+			types.DateTime(current.LastPoll), types.DateTime(current.LastPresence), env.uid)
+	} else {
+		env.Cr().Execute(`INSERT INTO user_presence (uid, last_poll, last_presence) VALUES (?, ?, ?)`,
+			env.uid, types.DateTime(current.LastPoll), types.DateTime(current.LastPresence))
+	}
+	status := current.status(now)
+	if (ok && previous.status(now) == status) || PresenceNotifications == nil {
+		return
+	}
+	if err := PresenceNotifications.NotifyPresence(env.uid, status); err != nil {
+		log.Warn("Unable to notify presence", "uid", env.uid, "status", status, "error", err)
+	}
+}
+
+// presences returns the stored presences of the users with the given uids
+func (env Environment) presences(uids ...int64) map[int64]userPresence {
+	res := make(map[int64]userPresence)
+	if len(uids) == 0 {
+		return res
+	}
+	var lines []userPresence
+	env.Cr().Select(&lines, `SELECT uid, last_poll, last_presence FROM user_presence WHERE uid IN (?)`, uids)
+	for _, line := range lines {
+		res[line.UID] = line
+	}
+	return res
+}
+
+// PresenceStatuses returns the status of the users with the given uids.
+// Users who never sent a heartbeat are offline.
+func PresenceStatuses(env *Environment, uids ...int64) map[int64]PresenceStatus {
+	now := time.Now()
+	presences := env.presences(uids...)
+	res := make(map[int64]PresenceStatus, len(uids))
+	for _, uid := range uids {
+		res[uid] = PresenceOffline
+		if p, ok := presences[uid]; ok {
+			res[uid] = p.status(now)
+		}
+	}
+	return res
+}
+
+// SetTyping sets whether the user of this Environment is typing in the
+// given channel and broadcasts it with PresenceNotifications. Clients
+// must call it again before TypingTimeout while the user is typing.
+func (env Environment) SetTyping(channel string, typing bool) {
+	typingUsers.Lock()
+	users := typingUsers.channels[channel]
+	expiry, wasTyping := users[env.uid]
+	wasTyping = wasTyping && time.Now().Before(expiry)
+	switch {
+	case typing && users == nil:
+		typingUsers.channels[channel] = map[int64]time.Time{env.uid: time.Now().Add(TypingTimeout)}
+	case typing:
+		users[env.uid] = time.Now().Add(TypingTimeout)
+	default:
+		delete(users, env.uid)
+		if len(users) == 0 {
+			delete(typingUsers.channels, channel)
+		}
+	}
+	typingUsers.Unlock()
+	if wasTyping == typing || PresenceNotifications == nil {
+		return
+	}
+	if err := PresenceNotifications.NotifyTyping(channel, env.uid, typing); err != nil {
+		log.Warn("Unable to notify typing", "channel", channel, "uid", env.uid, "error", err)
+	}
+}
+
+// TypingUsers returns the uids of the users typing in the given channel
+func TypingUsers(channel string) []int64 {
+	typingUsers.Lock()
+	defer typingUsers.Unlock()
+	now := time.Now()
+	var res []int64
+	for uid, expiry := range typingUsers.channels[channel] {
+		if now.After(expiry) {
+			delete(typingUsers.channels[channel], uid)
+			continue
+		}
+		res = append(res, uid)
+	}
+	if len(typingUsers.channels[channel]) == 0 {
+		delete(typingUsers.channels, channel)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
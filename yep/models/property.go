@@ -0,0 +1,126 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/security"
+)
+
+// A propertyLine is the value of a property field as stored in the database
+type propertyLine struct {
+	Value string
+}
+
+// declarePropertyModel creates the system model in which the
+// values of property fields are stored.
+//
+// A value with ResID set to 0 is the default value of the field
+// for all records.
+func declarePropertyModel() {
+	property := createModel("Property", SystemModel)
+	property.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	property.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Index: true})
+	property.AddCharField("Field", StringFieldParams{JSON: "field", Required: true})
+	property.AddCharField("KeyValue", StringFieldParams{JSON: "key_value"})
+	property.AddTextField("Value", StringFieldParams{JSON: "value"})
+	property.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// propertyKeySep separates the values of the context keys of
+// property fields depending on several keys in the database.
+const propertyKeySep = "|"
+
+// propertyKeyValue returns the values of the context keys of the given
+// property field as stored in the database. Keys missing from the
+// context have an empty value.
+func (rc RecordCollection) propertyKeyValue(fi *Field) string {
+	values := make([]string, len(fi.contexts))
+	for i, key := range fi.contexts {
+		if rc.env.context == nil || !rc.env.context.HasKey(key) {
+			continue
+		}
+		values[i] = fmt.Sprintf("%v", rc.env.context.Get(key))
+	}
+	return strings.Join(values, propertyKeySep)
+}
+
+// getProperty returns the raw value of the property field fi of this singleton
+// for the current values of its context keys. It falls back to the default value
+// of the field for these key values, and finally to the zero value of the field.
+func (rc RecordCollection) getProperty(fi *Field) interface{} {
+	var lines []propertyLine
+	query := `SELECT value FROM property
+		WHERE res_model = ? AND field = ? AND key_value = ? AND res_id IN (?, 0)
+		ORDER BY res_id DESC LIMIT 1`
+	rc.env.Cr().Select(&lines, query, rc.model.name, fi.json, rc.propertyKeyValue(fi), rc.ids[0])
+	if len(lines) == 0 {
+		return reflect.Zero(fi.structField.Type).Interface()
+	}
+	return rc.model.decodeFieldValue(fi, lines[0].Value)
+}
+
+// setProperty sets the value of the property field fi of the records of rc to
+// value for the current values of its context keys. If rc is empty, value is set
+// as the default value of the field.
+func (rc RecordCollection) setProperty(fi *Field, value interface{}) {
+	ids := rc.ids
+	if len(ids) == 0 {
+		ids = []int64{0}
+	}
+	keyValue := rc.propertyKeyValue(fi)
+	delQuery := `DELETE FROM property WHERE res_model = ? AND field = ? AND key_value = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(delQuery, rc.model.name, fi.json, keyValue, ids)
+	insQuery := `INSERT INTO property (res_model, res_id, field, key_value, value) VALUES (?, ?, ?, ?, ?)`
+	for _, id := range ids {
+		rc.env.Cr().Execute(insQuery, rc.model.name, id, fi.json, keyValue, encodeFieldValue(value))
+	}
+}
+
+// updatePropertyFields writes the values of the property fields of the
+// given FieldMap for all records of rc.
+func (rc RecordCollection) updatePropertyFields(fMap FieldMap) {
+	if rc.IsEmpty() {
+		return
+	}
+	for fName, value := range fMap {
+		fi, ok := rc.model.fields.get(fName)
+		if !ok || !fi.isPropertyField() {
+			continue
+		}
+		if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+			continue
+		}
+		rc.setProperty(fi, value)
+	}
+}
+
+// deleteProperties deletes the values of all property fields of the records of rc.
+// It must be called when the records are deleted.
+func (rc RecordCollection) deleteProperties() {
+	if len(rc.model.fields.propertyFields()) == 0 || len(rc.ids) == 0 {
+		return
+	}
+	query := `DELETE FROM property WHERE res_model = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(query, rc.model.name, rc.ids)
+}
+
+// SetPropertyDefault sets the default value of the given property field for
+// the current values of its context keys. This value is returned for all records
+// of the model that do not have their own value.
+func (rc RecordCollection) SetPropertyDefault(fieldName string, value interface{}) {
+	fi := rc.model.fields.MustGet(fieldName)
+	if !fi.isPropertyField() {
+		log.Panic("Field is not a property field", "model", rc.ModelName(), "field", fieldName)
+	}
+	if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+		log.Panic("You are not allowed to modify this field", "model", rc.ModelName(), "field", fieldName)
+	}
+	fMap := FieldMap{fi.json: value}
+	rc.model.convertValuesToFieldType(&fMap)
+	newRecordCollection(rc.Env(), rc.ModelName()).setProperty(fi, fMap[fi.json])
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// A PushPlatform is a push notification channel of a device
+type PushPlatform string
+
+// Push platforms
+const (
+	// PushFCM devices are reached through Firebase Cloud Messaging
+	PushFCM PushPlatform = "fcm"
+	// PushAPNs devices are reached through the Apple Push Notification service
+	PushAPNs PushPlatform = "apns"
+	// PushWeb devices are browsers reached through the Web Push protocol
+	PushWeb PushPlatform = "webpush"
+)
+
+// A NotificationKind is a kind of notification that
+// users can choose to receive as push notifications.
+type NotificationKind string
+
+// Kinds of notifications
+const (
+	// NotificationChatter notifications are the messages
+	// posted on the records followed by the user.
+	NotificationChatter NotificationKind = "chatter"
+	// NotificationApproval notifications are the records
+	// waiting for the approval of the user.
+	NotificationApproval NotificationKind = "approval"
+)
+
+// ErrInvalidPushToken is returned by PushProvider.SendPush when the device
+// token has expired or has been revoked. The device is then unregistered.
+var ErrInvalidPushToken = errors.New("invalid push token")
+
+// A PushNotification is a notification sent to the devices of a user
+type PushNotification struct {
+	Kind  NotificationKind
+	Title string
+	Body  string
+	// ResModel and ResID are the record the notification is about, if any
+	ResModel string
+	ResID    int64
+}
+
+// A PushProvider sends push notifications to the devices of a platform
+type PushProvider interface {
+	// SendPush sends the given notification to the device with the given
+	// token. It returns ErrInvalidPushToken if the token is not valid anymore.
+	SendPush(token string, notification PushNotification) error
+}
+
+// PushProviders are the PushProvider of each platform. Devices of
+// platforms without provider do not receive push notifications.
+var PushProviders = make(map[PushPlatform]PushProvider)
+
+// A PushDevice is a device registered by a user to receive push notifications
+type PushDevice struct {
+	ID       int64        `db:"id" json:"id"`
+	UID      int64        `db:"uid" json:"uid"`
+	Platform PushPlatform `db:"platform" json:"platform"`
+	Token    string       `db:"token" json:"token"`
+	Name     string       `db:"name" json:"name"`
+}
+
+// pushDeviceColumns are the columns of the push_device table read into PushDevice
+const pushDeviceColumns = `id, uid, platform, token, name`
+
+// declarePushModels creates the system models in which the push devices
+// and the notification preferences of the users are stored.
+func declarePushModels() {
+	device := createModel("PushDevice", SystemModel)
+	device.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true, Index: true})
+	device.AddSelectionField("Platform", SelectionFieldParams{JSON: "platform", Required: true,
+		Selection: types.Selection{
+			string(PushFCM):  "Firebase Cloud Messaging",
+			string(PushAPNs): "Apple Push Notification service",
+			string(PushWeb):  "Web Push",
+		}})
+	device.AddCharField("Token", StringFieldParams{JSON: "token", Required: true, Unique: true})
+	device.AddCharField("Name", StringFieldParams{JSON: "name"})
+	device.InheritModel(Registry.MustGet("CommonMixin"))
+
+	preference := createModel("NotificationPreference", SystemModel)
+	preference.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Required: true, Index: true})
+	preference.AddSelectionField("Kind", SelectionFieldParams{JSON: "kind", Required: true,
+		Selection: types.Selection{
+			string(NotificationChatter):  "Followed records",
+			string(NotificationApproval): "Approvals",
+		}})
+	preference.AddBooleanField("Push", SimpleFieldParams{JSON: "push"})
+	preference.InheritModel(Registry.MustGet("CommonMixin"))
+	preference.AddSQLConstraint("uid_kind_unique", "unique(uid, kind)", "There is already a preference for this kind of notifications")
+}
+
+// RegisterPushDevice registers the device with the given token so that the
+// user of this Environment receives push notifications on it, and returns
+// the id of the device. A device registered by another user is transferred
+// to the user of this Environment.
+func (env Environment) RegisterPushDevice(platform PushPlatform, token, name string) int64 {
+	switch platform {
+	case PushFCM, PushAPNs, PushWeb:
+	default:
+		log.Panic("Unknown push platform", "platform", platform)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		log.Panic("Empty push token", "platform", platform)
+	}
+	var id int64
+	env.Cr().Get(&id, `SELECT COALESCE(MAX(id), 0) FROM push_device WHERE token = ?`, token)
+	if id != 0 {
+		env.Cr().Execute(`UPDATE push_device SET uid = ?, platform = ?, name = ? WHERE id = ?`,
+			env.uid, platform, name, id)
+		return id
+	}
+	env.Cr().Execute(`INSERT INTO push_device (uid, platform, token, name) VALUES (?, ?, ?, ?)`,
+		env.uid, platform, token, name)
+	env.Cr().Get(&id, `SELECT id FROM push_device WHERE token = ?`, token)
+	return id
+}
+
+// UnregisterPushDevice removes the device with the given token from
+// the devices of the user of this Environment.
+func (env Environment) UnregisterPushDevice(token string) {
+	env.Cr().Execute(`DELETE FROM push_device WHERE token = ? AND uid = ?`, strings.TrimSpace(token), env.uid)
+}
+
+// PushDevices returns the devices registered by the user of this Environment
+func (env Environment) PushDevices() []PushDevice {
+	var res []PushDevice
+	query := fmt.Sprintf(`SELECT %s FROM push_device WHERE uid = ? ORDER BY id`, pushDeviceColumns)
+	env.Cr().Select(&res, query, env.uid)
+	return res
+}
+
+// SetPushPreference sets whether the user of this Environment receives
+// the notifications of the given kind as push notifications.
+func (env Environment) SetPushPreference(kind NotificationKind, enabled bool) {
+	switch kind {
+	case NotificationChatter, NotificationApproval:
+	default:
+		log.Panic("Unknown notification kind", "kind", kind)
+	}
+	var count int
+	env.Cr().Get(&count, `SELECT COUNT(*) FROM notification_preference WHERE uid = ? AND kind = ?`, env.uid, kind)
+	if count > 0 {
+		env.Cr().Execute(`UPDATE notification_preference SET push = ? WHERE uid = ? AND kind = ?`, enabled, env.uid, kind)
+		return
+	}
+	env.Cr().Execute(`INSERT INTO notification_preference (uid, kind, push) VALUES (?, ?, ?)`, env.uid, kind, enabled)
+}
+
+// PushPreference returns whether the user of this Environment receives the
+// notifications of the given kind as push notifications, which is the case
+// unless disabled with SetPushPreference.
+func (env Environment) PushPreference(kind NotificationKind) bool {
+	return len(pushRecipients(&env, []int64{env.uid}, kind)) == 1
+}
+
+// pushRecipients returns the given uids but those of the users
+// who disabled push notifications of the given kind.
+func pushRecipients(env *Environment, uids []int64, kind NotificationKind) []int64 {
+	if len(uids) == 0 {
+		return nil
+	}
+	var disabled []int64
+	env.Cr().Select(&disabled, `SELECT uid FROM notification_preference WHERE uid IN (?) AND kind = ? AND push = ?`,
+		uids, kind, false)
+	excluded := make(map[int64]bool, len(disabled))
+	for _, uid := range disabled {
+		excluded[uid] = true
+	}
+	var res []int64
+	for _, uid := range uids {
+		if !excluded[uid] {
+			res = append(res, uid)
+		}
+	}
+	return res
+}
+
+// SendPushNotification sends the given notification to the devices of the
+// users with the given uids, except those who disabled its kind. Devices
+// whose token is not valid anymore are unregistered. It returns the number
+// of devices to which the notification has been sent.
+func SendPushNotification(env *Environment, uids []int64, notification PushNotification) int {
+	if len(PushProviders) == 0 {
+		return 0
+	}
+	uids = pushRecipients(env, uids, notification.Kind)
+	if len(uids) == 0 {
+		return 0
+	}
+	var devices []PushDevice
+	query := fmt.Sprintf(`SELECT %s FROM push_device WHERE uid IN (?) ORDER BY id`, pushDeviceColumns)
+	env.Cr().Select(&devices, query, uids)
+	var count int
+	for _, device := range devices {
+		provider, ok := PushProviders[device.Platform]
+		if !ok {
+			continue
+		}
+		err := provider.SendPush(device.Token, notification)
+		switch err {
+		case nil:
+			count++
+		case ErrInvalidPushToken:
+			log.Info("Unregistering invalid push device", "id", device.ID, "uid", device.UID, "platform", device.Platform)
+			env.Cr().Execute(`DELETE FROM push_device WHERE id = ?`, device.ID)
+		default:
+			log.Warn("Unable to send push notification", "id", device.ID, "uid", device.UID,
+				"platform", device.Platform, "error", err)
+		}
+	}
+	return count
+}
+
+// A PushNotifier is a ChatterNotifier and an ApprovalNotifier that sends the
+// notifications to the devices of the users with SendPushNotification before
+// handing them over to the notifiers it wraps, if any.
+type PushNotifier struct {
+	Chatter   ChatterNotifier
+	Approvals ApprovalNotifier
+}
+
+var _ ChatterNotifier = PushNotifier{}
+var _ ApprovalNotifier = PushNotifier{}
+
+// NotifyFollowers sends the given message to the devices of the followers
+func (p PushNotifier) NotifyFollowers(rc RecordCollection, message ChatterMessage, uids []int64) error {
+	body := message.Body
+	if body == "" && len(message.Tracking) > 0 {
+		fields := make([]string, len(message.Tracking))
+		for i, tv := range message.Tracking {
+			fields[i] = rc.model.getRelatedFieldInfo(tv.Field).description
+		}
+		body = fmt.Sprintf("Modified: %s", strings.Join(fields, ", "))
+	}
+	SendPushNotification(rc.env, uids, PushNotification{
+		Kind:     NotificationChatter,
+		Title:    rc.Sudo().Call("NameGet").(string),
+		Body:     body,
+		ResModel: rc.model.name,
+		ResID:    message.ResID,
+	})
+	if p.Chatter == nil {
+		return nil
+	}
+	return p.Chatter.NotifyFollowers(rc, message, uids)
+}
+
+// NotifyApprovers sends the approval request to the devices of the approvers
+func (p PushNotifier) NotifyApprovers(rc RecordCollection, method string, level ApprovalLevel, uids []int64) error {
+	SendPushNotification(rc.env, uids, PushNotification{
+		Kind:     NotificationApproval,
+		Title:    rc.Sudo().Call("NameGet").(string),
+		Body:     fmt.Sprintf("Waiting for your approval: %s", level.Name),
+		ResModel: rc.model.name,
+		ResID:    rc.ids[0],
+	})
+	if p.Approvals == nil {
+		return nil
+	}
+	return p.Approvals.NotifyApprovers(rc, method, level, uids)
+}
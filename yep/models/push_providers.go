@@ -0,0 +1,539 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default endpoints of the push services
+const (
+	// FCMURL is the endpoint of the Firebase Cloud Messaging HTTP v1 API
+	FCMURL = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	// FCMScope is the OAuth2 scope required to send FCM messages
+	FCMScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// APNsURL is the endpoint of the production Apple Push Notification service
+	APNsURL = "https://api.push.apple.com"
+	// APNsSandboxURL is the endpoint of the development Apple Push Notification service
+	APNsSandboxURL = "https://api.sandbox.push.apple.com"
+)
+
+// apnsTokenLifetime is the duration after which the APNs provider token is
+// renewed. Apple rejects tokens older than one hour and refuses to renew
+// them more than once every twenty minutes.
+const apnsTokenLifetime = 40 * time.Minute
+
+// pushData returns the custom data sent with the given notification
+func pushData(notification PushNotification) map[string]string {
+	data := map[string]string{"kind": string(notification.Kind)}
+	if notification.ResModel != "" {
+		data["res_model"] = notification.ResModel
+		data["res_id"] = strconv.FormatInt(notification.ResID, 10)
+	}
+	return data
+}
+
+// signJWT returns the JSON Web Token with the given header and claims
+// signed with the given RSA (RS256) or ECDSA P-256 (ES256) private key.
+func signJWT(header, claims map[string]interface{}, key crypto.Signer) (string, error) {
+	var parts []string
+	for _, part := range []map[string]interface{}{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS signatures are the concatenation of r and s, each padded to the size of the curve
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	default:
+		return "", fmt.Errorf("unsupported JWT signing key %T", key)
+	}
+	return strings.Join(parts, ".") + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parsePrivateKey parses the given PEM encoded PKCS#8, PKCS#1 or SEC 1 private key
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// parseP256Key parses the given PEM encoded ECDSA P-256 private key
+func parseP256Key(data []byte) (*ecdsa.PrivateKey, error) {
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve.Params().Name != "P-256" {
+		return nil, errors.New("not an ECDSA P-256 private key")
+	}
+	return ecKey, nil
+}
+
+// FCMPush is a PushProvider sending notifications with Firebase Cloud
+// Messaging. It authenticates with the service account of a Firebase project.
+// FCMPush values must be created with NewFCMPush.
+type FCMPush struct {
+	// ProjectID is the id of the Firebase project
+	ProjectID string
+	// ClientEmail is the email of the service account
+	ClientEmail string
+	// TokenURL is the OAuth2 endpoint from which access tokens are obtained
+	TokenURL string
+	// URL is the endpoint of the API, with a %s verb for the project id.
+	// FCMURL is used if empty.
+	URL string
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+	key     crypto.Signer
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+}
+
+var _ PushProvider = new(FCMPush)
+
+// NewFCMPush returns an FCMPush provider for the service account
+// with the given JSON credentials, as downloaded from the Firebase console.
+func NewFCMPush(credentials []byte) (*FCMPush, error) {
+	var account struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(credentials, &account); err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials: %s", err)
+	}
+	key, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM private key: %s", err)
+	}
+	return &FCMPush{
+		ProjectID:   account.ProjectID,
+		ClientEmail: account.ClientEmail,
+		TokenURL:    account.TokenURI,
+		key:         key,
+	}, nil
+}
+
+// accessToken returns an OAuth2 access token of the service account,
+// requesting a new one from TokenURL if the current one has expired.
+func (f *FCMPush) accessToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.token != "" && now.Before(f.expiry) {
+		return f.token, nil
+	}
+	assertion, err := signJWT(map[string]interface{}{"alg": "RS256", "typ": "JWT"}, map[string]interface{}{
+		"iss":   f.ClientEmail,
+		"scope": FCMScope,
+		"aud":   f.TokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, f.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	client := http.Client{Timeout: f.Timeout}
+	resp, err := client.PostForm(f.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("unable to get FCM access token: %s", err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("invalid FCM token response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest || res.AccessToken == "" {
+		return "", fmt.Errorf("unable to get FCM access token (%s): %s", resp.Status, res.Error)
+	}
+	// Renew the token one minute before it expires
+	f.token = res.AccessToken
+	f.expiry = now.Add(time.Duration(res.ExpiresIn)*time.Second - time.Minute)
+	return f.token, nil
+}
+
+// SendPush sends the given notification to the device with the given registration token
+func (f *FCMPush) SendPush(token string, notification PushNotification) error {
+	accessToken, err := f.accessToken()
+	if err != nil {
+		return err
+	}
+	endpoint := f.URL
+	if endpoint == "" {
+		endpoint = FCMURL
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": notification.Title, "body": notification.Body},
+			"data":         pushData(notification),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(endpoint, f.ProjectID), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	client := http.Client{Timeout: f.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach FCM: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	var res struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode == http.StatusNotFound || res.Error.Status == "UNREGISTERED" {
+		return ErrInvalidPushToken
+	}
+	return fmt.Errorf("FCM error (%s): %s", resp.Status, res.Error.Message)
+}
+
+// APNsPush is a PushProvider sending notifications with the Apple Push
+// Notification service. It authenticates with a token signing key of an
+// Apple developer account. APNsPush values must be created with NewAPNsPush.
+type APNsPush struct {
+	// KeyID is the id of the signing key
+	KeyID string
+	// TeamID is the id of the Apple developer team
+	TeamID string
+	// Topic is the bundle id of the application
+	Topic string
+	// URL is the endpoint of the service. APNsURL is used if empty.
+	URL string
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+	key     *ecdsa.PrivateKey
+	mu      sync.Mutex
+	token   string
+	issued  time.Time
+}
+
+var _ PushProvider = new(APNsPush)
+
+// NewAPNsPush returns an APNsPush provider for the application with
+// the given bundle id (topic), authenticated with the given PEM encoded
+// signing key (.p8 file) of the given team.
+func NewAPNsPush(key []byte, keyID, teamID, topic string) (*APNsPush, error) {
+	ecKey, err := parseP256Key(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs signing key: %s", err)
+	}
+	return &APNsPush{KeyID: keyID, TeamID: teamID, Topic: topic, key: ecKey}, nil
+}
+
+// providerToken returns the JWT with which requests are authenticated,
+// signing a new one if the current one is older than apnsTokenLifetime.
+func (a *APNsPush) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.token != "" && now.Sub(a.issued) < apnsTokenLifetime {
+		return a.token, nil
+	}
+	token, err := signJWT(map[string]interface{}{"alg": "ES256", "kid": a.KeyID},
+		map[string]interface{}{"iss": a.TeamID, "iat": now.Unix()}, a.key)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = token, now
+	return token, nil
+}
+
+// SendPush sends the given notification to the device with the given device token
+func (a *APNsPush) SendPush(token string, notification PushNotification) error {
+	providerToken, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	endpoint := a.URL
+	if endpoint == "" {
+		endpoint = APNsURL
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": notification.Title, "body": notification.Body},
+			"sound": "default",
+		},
+	}
+	for key, value := range pushData(notification) {
+		payload[key] = value
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	endpoint = fmt.Sprintf("%s/3/device/%s", strings.TrimSuffix(endpoint, "/"), url.PathEscape(token))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	client := http.Client{Timeout: a.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach APNs: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var res struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	switch {
+	case resp.StatusCode == http.StatusGone, res.Reason == "BadDeviceToken", res.Reason == "Unregistered":
+		return ErrInvalidPushToken
+	}
+	return fmt.Errorf("APNs error (%s): %s", resp.Status, res.Reason)
+}
+
+// WebPush is a PushProvider sending notifications to browsers with the Web
+// Push protocol. Payloads are encrypted as specified in RFC 8291 and requests
+// are authenticated with VAPID (RFC 8292). Device tokens are the JSON
+// serialization of the PushSubscription objects of the browsers.
+// WebPush values must be created with NewWebPush.
+type WebPush struct {
+	// Subject is the contact of the application server given
+	// to push services, e.g. "mailto:admin@example.com"
+	Subject string
+	// TTL is the duration during which push services keep the
+	// notifications of offline devices. 4 weeks if 0.
+	TTL time.Duration
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+	key     *ecdsa.PrivateKey
+}
+
+var _ PushProvider = new(WebPush)
+
+// NewWebPush returns a WebPush provider authenticated with the given
+// PEM encoded ECDSA P-256 private key (VAPID key).
+func NewWebPush(key []byte, subject string) (*WebPush, error) {
+	ecKey, err := parseP256Key(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID key: %s", err)
+	}
+	return &WebPush{Subject: subject, key: ecKey}, nil
+}
+
+// PublicKey returns the VAPID public key of this provider, base64url
+// encoded, to be given as applicationServerKey to the subscribe method
+// of the PushManager of browsers.
+func (w *WebPush) PublicKey() string {
+	key, err := w.key.ECDH()
+	if err != nil {
+		log.Panic("Invalid VAPID key", "error", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// A webPushSubscription is a PushSubscription of a browser
+type webPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// SendPush sends the given notification to the browser whose
+// PushSubscription is given as JSON in token.
+func (w *WebPush) SendPush(token string, notification PushNotification) error {
+	var sub webPushSubscription
+	if err := json.Unmarshal([]byte(token), &sub); err != nil || sub.Endpoint == "" {
+		return ErrInvalidPushToken
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return ErrInvalidPushToken
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"title": notification.Title,
+		"body":  notification.Body,
+		"data":  pushData(notification),
+	})
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(payload, sub, rand.Reader)
+	if err != nil {
+		return ErrInvalidPushToken
+	}
+	jwt, err := signJWT(map[string]interface{}{"typ": "JWT", "alg": "ES256"}, map[string]interface{}{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": w.Subject,
+	}, w.key)
+	if err != nil {
+		return err
+	}
+	ttl := w.TTL
+	if ttl == 0 {
+		ttl = 4 * 7 * 24 * time.Hour
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", jwt, w.PublicKey()))
+	client := http.Client{Timeout: w.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach push service: %s", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		return ErrInvalidPushToken
+	case resp.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("push service error: %s", resp.Status)
+	}
+	return nil
+}
+
+// hkdf returns length bytes of key material derived with HKDF-SHA-256
+// (RFC 5869) from the given input key material, salt and info.
+// length must not exceed the size of a SHA-256 hash.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// encryptWebPush encrypts the given payload for the browser of the given
+// subscription with the aes128gcm content encoding of RFC 8291, taking the
+// ephemeral key and the salt from the given random source.
+func encryptWebPush(payload []byte, sub webPushSubscription, random io.Reader) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	secret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The payload is sent in a single record, terminated by the 0x02 delimiter
+	record := append(append([]byte{}, payload...), 2)
+	recordSize := 4096
+	if len(record)+gcm.Overhead() > recordSize {
+		recordSize = len(record) + gcm.Overhead()
+	}
+	header := make([]byte, 21, 21+len(asPublicBytes))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], uint32(recordSize))
+	header[20] = byte(len(asPublicBytes))
+	header = append(header, asPublicBytes...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
@@ -16,12 +16,17 @@ package models
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/npiganeau/yep/yep/models/fieldtype"
 	"github.com/npiganeau/yep/yep/models/operator"
 )
 
+// orderColumnPrefix is the prefix of the columns that are added to select
+// queries to order by selection fields with declared options.
+const orderColumnPrefix = "__order__"
+
 // An SQLParams is a list of parameters that are passed to the
 // DB server with the query string and that will be used in the
 // placeholders.
@@ -46,12 +51,16 @@ type Query struct {
 	offset    int
 	groups    []string
 	orders    []string
+	// granularities of the date groups, by jsonized field path
+	granularities map[string]DateGranularity
 }
 
 // clone returns a pointer to a deep copy of this Query
 func (q Query) clone() *Query {
 	newCond := *q.cond
 	q.cond = &newCond
+	q.groups = append([]string(nil), q.groups...)
+	q.orders = append([]string(nil), q.orders...)
 	return &q
 }
 
@@ -79,6 +88,10 @@ func (q *Query) conditionSQLClause(c *Condition) (string, SQLParams) {
 
 	first := true
 	for _, val := range c.predicates {
+		if val.isCond && (val.cond == nil || val.cond.IsEmpty()) {
+			// Empty nested conditions would give "()"
+			continue
+		}
 		vSQL, vArgs := q.predicateSQLClause(val, first)
 		first = false
 		sql += vSQL
@@ -130,9 +143,17 @@ func (q *Query) predicateSQLClause(p predicate, first ...bool) (string, SQLParam
 		return sql, args
 	}
 
-	opSql, arg := adapter.operatorSQL(p.operator, p.arg)
+	arg := p.arg
+	fi := q.recordSet.model.getRelatedFieldInfo(strings.Join(exprs, ExprSep))
+	if fi.isEncrypted() {
+		arg = fi.encryptedSearchArg(p.operator, arg)
+	}
+	opSql, arg := adapter.operatorSQL(p.operator, arg)
+	if p.operator.IsHierarchical() {
+		opSql = q.hierarchySQL(fi, p.operator)
+	}
 	sql += fmt.Sprintf(`%s %s `, field, opSql)
-	args = append(args, arg)
+	args = append(args, fi.sqlArg(arg))
 	return sql, args
 }
 
@@ -150,30 +171,75 @@ func (q *Query) sqlLimitOffsetClause() string {
 }
 
 // sqlOrderByClause returns the sql string for the ORDER BY clause
-// of this Query
+// of this Query. Queries without GROUP BY clause are ordered by id
+// last, so that the order of records with equal values is stable.
 func (q *Query) sqlOrderByClause() string {
-	if len(q.orders) == 0 {
+	orders := q.orderExprs()
+	if len(orders) == 0 {
 		return "ORDER BY id"
 	}
 
-	var fExprs [][]string
-	directions := make([]string, len(q.orders))
-	for i, order := range q.orders {
-		fieldOrder := strings.Split(strings.TrimSpace(order), " ")
+	var hasID bool
+	resSlice := make([]string, len(orders))
+	for i, order := range orders {
+		fieldOrder := strings.Split(order, " ")
 		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(fieldOrder[0], ExprSep))
-		fExprs = append(fExprs, oExprs)
+		if len(oExprs) == 1 && oExprs[0] == "id" {
+			hasID = true
+		}
+		if _, ok := q.selectionOrderExpression(oExprs); ok {
+			resSlice[i] = orderColumnName(oExprs)
+		} else {
+			resSlice[i] = q.groupFieldExpression(oExprs)
+		}
 		if len(fieldOrder) > 1 {
-			directions[i] = fieldOrder[1]
+			resSlice[i] += fmt.Sprintf(" %s", fieldOrder[1])
 		}
 	}
-	resSlice := make([]string, len(q.orders))
-	for i, field := range fExprs {
-		resSlice[i] = q.joinedFieldExpression(field)
-		resSlice[i] += fmt.Sprintf(" %s", directions[i])
+	if !hasID && len(q.groups) == 0 {
+		resSlice = append(resSlice, "id")
 	}
 	return fmt.Sprintf("ORDER BY %s", strings.Join(resSlice, ", "))
 }
 
+// selectionOrderExpression returns the SQL expression giving the position of
+// the value of the selection field pointed at by exprs in its declared options.
+// The second returned value is false if exprs does not point to a selection
+// field with declared options.
+func (q *Query) selectionOrderExpression(exprs []string) (string, bool) {
+	fi := q.recordSet.model.getRelatedFieldInfo(strings.Join(exprs, ExprSep))
+	if fi.fieldType != fieldtype.Selection || len(fi.selectionOptions) == 0 {
+		return "", false
+	}
+	whens := make([]string, len(fi.selectionOptions))
+	for i, opt := range fi.selectionOptions {
+		whens[i] = fmt.Sprintf("WHEN '%s' THEN %d", strings.Replace(opt.Value, "'", "''", -1), i)
+	}
+	return fmt.Sprintf("CASE %s %s ELSE %d END", q.joinedFieldExpression(exprs), strings.Join(whens, " "),
+		len(whens)), true
+}
+
+// selectionOrderFieldsSQL returns the SQL string to append to the fields of a select
+// query for each selection field with declared options of the ORDER BY clause.
+// Since queries are DISTINCT, the order expressions must appear in the fields.
+func (q *Query) selectionOrderFieldsSQL() string {
+	var res string
+	for _, order := range q.orderExprs() {
+		orderField := strings.Split(strings.TrimSpace(order), " ")[0]
+		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(orderField, ExprSep))
+		if caseExpr, ok := q.selectionOrderExpression(oExprs); ok {
+			res += fmt.Sprintf(", %s AS %s", caseExpr, orderColumnName(oExprs))
+		}
+	}
+	return res
+}
+
+// orderColumnName returns the name of the column added to select
+// queries to order by the selection field pointed at by exprs.
+func orderColumnName(exprs []string) string {
+	return orderColumnPrefix + strings.Join(exprs, sqlSep)
+}
+
 // sqlGroupByClause returns the sql string for the GROUP BY clause
 // of this Query
 func (q *Query) sqlGroupByClause() string {
@@ -184,7 +250,7 @@ func (q *Query) sqlGroupByClause() string {
 	}
 	resSlice := make([]string, len(q.groups))
 	for i, field := range fExprs {
-		resSlice[i] = q.joinedFieldExpression(field)
+		resSlice[i] = q.groupFieldExpression(field)
 	}
 	return fmt.Sprintf("GROUP BY %s", strings.Join(resSlice, ", "))
 }
@@ -216,14 +282,79 @@ func (q *Query) insertQuery(data FieldMap) (string, SQLParams) {
 		if fi.fieldType.IsFKRelationType() && !fi.required && v.(int64) == 0 {
 			continue
 		}
+		if fi.isEncrypted() {
+			v = fi.encryptValue(v)
+		}
 		cols = append(cols, fi.json)
-		vals = append(vals, v)
+		vals = append(vals, fi.sqlArg(v))
 		i++
 	}
 	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
 	fields := strings.Join(cols, ", ")
 	values := "?" + strings.Repeat(", ?", i-1)
-	sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING id", tableName, fields, values)
+	sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tableName, fields, values)
+	if adapter.supportsReturning() {
+		sql += " RETURNING id"
+	}
+	return sql, vals
+}
+
+// maxInsertRows is the maximum number of rows inserted by a single query
+// of insertMultiQuery, so as to stay below the limit of query parameters.
+const maxInsertRows = 500
+
+// insertMultiQuery returns the SQL query string and parameters to insert
+// a row for each of the given data in a single query. The ids of the rows
+// are returned in the order of data. Columns that are not given for a row
+// are set to their default value.
+func (q *Query) insertMultiQuery(data []FieldMap) (string, SQLParams) {
+	adapter := adapters[db.DriverName()]
+	rows := make([]map[string]interface{}, len(data))
+	colsSet := make(map[string]bool)
+	for i, fMap := range data {
+		rows[i] = make(map[string]interface{})
+		for k, v := range fMap {
+			fi := q.recordSet.model.fields.MustGet(k)
+			if fi.fieldType.IsFKRelationType() && !fi.required && v.(int64) == 0 {
+				continue
+			}
+			if fi.isEncrypted() {
+				v = fi.encryptValue(v)
+			}
+			rows[i][fi.json] = fi.sqlArg(v)
+			colsSet[fi.json] = true
+		}
+	}
+	if len(colsSet) == 0 {
+		log.Panic("No data given for insert")
+	}
+	cols := make([]string, 0, len(colsSet))
+	for col := range colsSet {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	var (
+		vals      SQLParams
+		valuesSQL []string
+	)
+	for _, row := range rows {
+		values := make([]string, len(cols))
+		for j, col := range cols {
+			v, ok := row[col]
+			if !ok {
+				values[j] = "DEFAULT"
+				continue
+			}
+			values[j] = "?"
+			vals = append(vals, v)
+		}
+		valuesSQL = append(valuesSQL, fmt.Sprintf("(%s)", strings.Join(values, ", ")))
+	}
+	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tableName, strings.Join(cols, ", "), strings.Join(valuesSQL, ", "))
+	if adapter.supportsReturning() {
+		sql += " RETURNING id"
+	}
 	return sql, vals
 }
 
@@ -251,7 +382,7 @@ func (q *Query) selectQuery(fields []string) (string, SQLParams) {
 	fieldExprs, allExprs := q.selectData(fields)
 	// Build up the query
 	// Fields
-	fieldsSQL := q.fieldsSQL(fieldExprs)
+	fieldsSQL := q.fieldsSQL(fieldExprs) + q.selectionOrderFieldsSQL()
 	// Tables
 	tablesSQL := q.tablesSQL(allExprs)
 	// Where clause and args
@@ -284,7 +415,7 @@ func (q *Query) selectGroupQuery(fields map[string]string) (string, SQLParams) {
 	fieldExprs, allExprs := q.selectData(fieldsList)
 	// Build up the query
 	// Fields
-	fieldsSQL := q.fieldsGroupSQL(fieldExprs, fields)
+	fieldsSQL := q.fieldsGroupSQL(fieldExprs, fields) + q.selectionOrderFieldsSQL()
 	// Tables
 	tablesSQL := q.tablesSQL(allExprs)
 	// Where clause and args
@@ -309,7 +440,7 @@ func (q *Query) selectData(fields []string) ([][]string, [][]string) {
 		fieldExprs[i] = jsonizeExpr(q.recordSet.model, strings.Split(f, ExprSep))
 	}
 	// Add 'order by' exprs
-	for _, order := range q.orders {
+	for _, order := range q.orderExprs() {
 		orderField := strings.Split(strings.TrimSpace(order), " ")[0]
 		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(orderField, ExprSep))
 		fieldExprs = append(fieldExprs, oExprs)
@@ -334,8 +465,11 @@ func (q *Query) updateQuery(data FieldMap) (string, SQLParams) {
 	)
 	for k, v := range data {
 		fi := q.recordSet.model.fields.MustGet(k)
+		if fi.isEncrypted() {
+			v = fi.encryptValue(v)
+		}
 		cols[i] = fmt.Sprintf("%s = ?", fi.json)
-		vals[i] = v
+		vals[i] = fi.sqlArg(v)
 		i++
 	}
 	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
@@ -365,9 +499,13 @@ func (q *Query) fieldsGroupSQL(fieldExprs [][]string, fields map[string]string)
 	fStr := make([]string, len(fieldExprs)+1)
 	for i, exprs := range fieldExprs {
 		aggFnct := fields[strings.Join(exprs, ExprSep)]
+		if aggFnct == "" {
+			fStr[i] = fmt.Sprintf("%s AS %s", q.groupFieldExpression(exprs), strings.Join(exprs, sqlSep))
+			continue
+		}
 		joins := q.generateTableJoins(exprs)
 		num := len(joins)
-		fStr[i] = fmt.Sprintf("%s(%s.%s) AS %s", aggFnct, joins[num-1].alias, exprs[num-1], strings.Join(exprs, sqlSep))
+		fStr[i] = fmt.Sprintf("%s(%s.%s) AS %s", aggFnct, joins[num-1].alias, exprs[len(exprs)-1], strings.Join(exprs, sqlSep))
 	}
 	fStr[len(fieldExprs)] = "count(1) AS __count"
 	return strings.Join(fStr, ", ")
@@ -380,10 +518,12 @@ func (q *Query) fieldsGroupSQL(fieldExprs [][]string, fields map[string]string)
 func (q *Query) joinedFieldExpression(exprs []string, withAlias ...bool) string {
 	joins := q.generateTableJoins(exprs)
 	num := len(joins)
+	// Many2many relations add two joins, so we do not rely on num for exprs
+	lastExpr := exprs[len(exprs)-1]
 	if len(withAlias) > 0 && withAlias[0] {
-		return fmt.Sprintf("%s.%s AS %s", joins[num-1].alias, exprs[num-1], strings.Join(exprs, sqlSep))
+		return fmt.Sprintf("%s.%s AS %s", joins[num-1].alias, lastExpr, strings.Join(exprs, sqlSep))
 	}
-	return fmt.Sprintf("%s.%s", joins[num-1].alias, exprs[num-1])
+	return fmt.Sprintf("%s.%s", joins[num-1].alias, lastExpr)
 }
 
 // generateTableJoins transforms a list of fields expression into a list of tableJoins
@@ -425,6 +565,20 @@ func (q *Query) generateTableJoins(fieldExprs []string) []tableJoin {
 			field, otherField = "id", expr
 		case fieldtype.One2Many, fieldtype.Rev2One:
 			field, otherField = jsonizePath(fi.relatedModel, fi.reverseFK), "id"
+		case fieldtype.Many2Many:
+			// We first join the relation table and then the related model table
+			relAlias := fmt.Sprintf("%s%s%s", alias, sqlSep, fi.m2mRelModel.tableName)
+			relTJ := tableJoin{
+				tableName:  adapter.quoteTableName(fi.m2mRelModel.tableName),
+				joined:     true,
+				field:      fi.m2mOurField.json,
+				otherTable: curTJ,
+				otherField: "id",
+				alias:      adapter.quoteTableName(relAlias),
+			}
+			joins = append(joins, relTJ)
+			curTJ = &relTJ
+			field, otherField = "id", fi.m2mTheirField.json
 		}
 
 		nextTJ := tableJoin{
@@ -14,7 +14,10 @@
 
 package models
 
-import "github.com/npiganeau/yep/yep/models/security"
+import (
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+)
 
 // computeFieldValues updates the given params with the given computed (non stored) fields
 // or all the computed fields of the model if not given.
@@ -38,27 +41,234 @@ func (rc RecordCollection) computeFieldValues(params *FieldMap, fields ...string
 	}
 }
 
-//updateStoredFields updates all dependent fields of rc that are included in the given FieldMap.
-func (rc RecordCollection) updateStoredFields(fMap FieldMap) {
-	fieldNames := fMap.Keys()
-	var toUpdate []computeData
+// getComputed returns the value of the given non stored computed field for
+// the first record of rc. Values of fields with depends are kept in cache
+// until one of their dependencies is modified. Fields without depends are
+// computed at each call.
+func (rc RecordCollection) getComputed(fi *Field) interface{} {
+	ref := newComputedRef(rc.env, rc.model, rc.ids[0], fi.json)
+	if len(fi.depends) > 0 {
+		if value, ok := rc.env.cache.getComputed(ref); ok {
+			return value
+		}
+	}
+	fMap := make(FieldMap)
+	rc.computeFieldValues(&fMap, fi.json)
+	// Cache all the fields computed by the same method
+	for jsonName, value := range fMap {
+		cfi, ok := rc.model.fields.get(jsonName)
+		if !ok || cfi.isStored() || len(cfi.depends) == 0 {
+			continue
+		}
+		rc.env.cache.addComputed(newComputedRef(rc.env, rc.model, rc.ids[0], jsonName), value)
+	}
+	return fMap[fi.json]
+}
+
+// invalidateCache removes the given fields of the records of rc from the
+// cache, as well as the cached values that depend on them.
+func (rc RecordCollection) invalidateCache(fieldNames []string) {
+	jsonNames := make([]string, 0, len(fieldNames))
+	for _, fName := range fieldNames {
+		if fi, ok := rc.model.fields.get(fName); ok {
+			jsonNames = append(jsonNames, fi.json)
+		}
+	}
+	rc.env.cache.invalidateFields(rc.model, rc.ids, jsonNames...)
+	rc.model.invalidateDependentFields(rc.env.cache, jsonNames, make(map[computeKey]bool))
+}
+
+// invalidateDependentFields removes from the given cache the values of
+// all records that depend on the given fields of this model:
+//
+// - the reverse relation fields of the related models, i.e. one2many and
+// rev2one fields mirroring a foreign key and the other side of many2many,
+//
+// - the non stored computed fields whose depends include these fields,
+// recursively. Stored computed fields are invalidated when they are
+// recomputed and written.
+//
+// done holds the compute methods already processed.
+func (m *Model) invalidateDependentFields(c *cache, fieldNames []string, done map[computeKey]bool) {
+	for _, fName := range fieldNames {
+		fi, ok := m.fields.get(fName)
+		if !ok {
+			continue
+		}
+		if fi.relatedModel != nil {
+			for _, rfi := range fi.relatedModel.fields.registryByJSON {
+				reverseFK := fi.fieldType.IsFKRelationType() && rfi.fieldType.IsReverseRelationType() && rfi.reverseFK == fi.name
+				otherM2M := fi.fieldType == fieldtype.Many2Many && rfi != fi && rfi.m2mRelModel == fi.m2mRelModel
+				if reverseFK || otherM2M {
+					c.invalidateFields(fi.relatedModel, nil, rfi.json)
+				}
+			}
+		}
+		for _, cData := range fi.dependencies {
+			key := computeKey{modelInfo: cData.modelInfo, compute: cData.compute}
+			if done[key] {
+				continue
+			}
+			done[key] = true
+			var computed []string
+			for _, cfi := range cData.modelInfo.fields.computedFields {
+				if cfi.compute == cData.compute {
+					computed = append(computed, cfi.json)
+				}
+			}
+			c.invalidateFields(cData.modelInfo, nil, computed...)
+			cData.modelInfo.invalidateDependentFields(c, computed, done)
+		}
+	}
+}
+
+// hasReverseDependencies returns true if fields of other records, reached
+// through a relation, are computed from the stored fields of this model.
+func (m *Model) hasReverseDependencies() bool {
+	for _, fi := range m.fields.registryByName {
+		if !fi.isStored() {
+			continue
+		}
+		for _, cData := range fi.dependencies {
+			if cData.path != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dependencyEnv returns the Environment in which the records depending on rc
+// are looked for. It runs as superuser and includes archived records so that
+// neither record rules nor the Active field hide records to recompute.
+func (rc RecordCollection) dependencyEnv() Environment {
+	return rc.Sudo().WithContext(activeTestContextKey, false).Env()
+}
+
+// computeTargets returns the records to recompute for each computeData
+// that depends on one of the given fields of rc.
+func (rc RecordCollection) computeTargets(fieldNames []string) map[computeData]RecordCollection {
+	res := make(map[computeData]RecordCollection)
+	rSet := rc.Fetch()
+	if rSet.IsEmpty() {
+		return res
+	}
+	depEnv := rSet.dependencyEnv()
 	for _, fieldName := range fieldNames {
 		refFieldInfo, ok := rc.model.fields.get(fieldName)
 		if !ok {
 			continue
 		}
-		toUpdate = append(toUpdate, refFieldInfo.dependencies...)
+		for _, cData := range refFieldInfo.dependencies {
+			recs := rSet
+			if cData.path != "" {
+				recs = depEnv.Pool(cData.modelInfo.name).Search(cData.modelInfo.Field(cData.path).In(rSet.Ids())).Fetch().WithEnv(*rSet.env)
+			}
+			if prev, exists := res[cData]; exists {
+				recs = prev.Union(recs)
+			}
+			res[cData] = recs
+		}
 	}
-	// Compute all that must be computed and store the values
-	rSet := rc.Fetch()
-	for _, cData := range toUpdate {
-		recs := rSet.env.Pool(cData.modelInfo.name)
-		if cData.path != "" {
-			recs = recs.Search(rSet.Model().Field(cData.path).In(rSet.Ids()))
-		} else {
-			recs = rSet
-		}
-		recs = recs.Fetch()
+	return res
+}
+
+// updateStoredFields updates all dependent fields of rc that are included in the given FieldMap.
+//
+// previousTargets are records to recompute in addition to those found with
+// the current values of rc. They are typically the targets computed before
+// an update, so that records that were related to rc before the update are also
+// recomputed.
+func (rc RecordCollection) updateStoredFields(fMap FieldMap, previousTargets ...map[computeData]RecordCollection) {
+	rc.recompute(append(previousTargets, rc.computeTargets(fMap.Keys()))...)
+}
+
+// recompute adds the given targets to the recompute queue of the Environment
+// and processes the queue. If the queue is already being processed, i.e. if
+// rc is being written by a compute method, the targets are recomputed later
+// by the caller in the dependency order.
+func (rc RecordCollection) recompute(targets ...map[computeData]RecordCollection) {
+	queue := rc.env.recomputeQueue
+	if queue == nil {
+		queue = newRecomputeQueue()
+	}
+	for _, t := range targets {
+		queue.add(t)
+	}
+	if queue.processing {
+		return
+	}
+	queue.process()
+}
+
+// A recomputeQueue holds the records waiting for the recomputation of
+// their stored computed fields in an Environment.
+type recomputeQueue struct {
+	processing bool
+	targets    map[computeData]RecordCollection
+}
+
+// newRecomputeQueue returns a pointer to a new empty recomputeQueue
+func newRecomputeQueue() *recomputeQueue {
+	return &recomputeQueue{
+		targets: make(map[computeData]RecordCollection),
+	}
+}
+
+// add the given targets to this queue
+func (q *recomputeQueue) add(targets map[computeData]RecordCollection) {
+	for cData, recs := range targets {
+		if prev, exists := q.targets[cData]; exists {
+			recs = prev.Union(recs)
+		}
+		q.targets[cData] = recs
+	}
+}
+
+// pop removes from this queue and returns the target with the lowest rank,
+// so that a compute method is only called once all the compute methods it
+// depends on have been called.
+func (q *recomputeQueue) pop() (computeData, RecordCollection) {
+	var (
+		res   computeData
+		found bool
+	)
+	for cData := range q.targets {
+		if !found || computeDataLess(cData, res) {
+			res = cData
+			found = true
+		}
+	}
+	recs := q.targets[res]
+	delete(q.targets, res)
+	return res, recs
+}
+
+// computeDataLess returns true if a must be recomputed before b.
+func computeDataLess(a, b computeData) bool {
+	rankA := computeRanks[computeKey{modelInfo: a.modelInfo, compute: a.compute}]
+	rankB := computeRanks[computeKey{modelInfo: b.modelInfo, compute: b.compute}]
+	switch {
+	case rankA != rankB:
+		return rankA < rankB
+	case a.modelInfo.name != b.modelInfo.name:
+		return a.modelInfo.name < b.modelInfo.name
+	case a.compute != b.compute:
+		return a.compute < b.compute
+	}
+	return a.path < b.path
+}
+
+// process computes and stores the values of the targets of this queue,
+// including those added while processing, in the dependency order.
+func (q *recomputeQueue) process() {
+	q.processing = true
+	defer func() {
+		q.processing = false
+		q.targets = make(map[computeData]RecordCollection)
+	}()
+	for len(q.targets) > 0 {
+		cData, recs := q.pop()
 		for _, rec := range recs.Records() {
 			retVal := rec.CallMulti(cData.compute)
 			vals := retVal[0].(FieldMapper).FieldMap()
@@ -0,0 +1,81 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+)
+
+// copyNameSuffix is appended to the name of duplicated records
+const copyNameSuffix = " (copy)"
+
+// isCopiedField returns true if the value of this field
+// must be given when duplicating a record.
+func (f *Field) isCopiedField() bool {
+	switch {
+	case f.noCopy, f.json == "id":
+		return false
+	case f.fieldType.IsReverseRelationType():
+		// Lines are copied after the record itself
+		return false
+	case f.isComputedField() && !f.isStored():
+		return false
+	}
+	return true
+}
+
+// copyData returns the values with which to create a duplicate of this
+// singleton. Values of overrides take precedence over the values of the
+// record. If it is not overridden, the name of the record is suffixed
+// with copyNameSuffix.
+func (rc RecordCollection) copyData(overrides FieldMap) FieldMap {
+	res := make(FieldMap)
+	for _, fi := range rc.model.fields.registryByName {
+		if !fi.isCopiedField() || !checkFieldPermission(fi, rc.env.uid, security.Read|security.Write) {
+			continue
+		}
+		value := rc.Get(fi.name)
+		if rs, ok := value.(RecordSet); ok {
+			ids := rs.Ids()
+			switch {
+			case fi.fieldType == fieldtype.Many2Many:
+				value = ids
+			case len(ids) == 0:
+				value = nil
+			default:
+				value = ids[0]
+			}
+		}
+		res[fi.json] = value
+	}
+	if nameFI, ok := rc.model.fields.get("name"); ok && nameFI.isCopiedField() && nameFI.fieldType == fieldtype.Char {
+		if name, _ := res[nameFI.json].(string); name != "" {
+			res[nameFI.json] = name + copyNameSuffix
+		}
+	}
+	for key, value := range overrides {
+		res[rc.model.JSONizeFieldName(key)] = value
+	}
+	return res
+}
+
+// copyLines duplicates the lines of the one2many fields of this singleton
+// and links them to the newRecord. Lines are duplicated with their model's
+// Copy method and keep their name.
+func (rc RecordCollection) copyLines(newRecord RecordCollection) {
+	for _, fi := range rc.model.fields.registryByName {
+		if fi.fieldType != fieldtype.One2Many || fi.noCopy || fi.isComputedField() || fi.isRelatedField() {
+			continue
+		}
+		revFI := fi.relatedModel.fields.MustGet(fi.reverseFK)
+		for _, line := range rc.Get(fi.name).(RecordSet).Collection().Records() {
+			lineOverrides := FieldMap{revFI.json: newRecord.ids[0]}
+			if nameFI, ok := line.model.fields.get("name"); ok && nameFI.isCopiedField() {
+				lineOverrides[nameFI.json] = line.Get(nameFI.name)
+			}
+			line.Call("Copy", lineOverrides)
+		}
+	}
+}
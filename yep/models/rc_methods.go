@@ -40,10 +40,11 @@ func (rc RecordCollection) CallMulti(methName string, args ...interface{}) []int
 	methLayer := rc.getExistingLayer(methInfo)
 	rSet := rc
 	if methLayer == nil {
-		methLayer = methInfo.topLayer
+		methLayer = methInfo.getActiveLayer(methInfo.topLayer, rc.env.context)
 		newEnv := rc.Env()
 		newEnv.callStack = append([]*methodLayer{methLayer}, newEnv.callStack...)
 		rSet = rSet.WithEnv(newEnv)
+		rSet.checkApprovals(methInfo)
 	}
 	return rSet.callMulti(methLayer, args...)
 }
@@ -74,13 +75,16 @@ func (rc RecordCollection) getExistingLayer(methInfo *Method) *methodLayer {
 // Calls to a different method than the current method will call its next layer only
 // if the current method has been called from a layer of the other method. Otherwise,
 // it will be the same as calling the other method directly.
+//
+// Layers that are skipped in the current context (see Method.ExtendUnless)
+// are not executed.
 func (rc RecordCollection) Super() RecordCollection {
 	if len(rc.env.callStack) == 0 {
 		log.Panic("Empty call stack", "model", rc.model.name)
 	}
 	currentLayer := rc.env.callStack[0]
 	methInfo := currentLayer.method
-	methLayer := methInfo.getNextLayer(currentLayer)
+	methLayer := methInfo.getActiveLayer(methInfo.getNextLayer(currentLayer), rc.env.context)
 	if methLayer == nil {
 		// No parent
 		log.Panic("Called Super() on a base method", "model", rc.model.name, "method", methInfo.name)
@@ -117,8 +121,27 @@ func (rc RecordCollection) callMulti(methLayer *methodLayer, args ...interface{}
 	return res
 }
 
-// checkExecutionPermission panics if the current user is not allowed to
-// execute the given method
+// A MethodAccessPolicy defines which method calls are checked against
+// the execution permissions granted with Method.AllowGroup.
+type MethodAccessPolicy int8
+
+const (
+	// CheckAllMethodCalls checks all method calls, whether they are made
+	// by a client or by Go code.
+	CheckAllMethodCalls MethodAccessPolicy = iota
+	// CheckClientMethodCalls only checks the methods called directly by
+	// clients, i.e. the first method called in transactions of the
+	// InteractiveRequest class such as RPC calls. The methods they call
+	// and the methods called by Go code in other transactions are not
+	// checked.
+	CheckClientMethodCalls
+)
+
+// MethodAccess is the policy defining which method calls are checked.
+var MethodAccess = CheckAllMethodCalls
+
+// checkExecutionPermission panics with a MethodAccessError if the current
+// user is not allowed to execute the given method
 func (rc RecordCollection) checkExecutionPermission(method *Method) {
 	var caller *Method
 	if len(rc.env.callStack) > 1 {
@@ -128,6 +151,9 @@ func (rc RecordCollection) checkExecutionPermission(method *Method) {
 		// We are calling Super on the same method, so it's ok
 		return
 	}
+	if MethodAccess == CheckClientMethodCalls && !rc.isClientCall(method) {
+		return
+	}
 	userGroups := security.Registry.UserGroups(rc.env.uid)
 	for group := range userGroups {
 		if method.groups[group] {
@@ -140,5 +166,26 @@ func (rc RecordCollection) checkExecutionPermission(method *Method) {
 			return
 		}
 	}
-	log.Panic("You are not allowed to execute this method", "model", rc.ModelName(), "method", method.name, "uid", rc.env.uid)
+	log.Debug("Method execution denied", "model", rc.ModelName(), "method", method.name, "uid", rc.env.uid)
+	panic(MethodAccessError{
+		Model:  rc.ModelName(),
+		Method: method.name,
+		Groups: method.allowedGroups(caller),
+	})
+}
+
+// isClientCall returns true if the given method is called directly
+// by a client, i.e. it is the first method called in a transaction
+// of the InteractiveRequest class.
+func (rc RecordCollection) isClientCall(method *Method) bool {
+	if RequestClassOf(rc.env.GoContext()) != InteractiveRequest {
+		return false
+	}
+	switch len(rc.env.callStack) {
+	case 0:
+		return true
+	case 1:
+		return rc.env.callStack[0].method == method
+	}
+	return false
 }
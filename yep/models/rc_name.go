@@ -0,0 +1,99 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/models/operator"
+)
+
+// defaultRecName is the name of the field used as record name
+// of models that do not set one with SetRecName.
+const defaultRecName = "name"
+
+// SetRecName sets the field used as display name of the records of this
+// model by NameGet and searched by NameSearch. It defaults to the "Name"
+// field if the model has one.
+func (m *Model) SetRecName(fieldName string) *Model {
+	m.recName = fieldName
+	return m
+}
+
+// recNameField returns the field used as display name of the records of
+// this model. The second returned value is false if the model has none.
+func (m *Model) recNameField() (*Field, bool) {
+	if m.recName == "" {
+		return m.fields.get(defaultRecName)
+	}
+	return m.fields.get(m.recName)
+}
+
+// checkRecNames checks that the rec name of all models is an existing
+// field. It panics if it is not the case.
+func checkRecNames() {
+	for _, mi := range Registry.registryByName {
+		if mi.recName == "" {
+			continue
+		}
+		if _, ok := mi.fields.get(mi.recName); !ok {
+			log.Panic("Unknown rec name field", "model", mi.name, "field", mi.recName)
+		}
+	}
+}
+
+// nameGet returns the display name of this singleton, that is the value
+// of its rec name field, or its string representation if it has none.
+func (rc RecordCollection) nameGet() string {
+	fi, ok := rc.model.recNameField()
+	if !ok {
+		return rc.String()
+	}
+	if !rc.env.cache.checkIfInCache(rc.model, rc.ids, []string{fi.json}) {
+		rc.Load(fi.json)
+	}
+	switch value := rc.Get(fi.json).(type) {
+	case string:
+		return value
+	case RecordCollection:
+		if value.IsEmpty() {
+			return ""
+		}
+		return value.Call("NameGet").(string)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// nameSearch returns the records matching params.Args whose rec name
+// matches params.Name with params.Operator. The name is not searched
+// if it is empty or if the model has no rec name field.
+func (rc RecordCollection) nameSearch(params NameSearchParams) RecordCollection {
+	cond := params.Args
+	if fi, ok := rc.model.recNameField(); ok && params.Name != "" {
+		op := params.Operator
+		if op == "" {
+			op = operator.ILike
+		}
+		if !op.IsValid() {
+			log.Panic("Unknown operator", "model", rc.ModelName(), "operator", op)
+		}
+		nameCond := rc.model.Field(fi.name).AddOperator(op, params.Name)
+		if cond == nil || cond.IsEmpty() {
+			cond = nameCond
+		} else {
+			cond = cond.AndCond(nameCond)
+		}
+	}
+	res := rc.FetchAll()
+	if cond != nil && !cond.IsEmpty() {
+		res = rc.Search(cond)
+	}
+	if limit := ConvertLimitToInt(params.Limit); limit > 0 {
+		res = res.Limit(limit)
+	}
+	return res.Fetch()
+}
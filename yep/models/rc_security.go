@@ -14,30 +14,31 @@
 
 package models
 
-import "github.com/npiganeau/yep/yep/models/security"
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/models/security"
+)
 
 // addRecordRuleConditions adds the RecordRule conditions on the query of this
 // RecordSet for the user with the given uid and for the given perm Permission.
+//
+// Global rules are AND-combined, while rules of the user's groups are
+// OR-combined. Record rules do not apply to the super user.
 func (rc RecordCollection) addRecordRuleConditions(uid int64, perm security.Permission) RecordCollection {
-	if rc.filtered {
+	if rc.filtered || uid == security.SuperUserID {
 		return rc
 	}
 	rSet := rc
+	globalRules, groupRules := rSet.model.rulesRegistry.rulesFor(uid, perm)
 	// Add global rules
-	for _, rule := range rSet.model.rulesRegistry.globalRules {
-		if perm&rule.Perms > 0 {
-			rSet = rSet.Search(rule.Condition)
-		}
+	for _, rule := range globalRules {
+		rSet = rSet.Search(rule.condition(rSet.model, rSet.env))
 	}
 	// Add groups rules
-	userGroups := security.Registry.UserGroups(uid)
 	groupCondition := newCondition()
-	for group := range userGroups {
-		for _, rule := range rSet.model.rulesRegistry.rulesByGroup[group.Name] {
-			if perm&rule.Perms > 0 {
-				groupCondition = groupCondition.OrCond(rule.Condition)
-			}
-		}
+	for _, rule := range groupRules {
+		groupCondition = groupCondition.OrCond(rule.condition(rSet.model, rSet.env))
 	}
 	if !groupCondition.IsEmpty() {
 		rSet = rSet.Search(groupCondition)
@@ -45,3 +46,19 @@ func (rc RecordCollection) addRecordRuleConditions(uid int64, perm security.Perm
 	rSet.filtered = true
 	return rSet
 }
+
+// checkCreateRecordRules checks that the records of rc, which have just been
+// created, satisfy the record rules for the Create permission of the current
+// user. It panics with an AccessError otherwise.
+func (rc RecordCollection) checkCreateRecordRules() {
+	if rc.env.uid == security.SuperUserID || !rc.model.rulesRegistry.hasRules(rc.env.uid, security.Create) {
+		return
+	}
+	if rc.addRecordRuleConditions(rc.env.uid, security.Create).SearchCount() == len(rc.ids) {
+		return
+	}
+	panic(AccessError{
+		Model:   rc.model.name,
+		Message: fmt.Sprintf("You are not allowed to create this '%s' record", rc.model.name),
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+)
+
+// A DateGranularity is the period by which the values
+// of a date or datetime field are grouped.
+type DateGranularity string
+
+// Date granularities
+const (
+	GranularityDay   DateGranularity = "day"
+	GranularityWeek  DateGranularity = "week"
+	GranularityMonth DateGranularity = "month"
+)
+
+// granularitySep separates a field name from its
+// granularity in the group by expressions of ReadGroup.
+const granularitySep = ":"
+
+// next returns the beginning of the period following
+// the one beginning at start.
+func (dg DateGranularity) next(start time.Time) time.Time {
+	switch dg {
+	case GranularityDay:
+		return start.AddDate(0, 0, 1)
+	case GranularityWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// ReadGroupParams is the args struct of the ReadGroup method
+type ReadGroupParams struct {
+	Condition *Condition  `json:"domain"`
+	Fields    []FieldName `json:"fields"`
+	GroupBy   []string    `json:"groupby"`
+}
+
+// ReadGroup returns the aggregated values of the given fields of the records
+// matching cond, grouped by the given groupBy expressions. Numeric fields are
+// aggregated with their group operator (sum, avg, min, max, count).
+//
+// A groupBy expression is a field name or path, such as "Profile.Country",
+// which may be followed by a granularity for date and datetime fields, such
+// as "Birthday:month". Available granularities are day, week and month.
+//
+// The grouped fields are always included in the Values of the returned rows.
+func (rc RecordCollection) ReadGroup(cond *Condition, fields []FieldNamer, groupBy []string) []GroupAggregateRow {
+	if len(groupBy) == 0 {
+		log.Panic("ReadGroup needs at least one group by expression", "model", rc.model)
+	}
+	rSet := rc
+	if cond != nil && !cond.IsEmpty() {
+		rSet = rSet.Search(cond)
+	}
+	groupFields := make([]FieldNamer, len(groupBy))
+	for i, gb := range groupBy {
+		var fieldName string
+		fieldName, rSet = rSet.withGroupGranularity(gb)
+		groupFields[i] = FieldName(fieldName)
+	}
+	rSet = rSet.GroupBy(groupFields...)
+	return rSet.Aggregates(append(groupFields, fields...)...)
+}
+
+// withGroupGranularity returns the field path of the given group by
+// expression and a copy of this RecordCollection that groups this
+// field by the granularity given in the expression, if any.
+func (rc RecordCollection) withGroupGranularity(groupBy string) (string, RecordCollection) {
+	tokens := strings.SplitN(groupBy, granularitySep, 2)
+	fieldName := strings.TrimSpace(tokens[0])
+	if len(tokens) == 1 {
+		return fieldName, rc
+	}
+	granularity := DateGranularity(strings.TrimSpace(tokens[1]))
+	switch granularity {
+	case GranularityDay, GranularityWeek, GranularityMonth:
+	default:
+		log.Panic("Unknown date granularity", "model", rc.model, "groupBy", groupBy)
+	}
+	fi := rc.model.getRelatedFieldInfo(fieldName)
+	if fi.fieldType != fieldtype.Date && fi.fieldType != fieldtype.DateTime {
+		log.Panic("Granularity can only be set on date and datetime fields", "model", rc.model, "groupBy", groupBy)
+	}
+	rc.query = rc.query.clone()
+	granularities := make(map[string]DateGranularity)
+	for k, v := range rc.query.granularities {
+		granularities[k] = v
+	}
+	exprs := jsonizeExpr(rc.model, strings.Split(fieldName, ExprSep))
+	granularities[strings.Join(exprs, ExprSep)] = granularity
+	rc.query.granularities = granularities
+	return fieldName, rc
+}
+
+// groupFieldExpression returns the SQL expression of the field pointed at by
+// exprs, truncated to its granularity if it is grouped by date periods.
+func (q *Query) groupFieldExpression(exprs []string) string {
+	res := q.joinedFieldExpression(exprs)
+	if granularity, ok := q.granularities[strings.Join(exprs, ExprSep)]; ok {
+		res = adapters[db.DriverName()].dateTruncSQL(granularity, res)
+	}
+	return res
+}
+
+// groupCondition returns the condition to retrieve the records
+// aggregated in the row with the given vals of this grouped Query.
+func (q *Query) groupCondition(vals map[string]interface{}) *Condition {
+	res := newCondition()
+	for _, group := range q.groups {
+		exprs := jsonizeExpr(q.recordSet.model, strings.Split(group, ExprSep))
+		val := vals[strings.Join(exprs, sqlSep)]
+		granularity, ok := q.granularities[strings.Join(exprs, ExprSep)]
+		start, isTime := val.(time.Time)
+		if !ok || !isTime {
+			res = res.And().Field(group).Equals(val)
+			continue
+		}
+		res = res.And().Field(group).GreaterOrEqual(start).
+			And().Field(group).Lower(granularity.next(start))
+	}
+	return res
+}
@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -70,27 +71,143 @@ func (rc RecordCollection) Ids() []int64 {
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Call("Create")
 func (rc RecordCollection) create(data FieldMapper) RecordCollection {
+	defer rc.convertDBErrors()
+	rc.checkNotAsOf()
+	rc.checkWritable("create")
 	rc.checkExecutionPermission(rc.model.methods.MustGet("Create"))
+	fMap, storedFieldMap, x2ManyCommands := rc.prepareCreateData(data)
+	// insert in DB
+	sql, args := rc.query.insertQuery(storedFieldMap)
+	createdIds := rc.insertRows(sql, args, 1)
+
+	rSet := rc.withIds(createdIds)
+	rSet.updateCreatedRecord(fMap, storedFieldMap, x2ManyCommands)
+	// compute stored fields
+	rSet.updateStoredFields(fMap)
+	rSet.logAuditCreation()
+	rSet.subscribeCreator()
+	rSet.checkCreateRecordRules()
+	rSet.checkConstraints(fMap.Keys())
+	rSet.updateSLA()
+	rSet.runAutomations(TriggerOnCreate, nil)
+	return rSet
+}
+
+// insertRows executes the given INSERT query of count rows and returns the
+// ids of the inserted rows in order. If the database does not support
+// RETURNING clauses, ids are deduced from the first id given by LastInsertId,
+// which requires that the ids of a multi-row INSERT are consecutive.
+func (rc RecordCollection) insertRows(sql string, args SQLParams, count int) []int64 {
+	if adapters[db.DriverName()].supportsReturning() {
+		var ids []int64
+		rc.env.Cr().Select(&ids, sql, args...)
+		return ids
+	}
+	firstID, err := rc.env.Cr().Execute(sql, args...).LastInsertId()
+	if err != nil {
+		log.Panic("Unable to get the ids of inserted records", "model", rc.model, "error", err)
+	}
+	ids := make([]int64, count)
+	for i := range ids {
+		ids[i] = firstID + int64(i)
+	}
+	return ids
+}
+
+// createMulti inserts a record for each of the given data in the database
+// and returns the created records in the order of data. Records are inserted
+// with a single multi-row INSERT query per batch of maxInsertRows, and stored
+// computed fields, record rules and constraints are processed once for all
+// the records.
+// This function is private and low level. It should not be called directly.
+// Instead use rs.Call("CreateMulti")
+func (rc RecordCollection) createMulti(data []FieldMap) RecordCollection {
+	defer rc.convertDBErrors()
+	rc.checkNotAsOf()
+	rc.checkWritable("create")
+	rc.checkExecutionPermission(rc.model.methods.MustGet("Create"))
+	if len(data) == 0 {
+		return rc.withIds([]int64{})
+	}
+	fMaps := make([]FieldMap, len(data))
+	storedFieldMaps := make([]FieldMap, len(data))
+	x2ManyCommands := make([]map[string]X2ManyCommands, len(data))
+	for i, d := range data {
+		fMaps[i], storedFieldMaps[i], x2ManyCommands[i] = rc.prepareCreateData(d)
+	}
+	// insert in DB
+	ids := make([]int64, 0, len(data))
+	for start := 0; start < len(data); start += maxInsertRows {
+		end := start + maxInsertRows
+		if end > len(data) {
+			end = len(data)
+		}
+		sql, args := rc.query.insertMultiQuery(storedFieldMaps[start:end])
+		ids = append(ids, rc.insertRows(sql, args, end-start)...)
+	}
+
+	rSet := rc.withIds(ids)
+	allFields := make(FieldMap)
+	for i, rec := range rSet.Records() {
+		rec.updateCreatedRecord(fMaps[i], storedFieldMaps[i], x2ManyCommands[i])
+		for _, key := range fMaps[i].Keys() {
+			allFields[key] = nil
+		}
+	}
+	// compute stored fields
+	rSet.updateStoredFields(allFields)
+	rSet.logAuditCreation()
+	rSet.subscribeCreator()
+	rSet.checkCreateRecordRules()
+	rSet.checkConstraints(allFields.Keys())
+	rSet.updateSLA()
+	rSet.runAutomations(TriggerOnCreate, nil)
+	return rSet
+}
+
+// prepareCreateData checks the given data of a record to create and completes
+// it with default values and embedded records. It returns the data with the
+// x2many commands extracted, the data of stored fields to insert and the
+// x2many commands to apply after insertion.
+func (rc RecordCollection) prepareCreateData(data FieldMapper) (FieldMap, FieldMap, map[string]X2ManyCommands) {
 	fMap := data.FieldMap()
+	rc.checkFieldsAccess(fMap.Keys(), security.Write)
 	fMap = filterMapOnAuthorizedFields(rc.model, fMap, rc.env.uid, security.Write)
 	rc.applyDefaults(&fMap)
 	rc.addAccessFieldsCreateData(&fMap)
+	rc.addAutoNowCreateData(&fMap)
+	x2ManyCommands := extractX2ManyCommands(rc.model, &fMap)
+	rc.parseDateValues(fMap)
 	rc.model.convertValuesToFieldType(&fMap)
+	rc.roundDecimalValues(fMap)
+	rc.model.checkSelectionValues(rc.env, fMap)
+	rc.model.checkTaxIDValues(fMap)
+	rc.model.checkBankValues(fMap)
 	fMap = rc.createEmbeddedRecords(fMap)
 	// clean our fMap from ID and non stored fields
 	fMap.RemovePKIfZero()
 	storedFieldMap := filterMapOnStoredFields(rc.model, fMap)
-	// insert in DB
-	var createdId int64
-	sql, args := rc.query.insertQuery(storedFieldMap)
-	rc.env.cr.Get(&createdId, sql, args...)
+	return fMap, storedFieldMap, x2ManyCommands
+}
 
-	rSet := rc.withIds([]int64{createdId})
+// updateCreatedRecord updates the data that is not stored in the table of
+// the model for the record of rc that has just been inserted with the data
+// returned by prepareCreateData.
+func (rc RecordCollection) updateCreatedRecord(fMap, storedFieldMap FieldMap, x2ManyCommands map[string]X2ManyCommands) {
+	rc.roundMonetaryFields(storedFieldMap.Keys())
+	rc.updateParentPaths(storedFieldMap)
 	// update reverse relation fields
-	rSet.updateRelationFields(fMap)
-	// compute stored fields
-	rSet.updateStoredFields(fMap)
-	return rSet
+	rc.updateRelationFields(fMap)
+	rc.applyX2ManyCommands(x2ManyCommands)
+	// remove cached values depending on the new record, such as one2many fields
+	created := fMap.Keys()
+	for fName := range x2ManyCommands {
+		created = append(created, fName)
+	}
+	rc.model.invalidateDependentFields(rc.env.cache, created, make(map[computeKey]bool))
+	rc.updatePropertyFields(fMap)
+	rc.updateAttachmentFields(fMap)
+	rc.logChanges(ChangeCreate, created)
 }
 
 // createEmbeddedRecords creates the records that are embedded in this
@@ -134,7 +251,7 @@ func (rc RecordCollection) createEmbeddedRecords(fMap FieldMap) FieldMap {
 	// 3. We create the embedded records
 	for fieldName, vals := range embeddedData {
 		// We do not call "create" directly to have the caller set in the callstack for permissions
-		res := rc.env.Pool(vals.model).Call("Create", vals.values)
+		res := rc.env.subOperationEnv().Pool(vals.model).Call("Create", vals.values)
 		if resRS, ok := res.(RecordSet); ok {
 			fMap[fieldName] = resRS.Ids()[0]
 		}
@@ -145,23 +262,81 @@ func (rc RecordCollection) createEmbeddedRecords(fMap FieldMap) FieldMap {
 // applyDefaults adds the default value to the given fMap values which
 // are equal to their Go type zero value
 func (rc RecordCollection) applyDefaults(fMap *FieldMap) {
-	for fName, fi := range Registry.MustGet(rc.ModelName()).fields.registryByJSON {
+	for fName, value := range rc.computeDefaults(*fMap) {
+		(*fMap)[rc.model.fields.MustGet(fName).json] = value
+	}
+}
+
+// computeDefaults returns a FieldMap with the default values of the fields of
+// this RecordCollection's model that are not set in fMap.
+//
+// Defaults of the fields given with SetDefaultDepends are computed before the
+// default of the field itself. Each default function receives the values known
+// so far, i.e. those of fMap and the defaults that have already been computed,
+// with field names as keys.
+//
+// A value given in the context with a "default_<field_json_name>" key
+// takes precedence over a default declared in a data file, which itself
+// takes precedence over the default function of the field.
+func (rc RecordCollection) computeDefaults(fMap FieldMap) FieldMap {
+	dataDefaults := rc.dataDefaults()
+	values := make(FieldMap)
+	for key, value := range fMap {
+		if fi, ok := rc.model.fields.get(key); ok && value != nil {
+			values[fi.name] = value
+		}
+	}
+	res := make(FieldMap)
+	visiting := make(map[*Field]bool)
+	var computeDefault func(fi *Field)
+	computeDefault = func(fi *Field) {
+		if _, exists := values[fi.name]; exists {
+			return
+		}
+		if ctxKey := defaultContextKeyPrefix + fi.json; rc.env.context.HasKey(ctxKey) {
+			values[fi.name] = rc.env.context.Get(ctxKey)
+			res[fi.name] = values[fi.name]
+			return
+		}
+		if value, ok := dataDefaults[fi.name]; ok {
+			values[fi.name] = value
+			res[fi.name] = value
+			return
+		}
 		if fi.defaultFunc == nil {
-			continue
+			return
+		}
+		if visiting[fi] {
+			log.Panic("Circular dependency in default values", "model", rc.ModelName(), "field", fi.name)
 		}
-		val := reflect.ValueOf((*fMap)[fName])
-		if !val.IsValid() || val == reflect.Zero(val.Type()) {
-			(*fMap)[fName] = fi.defaultFunc(rc.Env(), FieldMap{})
+		visiting[fi] = true
+		for _, dep := range fi.defaultDepends {
+			computeDefault(rc.model.fields.MustGet(dep))
 		}
+		values[fi.name] = fi.defaultFunc(rc.Env(), values)
+		res[fi.name] = values[fi.name]
 	}
+	var fNames []string
+	for fName := range rc.model.fields.registryByName {
+		fNames = append(fNames, fName)
+	}
+	sort.Strings(fNames)
+	for _, fName := range fNames {
+		computeDefault(rc.model.fields.MustGet(fName))
+	}
+	return res
 }
 
-// addAccessFieldsCreateData adds appropriate CreateDate and CreateUID fields to
-// the given FieldMap.
+// addAccessFieldsCreateData adds appropriate CreateDate, CreateUID, WriteDate
+// and WriteUID fields to the given FieldMap, so that a new record is seen as
+// last modified at its creation.
 func (rc RecordCollection) addAccessFieldsCreateData(fMap *FieldMap) {
-	if !rc.model.isSystem() {
-		(*fMap)["CreateDate"] = types.Now()
+	if rc.model.hasLogAccess() {
+		now := types.Now()
+		(*fMap)["CreateDate"] = now
 		(*fMap)["CreateUID"] = rc.env.uid
+		(*fMap)["WriteDate"] = now
+		(*fMap)["WriteUID"] = rc.env.uid
 	}
 }
 
@@ -170,6 +345,9 @@ func (rc RecordCollection) addAccessFieldsCreateData(fMap *FieldMap) {
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Call("Write")
 func (rc RecordCollection) update(data FieldMapper, fieldsToUnset ...FieldNamer) bool {
+	defer rc.convertDBErrors()
+	rc.checkNotAsOf()
+	rc.checkWritable("write")
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write)
 	fMap := data.FieldMap()
 	if _, ok := data.(FieldMap); !ok {
@@ -179,27 +357,105 @@ func (rc RecordCollection) update(data FieldMapper, fieldsToUnset ...FieldNamer)
 			}
 		}
 	}
+	rSet.checkFieldsAccess(fMap.Keys(), security.Write)
 	rSet.addAccessFieldsUpdateData(&fMap)
+	rSet.addAutoNowUpdateData(&fMap)
+	x2ManyCommands := extractX2ManyCommands(rSet.model, &fMap)
+	rSet.parseDateValues(fMap)
 	rSet.model.convertValuesToFieldType(&fMap)
+	rSet.roundDecimalValues(fMap)
+	rSet.model.checkSelectionValues(rSet.env, fMap)
+	rSet.model.checkTaxIDValues(fMap)
+	rSet.model.checkBankValues(fMap)
+	rSet.checkOne2OneValues(fMap)
 	// clean our fMap from ID and non stored fields
 	fMap.RemovePK()
 	storedFieldMap := filterMapOnStoredFields(rSet.model, fMap)
-	rSet.doUpdate(storedFieldMap)
+	// translatable fields are written as translations if a language is set
+	storedFieldMap = rSet.updateTranslations(storedFieldMap)
 	// Let's fetch once for all
-	rSet = rSet.Fetch()
+	rSet = rSet.fetchWithArchived()
+	rSet.checkConcurrency()
+	// get records to recompute before the update
+	previousTargets := rSet.computeTargets(fMap.Keys())
+	trackedValues := rSet.trackedValues(storedFieldMap)
+	rSet.logAuditTrail(storedFieldMap)
+	rSet.doUpdate(storedFieldMap)
+	rSet.roundMonetaryFields(storedFieldMap.Keys())
+	rSet.updateParentPaths(storedFieldMap)
 	// write reverse relation fields
 	rSet.updateRelationFields(fMap)
+	rSet.applyX2ManyCommands(x2ManyCommands)
+	// remove modified values and values depending on them from the cache
+	modified := fMap.Keys()
+	for fName := range x2ManyCommands {
+		modified = append(modified, fName)
+	}
+	rSet.invalidateCache(modified)
+	rSet.logChanges(ChangeWrite, modified)
 	// write related fields
 	rSet.updateRelatedFields(fMap)
+	rSet.updatePropertyFields(fMap)
+	rSet.updateAttachmentFields(fMap)
 	// compute stored fields
-	rSet.updateStoredFields(fMap)
+	rSet.updateStoredFields(fMap, previousTargets)
+	rSet.checkConstraints(fMap.Keys())
+	rSet.updateSLA()
+	rSet.postTrackingMessages(trackedValues)
+	rSet.runAutomations(TriggerOnWrite, modified)
 	return true
 }
 
+// checkConstraints runs the constraint methods of the given fields on rc.
+// It panics with a ValidationError if one of them returns an error, so
+// that the current transaction is rolled back.
+func (rc RecordCollection) checkConstraints(fieldNames []string) {
+	for _, methName := range rc.model.fields.constraintMethods(fieldNames) {
+		res := rc.Call(methName)
+		if res == nil {
+			continue
+		}
+		if vErr, ok := res.(ValidationError); ok {
+			panic(vErr)
+		}
+		panic(ValidationError{
+			Model:   rc.model.name,
+			Message: res.(error).Error(),
+		})
+	}
+}
+
+// checkOne2OneValues checks that the one2one fields of the given FieldMap
+// are not set to the same related record on several records of rc.
+// It panics with a ValidationError otherwise.
+func (rc RecordCollection) checkOne2OneValues(fMap FieldMap) {
+	if len(rc.ids) < 2 {
+		return
+	}
+	for colName, value := range fMap {
+		fi := rc.model.getRelatedFieldInfo(colName)
+		if fi.fieldType != fieldtype.One2One || value == nil || value == int64(0) {
+			continue
+		}
+		panic(ValidationError{
+			Model:   rc.model.name,
+			Field:   fi.name,
+			Value:   fmt.Sprintf("%v", value),
+			Message: fmt.Sprintf("Field '%s' cannot be set to the same record on several records", fi.description),
+		})
+	}
+}
+
 // addAccessFieldsUpdateData adds appropriate WriteDate and WriteUID fields to
-// the given FieldMap.
+// the given FieldMap. CreateDate and CreateUID are removed from it since they
+// cannot be modified.
 func (rc RecordCollection) addAccessFieldsUpdateData(fMap *FieldMap) {
-	if !rc.model.isSystem() {
+	if rc.model.hasLogAccess() {
+		for key := range *fMap {
+			if fi, ok := rc.model.fields.get(key); ok && (fi.name == "CreateDate" || fi.name == "CreateUID") {
+				delete(*fMap, key)
+			}
+		}
 		(*fMap)["WriteDate"] = types.Now()
 		(*fMap)["WriteUID"] = rc.env.uid
 	}
@@ -207,21 +463,17 @@ func (rc RecordCollection) addAccessFieldsUpdateData(fMap *FieldMap) {
 
 // doUpdate just updates the database records pointed at by
 // this RecordCollection with the given fieldMap. It also
-// invalidates the cache for the record
+// invalidates the given fields in the cache.
 func (rc RecordCollection) doUpdate(fMap FieldMap) {
 	rc.checkExecutionPermission(rc.model.methods.MustGet("Write"))
-	defer func() {
-		for _, id := range rc.Ids() {
-			rc.env.cache.invalidateRecord(rc.model, id)
-		}
-	}()
+	defer rc.invalidateCache(fMap.Keys())
 	fMap = filterMapOnAuthorizedFields(rc.model, fMap, rc.env.uid, security.Write)
 	// update DB
 	if len(fMap) > 0 {
 		sql, args := rc.query.updateQuery(fMap)
-		res := rc.env.cr.Execute(sql, args...)
+		res := rc.env.Cr().Execute(sql, args...)
 		if num, _ := res.RowsAffected(); num == 0 {
-			log.Panic("Trying to update an empty RecordSet", "model", rc.ModelName(), "values", fMap)
+			log.Panic("Trying to update an empty RecordSet", "model", rc.ModelName(), "values", rc.model.maskFieldMap(fMap))
 		}
 	}
 }
@@ -240,12 +492,12 @@ func (rc RecordCollection) updateRelationFields(fMap FieldMap) {
 		case fieldtype.Rev2One:
 		case fieldtype.Many2Many:
 			delQuery := fmt.Sprintf(`DELETE FROM %s WHERE %s IN (?)`, fi.m2mRelModel.tableName, fi.m2mOurField.json)
-			rc.env.cr.Execute(delQuery, rSet.ids)
+			rc.env.Cr().Execute(delQuery, rSet.ids)
 			for _, id := range rSet.ids {
 				query := fmt.Sprintf(`INSERT INTO %s (%s, %s) VALUES (?, ?)`, fi.m2mRelModel.tableName,
 					fi.m2mOurField.json, fi.m2mTheirField.json)
 				for _, relId := range value.([]int64) {
-					rc.env.cr.Execute(query, id, relId)
+					rc.env.Cr().Execute(query, id, relId)
 				}
 			}
 		}
@@ -299,11 +551,47 @@ func (rc RecordCollection) updateRelatedFields(fMap FieldMap) {
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Unlink() or rs.Call("Unlink")
 func (rc RecordCollection) unlink() int64 {
+	defer rc.convertDBErrors()
+	rc.checkNotAsOf()
+	rc.checkWritable("unlink")
 	rc.checkExecutionPermission(rc.model.methods.MustGet("Unlink"))
-	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Unlink)
+	// The ids of the records are needed to delete the data attached to them
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Unlink).fetchWithArchived()
+	// get the records of other models to recompute once these are deleted
+	var targets map[computeData]RecordCollection
+	if rSet.model.hasReverseDependencies() {
+		targets = rSet.computeTargets(rSet.model.fields.storedFieldNames())
+		for cData := range targets {
+			if cData.path == "" {
+				delete(targets, cData)
+			}
+		}
+	}
+	rSet.runAutomations(TriggerOnUnlink, nil)
+	rSet.logAuditDeletion()
+	rSet.deleteProperties()
+	rSet.deleteAttachments()
+	rSet.deleteChatter()
+	rSet.deleteRecurrences()
+	rSet.deleteTranslations()
 	sql, args := rSet.query.deleteQuery()
-	res := rSet.env.cr.Execute(sql, args...)
+	res := rSet.env.Cr().Execute(sql, args...)
 	num, _ := res.RowsAffected()
+	for _, id := range rSet.ids {
+		rSet.env.cache.invalidateRecord(rSet.model, id)
+	}
+	rSet.model.invalidateDependentFields(rSet.env.cache, rSet.model.fields.storedFieldNames(), make(map[computeKey]bool))
+	rSet.logChanges(ChangeUnlink, nil)
+	depEnv := rSet.dependencyEnv()
+	for cData, recs := range targets {
+		if recs.IsEmpty() {
+			delete(targets, cData)
+			continue
+		}
+		// Filter out records that have been deleted with rSet (e.g. on cascade)
+		targets[cData] = depEnv.Pool(recs.ModelName()).Search(recs.Model().Field("ID").In(recs.Ids())).Fetch().WithEnv(*rSet.env)
+	}
+	rSet.recompute(targets)
 	return num
 }
 
@@ -312,27 +600,46 @@ func (rc RecordCollection) unlink() int64 {
 func (rc RecordCollection) Search(cond *Condition) RecordCollection {
 	rc.query = rc.query.clone()
 	rc.query.cond = rc.query.cond.AndCond(cond)
+	rc.fetched = false
 	return rc
 }
 
 // Limit returns a new RecordSet with only the first 'limit' records.
+// A limit lower or equal to 0 removes the limit.
 func (rc RecordCollection) Limit(limit int) RecordCollection {
 	rc.query = rc.query.clone()
 	rc.query.limit = limit
+	rc.fetched = false
 	return rc
 }
 
-// Offset returns a new RecordSet with only the records starting at offset
+// Offset returns a new RecordSet with only the records starting at offset.
+// It panics if offset is negative.
 func (rc RecordCollection) Offset(offset int) RecordCollection {
+	if offset < 0 {
+		log.Panic("Offset cannot be negative", "model", rc.model.name, "offset", offset)
+	}
 	rc.query = rc.query.clone()
 	rc.query.offset = offset
+	rc.fetched = false
 	return rc
 }
 
-// OrderBy returns a new RecordSet ordered by the given ORDER BY expressions
+// OrderBy returns a new RecordSet ordered by the given ORDER BY expressions,
+// replacing the order of this RecordSet. Each expression is a field path,
+// optionally followed by ASC or DESC, such as "Name" or "Profile.Age DESC".
+// Paths may only follow many2one and one2one fields, which are joined with
+// a LEFT JOIN unless required, so that records without related record are
+// kept. Records with equal values are ordered by ID.
+//
+// It panics if an expression is invalid.
 func (rc RecordCollection) OrderBy(exprs ...string) RecordCollection {
+	for _, expr := range exprs {
+		rc.model.resolveOrderExpr(expr)
+	}
 	rc.query = rc.query.clone()
-	rc.query.orders = append(rc.query.orders, exprs...)
+	rc.query.orders = append([]string(nil), exprs...)
+	rc.fetched = false
 	return rc
 }
 
@@ -370,10 +677,10 @@ func (rc RecordCollection) FetchAll() RecordCollection {
 // SearchCount fetch from the database the number of records that match the RecordSet conditions
 // It panics in case of error
 func (rc RecordCollection) SearchCount() int {
-	rSet := rc.Limit(0)
+	rSet := rc.addActiveCondition().addRecordRuleConditions(rc.env.uid, security.Read).Limit(0)
 	sql, args := rSet.query.countQuery()
 	var res int
-	rSet.env.cr.Get(&res, sql, args...)
+	rSet.env.Cr().Get(&res, sql, args...)
 	return res
 }
 
@@ -392,7 +699,10 @@ func (rc RecordCollection) Load(fields ...string) RecordCollection {
 	if len(rc.query.groups) > 0 {
 		log.Panic("Trying to load a grouped query", "model", rc.model, "groups", rc.query.groups)
 	}
-	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
+	if !rc.fetched {
+		rc.checkQueryGuard()
+	}
+	rSet := rc.addActiveCondition().addRecordRuleConditions(rc.env.uid, security.Read)
 	var results []FieldMap
 	if len(fields) == 0 {
 		fields = rSet.model.fields.storedFieldNames()
@@ -401,7 +711,7 @@ func (rc RecordCollection) Load(fields ...string) RecordCollection {
 	subFields, rSet := rSet.substituteRelatedFields(fields)
 	dbFields := filterOnDBFields(rSet.model, subFields)
 	sql, args := rSet.query.selectQuery(dbFields)
-	rows := dbQuery(rSet.env.cr.tx, sql, args...)
+	rows := rSet.env.Cr().query(sql, args...)
 	defer rows.Close()
 	var ids []int64
 	for rows.Next() {
@@ -414,8 +724,13 @@ func (rc RecordCollection) Load(fields ...string) RecordCollection {
 		rSet.env.cache.addRecord(rSet.model, line["id"].(int64), line)
 		ids = append(ids, line["id"].(int64))
 	}
+	if rc.fetched {
+		// Keep the order of the records of rc
+		ids = orderIdsAs(ids, rc.ids)
+	}
 
 	rSet = rSet.withIds(ids)
+	rSet.addRelationsToPrefetch(results)
 	rSet.loadRelationFields(fields)
 	return rSet
 }
@@ -431,12 +746,14 @@ func (rc RecordCollection) loadRelationFields(fields []string) {
 			case fieldtype.One2Many:
 				relRC := rc.env.Pool(fi.relatedModelName).Search(rc.Model().Field(fi.reverseFK).Equals(id)).Fetch()
 				rc.env.cache.addEntry(rc.model, id, fieldName, relRC.ids)
+				rc.env.cache.addPrefetch(fi.relatedModel, relRC.ids...)
 			case fieldtype.Many2Many:
 				query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = ?`, fi.m2mTheirField.json,
 					fi.m2mRelModel.tableName, fi.m2mOurField.json)
 				var ids []int64
-				rc.env.cr.Select(&ids, query, id)
+				rc.env.Cr().Select(&ids, query, id)
 				rc.env.cache.addEntry(rc.model, id, fieldName, ids)
+				rc.env.cache.addPrefetch(fi.relatedModel, ids...)
 			case fieldtype.Rev2One:
 				relRC := rc.env.Pool(fi.relatedModelName).Search(rc.Model().Field(fi.reverseFK).Equals(id)).Fetch()
 				var relID int64
@@ -456,17 +773,24 @@ func (rc RecordCollection) loadRelationFields(fields []string) {
 func (rc RecordCollection) Get(fieldName string) interface{} {
 	rSet := rc.Fetch()
 	fi := rSet.model.fields.MustGet(fieldName)
+	asOfDate, asOf := rSet.asOfDate()
 	var res interface{}
 
 	switch {
 	case rSet.IsEmpty():
 		res = reflect.Zero(fi.structField.Type).Interface()
 	case fi.isComputedField() && !fi.isStored():
-		fMap := make(FieldMap)
-		rSet.computeFieldValues(&fMap, fi.json)
-		res = fMap[fi.json]
+		res = rSet.getComputed(fi)
 	case fi.isRelatedField() && !fi.isStored():
 		res = rSet.get(fi.relatedPath, false)
+	case fi.audited && asOf:
+		res = rSet.valueAsOf(fi, asOfDate)
+	case fi.isPropertyField():
+		res = rSet.getProperty(fi)
+	case fi.isAttachmentField():
+		res = rSet.getAttachment(fi)
+	case fi.translate && fi.isStored() && rSet.translationLang() != "":
+		res = rSet.getTranslation(fi)
 	default:
 		// If value is not in cache we fetch the whole model to speed up later calls to Get,
 		// except for the case of non stored relation fields, where we only load the requested field.
@@ -480,6 +804,10 @@ func (rc RecordCollection) Get(fieldName string) interface{} {
 		return reflect.Zero(fi.structField.Type).Interface()
 	}
 
+	if dt, ok := res.(types.DateTime); ok {
+		res = rSet.localizeDateTime(dt)
+	}
+
 	if fi.isRelationField() {
 		switch r := res.(type) {
 		case int64:
@@ -494,16 +822,22 @@ func (rc RecordCollection) Get(fieldName string) interface{} {
 	return res
 }
 
-// get returns the value of field for this RecordSet.
-// It loads the cache if necessary before reading.
+// get returns the value of field for this RecordSet, or nil if the
+// current user cannot read it. It loads the cache if necessary before reading.
 // If all is true, all fields of the model are loaded, otherwise only field.
 func (rc RecordCollection) get(field string, all bool) interface{} {
 	rSet := rc.Fetch()
+	if !checkFieldPermission(rSet.model.getRelatedFieldInfo(field), rSet.env.uid, security.Read) {
+		// The value may be in cache if it has been read by the same
+		// records with another user, e.g. through Sudo.
+		return nil
+	}
 	if !rSet.env.cache.checkIfInCache(rSet.model, []int64{rSet.ids[0]}, []string{field}) {
 		if !all {
 			rSet.Load(field)
 		} else {
-			rSet.Load()
+			// Load the records waiting to be prefetched in the same query
+			rSet.withPrefetch(field).Load()
 		}
 	}
 	return rSet.env.cache.get(rSet.model, rSet.ids[0], field)
@@ -566,6 +900,7 @@ func (rc RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregate
 	}
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
 	fields := filterOnAuthorizedFields(rSet.model, rSet.env.uid, convertToStringSlice(fieldNames), security.Read)
+	rSet, fields = rSet.addCurrencyGroups(fields)
 	subFields, rSet := rSet.substituteRelatedFields(fields)
 	dbFields := filterOnDBFields(rSet.model, subFields, true)
 
@@ -575,7 +910,7 @@ func (rc RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregate
 	fieldsOperatorMap := rSet.fieldsGroupOperators(dbFields)
 	sql, args := rSet.query.selectGroupQuery(fieldsOperatorMap)
 	var res []GroupAggregateRow
-	rows := dbQuery(rSet.env.cr.tx, sql, args...)
+	rows := rSet.env.Cr().query(sql, args...)
 	defer rows.Close()
 
 	for rows.Next() {
@@ -586,10 +921,17 @@ func (rc RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregate
 		}
 		cnt := vals["__count"].(int64)
 		delete(vals, "__count")
+		rSet.convertMonetaryAggregates(vals)
+		rSet.decryptAggregates(vals)
+		for key := range vals {
+			if strings.HasPrefix(key, orderColumnPrefix) {
+				delete(vals, key)
+			}
+		}
 		line := GroupAggregateRow{
 			Values:    vals,
 			Count:     int(cnt),
-			Condition: getGroupCondition(rc.query.groups, vals),
+			Condition: rSet.query.groupCondition(vals),
 		}
 		res = append(res, line)
 	}
@@ -611,7 +953,7 @@ func (rc RecordCollection) fieldsGroupOperators(fields []string) map[string]stri
 			continue
 		}
 		fi := rc.model.getRelatedFieldInfo(dbf)
-		if fi.fieldType != fieldtype.Float && fi.fieldType != fieldtype.Integer {
+		if fi.fieldType != fieldtype.Float && fi.fieldType != fieldtype.Integer && fi.fieldType != fieldtype.Monetary {
 			continue
 		}
 		res[dbf] = fi.groupOperator
@@ -619,8 +961,29 @@ func (rc RecordCollection) fieldsGroupOperators(fields []string) map[string]stri
 	return res
 }
 
+// orderIdsAs returns the given ids sorted in the order of the reference
+// slice. ids that are not in reference are dropped.
+func orderIdsAs(ids []int64, reference []int64) []int64 {
+	idMap := make(map[int64]bool)
+	for _, id := range ids {
+		idMap[id] = true
+	}
+	res := make([]int64, 0, len(ids))
+	for _, id := range reference {
+		if idMap[id] {
+			res = append(res, id)
+			delete(idMap, id)
+		}
+	}
+	return res
+}
+
 // Records returns the slice of RecordCollection singletons that constitute this
-// RecordCollection.
+// RecordCollection, in the order of the RecordCollection.
+//
+// Records of a RecordCollection returned by a search are ordered by the
+// OrderBy expressions of the search, or by id if none is given. Records of
+// a RecordCollection built from ids keep the order of these ids.
 func (rc RecordCollection) Records() []RecordCollection {
 	rSet := rc.Load()
 	res := make([]RecordCollection, rSet.Len())
@@ -631,11 +994,91 @@ func (rc RecordCollection) Records() []RecordCollection {
 	return res
 }
 
-// EnsureOne panics if rc is not a singleton
+// Record returns the i-th record of this RecordCollection as a singleton,
+// in the order of Records(). It panics with a RecordSetError if i is out of range.
+func (rc RecordCollection) Record(i int) RecordCollection {
+	rSet := rc.Fetch()
+	if i < 0 || i >= len(rSet.ids) {
+		panic(RecordSetError{
+			Model:   rSet.ModelName(),
+			IDs:     rSet.ids,
+			Message: fmt.Sprintf("Record index %d out of range", i),
+		})
+	}
+	return newRecordCollection(rSet.Env(), rSet.ModelName()).withIds([]int64{rSet.ids[i]})
+}
+
+// FirstRecord returns the first record of this RecordCollection as a singleton,
+// or an empty RecordCollection if rc is empty.
+func (rc RecordCollection) FirstRecord() RecordCollection {
+	rSet := rc.Fetch()
+	if len(rSet.ids) == 0 {
+		return newRecordCollection(rSet.Env(), rSet.ModelName())
+	}
+	return rSet.Record(0)
+}
+
+// LastRecord returns the last record of this RecordCollection as a singleton,
+// or an empty RecordCollection if rc is empty.
+func (rc RecordCollection) LastRecord() RecordCollection {
+	rSet := rc.Fetch()
+	if len(rSet.ids) == 0 {
+		return newRecordCollection(rSet.Env(), rSet.ModelName())
+	}
+	return rSet.Record(len(rSet.ids) - 1)
+}
+
+// EnsureOne panics with a RecordSetError if rc is not a singleton
 func (rc RecordCollection) EnsureOne() {
-	if rc.Len() != 1 {
-		log.Panic("Expected singleton", "model", rc.ModelName(), "received", rc)
+	rSet := rc.Fetch()
+	if len(rSet.ids) != 1 {
+		panic(RecordSetError{
+			Model:   rSet.ModelName(),
+			IDs:     rSet.ids,
+			Message: fmt.Sprintf("Expected singleton, got %d records", len(rSet.ids)),
+		})
+	}
+}
+
+// IsValid returns true if all the records of rc exist in the database,
+// i.e. if none of them has been deleted. An empty RecordCollection is valid.
+func (rc RecordCollection) IsValid() bool {
+	return len(rc.missingIds()) == 0
+}
+
+// EnsureValid panics with a RecordSetError holding the ids of the
+// missing records if some records of rc do not exist in the database.
+func (rc RecordCollection) EnsureValid() {
+	missing := rc.missingIds()
+	if len(missing) > 0 {
+		panic(RecordSetError{
+			Model:   rc.ModelName(),
+			IDs:     missing,
+			Message: "Records do not exist or have been deleted",
+		})
+	}
+}
+
+// missingIds returns the ids of rc that do not exist in the database
+func (rc RecordCollection) missingIds() []int64 {
+	rSet := rc.Fetch()
+	if len(rSet.ids) == 0 {
+		return nil
+	}
+	var existing []int64
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE id IN (?)`, adapters[db.DriverName()].quoteTableName(rSet.model.tableName))
+	rSet.env.Cr().Select(&existing, query, rSet.ids)
+	existMap := make(map[int64]bool)
+	for _, id := range existing {
+		existMap[id] = true
 	}
+	var res []int64
+	for _, id := range rSet.ids {
+		if !existMap[id] {
+			res = append(res, id)
+		}
+	}
+	return res
 }
 
 // IsEmpty returns true if rc is an empty RecordCollection
@@ -656,30 +1099,148 @@ func (rc RecordCollection) Model() *Model {
 
 // Union returns a new RecordCollection that is the union of this RecordCollection
 // and the given `other` RecordCollection. The result is guaranteed to be a
-// set of unique records.
+// set of unique records, with the records of rc first, in their order.
 func (rc RecordCollection) Union(other RecordCollection) RecordCollection {
-	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to union RecordCollections of different models", "this", rc.ModelName(),
-			"other", other.ModelName())
-	}
-	thisRC := rc.Fetch()
-	otherRC := other.Fetch()
+	rc.checkSameModel(other, "union")
 	idMap := make(map[int64]bool)
-	for _, id := range thisRC.ids {
+	var ids []int64
+	for _, id := range append(rc.Ids(), other.Ids()...) {
+		if idMap[id] {
+			continue
+		}
 		idMap[id] = true
+		ids = append(ids, id)
 	}
-	for _, id := range otherRC.ids {
-		idMap[id] = true
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+}
+
+// Subtract returns a new RecordCollection with the records of this RecordCollection
+// that are not in the given `other` RecordCollection, in their order.
+func (rc RecordCollection) Subtract(other RecordCollection) RecordCollection {
+	rc.checkSameModel(other, "subtract")
+	otherIds := make(map[int64]bool)
+	for _, id := range other.Ids() {
+		otherIds[id] = true
 	}
-	ids := make([]int64, len(idMap))
-	i := 0
-	for id := range idMap {
-		ids[i] = id
-		i++
+	return rc.filterIds(func(id int64) bool {
+		return !otherIds[id]
+	})
+}
+
+// Intersect returns a new RecordCollection with the records of this RecordCollection
+// that are also in the given `other` RecordCollection, in their order.
+func (rc RecordCollection) Intersect(other RecordCollection) RecordCollection {
+	rc.checkSameModel(other, "intersect")
+	otherIds := make(map[int64]bool)
+	for _, id := range other.Ids() {
+		otherIds[id] = true
+	}
+	return rc.filterIds(func(id int64) bool {
+		return otherIds[id]
+	})
+}
+
+// Filtered returns a new RecordCollection with the records of this RecordCollection
+// for which fnct returns true, in their order. fnct is called with each record
+// as a singleton RecordCollection.
+func (rc RecordCollection) Filtered(fnct func(RecordCollection) bool) RecordCollection {
+	var ids []int64
+	for _, rec := range rc.Records() {
+		if fnct(rec) {
+			ids = append(ids, rec.ids[0])
+		}
+	}
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+}
+
+// Sorted returns a new RecordCollection with the records of this RecordCollection
+// sorted according to the given less function, which is called with singleton
+// RecordCollections. The sort is stable.
+func (rc RecordCollection) Sorted(less func(rs1, rs2 RecordCollection) bool) RecordCollection {
+	sorter := recordsSorter{
+		records: rc.Records(),
+		less:    less,
+	}
+	sort.Stable(sorter)
+	ids := make([]int64, len(sorter.records))
+	for i, rec := range sorter.records {
+		ids[i] = rec.ids[0]
 	}
 	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
 }
 
+// Mapped returns the records reached by following the given path of relation
+// fields from the records of this RecordCollection, e.g. "Partner.Country".
+// The result is a set of unique records of the model of the last field of the path.
+//
+// It panics if a field of the path is not a relation field.
+func (rc RecordCollection) Mapped(path string) RecordCollection {
+	res := rc
+	for _, fName := range strings.Split(path, ExprSep) {
+		fi := res.model.fields.MustGet(fName)
+		if !fi.isRelationField() {
+			log.Panic("Mapped path must contain only relation fields", "model", res.ModelName(),
+				"path", path, "field", fName)
+		}
+		idMap := make(map[int64]bool)
+		var ids []int64
+		for _, rec := range res.Records() {
+			for _, id := range rec.Get(fi.name).(RecordCollection).Ids() {
+				if idMap[id] {
+					continue
+				}
+				idMap[id] = true
+				ids = append(ids, id)
+			}
+		}
+		res = newRecordCollection(rc.Env(), fi.relatedModelName).withIds(ids)
+	}
+	return res
+}
+
+// filterIds returns a new RecordCollection with the ids of rc
+// for which keep returns true, in their order.
+func (rc RecordCollection) filterIds(keep func(int64) bool) RecordCollection {
+	var ids []int64
+	for _, id := range rc.Ids() {
+		if keep(id) {
+			ids = append(ids, id)
+		}
+	}
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+}
+
+// checkSameModel panics if other is not of the same model as rc.
+// operation is the name of the operation for the log message.
+func (rc RecordCollection) checkSameModel(other RecordCollection, operation string) {
+	if rc.ModelName() != other.ModelName() {
+		log.Panic(fmt.Sprintf("Unable to %s RecordCollections of different models", operation), "this", rc.ModelName(),
+			"other", other.ModelName())
+	}
+}
+
+// recordsSorter is a sort.Interface implementation to sort
+// singleton RecordCollections with a less function.
+type recordsSorter struct {
+	records []RecordCollection
+	less    func(rs1, rs2 RecordCollection) bool
+}
+
+// Len returns the number of records to sort
+func (s recordsSorter) Len() int {
+	return len(s.records)
+}
+
+// Swap swaps records i and j
+func (s recordsSorter) Swap(i, j int) {
+	s.records[i], s.records[j] = s.records[j], s.records[i]
+}
+
+// Less returns true if record i must be sorted before record j
+func (s recordsSorter) Less(i, j int) bool {
+	return s.less(s.records[i], s.records[j])
+}
+
 // withIdMap returns a new RecordCollection pointing to the given ids.
 // It overrides the current query with ("ID", "in", ids).
 func (rc RecordCollection) withIds(ids []int64) RecordCollection {
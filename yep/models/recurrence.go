@@ -0,0 +1,365 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/rrule"
+)
+
+// recurrenceMixinName is the name of the mixin making the records of a model recurrent
+const recurrenceMixinName = "RecurrenceMixin"
+
+// maxOccurrences is the maximum number of occurrences of a single recurrent
+// record that are returned or materialized at once.
+const maxOccurrences = 1000
+
+// An Occurrence is an occurrence of a record of a model inheriting
+// RecurrenceMixin in a date range.
+type Occurrence struct {
+	// ID is the id of the record of this occurrence, that is the id of its
+	// recurrent record if the occurrence is not materialized.
+	ID int64 `json:"id"`
+	// MasterID is the id of the recurrent record of this occurrence,
+	// or 0 if it is a record without recurrence.
+	MasterID int64          `json:"master_id"`
+	Date     types.DateTime `json:"date"`
+	// Virtual is true if this occurrence is not materialized as a record
+	Virtual bool `json:"virtual"`
+}
+
+// declareRecurrenceModels creates the RecurrenceMixin and the system
+// model in which the excluded occurrences are stored.
+func declareRecurrenceModels() {
+	exception := createModel("RecurrenceException", SystemModel)
+	exception.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	exception.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	exception.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true})
+	exception.InheritModel(Registry.MustGet("CommonMixin"))
+
+	recurrenceMixin := NewMixinModel(recurrenceMixinName)
+	recurrenceMixin.AddCharField("RRule", StringFieldParams{JSON: "rrule", Constraint: "checkRRule"})
+	recurrenceMixin.AddDateTimeField("RecurrenceStart", SimpleFieldParams{JSON: "recurrence_start", Index: true})
+	recurrenceMixin.AddIntegerField("RecurrenceMasterID", SimpleFieldParams{JSON: "recurrence_master_id",
+		NoCopy: true, Index: true})
+	recurrenceMixin.AddDateTimeField("RecurrenceDate", SimpleFieldParams{JSON: "recurrence_date", NoCopy: true})
+
+	recurrenceMixin.AddMethod("checkRRule",
+		`checkRRule returns an error if the recurrence rule of
+		one of the records of this RecordSet is invalid.`,
+		func(rc RecordCollection) error {
+			for _, rec := range rc.Records() {
+				src := rec.Get("RRule").(string)
+				if src == "" {
+					continue
+				}
+				if _, err := rrule.Parse(src); err != nil {
+					return fmt.Errorf("invalid recurrence rule '%s': %s", src, err)
+				}
+			}
+			return nil
+		})
+
+	recurrenceMixin.AddMethod("OccurrencesBetween",
+		`OccurrencesBetween returns the occurrences of the records
+		of this RecordSet that are in the [from, to) interval.`,
+		func(rc RecordCollection, from, to types.DateTime) []Occurrence {
+			return rc.OccurrencesBetween(time.Time(from), time.Time(to))
+		}).AllowGroup(security.GroupEveryone)
+
+	recurrenceMixin.AddMethod("MaterializeOccurrences",
+		`MaterializeOccurrences creates a record for each occurrence of the
+		records of this RecordSet before until and returns the new records.`,
+		func(rc RecordCollection, until types.DateTime) RecordCollection {
+			return rc.MaterializeOccurrences(time.Time(until))
+		}).AllowGroup(security.GroupEveryone)
+
+	recurrenceMixin.AddMethod("ExcludeOccurrence",
+		`ExcludeOccurrence removes the occurrence at the given date
+		from the recurrence of this record.`,
+		func(rc RecordCollection, date types.DateTime) {
+			rc.ExcludeOccurrence(time.Time(date))
+		}).AllowGroup(security.GroupEveryone)
+
+	recurrenceMixin.AddMethod("SplitRecurrence",
+		`SplitRecurrence ends the recurrence of this record before the given
+		date and returns a new recurrent record for the following occurrences.`,
+		func(rc RecordCollection, date types.DateTime) RecordCollection {
+			return rc.SplitRecurrence(time.Time(date))
+		}).AllowGroup(security.GroupEveryone)
+}
+
+// hasRecurrence returns true if this model inherits RecurrenceMixin
+func (m *Model) hasRecurrence() bool {
+	if m.isMixin() {
+		return false
+	}
+	for _, mixin := range m.allMixins() {
+		if mixin.name == recurrenceMixinName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRecurrenceModel panics if the model of rc does not inherit RecurrenceMixin
+func (rc RecordCollection) checkRecurrenceModel() {
+	if !rc.model.hasRecurrence() {
+		log.Panic("Model does not inherit RecurrenceMixin", "model", rc.model.name)
+	}
+}
+
+// recurrenceRule returns the recurrence rule and start of this singleton.
+// The last returned value is false if the record is not recurrent.
+func (rc RecordCollection) recurrenceRule() (rrule.Rule, time.Time, bool) {
+	src := rc.Get("RRule").(string)
+	start := rc.Get("RecurrenceStart").(types.DateTime)
+	if src == "" || start.IsNull() {
+		return rrule.Rule{}, time.Time{}, false
+	}
+	rule, err := rrule.Parse(src)
+	if err != nil {
+		log.Panic("Invalid recurrence rule", "model", rc.model.name, "id", rc.ids[0], "rule", src, "error", err)
+	}
+	return rule, time.Time(start), true
+}
+
+// skippedOccurrences returns the dates, as unix timestamps, of the
+// occurrences of this recurrent singleton that must not be returned as
+// virtual occurrences, because they are excluded or materialized.
+func (rc RecordCollection) skippedOccurrences() map[int64]bool {
+	var dates, materialized []time.Time
+	rc.env.Cr().Select(&dates, `SELECT date FROM recurrence_exception WHERE res_model = ? AND res_id = ?`,
+		rc.model.name, rc.ids[0])
+	query := fmt.Sprintf(`SELECT recurrence_date FROM %s WHERE recurrence_master_id = ?
+		AND recurrence_date IS NOT NULL`, rc.model.tableName)
+	rc.env.Cr().Select(&materialized, query, rc.ids[0])
+	res := make(map[int64]bool)
+	for _, date := range append(dates, materialized...) {
+		res[date.Unix()] = true
+	}
+	return res
+}
+
+// virtualOccurrences returns the dates of the occurrences of this singleton
+// in the [from, to) interval that are neither excluded nor materialized,
+// up to maxOccurrences.
+func (rc RecordCollection) virtualOccurrences(from, to time.Time) []time.Time {
+	rule, start, ok := rc.recurrenceRule()
+	if !ok {
+		return nil
+	}
+	skipped := rc.skippedOccurrences()
+	var res []time.Time
+	rule.Iterate(start, func(occurrence time.Time) bool {
+		if !occurrence.Before(to) {
+			return false
+		}
+		if !occurrence.Before(from) && !skipped[occurrence.Unix()] {
+			res = append(res, occurrence)
+		}
+		return len(res) < maxOccurrences
+	})
+	return res
+}
+
+// OccurrencesBetween returns the occurrences of the records of this
+// RecordCollection in the [from, to) interval, in chronological order.
+//
+// Recurrent records return their occurrences that are neither excluded nor
+// materialized as virtual occurrences. Other records, including materialized
+// occurrences, are returned if their RecurrenceStart is in the interval.
+func (rc RecordCollection) OccurrencesBetween(from, to time.Time) []Occurrence {
+	rc.checkRecurrenceModel()
+	var res []Occurrence
+	for _, rec := range rc.Fetch().Records() {
+		if rec.Get("RRule").(string) != "" {
+			for _, date := range rec.virtualOccurrences(from, to) {
+				res = append(res, Occurrence{
+					ID:       rec.ids[0],
+					MasterID: rec.ids[0],
+					Date:     types.DateTime(date),
+					Virtual:  true,
+				})
+			}
+			continue
+		}
+		start := time.Time(rec.Get("RecurrenceStart").(types.DateTime))
+		if start.IsZero() || start.Before(from) || !start.Before(to) {
+			continue
+		}
+		res = append(res, Occurrence{
+			ID:       rec.ids[0],
+			MasterID: rec.Get("RecurrenceMasterID").(int64),
+			Date:     types.DateTime(start),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		di, dj := time.Time(res[i].Date), time.Time(res[j].Date)
+		if di.Equal(dj) {
+			return res[i].ID < res[j].ID
+		}
+		return di.Before(dj)
+	})
+	return res
+}
+
+// MaterializeOccurrences creates a record for each occurrence before until of
+// the recurrent records of this RecordCollection that is neither excluded nor
+// already materialized, and returns the new records. New records are copies
+// of their recurrent record without recurrence rule, whose RecurrenceStart is
+// the date of the occurrence.
+//
+// This is typically called periodically to generate recurring invoices or tasks.
+func (rc RecordCollection) MaterializeOccurrences(until time.Time) RecordCollection {
+	rc.checkRecurrenceModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("materialize")
+	var ids []int64
+	for _, rec := range rc.Fetch().Records() {
+		_, start, ok := rec.recurrenceRule()
+		if !ok {
+			continue
+		}
+		for _, date := range rec.virtualOccurrences(start, until) {
+			overrides := FieldMap{
+				"RRule":              "",
+				"RecurrenceStart":    types.DateTime(date),
+				"RecurrenceMasterID": rec.ids[0],
+				"RecurrenceDate":     types.DateTime(date),
+			}
+			if nameFI, ok := rec.model.fields.get("name"); ok && nameFI.isCopiedField() {
+				overrides[nameFI.json] = rec.Get(nameFI.name)
+			}
+			newRec := rec.Call("Copy", overrides).(RecordCollection)
+			ids = append(ids, newRec.ids...)
+		}
+	}
+	return rc.withIds(ids)
+}
+
+// ExcludeOccurrence removes the occurrence at the given date from the
+// recurrence of this singleton. If this occurrence is materialized, its
+// record is deleted.
+func (rc RecordCollection) ExcludeOccurrence(date time.Time) {
+	rc.checkRecurrenceModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("exclude")
+	rc.EnsureOne()
+	if _, _, ok := rc.recurrenceRule(); !ok {
+		log.Panic("Record is not recurrent", "model", rc.model.name, "id", rc.ids[0])
+	}
+	var ids []int64
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE recurrence_master_id = ? AND recurrence_date = ?`,
+		rc.model.tableName)
+	rc.env.Cr().Select(&ids, query, rc.ids[0], date)
+	if len(ids) > 0 {
+		// the exception is added when the occurrence is deleted
+		rc.withIds(ids).Call("Unlink")
+		return
+	}
+	rc.addRecurrenceException(rc.ids[0], date)
+}
+
+// addRecurrenceException excludes the occurrence at the given date of the
+// record with the given id of the model of rc, if it is not already excluded.
+func (rc RecordCollection) addRecurrenceException(id int64, date time.Time) {
+	var count int
+	rc.env.Cr().Get(&count, `SELECT COUNT(*) FROM recurrence_exception WHERE res_model = ? AND res_id = ? AND date = ?`,
+		rc.model.name, id, date)
+	if count > 0 {
+		return
+	}
+	rc.env.Cr().Execute(`INSERT INTO recurrence_exception (res_model, res_id, date) VALUES (?, ?, ?)`,
+		rc.model.name, id, date)
+}
+
+// SplitRecurrence ends the recurrence of this singleton before the given
+// date and returns a copy of it whose recurrence starts at date and holds
+// the following occurrences. Materialized and excluded occurrences from date
+// onwards are moved to the returned record.
+//
+// It is used to modify an occurrence and all the following ones: the
+// modifications are written on the returned record. If date is the first
+// occurrence, this singleton is returned as is.
+func (rc RecordCollection) SplitRecurrence(date time.Time) RecordCollection {
+	rc.checkRecurrenceModel()
+	rc.checkNotAsOf()
+	rc.checkWritable("split")
+	rc.EnsureOne()
+	rule, start, ok := rc.recurrenceRule()
+	if !ok {
+		log.Panic("Record is not recurrent", "model", rc.model.name, "id", rc.ids[0])
+	}
+	var before int
+	rule.Iterate(start, func(occurrence time.Time) bool {
+		if !occurrence.Before(date) {
+			return false
+		}
+		before++
+		return true
+	})
+	if before == 0 {
+		return rc
+	}
+	newRule, oldRule := rule, rule
+	if rule.Count > 0 {
+		if rule.Count <= before {
+			log.Panic("Recurrence has no occurrence after date", "model", rc.model.name, "id", rc.ids[0], "date", date)
+		}
+		newRule.Count = rule.Count - before
+		oldRule.Count = before
+	} else {
+		oldRule.Until = date.Add(-time.Second)
+	}
+	overrides := FieldMap{
+		"RRule":           newRule.String(),
+		"RecurrenceStart": types.DateTime(date),
+	}
+	if nameFI, ok := rc.model.fields.get("name"); ok && nameFI.isCopiedField() {
+		overrides[nameFI.json] = rc.Get(nameFI.name)
+	}
+	newRec := rc.Call("Copy", overrides).(RecordCollection)
+	rc.Call("Write", FieldMap{"RRule": oldRule.String()})
+
+	var ids []int64
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE recurrence_master_id = ? AND recurrence_date >= ?`,
+		rc.model.tableName)
+	rc.env.Cr().Select(&ids, query, rc.ids[0], date)
+	if len(ids) > 0 {
+		rc.withIds(ids).Call("Write", FieldMap{"RecurrenceMasterID": newRec.ids[0]})
+	}
+	rc.env.Cr().Execute(`UPDATE recurrence_exception SET res_id = ? WHERE res_model = ? AND res_id = ? AND date >= ?`,
+		newRec.ids[0], rc.model.name, rc.ids[0], date)
+	return newRec
+}
+
+// deleteRecurrences deletes the excluded occurrences of the records of rc
+// and excludes the materialized occurrences of rc from the recurrence of
+// their recurrent record, so that they are not returned as virtual
+// occurrences anymore. It must be called when the records are deleted.
+func (rc RecordCollection) deleteRecurrences() {
+	if !rc.model.hasRecurrence() || len(rc.ids) == 0 {
+		return
+	}
+	rc.env.Cr().Execute(`DELETE FROM recurrence_exception WHERE res_model = ? AND res_id IN (?)`,
+		rc.model.name, rc.ids)
+	deleted := make(map[int64]bool)
+	for _, id := range rc.ids {
+		deleted[id] = true
+	}
+	for _, rec := range rc.Records() {
+		masterID := rec.Get("RecurrenceMasterID").(int64)
+		date := rec.Get("RecurrenceDate").(types.DateTime)
+		if masterID == 0 || date.IsNull() || deleted[masterID] {
+			continue
+		}
+		rc.addRecurrenceException(masterID, time.Time(date))
+	}
+}
@@ -60,6 +60,15 @@ func (mc *modelCollection) MustGet(nameOrJSON string) *Model {
 	return mi
 }
 
+// all returns all the models of the collection
+func (mc *modelCollection) all() []*Model {
+	res := make([]*Model, 0, len(mc.registryByName))
+	for _, mi := range mc.registryByName {
+		res = append(res, mi)
+	}
+	return res
+}
+
 // GetSequence the given Sequence by name or by db name
 func (mc *modelCollection) GetSequence(nameOrJSON string) (s *Sequence, ok bool) {
 	s, ok = mc.sequences[nameOrJSON]
@@ -112,14 +121,21 @@ func newModelCollection() *modelCollection {
 // A Model is the definition of a business object (e.g. a partner, a sale order, etc.)
 // including fields and methods.
 type Model struct {
-	name          string
-	options       Option
-	acl           *security.AccessControlList
-	rulesRegistry *recordRuleRegistry
-	tableName     string
-	fields        *FieldsCollection
-	methods       *MethodsCollection
-	mixins        []*Model
+	name           string
+	options        Option
+	acl            *security.AccessControlList
+	rulesRegistry  *recordRuleRegistry
+	tableName      string
+	fields         *FieldsCollection
+	methods        *MethodsCollection
+	mixins         []*Model
+	sqlConstraints map[string]*sqlConstraint
+	sqlIndexes     map[string]*sqlIndex
+	recName        string
+	parentName     string
+	parentPath     bool
+	defaultOrder   []string
+	changeFeed     bool
 }
 
 // getRelatedModelInfo returns the Model of the related model when
@@ -191,8 +207,15 @@ func (m *Model) scanToFieldMap(r sqlx.ColScanner, dest *FieldMap) error {
 
 	// Step 2: We populate our FieldMap with these values
 	for i, dbValue := range dbValues {
+		if strings.HasPrefix(columns[i], orderColumnPrefix) {
+			// Columns only used for ordering
+			continue
+		}
 		colName := strings.Replace(columns[i], sqlSep, ExprSep, -1)
 		dbVal := reflect.ValueOf(dbValue).Elem().Interface()
+		if fi := m.getRelatedFieldInfo(colName); fi.isEncrypted() {
+			dbVal = fi.decryptValue(dbVal)
+		}
 		(*dest)[colName] = dbVal
 	}
 
@@ -242,7 +265,7 @@ func (m *Model) convertValuesToFieldType(fMap *FieldMap) {
 				} else if fType == reflect.TypeOf([]int64{}) {
 					val = reflect.ValueOf(ids)
 				} else {
-					log.Panic("Non consistent type", "model", m.name, "field", colName, "type", fType, "value", fMapValue)
+					log.Panic("Non consistent type", "model", m.name, "field", colName, "type", fType, "value", fi.sqlArg(fMapValue))
 				}
 			} else {
 				val = reflect.ValueOf(fMapValue)
@@ -257,6 +280,32 @@ func (m *Model) convertValuesToFieldType(fMap *FieldMap) {
 	}
 }
 
+// checkSelectionValues checks that the values of the selection fields of the
+// given FieldMap are among the declared options of each field. Empty values are
+// always accepted since they mean that the field is unset.
+// It panics with a ValidationError if a value is not valid.
+func (m *Model) checkSelectionValues(env *Environment, fMap FieldMap) {
+	for colName, value := range fMap {
+		fi := m.getRelatedFieldInfo(colName)
+		if fi.fieldType != fieldtype.Selection {
+			continue
+		}
+		val, ok := value.(string)
+		if !ok || val == "" {
+			continue
+		}
+		if _, exists := fi.selectionValues(*env)[val]; !exists {
+			log.Debug("Invalid value for selection field", "model", m.name, "field", fi.name, "value", val)
+			panic(ValidationError{
+				Model:   m.name,
+				Field:   fi.name,
+				Value:   val,
+				Message: fmt.Sprintf("The value '%s' is not allowed for field '%s'", val, fi.description),
+			})
+		}
+	}
+}
+
 // isMixin returns true if this is a mixin model.
 func (m *Model) isMixin() bool {
 	if m.options&MixinModel > 0 {
@@ -281,6 +330,29 @@ func (m *Model) isSystem() bool {
 	return false
 }
 
+// SetLogAccess sets whether the records of this model have the CreateDate,
+// CreateUID, WriteDate and WriteUID fields, which are set by the ORM on
+// Create and Write. It is enabled by default for all models inheriting
+// BaseMixin and must be set before bootstrap.
+func (m *Model) SetLogAccess(enabled bool) *Model {
+	if enabled {
+		m.options &^= NoLogAccess
+	} else {
+		m.options |= NoLogAccess
+	}
+	return m
+}
+
+// hasLogAccess returns true if the ORM must set the CreateDate, CreateUID,
+// WriteDate and WriteUID fields of the records of this model.
+func (m *Model) hasLogAccess() bool {
+	if m.isSystem() || m.options&NoLogAccess > 0 {
+		return false
+	}
+	_, ok := m.fields.get("CreateDate")
+	return ok
+}
+
 // isSystem returns true if this is a n M2M Link model.
 func (m *Model) isM2MLink() bool {
 	if m.options&Many2ManyLinkModel > 0 {
@@ -341,13 +413,15 @@ func (m *Model) InheritModel(mixInModel *Model) {
 // by parsing the given struct pointer.
 func createModel(name string, options Option) *Model {
 	mi := &Model{
-		name:          name,
-		options:       options,
-		acl:           security.NewAccessControlList(),
-		rulesRegistry: newRecordRuleRegistry(),
-		tableName:     strutils.SnakeCaseString(name),
-		fields:        newFieldsCollection(),
-		methods:       newMethodsCollection(),
+		name:           name,
+		options:        options,
+		acl:            security.NewAccessControlList(),
+		rulesRegistry:  newRecordRuleRegistry(),
+		tableName:      strutils.SnakeCaseString(name),
+		fields:         newFieldsCollection(),
+		methods:        newMethodsCollection(),
+		sqlConstraints: make(map[string]*sqlConstraint),
+		sqlIndexes:     make(map[string]*sqlIndex),
 	}
 	pk := &Field{
 		name:      "ID",
@@ -387,14 +461,7 @@ func (m *Model) Field(name string) *ConditionField {
 // FilteredOn adds a condition with a table join on the given field and
 // filters the result with the given condition
 func (m *Model) FilteredOn(field string, condition *Condition) *Condition {
-	res := Condition{predicates: make([]predicate, len(condition.predicates))}
-	i := 0
-	for _, p := range condition.predicates {
-		p.exprs = append([]string{field}, p.exprs...)
-		res.predicates[i] = p
-		i++
-	}
-	return &res
+	return condition.filteredOn(field)
 }
 
 // Create creates a new record in this model with the given data.
@@ -402,6 +469,12 @@ func (m *Model) Create(env Environment, data interface{}) RecordCollection {
 	return env.Pool(m.name).Call("Create", data).(RecordSet).Collection()
 }
 
+// CreateMulti creates a record in the database for each of the given data
+// in a single query and returns the created records in the order of data.
+func (m *Model) CreateMulti(env Environment, data []FieldMap) RecordCollection {
+	return env.Pool(m.name).Call("CreateMulti", data).(RecordSet).Collection()
+}
+
 // Search searches the database and returns records matching the given condition.
 func (m *Model) Search(env Environment, cond *Condition) RecordCollection {
 	return env.Pool(m.name).Call("Search", cond).(RecordSet).Collection()
@@ -427,5 +500,14 @@ func NewSequence(name string) *Sequence {
 // NextValue returns the next value of this Sequence
 func (s *Sequence) NextValue() int64 {
 	adapter := adapters[db.DriverName()]
-	return adapter.nextSequenceValue(s.JSON)
+	return adapter.nextSequenceValue(nil, s.JSON)
+}
+
+// NextValueInEnv returns the next value of this Sequence, querying the
+// database in the transaction of the given Environment. It must be used
+// instead of NextValue when the transaction may hold locks that the
+// sequence needs, such as the write lock of an SQLite database.
+func (s *Sequence) NextValueInEnv(env Environment) int64 {
+	adapter := adapters[db.DriverName()]
+	return adapter.nextSequenceValue(env.Cr(), s.JSON)
 }
@@ -0,0 +1,72 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/tools/nbutils"
+)
+
+// companyContextKey is the context key holding the ID of the current company
+const companyContextKey = "company_id"
+
+// companyRoundingPolicies holds the rounding policy of each company, by company ID.
+var companyRoundingPolicies = struct {
+	sync.RWMutex
+	policies map[int64]nbutils.RoundingPolicy
+}{
+	policies: make(map[int64]nbutils.RoundingPolicy),
+}
+
+// SetCompanyRoundingPolicy sets the rounding policy of the company with the
+// given ID. This policy rounds the values of decimal fields when the company_id
+// key of the context is set to this company. If policy is nil, the company
+// policy is removed and the default policy is used instead.
+func SetCompanyRoundingPolicy(companyID int64, policy *nbutils.RoundingPolicy) {
+	companyRoundingPolicies.Lock()
+	defer companyRoundingPolicies.Unlock()
+	if policy == nil {
+		delete(companyRoundingPolicies.policies, companyID)
+		return
+	}
+	companyRoundingPolicies.policies[companyID] = *policy
+}
+
+// RoundingPolicy returns the rounding policy of the company of this
+// Environment or nbutils.DefaultRoundingPolicy if it has none.
+func (env Environment) RoundingPolicy() nbutils.RoundingPolicy {
+	var companyID int64
+	if env.context != nil {
+		companyID, _ = env.context.Get(companyContextKey).(int64)
+	}
+	companyRoundingPolicies.RLock()
+	defer companyRoundingPolicies.RUnlock()
+	var companyPolicy *nbutils.RoundingPolicy
+	if policy, ok := companyRoundingPolicies.policies[companyID]; ok {
+		companyPolicy = &policy
+	}
+	return nbutils.SelectPolicy(companyPolicy)
+}
+
+// roundDecimalValues rounds in place the values of the given FieldMap
+// that belong to float fields with a scale, with the rounding method of
+// the company of the Environment of rc.
+func (rc RecordCollection) roundDecimalValues(fMap FieldMap) {
+	policy := rc.env.RoundingPolicy()
+	for key, value := range fMap {
+		fi, ok := rc.model.fields.get(key)
+		if !ok || fi.fieldType != fieldtype.Float || fi.digits.Scale == 0 {
+			continue
+		}
+		val := reflect.ValueOf(value)
+		if val.Kind() != reflect.Float32 && val.Kind() != reflect.Float64 {
+			continue
+		}
+		policy.Scale = fi.digits.Scale
+		fMap[key] = reflect.ValueOf(policy.Round(val.Float())).Convert(val.Type()).Interface()
+	}
+}
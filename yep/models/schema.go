@@ -0,0 +1,65 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// syncPlan holds the statements that SyncDatabase would execute when
+// it is run by PlanDatabaseSync. It is nil when statements are executed.
+var syncPlan *[]string
+
+// syncExecute executes the given schema modification query outside of any
+// transaction, or only records it if the database sync is being planned.
+func syncExecute(query string, args ...interface{}) {
+	if syncPlan == nil {
+		dbExecuteNoTx(query, args...)
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(args) > 0 {
+		query = fmt.Sprintf("%s -- %v", query, args)
+	}
+	*syncPlan = append(*syncPlan, query)
+}
+
+// PlanDatabaseSync returns the statements that SyncDatabase would execute to
+// synchronize the database with the model registry, without executing them.
+//
+// Statements that depend on the result of a previous statement, such as the
+// orphan values check of selection fields, are computed from the current
+// database schema.
+func PlanDatabaseSync() []string {
+	res := make([]string, 0)
+	syncPlan = &res
+	defer func() {
+		syncPlan = nil
+	}()
+	SyncDatabase()
+	return res
+}
+
+// SetPreviousName sets the JSON name that this Field had before being renamed,
+// so that its column is renamed instead of being dropped and created again
+// when the database is synchronized, thus keeping its data.
+func (f *Field) SetPreviousName(jsonName string) *Field {
+	f.previousName = jsonName
+	return f
+}
+
+// renameDBColumn renames the column oldName of the given table to newName,
+// as well as its index and its unique and foreign key constraints.
+func renameDBColumn(tableName, oldName, newName string) {
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`
+		ALTER TABLE %s
+		RENAME COLUMN %s TO %s
+	`, adapter.quoteTableName(tableName), oldName, newName)
+	syncExecute(query)
+	renameDBIndex(tableName, columnIndexName(tableName, oldName), columnIndexName(tableName, newName))
+	renameDBConstraint(tableName, uniqueConstraintName(tableName, oldName), uniqueConstraintName(tableName, newName))
+	renameDBConstraint(tableName, fkConstraintName(tableName, oldName), fkConstraintName(tableName, newName))
+}
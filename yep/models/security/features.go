@@ -0,0 +1,141 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package security
+
+import "sync"
+
+// Features is the feature flags registry of the application
+var Features *FeatureCollection
+
+// A FeatureFlag allows to roll out a feature progressively. A feature is
+// enabled for a user if it is enabled globally, for one of the groups of
+// the user or for the current company of the user.
+type FeatureFlag struct {
+	ID          string
+	Description string
+	enabled     bool
+	groups      map[*Group]bool
+	companies   map[int64]bool
+}
+
+// A FeatureCollection keeps a list of feature flags
+type FeatureCollection struct {
+	sync.RWMutex
+	features map[string]*FeatureFlag
+}
+
+// NewFeatureCollection returns a pointer to a new FeatureCollection instance
+func NewFeatureCollection() *FeatureCollection {
+	return &FeatureCollection{
+		features: make(map[string]*FeatureFlag),
+	}
+}
+
+// NewFeature creates a new disabled feature flag with the given ID and
+// description and registers it. If a feature with the same ID already
+// exists, it is returned instead.
+func (fc *FeatureCollection) NewFeature(ID, description string) *FeatureFlag {
+	fc.Lock()
+	defer fc.Unlock()
+	if feature, exists := fc.features[ID]; exists {
+		return feature
+	}
+	feature := &FeatureFlag{
+		ID:          ID,
+		Description: description,
+		groups:      make(map[*Group]bool),
+		companies:   make(map[int64]bool),
+	}
+	fc.features[ID] = feature
+	return feature
+}
+
+// GetFeature returns the feature flag with the given ID or nil if not found
+func (fc *FeatureCollection) GetFeature(ID string) *FeatureFlag {
+	fc.RLock()
+	defer fc.RUnlock()
+	return fc.features[ID]
+}
+
+// AllFeatures returns all the registered feature flags
+func (fc *FeatureCollection) AllFeatures() []*FeatureFlag {
+	fc.RLock()
+	defer fc.RUnlock()
+	res := make([]*FeatureFlag, 0, len(fc.features))
+	for _, feature := range fc.features {
+		res = append(res, feature)
+	}
+	return res
+}
+
+// SetEnabled enables or disables the feature with the given ID for everyone.
+// It panics if the feature does not exist.
+func (fc *FeatureCollection) SetEnabled(ID string, value bool) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.mustGet(ID).enabled = value
+}
+
+// EnableForGroup enables the feature with the given ID for the members of
+// the given group. It panics if the feature does not exist.
+func (fc *FeatureCollection) EnableForGroup(ID string, group *Group) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.mustGet(ID).groups[group] = true
+}
+
+// DisableForGroup disables the feature with the given ID for the members of
+// the given group. It panics if the feature does not exist.
+func (fc *FeatureCollection) DisableForGroup(ID string, group *Group) {
+	fc.Lock()
+	defer fc.Unlock()
+	delete(fc.mustGet(ID).groups, group)
+}
+
+// EnableForCompany enables the feature with the given ID for the users of
+// the company with the given ID. It panics if the feature does not exist.
+func (fc *FeatureCollection) EnableForCompany(ID string, companyID int64) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.mustGet(ID).companies[companyID] = true
+}
+
+// DisableForCompany disables the feature with the given ID for the users of
+// the company with the given ID. It panics if the feature does not exist.
+func (fc *FeatureCollection) DisableForCompany(ID string, companyID int64) {
+	fc.Lock()
+	defer fc.Unlock()
+	delete(fc.mustGet(ID).companies, companyID)
+}
+
+// IsEnabled returns true if the feature with the given ID is enabled for the
+// user with the given uid working for the company with the given ID. Unknown
+// features are disabled.
+func (fc *FeatureCollection) IsEnabled(ID string, uid, companyID int64) bool {
+	fc.RLock()
+	defer fc.RUnlock()
+	feature, exists := fc.features[ID]
+	if !exists {
+		return false
+	}
+	if feature.enabled || feature.companies[companyID] {
+		return true
+	}
+	for group := range feature.groups {
+		if Registry.HasMembership(uid, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustGet returns the feature with the given ID. It panics if it does not exist.
+// It must be called with the lock held.
+func (fc *FeatureCollection) mustGet(ID string) *FeatureFlag {
+	feature, exists := fc.features[ID]
+	if !exists {
+		log.Panic("Unknown feature", "feature", ID)
+	}
+	return feature
+}
@@ -14,7 +14,10 @@
 
 package security
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 const (
 	// SuperUserID is the uid of the administrator
@@ -210,6 +213,20 @@ func (gc *GroupCollection) UserGroups(uid int64) map[*Group]InheritanceInfo {
 	return res
 }
 
+// Members returns the sorted uids of the members of the given group,
+// including the users that inherit the membership. It returns nil for
+// GroupEveryone.
+func (gc *GroupCollection) Members(group *Group) []int64 {
+	var res []int64
+	for uid, groups := range gc.memberships {
+		if _, ok := groups[group]; ok {
+			res = append(res, uid)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
 // AllGroups returns a slice with all the groups of the collection
 func (gc *GroupCollection) AllGroups() []*Group {
 	res := make([]*Group, len(gc.groups))
@@ -14,13 +14,14 @@
 
 package security
 
-// A Permission defines which of the read, write or unlink rights apply.
+// A Permission defines which of the read, write, unlink or create rights apply.
 type Permission uint8
 
-// The four Permissions are Read, Write, Unlink and All.
+// The five Permissions are Read, Write, Unlink, Create and All.
 const (
 	Read = 1 << Permission(iota)
 	Write
 	Unlink
-	All = Read | Write | Unlink
+	Create
+	All = Read | Write | Unlink | Create
 )
@@ -41,7 +41,7 @@ func TestAccessControlList(t *testing.T) {
 
 		Convey("Removing permissions from groups", func() {
 			acl.RemovePermission(group2, Read)
-			So(acl.perms[group2], ShouldEqual, Write|Unlink)
+			So(acl.perms[group2], ShouldEqual, Write|Unlink|Create)
 			acl.RemovePermission(group1, Write|Unlink)
 			So(acl.perms[group1], ShouldEqual, Read)
 		})
@@ -100,6 +100,9 @@ func TestGroupRegistry(t *testing.T) {
 			So(Registry.UserGroups(6), ShouldContainKey, group1)
 			So(Registry.UserGroups(6), ShouldContainKey, group5)
 			So(Registry.UserGroups(6), ShouldContainKey, GroupEveryone)
+
+			So(Registry.Members(group1), ShouldResemble, []int64{2, 4, 5, 6})
+			So(Registry.Members(group4), ShouldResemble, []int64{5})
 		})
 		Convey("Removing a group should remove all memberships (incl. inherited)", func() {
 			Registry.UnregisterGroup(group3)
@@ -177,3 +180,38 @@ func TestGroupRegistry(t *testing.T) {
 		})
 	})
 }
+
+func TestFeatureFlags(t *testing.T) {
+	betaGroup := Registry.NewGroup("beta_testers", "Beta Testers")
+	Registry.AddMembership(7, betaGroup)
+	Convey("Testing feature flags", t, func() {
+		fc := NewFeatureCollection()
+		fc.NewFeature("new_ui", "New user interface")
+		Convey("New features are disabled", func() {
+			So(fc.GetFeature("new_ui").Description, ShouldEqual, "New user interface")
+			So(fc.IsEnabled("new_ui", 7, 1), ShouldBeFalse)
+			So(fc.IsEnabled("unknown_feature", 7, 1), ShouldBeFalse)
+		})
+		Convey("Features can be enabled for everyone", func() {
+			fc.SetEnabled("new_ui", true)
+			So(fc.IsEnabled("new_ui", 8, 0), ShouldBeTrue)
+		})
+		Convey("Features can be enabled per group", func() {
+			fc.EnableForGroup("new_ui", betaGroup)
+			So(fc.IsEnabled("new_ui", 7, 0), ShouldBeTrue)
+			So(fc.IsEnabled("new_ui", 8, 0), ShouldBeFalse)
+			fc.DisableForGroup("new_ui", betaGroup)
+			So(fc.IsEnabled("new_ui", 7, 0), ShouldBeFalse)
+		})
+		Convey("Features can be enabled per company", func() {
+			fc.EnableForCompany("new_ui", 2)
+			So(fc.IsEnabled("new_ui", 8, 2), ShouldBeTrue)
+			So(fc.IsEnabled("new_ui", 8, 3), ShouldBeFalse)
+			fc.DisableForCompany("new_ui", 2)
+			So(fc.IsEnabled("new_ui", 8, 2), ShouldBeFalse)
+		})
+		Convey("Enabling an unknown feature panics", func() {
+			So(func() { fc.SetEnabled("unknown_feature", true) }, ShouldPanic)
+		})
+	})
+}
@@ -14,7 +14,27 @@
 
 package models
 
-import "github.com/npiganeau/yep/yep/models/security"
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/models/security"
+)
+
+// A FieldAccessPolicy defines what to do when a user reads or writes
+// fields they have no access rights on.
+type FieldAccessPolicy int8
+
+const (
+	// UnauthorizedFieldsDrop silently ignores unauthorized fields: they
+	// are not written and they are not returned when reading.
+	UnauthorizedFieldsDrop FieldAccessPolicy = iota
+	// UnauthorizedFieldsFail panics with an AccessError
+	UnauthorizedFieldsFail
+)
+
+// UnauthorizedFields is the policy applied when a user reads
+// or writes fields they have no access rights on.
+var UnauthorizedFields = UnauthorizedFieldsDrop
 
 // GrantAccess grants the given perm to the given group on the given field of model.
 // Only security.Read and security.Write permissions are taken into account by
@@ -34,6 +54,53 @@ func (f *Field) RevokeAccess(group *security.Group, perm security.Permission) *F
 	return f
 }
 
+// setupFieldGroups restricts the access to the fields declared with Groups
+// to the members of these groups and to the administrators. It panics if
+// one of the groups does not exist.
+func setupFieldGroups() {
+	for _, model := range Registry.registryByName {
+		for _, fi := range model.fields.registryByName {
+			if len(fi.groups) == 0 {
+				continue
+			}
+			fi.acl.RemovePermission(security.GroupEveryone, security.Read|security.Write)
+			fi.acl.AddPermission(security.GroupAdmin, security.Read|security.Write)
+			for _, groupID := range fi.groups {
+				group := security.Registry.GetGroup(groupID)
+				if group == nil {
+					log.Panic("Unknown group in field declaration", "model", model.name, "field", fi.name, "group", groupID)
+				}
+				fi.acl.AddPermission(group, security.Read|security.Write)
+			}
+		}
+	}
+}
+
+// checkFieldsAccess checks that the current user has the given perm on the
+// given fields of rc's model. If the UnauthorizedFields policy is
+// UnauthorizedFieldsFail, it panics with an AccessError if it is not the case.
+// Otherwise, it does nothing and unauthorized fields are dropped later.
+func (rc RecordCollection) checkFieldsAccess(fields []string, perm security.Permission) {
+	if UnauthorizedFields != UnauthorizedFieldsFail {
+		return
+	}
+	for _, field := range fields {
+		fi := rc.model.getRelatedFieldInfo(field)
+		if checkFieldPermission(fi, rc.env.uid, perm) {
+			continue
+		}
+		action := "read"
+		if perm&security.Write != 0 {
+			action = "write"
+		}
+		panic(AccessError{
+			Model:   rc.model.name,
+			Field:   fi.name,
+			Message: fmt.Sprintf("You are not allowed to %s field '%s'", action, fi.description),
+		})
+	}
+}
+
 // checkFieldPermission checks if the given uid has the given perm on the given field info.
 func checkFieldPermission(f *Field, uid int64, perm security.Permission) bool {
 	userGroups := security.Registry.UserGroups(uid)
@@ -0,0 +1,210 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// A SecurityEventType is the type of an authentication event
+type SecurityEventType string
+
+// Security event types
+const (
+	EventLoginSuccess     SecurityEventType = "login_success"
+	EventLoginFailure     SecurityEventType = "login_failure"
+	EventTwoFactorSuccess SecurityEventType = "2fa_success"
+	EventTwoFactorFailure SecurityEventType = "2fa_failure"
+	EventImpersonation    SecurityEventType = "impersonation"
+	EventAPIKeyUse        SecurityEventType = "api_key"
+)
+
+// A SecurityEvent is an authentication event, as recorded
+// in the SecurityEvent model.
+type SecurityEvent struct {
+	Type  SecurityEventType
+	Login string
+	// UID is the ID of the authenticated user, or of the
+	// user impersonating another one. 0 if unknown.
+	UID int64
+	// TargetUID is the ID of the impersonated user
+	TargetUID int64
+	IP        string
+	UserAgent string
+	Details   string
+}
+
+// declareSecurityEventModel creates the system model in
+// which authentication events are recorded.
+func declareSecurityEventModel() {
+	securityEvent := createModel("SecurityEvent", SystemModel)
+	securityEvent.AddSelectionField("EventType", SelectionFieldParams{JSON: "event_type", Required: true, Index: true,
+		Selection: types.Selection{
+			string(EventLoginSuccess):     "Login Success",
+			string(EventLoginFailure):     "Login Failure",
+			string(EventTwoFactorSuccess): "Two-Factor Success",
+			string(EventTwoFactorFailure): "Two-Factor Failure",
+			string(EventImpersonation):    "Impersonation",
+			string(EventAPIKeyUse):        "API Key Use",
+		}})
+	securityEvent.AddCharField("Login", StringFieldParams{JSON: "login", Index: true})
+	securityEvent.AddIntegerField("UID", SimpleFieldParams{JSON: "uid", Index: true})
+	securityEvent.AddIntegerField("TargetUID", SimpleFieldParams{JSON: "target_uid"})
+	securityEvent.AddCharField("IP", StringFieldParams{JSON: "ip"})
+	securityEvent.AddCharField("UserAgent", StringFieldParams{JSON: "user_agent"})
+	securityEvent.AddTextField("Details", StringFieldParams{JSON: "details"})
+	securityEvent.AddDateTimeField("Date", SimpleFieldParams{JSON: "date", Required: true, Index: true})
+	securityEvent.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// RecordSecurityEvent records the given event in the SecurityEvent model and
+// checks the alert rules of its type.
+//
+// The event is recorded outside of any transaction, so that it is kept even
+// if the transaction of the caller is rolled back, e.g. after a failed login.
+func RecordSecurityEvent(event SecurityEvent) {
+	now := time.Now()
+	query := `INSERT INTO security_event (event_type, login, uid, target_uid, ip, user_agent, details, date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	dbExecuteNoTx(query, string(event.Type), event.Login, event.UID, event.TargetUID, event.IP, event.UserAgent,
+		event.Details, now)
+	for _, rule := range securityAlertRules.matching(event.Type) {
+		rule.check(event, now)
+	}
+}
+
+// A SecurityAlertRule raises an alert when Threshold events of
+// EventType happen for the same login within Period.
+type SecurityAlertRule struct {
+	Name      string
+	EventType SecurityEventType
+	Threshold int
+	Period    time.Duration
+	// Recipients are the email addresses to which the alert is sent
+	Recipients []string
+}
+
+// check sends an alert if the given event, which happened at date now,
+// makes the number of events of this rule reach its threshold. The alert
+// is sent only once per burst of events.
+func (sar *SecurityAlertRule) check(event SecurityEvent, now time.Time) {
+	var count int
+	query := `SELECT COUNT(*) FROM security_event WHERE event_type = ? AND login = ? AND date > ?`
+	dbGetNoTx(&count, query, string(sar.EventType), event.Login, now.Add(-sar.Period))
+	if count != sar.Threshold {
+		return
+	}
+	log.Warn("Security alert", "rule", sar.Name, "type", event.Type, "login", event.Login, "ip", event.IP, "count", count)
+	if SecurityAlerts == nil {
+		return
+	}
+	if err := SecurityAlerts.SendAlert(*sar, event, count); err != nil {
+		log.Warn("Unable to send security alert", "rule", sar.Name, "error", err)
+	}
+}
+
+// A securityAlertRuleRegistry holds the security alert rules by name
+type securityAlertRuleRegistry struct {
+	sync.RWMutex
+	rules map[string]*SecurityAlertRule
+}
+
+// matching returns the rules of the given event type
+func (sarr *securityAlertRuleRegistry) matching(eventType SecurityEventType) []*SecurityAlertRule {
+	sarr.RLock()
+	defer sarr.RUnlock()
+	var res []*SecurityAlertRule
+	for _, rule := range sarr.rules {
+		if rule.EventType == eventType {
+			res = append(res, rule)
+		}
+	}
+	return res
+}
+
+// securityAlertRules is the registry of the security alert rules of the application
+var securityAlertRules = &securityAlertRuleRegistry{
+	rules: make(map[string]*SecurityAlertRule),
+}
+
+// AddSecurityAlertRule adds the given rule, replacing any existing rule with the
+// same name. It panics if the rule has no threshold or no period.
+func AddSecurityAlertRule(rule SecurityAlertRule) {
+	if rule.Threshold <= 0 || rule.Period <= 0 {
+		log.Panic("Security alert rules must have a positive threshold and period", "rule", rule.Name)
+	}
+	securityAlertRules.Lock()
+	defer securityAlertRules.Unlock()
+	securityAlertRules.rules[rule.Name] = &rule
+}
+
+// RemoveSecurityAlertRule removes the security alert rule with the given name
+func RemoveSecurityAlertRule(name string) {
+	securityAlertRules.Lock()
+	defer securityAlertRules.Unlock()
+	delete(securityAlertRules.rules, name)
+}
+
+// A SecurityAlertSender sends the alerts raised by security alert rules
+type SecurityAlertSender interface {
+	// SendAlert sends an alert for the given rule whose threshold
+	// has been reached with count events, the last one being event.
+	SendAlert(rule SecurityAlertRule, event SecurityEvent, count int) error
+}
+
+// SecurityAlerts is the SecurityAlertSender of security alerts.
+// Alerts are only logged if it is nil.
+var SecurityAlerts SecurityAlertSender
+
+// A MailSender sends emails
+type MailSender interface {
+	// SendMail sends an email with the given subject
+	// and plain text body to the given addresses.
+	SendMail(to []string, subject, body string) error
+}
+
+// A MailAlertSender is a SecurityAlertSender that sends
+// alerts by email to the recipients of the rule.
+//
+// It is also a MailSender that can be used for the emails of automations.
+type MailAlertSender struct {
+	// Address is the address of the SMTP server, e.g. "localhost:25"
+	Address string
+	// From is the sender address of the emails
+	From string
+	// Auth is the authentication mechanism of the SMTP server, if any
+	Auth smtp.Auth
+}
+
+var _ SecurityAlertSender = MailAlertSender{}
+var _ MailSender = MailAlertSender{}
+
+// SendAlert sends an alert for the given rule whose threshold
+// has been reached with count events, the last one being event.
+func (s MailAlertSender) SendAlert(rule SecurityAlertRule, event SecurityEvent, count int) error {
+	if len(rule.Recipients) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("Security alert: %s", rule.Name)
+	body := fmt.Sprintf("%d %s events for login '%s' within %s.\r\n\r\nLast event from IP %s (%s) at %s.\r\n",
+		count, event.Type, event.Login, rule.Period, event.IP, event.UserAgent, time.Now().Format(time.RFC1123))
+	return s.SendMail(rule.Recipients, subject, body)
+}
+
+// SendMail sends an email with the given subject
+// and plain text body to the given addresses.
+func (s MailAlertSender) SendMail(to []string, subject, body string) error {
+	if len(to) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
+		s.From, strings.Join(to, ", "), subject, body)
+	return smtp.SendMail(s.Address, s.Auth, s.From, to, []byte(msg))
+}
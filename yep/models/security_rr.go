@@ -18,6 +18,7 @@ import (
 	"sync"
 
 	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/expr"
 )
 
 // A RecordRule allow to grant a group some permissions
@@ -25,12 +26,32 @@ import (
 // - If Global is true, then the RecordRule applies to all groups
 // - Condition is the filter to apply on the model to retrieve
 // the records on which to allow the Perms permission.
+// - Domain is a domain expression (see package expr) with dynamic parts
+// evaluated for the current user, e.g. "company_id == user.company_id".
+// It is AND-combined with Condition if both are set.
+// - Perms can combine security.Read, security.Write, security.Unlink
+// and security.Create. Create rules are checked on the created records.
 type RecordRule struct {
 	Name      string
 	Global    bool
 	Group     *security.Group
 	Condition *Condition
+	Domain    string
 	Perms     security.Permission
+	domain    *expr.Program
+}
+
+// condition returns the filter of this rule on the given model
+// for the given Environment.
+func (rr *RecordRule) condition(mi *Model, env *Environment) *Condition {
+	if rr.domain == nil {
+		return rr.Condition
+	}
+	cond := domainCondition(mi, rr.domain, env)
+	if rr.Condition == nil {
+		return cond
+	}
+	return rr.Condition.AndCond(cond)
 }
 
 // A RecordRuleRegistry keeps a list of RecordRule. It is meant
@@ -44,6 +65,13 @@ type recordRuleRegistry struct {
 
 // AddRule registers the given RecordRule to the registry with the given name.
 func (rrr *recordRuleRegistry) addRule(rule *RecordRule) {
+	if rule.Domain != "" {
+		program, err := expr.Compile(rule.Domain)
+		if err != nil {
+			log.Panic("Invalid record rule domain", "rule", rule.Name, "error", err)
+		}
+		rule.domain = program
+	}
 	rrr.Lock()
 	defer rrr.Unlock()
 	rrr.rulesByName[rule.Name] = rule
@@ -81,6 +109,47 @@ func (rrr *recordRuleRegistry) removeRule(name string) {
 	}
 }
 
+// hasRules returns true if there are rules for the given perm that apply
+// to the user with the given uid.
+func (rrr *recordRuleRegistry) hasRules(uid int64, perm security.Permission) bool {
+	rrr.RLock()
+	defer rrr.RUnlock()
+	for _, rule := range rrr.globalRules {
+		if perm&rule.Perms > 0 {
+			return true
+		}
+	}
+	for group := range security.Registry.UserGroups(uid) {
+		for _, rule := range rrr.rulesByGroup[group.Name] {
+			if perm&rule.Perms > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rulesFor returns the global rules and the rules of the groups of the user
+// with the given uid that apply to the given perm. The rules are copied so
+// that they can be used without holding the lock of the registry.
+func (rrr *recordRuleRegistry) rulesFor(uid int64, perm security.Permission) (global, groups []*RecordRule) {
+	rrr.RLock()
+	defer rrr.RUnlock()
+	for _, rule := range rrr.globalRules {
+		if perm&rule.Perms > 0 {
+			global = append(global, rule)
+		}
+	}
+	for group := range security.Registry.UserGroups(uid) {
+		for _, rule := range rrr.rulesByGroup[group.Name] {
+			if perm&rule.Perms > 0 {
+				groups = append(groups, rule)
+			}
+		}
+	}
+	return
+}
+
 // newRecordRuleRegistry returns a pointer to a new RecordRuleRegistry instance
 func newRecordRuleRegistry() *recordRuleRegistry {
 	return &recordRuleRegistry{
@@ -101,3 +170,18 @@ func (m *Model) AddRecordRule(rule *RecordRule) {
 func (m *Model) RemoveRecordRule(name string) {
 	m.rulesRegistry.removeRule(name)
 }
+
+// checkRecordRuleDomains checks that the domains of
+// all record rules are valid for their model.
+func checkRecordRuleDomains() {
+	for _, mi := range Registry.registryByName {
+		for _, rule := range mi.rulesRegistry.rulesByName {
+			if rule.domain == nil {
+				continue
+			}
+			if err := mi.checkDomain(rule.domain); err != nil {
+				log.Panic("Invalid record rule domain", "model", mi.name, "rule", rule.Name, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"reflect"
+
+	"github.com/npiganeau/yep/yep/models/security"
+)
+
+// maskedValue replaces the values of sensitive fields in logs and traces
+const maskedValue = "********"
+
+// A sensitiveArg is an SQL query argument holding the value of a sensitive
+// field. It is printed as maskedValue so that the value does not appear in
+// SQL logs and panic messages, and it is unwrapped before the query is sent
+// to the database.
+type sensitiveArg struct {
+	value interface{}
+}
+
+// String returns the masked representation of this sensitiveArg
+func (s sensitiveArg) String() string {
+	return maskedValue
+}
+
+// isSensitive returns true if the values of this field must be masked
+// in logs and traces. Encrypted fields are always sensitive.
+func (f *Field) isSensitive() bool {
+	return f.sensitive || f.isEncrypted()
+}
+
+// sqlArg returns the given value of this field as an SQL query argument,
+// wrapped in a sensitiveArg if the field is sensitive.
+func (f *Field) sqlArg(value interface{}) interface{} {
+	if !f.isSensitive() || value == nil {
+		return value
+	}
+	if values := reflect.ValueOf(value); values.Kind() == reflect.Slice && values.Type() != reflect.TypeOf([]byte{}) {
+		// Wrap each element so that IN clauses are still expanded
+		res := make([]interface{}, values.Len())
+		for i := 0; i < values.Len(); i++ {
+			res[i] = sensitiveArg{value: values.Index(i).Interface()}
+		}
+		return res
+	}
+	return sensitiveArg{value: value}
+}
+
+// unmaskArgs returns the given SQL query arguments with the values of
+// sensitiveArg arguments unwrapped. args is returned as is if it does
+// not hold any sensitiveArg.
+func unmaskArgs(args []interface{}) []interface{} {
+	var res []interface{}
+	for i, arg := range args {
+		sArg, ok := arg.(sensitiveArg)
+		if !ok {
+			if res != nil {
+				res[i] = arg
+			}
+			continue
+		}
+		if res == nil {
+			res = make([]interface{}, len(args))
+			copy(res, args[:i])
+		}
+		res[i] = sArg.value
+	}
+	if res == nil {
+		return args
+	}
+	return res
+}
+
+// maskFieldMap returns a copy of the given FieldMap in which the values
+// of the sensitive fields are masked, to be used in logs and panics.
+func (m *Model) maskFieldMap(fMap FieldMap) FieldMap {
+	res := make(FieldMap)
+	for fName, value := range fMap {
+		if fi, ok := m.fields.get(fName); ok && fi.isSensitive() {
+			value = maskedValue
+		}
+		res[fName] = value
+	}
+	return res
+}
+
+// maskedValue returns the value to give instead of a value of this
+// sensitive field, i.e. maskedValue for string fields and the zero
+// value of the field's type otherwise.
+func (f *Field) maskedValue() interface{} {
+	if f.structField.Type.Kind() == reflect.String {
+		return reflect.ValueOf(maskedValue).Convert(f.structField.Type).Interface()
+	}
+	return reflect.Zero(f.structField.Type).Interface()
+}
+
+// canSeeSensitiveHistory returns true if the current user can see the
+// previous values of sensitive fields, i.e. if they are an administrator.
+func (rc RecordCollection) canSeeSensitiveHistory() bool {
+	return security.Registry.HasMembership(rc.env.uid, security.GroupAdmin)
+}
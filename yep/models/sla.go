@@ -0,0 +1,305 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/expr"
+)
+
+// slaMixinName is the name of the mixin adding SLA tracking to a model
+const slaMixinName = "SLAMixin"
+
+// TriggerOnSLABreach triggers an automation when the deadline of a record
+// of a model inheriting SLAMixin is missed (see CheckSLABreaches).
+const TriggerOnSLABreach AutomationTrigger = "on_sla_breach"
+
+// slaWeekdays are the names of the days in the WorkDays field of SLA policies
+var slaWeekdays = map[string]time.Weekday{
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+	"sun": time.Sunday,
+}
+
+// An SLABreachNotifier is notified of the records whose SLA deadline is missed
+type SLABreachNotifier interface {
+	// NotifySLABreach notifies that the deadline of the given records has
+	// been missed.
+	NotifySLABreach(rc RecordCollection) error
+}
+
+// SLABreaches is the SLABreachNotifier of the application.
+// Breaches are only logged if it is nil.
+var SLABreaches SLABreachNotifier
+
+// An slaPolicy is an SLA policy as stored in the sla_policy table
+type slaPolicy struct {
+	ID            int64   `db:"id"`
+	Name          string  `db:"name"`
+	ResModel      string  `db:"res_model"`
+	Condition     string  `db:"condition_expr"`
+	DoneCondition string  `db:"done_condition"`
+	TargetHours   float64 `db:"target_hours"`
+	WorkDays      string  `db:"work_days"`
+	WorkFrom      float64 `db:"work_from"`
+	WorkTo        float64 `db:"work_to"`
+	CalendarID    int64   `db:"calendar_id"`
+}
+
+// slaPolicyColumns are the columns of the sla_policy table read into slaPolicy
+const slaPolicyColumns = `id, name, res_model, condition_expr, done_condition, target_hours, work_days,
+	work_from, work_to, COALESCE(calendar_id, 0) AS calendar_id`
+
+// declareSLAModels creates the SLAMixin and the system model
+// in which SLA policies are stored.
+func declareSLAModels() {
+	slaMixin := NewMixinModel(slaMixinName)
+	slaMixin.AddCharField("SLAPolicy", StringFieldParams{JSON: "sla_policy", NoCopy: true})
+	slaMixin.AddDateTimeField("SLADeadline", SimpleFieldParams{JSON: "sla_deadline", NoCopy: true, Index: true})
+	slaMixin.AddDateTimeField("SLADoneDate", SimpleFieldParams{JSON: "sla_done_date", NoCopy: true})
+	slaMixin.AddBooleanField("SLABreached", SimpleFieldParams{JSON: "sla_breached", NoCopy: true, Index: true})
+
+	policy := createModel("SLAPolicy", SystemModel)
+	policy.AddCharField("Name", StringFieldParams{JSON: "name", Required: true})
+	policy.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true,
+		Constraint: "checkSLAPolicy"})
+	policy.AddActiveField(SimpleFieldParams{JSON: "active"})
+	policy.AddIntegerField("Sequence", SimpleFieldParams{JSON: "sequence"})
+	policy.AddTextField("Condition", StringFieldParams{JSON: "condition_expr", Constraint: "checkSLAPolicy"})
+	policy.AddTextField("DoneCondition", StringFieldParams{JSON: "done_condition", Required: true,
+		Constraint: "checkSLAPolicy"})
+	policy.AddFloatField("TargetHours", FloatFieldParams{JSON: "target_hours", Required: true,
+		Constraint: "checkSLAPolicy"})
+	policy.AddCharField("WorkDays", StringFieldParams{JSON: "work_days", Constraint: "checkSLAPolicy",
+		Default: func(Environment, FieldMap) interface{} {
+			return "mon,tue,wed,thu,fri"
+		}})
+	policy.AddFloatField("WorkFrom", FloatFieldParams{JSON: "work_from", Constraint: "checkSLAPolicy",
+		Default: func(Environment, FieldMap) interface{} {
+			return 8.0
+		}})
+	policy.AddFloatField("WorkTo", FloatFieldParams{JSON: "work_to", Constraint: "checkSLAPolicy",
+		Default: func(Environment, FieldMap) interface{} {
+			return 17.0
+		}})
+	policy.AddIntegerField("CalendarID", SimpleFieldParams{JSON: "calendar_id", Constraint: "checkSLAPolicy"})
+	policy.InheritModel(Registry.MustGet("CommonMixin"))
+
+	policy.AddMethod("checkSLAPolicy",
+		`checkSLAPolicy returns an error if one of the SLA policies of this
+		RecordSet cannot be applied to its model.`,
+		func(rc RecordCollection) error {
+			for _, id := range rc.Ids() {
+				var policies []slaPolicy
+				query := fmt.Sprintf(`SELECT %s FROM sla_policy WHERE id = ?`, slaPolicyColumns)
+				rc.env.Cr().Select(&policies, query, id)
+				for _, p := range policies {
+					if err := p.check(); err != nil {
+						return fmt.Errorf("invalid SLA policy '%s': %s", p.Name, err)
+					}
+					if p.CalendarID == 0 {
+						continue
+					}
+					var count int
+					rc.env.Cr().Get(&count, `SELECT COUNT(*) FROM resource_calendar WHERE id = ?`, p.CalendarID)
+					if count == 0 {
+						return fmt.Errorf("invalid SLA policy '%s': unknown calendar %d", p.Name, p.CalendarID)
+					}
+				}
+			}
+			return nil
+		})
+}
+
+// hasSLA returns true if this model inherits SLAMixin
+func (m *Model) hasSLA() bool {
+	if m.isMixin() {
+		return false
+	}
+	for _, mixin := range m.allMixins() {
+		if mixin.name == slaMixinName {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if this policy cannot be applied to its model
+func (p slaPolicy) check() error {
+	mi, ok := Registry.Get(p.ResModel)
+	if !ok || !mi.hasSLA() {
+		return fmt.Errorf("model '%s' does not inherit %s", p.ResModel, slaMixinName)
+	}
+	for _, src := range []string{p.Condition, p.DoneCondition} {
+		if src == "" {
+			continue
+		}
+		program, err := expr.Compile(src)
+		if err != nil {
+			return err
+		}
+		if err = mi.CheckExpr(program); err != nil {
+			return err
+		}
+	}
+	if p.TargetHours <= 0 {
+		return fmt.Errorf("target hours must be positive")
+	}
+	if p.WorkFrom < 0 || p.WorkTo > 24 || p.WorkFrom >= p.WorkTo {
+		return fmt.Errorf("invalid working hours %g-%g", p.WorkFrom, p.WorkTo)
+	}
+	days, err := p.workDays()
+	if err != nil {
+		return err
+	}
+	if len(days) == 0 {
+		return fmt.Errorf("no working days")
+	}
+	return nil
+}
+
+// workDays returns the working days of this policy
+func (p slaPolicy) workDays() (map[time.Weekday]bool, error) {
+	res := make(map[time.Weekday]bool)
+	for _, day := range strings.Split(p.WorkDays, ",") {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if day == "" {
+			continue
+		}
+		weekday, ok := slaWeekdays[day]
+		if !ok {
+			return nil, fmt.Errorf("unknown working day '%s'", day)
+		}
+		res[weekday] = true
+	}
+	return res, nil
+}
+
+// calendar returns the calendar in which the deadlines of this policy are
+// computed, that is its ResourceCalendar if it has one, or its working days
+// and hours otherwise.
+func (p slaPolicy) calendar(env *Environment) Calendar {
+	if p.CalendarID != 0 {
+		return LoadCalendar(*env, p.CalendarID)
+	}
+	days, err := p.workDays()
+	if err != nil || len(days) == 0 {
+		log.Panic("Invalid SLA policy", "policy", p.Name, "error", err)
+	}
+	res := Calendar{Name: p.Name, Location: time.UTC}
+	for day := range days {
+		res.Hours = append(res.Hours, WorkingHours{Weekday: day, HourFrom: p.WorkFrom, HourTo: p.WorkTo})
+	}
+	return res
+}
+
+// matches returns true if the given condition of this policy is
+// satisfied by the given singleton. Empty conditions are satisfied.
+func (p slaPolicy) matches(rc RecordCollection, condition string) bool {
+	if condition == "" {
+		return true
+	}
+	program, err := expr.Compile(condition)
+	if err != nil {
+		log.Panic("Invalid SLA policy condition", "policy", p.Name, "error", err)
+	}
+	return expr.Truth(rc.EvalExpr(program))
+}
+
+// slaPolicies returns the active SLA policies of the model of this
+// RecordCollection, in the order in which they must be tried.
+func (rc RecordCollection) slaPolicies() []slaPolicy {
+	var policies []slaPolicy
+	query := fmt.Sprintf(`SELECT %s FROM sla_policy WHERE res_model = ? AND active = ? ORDER BY sequence, id`,
+		slaPolicyColumns)
+	rc.env.Cr().Select(&policies, query, rc.model.name, true)
+	return policies
+}
+
+// updateSLA sets the SLA policy and deadline of the records of rc that are
+// not done yet, from the first policy whose condition they satisfy, and marks
+// them as done when they satisfy the done condition of their policy. It must
+// be called after the records are created or updated.
+//
+// Deadlines are computed from the creation date of the records, so that a
+// record that switches to another policy gets the deadline of this policy.
+func (rc RecordCollection) updateSLA() {
+	if !rc.model.hasSLA() || len(rc.ids) == 0 {
+		return
+	}
+	policies := rc.slaPolicies()
+	now := time.Now()
+	for _, rec := range rc.Records() {
+		if !rec.Get("SLADoneDate").(types.DateTime).IsNull() {
+			continue
+		}
+		values := FieldMap{"SLAPolicy": "", "SLADeadline": nil}
+		for _, policy := range policies {
+			if !policy.matches(rec, policy.Condition) {
+				continue
+			}
+			start := now
+			if createDate, ok := rec.model.fields.get("CreateDate"); ok {
+				if date := rec.Get(createDate.name).(types.DateTime); !date.IsNull() {
+					start = time.Time(date)
+				}
+			}
+			deadline := policy.calendar(rec.env).AddHours(start, policy.TargetHours)
+			values = FieldMap{"SLAPolicy": policy.Name, "SLADeadline": types.DateTime(deadline)}
+			if policy.matches(rec, policy.DoneCondition) {
+				values["SLADoneDate"] = types.DateTime(now)
+				values["SLABreached"] = now.After(deadline)
+			}
+			break
+		}
+		if rec.Get("SLAPolicy") == values["SLAPolicy"] && len(values) == 2 {
+			continue
+		}
+		rec.doUpdate(values)
+	}
+}
+
+// CheckSLABreaches marks as breached the records of all the models
+// inheriting SLAMixin whose deadline is missed, notifies the SLABreaches
+// notifier and runs the automations triggered on SLA breach, for instance
+// to escalate the records to a manager. It returns the number of records
+// newly breached.
+//
+// It is meant to be called periodically.
+func CheckSLABreaches(env Environment) int {
+	var count int
+	for _, mi := range Registry.registryByName {
+		if !mi.hasSLA() {
+			continue
+		}
+		var ids []int64
+		query := fmt.Sprintf(`SELECT id FROM %s WHERE sla_deadline < ? AND sla_breached IS NOT TRUE
+			AND sla_done_date IS NULL ORDER BY id`, mi.tableName)
+		env.Cr().Select(&ids, query, time.Now())
+		if len(ids) == 0 {
+			continue
+		}
+		records := env.Pool(mi.name).withIds(ids)
+		records.doUpdate(FieldMap{"SLABreached": true})
+		records.logChanges(ChangeWrite, []string{"SLABreached"})
+		if SLABreaches != nil {
+			if err := SLABreaches.NotifySLABreach(records); err != nil {
+				log.Warn("Unable to notify SLA breach", "model", mi.name, "ids", ids, "error", err)
+			}
+		} else {
+			log.Info("SLA breached", "model", mi.name, "ids", ids)
+		}
+		records.runAutomations(TriggerOnSLABreach, nil)
+		count += len(ids)
+	}
+	return count
+}
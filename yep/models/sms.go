@@ -0,0 +1,256 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// An SMSStatus is the delivery status of a text message
+type SMSStatus string
+
+// Statuses of text messages
+const (
+	// SMSOutgoing messages are waiting in the queue to be sent
+	SMSOutgoing SMSStatus = "outgoing"
+	// SMSSent messages have been accepted by the provider
+	SMSSent SMSStatus = "sent"
+	// SMSDelivered messages have been received by their recipient
+	SMSDelivered SMSStatus = "delivered"
+	// SMSFailed messages could not be sent or delivered
+	SMSFailed SMSStatus = "failed"
+)
+
+// maxSMSAttempts is the number of times a message is tried
+// to be sent before being marked as failed.
+const maxSMSAttempts = 3
+
+// An SMSStatusUpdate is the delivery status of a message reported by the
+// provider that sent it.
+type SMSStatusUpdate struct {
+	// ProviderID is the id of the message at the provider
+	ProviderID string
+	Status     SMSStatus
+	// Error is the reason of the failure of the message, if any
+	Error string
+}
+
+// An SMSProvider sends text messages through an SMS gateway
+type SMSProvider interface {
+	// SendSMS sends a text message with the given body to the given phone
+	// number and returns the id of the message at the provider.
+	SendSMS(to, body string) (string, error)
+	// ParseStatusCallback authenticates the given request with which the
+	// provider reports the delivery status of a message and returns this
+	// status.
+	ParseStatusCallback(r *http.Request) (SMSStatusUpdate, error)
+}
+
+// SMSGateway is the SMSProvider with which the queued text messages
+// are sent. Messages stay in the queue if it is nil.
+var SMSGateway SMSProvider
+
+// An SMSMessage is a text message of the SMS queue
+type SMSMessage struct {
+	ID           int64     `db:"id" json:"id"`
+	To           string    `db:"to_number" json:"to_number"`
+	Body         string    `db:"body" json:"body"`
+	ResModel     string    `db:"res_model" json:"res_model"`
+	ResID        int64     `db:"res_id" json:"res_id"`
+	Status       SMSStatus `db:"status" json:"status"`
+	ProviderID   string    `db:"provider_id" json:"provider_id"`
+	ErrorMessage string    `db:"error_message" json:"error_message"`
+	Attempts     int       `db:"attempts" json:"attempts"`
+}
+
+// smsMessageColumns are the columns of the sms_message table read into SMSMessage
+const smsMessageColumns = `id, to_number, body, res_model, res_id, status, provider_id, error_message, attempts`
+
+// An smsTemplate is an SMS template as stored in the sms_template table
+type smsTemplate struct {
+	ID       int64  `db:"id"`
+	Name     string `db:"name"`
+	ResModel string `db:"res_model"`
+	To       string `db:"to_number"`
+	Body     string `db:"body"`
+}
+
+// declareSMSModels creates the system models in which
+// the SMS queue and the SMS templates are stored.
+func declareSMSModels() {
+	message := createModel("SMSMessage", SystemModel)
+	message.AddCharField("To", StringFieldParams{JSON: "to_number", Required: true})
+	message.AddTextField("Body", StringFieldParams{JSON: "body", Required: true})
+	message.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Index: true})
+	message.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Index: true})
+	message.AddSelectionField("Status", SelectionFieldParams{JSON: "status", Required: true, Index: true,
+		Selection: types.Selection{
+			string(SMSOutgoing):  "Outgoing",
+			string(SMSSent):      "Sent",
+			string(SMSDelivered): "Delivered",
+			string(SMSFailed):    "Failed",
+		}})
+	message.AddCharField("ProviderID", StringFieldParams{JSON: "provider_id", Index: true})
+	message.AddTextField("ErrorMessage", StringFieldParams{JSON: "error_message"})
+	message.AddIntegerField("Attempts", SimpleFieldParams{JSON: "attempts", Required: true})
+	message.AddDateTimeField("SendDate", SimpleFieldParams{JSON: "send_date"})
+	message.InheritModel(Registry.MustGet("CommonMixin"))
+
+	template := createModel("SMSTemplate", SystemModel)
+	template.AddCharField("Name", StringFieldParams{JSON: "name", Required: true})
+	template.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true,
+		Constraint: "checkSMSTemplate"})
+	template.AddCharField("To", StringFieldParams{JSON: "to_number", Required: true, Constraint: "checkSMSTemplate",
+		Help: "Phone number of the recipient, e.g. {{ Mobile }}"})
+	template.AddTextField("Body", StringFieldParams{JSON: "body", Required: true, Constraint: "checkSMSTemplate"})
+	template.InheritModel(Registry.MustGet("CommonMixin"))
+
+	template.AddMethod("checkSMSTemplate",
+		`checkSMSTemplate returns an error if one of the SMS templates of this
+		RecordSet cannot be rendered for its model.`,
+		func(rc RecordCollection) error {
+			for _, id := range rc.Ids() {
+				tmpl, ok := getSMSTemplate(rc.env, id)
+				if !ok {
+					continue
+				}
+				if err := tmpl.check(); err != nil {
+					return fmt.Errorf("invalid SMS template '%s': %s", tmpl.Name, err)
+				}
+			}
+			return nil
+		})
+}
+
+// getSMSTemplate returns the SMS template with the given id
+func getSMSTemplate(env *Environment, id int64) (smsTemplate, bool) {
+	var tmpls []smsTemplate
+	env.Cr().Select(&tmpls, `SELECT id, name, res_model, to_number, body FROM sms_template WHERE id = ?`, id)
+	if len(tmpls) == 0 {
+		return smsTemplate{}, false
+	}
+	return tmpls[0], true
+}
+
+// check returns an error if this template cannot be rendered for its model
+func (t smsTemplate) check() error {
+	mi, ok := Registry.Get(t.ResModel)
+	if !ok || mi.isSystem() || mi.isMixin() {
+		return fmt.Errorf("unknown model '%s'", t.ResModel)
+	}
+	for _, tmpl := range []string{t.To, t.Body} {
+		if err := mi.checkTemplate(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueSMS adds a text message with the given body to the given phone number
+// to the SMS queue. The message is linked to this record if it is a singleton.
+// It is sent by ProcessSMSQueue.
+func (rc RecordCollection) QueueSMS(to, body string) {
+	to = strings.Replace(strings.TrimSpace(to), " ", "", -1)
+	if to == "" {
+		log.Panic("No phone number to send SMS to", "model", rc.model.name, "ids", rc.ids)
+	}
+	var resID int64
+	if len(rc.ids) == 1 {
+		resID = rc.ids[0]
+	}
+	query := `INSERT INTO sms_message (to_number, body, res_model, res_id, status, attempts)
+		VALUES (?, ?, ?, ?, ?, 0)`
+	rc.env.Cr().Execute(query, to, body, rc.model.name, resID, SMSOutgoing)
+}
+
+// QueueSMSTemplate renders the SMS template with the given id for each record
+// of this RecordCollection and adds the messages to the SMS queue. Records
+// for which the template renders no phone number are skipped. It panics if
+// the template does not exist or is bound to another model.
+func (rc RecordCollection) QueueSMSTemplate(templateID int64) {
+	tmpl, ok := getSMSTemplate(rc.env, templateID)
+	if !ok {
+		log.Panic("Unknown SMS template", "id", templateID)
+	}
+	if tmpl.ResModel != rc.model.name {
+		log.Panic("SMS template is bound to another model", "template", tmpl.Name, "model", rc.model.name)
+	}
+	for _, rec := range rc.Records() {
+		to := renderTemplate(rec, tmpl.To)
+		if strings.TrimSpace(to) == "" {
+			log.Debug("No phone number for SMS template", "template", tmpl.Name, "model", rc.model.name, "id", rec.ids[0])
+			continue
+		}
+		rec.QueueSMS(to, renderTemplate(rec, tmpl.Body))
+	}
+}
+
+// SMSMessages returns the text messages linked to the records of
+// this RecordCollection, from the most recent to the oldest.
+func (rc RecordCollection) SMSMessages() []SMSMessage {
+	var res []SMSMessage
+	if len(rc.ids) == 0 {
+		return res
+	}
+	query := fmt.Sprintf(`SELECT %s FROM sms_message WHERE res_model = ? AND res_id IN (?) ORDER BY id DESC`,
+		smsMessageColumns)
+	rc.env.Cr().Select(&res, query, rc.model.name, rc.ids)
+	return res
+}
+
+// ProcessSMSQueue sends the outgoing messages of the SMS queue with the
+// SMSGateway, at most limit messages if limit is positive. Messages that
+// cannot be sent are tried again at the next call, up to maxSMSAttempts
+// times before being marked as failed. It returns the number of messages
+// sent.
+//
+// It is meant to be called periodically.
+func ProcessSMSQueue(env Environment, limit int) int {
+	if SMSGateway == nil {
+		return 0
+	}
+	var messages []SMSMessage
+	query := fmt.Sprintf(`SELECT %s FROM sms_message WHERE status = ? ORDER BY id`, smsMessageColumns)
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	env.Cr().Select(&messages, query, SMSOutgoing)
+	var count int
+	for _, msg := range messages {
+		providerID, err := SMSGateway.SendSMS(msg.To, msg.Body)
+		if err != nil {
+			status := SMSOutgoing
+			if msg.Attempts+1 >= maxSMSAttempts {
+				status = SMSFailed
+			}
+			log.Warn("Unable to send SMS", "id", msg.ID, "to", msg.To, "attempt", msg.Attempts+1, "error", err)
+			env.Cr().Execute(`UPDATE sms_message SET status = ?, attempts = ?, error_message = ? WHERE id = ?`,
+				status, msg.Attempts+1, err.Error(), msg.ID)
+			continue
+		}
+		env.Cr().Execute(`UPDATE sms_message SET status = ?, attempts = ?, provider_id = ?, error_message = '',
+			send_date = ? WHERE id = ?`, SMSSent, msg.Attempts+1, providerID, time.Now(), msg.ID)
+		count++
+	}
+	return count
+}
+
+// UpdateSMSStatus sets the status reported by the provider of the message
+// of the given update. Delivered messages keep their status. It returns
+// false if no sent message has the provider id of the update.
+func UpdateSMSStatus(env Environment, update SMSStatusUpdate) bool {
+	var ids []int64
+	env.Cr().Select(&ids, `SELECT id FROM sms_message WHERE provider_id = ? AND status != ?`, update.ProviderID, SMSOutgoing)
+	if len(ids) == 0 {
+		return false
+	}
+	env.Cr().Execute(`UPDATE sms_message SET status = ?, error_message = ? WHERE id IN (?) AND status != ?`,
+		update.Status, update.Error, ids, SMSDelivered)
+	return true
+}
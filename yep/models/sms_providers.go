@@ -0,0 +1,206 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TwilioURL is the default endpoint of the Twilio REST API
+const TwilioURL = "https://api.twilio.com/2010-04-01"
+
+// TwilioSMS is an SMSProvider sending text messages with Twilio
+type TwilioSMS struct {
+	// AccountSID is the identifier of the Twilio account
+	AccountSID string
+	// AuthToken is the secret of the Twilio account. It is
+	// also used to authenticate the status callbacks.
+	AuthToken string
+	// From is the phone number or the messaging service SID of the sender
+	From string
+	// StatusCallback is the public URL of the SMS status endpoint of this
+	// server, e.g. "https://example.com/sms/status". No status is reported
+	// by Twilio if empty.
+	StatusCallback string
+	// URL is the endpoint of the API. TwilioURL is used if empty.
+	URL string
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+}
+
+var _ SMSProvider = TwilioSMS{}
+
+// SendSMS sends a text message with the given body to the given
+// phone number and returns the SID of the message.
+func (t TwilioSMS) SendSMS(to, body string) (string, error) {
+	endpoint := t.URL
+	if endpoint == "" {
+		endpoint = TwilioURL
+	}
+	endpoint = fmt.Sprintf("%s/Accounts/%s/Messages.json", strings.TrimSuffix(endpoint, "/"), t.AccountSID)
+	form := url.Values{"To": {to}, "Body": {body}}
+	if strings.HasPrefix(t.From, "MG") {
+		form.Set("MessagingServiceSid", t.From)
+	} else {
+		form.Set("From", t.From)
+	}
+	if t.StatusCallback != "" {
+		form.Set("StatusCallback", t.StatusCallback)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	client := http.Client{Timeout: t.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach Twilio: %s", err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		SID     string `json:"sid"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("invalid Twilio response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("Twilio error (%s): %s", resp.Status, res.Message)
+	}
+	return res.SID, nil
+}
+
+// ParseStatusCallback checks the X-Twilio-Signature header of the given
+// status callback and returns the status it reports.
+func (t TwilioSMS) ParseStatusCallback(r *http.Request) (SMSStatusUpdate, error) {
+	if err := r.ParseForm(); err != nil {
+		return SMSStatusUpdate{}, err
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Twilio-Signature")), []byte(t.signature(r.PostForm))) {
+		return SMSStatusUpdate{}, errors.New("invalid Twilio signature")
+	}
+	update := SMSStatusUpdate{
+		ProviderID: r.PostForm.Get("MessageSid"),
+		Status:     SMSSent,
+	}
+	switch r.PostForm.Get("MessageStatus") {
+	case "delivered":
+		update.Status = SMSDelivered
+	case "failed", "undelivered":
+		update.Status = SMSFailed
+		update.Error = fmt.Sprintf("%s (error %s)", r.PostForm.Get("MessageStatus"), r.PostForm.Get("ErrorCode"))
+	}
+	return update, nil
+}
+
+// signature returns the signature that Twilio computes for the status
+// callbacks with the given parameters, that is the base64 encoded
+// HMAC-SHA1 of the callback URL followed by the sorted parameters.
+func (t TwilioSMS) signature(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := t.StatusCallback
+	for _, key := range keys {
+		for _, value := range params[key] {
+			data += key + value
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(t.AuthToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// HTTPSMS is an SMSProvider sending text messages with a generic HTTP
+// gateway. Messages are posted to URL as a JSON object with "to", "from"
+// and "body" keys, and the gateway answers with the id of the message
+// in the "id" key. Status callbacks are JSON objects with "id", "status"
+// and "error" keys, status being one of "sent", "delivered" and "failed".
+//
+// Both requests are authenticated with Token as a bearer token.
+type HTTPSMS struct {
+	// URL is the endpoint of the gateway
+	URL string
+	// Token is the bearer token of the requests to and from the gateway
+	Token string
+	// From is the phone number or the name of the sender
+	From string
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+}
+
+var _ SMSProvider = HTTPSMS{}
+
+// SendSMS sends a text message with the given body to the given
+// phone number and returns the id of the message at the gateway.
+func (h HTTPSMS) SendSMS(to, body string) (string, error) {
+	data, err := json.Marshal(map[string]string{"to": to, "from": h.From, "body": body})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	client := http.Client{Timeout: h.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach SMS gateway: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("SMS gateway error: %s", resp.Status)
+	}
+	var res struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("invalid SMS gateway response (%s): %s", resp.Status, err)
+	}
+	return res.ID, nil
+}
+
+// ParseStatusCallback checks the bearer token of the given
+// status callback and returns the status it reports.
+func (h HTTPSMS) ParseStatusCallback(r *http.Request) (SMSStatusUpdate, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if h.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+		return SMSStatusUpdate{}, errors.New("invalid SMS gateway token")
+	}
+	var data struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return SMSStatusUpdate{}, err
+	}
+	status := SMSStatus(data.Status)
+	switch status {
+	case SMSSent, SMSDelivered, SMSFailed:
+	default:
+		return SMSStatusUpdate{}, fmt.Errorf("unknown SMS status '%s'", data.Status)
+	}
+	return SMSStatusUpdate{ProviderID: data.ID, Status: status, Error: data.Error}, nil
+}
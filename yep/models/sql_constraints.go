@@ -0,0 +1,72 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import "fmt"
+
+// An sqlConstraint is a constraint of a model that is
+// enforced by the database.
+type sqlConstraint struct {
+	name     string
+	sql      string
+	errorMsg string
+	removed  bool
+}
+
+// AddSQLConstraint adds a table constraint with the given name to this Model.
+// sql is the definition of the constraint, such as "UNIQUE (name, code)" or
+// "CHECK (age >= 0)". It is created at database synchronization.
+//
+// If the constraint is violated when writing to the database, a ValidationError
+// with the given errorMsg is raised.
+func (m *Model) AddSQLConstraint(name, sql, errorMsg string) {
+	m.sqlConstraints[name] = &sqlConstraint{
+		name:     name,
+		sql:      sql,
+		errorMsg: errorMsg,
+	}
+}
+
+// RemoveSQLConstraint removes the constraint with the given name from this Model.
+// The constraint is dropped from the database at synchronization.
+func (m *Model) RemoveSQLConstraint(name string) {
+	c, exists := m.sqlConstraints[name]
+	if !exists {
+		log.Panic("Unknown SQL constraint", "model", m.name, "constraint", name)
+	}
+	c.removed = true
+}
+
+// sqlConstraintName returns the name in database of the given constraint of this Model
+func (m *Model) sqlConstraintName(c *sqlConstraint) string {
+	return dbIdentifier(fmt.Sprintf("%s_%s", m.tableName, c.name))
+}
+
+// sqlConstraintByDBName returns the constraint of this Model with the
+// given name in the database, or nil if there is none.
+func (m *Model) sqlConstraintByDBName(dbName string) *sqlConstraint {
+	for _, c := range m.sqlConstraints {
+		if !c.removed && m.sqlConstraintName(c) == dbName {
+			return c
+		}
+	}
+	return nil
+}
+
+// updateDBSQLConstraints creates the SQL constraints of the given Model in the
+// database and drops the removed ones. Existing constraints are always recreated,
+// since their definition may have changed.
+func updateDBSQLConstraints(m *Model) {
+	adapter := adapters[db.DriverName()]
+	for _, c := range m.sqlConstraints {
+		constraintName := m.sqlConstraintName(c)
+		if adapter.constraintExists(constraintName) {
+			dropDBConstraint(m.tableName, constraintName)
+		}
+		if c.removed {
+			continue
+		}
+		createDBConstraint(m.tableName, constraintName, c.sql)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IndexOptions are the options of an index declared with AddIndex
+type IndexOptions struct {
+	// Unique makes the index reject duplicate values
+	Unique bool
+	// Where is the SQL condition of the rows to index, for a partial
+	// index, such as "active = true"
+	Where string
+	// ErrorMsg is the message of the ValidationError raised when
+	// a unique index is violated
+	ErrorMsg string
+}
+
+// An sqlIndex is an index on one or several columns of
+// a model declared with AddIndex.
+type sqlIndex struct {
+	name    string
+	fields  []string
+	options IndexOptions
+	removed bool
+}
+
+// AddIndex adds an index with the given name on the given fields of this
+// Model. Fields are field names or JSON names of stored fields. The index is
+// created at database synchronization, and recreated if its definition
+// has changed.
+//
+// Use the Index parameter of fields for simple single column indexes.
+func (m *Model) AddIndex(name string, fields []string, options IndexOptions) {
+	if len(fields) == 0 {
+		log.Panic("An index must have at least one field", "model", m.name, "index", name)
+	}
+	m.sqlIndexes[name] = &sqlIndex{
+		name:    name,
+		fields:  fields,
+		options: options,
+	}
+}
+
+// RemoveIndex removes the index with the given name from this Model.
+// The index is dropped from the database at synchronization.
+func (m *Model) RemoveIndex(name string) {
+	idx, exists := m.sqlIndexes[name]
+	if !exists {
+		log.Panic("Unknown index", "model", m.name, "index", name)
+	}
+	idx.removed = true
+}
+
+// sqlIndexName returns the name in database of the given index of this Model
+func (m *Model) sqlIndexName(idx *sqlIndex) string {
+	return dbIdentifier(fmt.Sprintf("%s_%s_idx", m.tableName, idx.name))
+}
+
+// sqlIndexByDBName returns the index of this Model with the
+// given name in the database, or nil if there is none.
+func (m *Model) sqlIndexByDBName(dbName string) *sqlIndex {
+	for _, idx := range m.sqlIndexes {
+		if !idx.removed && m.sqlIndexName(idx) == dbName {
+			return idx
+		}
+	}
+	return nil
+}
+
+// sqlIndexColumns returns the column names of the fields of the given index
+// of this Model. It panics if a field is not a stored field.
+func (m *Model) sqlIndexColumns(idx *sqlIndex) []string {
+	res := make([]string, len(idx.fields))
+	for i, fName := range idx.fields {
+		fi, ok := m.fields.get(fName)
+		if !ok || !fi.isStored() || fi.fieldType.Is2ManyRelationType() {
+			log.Panic("Index fields must be stored fields of the model", "model", m.name, "index", idx.name,
+				"field", fName)
+		}
+		res[i] = fi.json
+	}
+	return res
+}
+
+// sqlIndexDefinition returns the definition of the given index of this Model,
+// e.g. "UNIQUE (name, code) WHERE active = true". It is stored as comment of the
+// index in the database to detect changes of definition.
+func (m *Model) sqlIndexDefinition(idx *sqlIndex) string {
+	res := fmt.Sprintf("(%s)", strings.Join(m.sqlIndexColumns(idx), ", "))
+	if idx.options.Unique {
+		res = "UNIQUE " + res
+	}
+	if idx.options.Where != "" {
+		res += " WHERE " + idx.options.Where
+	}
+	return res
+}
+
+// updateDBSQLIndexes creates the indexes declared with AddIndex on the given
+// Model in the database, recreates those whose definition has changed and
+// drops the removed ones.
+func updateDBSQLIndexes(m *Model) {
+	adapter := adapters[db.DriverName()]
+	for _, idx := range m.sqlIndexes {
+		indexName := m.sqlIndexName(idx)
+		indexInDB := adapter.indexExists(m.tableName, indexName)
+		var definition string
+		if !idx.removed {
+			definition = m.sqlIndexDefinition(idx)
+		}
+		if indexInDB && (idx.removed || adapter.indexComment(indexName) != definition) {
+			if query := adapter.dropIndexSQL(m.tableName, indexName); query != "" {
+				syncExecute(query)
+			}
+			indexInDB = false
+		}
+		if idx.removed || indexInDB {
+			continue
+		}
+		for _, query := range adapter.createIndexSQL(idx.options.Unique, indexName, m.tableName, m.sqlIndexColumns(idx),
+			idx.options.Where, definition) {
+			syncExecute(query)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -71,17 +72,26 @@ func initializeTests() {
 	}
 	logging.Initialize()
 
-	admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
-	admDB.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbArgs.DB))
-	admDB.Close()
+	if dbArgs.Driver == "sqlite3" {
+		DBConnect(dbArgs.Driver, fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000",
+			filepath.Join(os.TempDir(), dbArgs.DB+".db")))
+	} else {
+		admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
+		admDB.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbArgs.DB))
+		admDB.Close()
 
-	DBConnect(dbArgs.Driver, fmt.Sprintf("dbname=%s sslmode=disable user=%s password=%s", dbArgs.DB, dbArgs.User, dbArgs.Password))
+		DBConnect(dbArgs.Driver, fmt.Sprintf("dbname=%s sslmode=disable user=%s password=%s", dbArgs.DB, dbArgs.User, dbArgs.Password))
+	}
 	testAdapter = adapters[db.DriverName()]
 }
 
 func tearDownTests() {
 	DBClose()
 	fmt.Printf("Tearing down database for models\n")
+	if dbArgs.Driver == "sqlite3" {
+		os.Remove(filepath.Join(os.TempDir(), dbArgs.DB+".db"))
+		return
+	}
 	admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
 	admDB.MustExec(fmt.Sprintf("DROP DATABASE %s", dbArgs.DB))
 	admDB.Close()
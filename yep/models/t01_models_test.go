@@ -18,6 +18,9 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -25,9 +28,9 @@ func TestCreateDB(t *testing.T) {
 	Convey("Creating DataBase...", t, func() {
 		user := NewModel("User")
 		user.AddCharField("Name", StringFieldParams{String: "Name", Help: "The user's username", Unique: true})
-		user.AddCharField("DecoratedName", StringFieldParams{Compute: "computeDecoratedName"})
+		user.AddCharField("DecoratedName", StringFieldParams{Compute: "computeDecoratedName", Depends: []string{"Name", "Email"}})
 		user.AddCharField("Email", StringFieldParams{Help: "The user's email address", Size: 100, Index: true})
-		user.AddCharField("Password", StringFieldParams{})
+		user.AddCharField("Password", StringFieldParams{Sensitive: true})
 		user.AddIntegerField("Status", SimpleFieldParams{JSON: "status_json", GoType: new(int16)})
 		user.AddBooleanField("IsStaff", SimpleFieldParams{})
 		user.AddBooleanField("IsActive", SimpleFieldParams{})
@@ -40,32 +43,87 @@ func TestCreateDB(t *testing.T) {
 		user.AddBooleanField("IsPremium", SimpleFieldParams{})
 		user.AddIntegerField("Nums", SimpleFieldParams{GoType: new(int)})
 		user.AddFloatField("Size", FloatFieldParams{})
+		user.AddCharField("Nickname", StringFieldParams{}).SetPropertyKey("company_id")
+		user.AddFloatField("Discount", FloatFieldParams{Contexts: []string{"company_id", "date"}})
 
 		profile := NewModel("Profile")
 		profile.AddIntegerField("Age", SimpleFieldParams{GoType: new(int16)})
-		profile.AddFloatField("Money", FloatFieldParams{})
+		profile.AddSQLConstraint("age_positive", "CHECK (age >= 0)", "Age cannot be negative")
+		profile.AddFloatField("Money", FloatFieldParams{}).SetAudited(true)
 		profile.AddMany2OneField("User", ForeignKeyFieldParams{RelationModel: "User"})
 		profile.AddOne2OneField("BestPost", ForeignKeyFieldParams{RelationModel: "Post"})
 		profile.AddCharField("City", StringFieldParams{})
-		profile.AddCharField("Country", StringFieldParams{})
+		profile.AddCharField("Country", StringFieldParams{}).SetTrackVisibility(TrackAlways)
 
-		post := NewModel("Post")
+		post := NewModel("Post").SetRecName("Title")
 		post.AddMany2OneField("User", ForeignKeyFieldParams{RelationModel: "User"})
 		post.AddCharField("Title", StringFieldParams{})
 		post.AddTextField("Content", StringFieldParams{})
 		post.AddMany2ManyField("Tags", Many2ManyFieldParams{RelationModel: "Tag"})
+		post.AddDateTimeField("PublishDate", SimpleFieldParams{})
+		post.AddDateField("ExpiryDate", SimpleFieldParams{})
+		post.AddDateTimeField("LastEditDate", SimpleFieldParams{AutoNow: true})
+		post.AddDateField("CreationDay", SimpleFieldParams{AutoNowAdd: true})
+		post.AddSelectionField("Status", SelectionFieldParams{Options: types.SelectionOptions{
+			{Value: "draft", Label: "Draft", Group: "Open"},
+			{Value: "review", Label: "In Review", Group: "Open"},
+			{Value: "published", Label: "Published", Group: "Closed"},
+		}})
+		post.AddIntegerField("AuthorAge", SimpleFieldParams{Compute: "computeAuthorAge", Depends: []string{"User", "User.Age"}, Stored: true, GoType: new(int16)})
 
 		tag := NewModel("Tag")
-		tag.AddCharField("Name", StringFieldParams{})
+		tag.AddCharField("Name", StringFieldParams{Constraint: "checkNameDescription"})
 		tag.AddMany2OneField("BestPost", ForeignKeyFieldParams{RelationModel: "Post"})
+		tag.AddMany2OneField("Parent", ForeignKeyFieldParams{RelationModel: "Tag"})
 		tag.AddMany2ManyField("Posts", Many2ManyFieldParams{RelationModel: "Post"})
-		tag.AddCharField("Description", StringFieldParams{})
+		tag.AddCharField("Description", StringFieldParams{Constraint: "checkNameDescription", Translate: true})
+		tag.AddBinaryField("Cover", SimpleFieldParams{}).SetAttachment(true)
+		tag.AddBinaryField("Thumbnail", SimpleFieldParams{})
+		tag.AddCharField("Theme", StringFieldParams{Default: func(env Environment, values FieldMap) interface{} {
+			return "dark"
+		}}).SetOnChange("onchangeTheme")
+		tag.AddCharField("Caption", StringFieldParams{Default: func(env Environment, values FieldMap) interface{} {
+			return fmt.Sprintf("Theme: %s", values["Theme"])
+		}}).SetDefaultDepends([]string{"Theme"})
+		tag.AddSelectionField("Visibility", SelectionFieldParams{SelectionFunc: "VisibilitySelection"})
+		tag.AddMany2OneField("Currency", ForeignKeyFieldParams{RelationModel: "Currency"})
+		tag.AddMonetaryField("Price", MonetaryFieldParams{})
+		tag.AddCharField("Secret", StringFieldParams{Groups: []string{"tag_secret"}})
+		tag.AddCharField("Code", StringFieldParams{Size: 10, Encrypted: DeterministicEncryption})
+		tag.AddCharField("APIKey", StringFieldParams{Encrypted: RandomEncryption})
+		security.Registry.NewGroup("tag_secret", "Tag Secret")
+
+		category := NewModel("Category").SetDefaultOrder("Sequence", "Name").SetChangeFeed(true).SetConcurrency(true)
+		category.AddCharField("Name", StringFieldParams{})
+		category.AddIntegerField("Sequence", SimpleFieldParams{})
+		category.AddParentField(ForeignKeyFieldParams{})
+		category.AddActiveField(SimpleFieldParams{})
+		category.AddIndex("root_name", []string{"Name"}, IndexOptions{Unique: true, Where: "parent_id IS NULL",
+			ErrorMsg: "Root categories must have unique names"})
+		category.AddIndex("sequence_name", []string{"Sequence", "Name"}, IndexOptions{})
+		category.InheritModel(Registry.MustGet("SLAMixin"))
+
+		currency := NewModel("Currency").SetLogAccess(false)
+		currency.AddCharField("Name", StringFieldParams{})
+		currency.AddIntegerField("DecimalPlaces", SimpleFieldParams{})
+		currency.AddCharField("RoundingMethod", StringFieldParams{})
 
 		addressMI := NewMixinModel("AddressMixIn")
 		addressMI.AddCharField("Street", StringFieldParams{})
 		addressMI.AddCharField("Zip", StringFieldParams{})
 		addressMI.AddCharField("City", StringFieldParams{})
+		addressMI.AddMany2ManyField("Labels", Many2ManyFieldParams{RelationModel: "Tag"})
 		profile.InheritModel(addressMI)
+		profile.InheritModel(Registry.MustGet("ChatterMixin"))
+		post.InheritModel(Registry.MustGet("RecurrenceMixin"))
+		user.InheritModel(Registry.MustGet("PresenceMixin"))
+
+		partner := NewModel("Partner")
+		partner.AddCharField("Name", StringFieldParams{})
+		partner.AddTaxIDField("VAT", StringFieldParams{})
+		partner.AddIBANField("IBAN", StringFieldParams{}).SetUnmaskedGroups([]string{"tag_secret"})
+		partner.AddBICField("BIC", StringFieldParams{})
+		partner.InheritModel(Registry.MustGet("AddressMixin"))
 
 		activeMI := NewMixinModel("ActiveMixIn")
 		activeMI.AddBooleanField("Active", SimpleFieldParams{})
@@ -105,6 +163,23 @@ func TestCreateDB(t *testing.T) {
 				return fmt.Sprintf("[%s]", res)
 			})
 
+		user.AddMethod("Greet", "",
+			func(rc RecordCollection, name string) string {
+				return fmt.Sprintf("Hello %s", name)
+			})
+
+		user.Methods().MustGet("Greet").ExtendUnless([]string{"plain_greeting"}, "",
+			func(rc RecordCollection, name string) string {
+				res := rc.Super().Call("Greet", name).(string)
+				return fmt.Sprintf("%s!", res)
+			})
+
+		user.Methods().MustGet("Greet").Extend("",
+			func(rc RecordCollection, name string) string {
+				res := rc.Super().Call("Greet", name).(string)
+				return fmt.Sprintf("<%s>", res)
+			})
+
 		user.AddMethod("computeDecoratedName", "",
 			func(rc RecordCollection) FieldMap {
 				res := make(FieldMap)
@@ -119,6 +194,13 @@ func TestCreateDB(t *testing.T) {
 				return res, []FieldNamer{}
 			})
 
+		post.AddMethod("computeAuthorAge", "",
+			func(rc RecordCollection) (FieldMap, []FieldNamer) {
+				res := make(FieldMap)
+				res["AuthorAge"] = rc.Get("User").(RecordCollection).Get("Age").(int16)
+				return res, []FieldNamer{}
+			})
+
 		user.AddMethod("UpdateCity", "",
 			func(rc RecordCollection, value string) {
 				rc.Get("Profile").(RecordCollection).Set("City", value)
@@ -157,6 +239,30 @@ func TestCreateDB(t *testing.T) {
 				return fmt.Sprintf("[%s]", res)
 			})
 
+		tag.AddMethod("onchangeTheme", "",
+			func(rc RecordCollection, values FieldMap) FieldMap {
+				return FieldMap{"Caption": fmt.Sprintf("Theme: %s", values["Theme"])}
+			})
+
+		tag.AddMethod("checkNameDescription", "",
+			func(rc RecordCollection) error {
+				for _, rec := range rc.Records() {
+					if rec.Get("Description") != "" && rec.Get("Name") == rec.Get("Description") {
+						return fmt.Errorf("Tag name and description must be different")
+					}
+				}
+				return nil
+			})
+
+		tag.AddMethod("VisibilitySelection", "",
+			func(rc RecordCollection) types.Selection {
+				res := types.Selection{"public": "Public"}
+				if rc.Env().Context() != nil && rc.Env().Context().HasKey("allow_private") {
+					res["private"] = "Private"
+				}
+				return res
+			})
+
 		post.Methods().MustGet("Create").Extend("",
 			func(rc RecordCollection, data FieldMapper) RecordCollection {
 				res := rc.Super().Call("Create", data).(RecordSet).Collection()
@@ -171,6 +277,39 @@ func TestCreateDB(t *testing.T) {
 		Convey("Dummy table should exist", func() {
 			So(testAdapter.tables(), ShouldContainKey, "shouldbedeleted")
 		})
+		Convey("Registry check should not report any problem", func() {
+			So(CheckRegistry(), ShouldBeEmpty)
+		})
+		Convey("Registry check should report all problems of a model", func() {
+			broken := &Model{
+				name:          "Broken",
+				fields:        newFieldsCollection(),
+				methods:       newMethodsCollection(),
+				rulesRegistry: newRecordRuleRegistry(),
+				recName:       "Title",
+				mixins:        []*Model{Registry.MustGet("ModelMixin")},
+			}
+			broken.methods.model = broken
+			broken.fields.model = broken
+			for _, fi := range []*Field{
+				{name: "Total", json: "total", fieldType: fieldtype.Float, compute: "ComputeTotal"},
+				{name: "Owner", json: "owner_id", fieldType: fieldtype.Many2One, relatedModelName: "Owner"},
+				{name: "UserName", json: "user_name", fieldType: fieldtype.Char, relatedPath: "User.Missing"},
+				{name: "User", json: "user_id", fieldType: fieldtype.Many2One, relatedModelName: "User"},
+				{name: "Nums", json: "nums", fieldType: fieldtype.Char, relatedPath: "DisplayName.Name"},
+			} {
+				fi.model = broken
+				broken.fields.registryByName[fi.name] = fi
+				broken.fields.registryByJSON[fi.json] = fi
+			}
+			var report RegistryReport
+			checkModel(broken, &report)
+			So(report.String(), ShouldEqual, `model Broken, field Nums: invalid related path 'DisplayName.Name': field 'DisplayName' of model 'Broken' is not a relation field
+model Broken, field Owner: unknown related model 'Owner'
+model Broken, field Total: unknown compute method 'ComputeTotal'
+model Broken, field UserName: invalid related path 'User.Missing': unknown field 'Missing' in model 'User'
+model Broken: unknown rec name field 'Title'`)
+		})
 		Convey("Bootstrap should not panic", func() {
 			So(BootStrap, ShouldNotPanic)
 			So(SyncDatabase, ShouldNotPanic)
@@ -199,6 +338,90 @@ func TestCreateDB(t *testing.T) {
 				So(Registry.registryByTableName, ShouldContainKey, dbTable)
 			}
 		})
+		Convey("Many2many fields of mixins should have a link model per model", func() {
+			_, exists := Registry.Get("ProfileTagRel")
+			So(exists, ShouldBeTrue)
+			_, exists = Registry.Get("AddressMixInTagRel")
+			So(exists, ShouldBeFalse)
+			So(Registry.MustGet("Profile").fields.MustGet("Labels").m2mRelModel.name, ShouldEqual, "ProfileTagRel")
+		})
+		Convey("Planning the sync of an up to date database should not modify columns", func() {
+			for _, query := range PlanDatabaseSync() {
+				So(query, ShouldNotContainSubstring, "ADD COLUMN")
+				So(query, ShouldNotContainSubstring, "DROP COLUMN")
+				So(query, ShouldNotContainSubstring, "SET DATA TYPE")
+				So(query, ShouldNotContainSubstring, "INDEX")
+			}
+		})
+		Convey("Indexes declared with AddIndex should be created", func() {
+			So(testAdapter.indexExists("category", "category_root_name_idx"), ShouldBeTrue)
+			So(testAdapter.indexExists("category", "category_sequence_name_idx"), ShouldBeTrue)
+		})
+		Convey("Indexes whose definition changed should be recreated", func() {
+			catModel := Registry.MustGet("Category")
+			catModel.AddIndex("sequence_name", []string{"Name", "Sequence"}, IndexOptions{})
+			So(PlanDatabaseSync(), ShouldContain, "DROP INDEX IF EXISTS category_sequence_name_idx")
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.indexComment("category_sequence_name_idx"), ShouldEqual, "(name, sequence)")
+		})
+		Convey("Selection check constraints should only be recreated when values change", func() {
+			typeField := Registry.MustGet("ChatterMessage").fields.MustGet("MessageType")
+			constraintName := dbIdentifier("chatter_message_message_type_check")
+			typeField.SetCheckConstraint(true)
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.checkConstraintDefinition(constraintName), ShouldContainSubstring, "notification")
+			for _, query := range PlanDatabaseSync() {
+				So(query, ShouldNotContainSubstring, constraintName)
+			}
+			typeField.selection["archived"] = "Archived"
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.checkConstraintDefinition(constraintName), ShouldContainSubstring, "archived")
+			delete(typeField.selection, "archived")
+			typeField.SetCheckConstraint(false)
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.checkConstraintDefinition(constraintName), ShouldBeEmpty)
+		})
+		Convey("CHECK constraint definitions should be compared by their values", func() {
+			definition := `CHECK (((message_type)::text = ANY ((ARRAY['comment'::character varying, 'it''s'::character varying, ''::character varying])::text[])))`
+			So(checkConstraintAllows(definition, []string{"", "comment", "it's"}), ShouldBeTrue)
+			So(checkConstraintAllows(definition, []string{"", "comment"}), ShouldBeFalse)
+			So(checkConstraintAllows(definition, []string{"", "comment", "it's", "notification"}), ShouldBeFalse)
+		})
+		Convey("Renamed fields should keep their data", func() {
+			dbExecuteNoTx(`ALTER TABLE "user" RENAME COLUMN email TO old_email`)
+			emailField := Registry.MustGet("User").fields.MustGet("Email")
+			emailField.SetPreviousName("old_email")
+			plan := PlanDatabaseSync()
+			So(plan, ShouldContain, `ALTER TABLE "user" RENAME COLUMN old_email TO email`)
+			for _, query := range plan {
+				So(query, ShouldNotContainSubstring, "DROP COLUMN")
+			}
+			So(SyncDatabase, ShouldNotPanic)
+			emailField.SetPreviousName("")
+			columns := testAdapter.columns("user")
+			So(columns, ShouldContainKey, "email")
+			So(columns, ShouldNotContainKey, "old_email")
+		})
+		if dbArgs.Driver == "postgres" {
+			Convey("Changed column types should be migrated", func() {
+				dbExecuteNoTx(`ALTER TABLE "user" ALTER COLUMN age SET DATA TYPE varchar USING age::varchar`)
+				So(PlanDatabaseSync(), ShouldContain,
+					`ALTER TABLE "user" ALTER COLUMN age DROP DEFAULT, ALTER COLUMN age SET DATA TYPE integer USING age::integer`)
+				So(SyncDatabase, ShouldNotPanic)
+				So(testAdapter.columns("user")["age"].DataType, ShouldEqual, "integer")
+			})
+		}
+		Convey("Legacy link tables should get a primary key on their link columns", func() {
+			pkName := dbIdentifier("post_tag_rel_pkey")
+			So(testAdapter.constraintColumns("post_tag_rel", pkName), ShouldResemble, []string{"post_id", "tag_id"})
+			dbExecuteNoTx(fmt.Sprintf(`ALTER TABLE post_tag_rel DROP CONSTRAINT %s`, pkName))
+			dbExecuteNoTx(`ALTER TABLE post_tag_rel ADD COLUMN id serial PRIMARY KEY`)
+			So(testAdapter.constraintColumns("post_tag_rel", pkName), ShouldResemble, []string{"id"})
+			So(PlanDatabaseSync(), ShouldContain, fmt.Sprintf("ALTER TABLE \"post_tag_rel\" DROP CONSTRAINT IF EXISTS %s", pkName))
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.columns("post_tag_rel"), ShouldNotContainKey, "id")
+			So(testAdapter.constraintColumns("post_tag_rel", pkName), ShouldResemble, []string{"post_id", "tag_id"})
+		})
 	})
 	Convey("Truncating all tables...", t, func() {
 		for tn, mi := range Registry.registryByTableName {
@@ -15,11 +15,15 @@
 package models
 
 import (
+	"database/sql"
 	"testing"
 
 	"fmt"
 
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/operator"
 	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -79,6 +83,30 @@ func TestConditions(t *testing.T) {
 					sql, _ = rs.query.selectQuery(fields)
 					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name, "user__profile__post".title AS profile_id__best_post_id__title FROM "user" "user" LEFT JOIN "profile" "user__profile" ON "user".profile_id="user__profile".id LEFT JOIN "post" "user__profile__post" ON "user__profile".best_post_id="user__profile__post".id  WHERE ("user__profile__post".title = ? ) AND ("user__profile".age >= ? ) AND ("user".name LIKE ? OR "user__profile".money < ? )  ORDER BY id `)
 				})
+				Convey("Testing nested, negated and empty condition groups", func() {
+					userModel := rs.Model()
+					cond := userModel.Field("Name").Equals("a").
+						OrNotCond(userModel.Field("IsStaff").Equals(true).And().Field("Nums").Greater(2)).
+						AndCond(newCondition())
+					sql, args := env.Pool("User").Search(cond).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".name = ? OR NOT ("user".is_staff = ? AND "user".nums > ? ) ) `)
+					So(args, ShouldHaveLength, 3)
+				})
+				Convey("Testing FilteredOn with OR operator and nested conditions", func() {
+					profileModel := env.Pool("Profile").Model()
+					cond := rs.Model().Field("Name").Equals("a").Or().FilteredOn("Profile",
+						profileModel.Field("Age").Greater(12).OrCond(profileModel.Field("City").Equals("Paris")))
+					sql, _ := env.Pool("User").Search(cond).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".name = ? OR ("user__profile".age > ? OR ("user__profile".city = ? ) ) ) `)
+				})
+				Convey("Testing hierarchical operators", func() {
+					tagModel := env.Pool("Tag").Model()
+					sql, args := env.Pool("Tag").Search(tagModel.Field("Parent").ChildOf(3)).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("tag".parent_id IN (WITH RECURSIVE tree(id) AS (SELECT id FROM "tag" WHERE id IN (?) UNION SELECT t.id FROM "tag" t INNER JOIN tree ON t.parent_id = tree.id) SELECT id FROM tree) ) `)
+					So(args, ShouldContain, 3)
+					sql, _ = env.Pool("Tag").Search(tagModel.Field("ID").ParentOf(3)).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("tag".id IN (WITH RECURSIVE tree(id, parent) AS (SELECT id, parent_id FROM "tag" WHERE id IN (?) UNION SELECT t.id, t.parent_id FROM "tag" t INNER JOIN tree ON t.id = tree.parent) SELECT id FROM tree) ) `)
+				})
 				Convey("Testing query without WHERE clause", func() {
 					rs = env.Pool("User").Load()
 					fields := []string{"name"}
@@ -97,6 +125,48 @@ func TestConditions(t *testing.T) {
 					sql, _ := rs.query.selectQuery(fields)
 					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY id LIMIT 1 OFFSET 2`)
 				})
+				Convey("Testing query with ORDER BY on related fields", func() {
+					rs = env.Pool("User").Search(rs.Model().Field("email").ILike("jane.smith@example.com")).OrderBy("Profile.Age desc", "PMoney")
+					sql, _ := rs.query.selectQuery([]string{"id"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "user".id AS id, "user__profile".age AS profile_id__age, "user__profile".money AS profile_id__money FROM "user" "user" LEFT JOIN "profile" "user__profile" ON "user".profile_id="user__profile".id  WHERE ("user".email ILIKE ? )  ORDER BY "user__profile".age DESC, "user__profile".money, id `)
+				})
+				Convey("Testing query with ORDER BY on selection fields with declared options", func() {
+					posts := env.Pool("Post").OrderBy("Status desc", "Title")
+					sql, _ := posts.query.selectQuery([]string{"id"})
+					So(sql, ShouldContainSubstring, `, CASE "post".status WHEN 'draft' THEN 0 WHEN 'review' THEN 1 WHEN 'published' THEN 2 ELSE 3 END AS __order__status FROM "post" "post"`)
+					So(sql, ShouldEndWith, `ORDER BY __order__status DESC, "post".title, id `)
+				})
+				Convey("Testing grouped query with ORDER BY on selection fields with declared options", func() {
+					posts := env.Pool("Post").GroupBy(FieldName("Status")).OrderBy("Status")
+					sql, _ := posts.query.selectGroupQuery(map[string]string{"status": ""})
+					So(sql, ShouldContainSubstring, `count(1) AS __count, CASE "post".status WHEN 'draft' THEN 0 WHEN 'review' THEN 1 WHEN 'published' THEN 2 ELSE 3 END AS __order__status FROM "post" "post"`)
+					So(sql, ShouldContainSubstring, `GROUP BY "post".status ORDER BY __order__status `)
+					So(sql, ShouldNotContainSubstring, `, id `)
+				})
+				Convey("Testing joins of many2many fields through their link table", func() {
+					posts := env.Pool("Post")
+					joins := posts.query.generateTableJoins([]string{"Tags", "Name"})
+					So(joins, ShouldHaveLength, 3)
+					So(joins[1].sqlString(), ShouldEqual, `LEFT JOIN "post_tag_rel" "post__tag__post_tag_rel" ON "post".id="post__tag__post_tag_rel".post_id `)
+					So(joins[2].sqlString(), ShouldEqual, `LEFT JOIN "tag" "post__tag" ON "post__tag__post_tag_rel".tag_id="post__tag".id `)
+					posts = posts.Search(posts.Model().Field("Tags.Name").Equals("foo"))
+					sql, args := posts.query.selectQuery([]string{"title"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "post".title AS title FROM "post" "post" LEFT JOIN "post_tag_rel" "post__tag__post_tag_rel" ON "post".id="post__tag__post_tag_rel".post_id LEFT JOIN "tag" "post__tag" ON "post__tag__post_tag_rel".tag_id="post__tag".id  WHERE ("post__tag".name = ? )  ORDER BY id `)
+					So(args, ShouldContain, "foo")
+				})
+				Convey("Testing chained ORDER BY, LIMIT and OFFSET", func() {
+					users := env.Pool("User").Search(rs.Model().Field("email").ILike("jane.smith@example.com"))
+					byName := users.OrderBy("Name").Limit(5)
+					byEmail := byName.OrderBy("Email DESC").Offset(10)
+					sql, _ := byName.query.selectQuery([]string{"id"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "user".id AS id, "user".name AS name FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".name, id LIMIT 5 `)
+					sql, _ = byEmail.query.selectQuery([]string{"id"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "user".id AS id, "user".email AS email FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".email DESC, id LIMIT 5 OFFSET 10`)
+					So(func() { users.OrderBy("Posts.Title") }, ShouldPanic)
+					So(func() { users.OrderBy("Name; DROP TABLE user") }, ShouldPanic)
+					So(func() { users.OrderBy("Name UP") }, ShouldPanic)
+					So(func() { users.Offset(-1) }, ShouldPanic)
+				})
 			})
 		}
 	})
@@ -126,5 +196,91 @@ func TestConditionSerialization(t *testing.T) {
 			dom := cond.Serialize()
 			So(fmt.Sprint(dom), ShouldEqual, "[| [F = F Value] & | [B = B Value] [A = A Value] | [D = D Value] [C = C Value]]")
 		})
+		Convey("Testing A OR B AND C condition", func() {
+			cond := newCondition().And().Field("A").Equals(1).Or().Field("B").Equals(2).And().Field("C").Equals(3)
+			dom := cond.Serialize()
+			So(fmt.Sprint(dom), ShouldEqual, "[| & [B = 2] [C = 3] [A = 1]]")
+		})
+		Convey("Testing A AND NOT B condition", func() {
+			cond := newCondition().And().Field("Name").ILike("John").AndNot().Field("Age").Greater(18)
+			dom := cond.Serialize()
+			So(fmt.Sprint(dom), ShouldEqual, "[& [Name ilike John] ! [Age > 18]]")
+		})
+		Convey("Testing A OR NOT (B AND C) condition", func() {
+			bAndC := newCondition().And().Field("B").Equals(2).And().Field("C").Equals(3)
+			cond := newCondition().And().Field("A").Equals(1).OrNotCond(bAndC)
+			dom := cond.Serialize()
+			So(fmt.Sprint(dom), ShouldEqual, "[| ! & [B = 2] [C = 3] [A = 1]]")
+		})
+		Convey("Testing condition with an empty group", func() {
+			cond := newCondition().And().Field("A").Equals(1).AndCond(newCondition())
+			dom := cond.Serialize()
+			So(fmt.Sprint(dom), ShouldEqual, "[[A = 1]]")
+		})
+	})
+}
+
+func TestMySQLSQLGeneration(t *testing.T) {
+	Convey("Testing SQL generated for MySQL", t, func() {
+		d := new(mysqlAdapter)
+		partner := &Model{name: "Partner", tableName: "order"}
+		Convey("Table names are quoted with backticks", func() {
+			So(d.quoteTableName("order"), ShouldEqual, "`order`")
+			So(d.hierarchySQL(operator.ChildOf, "order", "parent_id"), ShouldEqual,
+				"IN (WITH RECURSIVE tree(id) AS (SELECT id FROM `order` WHERE id IN (?) "+
+					"UNION SELECT t.id FROM `order` t INNER JOIN tree ON t.parent_id = tree.id) SELECT id FROM tree)")
+			So(d.parentPathSQL(operator.ParentOf, "order", "parent_path"), ShouldEqual,
+				"IN (SELECT p.id FROM `order` t INNER JOIN `order` p ON t.parent_path LIKE CONCAT(p.parent_path, '%') WHERE t.id IN (?))")
+			So(d.addConstraintSQL("order", "order_name_check", "CHECK (name <> '')"), ShouldContainSubstring,
+				"ALTER TABLE `order` ADD CONSTRAINT order_name_check CHECK (name <> '')")
+			So(d.renameIndexSQL("order", "order_old_idx", "order_new_idx"), ShouldContainSubstring,
+				"ALTER TABLE `order` RENAME INDEX `order_old_idx` TO `order_new_idx`")
+			queries := d.createIndexSQL(true, "order_name_idx", "order", []string{"name", "ref"}, "", "Name's index")
+			So(queries, ShouldHaveLength, 1)
+			So(queries[0], ShouldContainSubstring, "CREATE UNIQUE INDEX order_name_idx ON `order` (name, ref)")
+			So(queries[0], ShouldEndWith, "COMMENT 'Name''s index'")
+			So(func() { d.createIndexSQL(false, "order_name_idx", "order", []string{"name"}, "active", "") }, ShouldPanic)
+		})
+		Convey("Primary keys are dropped with DROP PRIMARY KEY", func() {
+			query, args := d.constraintExistsQuery("order_pkey")
+			So(query, ShouldContainSubstring, "constraint_type = 'PRIMARY KEY' AND table_name = ?")
+			So(args, ShouldResemble, []interface{}{"order"})
+			query, args = d.constraintExistsQuery("order_name_check")
+			So(query, ShouldContainSubstring, "constraint_name = ?")
+			So(args, ShouldResemble, []interface{}{"order_name_check"})
+			So(d.dropExistingConstraintSQL("order", "order_pkey"), ShouldContainSubstring,
+				"ALTER TABLE `order` DROP PRIMARY KEY")
+			So(d.dropExistingConstraintSQL("order", "order_name_check"), ShouldContainSubstring,
+				"ALTER TABLE `order` DROP CONSTRAINT order_name_check")
+		})
+		Convey("Column types match the types read from the database", func() {
+			name := &Field{model: partner, name: "Name", json: "name", fieldType: fieldtype.Char, size: 20}
+			ref := &Field{model: partner, name: "Ref", json: "ref", fieldType: fieldtype.Char}
+			secret := &Field{model: partner, name: "Secret", json: "secret", fieldType: fieldtype.Char, encrypted: "key"}
+			amount := &Field{model: partner, name: "Amount", json: "amount", fieldType: fieldtype.Float,
+				digits: types.Digits{Precision: 10, Scale: 2}}
+			ratio := &Field{model: partner, name: "Ratio", json: "ratio", fieldType: fieldtype.Float}
+			active := &Field{model: partner, name: "Active", json: "active", fieldType: fieldtype.Boolean}
+			parent := &Field{model: partner, name: "Parent", json: "parent_id", fieldType: fieldtype.Many2One}
+			So(d.typeSQL(name), ShouldEqual, "varchar(20)")
+			So(d.typeSQL(ref), ShouldEqual, "varchar(255)")
+			So(d.typeSQL(secret), ShouldEqual, "text")
+			So(d.typeSQL(amount), ShouldEqual, "decimal(10, 2)")
+			So(d.typeSQL(ratio), ShouldEqual, "double")
+			So(d.typeSQL(active), ShouldEqual, "tinyint(1)")
+			So(d.columnTypeSQL(ColumnData{DataType: "varchar",
+				CharacterMaximumLength: sql.NullInt64{Int64: 20, Valid: true}}), ShouldEqual, d.typeSQL(name))
+			So(d.columnTypeSQL(ColumnData{DataType: "decimal",
+				NumericPrecision: sql.NullInt64{Int64: 10, Valid: true},
+				NumericScale:     sql.NullInt64{Int64: 2, Valid: true}}), ShouldEqual, d.typeSQL(amount))
+			So(d.columnTypeSQL(ColumnData{DataType: "double"}), ShouldEqual, d.typeSQL(ratio))
+			So(d.columnTypeSQL(ColumnData{DataType: "tinyint"}), ShouldEqual, d.typeSQL(active))
+			So(d.columnSQLDefinition(name), ShouldEqual, "varchar(20) NOT NULL DEFAULT ''")
+			So(d.columnSQLDefinition(secret), ShouldEqual, "text NOT NULL DEFAULT ('')")
+			So(d.columnSQLDefinition(parent), ShouldEqual, "int")
+			So(d.alterColumnTypeSQL(name)[0], ShouldContainSubstring, "ALTER TABLE `order`")
+			So(d.alterColumnTypeSQL(name)[0], ShouldContainSubstring, "MODIFY COLUMN name varchar(20) NOT NULL DEFAULT ''")
+			So(d.alterColumnDefaultSQL(parent), ShouldContainSubstring, "ALTER COLUMN parent_id DROP DEFAULT")
+		})
 	})
 }
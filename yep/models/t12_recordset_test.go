@@ -15,9 +15,38 @@
 package models
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+	"github.com/npiganeau/yep/yep/tools/address"
+	"github.com/npiganeau/yep/yep/tools/expr"
+	"github.com/npiganeau/yep/yep/tools/i18n"
+	"github.com/npiganeau/yep/yep/tools/nbutils"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -164,6 +193,75 @@ func TestCreateRecordSet(t *testing.T) {
 	security.Registry.UnregisterGroup(group1)
 }
 
+func TestLogAccessFields(t *testing.T) {
+	Convey("Testing CreateDate, CreateUID, WriteDate and WriteUID fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Convey("Log access fields are set on creation and modification", func() {
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Logged"}).(RecordCollection)
+				createDate := tag.Get("CreateDate").(types.DateTime)
+				So(createDate.IsNull(), ShouldBeFalse)
+				So(tag.Get("CreateUID"), ShouldEqual, security.SuperUserID)
+				So(tag.Get("WriteDate"), ShouldResemble, createDate)
+				So(tag.Get("WriteUID"), ShouldEqual, security.SuperUserID)
+				tag.Call("Write", FieldMap{"CreateUID": 5, "Description": "Modified"})
+				So(tag.Get("CreateUID"), ShouldEqual, security.SuperUserID)
+				So(time.Time(tag.Get("WriteDate").(types.DateTime)).Before(time.Time(createDate)), ShouldBeFalse)
+			})
+			Convey("Log access fields can be disabled per model", func() {
+				currencies := env.Pool("Currency")
+				_, ok := currencies.model.fields.get("CreateDate")
+				So(ok, ShouldBeFalse)
+				_, ok = currencies.model.fields.get("LastUpdate")
+				So(ok, ShouldBeTrue)
+				usd := currencies.Call("Create", FieldMap{"Name": "USD", "DecimalPlaces": 2}).(RecordCollection)
+				So(usd.Get("LastUpdate").(types.DateTime).IsNull(), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestCreateMultiRecordSet(t *testing.T) {
+	Convey("Test creating several records at once", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Convey("Records should be created in the order of data with their defaults", func() {
+				tags := env.Pool("Tag").Call("CreateMulti", []FieldMap{
+					{"Name": "Multi 1", "Theme": "light"},
+					{"Name": "Multi 2"},
+					{"Name": "Multi 3", "Description": "Third"},
+				}).(RecordCollection)
+				So(tags.Len(), ShouldEqual, 3)
+				recs := tags.Records()
+				So(recs[0].Get("Name"), ShouldEqual, "Multi 1")
+				So(recs[0].Get("Caption"), ShouldEqual, "Theme: light")
+				So(recs[1].Get("Name"), ShouldEqual, "Multi 2")
+				So(recs[1].Get("Theme"), ShouldEqual, "dark")
+				So(recs[2].Get("Description"), ShouldEqual, "Third")
+			})
+			Convey("Stored computed fields should be computed for all records", func() {
+				profile := env.Pool("Profile").Call("Create", FieldMap{"Age": 31}).(RecordCollection)
+				users := env.Pool("User").Call("CreateMulti", []FieldMap{
+					{"Name": "Multi User 1", "Profile": profile},
+					{"Name": "Multi User 2", "Profile": profile},
+				}).(RecordCollection)
+				for _, user := range users.Records() {
+					So(user.Get("Age"), ShouldEqual, 31)
+				}
+			})
+			Convey("Constraints should be checked on all records", func() {
+				So(func() {
+					env.Pool("Tag").Call("CreateMulti", []FieldMap{
+						{"Name": "Multi 4"},
+						{"Name": "Multi 5", "Description": "Multi 5"},
+					})
+				}, ShouldPanicWith, ValidationError{Model: "Tag", Message: "Tag name and description must be different"})
+			})
+			Convey("Creating no records should return an empty RecordSet", func() {
+				So(env.Pool("Tag").Call("CreateMulti", []FieldMap{}).(RecordCollection).IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
 func TestSearchRecordSet(t *testing.T) {
 	Convey("Testing search through RecordSets", t, func() {
 		type UserStruct struct {
@@ -288,12 +386,55 @@ func TestSearchRecordSet(t *testing.T) {
 				}
 				userModel.AddRecordRule(&notUsedRule)
 
+				So(env.Pool("User").SearchCount(), ShouldEqual, 2)
 				users = env.Pool("User").FetchAll()
 				So(users.Len(), ShouldEqual, 2)
 				So(users.Records()[0].Get("Name"), ShouldBeIn, []string{"Jane Smith", "John Smith"})
 				userModel.RemoveRecordRule("jOnly")
 				userModel.RemoveRecordRule("writeRule")
 			})
+			Convey("Checking record rules with domain expressions", func() {
+				rule := RecordRule{
+					Name:   "domainRule",
+					Group:  group1,
+					Domain: "name in ['Jane Smith', 'Will Smith'] and id != uid + 1000",
+					Perms:  security.Read,
+				}
+				userModel.AddRecordRule(&rule)
+				So(env.Pool("User").SearchCount(), ShouldEqual, 2)
+				userModel.RemoveRecordRule("domainRule")
+
+				So(userModel.checkDomain(expr.MustCompile("age > 20 and not (name == 'Nobody')")), ShouldBeNil)
+				So(userModel.checkDomain(expr.MustCompile("unknown_field == 1")), ShouldNotBeNil)
+				So(userModel.checkDomain(expr.MustCompile("name == email")), ShouldNotBeNil)
+				So(func() { userModel.AddRecordRule(&RecordRule{Name: "broken", Global: true, Domain: "name =="}) }, ShouldPanic)
+			})
+			Convey("Evaluating expressions on records", func() {
+				userJane := env.Pool("User").Search(userModel.Field("Name").Equals("Jane Smith"))
+				So(userJane.EvalExpr(expr.MustCompile("upper(name) + ' ' + str(uid)")), ShouldEqual, "JANE SMITH 2")
+				So(userJane.EvalExpr(expr.MustCompile("age >= 18 and name != email and len([name, email]) == 2")), ShouldEqual, true)
+				So(userModel.CheckExpr(expr.MustCompile("profile_id.unknown > 1")), ShouldNotBeNil)
+			})
+			Convey("Checking create record rules", func() {
+				users := env.Pool("User").FetchAll().OrderBy("Name").Records()
+				So(users, ShouldHaveLength, 3)
+
+				rule := RecordRule{
+					Name:      "createJOnly",
+					Group:     group1,
+					Condition: users[0].Model().Field("Name").ILike("j"),
+					Perms:     security.Create,
+				}
+				userModel.AddRecordRule(&rule)
+
+				So(func() { users[0].checkCreateRecordRules() }, ShouldNotPanic)
+				So(func() { users[2].checkCreateRecordRules() }, ShouldPanicWith, AccessError{
+					Model:   "User",
+					Message: "You are not allowed to create this 'User' record",
+				})
+				So(env.Pool("User").SearchCount(), ShouldEqual, 3)
+				userModel.RemoveRecordRule("createJOnly")
+			})
 		})
 	})
 	security.Registry.UnregisterGroup(group1)
@@ -389,6 +530,39 @@ func TestGroupedQueries(t *testing.T) {
 				So(groupedUsers[1].Values["nums"], ShouldEqual, 4)
 				So(groupedUsers[1].Count, ShouldEqual, 2)
 			})
+			Convey("ReadGroup with a condition and a relation field", func() {
+				userModel := Registry.MustGet("User")
+				groupedUsers := env.Pool("User").ReadGroup(userModel.Field("IsStaff").Equals(true),
+					[]FieldNamer{FieldName("Nums")}, []string{"Profile"})
+				So(groupedUsers, ShouldNotBeEmpty)
+				var total, count int
+				for _, row := range groupedUsers {
+					So(row.Values, ShouldContainKey, "profile_id")
+					total += int(row.Values["nums"].(int64))
+					count += row.Count
+					So(env.Pool("User").Search(row.Condition).Len(), ShouldEqual, row.Count)
+				}
+				So(total, ShouldEqual, 4)
+				So(count, ShouldEqual, 2)
+			})
+			Convey("ReadGroup by date granularity", func() {
+				for _, granularity := range []string{"day", "week", "month"} {
+					groupedUsers := env.Pool("User").ReadGroup(nil, []FieldNamer{FieldName("Nums")},
+						[]string{"CreateDate:" + granularity})
+					var count int
+					for _, row := range groupedUsers {
+						So(row.Values, ShouldContainKey, "create_date")
+						So(env.Pool("User").Search(row.Condition).Len(), ShouldEqual, row.Count)
+						count += row.Count
+					}
+					So(count, ShouldEqual, env.Pool("User").SearchCount())
+				}
+			})
+			Convey("ReadGroup with invalid granularities", func() {
+				So(func() { env.Pool("User").ReadGroup(nil, nil, []string{"CreateDate:year"}) }, ShouldPanic)
+				So(func() { env.Pool("User").ReadGroup(nil, nil, []string{"Name:month"}) }, ShouldPanic)
+				So(func() { env.Pool("User").ReadGroup(nil, nil, nil) }, ShouldPanic)
+			})
 		})
 	})
 }
@@ -556,6 +730,2005 @@ func TestUpdateRecordSet(t *testing.T) {
 	security.Registry.UnregisterGroup(group1)
 }
 
+func TestAsOfRecordSet(t *testing.T) {
+	Convey("Test reading records as of a past date", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			profile := userJane.Get("Profile").(RecordCollection)
+			before := types.DateTime(time.Now().Add(-time.Second))
+			oldMoney := profile.Get("Money").(float64)
+			profile.Set("Money", oldMoney+100)
+			Convey("Current value is the new value", func() {
+				So(profile.Get("Money"), ShouldEqual, oldMoney+100)
+			})
+			Convey("Value as of a past date is the old value", func() {
+				So(profile.AsOf(before).Get("Money"), ShouldEqual, oldMoney)
+				So(profile.ValuesAsOf(before)["Money"], ShouldEqual, oldMoney)
+			})
+			Convey("Value as of now is the current value", func() {
+				So(profile.AsOf(types.Now()).Get("Money"), ShouldEqual, oldMoney+100)
+			})
+			Convey("RecordSets in 'as of' mode are read-only", func() {
+				So(func() { profile.AsOf(before).Set("Money", 0) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestAuditTrail(t *testing.T) {
+	Convey("Testing the audit trail of records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Money": 10, "Country": "France"}).(RecordCollection)
+			Convey("Creations and modifications are recorded with the fields tracked always", func() {
+				profile.Set("City", "Paris")
+				profile.Set("Money", 20.0)
+				trail := profile.AuditTrail()
+				So(trail, ShouldHaveLength, 2)
+				So(trail[0].Operation, ShouldEqual, "write")
+				So(trail[0].UID, ShouldEqual, security.SuperUserID)
+				So(trail[0].Changes, ShouldResemble, []AuditChange{
+					{Field: "country", OldValue: "France", NewValue: "France"},
+					{Field: "money", OldValue: 10.0, NewValue: 20.0},
+				})
+				So(trail[1].Operation, ShouldEqual, "create")
+				So(trail[1].Changes, ShouldResemble, []AuditChange{
+					{Field: "country", OldValue: nil, NewValue: "France"},
+					{Field: "money", OldValue: nil, NewValue: 10.0},
+				})
+			})
+			Convey("Deletions are recorded and the audit trail can be searched", func() {
+				id := profile.ids[0]
+				profile.Call("Unlink")
+				auditLogs := env.Pool("AuditLog")
+				cond := auditLogs.Model().Field("ResModel").Equals("Profile").
+					And().Field("ResID").Equals(id).
+					And().Field("Operation").Equals("unlink")
+				So(auditLogs.Search(cond).Len(), ShouldEqual, 2)
+			})
+			Convey("Only stored fields can be tracked", func() {
+				So(func() { Registry.MustGet("Post").Fields().MustGet("Tags").SetTrackVisibility(TrackAlways) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+type testChatterNotifier struct {
+	notifications []string
+}
+
+// NotifyFollowers records the message and the users notified
+func (n *testChatterNotifier) NotifyFollowers(rc RecordCollection, message ChatterMessage, uids []int64) error {
+	n.notifications = append(n.notifications, fmt.Sprintf("%s %s: %v", message.MessageType, message.Body, uids))
+	return nil
+}
+
+func TestMixInRelationFields(t *testing.T) {
+	Convey("Testing relation fields declared in mixins", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tag1 := env.Pool("Tag").Call("Create", FieldMap{"Name": "Label 1"}).(RecordCollection)
+			tag2 := env.Pool("Tag").Call("Create", FieldMap{"Name": "Label 2"}).(RecordCollection)
+			profile := env.Pool("Profile").Call("Create", FieldMap{"City": "London"}).(RecordCollection)
+			profile.Set("Labels", tag1)
+			Convey("Many2many fields of mixins are stored in the link table of the model", func() {
+				So(profile.Get("Labels").(RecordCollection).Ids(), ShouldResemble, []int64{tag1.ids[0]})
+				profile.Set("Labels", tag1.Union(tag2))
+				So(profile.Get("Labels").(RecordCollection).Len(), ShouldEqual, 2)
+				var count int
+				env.cr.Get(&count, `SELECT COUNT(*) FROM profile_tag_rel WHERE profile_id = ?`, profile.ids[0])
+				So(count, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestAddresses(t *testing.T) {
+	Convey("Testing postal addresses", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			partner := env.Pool("Partner").Call("Create", FieldMap{
+				"Name":        "NDP Systèmes",
+				"Street":      "12 rue de Rivoli",
+				"Zip":         "75001",
+				"City":        "Paris",
+				"CountryCode": "FR",
+			}).(RecordCollection)
+			Convey("Addresses are formatted according to their country", func() {
+				So(partner.Get("FormattedAddress"), ShouldEqual, "12 rue de Rivoli\n75001 Paris\nFrance")
+				partner.Call("Write", FieldMap{"Zip": "10010", "City": "New York", "State": "NY", "CountryCode": "US"})
+				So(partner.Get("FormattedAddress"), ShouldEqual, "12 rue de Rivoli\nNew York, NY 10010\nUnited States")
+				So(partner.Call("Address").(address.Address).FormatFrom("US"), ShouldEqual, "12 rue de Rivoli\nNew York, NY 10010")
+			})
+			Convey("Invalid addresses are rejected", func() {
+				So(func() { partner.Set("Zip", "7500") }, ShouldPanic)
+				So(func() { partner.Set("CountryCode", "US") }, ShouldPanic)
+			})
+			Convey("Addresses without country are not validated", func() {
+				other := env.Pool("Partner").Call("Create", FieldMap{"Name": "Somewhere", "City": "Springfield"}).(RecordCollection)
+				So(other.Get("FormattedAddress"), ShouldEqual, "Springfield")
+			})
+		})
+	})
+}
+
+type testTaxIDVerifier struct {
+	err error
+}
+
+// Verify only accepts the tax id of NDP Systèmes
+func (v testTaxIDVerifier) Verify(vat string) (bool, error) {
+	return vat == "FR40303265045", v.err
+}
+
+func TestTaxIDFields(t *testing.T) {
+	Convey("Testing tax id fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			partner := env.Pool("Partner").Call("Create", FieldMap{
+				"Name": "NDP Systèmes",
+				"VAT":  "fr 40 303 265 045",
+			}).(RecordCollection)
+			Convey("Tax ids are normalized", func() {
+				So(partner.Get("VAT"), ShouldEqual, "FR40303265045")
+				partner.Set("VAT", "be 0403.019.261")
+				So(partner.Get("VAT"), ShouldEqual, "BE0403019261")
+				partner.Set("VAT", "")
+				So(partner.Get("VAT"), ShouldEqual, "")
+			})
+			Convey("Tax ids with invalid checksums are rejected", func() {
+				So(func() { partner.Set("VAT", "FR41303265045") }, ShouldPanic)
+				So(func() { partner.Set("VAT", "40303265045") }, ShouldPanic)
+			})
+			Convey("Tax ids are checked with the verifier", func() {
+				TaxIDVerifier = testTaxIDVerifier{}
+				defer func() { TaxIDVerifier = nil }()
+				partner.Set("VAT", "FR40303265045")
+				So(func() { partner.Set("VAT", "DE136695976") }, ShouldPanic)
+				Convey("Tax ids are accepted when the verifier is unavailable", func() {
+					TaxIDVerifier = testTaxIDVerifier{err: errors.New("service unavailable")}
+					partner.Set("VAT", "DE136695976")
+					So(partner.Get("VAT"), ShouldEqual, "DE136695976")
+				})
+			})
+			Convey("Invalid tax ids are only logged with the warn policy", func() {
+				InvalidTaxIDs = InvalidTaxIDsWarn
+				defer func() { InvalidTaxIDs = InvalidTaxIDsReject }()
+				partner.Set("VAT", "FR41303265045")
+				So(partner.Get("VAT"), ShouldEqual, "FR41303265045")
+			})
+		})
+	})
+}
+
+func TestBankAccountFields(t *testing.T) {
+	Convey("Testing IBAN and BIC fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			partner := env.Pool("Partner").Call("Create", FieldMap{
+				"Name": "NDP Systèmes",
+				"IBAN": "fr14 2004 1010 0505 0001 3m02 606",
+				"BIC":  "psst fr pp par",
+			}).(RecordCollection)
+			Convey("IBANs and BICs are stored normalized", func() {
+				So(partner.Get("IBAN"), ShouldEqual, "FR1420041010050500013M02606")
+				So(partner.Get("BIC"), ShouldEqual, "PSSTFRPPPAR")
+			})
+			Convey("Invalid IBANs and BICs are rejected", func() {
+				So(func() { partner.Set("IBAN", "FR1420041010050500013M02607") }, ShouldPanic)
+				So(func() { partner.Set("IBAN", "FR14 2004 1010 0505") }, ShouldPanic)
+				So(func() { partner.Set("BIC", "PSSTFRPPP") }, ShouldPanic)
+				So(partner.Get("IBAN"), ShouldEqual, "FR1420041010050500013M02606")
+			})
+			Convey("IBANs are read formatted by privileged users and masked by others", func() {
+				fields := []string{"Name", "IBAN"}
+				res := []FieldMap{{"Name": "NDP Systèmes", "IBAN": partner.Get("IBAN")}}
+				partner.displayIBANValues(fields, res)
+				So(res[0]["IBAN"], ShouldEqual, "FR14 2004 1010 0505 0001 3M02 606")
+				res = []FieldMap{{"Name": "NDP Systèmes", "IBAN": partner.Get("IBAN")}}
+				partner.Sudo(3).displayIBANValues(fields, res)
+				So(res[0]["IBAN"], ShouldEqual, "FR14 **** **** **** **** ***2 606")
+				group := security.Registry.GetGroup("tag_secret")
+				security.Registry.AddMembership(3, group)
+				defer security.Registry.RemoveMembership(3, group)
+				res = []FieldMap{{"Name": "NDP Systèmes", "IBAN": partner.Get("IBAN")}}
+				partner.Sudo(3).displayIBANValues(fields, res)
+				So(res[0]["IBAN"], ShouldEqual, "FR14 2004 1010 0505 0001 3M02 606")
+				So(partner.Call("Read", fields).([]FieldMap)[0]["IBAN"], ShouldEqual, "FR14 2004 1010 0505 0001 3M02 606")
+			})
+		})
+	})
+}
+
+func TestChatter(t *testing.T) {
+	Convey("Testing messages and followers of records", t, func() {
+		notifier := new(testChatterNotifier)
+		ChatterNotifications = notifier
+		defer func() { ChatterNotifications = nil }()
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Money": 10, "Country": "France"}).(RecordCollection)
+			Convey("The creator follows the record and followers can be managed", func() {
+				So(profile.Followers(), ShouldResemble, []int64{security.SuperUserID})
+				profile.Call("AddFollowers", []int64{2, 3, 2})
+				So(profile.Followers(), ShouldResemble, []int64{security.SuperUserID, 2, 3})
+				profile.Call("RemoveFollowers", []int64{3})
+				So(profile.Call("Followers"), ShouldResemble, []int64{security.SuperUserID, 2})
+			})
+			Convey("Posted messages are notified to the followers except their author", func() {
+				profile.AddFollowers(2)
+				profile.Call("PostMessage", "Hello")
+				messages := profile.Messages()
+				So(messages, ShouldHaveLength, 1)
+				So(messages[0].Body, ShouldEqual, "Hello")
+				So(messages[0].MessageType, ShouldEqual, MessageComment)
+				So(messages[0].AuthorUID, ShouldEqual, security.SuperUserID)
+				So(notifier.notifications, ShouldResemble, []string{"comment Hello: [2]"})
+			})
+			Convey("Modifications of tracked fields are posted as notifications", func() {
+				profile.Set("City", "Paris")
+				So(profile.Messages(), ShouldBeEmpty)
+				profile.Set("Money", 20.0)
+				messages := profile.Call("Messages").([]ChatterMessage)
+				So(messages, ShouldHaveLength, 1)
+				So(messages[0].MessageType, ShouldEqual, MessageNotification)
+				So(messages[0].Tracking, ShouldResemble, []TrackingValue{{Field: "money", OldValue: 10.0, NewValue: 20.0}})
+			})
+			Convey("Messages and followers are deleted with their record", func() {
+				id := profile.ids[0]
+				profile.PostMessage("Bye")
+				profile.Call("Unlink")
+				var count int
+				env.cr.Get(&count, `SELECT COUNT(*) FROM chatter_message WHERE res_model = ? AND res_id = ?`, "Profile", id)
+				So(count, ShouldEqual, 0)
+				env.cr.Get(&count, `SELECT COUNT(*) FROM chatter_follower WHERE res_model = ? AND res_id = ?`, "Profile", id)
+				So(count, ShouldEqual, 0)
+			})
+			Convey("Models without ChatterMixin have no messages", func() {
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "No chatter"}).(RecordCollection)
+				So(func() { tag.PostMessage("Hello") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestRecurrences(t *testing.T) {
+	Convey("Testing recurrent records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			day := func(d int) time.Time {
+				return time.Date(2017, 6, d, 10, 0, 0, 0, time.UTC)
+			}
+			dates := func(occurrences []Occurrence) []string {
+				var res []string
+				for _, o := range occurrences {
+					res = append(res, time.Time(o.Date).UTC().Format("2006-01-02"))
+				}
+				return res
+			}
+			posts := env.Pool("Post")
+			meeting := posts.Call("Create", FieldMap{
+				"Title":           "Weekly meeting",
+				"RRule":           "FREQ=WEEKLY;COUNT=4",
+				"RecurrenceStart": types.DateTime(day(5)),
+			}).(RecordCollection)
+			single := posts.Call("Create", FieldMap{
+				"Title":           "Kick-off",
+				"RecurrenceStart": types.DateTime(day(14)),
+			}).(RecordCollection)
+			both := meeting.Union(single)
+			Convey("Invalid rules are rejected", func() {
+				So(func() { meeting.Set("RRule", "FREQ=HOURLY") }, ShouldPanic)
+			})
+			Convey("Occurrences of a date range are returned in chronological order", func() {
+				occurrences := both.OccurrencesBetween(day(1), day(30))
+				So(dates(occurrences), ShouldResemble, []string{"2017-06-05", "2017-06-12", "2017-06-14", "2017-06-19", "2017-06-26"})
+				So(occurrences[0].Virtual, ShouldBeTrue)
+				So(occurrences[0].MasterID, ShouldEqual, meeting.ids[0])
+				So(occurrences[2].ID, ShouldEqual, single.ids[0])
+				So(occurrences[2].Virtual, ShouldBeFalse)
+				So(dates(both.OccurrencesBetween(day(10), day(20))), ShouldResemble, []string{"2017-06-12", "2017-06-14", "2017-06-19"})
+			})
+			Convey("Materialized occurrences are records of their own", func() {
+				created := meeting.Call("MaterializeOccurrences", types.DateTime(day(15))).(RecordCollection)
+				So(created.Len(), ShouldEqual, 2)
+				So(created.Records()[0].Get("Title"), ShouldEqual, "Weekly meeting")
+				So(created.Records()[0].Get("RRule"), ShouldEqual, "")
+				So(created.Records()[1].Get("RecurrenceMasterID"), ShouldEqual, meeting.ids[0])
+				So(meeting.MaterializeOccurrences(day(15)).IsEmpty(), ShouldBeTrue)
+				all := meeting.Union(created)
+				occurrences := all.OccurrencesBetween(day(1), day(30))
+				So(dates(occurrences), ShouldResemble, []string{"2017-06-05", "2017-06-12", "2017-06-19", "2017-06-26"})
+				So(occurrences[1].ID, ShouldEqual, created.ids[1])
+				So(occurrences[2].Virtual, ShouldBeTrue)
+			})
+			Convey("Excluded occurrences are not returned", func() {
+				meeting.Call("ExcludeOccurrence", types.DateTime(day(12)))
+				So(dates(meeting.OccurrencesBetween(day(1), day(30))), ShouldResemble, []string{"2017-06-05", "2017-06-19", "2017-06-26"})
+				created := meeting.MaterializeOccurrences(day(30))
+				So(created.Len(), ShouldEqual, 3)
+				created.Records()[1].Call("Unlink")
+				So(meeting.MaterializeOccurrences(day(30)).IsEmpty(), ShouldBeTrue)
+				So(meeting.OccurrencesBetween(day(1), day(30)), ShouldBeEmpty)
+			})
+			Convey("Splitting a recurrence moves the following occurrences to a new record", func() {
+				created := meeting.MaterializeOccurrences(day(30)).Records()
+				meeting.ExcludeOccurrence(day(26))
+				following := meeting.Call("SplitRecurrence", types.DateTime(day(19))).(RecordCollection)
+				So(following.ids[0], ShouldNotEqual, meeting.ids[0])
+				So(meeting.Get("RRule"), ShouldEqual, "FREQ=WEEKLY;COUNT=2")
+				So(following.Get("RRule"), ShouldEqual, "FREQ=WEEKLY;COUNT=2")
+				So(following.Get("Title"), ShouldEqual, "Weekly meeting")
+				So(created[0].Get("RecurrenceMasterID"), ShouldEqual, meeting.ids[0])
+				So(created[2].Get("RecurrenceMasterID"), ShouldEqual, following.ids[0])
+				So(meeting.SplitRecurrence(day(5)).ids, ShouldResemble, meeting.ids)
+				So(func() { following.SplitRecurrence(day(30)) }, ShouldPanic)
+			})
+			Convey("Rules without count end the day before the split", func() {
+				meeting.Set("RRule", "FREQ=DAILY")
+				following := meeting.SplitRecurrence(day(8))
+				So(dates(meeting.OccurrencesBetween(day(1), day(30))), ShouldResemble, []string{"2017-06-05", "2017-06-06", "2017-06-07"})
+				So(dates(following.OccurrencesBetween(day(1), day(10))), ShouldResemble, []string{"2017-06-08", "2017-06-09"})
+			})
+			Convey("Models without RecurrenceMixin have no occurrences", func() {
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "No recurrence"}).(RecordCollection)
+				So(func() { tag.OccurrencesBetween(day(1), day(30)) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestPropertyFields(t *testing.T) {
+	Convey("Test property fields depending on a context key", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			userWill := users.Search(users.Model().Field("Email").Equals("will.smith@example.com"))
+			userJane.WithContext("company_id", 1).Set("Nickname", "Janie")
+			Convey("Value is returned for the same context key value", func() {
+				So(userJane.WithContext("company_id", 1).Get("Nickname"), ShouldEqual, "Janie")
+			})
+			Convey("Value is not returned for another context key value", func() {
+				So(userJane.WithContext("company_id", 2).Get("Nickname"), ShouldEqual, "")
+				So(userJane.Get("Nickname"), ShouldEqual, "")
+			})
+			Convey("Default value is returned for records without value", func() {
+				users.WithContext("company_id", 1).SetPropertyDefault("Nickname", "Smithy")
+				So(userWill.WithContext("company_id", 1).Get("Nickname"), ShouldEqual, "Smithy")
+				So(userJane.WithContext("company_id", 1).Get("Nickname"), ShouldEqual, "Janie")
+				So(userWill.WithContext("company_id", 2).Get("Nickname"), ShouldEqual, "")
+			})
+			Convey("Values depend on all the context keys of the field", func() {
+				userJane.WithContext("company_id", 1).WithContext("date", "2017-01-01").Set("Discount", 0.1)
+				userJane.WithContext("company_id", 1).WithContext("date", "2017-06-01").Set("Discount", 0.2)
+				So(userJane.WithContext("company_id", 1).WithContext("date", "2017-01-01").Get("Discount"), ShouldEqual, 0.1)
+				So(userJane.WithContext("company_id", 1).WithContext("date", "2017-06-01").Get("Discount"), ShouldEqual, 0.2)
+				So(userJane.WithContext("company_id", 2).WithContext("date", "2017-01-01").Get("Discount"), ShouldEqual, 0.0)
+				So(userJane.WithContext("company_id", 1).Get("Discount"), ShouldEqual, 0.0)
+			})
+		})
+	})
+}
+
+func TestDefaultValues(t *testing.T) {
+	Convey("Test ordered default values resolution", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			Convey("DefaultGet computes dependent defaults after their dependencies", func() {
+				defaults := tags.Call("DefaultGet").(FieldMap)
+				So(defaults["theme"], ShouldEqual, "dark")
+				So(defaults["caption"], ShouldEqual, "Theme: dark")
+			})
+			Convey("Given values are used to compute dependent defaults", func() {
+				tag := tags.Call("Create", FieldMap{"Name": "Music", "Theme": "light"}).(RecordCollection)
+				So(tag.Get("Theme"), ShouldEqual, "light")
+				So(tag.Get("Caption"), ShouldEqual, "Theme: light")
+			})
+		})
+	})
+}
+
+func TestOnchange(t *testing.T) {
+	Convey("Test field OnChange methods", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			Convey("OnChange method of a modified field returns values to update", func() {
+				res := tags.Call("Onchange", OnchangeParams{
+					Values: FieldMap{"name": "Music", "theme": "light"},
+					Fields: []string{"theme"},
+				}).(FieldMap)
+				So(res, ShouldHaveLength, 1)
+				So(res["caption"], ShouldEqual, "Theme: light")
+			})
+			Convey("Fields without OnChange method return nothing", func() {
+				res := tags.Call("Onchange", OnchangeParams{
+					Values: FieldMap{"name": "Music", "theme": "light"},
+					Fields: []string{"name"},
+				}).(FieldMap)
+				So(res, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestSelectionValues(t *testing.T) {
+	Convey("Test selection values validation", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			Convey("Allowed values can be written", func() {
+				So(func() { tags.Call("Create", FieldMap{"Name": "Sport", "Visibility": "public"}) }, ShouldNotPanic)
+			})
+			Convey("Values not allowed in this environment are rejected", func() {
+				So(func() { tags.Call("Create", FieldMap{"Name": "Sport", "Visibility": "private"}) }, ShouldPanic)
+				privateTags := tags.WithContext("allow_private", true)
+				So(func() { privateTags.Call("Create", FieldMap{"Name": "Sport", "Visibility": "private"}) }, ShouldNotPanic)
+			})
+			Convey("Allowed values are returned by SelectionGet", func() {
+				So(tags.Call("SelectionGet", FieldName("Visibility")), ShouldHaveLength, 1)
+				So(tags.WithContext("allow_private", true).Call("SelectionGet", FieldName("Visibility")), ShouldHaveLength, 2)
+			})
+		})
+	})
+}
+
+func TestSQLConstraints(t *testing.T) {
+	Convey("Test SQL constraints violations", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			So(func() { env.Pool("Profile").Call("Create", FieldMap{"Age": -1}) }, ShouldPanicWith,
+				ValidationError{Model: "Profile", Message: "Age cannot be negative"})
+			catModel := env.Pool("Category").Model()
+			root := env.Pool("Category").Call("Create", FieldMap{"Name": "Unique Root"}).(RecordCollection)
+			So(func() { catModel.Create(env, FieldMap{"Name": "Unique Root", "Parent": root}) }, ShouldNotPanic)
+			So(func() { catModel.Create(env, FieldMap{"Name": "Unique Root"}) }, ShouldPanicWith,
+				ValidationError{Model: "Category", Message: "Root categories must have unique names"})
+		})
+	})
+	Convey("Test unique fields violations", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Pool("User").Call("Create", FieldMap{"Name": "Unique User"})
+			Convey("Violations should be converted into a ValidationError naming the field", func() {
+				So(func() { env.Pool("User").Call("Create", FieldMap{"Name": "Unique User"}) }, ShouldPanicWith,
+					ValidationError{Model: "User", Field: "Name", Value: "Unique User",
+						Message: "The value 'Unique User' of field 'Name' is already used by another record"})
+			})
+			Convey("Messages should be translated in the language of the user", func() {
+				i18n.Registry.Add("fr_FR", "The value '%s' of field '%s' is already used by another record",
+					"La valeur '%s' du champ '%s' est déjà utilisée par un autre enregistrement")
+				i18n.Registry.Add("fr_FR", "Name", "Nom")
+				users := env.Pool("User").WithContext("lang", "fr_FR")
+				So(func() { users.Call("Create", FieldMap{"Name": "Unique User"}) }, ShouldPanicWith,
+					ValidationError{Model: "User", Field: "Name", Value: "Unique User",
+						Message: "La valeur 'Unique User' du champ 'Nom' est déjà utilisée par un autre enregistrement"})
+			})
+		})
+	})
+}
+
+func TestOne2OneFields(t *testing.T) {
+	Convey("Test one2one fields uniqueness", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			post := env.Pool("Post").Call("Create", FieldMap{"Title": "Unique Post"}).(RecordCollection)
+			profile1 := env.Pool("Profile").Call("Create", FieldMap{"Age": 20}).(RecordCollection)
+			profile2 := env.Pool("Profile").Call("Create", FieldMap{"Age": 30}).(RecordCollection)
+			Convey("One2one field cannot be set to the same record on several records", func() {
+				So(func() { profile1.Union(profile2).Call("Write", FieldMap{"BestPost": post.Ids()[0]}) }, ShouldPanic)
+			})
+			Convey("One2one field can be unset on several records", func() {
+				So(func() { profile1.Union(profile2).Call("Write", FieldMap{"BestPost": nil}) }, ShouldNotPanic)
+			})
+			Convey("One2one field values are not copied", func() {
+				So(profile1.model.fields.MustGet("BestPost").noCopy, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestConstraints(t *testing.T) {
+	Convey("Test Go constraints on records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			So(func() { env.Pool("Tag").Call("Create", FieldMap{"Name": "Same", "Description": "Same"}) }, ShouldPanicWith,
+				ValidationError{Model: "Tag", Message: "Tag name and description must be different"})
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Tag", "Description": "Other"}).(RecordCollection)
+			So(func() { tag.Call("Write", FieldMap{"Description": "Tag"}) }, ShouldPanic)
+			So(func() { tag.Call("Write", FieldMap{"Description": "Another"}) }, ShouldNotPanic)
+		})
+	})
+}
+
+func TestCascadeRecompute(t *testing.T) {
+	Convey("Test recomputation of stored fields across relations", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userKey := computeKey{modelInfo: Registry.MustGet("User"), compute: "computeAge"}
+			postKey := computeKey{modelInfo: Registry.MustGet("Post"), compute: "computeAuthorAge"}
+			So(computeRanks[userKey], ShouldBeLessThan, computeRanks[postKey])
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Age": 25}).(RecordCollection)
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Cascade User", "Profile": profile.Ids()[0]}).(RecordCollection)
+			post := env.Pool("Post").Call("Create", FieldMap{"Title": "Cascade Post", "User": user.Ids()[0]}).(RecordCollection)
+			So(user.Get("Age"), ShouldEqual, 25)
+			So(post.Get("AuthorAge"), ShouldEqual, 25)
+			profile.Call("Write", FieldMap{"Age": 31})
+			So(user.Get("Age"), ShouldEqual, 31)
+			So(post.Get("AuthorAge"), ShouldEqual, 31)
+			So(env.recomputeQueue.targets, ShouldBeEmpty)
+			Convey("Records depending on unlinked records should be recomputed", func() {
+				So(Registry.MustGet("Profile").hasReverseDependencies(), ShouldBeTrue)
+				profile.Call("Unlink")
+				So(user.Get("Age"), ShouldEqual, 0)
+				So(post.Get("AuthorAge"), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestContextDefaults(t *testing.T) {
+	Convey("Test default values given in context", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag").WithContext("default_theme", "light").WithContext("default_description", "Tagged")
+			tag := tags.Call("Create", FieldMap{"Name": "Context Tag", "Description": "Given"}).(RecordCollection)
+			So(tag.Get("Theme"), ShouldEqual, "light")
+			So(tag.Get("Caption"), ShouldEqual, "Theme: light")
+			So(tag.Get("Description"), ShouldEqual, "Given")
+		})
+	})
+}
+
+func TestActiveRecords(t *testing.T) {
+	Convey("Test getting active records from context", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
+			wizard := env.Pool("Post").WithContext("active_model", "User").WithContext("active_ids", users.Ids())
+			So(wizard.ActiveRecords().ModelName(), ShouldEqual, "User")
+			So(wizard.ActiveRecords().Ids(), ShouldResemble, users.Ids())
+			So(wizard.WithContext("active_ids", []interface{}{float64(users.Ids()[0])}).ActiveRecords().Ids(),
+				ShouldResemble, users.Ids()[:1])
+			So(func() { wizard.ActiveRecordsOf("Profile") }, ShouldPanic)
+			So(func() { env.Pool("Post").ActiveRecords() }, ShouldPanic)
+			So(env.Pool("Post").ActiveRecordsOf("User").IsEmpty(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestSetOperations(t *testing.T) {
+	Convey("Test RecordSet operations", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			john := users.Search(users.Model().Field("Name").Equals("John Smith"))
+			jane := users.Search(users.Model().Field("Name").Equals("Jane A. Smith"))
+			both := jane.Union(john)
+			Convey("Union keeps the order of the records", func() {
+				So(both.Ids(), ShouldResemble, []int64{jane.Ids()[0], john.Ids()[0]})
+				So(both.Union(john).Len(), ShouldEqual, 2)
+			})
+			Convey("Subtract and Intersect", func() {
+				So(both.Subtract(john).Ids(), ShouldResemble, jane.Ids())
+				So(both.Intersect(john).Ids(), ShouldResemble, john.Ids())
+				So(john.Intersect(jane).IsEmpty(), ShouldBeTrue)
+				So(func() { both.Subtract(env.Pool("Post")) }, ShouldPanic)
+			})
+			Convey("Filtered and Sorted", func() {
+				filtered := both.Filtered(func(rc RecordCollection) bool {
+					return rc.Get("Nums").(int) > 10
+				})
+				So(filtered.Ids(), ShouldResemble, john.Ids())
+				sorted := both.Sorted(func(rs1, rs2 RecordCollection) bool {
+					return rs1.Get("Name").(string) < rs2.Get("Name").(string)
+				})
+				So(sorted.Ids(), ShouldResemble, []int64{jane.Ids()[0], john.Ids()[0]})
+			})
+			Convey("Mapped", func() {
+				So(both.Mapped("Profile").Ids(), ShouldResemble, jane.Get("Profile").(RecordCollection).Ids())
+				So(both.Mapped("Posts.Tags").ModelName(), ShouldEqual, "Tag")
+				So(func() { both.Mapped("Profile.Age") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestBinaryFields(t *testing.T) {
+	Convey("Test binary fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Binary Tag", "Cover": "cover data", "Thumbnail": "thumb"}).(RecordCollection)
+			Convey("Attachment fields are not stored in the model's table", func() {
+				So(tag.model.fields.MustGet("Cover").isStored(), ShouldBeFalse)
+				So(tag.model.fields.MustGet("Thumbnail").isStored(), ShouldBeTrue)
+			})
+			Convey("Reading binary fields", func() {
+				So(tag.Get("Cover"), ShouldEqual, "cover data")
+				So(tag.Get("Thumbnail"), ShouldEqual, "thumb")
+				reader := tag.OpenBinary("Cover")
+				data, _ := ioutil.ReadAll(reader)
+				reader.Close()
+				So(string(data), ShouldEqual, "cover data")
+			})
+			Convey("Writing binary fields", func() {
+				tag.WriteBinary("Cover", strings.NewReader("new cover"))
+				tag.WriteBinary("Thumbnail", strings.NewReader("new thumb"))
+				So(tag.Get("Cover"), ShouldEqual, "new cover")
+				So(tag.Get("Thumbnail"), ShouldEqual, "new thumb")
+				tag.Call("Write", FieldMap{"Cover": ""})
+				So(tag.Get("Cover"), ShouldEqual, "")
+				So(func() { tag.WriteBinary("Title", strings.NewReader("")) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestAttachmentStores(t *testing.T) {
+	Convey("Test attachment stores", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			readAll := func(store AttachmentStore, key string) string {
+				reader, err := store.Open(key)
+				So(err, ShouldBeNil)
+				defer reader.Close()
+				data, _ := ioutil.ReadAll(reader)
+				return string(data)
+			}
+			Convey("S3 store", func() {
+				objects := make(map[string]string)
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					data, exists := objects[r.URL.Path]
+					switch {
+					case r.Method == http.MethodPut:
+						body, _ := ioutil.ReadAll(r.Body)
+						objects[r.URL.Path] = string(body)
+					case !exists:
+						w.WriteHeader(http.StatusNotFound)
+					case r.Method == http.MethodGet:
+						w.Write([]byte(data))
+					}
+				}))
+				defer srv.Close()
+				store := S3Store{Endpoint: srv.URL, Region: "us-east-1", Bucket: "bucket", Prefix: "test", AccessKey: "key", SecretKey: "secret"}
+				key, size, err := store.Store(strings.NewReader("s3 content"))
+				So(err, ShouldBeNil)
+				So(size, ShouldEqual, 10)
+				So(objects, ShouldContainKey, "/bucket/test/"+key)
+				So(readAll(store, key), ShouldEqual, "s3 content")
+				_, err = store.Open("unknown")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Database store", func() {
+				store := DBStore{}
+				key, size, err := store.Store(strings.NewReader("db content"))
+				So(err, ShouldBeNil)
+				So(size, ShouldEqual, 10)
+				key2, _, _ := store.Store(strings.NewReader("db content"))
+				So(key2, ShouldEqual, key)
+				So(readAll(store, key), ShouldEqual, "db content")
+				contents, err := store.List()
+				So(err, ShouldBeNil)
+				So(contents, ShouldHaveLength, 1)
+				So(contents[0].Key, ShouldEqual, key)
+				So(store.Delete(key), ShouldBeNil)
+				_, err = store.Open(key)
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Migrating attachments", func() {
+				fromDir, _ := ioutil.TempDir("", "yep-from")
+				toDir, _ := ioutil.TempDir("", "yep-to")
+				defer os.RemoveAll(fromDir)
+				defer os.RemoveAll(toDir)
+				from := FileSystemStore{Dir: fromDir}
+				to := FileSystemStore{Dir: toDir}
+				oldStore := Attachments
+				Attachments = from
+				defer func() { Attachments = oldStore }()
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Migrated Tag", "Cover": "to migrate"}).(RecordCollection)
+				key := tag.attachmentKey(tag.model.fields.MustGet("Cover"))
+				Attachments = MigratingStore{From: from, To: to}
+				So(tag.Get("Cover"), ShouldEqual, "to migrate")
+				_, err := to.Open(key)
+				So(err, ShouldNotBeNil)
+				count, err := MigrateAttachments(env, from, to)
+				So(err, ShouldBeNil)
+				So(count, ShouldBeGreaterThanOrEqualTo, 1)
+				So(readAll(to, key), ShouldEqual, "to migrate")
+				Attachments = to
+				So(tag.Get("Cover"), ShouldEqual, "to migrate")
+			})
+			Convey("Collecting unreferenced contents", func() {
+				dir, _ := ioutil.TempDir("", "yep-gc")
+				defer os.RemoveAll(dir)
+				store := FileSystemStore{Dir: dir}
+				oldStore := Attachments
+				Attachments = store
+				defer func() { Attachments = oldStore }()
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "GC Tag", "Cover": "kept"}).(RecordCollection)
+				orphanKey, _, _ := store.Store(strings.NewReader("orphan"))
+				contents, err := store.List()
+				So(err, ShouldBeNil)
+				So(contents, ShouldHaveLength, 2)
+				report, err := CollectAttachmentGarbage(env, store, time.Hour)
+				So(err, ShouldBeNil)
+				So(report, ShouldResemble, AttachmentGCReport{Scanned: 2, Referenced: 1})
+				report, err = CollectAttachmentGarbage(env, store, 0)
+				So(err, ShouldBeNil)
+				So(report, ShouldResemble, AttachmentGCReport{Scanned: 2, Referenced: 1, Deleted: 1, Reclaimed: 6})
+				_, err = store.Open(orphanKey)
+				So(err, ShouldNotBeNil)
+				So(tag.Get("Cover"), ShouldEqual, "kept")
+			})
+		})
+	})
+}
+
+func TestGenericAttachments(t *testing.T) {
+	Convey("Test files attached to records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Attached Tag"}).(RecordCollection)
+			Convey("Attaching files to a record", func() {
+				report := tag.Attach("report.txt", strings.NewReader("report content"))
+				So(report.ID, ShouldNotEqual, 0)
+				So(report.ResModel, ShouldEqual, "Tag")
+				So(report.ResID, ShouldEqual, tag.Ids()[0])
+				So(report.MimeType, ShouldStartWith, "text/plain")
+				So(report.FileSize, ShouldEqual, 14)
+				So(report.Checksum, ShouldEqual, "b7368d32fc900f5380f6c3c5299b8be6defc7d18")
+				same := tag.Attach("report.txt", strings.NewReader("report content"))
+				So(same.ID, ShouldEqual, report.ID)
+				copied := tag.Attach("copy.bin", strings.NewReader("report content"))
+				So(copied.ID, ShouldNotEqual, report.ID)
+				So(copied.StoreFname, ShouldEqual, report.StoreFname)
+				So(copied.MimeType, ShouldEqual, "application/octet-stream")
+				attachments := tag.Attachments()
+				So(attachments, ShouldHaveLength, 2)
+				So(attachments[0].Name, ShouldEqual, "report.txt")
+				So(attachments[1].Name, ShouldEqual, "copy.bin")
+				info, reader := OpenAttachment(env, report.ID)
+				defer reader.Close()
+				data, _ := ioutil.ReadAll(reader)
+				So(info.Name, ShouldEqual, "report.txt")
+				So(string(data), ShouldEqual, "report content")
+			})
+			Convey("Attachments are deleted with their record", func() {
+				report := tag.Attach("report.txt", strings.NewReader("report content"))
+				tag.Call("Unlink")
+				So(func() { OpenAttachment(env, report.ID) }, ShouldPanicWith,
+					AccessError{Model: "Attachment", Message: "This attachment does not exist or has been deleted"})
+			})
+			Convey("Attachment fields are not listed", func() {
+				covered := env.Pool("Tag").Call("Create", FieldMap{"Name": "Covered Tag", "Cover": "cover"}).(RecordCollection)
+				So(covered.Attachments(), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestFieldGroups(t *testing.T) {
+	Convey("Test field access restricted to groups", t, func() {
+		secret := Registry.MustGet("Tag").fields.MustGet("Secret")
+		group := security.Registry.GetGroup("tag_secret")
+		Convey("Only members of the field's groups and admins have access", func() {
+			So(checkFieldPermission(secret, security.SuperUserID, security.Read), ShouldBeTrue)
+			So(checkFieldPermission(secret, 3, security.Read), ShouldBeFalse)
+			So(checkFieldPermission(secret, 3, security.Write), ShouldBeFalse)
+			security.Registry.AddMembership(3, group)
+			So(checkFieldPermission(secret, 3, security.Read), ShouldBeTrue)
+			So(checkFieldPermission(secret, 3, security.Write), ShouldBeTrue)
+			security.Registry.RemoveMembership(3, group)
+		})
+		Convey("Unauthorized fields are dropped or raise an AccessError", func() {
+			SimulateInNewEnvironment(3, func(env Environment) {
+				tags := env.Pool("Tag")
+				So(filterOnAuthorizedFields(tags.model, 3, []string{"Name", "Secret"}, security.Read), ShouldResemble, []string{"Name"})
+				So(func() { tags.checkFieldsAccess([]string{"Name", "Secret"}, security.Write) }, ShouldNotPanic)
+				UnauthorizedFields = UnauthorizedFieldsFail
+				defer func() { UnauthorizedFields = UnauthorizedFieldsDrop }()
+				So(func() { tags.checkFieldsAccess([]string{"Name"}, security.Read) }, ShouldNotPanic)
+				So(func() { tags.checkFieldsAccess([]string{"Name", "Secret"}, security.Write) }, ShouldPanicWith, AccessError{
+					Model:   "Tag",
+					Field:   "Secret",
+					Message: "You are not allowed to write field 'Secret'",
+				})
+			})
+		})
+	})
+}
+
+func TestEnvironmentChaining(t *testing.T) {
+	Convey("Test Sudo and context chaining on RecordSets", t, func() {
+		SimulateInNewEnvironment(3, func(env Environment) {
+			tags := env.Pool("Tag")
+			parent := tags.Sudo().Call("Create", FieldMap{"Name": "Chained Parent", "Secret": "s3cret"}).(RecordCollection)
+			child := tags.Sudo().Call("Create", FieldMap{"Name": "Chained Child", "Parent": parent}).(RecordCollection)
+			Convey("Sudo and WithContext propagate to derived RecordSets", func() {
+				So(parent.Env().Uid(), ShouldEqual, security.SuperUserID)
+				sudoParent := child.Sudo(3).WithContext("lang", "fr_FR").Sudo().Get("Parent").(RecordCollection)
+				So(sudoParent.Env().Uid(), ShouldEqual, security.SuperUserID)
+				So(sudoParent.Env().Context().GetString("lang", ""), ShouldEqual, "fr_FR")
+				found := tags.Sudo().WithContext("lang", "fr_FR").Search(tags.Model().Field("Name").Equals("Chained Child"))
+				So(found.Records(), ShouldHaveLength, 1)
+				for _, rec := range found.Records() {
+					So(rec.Env().Uid(), ShouldEqual, security.SuperUserID)
+					So(rec.Env().Context().GetString("lang", ""), ShouldEqual, "fr_FR")
+				}
+				So(tags.Env().Uid(), ShouldEqual, 3)
+				So(tags.Env().Context().HasKey("lang"), ShouldBeFalse)
+			})
+			Convey("Values read with Sudo are not readable by unauthorized users", func() {
+				So(parent.Get("Secret"), ShouldEqual, "s3cret")
+				So(parent.Sudo(3).Get("Secret"), ShouldEqual, "")
+				So(parent.Sudo(3).Get("Name"), ShouldEqual, "Chained Parent")
+				So(child.Get("Parent").(RecordCollection).Sudo(3).Get("Secret"), ShouldEqual, "")
+			})
+		})
+	})
+}
+
+func TestRecordSetAssertions(t *testing.T) {
+	Convey("Test RecordSet assertion helpers", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			recoverFrom := func(fnct func()) (res interface{}) {
+				defer func() {
+					res = recover()
+				}()
+				fnct()
+				return
+			}
+			tags := env.Pool("Tag")
+			tag1 := tags.Call("Create", FieldMap{"Name": "Assert 1"}).(RecordCollection)
+			tag2 := tags.Call("Create", FieldMap{"Name": "Assert 2"}).(RecordCollection)
+			both := tag1.Union(tag2)
+			So(func() { tag1.EnsureOne() }, ShouldNotPanic)
+			So(recoverFrom(both.EnsureOne), ShouldResemble, RecordSetError{
+				Model:   "Tag",
+				IDs:     both.Ids(),
+				Message: "Expected singleton, got 2 records",
+			})
+			So(both.IsValid(), ShouldBeTrue)
+			tag2.Call("Unlink")
+			So(both.IsValid(), ShouldBeFalse)
+			So(tag1.IsValid(), ShouldBeTrue)
+			So(recoverFrom(both.EnsureValid), ShouldResemble, RecordSetError{
+				Model:   "Tag",
+				IDs:     tag2.Ids(),
+				Message: "Records do not exist or have been deleted",
+			})
+		})
+	})
+}
+
+func TestRecordsOrder(t *testing.T) {
+	Convey("Test records order and accessors", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			john := users.Search(users.Model().Field("Name").Equals("John Smith"))
+			jane := users.Search(users.Model().Field("Name").Equals("Jane A. Smith"))
+			johnID, janeID := john.Ids()[0], jane.Ids()[0]
+			Convey("Records keeps the order of the given ids", func() {
+				both := users.withIds([]int64{janeID, johnID})
+				recs := both.Records()
+				So(recs, ShouldHaveLength, 2)
+				So(recs[0].Ids(), ShouldResemble, []int64{janeID})
+				So(recs[1].Ids(), ShouldResemble, []int64{johnID})
+				rev := users.withIds([]int64{johnID, janeID}).Records()
+				So(rev[0].Ids(), ShouldResemble, []int64{johnID})
+				So(rev[1].Ids(), ShouldResemble, []int64{janeID})
+			})
+			Convey("Records keeps the order of the search", func() {
+				sorted := users.Search(users.Model().Field("ID").In([]int64{johnID, janeID})).OrderBy("Name DESC")
+				So(sorted.Records()[0].Ids(), ShouldResemble, []int64{johnID})
+				So(sorted.OrderBy("Name").Records()[0].Ids(), ShouldResemble, []int64{janeID})
+			})
+			Convey("Record, FirstRecord and LastRecord", func() {
+				both := jane.Union(john)
+				So(both.Record(1).Ids(), ShouldResemble, []int64{johnID})
+				So(both.FirstRecord().Ids(), ShouldResemble, []int64{janeID})
+				So(both.LastRecord().Ids(), ShouldResemble, []int64{johnID})
+				So(func() { both.Record(2) }, ShouldPanic)
+				So(users.withIds([]int64{}).FirstRecord().IsEmpty(), ShouldBeTrue)
+				So(users.withIds([]int64{}).LastRecord().IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Default order and resequencing", func() {
+				categories := env.Pool("Category")
+				first := categories.Call("Create", FieldMap{"Name": "B Ordered", "Sequence": 1}).(RecordCollection)
+				second := categories.Call("Create", FieldMap{"Name": "A Ordered", "Sequence": 2}).(RecordCollection)
+				third := categories.Call("Create", FieldMap{"Name": "C Ordered", "Sequence": 2}).(RecordCollection)
+				ordered := categories.Search(categories.Model().Field("Name").ILike("Ordered"))
+				So(ordered.Ids(), ShouldResemble, []int64{first.Ids()[0], second.Ids()[0], third.Ids()[0]})
+				So(ordered.OrderBy("Name DESC").Ids(), ShouldResemble, []int64{third.Ids()[0], first.Ids()[0], second.Ids()[0]})
+				categories.Call("Resequence", []int64{third.Ids()[0], first.Ids()[0], second.Ids()[0]})
+				ordered = categories.Search(categories.Model().Field("Name").ILike("Ordered"))
+				So(ordered.Ids(), ShouldResemble, []int64{third.Ids()[0], first.Ids()[0], second.Ids()[0]})
+				So(func() { users.Call("Resequence", []int64{johnID, janeID}) }, ShouldPanic)
+			})
+			Convey("Archived records should be excluded from searches", func() {
+				categories := env.Pool("Category")
+				nameCond := categories.Model().Field("Name").ILike("Archivable")
+				kept := categories.Call("Create", FieldMap{"Name": "Archivable Kept"}).(RecordCollection)
+				archived := categories.Call("Create", FieldMap{"Name": "Archivable Archived"}).(RecordCollection)
+				So(archived.Get("Active"), ShouldBeTrue)
+				So(archived.Call("Archive"), ShouldBeTrue)
+				So(archived.Get("Active"), ShouldBeFalse)
+				So(categories.Search(nameCond).Ids(), ShouldResemble, kept.Ids())
+				So(categories.Search(nameCond).SearchCount(), ShouldEqual, 1)
+				So(categories.WithContext("active_test", false).Search(nameCond).SearchCount(), ShouldEqual, 2)
+				activeCond := nameCond.And().Field("Active").Equals(false)
+				So(categories.Search(activeCond).Ids(), ShouldResemble, archived.Ids())
+				archived.Call("Unarchive")
+				So(categories.Search(nameCond).SearchCount(), ShouldEqual, 2)
+				So(func() { users.Call("Archive") }, ShouldPanic)
+			})
+			Convey("Archived records selected by a search should be unarchived", func() {
+				categories := env.Pool("Category")
+				archived := categories.Call("Create", FieldMap{"Name": "Archivable Searched"}).(RecordCollection)
+				archived.Call("Archive")
+				searched := categories.Search(categories.Model().Field("ID").Equals(archived.Ids()[0]))
+				So(func() { searched.Call("Unarchive") }, ShouldNotPanic)
+				So(archived.Get("Active"), ShouldBeTrue)
+				So(categories.Search(categories.Model().Field("Name").Equals("Archivable Searched")).SearchCount(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMonetaryFields(t *testing.T) {
+	Convey("Test monetary fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			eur := env.Pool("Currency").Call("Create", FieldMap{"Name": "EUR", "DecimalPlaces": 2}).(RecordCollection)
+			jpy := env.Pool("Currency").Call("Create", FieldMap{"Name": "JPY", "DecimalPlaces": 0}).(RecordCollection)
+			tags := env.Pool("Tag")
+			tag1 := tags.Call("Create", FieldMap{"Name": "Price 1", "Currency": eur.Ids()[0], "Price": 12.345}).(RecordCollection)
+			tag2 := tags.Call("Create", FieldMap{"Name": "Price 2", "Currency": jpy.Ids()[0], "Price": 1234.5}).(RecordCollection)
+			tag3 := tags.Call("Create", FieldMap{"Name": "Price 3", "Currency": eur.Ids()[0], "Price": 10.004}).(RecordCollection)
+			Convey("Values are rounded with the currency's decimal places", func() {
+				So(tag1.Get("Price"), ShouldEqual, 12.35)
+				So(tag2.Get("Price"), ShouldEqual, 1235)
+				So(tag3.Get("Price"), ShouldEqual, 10)
+				tag1.Union(tag2).Call("Write", FieldMap{"Price": 7.777})
+				So(tag1.Get("Price"), ShouldEqual, 7.78)
+				So(tag2.Get("Price"), ShouldEqual, 8)
+				tag1.Set("Currency", jpy)
+				So(tag1.Get("Price"), ShouldEqual, 8)
+			})
+			Convey("Values are rounded with the method of the currency or else of the company", func() {
+				SetCompanyRoundingPolicy(1, &nbutils.RoundingPolicy{Method: nbutils.RoundUp})
+				defer SetCompanyRoundingPolicy(1, nil)
+				companyTags := tags.WithContext("company_id", int64(1))
+				tag4 := companyTags.Call("Create", FieldMap{"Name": "Price 4", "Currency": eur.Ids()[0], "Price": 10.001}).(RecordCollection)
+				So(tag4.Get("Price"), ShouldEqual, 10.01)
+				eur.Set("RoundingMethod", string(nbutils.RoundDown))
+				tag4.WithContext("company_id", int64(1)).Call("Write", FieldMap{"Price": 10.009})
+				So(tag4.Get("Price"), ShouldEqual, 10)
+			})
+			Convey("Amounts are aggregated per currency", func() {
+				rows := tags.Search(tags.Model().Field("Name").Like("Price ")).
+					GroupBy(FieldName("Name")).Aggregates(FieldName("Name"), FieldName("Price"))
+				So(rows, ShouldHaveLength, 3)
+				rows = tags.Search(tags.Model().Field("Name").Like("Price ")).
+					GroupBy(FieldName("Theme")).Aggregates(FieldName("Theme"), FieldName("Price"))
+				So(rows, ShouldHaveLength, 2)
+				for _, row := range rows {
+					switch row.Values["currency_id"] {
+					case eur.Ids()[0]:
+						So(row.Values["price"], ShouldEqual, 22.35)
+						So(row.Count, ShouldEqual, 2)
+					case jpy.Ids()[0]:
+						So(row.Values["price"], ShouldEqual, 1235)
+						So(row.Count, ShouldEqual, 1)
+					}
+				}
+			})
+		})
+	})
+}
+
+// testScanner is a VirusScanner that finds a threat in
+// contents holding the EICAR string.
+type testScanner struct{}
+
+// Scan reads the content from r and returns "EICAR" if it is infected
+func (testScanner) Scan(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if strings.Contains(string(data), "EICAR") {
+		return "EICAR", err
+	}
+	return "", err
+}
+
+func TestAntivirus(t *testing.T) {
+	Convey("Test antivirus scanning of uploads", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Antivirus = testScanner{}
+			defer func() {
+				Antivirus = nil
+				InfectedFiles = InfectedFilesReject
+				Quarantine = nil
+			}()
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Scanned Tag", "Cover": "clean cover"}).(RecordCollection)
+			Convey("Clean files are stored", func() {
+				So(tag.Get("Cover"), ShouldEqual, "clean cover")
+				So(ScanFile("clean.csv", strings.NewReader("clean file")), ShouldBeNil)
+			})
+			Convey("Infected files are rejected", func() {
+				So(func() { tag.WriteBinary("Cover", strings.NewReader("EICAR cover")) }, ShouldPanicWith, InfectedFileError{
+					Model:  "Tag",
+					Field:  "Cover",
+					Threat: "EICAR",
+				})
+				So(tag.Get("Cover"), ShouldEqual, "clean cover")
+				So(ScanFile("import.csv", strings.NewReader("EICAR file")), ShouldResemble, InfectedFileError{
+					FileName: "import.csv",
+					Threat:   "EICAR",
+				})
+			})
+			Convey("Infected files are quarantined", func() {
+				quarantineDir, _ := ioutil.TempDir("", "yep-quarantine")
+				defer os.RemoveAll(quarantineDir)
+				InfectedFiles = InfectedFilesQuarantine
+				Quarantine = FileSystemStore{Dir: quarantineDir}
+				So(ScanFile("import.csv", strings.NewReader("EICAR file")), ShouldHaveSameTypeAs, InfectedFileError{})
+				contents, err := Quarantine.(FileSystemStore).List()
+				So(err, ShouldBeNil)
+				So(contents, ShouldHaveLength, 1)
+			})
+			Convey("Clamd scanner", func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer listener.Close()
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						reader := bufio.NewReader(conn)
+						reader.ReadString(0)
+						var data []byte
+						for {
+							var size uint32
+							binary.Read(reader, binary.BigEndian, &size)
+							if size == 0 {
+								break
+							}
+							chunk := make([]byte, size)
+							io.ReadFull(reader, chunk)
+							data = append(data, chunk...)
+						}
+						if strings.Contains(string(data), "EICAR") {
+							conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+						} else {
+							conn.Write([]byte("stream: OK\x00"))
+						}
+						conn.Close()
+					}
+				}()
+				scanner := ClamdScanner{Address: listener.Addr().String(), Timeout: 5 * time.Second}
+				threat, err := scanner.Scan(strings.NewReader("clean content"))
+				So(err, ShouldBeNil)
+				So(threat, ShouldBeBlank)
+				threat, err = scanner.Scan(strings.NewReader("EICAR content"))
+				So(err, ShouldBeNil)
+				So(threat, ShouldEqual, "Eicar-Test-Signature")
+			})
+		})
+	})
+}
+
+func TestCopyRecordSet(t *testing.T) {
+	Convey("Test copying records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Copied User", "Email": "copied@example.com"}).(RecordCollection)
+			env.Pool("Post").Call("Create", FieldMap{"User": user.Ids()[0], "Title": "First Post"})
+			env.Pool("Post").Call("Create", FieldMap{"User": user.Ids()[0], "Title": "Second Post"})
+			Convey("Copying a record duplicates its lines", func() {
+				userCopy := user.Call("Copy", FieldMap{}).(RecordCollection)
+				So(userCopy.Ids()[0], ShouldNotEqual, user.Ids()[0])
+				So(userCopy.Get("Name"), ShouldEqual, "Copied User (copy)")
+				So(userCopy.Get("Email"), ShouldEqual, "copied@example.com")
+				posts := userCopy.Get("Posts").(RecordCollection).OrderBy("Title").Records()
+				So(posts, ShouldHaveLength, 2)
+				So(posts[0].Get("Title"), ShouldEqual, "First Post")
+				So(posts[1].Get("Title"), ShouldEqual, "Second Post")
+				So(user.Get("Posts").(RecordCollection).Len(), ShouldEqual, 2)
+			})
+			Convey("Overrides replace copied values", func() {
+				userCopy := user.Call("Copy", FieldMap{"Name": "Other User", "email": "other@example.com"}).(RecordCollection)
+				So(userCopy.Get("Name"), ShouldEqual, "Other User")
+				So(userCopy.Get("Email"), ShouldEqual, "other@example.com")
+			})
+			Convey("NoCopy fields are not copied", func() {
+				profile := env.Pool("Profile").Call("Create", FieldMap{"Age": 30}).(RecordCollection)
+				post := env.Pool("Post").Call("Create", FieldMap{"Title": "Best Post"}).(RecordCollection)
+				profile.Set("BestPost", post)
+				profileCopy := profile.Call("Copy", FieldMap{}).(RecordCollection)
+				So(profileCopy.Get("Age"), ShouldEqual, 30)
+				So(profileCopy.Get("BestPost").(RecordCollection).IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestEncryptedFields(t *testing.T) {
+	Convey("Test encrypted fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			SetEncryptionKeyProvider(StaticKey("0123456789abcdef0123456789abcdef"))
+			defer SetEncryptionKeyProvider(nil)
+			tagModel := Registry.MustGet("Tag")
+			rawValue := func(tag RecordCollection, field string) string {
+				var res string
+				query := fmt.Sprintf("SELECT %s FROM tag WHERE id = ?", tagModel.fields.MustGet(field).json)
+				env.cr.Get(&res, query, tag.Ids()[0])
+				return res
+			}
+			tag1 := env.Pool("Tag").Call("Create", FieldMap{"Name": "Encrypted 1", "Code": "FR7612345", "APIKey": "secret"}).(RecordCollection)
+			tag2 := env.Pool("Tag").Call("Create", FieldMap{"Name": "Encrypted 2", "Code": "FR7612345", "APIKey": "secret"}).(RecordCollection)
+			Convey("Values are encrypted in the database and decrypted on read", func() {
+				So(tag1.Get("Code"), ShouldEqual, "FR7612345")
+				So(tag1.Get("APIKey"), ShouldEqual, "secret")
+				So(rawValue(tag1, "Code"), ShouldStartWith, encryptedValuePrefix)
+				So(rawValue(tag1, "APIKey"), ShouldStartWith, encryptedValuePrefix)
+				So(rawValue(tag1, "Code"), ShouldEqual, rawValue(tag2, "Code"))
+				So(rawValue(tag1, "APIKey"), ShouldNotEqual, rawValue(tag2, "APIKey"))
+				tag1.Set("APIKey", "new secret")
+				So(tag1.Get("APIKey"), ShouldEqual, "new secret")
+			})
+			Convey("Deterministic fields can be searched with exact match", func() {
+				tags := env.Pool("Tag").Search(tagModel.Field("Code").Equals("FR7612345"))
+				So(tags.Len(), ShouldEqual, 2)
+				tags = env.Pool("Tag").Search(tagModel.Field("Code").In([]string{"FR7612345", "GB123"}))
+				So(tags.Len(), ShouldEqual, 2)
+				So(func() { env.Pool("Tag").Search(tagModel.Field("Code").ILike("FR76")).Len() }, ShouldPanic)
+			})
+			Convey("Random encryption fields cannot be searched", func() {
+				So(func() { env.Pool("Tag").Search(tagModel.Field("APIKey").Equals("secret")).Len() }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestSensitiveFields(t *testing.T) {
+	Convey("Test sensitive fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userModel := Registry.MustGet("User")
+			passwordField := userModel.fields.MustGet("Password")
+			Convey("Sensitive values are masked in query arguments", func() {
+				users := env.Pool("User").Search(userModel.Field("Password").Equals("p4ssw0rd"))
+				sql, args := users.query.sqlWhereClause()
+				So(sql, ShouldNotContainSubstring, "p4ssw0rd")
+				So(fmt.Sprintf("%v", args), ShouldContainSubstring, maskedValue)
+				So(fmt.Sprintf("%v", args), ShouldNotContainSubstring, "p4ssw0rd")
+				So(unmaskArgs(args), ShouldContain, "p4ssw0rd")
+			})
+			Convey("Sensitive values of IN clauses are masked one by one", func() {
+				arg := passwordField.sqlArg([]string{"secret1", "secret2"})
+				So(fmt.Sprintf("%v", arg), ShouldNotContainSubstring, "secret")
+				So(arg, ShouldHaveLength, 2)
+			})
+			Convey("Sensitive values are masked in field maps", func() {
+				fMap := userModel.maskFieldMap(FieldMap{"name": "John", "password": "p4ssw0rd"})
+				So(fMap["name"], ShouldEqual, "John")
+				So(fMap["password"], ShouldEqual, maskedValue)
+			})
+			Convey("Sensitive fields can still be written and searched", func() {
+				user := env.Pool("User").Call("Create", FieldMap{"Name": "Sensitive User", "Password": "p4ssw0rd"}).(RecordCollection)
+				So(user.Get("Password"), ShouldEqual, "p4ssw0rd")
+				users := env.Pool("User").Search(userModel.Field("Password").Equals("p4ssw0rd"))
+				So(users.Len(), ShouldEqual, 1)
+			})
+			Convey("Encrypted fields are sensitive", func() {
+				So(Registry.MustGet("Tag").fields.MustGet("APIKey").isSensitive(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+type testAlertSender struct {
+	counts []int
+}
+
+// SendAlert records the count of events of the alert
+func (s *testAlertSender) SendAlert(rule SecurityAlertRule, event SecurityEvent, count int) error {
+	s.counts = append(s.counts, count)
+	return nil
+}
+
+func TestSecurityEvents(t *testing.T) {
+	Convey("Test security events and alerts", t, func() {
+		sender := new(testAlertSender)
+		SecurityAlerts = sender
+		AddSecurityAlertRule(SecurityAlertRule{
+			Name:      "Test login failures",
+			EventType: EventLoginFailure,
+			Threshold: 2,
+			Period:    time.Hour,
+		})
+		defer func() {
+			SecurityAlerts = nil
+			RemoveSecurityAlertRule("Test login failures")
+		}()
+		failure := SecurityEvent{Type: EventLoginFailure, Login: "alerted_user", IP: "10.0.0.1", UserAgent: "test"}
+		Convey("Events are recorded even outside transactions", func() {
+			RecordSecurityEvent(SecurityEvent{Type: EventLoginSuccess, Login: "alerted_user", UID: 2, IP: "10.0.0.1"})
+			var count int
+			dbGetNoTx(&count, `SELECT COUNT(*) FROM security_event WHERE login = ? AND event_type = ?`,
+				"alerted_user", string(EventLoginSuccess))
+			So(count, ShouldEqual, 1)
+		})
+		Convey("An alert is sent once when the threshold is reached", func() {
+			RecordSecurityEvent(failure)
+			So(sender.counts, ShouldBeEmpty)
+			RecordSecurityEvent(failure)
+			So(sender.counts, ShouldResemble, []int{2})
+			RecordSecurityEvent(failure)
+			So(sender.counts, ShouldResemble, []int{2})
+		})
+		Convey("Events of other logins or types do not raise alerts", func() {
+			RecordSecurityEvent(SecurityEvent{Type: EventLoginFailure, Login: "other_user"})
+			RecordSecurityEvent(SecurityEvent{Type: EventAPIKeyUse, Login: "other_user"})
+			So(sender.counts, ShouldBeEmpty)
+		})
+		Convey("Alert rules must have a threshold and a period", func() {
+			So(func() { AddSecurityAlertRule(SecurityAlertRule{Name: "Invalid", EventType: EventLoginFailure}) }, ShouldPanic)
+		})
+	})
+}
+
+type testMailSender struct {
+	mails []string
+}
+
+// SendMail records the recipients and subject of the email
+func (s *testMailSender) SendMail(to []string, subject, body string) error {
+	s.mails = append(s.mails, fmt.Sprintf("%s: %s", strings.Join(to, ", "), subject))
+	return nil
+}
+
+func TestAutomations(t *testing.T) {
+	Convey("Testing automation rules", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			automations := env.Pool("Automation")
+			categories := env.Pool("Category")
+			Convey("Automations are checked against their model", func() {
+				So(func() {
+					automations.Call("Create", FieldMap{"Name": "Unknown method", "ResModel": "Category",
+						"TriggerType": "on_create", "Action": "method", "Method": "Unknown"})
+				}, ShouldPanic)
+				So(func() {
+					automations.Call("Create", FieldMap{"Name": "Unknown field", "ResModel": "Category",
+						"TriggerType": "on_create", "Condition": "size > 1", "Action": "method", "Method": "Archive"})
+				}, ShouldPanic)
+				So(func() {
+					automations.Call("Create", FieldMap{"Name": "Invalid values", "ResModel": "Category",
+						"TriggerType": "on_create", "Action": "write", "WriteValues": `{"name": 1}`})
+				}, ShouldPanic)
+			})
+			Convey("Write actions update matching records without triggering themselves", func() {
+				automations.Call("Create", FieldMap{"Name": "Uppercase", "ResModel": "Category",
+					"TriggerType": "on_create_or_write", "TriggerFields": "name", "Condition": "sequence > 10",
+					"Action": "write", "WriteValues": `{"name": "upper(name) + '!'"}`})
+				high := categories.Call("Create", FieldMap{"Name": "Automated", "Sequence": 20}).(RecordCollection)
+				low := categories.Call("Create", FieldMap{"Name": "Manual", "Sequence": 1}).(RecordCollection)
+				So(high.Get("Name"), ShouldEqual, "AUTOMATED!")
+				So(low.Get("Name"), ShouldEqual, "Manual")
+				low.Call("Write", FieldMap{"Sequence": 15})
+				So(low.Get("Name"), ShouldEqual, "Manual")
+				low.Call("Write", FieldMap{"Name": "Renamed"})
+				So(low.Get("Name"), ShouldEqual, "RENAMED!")
+				var count int
+				env.cr.Get(&count, `SELECT COUNT(*) FROM automation_log WHERE name = ? AND status = ?`, "Uppercase", "success")
+				So(count, ShouldEqual, 2)
+			})
+			Convey("Method and email actions are run on the matching records", func() {
+				sender := new(testMailSender)
+				AutomationMails = sender
+				defer func() { AutomationMails = nil }()
+				automations.Call("Create", FieldMap{"Name": "Archive drafts", "ResModel": "Category",
+					"TriggerType": "on_create", "Condition": "startswith(name, 'Draft')", "Action": "method",
+					"Method": "Archive"})
+				automations.Call("Create", FieldMap{"Name": "Notify", "ResModel": "Category",
+					"TriggerType": "on_unlink", "Action": "email", "EmailTo": "admin@example.com, {{ lower(name) }}@example.com",
+					"EmailSubject": "Category {{ name }} ({{ sequence }}) deleted"})
+				draft := categories.Call("Create", FieldMap{"Name": "Draft Category"}).(RecordCollection)
+				final := categories.Call("Create", FieldMap{"Name": "Final", "Sequence": 3}).(RecordCollection)
+				So(draft.Get("Active"), ShouldBeFalse)
+				So(final.Get("Active"), ShouldBeTrue)
+				So(sender.mails, ShouldBeEmpty)
+				final.Call("Unlink")
+				So(sender.mails, ShouldResemble, []string{"admin@example.com, final@example.com: Category Final (3) deleted"})
+			})
+			Convey("Failures are logged and roll back the operation", func() {
+				automations.Call("Create", FieldMap{"Name": "Broken", "ResModel": "Category",
+					"TriggerType": "on_create", "Condition": "name > 1", "Action": "method", "Method": "Archive"})
+				So(func() { categories.Call("Create", FieldMap{"Name": "Failing"}) }, ShouldPanic)
+				var count int
+				dbGetNoTx(&count, `SELECT COUNT(*) FROM automation_log WHERE name = ? AND status = ?`, "Broken", "failure")
+				So(count, ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
+
+type testSMSProvider struct {
+	failures int
+	sent     []string
+}
+
+// SendSMS records the recipient and body of the message, or fails
+// while the provider has failures left.
+func (p *testSMSProvider) SendSMS(to, body string) (string, error) {
+	if p.failures > 0 {
+		p.failures--
+		return "", errors.New("gateway unavailable")
+	}
+	p.sent = append(p.sent, fmt.Sprintf("%s: %s", to, body))
+	return fmt.Sprintf("SM%d", len(p.sent)), nil
+}
+
+// ParseStatusCallback is not used in tests
+func (p *testSMSProvider) ParseStatusCallback(r *http.Request) (SMSStatusUpdate, error) {
+	return SMSStatusUpdate{}, errors.New("not implemented")
+}
+
+func TestSMS(t *testing.T) {
+	Convey("Testing text messages", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			provider := new(testSMSProvider)
+			categories := env.Pool("Category")
+			category := categories.Call("Create", FieldMap{"Name": "Texted", "Sequence": 7}).(RecordCollection)
+			Convey("Messages are queued until a gateway sends them", func() {
+				category.QueueSMS("+33 6 12 34 56 78", "Hello")
+				msgs := category.SMSMessages()
+				So(msgs, ShouldHaveLength, 1)
+				So(msgs[0].To, ShouldEqual, "+33612345678")
+				So(msgs[0].ResModel, ShouldEqual, "Category")
+				So(msgs[0].ResID, ShouldEqual, category.ids[0])
+				So(msgs[0].Status, ShouldEqual, SMSOutgoing)
+				So(ProcessSMSQueue(env, 0), ShouldEqual, 0)
+				SMSGateway = provider
+				defer func() { SMSGateway = nil }()
+				So(ProcessSMSQueue(env, 0), ShouldEqual, 1)
+				So(provider.sent, ShouldResemble, []string{"+33612345678: Hello"})
+				msgs = category.SMSMessages()
+				So(msgs[0].Status, ShouldEqual, SMSSent)
+				So(msgs[0].ProviderID, ShouldEqual, "SM1")
+				So(msgs[0].Attempts, ShouldEqual, 1)
+				So(ProcessSMSQueue(env, 0), ShouldEqual, 0)
+			})
+			Convey("Messages are retried and then marked as failed", func() {
+				SMSGateway = provider
+				defer func() { SMSGateway = nil }()
+				provider.failures = maxSMSAttempts
+				category.QueueSMS("+33612345678", "Retried")
+				for i := 1; i < maxSMSAttempts; i++ {
+					So(ProcessSMSQueue(env, 0), ShouldEqual, 0)
+					So(category.SMSMessages()[0].Status, ShouldEqual, SMSOutgoing)
+				}
+				So(ProcessSMSQueue(env, 0), ShouldEqual, 0)
+				msgs := category.SMSMessages()
+				So(msgs[0].Status, ShouldEqual, SMSFailed)
+				So(msgs[0].Attempts, ShouldEqual, maxSMSAttempts)
+				So(msgs[0].ErrorMessage, ShouldEqual, "gateway unavailable")
+				So(provider.sent, ShouldBeEmpty)
+			})
+			Convey("Status callbacks update sent messages", func() {
+				SMSGateway = provider
+				defer func() { SMSGateway = nil }()
+				category.QueueSMS("+33612345678", "Tracked")
+				ProcessSMSQueue(env, 0)
+				So(UpdateSMSStatus(env, SMSStatusUpdate{ProviderID: "SM1", Status: SMSDelivered}), ShouldBeTrue)
+				So(category.SMSMessages()[0].Status, ShouldEqual, SMSDelivered)
+				So(UpdateSMSStatus(env, SMSStatusUpdate{ProviderID: "SM1", Status: SMSSent}), ShouldBeTrue)
+				So(category.SMSMessages()[0].Status, ShouldEqual, SMSDelivered)
+				So(UpdateSMSStatus(env, SMSStatusUpdate{ProviderID: "Unknown", Status: SMSFailed}), ShouldBeFalse)
+			})
+			Convey("Templates are rendered for each record by automations", func() {
+				templates := env.Pool("SMSTemplate")
+				So(func() {
+					templates.Call("Create", FieldMap{"Name": "Invalid", "ResModel": "Category",
+						"To": "+3361234567{{ size }}", "Body": "Hello"})
+				}, ShouldPanic)
+				tmpl := templates.Call("Create", FieldMap{"Name": "Created", "ResModel": "Category",
+					"To": "+3361234567{{ sequence }}", "Body": "Category {{ name }} created"}).(RecordCollection)
+				So(func() {
+					env.Pool("Automation").Call("Create", FieldMap{"Name": "No template", "ResModel": "Category",
+						"TriggerType": "on_create", "Action": "sms"})
+				}, ShouldPanic)
+				So(func() {
+					env.Pool("Automation").Call("Create", FieldMap{"Name": "Wrong model", "ResModel": "Tag",
+						"TriggerType": "on_create", "Action": "sms", "SMSTemplateID": tmpl.ids[0]})
+				}, ShouldPanic)
+				env.Pool("Automation").Call("Create", FieldMap{"Name": "Text on creation", "ResModel": "Category",
+					"TriggerType": "on_create", "Action": "sms", "SMSTemplateID": tmpl.ids[0]})
+				created := categories.Call("Create", FieldMap{"Name": "Automated", "Sequence": 8}).(RecordCollection)
+				msgs := created.SMSMessages()
+				So(msgs, ShouldHaveLength, 1)
+				So(msgs[0].To, ShouldEqual, "+33612345678")
+				So(msgs[0].Body, ShouldEqual, "Category Automated created")
+				So(func() { env.Pool("Tag").QueueSMSTemplate(tmpl.ids[0]) }, ShouldPanic)
+			})
+		})
+	})
+	Convey("Testing SMS providers", t, func() {
+		var received map[string]string
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&received)
+			fmt.Fprint(w, `{"id": "msg-42"}`)
+		}))
+		defer gateway.Close()
+		Convey("The HTTP provider posts messages and authenticates callbacks", func() {
+			provider := HTTPSMS{URL: gateway.URL, Token: "secret", From: "YEP"}
+			id, err := provider.SendSMS("+33612345678", "Hello")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "msg-42")
+			So(received, ShouldResemble, map[string]string{"to": "+33612345678", "from": "YEP", "body": "Hello"})
+			_, err = HTTPSMS{URL: gateway.URL, Token: "wrong"}.SendSMS("+33612345678", "Hello")
+			So(err, ShouldNotBeNil)
+
+			callback := httptest.NewRequest(http.MethodPost, "/sms/status",
+				strings.NewReader(`{"id": "msg-42", "status": "delivered"}`))
+			callback.Header.Set("Authorization", "Bearer secret")
+			update, err := provider.ParseStatusCallback(callback)
+			So(err, ShouldBeNil)
+			So(update, ShouldResemble, SMSStatusUpdate{ProviderID: "msg-42", Status: SMSDelivered})
+			forged := httptest.NewRequest(http.MethodPost, "/sms/status",
+				strings.NewReader(`{"id": "msg-42", "status": "delivered"}`))
+			_, err = provider.ParseStatusCallback(forged)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("The Twilio provider checks the signature of callbacks", func() {
+			provider := TwilioSMS{AccountSID: "AC123", AuthToken: "token", StatusCallback: "https://example.com/sms/status"}
+			form := url.Values{"MessageSid": {"SM42"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"30003"}}
+			newCallback := func(signature string) *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/sms/status", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.Header.Set("X-Twilio-Signature", signature)
+				return r
+			}
+			update, err := provider.ParseStatusCallback(newCallback(provider.signature(form)))
+			So(err, ShouldBeNil)
+			So(update, ShouldResemble, SMSStatusUpdate{ProviderID: "SM42", Status: SMSFailed,
+				Error: "undelivered (error 30003)"})
+			_, err = provider.ParseStatusCallback(newCallback("forged"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+type testPushProvider struct {
+	sent []string
+}
+
+// SendPush records the token and the notification, or fails if
+// the token is "expired".
+func (p *testPushProvider) SendPush(token string, notification PushNotification) error {
+	if token == "expired" {
+		return ErrInvalidPushToken
+	}
+	p.sent = append(p.sent, fmt.Sprintf("%s %s: %s - %s", token, notification.Kind, notification.Title, notification.Body))
+	return nil
+}
+
+func TestPushNotifications(t *testing.T) {
+	Convey("Testing push notifications", t, func() {
+		provider := new(testPushProvider)
+		PushProviders[PushFCM] = provider
+		defer delete(PushProviders, PushFCM)
+		notifier := new(testChatterNotifier)
+		ChatterNotifications = PushNotifier{Chatter: notifier}
+		defer func() { ChatterNotifications = nil }()
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Money": 10, "Country": "France"}).(RecordCollection)
+			profile.AddFollowers(2, 3)
+			jane := profile.Sudo(2).Env()
+			Convey("Devices are registered per user", func() {
+				id := jane.RegisterPushDevice(PushFCM, "token-1", "Phone")
+				So(jane.RegisterPushDevice(PushFCM, " token-1 ", "Phone"), ShouldEqual, id)
+				So(jane.PushDevices(), ShouldResemble, []PushDevice{
+					{ID: id, UID: 2, Platform: PushFCM, Token: "token-1", Name: "Phone"}})
+				So(profile.Sudo(3).Env().RegisterPushDevice(PushFCM, "token-1", "Shared"), ShouldEqual, id)
+				So(jane.PushDevices(), ShouldBeEmpty)
+				profile.Sudo(3).Env().UnregisterPushDevice("token-1")
+				So(profile.Sudo(3).Env().PushDevices(), ShouldBeEmpty)
+				So(func() { jane.RegisterPushDevice("pager", "token-2", "") }, ShouldPanic)
+				So(func() { jane.RegisterPushDevice(PushFCM, " ", "") }, ShouldPanic)
+			})
+			Convey("Messages are pushed to the devices of the followers", func() {
+				jane.RegisterPushDevice(PushFCM, "token-1", "Phone")
+				jane.RegisterPushDevice(PushAPNs, "token-2", "Tablet")
+				profile.PostMessage("Hello")
+				So(provider.sent, ShouldResemble, []string{fmt.Sprintf("token-1 chatter: %s - Hello", profile.Call("NameGet"))})
+				So(notifier.notifications, ShouldResemble, []string{"comment Hello: [2 3]"})
+			})
+			Convey("Users choose the kinds of notifications they receive", func() {
+				jane.RegisterPushDevice(PushFCM, "token-1", "Phone")
+				So(jane.PushPreference(NotificationChatter), ShouldBeTrue)
+				jane.SetPushPreference(NotificationChatter, false)
+				So(jane.PushPreference(NotificationChatter), ShouldBeFalse)
+				So(jane.PushPreference(NotificationApproval), ShouldBeTrue)
+				profile.PostMessage("Muted")
+				So(provider.sent, ShouldBeEmpty)
+				jane.SetPushPreference(NotificationChatter, true)
+				profile.PostMessage("Unmuted")
+				So(provider.sent, ShouldHaveLength, 1)
+				So(func() { jane.SetPushPreference("newsletter", true) }, ShouldPanic)
+			})
+			Convey("Devices with invalid tokens are unregistered", func() {
+				jane.RegisterPushDevice(PushFCM, "expired", "Old phone")
+				So(SendPushNotification(&env, []int64{2}, PushNotification{Kind: NotificationApproval, Title: "Hi"}), ShouldEqual, 0)
+				So(jane.PushDevices(), ShouldBeEmpty)
+			})
+		})
+	})
+	Convey("Testing web push encryption", t, func() {
+		vapidKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		vapidDER, _ := x509.MarshalECPrivateKey(vapidKey)
+		provider, err := NewWebPush(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: vapidDER}),
+			"mailto:admin@example.com")
+		So(err, ShouldBeNil)
+		uaKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+		authSecret := make([]byte, 16)
+		rand.Read(authSecret)
+		var (
+			authorization string
+			received      []byte
+		)
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			received, _ = ioutil.ReadAll(r.Body)
+			if r.URL.Path == "/gone" {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer service.Close()
+		subscription := func(path string) string {
+			return fmt.Sprintf(`{"endpoint": "%s%s", "keys": {"p256dh": "%s", "auth": "%s"}}`, service.URL, path,
+				base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+				base64.RawURLEncoding.EncodeToString(authSecret))
+		}
+		err = provider.SendPush(subscription("/push"), PushNotification{Kind: NotificationChatter, Title: "Title",
+			Body: "Body", ResModel: "Profile", ResID: 1})
+		So(err, ShouldBeNil)
+		So(authorization, ShouldStartWith, "vapid t=")
+		So(authorization, ShouldEndWith, ", k="+provider.PublicKey())
+		// Decrypt the payload as a browser would
+		salt, idLen := received[:16], int(received[20])
+		asPublic, err := ecdh.P256().NewPublicKey(received[21 : 21+idLen])
+		So(err, ShouldBeNil)
+		secret, _ := uaKey.ECDH(asPublic)
+		keyInfo := append([]byte("WebPush: info\x00"), uaKey.PublicKey().Bytes()...)
+		ikm := hkdf(authSecret, secret, append(keyInfo, asPublic.Bytes()...), 32)
+		block, _ := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+		gcm, _ := cipher.NewGCM(block)
+		plain, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), received[21+idLen:], nil)
+		So(err, ShouldBeNil)
+		So(string(plain), ShouldEqual,
+			`{"body":"Body","data":{"kind":"chatter","res_id":"1","res_model":"Profile"},"title":"Title"}`+"\x02")
+		So(provider.SendPush(subscription("/gone"), PushNotification{Title: "Gone"}), ShouldEqual, ErrInvalidPushToken)
+		So(provider.SendPush("not a subscription", PushNotification{Title: "Invalid"}), ShouldEqual, ErrInvalidPushToken)
+	})
+}
+
+func TestSLA(t *testing.T) {
+	Convey("Testing SLA policies", t, func() {
+		Convey("Deadlines are computed in working hours", func() {
+			policy := slaPolicy{Name: "Office", TargetHours: 4, WorkDays: "mon,tue,wed,thu,fri", WorkFrom: 8, WorkTo: 17}
+			calendar := policy.calendar(&Environment{})
+			friday := time.Date(2017, 6, 16, 16, 0, 0, 0, time.UTC)
+			So(calendar.AddHours(friday, 4), ShouldResemble, time.Date(2017, 6, 19, 11, 0, 0, 0, time.UTC))
+			saturday := time.Date(2017, 6, 17, 10, 0, 0, 0, time.UTC)
+			So(calendar.AddHours(saturday, 4), ShouldResemble, time.Date(2017, 6, 19, 12, 0, 0, 0, time.UTC))
+			So(calendar.AddHours(friday, 0.5), ShouldResemble, time.Date(2017, 6, 16, 16, 30, 0, 0, time.UTC))
+		})
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			policies := env.Pool("SLAPolicy")
+			categories := env.Pool("Category")
+			policies.Call("Create", FieldMap{"Name": "Urgent", "ResModel": "Category", "Condition": "sequence >= 100",
+				"DoneCondition": "not active", "TargetHours": 4, "WorkDays": "mon,tue,wed,thu,fri,sat,sun",
+				"WorkFrom": 0, "WorkTo": 24})
+			Convey("Policies are checked against their model", func() {
+				So(func() {
+					policies.Call("Create", FieldMap{"Name": "No SLA", "ResModel": "Tag", "DoneCondition": "name",
+						"TargetHours": 1})
+				}, ShouldPanic)
+				So(func() {
+					policies.Call("Create", FieldMap{"Name": "Invalid days", "ResModel": "Category",
+						"DoneCondition": "not active", "TargetHours": 1, "WorkDays": "monday"})
+				}, ShouldPanic)
+			})
+			Convey("Records get the deadline of the first matching policy until they are done", func() {
+				urgent := categories.Call("Create", FieldMap{"Name": "Urgent SLA", "Sequence": 200}).(RecordCollection)
+				normal := categories.Call("Create", FieldMap{"Name": "Normal SLA", "Sequence": 1}).(RecordCollection)
+				createDate := time.Time(urgent.Get("CreateDate").(types.DateTime))
+				So(urgent.Get("SLAPolicy"), ShouldEqual, "Urgent")
+				So(time.Time(urgent.Get("SLADeadline").(types.DateTime)).Sub(createDate).Hours(), ShouldAlmostEqual, 4, 0.001)
+				So(normal.Get("SLAPolicy"), ShouldEqual, "")
+				So(normal.Get("SLADeadline").(types.DateTime).IsNull(), ShouldBeTrue)
+				normal.Call("Write", FieldMap{"Sequence": 150})
+				So(normal.Get("SLAPolicy"), ShouldEqual, "Urgent")
+				urgent.Call("Archive")
+				So(urgent.Get("SLADoneDate").(types.DateTime).IsNull(), ShouldBeFalse)
+				So(urgent.Get("SLABreached"), ShouldBeFalse)
+			})
+			Convey("Missed deadlines are flagged and escalated by automations", func() {
+				env.Pool("Automation").Call("Create", FieldMap{"Name": "Escalate", "ResModel": "Category",
+					"TriggerType": "on_sla_breach", "Action": "write", "WriteValues": `{"name": "'ESCALATED ' + name"}`})
+				late := categories.Call("Create", FieldMap{"Name": "Late", "Sequence": 300}).(RecordCollection)
+				env.cr.Execute(`UPDATE category SET sla_deadline = ? WHERE id = ?`, time.Now().Add(-time.Hour), late.ids[0])
+				So(CheckSLABreaches(env), ShouldEqual, 1)
+				So(late.Get("SLABreached"), ShouldBeTrue)
+				So(late.Get("Name"), ShouldEqual, "ESCALATED Late")
+				So(CheckSLABreaches(env), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestCalendars(t *testing.T) {
+	Convey("Testing working time calendars", t, func() {
+		office := Calendar{Name: "Office"}
+		for day := time.Monday; day <= time.Friday; day++ {
+			office.Hours = append(office.Hours, WorkingHours{Weekday: day, HourFrom: 8, HourTo: 12},
+				WorkingHours{Weekday: day, HourFrom: 13, HourTo: 17})
+		}
+		office.Leaves = []Leave{{Name: "Bank holiday", From: time.Date(2017, 6, 20, 0, 0, 0, 0, time.UTC),
+			To: time.Date(2017, 6, 21, 0, 0, 0, 0, time.UTC)}}
+		friday := time.Date(2017, 6, 16, 11, 0, 0, 0, time.UTC)
+		Convey("Adding and subtracting working hours", func() {
+			So(office.AddHours(friday, 2), ShouldResemble, time.Date(2017, 6, 16, 14, 0, 0, 0, time.UTC))
+			So(office.AddHours(friday, 6), ShouldResemble, time.Date(2017, 6, 19, 9, 0, 0, 0, time.UTC))
+			So(office.AddHours(friday, 14), ShouldResemble, time.Date(2017, 6, 21, 9, 0, 0, 0, time.UTC))
+			So(office.AddHours(friday, -4), ShouldResemble, time.Date(2017, 6, 15, 16, 0, 0, 0, time.UTC))
+			monday := time.Date(2017, 6, 19, 9, 0, 0, 0, time.UTC)
+			So(office.AddHours(monday, -6), ShouldResemble, friday)
+		})
+		Convey("Working time between dates", func() {
+			wednesday := time.Date(2017, 6, 21, 10, 0, 0, 0, time.UTC)
+			So(office.WorkingDuration(friday, wednesday), ShouldEqual, 15*time.Hour)
+			So(office.WorkingDuration(wednesday, friday), ShouldEqual, -15*time.Hour)
+			So(office.WorkingDuration(friday, friday.Add(90*time.Minute)), ShouldEqual, time.Hour)
+		})
+		Convey("Next working slots and working days", func() {
+			from, to, ok := office.NextWorkingSlot(friday)
+			So(ok, ShouldBeTrue)
+			So(from, ShouldResemble, friday)
+			So(to, ShouldResemble, time.Date(2017, 6, 16, 12, 0, 0, 0, time.UTC))
+			from, _, _ = office.NextWorkingSlot(time.Date(2017, 6, 19, 18, 0, 0, 0, time.UTC))
+			So(from, ShouldResemble, time.Date(2017, 6, 21, 8, 0, 0, 0, time.UTC))
+			_, _, ok = Calendar{}.NextWorkingSlot(friday)
+			So(ok, ShouldBeFalse)
+			So(office.IsWorkingDay(friday), ShouldBeTrue)
+			So(office.IsWorkingDay(time.Date(2017, 6, 20, 10, 0, 0, 0, time.UTC)), ShouldBeFalse)
+			So(office.AddWorkingDays(friday, 2), ShouldResemble, time.Date(2017, 6, 21, 11, 0, 0, 0, time.UTC))
+			So(office.AddWorkingDays(friday, -1), ShouldResemble, time.Date(2017, 6, 15, 11, 0, 0, 0, time.UTC))
+		})
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			calendar := env.Pool("ResourceCalendar").Call("Create", FieldMap{"Name": "Paris",
+				"Timezone": "Europe/Paris"}).(RecordCollection)
+			attendances := env.Pool("ResourceCalendarAttendance")
+			for day := 1; day <= 5; day++ {
+				attendances.Call("Create", FieldMap{"CalendarID": calendar.ids[0], "DayOfWeek": day,
+					"HourFrom": 9, "HourTo": 18})
+			}
+			env.Pool("ResourceCalendarLeave").Call("Create", FieldMap{"Name": "Public holiday",
+				"DateFrom": time.Date(2017, 6, 19, 0, 0, 0, 0, time.UTC), "DateTo": time.Date(2017, 6, 20, 0, 0, 0, 0, time.UTC)})
+			Convey("Calendars are loaded with their time zone and the global leaves", func() {
+				paris := LoadCalendar(env, calendar.ids[0])
+				So(paris.Location.String(), ShouldEqual, "Europe/Paris")
+				So(paris.Hours, ShouldHaveLength, 5)
+				So(paris.Leaves, ShouldHaveLength, 1)
+				deadline := paris.AddHours(time.Date(2017, 6, 16, 15, 0, 0, 0, time.UTC), 2)
+				So(deadline.UTC(), ShouldResemble, time.Date(2017, 6, 20, 8, 0, 0, 0, time.UTC))
+			})
+			Convey("Invalid calendars are rejected", func() {
+				So(func() {
+					attendances.Call("Create", FieldMap{"CalendarID": calendar.ids[0], "DayOfWeek": 1,
+						"HourFrom": 18, "HourTo": 9})
+				}, ShouldPanic)
+				So(func() {
+					env.Pool("ResourceCalendar").Call("Create", FieldMap{"Name": "Nowhere", "Timezone": "Nowhere/City"})
+				}, ShouldPanic)
+			})
+			Convey("SLA deadlines are computed in the calendar of their policy", func() {
+				env.Pool("SLAPolicy").Call("Create", FieldMap{"Name": "Calendar", "ResModel": "Category",
+					"Condition": "sequence >= 100", "DoneCondition": "not active", "TargetHours": 4,
+					"CalendarID": calendar.ids[0]})
+				category := env.Pool("Category").Call("Create", FieldMap{"Name": "Calendar SLA", "Sequence": 100}).(RecordCollection)
+				createDate := time.Time(category.Get("CreateDate").(types.DateTime))
+				deadline := time.Time(category.Get("SLADeadline").(types.DateTime))
+				So(deadline, ShouldHappenWithin, time.Second, LoadCalendar(env, calendar.ids[0]).AddHours(createDate, 4))
+			})
+		})
+	})
+}
+
+type testApprovalNotifier struct {
+	notifications []string
+}
+
+// NotifyApprovers records the level and the users notified
+func (n *testApprovalNotifier) NotifyApprovers(rc RecordCollection, method string, level ApprovalLevel, uids []int64) error {
+	n.notifications = append(n.notifications, fmt.Sprintf("%s %s: %v", method, level.Name, uids))
+	return nil
+}
+
+func TestApprovals(t *testing.T) {
+	Convey("Testing approval workflows", t, func() {
+		managers := security.Registry.NewGroup("approval_managers", "Approval Managers")
+		directors := security.Registry.NewGroup("approval_directors", "Approval Directors")
+		for uid, group := range map[int64]*security.Group{2: managers, 3: directors, 4: nil} {
+			security.Registry.AddMembership(uid, security.GroupAdmin)
+			if group != nil {
+				security.Registry.AddMembership(uid, group)
+			}
+		}
+		archive := Registry.MustGet("Category").methods.MustGet("Archive")
+		archive.RequireApprovals(
+			ApprovalLevel{Name: "Manager", Group: managers},
+			ApprovalLevel{Name: "Director", Condition: "sequence >= 100", Group: directors})
+		notifier := new(testApprovalNotifier)
+		ApprovalNotifications = notifier
+		defer func() {
+			ApprovalNotifications = nil
+			archive.RequireApprovals()
+			for _, uid := range []int64{2, 3, 4} {
+				security.Registry.RemoveAllMembershipsForUser(uid)
+			}
+			security.Registry.UnregisterGroup(managers)
+			security.Registry.UnregisterGroup(directors)
+		}()
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			categories := env.Pool("Category")
+			small := categories.Call("Create", FieldMap{"Name": "Small", "Sequence": 10}).(RecordCollection)
+			large := categories.Call("Create", FieldMap{"Name": "Large", "Sequence": 500}).(RecordCollection)
+			Convey("Methods are blocked until all required levels are approved", func() {
+				So(small.Union(large).PendingApprovals("Archive"), ShouldResemble,
+					map[int64]string{small.ids[0]: "Manager", large.ids[0]: "Manager"})
+				So(env.ExecuteInSavepoint(func(Environment) error {
+					small.Call("Archive")
+					return nil
+				}), ShouldResemble, ApprovalError{Model: "Category", Method: "Archive", ID: small.ids[0], Level: "Manager"})
+				small.Union(large).Sudo(2).Approve("Archive", "OK for me")
+				So(notifier.notifications, ShouldResemble, []string{"Archive Director: [3]"})
+				So(small.Call("Archive"), ShouldBeTrue)
+				So(small.Get("Active"), ShouldBeFalse)
+				So(func() { large.Call("Archive") }, ShouldPanic)
+				So(large.PendingApprovals("Archive"), ShouldResemble, map[int64]string{large.ids[0]: "Director"})
+			})
+			Convey("Only members of the group of the level can approve", func() {
+				So(func() { large.Approve("Archive", "") }, ShouldPanicWith, AccessError{Model: "Category",
+					Message: "You are not allowed to approve 'Manager' of Category records"})
+				So(func() { large.Sudo(3).Approve("Archive", "") }, ShouldPanic)
+			})
+			Convey("Refused levels can be approved by another approver", func() {
+				large.Sudo(2).Refuse("Archive", "Too expensive")
+				So(env.ExecuteInSavepoint(func(Environment) error {
+					large.Call("Archive")
+					return nil
+				}), ShouldResemble, ApprovalError{Model: "Category", Method: "Archive", ID: large.ids[0],
+					Level: "Manager", Refused: true})
+				large.Sudo(2).Approve("Archive", "")
+				So(large.PendingApprovals("Archive"), ShouldResemble, map[int64]string{large.ids[0]: "Director"})
+				large.ResetApprovals("Archive")
+				So(large.PendingApprovals("Archive"), ShouldResemble, map[int64]string{large.ids[0]: "Manager"})
+			})
+			Convey("Delegates can approve on behalf of absent approvers", func() {
+				large.Sudo(2).Approve("Archive", "")
+				now := time.Now()
+				large.Sudo(3).Env().DelegateApprovals(4, types.DateTime(now.Add(-time.Hour)), types.DateTime(now.Add(time.Hour)))
+				large.RequestApprovals("Archive")
+				So(notifier.notifications[len(notifier.notifications)-1], ShouldEqual, "Archive Director: [3 4]")
+				large.Sudo(4).Approve("Archive", "On behalf of 3")
+				var onBehalfOf int64
+				env.cr.Get(&onBehalfOf, `SELECT on_behalf_of_uid FROM approval WHERE res_id = ? AND level = ?`,
+					large.ids[0], "Director")
+				So(onBehalfOf, ShouldEqual, 3)
+				So(large.PendingApprovals("Archive"), ShouldBeEmpty)
+				So(large.Call("Archive"), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestTranslatableFields(t *testing.T) {
+	Convey("Test translatable fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			termsOf := func(terms []TranslationTerm, tag RecordCollection) []TranslationTerm {
+				var res []TranslationTerm
+				for _, term := range terms {
+					if term.Model == "Tag" && term.ResID == tag.Ids()[0] {
+						res = append(res, term)
+					}
+				}
+				return res
+			}
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Translated", "Description": "Red"}).(RecordCollection)
+			Convey("Values are read in the source language without translation", func() {
+				So(tag.WithContext("lang", "fr_FR").Get("Description"), ShouldEqual, "Red")
+				So(tag.WithContext("lang", SourceLanguage).Get("Description"), ShouldEqual, "Red")
+			})
+			Convey("Values written with a language are read in this language only", func() {
+				tag.WithContext("lang", "fr_FR").Set("Description", "Rouge")
+				So(tag.WithContext("lang", "fr_FR").Get("Description"), ShouldEqual, "Rouge")
+				So(tag.WithContext("lang", "de_DE").Get("Description"), ShouldEqual, "Red")
+				So(tag.Get("Description"), ShouldEqual, "Red")
+				tag.WithContext("lang", "fr_FR").Set("Description", "Rouge vif")
+				So(tag.WithContext("lang", "fr_FR").Get("Description"), ShouldEqual, "Rouge vif")
+			})
+			Convey("Missing terms can be exported and imported", func() {
+				terms := termsOf(ExportTranslations(env, "fr_FR", true), tag)
+				So(terms, ShouldHaveLength, 1)
+				So(terms[0].Field, ShouldEqual, "Description")
+				So(terms[0].Source, ShouldEqual, "Red")
+				So(terms[0].Value, ShouldBeEmpty)
+				var buf bytes.Buffer
+				So(WriteTranslationsCSV(&buf, terms), ShouldBeNil)
+				imported, err := ReadTranslationsCSV(&buf)
+				So(err, ShouldBeNil)
+				So(imported, ShouldResemble, terms)
+				imported[0].Value = "Rouge"
+				So(ImportTranslations(env, "fr_FR", imported), ShouldEqual, 1)
+				So(tag.WithContext("lang", "fr_FR").Get("Description"), ShouldEqual, "Rouge")
+				So(termsOf(ExportTranslations(env, "fr_FR", true), tag), ShouldBeEmpty)
+				terms = termsOf(ExportTranslations(env, "fr_FR", false), tag)
+				So(terms, ShouldHaveLength, 1)
+				So(terms[0].Value, ShouldEqual, "Rouge")
+			})
+			Convey("Translations cannot be imported in the source language", func() {
+				So(func() { ImportTranslations(env, SourceLanguage, nil) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestHierarchicalSearch(t *testing.T) {
+	Convey("Test child_of and parent_of operators", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tagModel := env.Pool("Tag").Model()
+			root := env.Pool("Tag").Call("Create", FieldMap{"Name": "Root"}).(RecordCollection)
+			child := env.Pool("Tag").Call("Create", FieldMap{"Name": "Child", "Parent": root}).(RecordCollection)
+			grandChild := env.Pool("Tag").Call("Create", FieldMap{"Name": "Grand Child", "Parent": child}).(RecordCollection)
+			other := env.Pool("Tag").Call("Create", FieldMap{"Name": "Other"}).(RecordCollection)
+			Convey("child_of returns the records and all their descendants", func() {
+				tags := env.Pool("Tag").Search(tagModel.Field("ID").ChildOf(root))
+				So(tags.Ids(), ShouldHaveLength, 3)
+				So(tags.Ids(), ShouldContain, grandChild.Ids()[0])
+				So(tags.Ids(), ShouldNotContain, other.Ids()[0])
+				tags = env.Pool("Tag").Search(tagModel.Field("Parent").ChildOf(child))
+				So(tags.Ids(), ShouldResemble, grandChild.Ids())
+			})
+			Convey("parent_of returns the records and all their ancestors", func() {
+				tags := env.Pool("Tag").Search(tagModel.Field("ID").ParentOf(grandChild))
+				So(tags.Ids(), ShouldHaveLength, 3)
+				So(tags.Ids(), ShouldContain, root.Ids()[0])
+				So(tags.Ids(), ShouldNotContain, other.Ids()[0])
+				tags = env.Pool("Tag").Search(tagModel.Field("ID").ParentOf(child.Union(other)))
+				So(tags.Ids(), ShouldHaveLength, 3)
+			})
+			Convey("Parent paths are maintained on create and write", func() {
+				catModel := env.Pool("Category").Model()
+				catRoot := env.Pool("Category").Call("Create", FieldMap{"Name": "Root"}).(RecordCollection)
+				catChild := env.Pool("Category").Call("Create", FieldMap{"Name": "Child", "Parent": catRoot}).(RecordCollection)
+				catGrandChild := env.Pool("Category").Call("Create", FieldMap{"Name": "Grand Child", "Parent": catChild}).(RecordCollection)
+				catOther := env.Pool("Category").Call("Create", FieldMap{"Name": "Other"}).(RecordCollection)
+				So(catGrandChild.Get("ParentPath"), ShouldEqual,
+					fmt.Sprintf("%d/%d/%d/", catRoot.Ids()[0], catChild.Ids()[0], catGrandChild.Ids()[0]))
+				So(env.Pool("Category").Search(catModel.Field("ID").ChildOf(catRoot)).Ids(), ShouldHaveLength, 3)
+				So(env.Pool("Category").Search(catModel.Field("ID").ParentOf(catGrandChild)).Ids(), ShouldHaveLength, 3)
+				catChild.Set("Parent", catOther)
+				So(catGrandChild.Get("ParentPath"), ShouldEqual,
+					fmt.Sprintf("%d/%d/%d/", catOther.Ids()[0], catChild.Ids()[0], catGrandChild.Ids()[0]))
+				So(env.Pool("Category").Search(catModel.Field("ID").ChildOf(catRoot)).Ids(), ShouldResemble, catRoot.Ids())
+				So(env.Pool("Category").Search(catModel.Field("Parent").ChildOf(catOther)).Ids(), ShouldHaveLength, 2)
+				So(func() { catOther.Set("Parent", catGrandChild) }, ShouldPanic)
+				So(func() { catOther.Set("Parent", catOther) }, ShouldPanic)
+			})
+			Convey("Hierarchical operators need a model with a parent field", func() {
+				So(func() {
+					env.Pool("User").Search(env.Pool("User").Model().Field("ID").ChildOf(1)).Load()
+				}, ShouldPanic)
+				So(func() {
+					env.Pool("Tag").Search(tagModel.Field("Name").ChildOf("Root")).Load()
+				}, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestPrefetchRecordSet(t *testing.T) {
+	Convey("Test prefetching of many2one fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tagModel := env.Pool("Tag").Model()
+			var parentIds []int64
+			for i := 0; i < 3; i++ {
+				parent := env.Pool("Tag").Call("Create", FieldMap{"Name": fmt.Sprintf("Prefetch Parent %d", i)}).(RecordCollection)
+				env.Pool("Tag").Call("Create", FieldMap{"Name": fmt.Sprintf("Prefetch Child %d", i), "Parent": parent})
+				parentIds = append(parentIds, parent.Ids()[0])
+			}
+			// Start from an empty cache
+			env.cache = newCache()
+			children := env.Pool("Tag").Search(tagModel.Field("Name").Like("Prefetch Child")).OrderBy("ID").Records()
+			So(children, ShouldHaveLength, 3)
+			So(env.cache.checkIfInCache(tagModel, parentIds, []string{"name"}), ShouldBeFalse)
+			Convey("Reading a field of one parent loads all parents", func() {
+				So(children[0].Get("Parent").(RecordCollection).Get("Name"), ShouldEqual, "Prefetch Parent 0")
+				So(env.cache.checkIfInCache(tagModel, parentIds, []string{"name"}), ShouldBeTrue)
+				So(children[2].Get("Parent").(RecordCollection).Get("Name"), ShouldEqual, "Prefetch Parent 2")
+				So(env.cache.prefetch[tagModel.name], ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestRecordCacheInvalidation(t *testing.T) {
+	Convey("Test the invalidation of the record cache", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userModel := env.Pool("User").Model()
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Cache User", "Email": "cache@example.com"}).(RecordCollection)
+			So(user.Get("Name"), ShouldEqual, "Cache User")
+			Convey("Writing a field should only remove this field from the cache", func() {
+				user.Set("IsStaff", true)
+				So(user.env.cache.checkIfInCache(userModel, user.Ids(), []string{"name"}), ShouldBeTrue)
+				So(user.Get("IsStaff"), ShouldBeTrue)
+			})
+			Convey("Non stored computed fields should be cached until a dependency is written", func() {
+				So(user.Get("DecoratedName"), ShouldEqual, "User: Cache User [<cache@example.com>]")
+				ref := newComputedRef(user.env, userModel, user.Ids()[0], "decorated_name")
+				_, ok := user.env.cache.getComputed(ref)
+				So(ok, ShouldBeTrue)
+				user.Set("Email", "cache2@example.com")
+				_, ok = user.env.cache.getComputed(ref)
+				So(ok, ShouldBeFalse)
+				So(user.Get("DecoratedName"), ShouldEqual, "User: Cache User [<cache2@example.com>]")
+			})
+			Convey("Creating a related record should invalidate the reverse one2many field", func() {
+				So(user.Get("Posts").(RecordCollection).Len(), ShouldEqual, 0)
+				env.Pool("Post").Call("Create", FieldMap{"Title": "Cache Post", "User": user.Ids()[0]})
+				So(user.Get("Posts").(RecordCollection).Len(), ShouldEqual, 1)
+			})
+			Convey("Deleting a record should remove it from the cache", func() {
+				user.Call("Unlink")
+				So(user.env.cache.checkIfInCache(userModel, user.Ids(), []string{"name"}), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestPageRecordSet(t *testing.T) {
+	Convey("Test keyset pagination", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tagModel := env.Pool("Tag").Model()
+			for i := 1; i <= 5; i++ {
+				env.Pool("Tag").Call("Create", FieldMap{"Name": fmt.Sprintf("Page Tag %d", i)})
+			}
+			tags := env.Pool("Tag").Search(tagModel.Field("Name").Like("Page Tag"))
+			pageNames := func(rs RecordCollection) []string {
+				var res []string
+				for _, rec := range rs.Records() {
+					res = append(res, rec.Get("Name").(string))
+				}
+				return res
+			}
+			Convey("Pages should follow each other in the order of the RecordSet", func() {
+				page, cursor := tags.OrderBy("Name desc").Page("", 2)
+				So(pageNames(page), ShouldResemble, []string{"Page Tag 5", "Page Tag 4"})
+				So(cursor, ShouldNotBeEmpty)
+				page, cursor = tags.OrderBy("Name desc").Page(cursor, 2)
+				So(pageNames(page), ShouldResemble, []string{"Page Tag 3", "Page Tag 2"})
+				page, cursor = tags.OrderBy("Name desc").Page(cursor, 2)
+				So(pageNames(page), ShouldResemble, []string{"Page Tag 1"})
+				So(cursor, ShouldBeEmpty)
+			})
+			Convey("Records created before the cursor should not shift the next pages", func() {
+				page, cursor := tags.OrderBy("Name").Page("", 2)
+				So(pageNames(page), ShouldResemble, []string{"Page Tag 1", "Page Tag 2"})
+				env.Pool("Tag").Call("Create", FieldMap{"Name": "Page Tag 0"})
+				page, _ = tags.OrderBy("Name").Page(cursor, 2)
+				So(pageNames(page), ShouldResemble, []string{"Page Tag 3", "Page Tag 4"})
+			})
+			Convey("Cursors should only be used with the same order", func() {
+				_, cursor := tags.OrderBy("Name").Page("", 2)
+				So(func() { tags.OrderBy("Name desc").Page(cursor, 2) }, ShouldPanic)
+				So(func() { tags.Page("invalid", 2) }, ShouldPanic)
+			})
+		})
+	})
+}
+
 func TestDeleteRecordSet(t *testing.T) {
 	Convey("Delete user John Smith", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -615,3 +2788,19 @@ func TestDeleteRecordSet(t *testing.T) {
 	})
 	security.Registry.UnregisterGroup(group1)
 }
+
+func TestDecimalFields(t *testing.T) {
+	Convey("Test rounding of decimal fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			sizeField := Registry.MustGet("User").fields.MustGet("Size")
+			sizeField.digits = types.Digits{Precision: 16, Scale: 2}
+			defer func() { sizeField.digits = types.Digits{} }()
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Decimal User", "Size": 1.675}).(RecordCollection)
+			So(user.Get("Size"), ShouldEqual, 1.68)
+			SetCompanyRoundingPolicy(1, &nbutils.RoundingPolicy{Method: nbutils.RoundHalfEven})
+			defer SetCompanyRoundingPolicy(1, nil)
+			user.WithContext("company_id", int64(1)).Call("Write", FieldMap{"Size": 1.665})
+			So(user.Get("Size"), ShouldEqual, 1.66)
+		})
+	})
+}
@@ -15,6 +15,9 @@
 package models
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/npiganeau/yep/yep/models/security"
@@ -34,6 +37,137 @@ func TestMethods(t *testing.T) {
 	})
 }
 
+func TestInspectModel(t *testing.T) {
+	Convey("Testing model inspection", t, func() {
+		insp := InspectModel("User")
+		So(insp.Table, ShouldEqual, "user")
+		So(insp.Mixins, ShouldContain, "ModelMixin")
+		var email, createDate FieldInspection
+		for _, fi := range insp.Fields {
+			switch fi.Name {
+			case "Email":
+				email = fi
+			case "CreateDate":
+				createDate = fi
+			}
+		}
+		So(email.JSON, ShouldEqual, "email")
+		So(email.Stored, ShouldBeTrue)
+		So(email.Mixins, ShouldBeEmpty)
+		So(createDate.Mixins, ShouldContain, "BaseMixin")
+		var prefixedUser MethodInspection
+		for _, meth := range insp.Methods {
+			if meth.Name == "PrefixedUser" {
+				prefixedUser = meth
+			}
+		}
+		So(prefixedUser.Layers, ShouldHaveLength, 2)
+		So(prefixedUser.Layers[0], ShouldContainSubstring, "t01_models_test.go")
+		So(func() { InspectModel("NonExistentModel") }, ShouldPanic)
+	})
+}
+
+func TestMethodGuards(t *testing.T) {
+	Convey("Testing method layers skipped by context keys", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			Convey("Calling `Greet` without context key executes all layers", func() {
+				So(users.Call("Greet", "John"), ShouldEqual, "<Hello John!>")
+			})
+			Convey("Calling `Greet` with context key skips the guarded layer", func() {
+				So(users.WithContext("plain_greeting", true).Call("Greet", "John"), ShouldEqual, "<Hello John>")
+			})
+		})
+	})
+}
+
+func TestMethodAccess(t *testing.T) {
+	Convey("Testing method execution permissions", t, func() {
+		greeters := security.Registry.NewGroup("greeters", "Greeters")
+		defer security.Registry.UnregisterGroup(greeters)
+		greet := Registry.MustGet("User").methods.MustGet("Greet")
+		recoverFrom := func(fnct func()) (res interface{}) {
+			defer func() {
+				res = recover()
+			}()
+			fnct()
+			return
+		}
+		Convey("Denied calls panic with the groups allowed to execute the method", func() {
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(recoverFrom(func() { env.Pool("User").Call("Greet", "John") }), ShouldResemble,
+					MethodAccessError{Model: "User", Method: "Greet", Groups: []string{"admin"}})
+				err := MethodAccessError{Model: "User", Method: "Greet", Groups: []string{"admin", "greeters"}}
+				So(err.Error(), ShouldEqual, "You are not allowed to execute method 'Greet' of 'User'. It requires membership of one of these groups: admin, greeters")
+			})
+		})
+		Convey("Members of allowed groups can execute the method", func() {
+			greet.AllowGroup(greeters)
+			defer greet.RevokeGroup(greeters)
+			security.Registry.AddMembership(2, greeters)
+			defer security.Registry.RemoveMembership(2, greeters)
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(env.Pool("User").Call("Greet", "John"), ShouldEqual, "<Hello John!>")
+			})
+		})
+		Convey("Only client calls are checked with the CheckClientMethodCalls policy", func() {
+			MethodAccess = CheckClientMethodCalls
+			defer func() { MethodAccess = CheckAllMethodCalls }()
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(env.Pool("User").Call("Greet", "John"), ShouldEqual, "<Hello John!>")
+			})
+			ctx := WithRequestClass(context.Background(), InteractiveRequest)
+			SimulateInNewEnvironmentWithContext(ctx, 2, func(env Environment) {
+				So(recoverFrom(func() { env.Pool("User").Call("Greet", "John") }), ShouldResemble,
+					MethodAccessError{Model: "User", Method: "Greet", Groups: []string{"admin"}})
+			})
+		})
+	})
+}
+
+func TestMethodLayersOrder(t *testing.T) {
+	Convey("Testing the order of method layers across modules", t, func() {
+		RegisterModulePackage("example.com/base")
+		RegisterModulePackage("example.com/sale")
+		defer func() {
+			delete(modulePackages, "example.com/base")
+			delete(modulePackages, "example.com/sale")
+		}()
+		newLayeredMethod := func(pkgs ...string) *Method {
+			fnct := reflect.ValueOf(func(rc RecordCollection) {})
+			method := newMethod(Registry.MustGet("User"), "Layered", "0", fnct)
+			method.topLayer.pkg = pkgs[0]
+			for i, pkg := range pkgs[1:] {
+				method.addMethodLayer(fnct, fmt.Sprint(i+1))
+				method.topLayer.pkg = pkg
+			}
+			return method
+		}
+		layersDoc := func(method *Method) []string {
+			var res []string
+			for _, layer := range method.invertedLayers() {
+				res = append(res, layer.doc)
+			}
+			return res
+		}
+		Convey("Layers are ordered by module load order", func() {
+			method := newLayeredMethod("example.com/base", "example.com/sale", "example.com/base", "example.com/helpers")
+			method.sortLayers()
+			So(layersDoc(method), ShouldResemble, []string{"0", "2", "3", "1"})
+			So(method.topLayer.pkg, ShouldEqual, "example.com/sale")
+		})
+		Convey("Layers of modules loaded before the module of the method are rejected", func() {
+			method := newLayeredMethod("example.com/sale", "example.com/base")
+			So(method.sortLayers, ShouldPanic)
+		})
+		Convey("Package of functions are found from their name", func() {
+			So(PackageOfFunc("github.com/foo/sale.declareModels.func1"), ShouldEqual, "github.com/foo/sale")
+			So(PackageOfFunc("github.com/foo/sale.(*Order).Confirm-fm"), ShouldEqual, "github.com/foo/sale")
+			So(PackageOfFunc("main.init.0"), ShouldEqual, "main")
+		})
+	})
+}
+
 func TestComputedNonStoredFields(t *testing.T) {
 	Convey("Testing non stored computed fields", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -59,6 +193,43 @@ func TestComputedNonStoredFields(t *testing.T) {
 	})
 }
 
+func TestNameGetNameSearch(t *testing.T) {
+	Convey("Testing display names", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			post := env.Pool("Post").Call("Create", FieldMap{"Title": "Display Name Post"}).(RecordCollection)
+			otherPost := env.Pool("Post").Call("Create", FieldMap{"Title": "Other Post"}).(RecordCollection)
+			Convey("NameGet returns the value of the rec name field", func() {
+				So(post.Call("NameGet"), ShouldEqual, "Display Name Post")
+				So(post.Get("DisplayName"), ShouldEqual, "Display Name Post")
+			})
+			Convey("NameSearch searches on the rec name field", func() {
+				posts := env.Pool("Post").Call("NameSearch", NameSearchParams{Name: "display name"}).(RecordCollection)
+				So(posts.Len(), ShouldEqual, 1)
+				So(posts.Ids()[0], ShouldEqual, post.Ids()[0])
+				posts = env.Pool("Post").Call("NameSearch", NameSearchParams{Name: "Other Post", Operator: "="}).(RecordCollection)
+				So(posts.Len(), ShouldEqual, 1)
+				So(posts.Ids()[0], ShouldEqual, otherPost.Ids()[0])
+			})
+			Convey("NameSearch also matches the given condition and limit", func() {
+				postModel := env.Pool("Post").Model()
+				posts := env.Pool("Post").Call("NameSearch", NameSearchParams{
+					Name: "Post",
+					Args: postModel.Field("Title").NotEquals("Other Post"),
+				}).(RecordCollection)
+				So(posts.Ids(), ShouldContain, post.Ids()[0])
+				So(posts.Ids(), ShouldNotContain, otherPost.Ids()[0])
+				posts = env.Pool("Post").Call("NameSearch", NameSearchParams{Name: "Post", Limit: 1}).(RecordCollection)
+				So(posts.Len(), ShouldEqual, 1)
+			})
+			Convey("Models without rec name field use the default name field", func() {
+				users := env.Pool("User").Call("NameSearch", NameSearchParams{Name: "Jane A."}).(RecordCollection)
+				So(users.Len(), ShouldEqual, 1)
+				So(users.Call("NameGet"), ShouldEqual, "Jane A. Smith")
+			})
+		})
+	})
+}
+
 func TestComputedStoredFields(t *testing.T) {
 	Convey("Testing stored computed fields", t, func() {
 		ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -99,6 +270,38 @@ func TestComputedStoredFields(t *testing.T) {
 	})
 }
 
+func TestExplainCompute(t *testing.T) {
+	Convey("Testing the explanation of computed fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			jane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			Convey("Explaining an up to date stored computed field", func() {
+				expl := jane.ExplainCompute("Age")
+				So(expl.Compute, ShouldEqual, "computeAge")
+				So(expl.Stored, ShouldBeTrue)
+				So(expl.Triggers, ShouldContain, ComputeTrigger{Model: "User", Field: "Profile"})
+				So(expl.Triggers, ShouldContain, ComputeTrigger{Model: "Profile", Field: "Age", Path: "profile_id"})
+				So(expl.Sources, ShouldHaveLength, 3)
+				So(expl.Sources[2].Path, ShouldEqual, "Profile.Age")
+				So(expl.Sources[2].Values, ShouldResemble, []interface{}{int16(24)})
+				So(expl.ComputedValue, ShouldEqual, 24)
+				So(expl.Stale, ShouldBeFalse)
+			})
+			Convey("Explaining a stale stored computed field", func() {
+				env.Cr().Execute(`UPDATE "user" SET age = 12 WHERE id = ?`, jane.Ids()[0])
+				jane.Load()
+				expl := jane.ExplainCompute("Age")
+				So(expl.Value, ShouldEqual, 12)
+				So(expl.ComputedValue, ShouldEqual, 24)
+				So(expl.Stale, ShouldBeTrue)
+			})
+			Convey("Explaining a non computed field should panic", func() {
+				So(func() { jane.ExplainCompute("Email") }, ShouldPanic)
+			})
+		})
+	})
+}
+
 func TestRelatedNonStoredFields(t *testing.T) {
 	Convey("Testing non stored related fields", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -15,7 +15,11 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/models/types"
@@ -29,7 +33,7 @@ func TestEnvironment(t *testing.T) {
 			users := env.Pool("User")
 			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
 			Convey("Checking WithEnv", func() {
-				env2 := newEnvironment(2)
+				env2 := newEnvironment(context.Background(), 2)
 				userJane1 := userJane.WithEnv(env2)
 				So(userJane1.Env().Uid(), ShouldEqual, 2)
 				So(userJane.Env().Uid(), ShouldEqual, 1)
@@ -61,6 +65,27 @@ func TestEnvironment(t *testing.T) {
 				So(userJane.Env().Context().Get("key"), ShouldEqual, "context value")
 				So(userJane.Env().Uid(), ShouldEqual, security.SuperUserID)
 			})
+			Convey("Checking typed context getters", func() {
+				userJane1 := userJane.WithContext("count", float64(3)).WithContext("flag", true)
+				ctx := userJane1.Env().Context()
+				So(ctx.GetString("key", "none"), ShouldEqual, "context value")
+				So(ctx.GetString("unknown", "none"), ShouldEqual, "none")
+				So(ctx.GetInt("count", 0), ShouldEqual, int64(3))
+				So(ctx.GetInt("key", 7), ShouldEqual, int64(7))
+				So(ctx.GetBool("flag", false), ShouldBeTrue)
+				So(ctx.GetBool("unknown", true), ShouldBeTrue)
+				var nilCtx *types.Context
+				So(nilCtx.HasKey("key"), ShouldBeFalse)
+				So(nilCtx.GetString("key", "none"), ShouldEqual, "none")
+			})
+			Convey("Checking non propagated context keys", func() {
+				userJane1 := userJane.WithContext("default_name", "Default").WithContext("active_ids", []int64{1})
+				subEnv := userJane1.Env().subOperationEnv()
+				So(subEnv.Context().HasKey("key"), ShouldBeTrue)
+				So(subEnv.Context().HasKey("default_name"), ShouldBeFalse)
+				So(subEnv.Context().HasKey("active_ids"), ShouldBeFalse)
+				So(userJane1.Env().Context().HasKey("default_name"), ShouldBeTrue)
+			})
 			Convey("Checking Sudo", func() {
 				userJane1 := userJane.Sudo(2)
 				userJane2 := userJane1.Sudo()
@@ -81,3 +106,536 @@ func TestEnvironment(t *testing.T) {
 		})
 	})
 }
+
+func TestNestedEnvironments(t *testing.T) {
+	Convey("Testing nested transactions detection", t, func() {
+		Convey("Nested transactions should be allowed by default", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				err := SimulateInNewEnvironmentWithContext(env.GoContext(), security.SuperUserID, func(env2 Environment) {
+					So(env2.Cr(), ShouldNotEqual, env.Cr())
+				})
+				So(err, ShouldBeNil)
+			})
+			So(err, ShouldBeNil)
+			err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				err := SimulateInNewEnvironment(security.SuperUserID, func(env2 Environment) {
+					So(env2.Cr(), ShouldNotEqual, env.Cr())
+				})
+				So(err, ShouldBeNil)
+			})
+			So(err, ShouldBeNil)
+		})
+		Convey("Nested transactions can fail", func() {
+			NestedTransactions = NestedTransactionFail
+			defer func() { NestedTransactions = NestedTransactionAllow }()
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				SimulateInNewEnvironmentWithContext(env.GoContext(), security.SuperUserID, func(env Environment) {})
+			})
+			So(err, ShouldNotBeNil)
+			err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {})
+			})
+			So(err, ShouldNotBeNil)
+			if dbArgs.Driver == "postgres" {
+				// SQLite cannot open concurrent transactions
+				err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+					done := make(chan error)
+					go func() {
+						done <- SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {})
+					}()
+					So(<-done, ShouldBeNil)
+				})
+				So(err, ShouldBeNil)
+			}
+		})
+		Convey("Nested transactions can reuse the current transaction", func() {
+			NestedTransactions = NestedTransactionReuse
+			defer func() { NestedTransactions = NestedTransactionAllow }()
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				err := ExecuteInNewEnvironmentWithContext(env.GoContext(), 2, func(env2 Environment) {
+					So(env2.Cr(), ShouldEqual, env.Cr())
+					So(env2.Uid(), ShouldEqual, 2)
+				})
+				So(err, ShouldBeNil)
+			})
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestEnvironmentCancellation(t *testing.T) {
+	Convey("Testing Environment cancellation", t, func() {
+		Convey("Queries of a canceled context should be stopped", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			err := ExecuteInNewEnvironmentWithContext(ctx, security.SuperUserID, func(env Environment) {
+				So(env.GoContext().Done(), ShouldEqual, ctx.Done())
+				cancel()
+				env.Pool("User").SearchCount()
+			})
+			So(err, ShouldEqual, context.Canceled)
+		})
+		Convey("Running queries should be canceled at the context deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := SimulateInNewEnvironmentWithContext(ctx, security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("SELECT pg_sleep(10)")
+			})
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+	})
+}
+
+func TestStatementTimeoutsAndQueryGuards(t *testing.T) {
+	Convey("Testing statement timeouts", t, func() {
+		StatementTimeouts[CronRequest] = 100 * time.Millisecond
+		defer delete(StatementTimeouts, CronRequest)
+		Convey("Statements longer than the timeout of the class should be canceled", func() {
+			ctx := WithRequestClass(context.Background(), CronRequest)
+			start := time.Now()
+			err := SimulateInNewEnvironmentWithContext(ctx, security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("SELECT pg_sleep(10)")
+			})
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+		Convey("Statements of other classes should not have a timeout", func() {
+			ctx := WithRequestClass(context.Background(), ReportRequest)
+			err := SimulateInNewEnvironmentWithContext(ctx, security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("SELECT pg_sleep(0.2)")
+			})
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("Testing query guards", t, func() {
+		ClientQueryGuard = QueryGuard{RejectUnbounded: true, MaxOffset: 100}
+		defer func() { ClientQueryGuard = QueryGuard{} }()
+		Convey("Unbounded queries of interactive requests should be rejected", func() {
+			ctx := WithRequestClass(context.Background(), InteractiveRequest)
+			SimulateInNewEnvironmentWithContext(ctx, security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				So(func() { users.FetchAll().Len() }, ShouldPanicWith,
+					QueryGuardError{Model: "User", Message: "Searching all 'User' records without limit is not allowed"})
+				So(func() { users.FetchAll().Limit(10).Offset(1000).Len() }, ShouldPanicWith,
+					QueryGuardError{Model: "User", Message: "Offset 1000 is greater than the maximum offset 100"})
+				So(func() { users.FetchAll().Limit(10).Len() }, ShouldNotPanic)
+				So(func() { users.Search(users.Model().Field("Name").Equals("John Smith")).Len() }, ShouldNotPanic)
+			})
+		})
+		Convey("Queries of other requests should not be checked", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(func() { env.Pool("User").FetchAll().Len() }, ShouldNotPanic)
+			})
+		})
+	})
+}
+
+func TestSavepoints(t *testing.T) {
+	Convey("Testing savepoints", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userModel := env.Pool("User").Model()
+			count := func(name string) int {
+				return env.Pool("User").Search(userModel.Field("Name").Equals(name)).SearchCount()
+			}
+			Convey("Changes of a successful savepoint should be kept", func() {
+				err := env.ExecuteInSavepoint(func(env Environment) error {
+					env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 1"})
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(count("Savepoint User 1"), ShouldEqual, 1)
+			})
+			Convey("Changes of a savepoint returning an error should be rolled back", func() {
+				err := env.ExecuteInSavepoint(func(env Environment) error {
+					env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 2"})
+					return errors.New("failed")
+				})
+				So(err, ShouldResemble, errors.New("failed"))
+				So(count("Savepoint User 2"), ShouldEqual, 0)
+			})
+			Convey("Database errors should only abort the savepoint", func() {
+				env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 3"})
+				err := env.ExecuteInSavepoint(func(env Environment) error {
+					env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 3"})
+					return nil
+				})
+				So(err, ShouldHaveSameTypeAs, ValidationError{})
+				So(count("Savepoint User 3"), ShouldEqual, 1)
+			})
+			Convey("Savepoints can be nested", func() {
+				err := env.ExecuteInSavepoint(func(env Environment) error {
+					env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 4"})
+					env.ExecuteInSavepoint(func(env Environment) error {
+						env.Pool("User").Call("Create", FieldMap{"Name": "Savepoint User 5"})
+						return errors.New("inner failure")
+					})
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(count("Savepoint User 4"), ShouldEqual, 1)
+				So(count("Savepoint User 5"), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestChangeFeed(t *testing.T) {
+	Convey("Testing the change feed", t, func() {
+		var cursor string
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			for {
+				events, next := ChangesSince(env, cursor, 100)
+				cursor = next
+				if len(events) == 0 {
+					break
+				}
+			}
+		})
+		Convey("Committed changes should be returned in order", func() {
+			var catID int64
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				cat := env.Pool("Category").Call("Create", FieldMap{"Name": "Change Feed Category"}).(RecordCollection)
+				catID = cat.Ids()[0]
+				cat.Call("Write", FieldMap{"Name": "Change Feed Category 2", "Sequence": int64(3)})
+				cat.Call("Unlink")
+			})
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				events, next := ChangesSince(env, cursor, 100)
+				So(events, ShouldHaveLength, 3)
+				So(next, ShouldNotEqual, cursor)
+				for _, event := range events {
+					So(event.Model, ShouldEqual, "Category")
+					So(event.ResID, ShouldEqual, catID)
+				}
+				So(events[0].Operation, ShouldEqual, ChangeCreate)
+				So(events[0].Fields, ShouldContain, "name")
+				So(events[1].Operation, ShouldEqual, ChangeWrite)
+				So(events[1].Fields, ShouldResemble, []string{"name", "sequence"})
+				So(events[2].Operation, ShouldEqual, ChangeUnlink)
+				So(events[2].Fields, ShouldBeEmpty)
+				events, _ = ChangesSince(env, next, 100)
+				So(events, ShouldBeEmpty)
+			})
+		})
+		Convey("Rolled back changes should not be returned", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Category").Call("Create", FieldMap{"Name": "Rolled Back Category"})
+			})
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				events, _ := ChangesSince(env, cursor, 100)
+				So(events, ShouldBeEmpty)
+			})
+		})
+		Convey("Models without change feed should not be recorded", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				events, _ := ChangesSince(env, cursor, 100)
+				for _, event := range events {
+					So(event.Model, ShouldNotEqual, "User")
+				}
+			})
+		})
+	})
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	Convey("Testing optimistic concurrency control", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			cat := env.Pool("Category").Call("Create", FieldMap{"Name": "Versioned Category"}).(RecordCollection)
+			key := fmt.Sprintf("Category,%d", cat.Ids()[0])
+			Convey("Writing records modified since they were read should fail", func() {
+				err := env.ExecuteInSavepoint(func(env Environment) error {
+					stale := map[string]interface{}{key: "2000-01-01 00:00:00"}
+					cat.WithContext("__last_update", stale).Call("Write", FieldMap{"Name": "Stale Category"})
+					return nil
+				})
+				So(err, ShouldResemble, ConcurrentUpdateError{Model: "Category", IDs: cat.Ids()})
+				So(cat.Get("Name"), ShouldEqual, "Versioned Category")
+			})
+			Convey("Writing up to date records should succeed, even several times", func() {
+				So(cat.Versions(), ShouldContainKey, key)
+				versioned := cat.WithContext("__last_update", cat.Versions())
+				versioned.Call("Write", FieldMap{"Name": "Fresh Category"})
+				versioned.Call("Write", FieldMap{"Sequence": int64(2)})
+				So(cat.Get("Name"), ShouldEqual, "Fresh Category")
+			})
+			Convey("Writing without versions or on other models should not be checked", func() {
+				cat.Call("Write", FieldMap{"Name": "Unchecked Category"})
+				stale := map[string]interface{}{"User,1": "2000-01-01 00:00:00"}
+				user := env.Pool("User").Search(env.Pool("User").Model().Field("ID").Equals(1))
+				So(func() { user.WithContext("__last_update", stale).Call("Write", FieldMap{"Nums": 3}) }, ShouldNotPanic)
+			})
+		})
+	})
+}
+
+func TestTimeZones(t *testing.T) {
+	Convey("Testing time zones", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("Post")
+			parisPosts := posts.WithContext("tz", "Europe/Paris")
+			Convey("The location is given by the tz context key", func() {
+				So(parisPosts.Env().Location().String(), ShouldEqual, "Europe/Paris")
+				So(posts.Env().Location(), ShouldEqual, time.Local)
+				So(posts.WithContext("tz", "Nowhere/Unknown").Env().Location(), ShouldEqual, time.Local)
+			})
+			Convey("Datetimes are stored in UTC and read in the user's time zone", func() {
+				post := parisPosts.Call("Create", FieldMap{"Title": "Zoned Post",
+					"PublishDate": "2017-07-14 10:00:00", "ExpiryDate": "2017-08-01"}).(RecordCollection)
+				var stored string
+				env.cr.Get(&stored, `SELECT to_char(publish_date, 'YYYY-MM-DD HH24:MI:SS') FROM post WHERE id = ?`, post.ids[0])
+				So(stored, ShouldEqual, "2017-07-14 08:00:00")
+				publish := time.Time(post.Get("PublishDate").(types.DateTime))
+				So(publish.Location().String(), ShouldEqual, "Europe/Paris")
+				So(publish.Format("2006-01-02 15:04"), ShouldEqual, "2017-07-14 10:00")
+				utc := time.Time(post.WithContext("tz", "UTC").Get("PublishDate").(types.DateTime))
+				So(utc.Format("2006-01-02 15:04"), ShouldEqual, "2017-07-14 08:00")
+				So(time.Time(post.Get("ExpiryDate").(types.Date)).Format("2006-01-02"), ShouldEqual, "2017-08-01")
+				post.Call("Write", FieldMap{"PublishDate": time.Date(2017, 12, 24, 20, 0, 0, 0, time.UTC)})
+				env.cr.Get(&stored, `SELECT to_char(publish_date, 'YYYY-MM-DD HH24:MI:SS') FROM post WHERE id = ?`, post.ids[0])
+				So(stored, ShouldEqual, "2017-12-24 20:00:00")
+				So(func() { post.Call("Write", FieldMap{"PublishDate": "tomorrow"}) }, ShouldPanic)
+			})
+			Convey("The database session follows the time zone of the context", func() {
+				var offset string
+				parisPosts.Env().Cr().Get(&offset, `SELECT to_char(TIMESTAMPTZ '2017-01-01 12:00:00+00', 'HH24:MI')`)
+				So(offset, ShouldEqual, "13:00")
+				posts.WithContext("tz", "Asia/Tokyo").Env().Cr().Get(&offset, `SELECT to_char(TIMESTAMPTZ '2017-01-01 12:00:00+00', 'HH24:MI')`)
+				So(offset, ShouldEqual, "21:00")
+				posts.WithContext("tz", "America/New_York").SearchCount()
+				env.cr.Get(&offset, `SELECT to_char(TIMESTAMPTZ '2017-01-01 12:00:00+00', 'HH24:MI')`)
+				So(offset, ShouldEqual, "07:00")
+			})
+		})
+	})
+}
+
+func TestDateFields(t *testing.T) {
+	Convey("Testing date and datetime fields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("Post")
+			Convey("AutoNow and AutoNowAdd fields are set automatically", func() {
+				before := time.Now().Add(-time.Second)
+				post := posts.Call("Create", FieldMap{"Title": "Dated Post",
+					"CreationDay": "2001-01-01", "LastEditDate": "2001-01-01 00:00:00"}).(RecordCollection)
+				created := time.Time(post.Get("LastEditDate").(types.DateTime))
+				So(created.After(before), ShouldBeTrue)
+				So(post.Get("CreationDay").(types.Date).Format("2006-01-02"), ShouldEqual, env.Today().Format("2006-01-02"))
+				post.Call("Write", FieldMap{"Title": "Edited Post", "CreationDay": "2001-01-01"})
+				So(post.Get("CreationDay").(types.Date).Format("2006-01-02"), ShouldEqual, env.Today().Format("2006-01-02"))
+				So(time.Time(post.Get("LastEditDate").(types.DateTime)).Before(created), ShouldBeFalse)
+				So(func() { posts.Model().Fields().MustGet("Title").SetAutoNow(true) }, ShouldPanic)
+			})
+			Convey("Dates and datetimes can be truncated", func() {
+				paris, _ := time.LoadLocation("Europe/Paris")
+				dt := types.DateTime(time.Date(2017, 8, 17, 15, 30, 0, 0, paris))
+				So(dt.StartOf(types.Day).Format("2006-01-02 15:04 MST"), ShouldEqual, "2017-08-17 00:00 CEST")
+				So(dt.StartOf(types.Week).Format("2006-01-02"), ShouldEqual, "2017-08-14")
+				So(dt.StartOf(types.Month).Format("2006-01-02"), ShouldEqual, "2017-08-01")
+				So(dt.StartOf(types.Quarter).Format("2006-01-02"), ShouldEqual, "2017-07-01")
+				So(dt.StartOf(types.Year).Format("2006-01-02"), ShouldEqual, "2017-01-01")
+				So(dt.In(time.UTC).Format("15:04"), ShouldEqual, "13:30")
+				So(dt.ToDate().Format("2006-01-02 15:04"), ShouldEqual, "2017-08-17 00:00")
+				So(types.Date(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)).StartOf(types.Week).Format("2006-01-02"),
+					ShouldEqual, "2016-12-26")
+				So(types.Date{}.Format("2006-01-02"), ShouldBeBlank)
+				So(func() { dt.StartOf("century") }, ShouldPanic)
+			})
+			Convey("Dates are formatted in the language and time zone of the user", func() {
+				dt := types.DateTime(time.Date(2017, 8, 17, 13, 30, 0, 0, time.UTC))
+				parisEnv := posts.WithContext("tz", "Europe/Paris").Env()
+				So(parisEnv.FormatDateTime(dt), ShouldEqual, "08/17/2017 15:30:00")
+				So(parisEnv.FormatDate(dt.ToDate()), ShouldEqual, "08/17/2017")
+				So(env.FormatDate(types.Date{}), ShouldBeBlank)
+			})
+		})
+	})
+}
+
+type testPresenceNotifier struct {
+	notifications []string
+}
+
+// NotifyPresence records the new status of the user
+func (n *testPresenceNotifier) NotifyPresence(uid int64, status PresenceStatus) error {
+	n.notifications = append(n.notifications, fmt.Sprintf("%d %s", uid, status))
+	return nil
+}
+
+// NotifyTyping records the typing indicator of the user
+func (n *testPresenceNotifier) NotifyTyping(channel string, uid int64, typing bool) error {
+	n.notifications = append(n.notifications, fmt.Sprintf("%s: %d typing %t", channel, uid, typing))
+	return nil
+}
+
+func TestPresence(t *testing.T) {
+	Convey("Testing user presence", t, func() {
+		notifier := new(testPresenceNotifier)
+		PresenceNotifications = notifier
+		defer func() { PresenceNotifications = nil }()
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Present User"}).(RecordCollection)
+			uid := user.ids[0]
+			userEnv := user.Sudo(uid).Env()
+			Convey("Users are online while they send heartbeats and are active", func() {
+				So(user.Get("IMStatus"), ShouldEqual, string(PresenceOffline))
+				userEnv.UpdatePresence(0)
+				So(PresenceStatuses(&env, uid), ShouldResemble, map[int64]PresenceStatus{uid: PresenceOnline})
+				userEnv.UpdatePresence(time.Minute)
+				So(PresenceStatuses(&env, uid)[uid], ShouldEqual, PresenceOnline)
+				env.cr.Execute(`UPDATE user_presence SET last_presence = ? WHERE uid = ?`,
+					types.DateTime(time.Now().Add(-time.Hour)), uid)
+				So(user.Get("IMStatus"), ShouldEqual, string(PresenceAway))
+				env.cr.Execute(`UPDATE user_presence SET last_poll = ? WHERE uid = ?`,
+					types.DateTime(time.Now().Add(-time.Hour)), uid)
+				So(PresenceStatuses(&env, uid)[uid], ShouldEqual, PresenceOffline)
+				userEnv.UpdatePresence(2 * time.Hour)
+				So(PresenceStatuses(&env, uid)[uid], ShouldEqual, PresenceAway)
+				So(notifier.notifications, ShouldResemble, []string{fmt.Sprintf("%d online", uid), fmt.Sprintf("%d away", uid)})
+			})
+			Convey("Typing indicators expire", func() {
+				userEnv.SetTyping("discuss.channel_1", true)
+				userEnv.SetTyping("discuss.channel_1", true)
+				So(TypingUsers("discuss.channel_1"), ShouldResemble, []int64{uid})
+				So(TypingUsers("discuss.channel_2"), ShouldBeEmpty)
+				userEnv.SetTyping("discuss.channel_1", false)
+				So(TypingUsers("discuss.channel_1"), ShouldBeEmpty)
+				timeout := TypingTimeout
+				TypingTimeout = -time.Second
+				defer func() { TypingTimeout = timeout }()
+				userEnv.SetTyping("discuss.channel_1", true)
+				So(TypingUsers("discuss.channel_1"), ShouldBeEmpty)
+				So(notifier.notifications, ShouldResemble, []string{
+					fmt.Sprintf("discuss.channel_1: %d typing true", uid),
+					fmt.Sprintf("discuss.channel_1: %d typing false", uid),
+					fmt.Sprintf("discuss.channel_1: %d typing true", uid),
+				})
+			})
+		})
+	})
+}
+
+func TestReadOnlyEnvironment(t *testing.T) {
+	Convey("Testing read-only environments", t, func() {
+		Convey("Reading records should be allowed", func() {
+			var count int
+			err := ExecuteInReadOnlyEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.IsReadOnly(), ShouldBeTrue)
+				count = env.Pool("User").FetchAll().SearchCount()
+			})
+			So(err, ShouldBeNil)
+			So(count, ShouldBeGreaterThan, 0)
+		})
+		Convey("Creating, writing or unlinking records should fail", func() {
+			err := ExecuteInReadOnlyEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").Call("Create", FieldMap{"Name": "Read Only User"})
+			})
+			So(err, ShouldResemble, ReadOnlyError{Model: "User", Operation: "create"})
+			err = ExecuteInReadOnlyEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").FetchAll().Call("Write", FieldMap{"Email": "readonly@example.com"})
+			})
+			So(err, ShouldResemble, ReadOnlyError{Model: "User", Operation: "write"})
+			err = ExecuteInReadOnlyEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").FetchAll().Call("Unlink")
+			})
+			So(err, ShouldResemble, ReadOnlyError{Model: "User", Operation: "unlink"})
+		})
+		Convey("Direct database writes should be rejected", func() {
+			err := ExecuteInReadOnlyEnvironment(security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("UPDATE \"user\" SET email = 'readonly@example.com'")
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestX2ManyCommands(t *testing.T) {
+	Convey("Testing x2many commands of concurrent edits", t, func() {
+		var userID, post1ID, post2ID int64
+		var lastUpdate types.DateTime
+		ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "X2Many User"}).(RecordCollection)
+			post1 := env.Pool("Post").Call("Create", FieldMap{"Title": "First Line", "User": user.Ids()[0]}).(RecordCollection)
+			post2 := env.Pool("Post").Call("Create", FieldMap{"Title": "Second Line", "User": user.Ids()[0]}).(RecordCollection)
+			userID, post1ID, post2ID = user.Ids()[0], post1.Ids()[0], post2.Ids()[0]
+			lastUpdate = post2.Get("LastUpdate").(types.DateTime)
+		})
+		Convey("Non conflicting commands should all be committed", func() {
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").withIds([]int64{userID}).Call("Write", FieldMap{"Posts": X2ManyCommands{
+					{Type: CommandUpdate, ID: post1ID, Values: FieldMap{"Content": "Updated"}},
+					{Type: CommandUpdate, ID: post2ID, Values: FieldMap{"Content": "Updated"}, LastUpdate: lastUpdate},
+					{Type: CommandCreate, Values: FieldMap{"Title": "Third Line"}},
+				}})
+				env.Pool("Post").withIds([]int64{post1ID}).Call("Write", FieldMap{"Tags": X2ManyCommands{
+					{Type: CommandCreate, Values: FieldMap{"Name": "X2Many Tag"}},
+				}})
+			})
+			So(err, ShouldBeNil)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				posts := env.Pool("User").withIds([]int64{userID}).Get("Posts").(RecordCollection)
+				So(posts.Len(), ShouldEqual, 3)
+				So(env.Pool("Post").withIds([]int64{post1ID}).Get("Content"), ShouldEqual, "Updated")
+				So(env.Pool("Post").withIds([]int64{post2ID}).Get("Content"), ShouldEqual, "Updated")
+				tags := env.Pool("Post").withIds([]int64{post1ID}).Get("Tags").(RecordCollection)
+				So(tags.Len(), ShouldEqual, 1)
+				So(tags.Get("Name"), ShouldEqual, "X2Many Tag")
+			})
+		})
+		Convey("Conflicting commands should be reported and the transaction rolled back", func() {
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").withIds([]int64{userID}).Call("Write", FieldMap{"Posts": X2ManyCommands{
+					{Type: CommandUpdate, ID: post1ID, Values: FieldMap{"Content": "Updated"}},
+					{Type: CommandUpdate, ID: post2ID, Values: FieldMap{"Content": "Updated"},
+						LastUpdate: types.DateTime(time.Time(lastUpdate).Add(-time.Hour))},
+				}})
+			})
+			So(err, ShouldResemble, X2ManyConflictError{Conflicts: []X2ManyConflict{{
+				Model:   "User",
+				Field:   "Posts",
+				ID:      post2ID,
+				Command: CommandUpdate,
+				Reason:  "record has been modified by another user",
+			}}})
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.Pool("Post").withIds([]int64{post1ID}).Get("Content"), ShouldBeEmpty)
+				So(env.Pool("Post").withIds([]int64{post2ID}).Get("Content"), ShouldBeEmpty)
+			})
+		})
+		Convey("Modifications within the same second should be detected", func() {
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").withIds([]int64{userID}).Call("Write", FieldMap{"Posts": X2ManyCommands{
+					{Type: CommandUpdate, ID: post2ID, Values: FieldMap{"Content": "Updated"},
+						LastUpdate: types.DateTime(time.Time(lastUpdate).Add(-time.Millisecond))},
+				}})
+			})
+			So(err, ShouldHaveSameTypeAs, X2ManyConflictError{})
+		})
+		Convey("Set command should keep the given lines and detach the others", func() {
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").withIds([]int64{userID}).Call("Write", FieldMap{"Posts": X2ManyCommands{
+					{Type: CommandSet, IDs: []int64{post2ID}},
+				}})
+			})
+			So(err, ShouldBeNil)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				posts := env.Pool("User").withIds([]int64{userID}).Get("Posts").(RecordCollection)
+				So(posts.Ids(), ShouldResemble, []int64{post2ID})
+				post1 := env.Pool("Post").withIds([]int64{post1ID})
+				So(post1.Len(), ShouldEqual, 1)
+				So(post1.Get("User").(RecordCollection).IsEmpty(), ShouldBeTrue)
+			})
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Post").withIds([]int64{post1ID}).Call("Unlink")
+			})
+		})
+		ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("User").withIds([]int64{userID}).Get("Posts").(RecordCollection)
+			for _, post := range posts.Records() {
+				post.Get("Tags").(RecordCollection).Call("Unlink")
+			}
+			posts.Call("Unlink")
+			env.Pool("User").withIds([]int64{userID}).Call("Unlink")
+		})
+	})
+}
@@ -114,6 +114,20 @@ func TestDataLoading(t *testing.T) {
 				So(nickPost.Get("Content"), ShouldEqual, "No content")
 				So(nickPost.Get("Tags").(RecordCollection).Len(), ShouldEqual, 3)
 			})
+			Convey("Checking default values from data files", func() {
+				LoadCSVDataFile("testdata/Tag_defaults.csv")
+				tagObj := env.Pool("Tag")
+				tag := tagObj.Call("Create", FieldMap{"Name": "Defaults Tag"}).(RecordCollection)
+				So(tag.Get("Theme"), ShouldEqual, "light")
+				So(tag.Get("Caption"), ShouldEqual, "Theme: light")
+				So(tag.Get("Description"), ShouldEqual, "Default description")
+				ctxTag := tagObj.WithContext("default_theme", "blue").Call("Create", FieldMap{"Name": "Context Tag"}).(RecordCollection)
+				So(ctxTag.Get("Theme"), ShouldEqual, "blue")
+				So(ctxTag.Get("Description"), ShouldEqual, "Default description")
+				env.cr.Execute(`DELETE FROM field_default`)
+				noDefTag := tagObj.Call("Create", FieldMap{"Name": "No Defaults Tag"}).(RecordCollection)
+				So(noDefTag.Get("Theme"), ShouldEqual, "dark")
+			})
 		})
 	})
 }
@@ -0,0 +1,96 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/npiganeau/yep/yep/tools/taxid"
+)
+
+// InvalidTaxIDPolicy defines what happens when the value of a tax id
+// field fails its country checksum or is not confirmed by the TaxIDVerifier.
+type InvalidTaxIDPolicy int8
+
+const (
+	// InvalidTaxIDsReject rejects invalid tax ids with a ValidationError.
+	InvalidTaxIDsReject InvalidTaxIDPolicy = iota
+	// InvalidTaxIDsWarn stores invalid tax ids and logs a warning.
+	InvalidTaxIDsWarn
+)
+
+var (
+	// TaxIDVerifier verifies online the values of tax id fields, e.g. with
+	// VIES. Tax ids are only checked with their country checksum if it is nil.
+	TaxIDVerifier taxid.Verifier
+	// InvalidTaxIDs is the policy applied to invalid tax ids.
+	InvalidTaxIDs = InvalidTaxIDsReject
+)
+
+// AddTaxIDField adds a tax id field with the given name to this Model.
+// Tax id fields are char fields whose values are normalized and validated
+// with the checksum of their country, given by their prefix, and with the
+// TaxIDVerifier if set.
+func (m *Model) AddTaxIDField(name string, params StringFieldParams) *Field {
+	if params.Size == 0 {
+		params.Size = 32
+	}
+	fi := m.AddCharField(name, params)
+	fi.taxID = true
+	return fi
+}
+
+// checkTaxIDValues normalizes the values of the tax id fields of the given
+// FieldMap and checks them. Empty values are always accepted since they mean
+// that the field is unset. It panics with a ValidationError if a value is
+// invalid and InvalidTaxIDs is InvalidTaxIDsReject.
+func (m *Model) checkTaxIDValues(fMap FieldMap) {
+	for colName, value := range fMap {
+		fi := m.getRelatedFieldInfo(colName)
+		if !fi.taxID {
+			continue
+		}
+		val, ok := value.(string)
+		if !ok || val == "" {
+			continue
+		}
+		val = taxid.Normalize(val)
+		fMap[colName] = val
+		err := taxid.Validate(val)
+		if err == nil && TaxIDVerifier != nil {
+			err = verifyTaxID(val)
+		}
+		if err == nil {
+			continue
+		}
+		if InvalidTaxIDs == InvalidTaxIDsWarn {
+			log.Warn("Invalid tax id stored", "model", m.name, "field", fi.name, "value", val, "error", err)
+			continue
+		}
+		log.Debug("Invalid value for tax id field", "model", m.name, "field", fi.name, "value", val, "error", err)
+		panic(ValidationError{
+			Model:   m.name,
+			Field:   fi.name,
+			Value:   val,
+			Message: fmt.Sprintf("The value '%s' is not a valid tax id for field '%s'", val, fi.description),
+		})
+	}
+}
+
+// verifyTaxID checks the given tax id with the TaxIDVerifier. Tax ids that
+// cannot be verified, because the verifier does not support their country
+// or is unavailable, are accepted.
+func verifyTaxID(val string) error {
+	valid, err := TaxIDVerifier.Verify(val)
+	switch {
+	case err == taxid.ErrUnsupportedCountry:
+		return nil
+	case err != nil:
+		log.Warn("Unable to verify tax id", "value", val, "error", err)
+		return nil
+	case !valid:
+		return fmt.Errorf("tax id '%s' is not registered", val)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// tzContextKey is the context key holding the time zone of the user,
+// as an IANA time zone name, e.g. "Europe/Paris"
+const tzContextKey = "tz"
+
+// unknownTimeZone is the time zone of the cursors whose session time
+// zone may have been reverted by a rollback to a savepoint.
+const unknownTimeZone = "?"
+
+// dateTimeLayouts are the layouts of the datetime strings accepted when
+// writing datetime fields. Strings without offset are in the time zone
+// of the user.
+var dateTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", time.RFC3339}
+
+// locations caches the time zones loaded by name
+var locations = struct {
+	sync.RWMutex
+	locs map[string]*time.Location
+}{
+	locs: make(map[string]*time.Location),
+}
+
+// loadLocation returns the time zone with the given IANA name
+func loadLocation(name string) (*time.Location, error) {
+	locations.RLock()
+	loc, ok := locations.locs[name]
+	locations.RUnlock()
+	if ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Lock()
+	defer locations.Unlock()
+	locations.locs[name] = loc
+	return loc, nil
+}
+
+// timeZoneName returns the time zone name given by the tz key of the context of
+// this Environment, or an empty string if it is not set or if it is unknown.
+func (env Environment) timeZoneName() string {
+	if env.context == nil {
+		return ""
+	}
+	name := env.context.GetString(tzContextKey, "")
+	if name == "" {
+		return ""
+	}
+	if _, err := loadLocation(name); err != nil {
+		log.Warn("Unknown time zone in context", "tz", name, "error", err)
+		return ""
+	}
+	return name
+}
+
+// Location returns the time zone of the user of this Environment, as given
+// by the tz key of its context. It returns the local time zone of the server
+// if the context has no valid time zone.
+func (env Environment) Location() *time.Location {
+	name := env.timeZoneName()
+	if name == "" {
+		return time.Local
+	}
+	loc, _ := loadLocation(name)
+	return loc
+}
+
+// Today returns the current date in the time zone of the user of this Environment
+func (env Environment) Today() types.Date {
+	return types.Date(time.Now().In(env.Location()))
+}
+
+// syncTimeZone sets the time zone of the database session of the
+// cursor of this Environment to the time zone of its context.
+func (env Environment) syncTimeZone() {
+	env.cr.setTimeZone(env.timeZoneName())
+}
+
+// setTimeZone sets the time zone of the database session of this cursor
+// until the end of its transaction. An empty name resets it to the default
+// time zone of the database. Nothing is done if the session is already in
+// the given time zone or if the database does not support it.
+func (c *Cursor) setTimeZone(name string) {
+	if c.timeZone == name {
+		return
+	}
+	if query := adapters[db.DriverName()].setTimeZone(name); query != "" {
+		c.Execute(query)
+	}
+	c.timeZone = name
+}
+
+// localizeDateTime returns the given datetime in the time zone of the user of rc.
+func (rc RecordCollection) localizeDateTime(value types.DateTime) types.DateTime {
+	if value.IsNull() {
+		return value
+	}
+	return types.DateTime(time.Time(value).In(rc.env.Location()))
+}
+
+// parseDateValues converts the string values of the date and datetime fields
+// of the given FieldMap, as sent by clients, to Date and DateTime values.
+// Datetime strings without offset are read in the time zone of the user of rc.
+// It panics with a ValidationError if a value cannot be parsed.
+func (rc RecordCollection) parseDateValues(fMap FieldMap) {
+	for colName, value := range fMap {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		fi := rc.model.getRelatedFieldInfo(colName)
+		if fi.fieldType != fieldtype.Date && fi.fieldType != fieldtype.DateTime {
+			continue
+		}
+		if str == "" {
+			fMap[colName] = nil
+			continue
+		}
+		var (
+			t   time.Time
+			err error
+		)
+		if fi.fieldType == fieldtype.Date {
+			t, err = time.Parse("2006-01-02", str)
+			fMap[colName] = types.Date(t)
+		} else {
+			t, err = parseDateTime(str, rc.env.Location())
+			fMap[colName] = types.DateTime(t)
+		}
+		if err != nil {
+			panic(ValidationError{
+				Model:   rc.model.name,
+				Field:   fi.name,
+				Value:   str,
+				Message: fmt.Sprintf("The value of field '%s' is not a valid date: %s", fi.description, str),
+			})
+		}
+	}
+}
+
+// parseDateTime parses the given datetime string with one of the
+// dateTimeLayouts. Strings without offset are read in the given location.
+func parseDateTime(str string, loc *time.Location) (time.Time, error) {
+	str = strings.TrimSpace(str)
+	var err error
+	for _, layout := range dateTimeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, str, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,285 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/i18n"
+)
+
+// langContextKey is the context key holding the language of the user
+const langContextKey = "lang"
+
+// SourceLanguage is the language of the values of translatable fields as
+// stored in the models' tables. Values in other languages are stored in the
+// Translation system model.
+var SourceLanguage = "en_US"
+
+// translationHeaders are the columns of translation CSV files
+var translationHeaders = []string{"model", "field", "res_id", "source", "value"}
+
+// A translationLine is the translation of a value as stored in the database
+type translationLine struct {
+	Value string
+}
+
+// A TranslationTerm is the value of a translatable field of a record in the
+// SourceLanguage and its translation in another language. Value is empty if
+// the term has not been translated yet.
+type TranslationTerm struct {
+	Model  string
+	Field  string
+	ResID  int64
+	Source string
+	Value  string
+}
+
+// declareTranslationModel creates the system model in which the
+// translations of the values of translatable fields are stored.
+func declareTranslationModel() {
+	translation := createModel("Translation", SystemModel)
+	translation.AddCharField("ResModel", StringFieldParams{JSON: "res_model", Required: true, Index: true})
+	translation.AddIntegerField("ResID", SimpleFieldParams{JSON: "res_id", Required: true, Index: true})
+	translation.AddCharField("Field", StringFieldParams{JSON: "field", Required: true})
+	translation.AddCharField("Lang", StringFieldParams{JSON: "lang", Required: true, Index: true})
+	translation.AddTextField("Value", StringFieldParams{JSON: "value"})
+	translation.AddSQLConstraint("translation_uniq", "UNIQUE (res_model, res_id, field, lang)",
+		"There can be only one translation of a field of a record per language")
+	translation.InheritModel(Registry.MustGet("CommonMixin"))
+}
+
+// translationLang returns the language in which translatable fields are read
+// and written, as given by the lang key of the context. It returns an empty
+// string if values must be read and written in the models' tables.
+func (rc RecordCollection) translationLang() string {
+	if rc.env.context == nil {
+		return ""
+	}
+	lang := rc.env.context.GetString(langContextKey, "")
+	if lang == SourceLanguage {
+		return ""
+	}
+	return lang
+}
+
+// translate returns the translation of the given source message in the
+// language of the user of this Environment, or source itself if it has
+// not been translated.
+func (env Environment) translate(source string) string {
+	if env.context == nil || source == "" {
+		return source
+	}
+	return i18n.Registry.Translate(env.context.GetString(langContextKey, ""), source)
+}
+
+// getTranslation returns the value of the translatable field fi of this
+// singleton in the language of the context. It falls back to the value
+// stored in the model's table if there is no translation.
+func (rc RecordCollection) getTranslation(fi *Field) interface{} {
+	var lines []translationLine
+	query := `SELECT value FROM translation WHERE res_model = ? AND res_id = ? AND field = ? AND lang = ?`
+	rc.env.Cr().Select(&lines, query, rc.model.name, rc.ids[0], fi.json, rc.translationLang())
+	if len(lines) == 0 || lines[0].Value == "" {
+		return rc.get(fi.json, true)
+	}
+	return lines[0].Value
+}
+
+// updateTranslations writes the values of the translatable fields of the given
+// FieldMap as translations in the language of the context for all records of rc.
+// It returns the FieldMap without these fields, so that the values stored in the
+// models' tables are kept. fMap is returned as is if no language is set.
+func (rc RecordCollection) updateTranslations(fMap FieldMap) FieldMap {
+	lang := rc.translationLang()
+	if lang == "" || rc.IsEmpty() {
+		return fMap
+	}
+	res := make(FieldMap)
+	for fName, value := range fMap {
+		fi, ok := rc.model.fields.get(fName)
+		if !ok || !fi.translate {
+			res[fName] = value
+			continue
+		}
+		if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+			continue
+		}
+		rc.setTranslation(fi, lang, value)
+	}
+	return res
+}
+
+// setTranslation sets the translation of the field fi of the records
+// of rc in the given language to value. Translations are stored as text.
+func (rc RecordCollection) setTranslation(fi *Field, lang string, value interface{}) {
+	delQuery := `DELETE FROM translation WHERE res_model = ? AND field = ? AND lang = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(delQuery, rc.model.name, fi.json, lang, rc.ids)
+	insQuery := `INSERT INTO translation (res_model, res_id, field, lang, value) VALUES (?, ?, ?, ?, ?)`
+	for _, id := range rc.ids {
+		rc.env.Cr().Execute(insQuery, rc.model.name, id, fi.json, lang, fmt.Sprint(value))
+	}
+	for _, id := range rc.ids {
+		rc.env.cache.invalidateRecord(rc.model, id)
+	}
+}
+
+// deleteTranslations deletes the translations of the records of rc.
+// It must be called when the records are deleted.
+func (rc RecordCollection) deleteTranslations() {
+	if len(rc.model.fields.translatableFields()) == 0 || len(rc.ids) == 0 {
+		return
+	}
+	query := `DELETE FROM translation WHERE res_model = ? AND res_id IN (?)`
+	rc.env.Cr().Execute(query, rc.model.name, rc.ids)
+}
+
+// translatableFields returns the stored translatable fields of this collection
+func (fc *FieldsCollection) translatableFields() []*Field {
+	var res []*Field
+	for _, fi := range fc.registryByName {
+		if fi.translate && fi.isStored() {
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
+// ExportTranslations returns the terms of all the translatable fields of all
+// models with their translation in the given language. If missingOnly is true,
+// only the terms that have not been translated yet are returned.
+func ExportTranslations(env Environment, lang string, missingOnly bool) []TranslationTerm {
+	var modelNames []string
+	for name, mi := range Registry.registryByName {
+		if mi.isMixin() || mi.isManual() || mi.isSystem() {
+			continue
+		}
+		modelNames = append(modelNames, name)
+	}
+	sort.Strings(modelNames)
+	var res []TranslationTerm
+	for _, modelName := range modelNames {
+		mi := Registry.MustGet(modelName)
+		fields := mi.fields.translatableFields()
+		sort.Sort(fieldsByName(fields))
+		for _, fi := range fields {
+			res = append(res, exportFieldTranslations(env, fi, lang, missingOnly)...)
+		}
+	}
+	return res
+}
+
+// exportFieldTranslations returns the terms of the given translatable
+// field with their translation in the given language.
+func exportFieldTranslations(env Environment, fi *Field, lang string, missingOnly bool) []TranslationTerm {
+	var terms []struct {
+		ResID  int64  `db:"res_id"`
+		Source string `db:"source"`
+		Value  string `db:"value"`
+	}
+	query := fmt.Sprintf(`SELECT t.id AS res_id, t.%[1]s AS source, COALESCE(tr.value, '') AS value
+		FROM %[2]s t LEFT JOIN translation tr
+			ON tr.res_model = ? AND tr.res_id = t.id AND tr.field = ? AND tr.lang = ?
+		WHERE t.%[1]s IS NOT NULL AND t.%[1]s != ''`, fi.json, adapters[db.DriverName()].quoteTableName(fi.model.tableName))
+	if missingOnly {
+		query += ` AND COALESCE(tr.value, '') = ''`
+	}
+	query += ` ORDER BY t.id`
+	env.Cr().Select(&terms, query, fi.model.name, fi.json, lang)
+	res := make([]TranslationTerm, len(terms))
+	for i, term := range terms {
+		res[i] = TranslationTerm{
+			Model:  fi.model.name,
+			Field:  fi.name,
+			ResID:  term.ResID,
+			Source: term.Source,
+			Value:  term.Value,
+		}
+	}
+	return res
+}
+
+// ImportTranslations sets the translations in the given language of the
+// given terms and returns the number of imported terms. Terms without
+// value are skipped. It panics if a term does not refer to a translatable
+// field.
+func ImportTranslations(env Environment, lang string, terms []TranslationTerm) int {
+	if lang == "" || lang == SourceLanguage {
+		log.Panic("Translations cannot be imported in the source language", "lang", lang)
+	}
+	var count int
+	for _, term := range terms {
+		if term.Value == "" {
+			continue
+		}
+		mi := Registry.MustGet(term.Model)
+		fi := mi.fields.MustGet(term.Field)
+		if !fi.translate {
+			log.Panic("Field is not translatable", "model", term.Model, "field", term.Field)
+		}
+		rc := newRecordCollection(env, term.Model).withIds([]int64{term.ResID})
+		rc.setTranslation(fi, lang, term.Value)
+		count++
+	}
+	return count
+}
+
+// WriteTranslationsCSV writes the given terms to w in CSV format
+// with a header line.
+func WriteTranslationsCSV(w io.Writer, terms []TranslationTerm) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(translationHeaders); err != nil {
+		return err
+	}
+	for _, term := range terms {
+		line := []string{term.Model, term.Field, strconv.FormatInt(term.ResID, 10), term.Source, term.Value}
+		if err := csvWriter.Write(line); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadTranslationsCSV reads terms in the CSV format written by
+// WriteTranslationsCSV from r.
+func ReadTranslationsCSV(r io.Reader) ([]TranslationTerm, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = len(translationHeaders)
+	lines, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var res []TranslationTerm
+	for i, line := range lines {
+		if i == 0 {
+			// header line
+			continue
+		}
+		resID, err := strconv.ParseInt(line[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record ID on line %d: %s", i+1, line[2])
+		}
+		res = append(res, TranslationTerm{
+			Model:  line[0],
+			Field:  line[1],
+			ResID:  resID,
+			Source: line[3],
+			Value:  line[4],
+		})
+	}
+	return res, nil
+}
+
+// fieldsByName sorts a slice of fields by name
+type fieldsByName []*Field
+
+func (f fieldsByName) Len() int           { return len(f) }
+func (f fieldsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fieldsByName) Less(i, j int) bool { return f[i].name < f[j].name }
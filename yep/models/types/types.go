@@ -16,7 +16,9 @@ package types
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -35,18 +37,66 @@ func (c Context) Copy() *Context {
 	return newCtx
 }
 
-// Get returns the value of this Context for the given key
+// Get returns the value of this Context for the given key.
+// It returns nil if the key is not set or if c is nil.
 func (c *Context) Get(key string) interface{} {
+	if c == nil {
+		return nil
+	}
 	value := c.values[key]
 	return value
 }
 
 // HasKey returns true if this Context has the given key
 func (c *Context) HasKey(key string) bool {
+	if c == nil {
+		return false
+	}
 	_, exists := c.values[key]
 	return exists
 }
 
+// GetString returns the value of this Context for the given key as a string
+// or defaultValue if the key is not set or is not a string.
+func (c *Context) GetString(key string, defaultValue string) string {
+	if value, ok := c.Get(key).(string); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// GetInt returns the value of this Context for the given key as an int64
+// or defaultValue if the key is not set or is not a number. Float values,
+// such as numbers decoded from JSON, are truncated.
+func (c *Context) GetInt(key string, defaultValue int64) int64 {
+	switch value := c.Get(key).(type) {
+	case int:
+		return int64(value)
+	case int8:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	case float32:
+		return int64(value)
+	case float64:
+		return int64(value)
+	}
+	return defaultValue
+}
+
+// GetBool returns the value of this Context for the given key as a bool
+// or defaultValue if the key is not set or is not a bool.
+func (c *Context) GetBool(key string, defaultValue bool) bool {
+	if value, ok := c.Get(key).(bool); ok {
+		return value
+	}
+	return defaultValue
+}
+
 // WithKey returns a copy of this context with the given key/value.
 // If key already exists, it is overwritten.
 func (c Context) WithKey(key string, value interface{}) *Context {
@@ -54,6 +104,18 @@ func (c Context) WithKey(key string, value interface{}) *Context {
 	return &c
 }
 
+// WithoutKeys returns a copy of this context without the keys
+// for which the given function returns true.
+func (c Context) WithoutKeys(remove func(key string) bool) *Context {
+	newCtx := NewContext()
+	for k, v := range c.values {
+		if !remove(k) {
+			newCtx.values[k] = v
+		}
+	}
+	return newCtx
+}
+
 // IsEmpty returns true if this Context has no entries.
 func (c Context) IsEmpty() bool {
 	if len(c.values) == 0 {
@@ -71,6 +133,12 @@ func (c Context) ToMap() map[string]interface{} {
 	return res
 }
 
+// MarshalJSON is the JSON marshalling method of Context.
+// It marshals the values of the Context as a JSON object.
+func (c Context) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.values)
+}
+
 // NewContext returns a new Context instance
 func NewContext(data ...map[string]interface{}) *Context {
 	var values map[string]interface{}
@@ -154,15 +222,132 @@ func (d DateTime) MarshalJSON() ([]byte, error) {
 	return []byte(dateStr), nil
 }
 
-// Value formats our DateTime for storing in database
+// Value formats our DateTime in UTC for storing in database
 // Especially handles empty DateTime.
 func (d DateTime) Value() (driver.Value, error) {
 	if d.IsNull() {
 		return driver.Value("0001-01-01 00:00:00"), nil
 	}
-	return driver.Value(time.Time(d).Format("2006-01-02 15:04:05")), nil
+	return driver.Value(time.Time(d).UTC().Format("2006-01-02 15:04:05")), nil
+}
+
+// A DateUnit is a period to which dates and datetimes are truncated
+type DateUnit string
+
+// Date units
+const (
+	Day   DateUnit = "day"
+	Week  DateUnit = "week"
+	Month DateUnit = "month"
+	// Quarter is a period of three months beginning in January, April, July or October
+	Quarter DateUnit = "quarter"
+	Year    DateUnit = "year"
+)
+
+// startOf returns the beginning of the period of the given unit containing t,
+// in the location of t. Weeks begin on Monday.
+func startOf(t time.Time, unit DateUnit) time.Time {
+	year, month, day := t.Date()
+	switch unit {
+	case Day:
+	case Week:
+		day -= (int(t.Weekday()) + 6) % 7
+	case Month:
+		day = 1
+	case Quarter:
+		month, day = month-(month-1)%3, 1
+	case Year:
+		month, day = time.January, 1
+	default:
+		panic(fmt.Sprintf("unknown date unit '%s'", unit))
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// StartOf returns the first day of the period of the given unit containing this Date.
+// It panics if the unit is unknown.
+func (d Date) StartOf(unit DateUnit) Date {
+	return Date(startOf(time.Time(d), unit))
+}
+
+// Format returns this Date formatted with the given Go time layout,
+// or an empty string if it is null.
+func (d Date) Format(layout string) string {
+	if d.IsNull() {
+		return ""
+	}
+	return time.Time(d).Format(layout)
+}
+
+// StartOf returns the beginning of the period of the given unit containing
+// this DateTime, in its location. It panics if the unit is unknown.
+func (d DateTime) StartOf(unit DateUnit) DateTime {
+	return DateTime(startOf(time.Time(d), unit))
+}
+
+// In returns this DateTime in the given location
+func (d DateTime) In(loc *time.Location) DateTime {
+	return DateTime(time.Time(d).In(loc))
+}
+
+// ToDate returns the date of this DateTime in its location
+func (d DateTime) ToDate() Date {
+	return Date(startOf(time.Time(d), Day))
+}
+
+// Format returns this DateTime formatted with the given Go time layout
+// in its location, or an empty string if it is null.
+func (d DateTime) Format(layout string) string {
+	if d.IsNull() {
+		return ""
+	}
+	return time.Time(d).Format(layout)
 }
 
 // A Selection is a set of possible (key, label) values for a model
 // "selection" field.
 type Selection map[string]string
+
+// Options returns the options of this Selection sorted by value.
+func (s Selection) Options() SelectionOptions {
+	values := make([]string, 0, len(s))
+	for value := range s {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	res := make(SelectionOptions, len(values))
+	for i, value := range values {
+		res[i] = SelectionOption{Value: value, Label: s[value]}
+	}
+	return res
+}
+
+// A SelectionOption is a possible value of a model "selection" field.
+// Group is the optional name of the group of options it belongs to.
+type SelectionOption struct {
+	Value string
+	Label string
+	Group string
+}
+
+// MarshalJSON for SelectionOption type. Options are marshalled as a
+// [value, label] array, or [value, label, group] if it belongs to a group.
+func (so SelectionOption) MarshalJSON() ([]byte, error) {
+	if so.Group == "" {
+		return json.Marshal([]string{so.Value, so.Label})
+	}
+	return json.Marshal([]string{so.Value, so.Label, so.Group})
+}
+
+// SelectionOptions is an ordered list of SelectionOption. Consecutive options
+// with the same Group are displayed together and separated from the others.
+type SelectionOptions []SelectionOption
+
+// Selection returns the Selection with the values and labels of these options
+func (so SelectionOptions) Selection() Selection {
+	res := make(Selection, len(so))
+	for _, opt := range so {
+		res[opt.Value] = opt.Label
+	}
+	return res
+}
@@ -15,11 +15,16 @@
 package models
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/types"
 )
 
 var (
@@ -27,6 +32,31 @@ var (
 	Testing bool
 )
 
+// maxIdentifierLength is the maximum length of table, index and constraint
+// names in the database. Longer names are silently truncated by PostgreSQL.
+const maxIdentifierLength = 63
+
+// dbIdentifier returns name if it fits in maxIdentifierLength. Otherwise,
+// it returns a deterministic shortened name made of the beginning of name
+// and of a hash of the full name, so that two long names sharing the same
+// prefix do not collide.
+func dbIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(name)))[:8]
+	return fmt.Sprintf("%s_%s", name[:maxIdentifierLength-len(hash)-1], hash)
+}
+
+// legacyDBIdentifier returns name as it has been truncated by the database
+// if it has been created without dbIdentifier.
+func legacyDBIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	return name[:maxIdentifierLength]
+}
+
 /*
 checkStructPtr checks that the given data is a struct ptr valid for receiving data from
 the database through the RecordSet API. That is:
@@ -110,10 +140,8 @@ func inflate2ManyConditions(mi *Model, cond *Condition) {
 		path := strings.Join(cv.exprs, ExprSep)
 		fi := mi.getRelatedFieldInfo(path)
 		switch fi.fieldType {
-		case fieldtype.One2Many:
+		case fieldtype.One2Many, fieldtype.Many2Many, fieldtype.Rev2One:
 			cond.predicates[i].exprs = append(cv.exprs, "id")
-		case fieldtype.Many2Many:
-		case fieldtype.Rev2One:
 		}
 	}
 }
@@ -122,6 +150,9 @@ func inflate2ManyConditions(mi *Model, cond *Condition) {
 // on the name of the related records if they point to a relation field.
 func addNameSearchesToCondition(mi *Model, cond *Condition) {
 	for i, p := range cond.predicates {
+		if p.cond != nil {
+			addNameSearchesToCondition(mi, p.cond)
+		}
 		if len(p.exprs) == 0 {
 			continue
 		}
@@ -135,18 +166,14 @@ func addNameSearchesToCondition(mi *Model, cond *Condition) {
 		case string:
 			cond.predicates[i].exprs = addNameSearchToExprs(mi, fi, p.exprs)
 		}
-		if p.cond != nil {
-			addNameSearchesToCondition(mi, p.cond)
-		}
 	}
 }
 
 // addNameSearchToExprs modifies the given exprs to search on the name of the related record
 // if it points to a relation field.
 func addNameSearchToExprs(mi *Model, fi *Field, exprs []string) []string {
-	_, exists := fi.relatedModel.fields.get("name")
-	if exists {
-		exprs = append(exprs, "name")
+	if recNameFI, exists := fi.relatedModel.recNameField(); exists {
+		exprs = append(exprs, recNameFI.json)
 	}
 	return exprs
 }
@@ -305,58 +332,51 @@ func ConvertToFieldNameSlice(fields []string) []FieldNamer {
 	return res
 }
 
-// getGroupCondition returns the condition to retrieve the individual aggregated rows in vals
-// knowing that they were grouped by groups
-func getGroupCondition(groups []string, vals map[string]interface{}) *Condition {
-	res := newCondition()
-	for _, group := range groups {
-		res = res.And().Field(group).Equals(vals[group])
-	}
-	return res
-}
-
 // serializePredicates returns a list that mimics Odoo domains from the given
 // condition values.
+//
+// As in SQL, AND has precedence over OR, so that predicates are first split
+// into groups of AND predicates, which are then joined with OR operators.
 func serializePredicates(predicates []predicate) []interface{} {
+	var groups [][]predicate
+	for _, p := range predicates {
+		if p.isCond && (p.cond == nil || p.cond.IsEmpty()) {
+			continue
+		}
+		if len(groups) == 0 || p.isOr {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], p)
+	}
 	var res []interface{}
-	i := 0
-	for i < len(predicates) {
-		if predicates[i].isOr {
-			subRes := []interface{}{"|"}
-			subRes = appendPredicateToSerial(subRes, predicates[i])
-			subRes, i = consumeAndPredicates(i+1, predicates, subRes)
-			res = append(subRes, res...)
-		} else {
-			res, i = consumeAndPredicates(i, predicates, res)
+	for i := len(groups) - 1; i >= 0; i-- {
+		if i > 0 {
+			res = append(res, "|")
 		}
 	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		res = serializeAndPredicates(groups[i], res)
+	}
 	return res
 }
 
-// consumeAndPredicates appends res with all successive AND predicates
-// starting from position i and returns the next position as second argument.
-func consumeAndPredicates(i int, predicates []predicate, res []interface{}) ([]interface{}, int) {
-	if i >= len(predicates) || predicates[i].isOr {
-		return res, i
-	}
-	j := i
-	for j < len(predicates)-1 {
-		if predicates[j+1].isOr {
-			break
+// serializeAndPredicates appends to res the given predicates joined by AND operators
+func serializeAndPredicates(predicates []predicate, res []interface{}) []interface{} {
+	for k, p := range predicates {
+		if k < len(predicates)-1 {
+			res = append(res, "&")
 		}
-		j++
-	}
-	for k := i; k < j; k++ {
-		res = append(res, "&")
-		res = appendPredicateToSerial(res, predicates[k])
+		res = appendPredicateToSerial(res, p)
 	}
-	res = appendPredicateToSerial(res, predicates[j])
-	return res, j + 1
+	return res
 }
 
 // appendPredicateToSerial appends the given predicate to the given serialized
 // predicate list and returns the result.
 func appendPredicateToSerial(res []interface{}, predicate predicate) []interface{} {
+	if predicate.isNot {
+		res = append(res, "!")
+	}
 	if predicate.isCond {
 		res = append(res, serializePredicates(predicate.cond.predicates)...)
 	} else {
@@ -364,3 +384,54 @@ func appendPredicateToSerial(res []interface{}, predicate predicate) []interface
 	}
 	return res
 }
+
+// encodeFieldValue returns the given field value serialized as JSON
+// to be stored in a text column, e.g. for the audit trail. Datetimes
+// are serialized in UTC.
+func encodeFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case RecordSet:
+		var id int64
+		if ids := v.Ids(); len(ids) > 0 {
+			id = ids[0]
+		}
+		value = id
+	case types.DateTime:
+		value = types.DateTime(time.Time(v).UTC())
+	}
+	res, err := json.Marshal(value)
+	if err != nil {
+		log.Panic("Unable to serialize field value", "value", value, "error", err)
+	}
+	return string(res)
+}
+
+// decodeFieldValue returns the value of field fi that has been
+// serialized as data with encodeFieldValue.
+func (m *Model) decodeFieldValue(fi *Field, data string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		log.Panic("Unable to read serialized field value", "model", m.name, "field", fi.name, "error", err)
+	}
+	if value == false {
+		return reflect.Zero(fi.structField.Type).Interface()
+	}
+	switch fi.fieldType {
+	case fieldtype.Date, fieldtype.DateTime:
+		layout := "2006-01-02 15:04:05"
+		if fi.fieldType == fieldtype.Date {
+			layout = "2006-01-02"
+		}
+		t, err := time.Parse(layout, value.(string))
+		if err != nil {
+			log.Panic("Unable to read serialized date", "model", m.name, "field", fi.name, "error", err)
+		}
+		if fi.fieldType == fieldtype.Date {
+			return types.Date(t)
+		}
+		return types.DateTime(t)
+	}
+	fMap := FieldMap{fi.json: value}
+	m.convertValuesToFieldType(&fMap)
+	return fMap[fi.json]
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+// Context keys set by the client when opening an action from records
+const (
+	activeIDContextKey    = "active_id"
+	activeIDsContextKey   = "active_ids"
+	activeModelContextKey = "active_model"
+)
+
+// ActiveRecords returns the records on which the current action has been
+// launched, as given by the active_model and active_ids (or active_id) keys
+// of the context. It is typically called by transient models methods to get
+// the records a wizard has been opened on.
+//
+// It panics if there is no active_model in the context.
+func (rc RecordCollection) ActiveRecords() RecordCollection {
+	modelName, _ := rc.contextValue(activeModelContextKey).(string)
+	if modelName == "" {
+		log.Panic("No active model in context", "model", rc.ModelName(), "context", rc.env.context)
+	}
+	return rc.ActiveRecordsOf(modelName)
+}
+
+// ActiveRecordsOf returns the records of the model with the given name on which
+// the current action has been launched. The returned RecordCollection is empty
+// if there are no active records in the context.
+//
+// It panics if the active_model of the context is set to another model.
+func (rc RecordCollection) ActiveRecordsOf(modelName string) RecordCollection {
+	activeModel, _ := rc.contextValue(activeModelContextKey).(string)
+	if activeModel != "" && activeModel != modelName {
+		log.Panic("Active records are not of the requested model", "model", modelName, "activeModel", activeModel)
+	}
+	ids := convertToIds(rc.contextValue(activeIDsContextKey))
+	if len(ids) == 0 {
+		ids = convertToIds(rc.contextValue(activeIDContextKey))
+	}
+	return rc.env.Pool(modelName).withIds(ids)
+}
+
+// contextValue returns the value of the given key in this RecordCollection's
+// context or nil if it is not set.
+func (rc RecordCollection) contextValue(key string) interface{} {
+	if rc.env.context == nil || !rc.env.context.HasKey(key) {
+		return nil
+	}
+	return rc.env.context.Get(key)
+}
+
+// convertToIds returns the ids given as value, which can be a single
+// id or a slice of ids, as integers or as float64 when decoded from JSON.
+func convertToIds(value interface{}) []int64 {
+	switch val := value.(type) {
+	case int64:
+		return []int64{val}
+	case int:
+		return []int64{int64(val)}
+	case float64:
+		return []int64{int64(val)}
+	case []int64:
+		return val
+	case []interface{}:
+		var res []int64
+		for _, v := range val {
+			res = append(res, convertToIds(v)...)
+		}
+		return res
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// An X2ManyCommandType defines the action of an X2ManyCommand
+type X2ManyCommandType int8
+
+const (
+	// CommandCreate creates a new related record with Values and links it
+	CommandCreate X2ManyCommandType = iota
+	// CommandUpdate updates the related record ID with Values
+	CommandUpdate
+	// CommandDelete deletes the related record ID from the database
+	CommandDelete
+	// CommandUnlink removes the relation to record ID without deleting it
+	CommandUnlink
+	// CommandLink adds a relation to the existing record ID
+	CommandLink
+	// CommandClear removes all relations
+	CommandClear
+	// CommandSet replaces all relations with the records IDs
+	CommandSet
+)
+
+// An X2ManyCommand is a single modification of a one2many or many2many field.
+//
+// LastUpdate is the last update date of the related record as known by the
+// client when it issued the command. If set, CommandUpdate and CommandDelete
+// commands check that the record has not been modified since.
+type X2ManyCommand struct {
+	Type       X2ManyCommandType
+	ID         int64
+	IDs        []int64
+	Values     FieldMap
+	LastUpdate types.DateTime
+}
+
+// X2ManyCommands is a list of X2ManyCommand that can be given as value of
+// a one2many or many2many field to Create or Write. Commands are applied
+// one by one on the current state of the database, so that non conflicting
+// commands issued by concurrent users on different lines are merged.
+type X2ManyCommands []X2ManyCommand
+
+// An X2ManyConflict describes a command that could not be applied
+// because the related record has been modified concurrently.
+type X2ManyConflict struct {
+	Model   string
+	Field   string
+	ID      int64
+	Command X2ManyCommandType
+	Reason  string
+}
+
+// An X2ManyConflictError is returned by ExecuteInNewEnvironment when some
+// x2many commands could not be applied. It holds the list of conflicts per
+// line, and the whole transaction is rolled back.
+type X2ManyConflictError struct {
+	Conflicts []X2ManyConflict
+}
+
+// Error returns the error message of this X2ManyConflictError
+func (e X2ManyConflictError) Error() string {
+	msgs := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		msgs[i] = fmt.Sprintf("%s.%s (id %d): %s", c.Model, c.Field, c.ID, c.Reason)
+	}
+	return fmt.Sprintf("Conflicting modifications: %s", strings.Join(msgs, ", "))
+}
+
+// extractX2ManyCommands removes the X2ManyCommands values from the given FieldMap
+// and returns them in a map whose keys are the field names.
+func extractX2ManyCommands(mi *Model, fMap *FieldMap) map[string]X2ManyCommands {
+	res := make(map[string]X2ManyCommands)
+	for fName, value := range *fMap {
+		cmds, ok := value.(X2ManyCommands)
+		if !ok {
+			continue
+		}
+		fi := mi.fields.MustGet(fName)
+		if !fi.fieldType.Is2ManyRelationType() {
+			log.Panic("X2ManyCommands can only be given to one2many or many2many fields", "model", mi.name,
+				"field", fName)
+		}
+		res[fi.name] = cmds
+		delete(*fMap, fName)
+	}
+	return res
+}
+
+// applyX2ManyCommands applies the given commands on each record of rc.
+// If some commands conflict with concurrent modifications, it panics with
+// an X2ManyConflictError listing all the conflicts, so that the transaction
+// is rolled back.
+func (rc RecordCollection) applyX2ManyCommands(commands map[string]X2ManyCommands) {
+	var conflicts []X2ManyConflict
+	for fName, cmds := range commands {
+		fi := rc.model.fields.MustGet(fName)
+		if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+			continue
+		}
+		for _, rec := range rc.Records() {
+			for _, cmd := range cmds {
+				if reason := rec.applyX2ManyCommand(fi, cmd); reason != "" {
+					conflicts = append(conflicts, X2ManyConflict{
+						Model:   rc.model.name,
+						Field:   fi.name,
+						ID:      cmd.ID,
+						Command: cmd.Type,
+						Reason:  reason,
+					})
+				}
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		panic(X2ManyConflictError{Conflicts: conflicts})
+	}
+}
+
+// applyX2ManyCommand applies the given command on the given field of this singleton.
+// It returns the reason of the conflict if the command cannot be applied,
+// or an empty string otherwise.
+func (rc RecordCollection) applyX2ManyCommand(fi *Field, cmd X2ManyCommand) string {
+	relRC := rc.env.subOperationEnv().Pool(fi.relatedModel.name)
+	var line RecordCollection
+	if cmd.ID != 0 {
+		line = relRC.Search(relRC.Model().Field("ID").Equals(cmd.ID)).Fetch()
+	}
+	switch cmd.Type {
+	case CommandCreate:
+		vals := make(FieldMap)
+		for k, v := range cmd.Values {
+			vals[k] = v
+		}
+		if fi.fieldType == fieldtype.One2Many {
+			vals[fi.reverseFK] = rc.ids[0]
+		}
+		newLine := relRC.Call("Create", vals).(RecordSet)
+		if fi.fieldType == fieldtype.Many2Many {
+			rc.linkM2MRecords(fi, newLine.Ids())
+		}
+	case CommandUpdate:
+		if line.IsEmpty() {
+			return "record has been deleted"
+		}
+		if reason := rc.checkX2ManyLine(fi, line, cmd); reason != "" {
+			return reason
+		}
+		line.Call("Write", cmd.Values)
+	case CommandDelete:
+		if line.IsEmpty() {
+			// Already deleted, nothing to do
+			return ""
+		}
+		if reason := rc.checkX2ManyLine(fi, line, cmd); reason != "" {
+			return reason
+		}
+		line.Call("Unlink")
+	case CommandUnlink:
+		if line.IsEmpty() {
+			return ""
+		}
+		if fi.fieldType == fieldtype.One2Many {
+			if !rc.lineBelongsToRecord(fi, line) {
+				return ""
+			}
+			rc.removeO2MLines(fi, line)
+			return ""
+		}
+		rc.unlinkM2MRecords(fi, []int64{cmd.ID})
+	case CommandLink:
+		if line.IsEmpty() {
+			return "record has been deleted"
+		}
+		if fi.fieldType == fieldtype.One2Many {
+			line.Call("Write", FieldMap{fi.reverseFK: rc.ids[0]})
+			return ""
+		}
+		rc.unlinkM2MRecords(fi, []int64{cmd.ID})
+		rc.linkM2MRecords(fi, []int64{cmd.ID})
+	case CommandClear, CommandSet:
+		if fi.fieldType == fieldtype.One2Many {
+			lines := rc.Get(fi.name).(RecordCollection)
+			if cmd.Type == CommandSet {
+				lines = lines.Subtract(relRC.withIds(cmd.IDs))
+			}
+			rc.removeO2MLines(fi, lines)
+			if cmd.Type == CommandSet && len(cmd.IDs) > 0 {
+				relRC.withIds(cmd.IDs).Call("Write", FieldMap{fi.reverseFK: rc.ids[0]})
+			}
+			return ""
+		}
+		delQuery := fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`,
+			adapters[db.DriverName()].quoteTableName(fi.m2mRelModel.tableName), fi.m2mOurField.json)
+		rc.env.Cr().Execute(delQuery, rc.ids[0])
+		if cmd.Type == CommandSet {
+			rc.linkM2MRecords(fi, cmd.IDs)
+		}
+	default:
+		log.Panic("Unknown x2many command", "model", rc.ModelName(), "field", fi.name, "command", cmd.Type)
+	}
+	return ""
+}
+
+// checkX2ManyLine checks that the given line of the x2many field fi can be modified
+// by the given command. It returns the reason of the conflict or an empty string.
+func (rc RecordCollection) checkX2ManyLine(fi *Field, line RecordCollection, cmd X2ManyCommand) string {
+	if fi.fieldType == fieldtype.One2Many && !rc.lineBelongsToRecord(fi, line) {
+		return "record has been moved to another parent"
+	}
+	if cmd.LastUpdate.IsNull() {
+		return ""
+	}
+	if _, exists := line.model.fields.get("LastUpdate"); !exists {
+		return ""
+	}
+	// Values are compared at the precision of the database timestamps, since
+	// values that have not been read back from the database are more precise.
+	lastUpdate := time.Time(line.Get("LastUpdate").(types.DateTime)).Round(time.Microsecond)
+	if lastUpdate.After(time.Time(cmd.LastUpdate).Round(time.Microsecond)) {
+		return "record has been modified by another user"
+	}
+	return ""
+}
+
+// removeO2MLines removes the given lines from the one2many field fi of this
+// singleton. Lines are deleted if their reverse foreign key is required, since
+// they cannot exist without parent, and detached from this record otherwise.
+func (rc RecordCollection) removeO2MLines(fi *Field, lines RecordCollection) {
+	if lines.IsEmpty() {
+		return
+	}
+	if fi.relatedModel.fields.MustGet(fi.reverseFK).required {
+		lines.Call("Unlink")
+		return
+	}
+	lines.Call("Write", FieldMap{fi.reverseFK: nil})
+}
+
+// lineBelongsToRecord returns true if the given line of the one2many field fi
+// is still related to this singleton.
+func (rc RecordCollection) lineBelongsToRecord(fi *Field, line RecordCollection) bool {
+	parent := line.Get(fi.reverseFK).(RecordCollection)
+	return !parent.IsEmpty() && parent.ids[0] == rc.ids[0]
+}
+
+// linkM2MRecords adds the given ids to the many2many field fi of this singleton.
+func (rc RecordCollection) linkM2MRecords(fi *Field, ids []int64) {
+	query := fmt.Sprintf(`INSERT INTO %s (%s, %s) VALUES (?, ?)`,
+		adapters[db.DriverName()].quoteTableName(fi.m2mRelModel.tableName), fi.m2mOurField.json, fi.m2mTheirField.json)
+	for _, relID := range ids {
+		rc.env.Cr().Execute(query, rc.ids[0], relID)
+	}
+}
+
+// unlinkM2MRecords removes the given ids from the many2many field fi of this singleton.
+func (rc RecordCollection) unlinkM2MRecords(fi *Field, ids []int64) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s = ? AND %s IN (?)`,
+		adapters[db.DriverName()].quoteTableName(fi.m2mRelModel.tableName), fi.m2mOurField.json, fi.m2mTheirField.json)
+	rc.env.Cr().Execute(query, rc.ids[0], ids)
+}
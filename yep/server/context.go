@@ -4,12 +4,16 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/npiganeau/yep/yep/models"
 	"github.com/npiganeau/yep/yep/tools"
+	"github.com/npiganeau/yep/yep/tools/i18n"
 )
 
 // The Context allows to pass data across controller layers
@@ -18,6 +22,13 @@ type Context struct {
 	*gin.Context
 }
 
+// GoContext returns the context.Context of the request, to which the
+// transactions opened for this request should be bound. It is canceled
+// when the client goes away and has the models.InteractiveRequest class.
+func (c *Context) GoContext() context.Context {
+	return models.WithRequestClass(c.Request.Context(), models.InteractiveRequest)
+}
+
 // RPC serializes the given struct as JSON-RPC into the response body.
 func (c *Context) RPC(code int, obj interface{}, err ...error) {
 	id, ok := c.Get("id")
@@ -30,16 +41,22 @@ func (c *Context) RPC(code int, obj interface{}, err ...error) {
 		id = req.ID
 	}
 	if len(err) > 0 && err[0] != nil {
+		data := JSONRPCErrorData{
+			Arguments: i18n.Registry.Translate(c.Lang(), "Internal Server Error"),
+			Debug:     err[0].Error(),
+		}
+		if _, ok := err[0].(models.ConcurrentUpdateError); ok {
+			// The client should offer the user to reload the records
+			data.ExceptionType = ConcurrentUpdateException
+			data.Arguments = err[0].Error()
+		}
 		respErr := ResponseError{
 			JsonRPC: "2.0",
 			ID:      id.(int64),
 			Error: JSONRPCError{
 				Code:    code,
-				Message: "YEP Server Error",
-				Data: JSONRPCErrorData{
-					Arguments: "Internal Server Error",
-					Debug:     err[0].Error(),
-				},
+				Message: i18n.Registry.Translate(c.Lang(), "YEP Server Error"),
+				Data:    data,
 			},
 		}
 		c.JSON(code, respErr)
@@ -67,6 +84,37 @@ func (c *Context) BindRPCParams(data interface{}) {
 	}
 }
 
+// ClientHeader is the HTTP header in which clients can give hints
+// about themselves, such as "mobile" for clients running on small screens.
+const ClientHeader = "X-Yep-Client"
+
+// IsMobileClient returns true if the client of this request
+// identified itself as a mobile client.
+func (c *Context) IsMobileClient() bool {
+	for _, hint := range strings.Split(c.Request.Header.Get(ClientHeader), ",") {
+		if strings.TrimSpace(hint) == "mobile" {
+			return true
+		}
+	}
+	return false
+}
+
+// Lang returns the language of the user of this request, as stored in the
+// "lang" key of the session or else as given by the first language of the
+// Accept-Language header, e.g. "fr_FR". It returns an empty string if
+// neither is set.
+func (c *Context) Lang() string {
+	if lang, ok := c.Session().Get("lang").(string); ok && lang != "" {
+		return lang
+	}
+	accepted := strings.Split(c.Request.Header.Get("Accept-Language"), ",")[0]
+	accepted = strings.TrimSpace(strings.Split(accepted, ";")[0])
+	if accepted == "*" {
+		return ""
+	}
+	return strings.Replace(accepted, "-", "_", -1)
+}
+
 // Session returns the current Session instance
 func (c *Context) Session() sessions.Session {
 	return sessions.Default(c.Context)
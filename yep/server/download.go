@@ -0,0 +1,173 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	// downloadChunkSize is the size of the chunks in which downloads are
+	// written to the client.
+	downloadChunkSize = 32 * 1024
+	// defaultMaxInMemoryDownloadSize is the default size above which
+	// generated downloads are spilled to a temporary file.
+	defaultMaxInMemoryDownloadSize = 4 * 1024 * 1024
+)
+
+// MaxInMemoryDownloadSize is the size in bytes above which the content
+// generated for a download is written to a temporary file instead of
+// being kept in memory.
+var MaxInMemoryDownloadSize int64 = defaultMaxInMemoryDownloadSize
+
+// generationSlots limits the number of downloads that can be generated
+// concurrently. A nil channel means that there is no limit.
+var generationSlots = struct {
+	sync.RWMutex
+	slots chan struct{}
+}{}
+
+// SetMaxConcurrentDownloads sets the maximum number of downloads (such as
+// reports or exports) that can be generated at the same time. Requests
+// above this limit wait for a running generation to finish. If n is 0 or
+// negative, the number of concurrent generations is not limited.
+func SetMaxConcurrentDownloads(n int) {
+	generationSlots.Lock()
+	defer generationSlots.Unlock()
+	if n <= 0 {
+		generationSlots.slots = nil
+		return
+	}
+	generationSlots.slots = make(chan struct{}, n)
+}
+
+// acquireGenerationSlot blocks until a download can be generated and
+// returns the function to call to release the slot.
+func acquireGenerationSlot() func() {
+	generationSlots.RLock()
+	slots := generationSlots.slots
+	generationSlots.RUnlock()
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// A spool is an io.Writer that keeps the data written to it in memory
+// until it reaches a threshold, and then spills it to a temporary file.
+type spool struct {
+	threshold int64
+	size      int64
+	buf       bytes.Buffer
+	file      *os.File
+}
+
+// Write writes p to the spool, spilling its content to a temporary
+// file if the threshold is reached.
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.threshold {
+		file, err := ioutil.TempFile("", "yep-download")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.buf.WriteTo(s.file); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns a reader on the content of the spool.
+func (s *spool) reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.buf, nil
+	}
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// Close releases the resources of the spool, removing its temporary file if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	os.Remove(s.file.Name())
+	return err
+}
+
+// Download generates a file by calling generate and sends it to the client as
+// an attachment with the given file name and content type.
+//
+// The number of concurrent generations is limited (see SetMaxConcurrentDownloads).
+// The generated content is kept in memory if it is small, and spilled to a
+// temporary file above MaxInMemoryDownloadSize. If generate returns an error,
+// the request is aborted with an internal server error.
+func (c *Context) Download(fileName, contentType string, generate func(w io.Writer) error) {
+	release := acquireGenerationSlot()
+	content := &spool{threshold: MaxInMemoryDownloadSize}
+	defer content.Close()
+	err := generate(content)
+	release()
+	if err != nil {
+		log.Warn("Error while generating download", "file", fileName, "error", err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	r, err := content.reader()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Content-Length", fmt.Sprintf("%d", content.size))
+	c.StreamFile(fileName, contentType, r)
+}
+
+// StreamFile sends the content read from r to the client as an attachment
+// with the given file name and content type. The content is written in chunks
+// and flushed as it is read, so that it is never entirely held in memory. If
+// no Content-Length header has been set, chunked transfer encoding is used.
+func (c *Context) StreamFile(fileName, contentType string, r io.Reader) {
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	c.Status(http.StatusOK)
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, wErr := c.Writer.Write(buf[:n]); wErr != nil {
+				log.Warn("Error while streaming download", "file", fileName, "error", wErr)
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Warn("Error while reading download content", "file", fileName, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// spilledDownloads returns the number of temporary files of downloads
+func spilledDownloads() int {
+	files, _ := filepath.Glob(filepath.Join(os.TempDir(), "yep-download*"))
+	return len(files)
+}
+
+// newTestContext returns a Context on a new GET request and its recorder
+func newTestContext() (*Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.ReleaseMode)
+	w := httptest.NewRecorder()
+	ginCtx, _ := gin.CreateTestContext(w)
+	ginCtx.Request = httptest.NewRequest(http.MethodGet, "/download", nil)
+	return &Context{Context: ginCtx}, w
+}
+
+func TestDownloads(t *testing.T) {
+	Convey("Testing download spools", t, func() {
+		Convey("Small contents are kept in memory", func() {
+			s := &spool{threshold: 10}
+			n, err := s.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+			So(s.file, ShouldBeNil)
+			r, err := s.reader()
+			So(err, ShouldBeNil)
+			content, _ := ioutil.ReadAll(r)
+			So(string(content), ShouldEqual, "hello")
+			So(s.Close(), ShouldBeNil)
+		})
+		Convey("Large contents are spilled to a temporary file", func() {
+			s := &spool{threshold: 10}
+			s.Write([]byte("hello "))
+			So(s.file, ShouldBeNil)
+			s.Write([]byte("world!"))
+			So(s.file, ShouldNotBeNil)
+			So(s.size, ShouldEqual, 12)
+			So(s.buf.Len(), ShouldEqual, 0)
+			r, err := s.reader()
+			So(err, ShouldBeNil)
+			content, _ := ioutil.ReadAll(r)
+			So(string(content), ShouldEqual, "hello world!")
+			fileName := s.file.Name()
+			So(s.Close(), ShouldBeNil)
+			_, err = os.Stat(fileName)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+	Convey("Testing downloads", t, func() {
+		maxSize := MaxInMemoryDownloadSize
+		MaxInMemoryDownloadSize = 1024
+		Reset(func() {
+			MaxInMemoryDownloadSize = maxSize
+		})
+		Convey("Large downloads are streamed from a temporary file", func() {
+			data := bytes.Repeat([]byte("0123456789"), 10000)
+			before := spilledDownloads()
+			var during int
+			c, w := newTestContext()
+			c.Download("export.csv", "text/csv", func(wr io.Writer) error {
+				for i := 0; i < len(data); i += 1000 {
+					if _, err := wr.Write(data[i : i+1000]); err != nil {
+						return err
+					}
+				}
+				during = spilledDownloads()
+				return nil
+			})
+			So(during, ShouldEqual, before+1)
+			So(spilledDownloads(), ShouldEqual, before)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/csv")
+			So(w.Header().Get("Content-Disposition"), ShouldEqual, `attachment; filename="export.csv"`)
+			So(w.Header().Get("Content-Length"), ShouldEqual, "100000")
+			So(w.Body.Bytes(), ShouldResemble, data)
+		})
+		Convey("Small downloads are served from memory", func() {
+			before := spilledDownloads()
+			c, w := newTestContext()
+			c.Download("report.txt", "text/plain", func(wr io.Writer) error {
+				_, err := io.WriteString(wr, "Total: 42")
+				return err
+			})
+			So(spilledDownloads(), ShouldEqual, before)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Length"), ShouldEqual, "9")
+			So(w.Body.String(), ShouldEqual, "Total: 42")
+		})
+		Convey("Generation errors abort the request", func() {
+			c, w := newTestContext()
+			c.Download("report.txt", "text/plain", func(wr io.Writer) error {
+				return errors.New("generation failed")
+			})
+			So(w.Code, ShouldEqual, http.StatusInternalServerError)
+			So(w.Body.String(), ShouldBeEmpty)
+		})
+	})
+	Convey("Testing concurrent generations limit", t, func() {
+		SetMaxConcurrentDownloads(1)
+		Reset(func() {
+			SetMaxConcurrentDownloads(0)
+		})
+		release := acquireGenerationSlot()
+		acquired := make(chan struct{})
+		go func() {
+			acquireGenerationSlot()()
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			t.Error("Generation slot acquired above the limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+		release()
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Error("Generation slot not acquired after release")
+		}
+	})
+}
@@ -58,6 +58,11 @@ var Modules ModulesList
 // all YEP Addons.
 func RegisterModule(mod *Module) {
 	createModuleSymlinks(mod)
+	pc, _, _, ok := runtime.Caller(1)
+	if !ok {
+		log.Panic("Unable to find caller", "module", mod.Name)
+	}
+	models.RegisterModulePackage(models.PackageOfFunc(runtime.FuncForPC(pc).Name()))
 	Modules = append(Modules, mod)
 }
 
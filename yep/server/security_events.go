@@ -0,0 +1,34 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/models/types"
+)
+
+// RecordSecurityEvent records a security event of the given type for the
+// given login and user ID, with the IP address and user agent of the client.
+func (c *Context) RecordSecurityEvent(eventType models.SecurityEventType, login string, uid int64) {
+	models.RecordSecurityEvent(models.SecurityEvent{
+		Type:      eventType,
+		Login:     login,
+		UID:       uid,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+}
+
+// Authenticate authenticates the user with the given login and secret against
+// the security.AuthenticationRegistry and records the login success or failure.
+func (c *Context) Authenticate(login, secret string, context *types.Context) (int64, error) {
+	uid, err := security.AuthenticationRegistry.Authenticate(login, secret, context)
+	if err != nil {
+		c.RecordSecurityEvent(models.EventLoginFailure, login, 0)
+		return 0, err
+	}
+	c.RecordSecurityEvent(models.EventLoginSuccess, login, uid)
+	return uid, nil
+}
@@ -63,10 +63,15 @@ type ResponseError struct {
 
 // JSONRPCErrorData is the format of the Data field of an Error Response
 type JSONRPCErrorData struct {
-	Arguments string `json:"arguments"`
-	Debug     string `json:"debug"`
+	Arguments     string `json:"arguments"`
+	Debug         string `json:"debug"`
+	ExceptionType string `json:"exception_type,omitempty"`
 }
 
+// ConcurrentUpdateException is the exception type of the errors sent back
+// to clients when writing records modified since they were read.
+const ConcurrentUpdateException = "concurrent_update"
+
 // JSONRPCError is the format of an Error in a ResponseError
 type JSONRPCError struct {
 	Code    int         `json:"code"`
@@ -0,0 +1,28 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"mime/multipart"
+
+	"github.com/npiganeau/yep/yep/models"
+)
+
+// ScannedFormFile returns the file uploaded in the given form field of the
+// request, after it has been scanned by the models.Antivirus. It returns a
+// models.InfectedFileError if a threat has been found in the file.
+//
+// Controllers receiving files that are not stored in attachment fields, such
+// as import files, must use it instead of FormFile.
+func (c *Context) ScannedFormFile(name string) (multipart.File, *multipart.FileHeader, error) {
+	file, header, err := c.Request.FormFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := models.ScanFile(header.Filename, file); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, header, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/tools/i18n"
+)
+
+// UpdateGoldenEnv is the environment variable which, when set, makes
+// CheckReportSnapshot write the golden files instead of comparing to them.
+const UpdateGoldenEnv = "YEP_UPDATE_GOLDEN"
+
+var (
+	// htmlSpaces matches runs of white spaces in HTML documents
+	htmlSpaces = regexp.MustCompile(`\s+`)
+	// htmlTagBoundary matches the white spaces between two HTML tags
+	htmlTagBoundary = regexp.MustCompile(`>\s*<`)
+)
+
+// NormalizeHTML returns the given HTML document with its white spaces
+// collapsed and each tag on its own line, so that rendered documents can
+// be compared regardless of their indentation.
+func NormalizeHTML(html string) string {
+	res := htmlSpaces.ReplaceAllString(html, " ")
+	res = htmlTagBoundary.ReplaceAllString(res, ">\n<")
+	lines := strings.Split(strings.TrimSpace(res), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// RenderReport renders the report template of the given file with data and
+// the formatting functions of the given language, such as formatAmount and
+// formatDate. It returns the normalized HTML of the rendered document.
+func RenderReport(templateFile, lang string, data interface{}) (string, error) {
+	tmpl, err := template.New(filepath.Base(templateFile)).
+		Funcs(i18n.Registry.Formatter(lang).FuncMap()).
+		ParseFiles(templateFile)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return NormalizeHTML(buf.String()), nil
+}
+
+// CheckReportSnapshot renders the report template of the given file with
+// data in the given language and compares the result with the content of
+// goldenFile. It returns an error showing the first differing line if they
+// do not match. Use it in your module's tests with:
+//
+//	So(tests.CheckReportSnapshot("templates/invoice.html", "fr_FR", invoice, "testdata/invoice.golden"), ShouldBeNil)
+//
+// If the YEP_UPDATE_GOLDEN environment variable is set, the golden file is
+// written with the rendered document instead.
+func CheckReportSnapshot(templateFile, lang string, data interface{}, goldenFile string) error {
+	got, err := RenderReport(templateFile, lang, data)
+	if err != nil {
+		return fmt.Errorf("unable to render report %s: %s", templateFile, err)
+	}
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(goldenFile), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(goldenFile, []byte(got), 0644)
+	}
+	golden, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read golden file %s (set %s to create it): %s", goldenFile, UpdateGoldenEnv, err)
+	}
+	want := NormalizeHTML(string(golden))
+	if got == want {
+		return nil
+	}
+	gotLines, wantLines := strings.Split(got, "\n"), strings.Split(want, "\n")
+	for i := 0; ; i++ {
+		var gotLine, wantLine string
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if gotLine != wantLine {
+			return fmt.Errorf("report %s differs from golden file %s at line %d:\n  got:  %s\n  want: %s",
+				templateFile, goldenFile, i+1, gotLine, wantLine)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/npiganeau/yep/pool"
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReportSnapshots(t *testing.T) {
+	Convey("Testing report snapshots", t, func() {
+		So(NormalizeHTML("<div>\n    <p> Some   text </p>\r\n</div>"), ShouldEqual, "<div>\n<p> Some text </p>\n</div>\n")
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			profile := pool.Profile().Create(env, &pool.ProfileData{Money: 12345.5})
+			user := pool.User().Create(env, &pool.UserData{Name: "Report Author", Profile: profile})
+			post := pool.Post().Create(env, &pool.PostData{User: user, Title: "Report Post"})
+			Convey("Rendered report should match its golden file", func() {
+				So(CheckReportSnapshot("testdata/post_report.html", "fr_FR", post, "testdata/post_report.golden"), ShouldBeNil)
+			})
+			Convey("Data changes should be reported", func() {
+				post.SetTitle("Changed Post")
+				err := CheckReportSnapshot("testdata/post_report.html", "fr_FR", post, "testdata/post_report.golden")
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "at line 2")
+			})
+		})
+	})
+}
@@ -6,6 +6,7 @@ package tests
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -68,11 +69,16 @@ func InitializeTests(moduleName string) {
 	}
 	logging.Initialize()
 
-	db := sqlx.MustConnect(driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", user, password))
-	db.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbName))
-	db.Close()
+	if driver == "sqlite3" {
+		// SQLite databases are files which are created on connection
+		models.DBConnect(driver, sqliteConnectString(dbName))
+	} else {
+		db := sqlx.MustConnect(driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", user, password))
+		db.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbName))
+		db.Close()
 
-	models.DBConnect(driver, fmt.Sprintf("dbname=%s sslmode=disable user=%s password=%s", dbName, user, password))
+		models.DBConnect(driver, fmt.Sprintf("dbname=%s sslmode=disable user=%s password=%s", dbName, user, password))
+	}
 	models.BootStrap()
 	models.SyncDatabase()
 
@@ -84,7 +90,23 @@ func TearDownTests(moduleName string) {
 	models.DBClose()
 	fmt.Printf("Tearing down database for module %s\n", moduleName)
 	dbName := fmt.Sprintf("%s_%s_tests", prefix, moduleName)
+	if driver == "sqlite3" {
+		os.Remove(sqliteFileName(dbName))
+		return
+	}
 	db := sqlx.MustConnect(driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", user, password))
 	db.MustExec(fmt.Sprintf("DROP DATABASE %s", dbName))
 	db.Close()
 }
+
+// sqliteFileName returns the path of the SQLite test database file
+// with the given name, in the temporary directory.
+func sqliteFileName(dbName string) string {
+	return filepath.Join(os.TempDir(), dbName+".db")
+}
+
+// sqliteConnectString returns the data source name of the SQLite
+// test database with the given name.
+func sqliteConnectString(dbName string) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000", sqliteFileName(dbName))
+}
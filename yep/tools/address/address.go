@@ -0,0 +1,199 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package address formats and validates postal addresses according to the
+conventions of their country.
+
+Each country has a Format giving the layout of its addresses, in which the
+parts of the address are given between braces:
+
+	{street}
+	{street2}
+	{zip} {city}
+	{country}
+
+Formats of the countries that are not registered with RegisterFormat use
+DefaultFormat. Empty lines are removed from formatted addresses.
+*/
+package address
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An Address is a postal address. Country is the ISO 3166-1 alpha-2 code
+// of the country of the address.
+type Address struct {
+	Street  string
+	Street2 string
+	Zip     string
+	City    string
+	State   string
+	Country string
+}
+
+// A Format defines how the addresses of a country are laid out and validated
+type Format struct {
+	// CountryName is the name of the country printed in addresses
+	CountryName string
+	// Layout is the template of the address lines
+	Layout string
+	// ZipPattern is the regular expression that zip codes must match,
+	// if not empty.
+	ZipPattern string
+	// Required are the parts of the address that must be set,
+	// e.g. "zip" or "state".
+	Required []string
+}
+
+// A Validator checks addresses, e.g. against the database of a postal service
+type Validator interface {
+	// ValidateAddress returns an error if the given address is invalid
+	ValidateAddress(addr Address) error
+}
+
+// DefaultFormat is the format of the countries without registered format
+var DefaultFormat = Format{
+	Layout:   "{street}\n{street2}\n{city} {state} {zip}\n{country}",
+	Required: []string{"street", "city"},
+}
+
+// placeholder matches the placeholders of layouts
+var placeholder = regexp.MustCompile(`\{[a-z0-9]+\}`)
+
+// spaces matches consecutive spaces, left by empty parts of the address
+var spaces = regexp.MustCompile(` {2,}`)
+
+var (
+	formats = map[string]Format{
+		"BE": {CountryName: "Belgium", Layout: "{street}\n{street2}\n{zip} {city}\n{country}",
+			ZipPattern: `^\d{4}$`, Required: []string{"street", "zip", "city"}},
+		"CA": {CountryName: "Canada", Layout: "{street}\n{street2}\n{city} {state} {zip}\n{country}",
+			ZipPattern: `^[A-Z]\d[A-Z] ?\d[A-Z]\d$`, Required: []string{"street", "zip", "city", "state"}},
+		"CH": {CountryName: "Switzerland", Layout: "{street}\n{street2}\n{zip} {city}\n{country}",
+			ZipPattern: `^\d{4}$`, Required: []string{"street", "zip", "city"}},
+		"DE": {CountryName: "Germany", Layout: "{street}\n{street2}\n{zip} {city}\n{country}",
+			ZipPattern: `^\d{5}$`, Required: []string{"street", "zip", "city"}},
+		"ES": {CountryName: "Spain", Layout: "{street}\n{street2}\n{zip} {city} {state}\n{country}",
+			ZipPattern: `^\d{5}$`, Required: []string{"street", "zip", "city"}},
+		"FR": {CountryName: "France", Layout: "{street}\n{street2}\n{zip} {city}\n{country}",
+			ZipPattern: `^\d{5}$`, Required: []string{"street", "zip", "city"}},
+		"GB": {CountryName: "United Kingdom", Layout: "{street}\n{street2}\n{city}\n{state}\n{zip}\n{country}",
+			ZipPattern: `^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`, Required: []string{"street", "zip", "city"}},
+		"IT": {CountryName: "Italy", Layout: "{street}\n{street2}\n{zip} {city} {state}\n{country}",
+			ZipPattern: `^\d{5}$`, Required: []string{"street", "zip", "city"}},
+		"NL": {CountryName: "Netherlands", Layout: "{street}\n{street2}\n{zip} {city}\n{country}",
+			ZipPattern: `^\d{4} ?[A-Z]{2}$`, Required: []string{"street", "zip", "city"}},
+		"US": {CountryName: "United States", Layout: "{street}\n{street2}\n{city}, {state} {zip}\n{country}",
+			ZipPattern: `^\d{5}(-\d{4})?$`, Required: []string{"street", "zip", "city", "state"}},
+	}
+	validators []Validator
+)
+
+// RegisterFormat sets the format of the addresses of the given country,
+// replacing its current format if any. It must be called at initialization.
+func RegisterFormat(country string, format Format) {
+	if format.ZipPattern != "" {
+		if _, err := regexp.Compile(format.ZipPattern); err != nil {
+			panic(fmt.Errorf("invalid zip pattern of country %s: %s", country, err))
+		}
+	}
+	formats[strings.ToUpper(country)] = format
+}
+
+// RegisterValidator adds the given validator to the validators called by
+// Validate. It must be called at initialization.
+func RegisterValidator(validator Validator) {
+	validators = append(validators, validator)
+}
+
+// GetFormat returns the format of the addresses of the given country
+func GetFormat(country string) Format {
+	if format, ok := formats[strings.ToUpper(country)]; ok {
+		return format
+	}
+	format := DefaultFormat
+	format.CountryName = strings.ToUpper(country)
+	return format
+}
+
+// values returns the parts of this address by placeholder name
+func (a Address) values() map[string]string {
+	return map[string]string{
+		"street":  strings.TrimSpace(a.Street),
+		"street2": strings.TrimSpace(a.Street2),
+		"zip":     strings.TrimSpace(a.Zip),
+		"city":    strings.TrimSpace(a.City),
+		"state":   strings.TrimSpace(a.State),
+		"country": GetFormat(a.Country).CountryName,
+	}
+}
+
+// Lines returns the lines of this address laid out
+// according to its country, without empty lines.
+func (a Address) Lines() []string {
+	return a.lines(true)
+}
+
+// lines returns the non empty lines of this address, with
+// the country line only if withCountry is true.
+func (a Address) lines(withCountry bool) []string {
+	values := a.values()
+	if a.Country == "" || !withCountry {
+		values["country"] = ""
+	}
+	var res []string
+	for _, line := range strings.Split(GetFormat(a.Country).Layout, "\n") {
+		line = placeholder.ReplaceAllStringFunc(line, func(p string) string {
+			return values[p[1:len(p)-1]]
+		})
+		line = strings.Trim(spaces.ReplaceAllString(line, " "), " ,")
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// String returns this address on several lines
+func (a Address) String() string {
+	return strings.Join(a.Lines(), "\n")
+}
+
+// FormatFrom returns this address on several lines as written on a mail sent
+// from the given country, that is without the country line for domestic mail.
+func (a Address) FormatFrom(country string) string {
+	return strings.Join(a.lines(!strings.EqualFold(a.Country, country)), "\n")
+}
+
+// IsEmpty returns true if no part of this address is set
+func (a Address) IsEmpty() bool {
+	return a == Address{}
+}
+
+// Validate returns an error if the given address does not satisfy the format
+// of its country or is rejected by one of the registered validators.
+func Validate(addr Address) error {
+	format := GetFormat(addr.Country)
+	values := addr.values()
+	for _, part := range format.Required {
+		if values[part] == "" {
+			return fmt.Errorf("%s is required", part)
+		}
+	}
+	if format.ZipPattern != "" && values["zip"] != "" {
+		zip := strings.ToUpper(values["zip"])
+		if !regexp.MustCompile(format.ZipPattern).MatchString(zip) {
+			return fmt.Errorf("invalid zip code '%s' for %s", values["zip"], format.CountryName)
+		}
+	}
+	for _, validator := range validators {
+		if err := validator.ValidateAddress(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package address
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testValidator struct{}
+
+func (testValidator) ValidateAddress(addr Address) error {
+	if addr.Street == "Nowhere" {
+		return errors.New("unknown street")
+	}
+	return nil
+}
+
+func TestFormat(t *testing.T) {
+	Convey("Testing address formatting", t, func() {
+		paris := Address{Street: "12 rue de Rivoli", Zip: "75001", City: "Paris", Country: "FR"}
+		newYork := Address{Street: "165 5th Avenue", Street2: "Suite 3", Zip: "10010", City: "New York", State: "NY", Country: "us"}
+		So(paris.Lines(), ShouldResemble, []string{"12 rue de Rivoli", "75001 Paris", "France"})
+		So(newYork.String(), ShouldEqual, "165 5th Avenue\nSuite 3\nNew York, NY 10010\nUnited States")
+		So(paris.FormatFrom("FR"), ShouldEqual, "12 rue de Rivoli\n75001 Paris")
+		So(paris.FormatFrom("DE"), ShouldEqual, "12 rue de Rivoli\n75001 Paris\nFrance")
+		So(Address{City: "New York", Zip: "10010", Country: "US"}.Lines(), ShouldResemble,
+			[]string{"New York, 10010", "United States"})
+		So(Address{Street: "1 Main Street", City: "Springfield"}.String(), ShouldEqual, "1 Main Street\nSpringfield")
+		So(Address{Street: "Kungsgatan 1", Zip: "111 43", City: "Stockholm", Country: "SE"}.Lines(), ShouldResemble,
+			[]string{"Kungsgatan 1", "Stockholm 111 43", "SE"})
+		So(Address{}.IsEmpty(), ShouldBeTrue)
+	})
+	Convey("Testing custom formats", t, func() {
+		RegisterFormat("SE", Format{CountryName: "Sweden", Layout: "{street}\n{zip} {city}\n{country}", ZipPattern: `^\d{3} ?\d{2}$`})
+		defer delete(formats, "SE")
+		addr := Address{Street: "Kungsgatan 1", Zip: "111 43", City: "Stockholm", Country: "SE"}
+		So(addr.String(), ShouldEqual, "Kungsgatan 1\n111 43 Stockholm\nSweden")
+		So(Validate(addr), ShouldBeNil)
+		So(func() { RegisterFormat("XX", Format{ZipPattern: "(("}) }, ShouldPanic)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Testing address validation", t, func() {
+		So(Validate(Address{Street: "12 rue de Rivoli", Zip: "75001", City: "Paris", Country: "FR"}), ShouldBeNil)
+		So(Validate(Address{Street: "12 rue de Rivoli", Zip: "7500", City: "Paris", Country: "FR"}), ShouldNotBeNil)
+		So(Validate(Address{Street: "12 rue de Rivoli", City: "Paris", Country: "FR"}), ShouldNotBeNil)
+		So(Validate(Address{Street: "10 Downing Street", Zip: "sw1a 2aa", City: "London", Country: "GB"}), ShouldBeNil)
+		So(Validate(Address{Street: "165 5th Avenue", Zip: "10010", City: "New York", Country: "US"}), ShouldNotBeNil)
+		So(Validate(Address{Street: "1 Main Street", City: "Springfield"}), ShouldBeNil)
+		Convey("Registered validators are called", func() {
+			RegisterValidator(testValidator{})
+			defer func() { validators = nil }()
+			So(Validate(Address{Street: "Nowhere", City: "Springfield"}), ShouldNotBeNil)
+			So(Validate(Address{Street: "1 Main Street", City: "Springfield"}), ShouldBeNil)
+		})
+	})
+}
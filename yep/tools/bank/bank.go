@@ -0,0 +1,128 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package bank validates and formats the identifiers of bank accounts: IBAN
+(International Bank Account Number, ISO 13616) and BIC (Business Identifier
+Code, ISO 9362).
+
+IBANs are stored in their electronic format, in upper case and without
+spaces, e.g. "FR1420041010050500013M02606", and displayed in their print
+format by groups of four characters, e.g. "FR14 2004 1010 0505 0001 3M02 606".
+*/
+package bank
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ibanLengths are the lengths of the IBANs of each country of the IBAN registry
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22,
+	"BH": 22, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22,
+	"DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24, "FI": 18, "FO": 18, "FR": 27,
+	"GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28, "HR": 21, "HU": 28,
+	"IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24,
+	"ME": 22, "MK": 19, "MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "SA": 24, "SC": 31,
+	"SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28, "TL": 23, "TN": 24,
+	"TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+var (
+	// ibanPattern is the format of normalized IBANs
+	ibanPattern = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]+$`)
+	// bicPattern is the format of normalized BICs: institution,
+	// country, location and optional branch codes.
+	bicPattern = regexp.MustCompile(`^[A-Z0-9]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+)
+
+// removeSpaces removes the whitespaces and dashes of the given string
+func removeSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '-', '\u00a0':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// NormalizeIBAN returns the given IBAN in its electronic format,
+// i.e. in upper case and without spaces.
+func NormalizeIBAN(iban string) string {
+	iban = strings.ToUpper(removeSpaces(iban))
+	return strings.TrimPrefix(iban, "IBAN")
+}
+
+// ValidateIBAN returns an error if the given IBAN does not have the length
+// of its country or if its check digits are wrong.
+func ValidateIBAN(iban string) error {
+	iban = NormalizeIBAN(iban)
+	if !ibanPattern.MatchString(iban) {
+		return fmt.Errorf("invalid IBAN '%s'", iban)
+	}
+	length, ok := ibanLengths[iban[:2]]
+	if !ok {
+		return fmt.Errorf("unknown IBAN country '%s'", iban[:2])
+	}
+	if len(iban) != length {
+		return fmt.Errorf("IBANs of country %s must have %d characters", iban[:2], length)
+	}
+	// ISO 7064 mod 97-10 on the IBAN with its first four characters moved to the
+	// end and its letters replaced by their position in the alphabet plus 9.
+	var rem int
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' {
+			rem = (rem*100 + int(c-'A') + 10) % 97
+			continue
+		}
+		rem = (rem*10 + int(c-'0')) % 97
+	}
+	if rem != 1 {
+		return fmt.Errorf("wrong check digits of IBAN '%s'", iban)
+	}
+	return nil
+}
+
+// FormatIBAN returns the given IBAN in its print format,
+// i.e. by groups of four characters separated by spaces.
+func FormatIBAN(iban string) string {
+	iban = NormalizeIBAN(iban)
+	var groups []string
+	for len(iban) > 4 {
+		groups = append(groups, iban[:4])
+		iban = iban[4:]
+	}
+	groups = append(groups, iban)
+	return strings.Join(groups, " ")
+}
+
+// MaskIBAN returns the given IBAN in its print format, with all its
+// characters but the country code, the check digits and the last four
+// characters replaced by stars.
+func MaskIBAN(iban string) string {
+	iban = NormalizeIBAN(iban)
+	if len(iban) <= 8 {
+		return FormatIBAN(strings.Repeat("*", len(iban)))
+	}
+	return FormatIBAN(iban[:4] + strings.Repeat("*", len(iban)-8) + iban[len(iban)-4:])
+}
+
+// NormalizeBIC returns the given BIC in upper case and without spaces
+func NormalizeBIC(bic string) string {
+	return strings.ToUpper(removeSpaces(bic))
+}
+
+// ValidateBIC returns an error if the given BIC does not have
+// 8 or 11 characters with a country code in 5th and 6th position.
+func ValidateBIC(bic string) error {
+	bic = NormalizeBIC(bic)
+	if !bicPattern.MatchString(bic) {
+		return fmt.Errorf("invalid BIC '%s'", bic)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bank
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIBAN(t *testing.T) {
+	Convey("Testing IBANs", t, func() {
+		Convey("IBANs should be normalized", func() {
+			So(NormalizeIBAN("fr14 2004 1010 0505 0001 3m02 606"), ShouldEqual, "FR1420041010050500013M02606")
+			So(NormalizeIBAN("IBAN DE89-3704-0044-0532-0130-00"), ShouldEqual, "DE89370400440532013000")
+		})
+		Convey("Valid IBANs should be accepted", func() {
+			for _, iban := range []string{"FR1420041010050500013M02606", "DE89 3704 0044 0532 0130 00",
+				"GB82WEST12345698765432", "BE68539007547034", "NL91ABNA0417164300", "CH9300762011623852957"} {
+				So(ValidateIBAN(iban), ShouldBeNil)
+			}
+		})
+		Convey("Invalid IBANs should be rejected", func() {
+			for _, iban := range []string{"FR1420041010050500013M02607", "DE88370400440532013000",
+				"GB82WEST1234569876543", "US64SVBKUS6S3300958879", "BE6853900754703$", "68539007547034", ""} {
+				So(ValidateIBAN(iban), ShouldNotBeNil)
+			}
+		})
+		Convey("IBANs should be formatted and masked by groups of four", func() {
+			So(FormatIBAN("FR1420041010050500013M02606"), ShouldEqual, "FR14 2004 1010 0505 0001 3M02 606")
+			So(FormatIBAN("BE68539007547034"), ShouldEqual, "BE68 5390 0754 7034")
+			So(MaskIBAN("FR1420041010050500013M02606"), ShouldEqual, "FR14 **** **** **** **** ***2 606")
+			So(MaskIBAN("BE68 5390 0754 7034"), ShouldEqual, "BE68 **** **** 7034")
+			So(MaskIBAN("BE68"), ShouldEqual, "****")
+		})
+	})
+}
+
+func TestBIC(t *testing.T) {
+	Convey("Testing BICs", t, func() {
+		So(NormalizeBIC("deut de ff 500"), ShouldEqual, "DEUTDEFF500")
+		for _, bic := range []string{"DEUTDEFF", "DEUTDEFF500", "nedszajjxxx"} {
+			So(ValidateBIC(bic), ShouldBeNil)
+		}
+		for _, bic := range []string{"DEUTDEF", "DEUTDEFF5", "DEUT12FF", "DEUTDEFF_00", ""} {
+			So(ValidateBIC(bic), ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,430 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// An evaluator evaluates the nodes of an expression in an Env
+type evaluator struct {
+	src string
+	env Env
+}
+
+// Eval evaluates the given node of the expression src in the given Env and
+// returns its result. It is meant to evaluate parts of a Program, Program.Eval
+// should be used otherwise.
+func Eval(src string, node Node, env Env) (res interface{}, err error) {
+	e := evaluator{src: src, env: env}
+	err = catchError(func() {
+		res = e.eval(node)
+	})
+	return res, err
+}
+
+// fail aborts evaluation with an error at the position of the given node
+func (e *evaluator) fail(node Node, format string, args ...interface{}) {
+	panic(newError(e.src, node.Pos(), format, args...))
+}
+
+// eval returns the value of the given node
+func (e *evaluator) eval(node Node) interface{} {
+	switch n := node.(type) {
+	case *Literal:
+		return n.Value
+	case *Ident:
+		val, ok := e.env.Lookup(n.Name)
+		if !ok {
+			e.fail(n, "unknown name '%s'", n.Name)
+		}
+		return val
+	case *Attr:
+		return e.attr(n, e.eval(n.X))
+	case *List:
+		res := make([]interface{}, len(n.Elems))
+		for i, elem := range n.Elems {
+			res[i] = e.eval(elem)
+		}
+		return res
+	case *Call:
+		args := make([]interface{}, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = Value(e.eval(arg))
+		}
+		res, err := functions[n.Func].fnct(args)
+		if err != nil {
+			e.fail(n, "%s: %s", n.Func, err)
+		}
+		return res
+	case *Unary:
+		return e.unary(n)
+	case *Binary:
+		return e.binary(n)
+	}
+	e.fail(node, "unknown expression")
+	return nil
+}
+
+// attr returns the attribute of the given node on the given value.
+// Attributes of null values are null.
+func (e *evaluator) attr(n *Attr, value interface{}) interface{} {
+	switch val := value.(type) {
+	case nil:
+		return nil
+	case Object:
+		res, err := val.Attr(n.Name)
+		if err != nil {
+			e.fail(n, "%s", err)
+		}
+		return res
+	case map[string]interface{}:
+		return val[n.Name]
+	}
+	e.fail(n, "cannot access attribute '%s' of %s", n.Name, typeName(value))
+	return nil
+}
+
+// unary returns the result of the given unary operation
+func (e *evaluator) unary(n *Unary) interface{} {
+	val := Value(e.eval(n.X))
+	if n.Op == "not" {
+		return !Truth(val)
+	}
+	switch v := val.(type) {
+	case int64:
+		return -v
+	case float64:
+		return -v
+	}
+	e.fail(n, "cannot negate %s", typeName(val))
+	return nil
+}
+
+// binary returns the result of the given binary operation.
+// "and" and "or" are short-circuited.
+func (e *evaluator) binary(n *Binary) interface{} {
+	switch n.Op {
+	case "and":
+		return Truth(Value(e.eval(n.X))) && Truth(Value(e.eval(n.Y)))
+	case "or":
+		return Truth(Value(e.eval(n.X))) || Truth(Value(e.eval(n.Y)))
+	}
+	x, y := Value(e.eval(n.X)), Value(e.eval(n.Y))
+	switch n.Op {
+	case "==":
+		return equals(x, y)
+	case "!=":
+		return !equals(x, y)
+	case "in":
+		return e.contains(n, y, x)
+	case "not in":
+		return !e.contains(n, y, x)
+	case "<", "<=", ">", ">=":
+		cmp, ok := compare(x, y)
+		if !ok {
+			e.fail(n, "cannot compare %s and %s", typeName(x), typeName(y))
+		}
+		switch n.Op {
+		case "<":
+			return cmp < 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		}
+		return cmp >= 0
+	}
+	return e.arithmetic(n, x, y)
+}
+
+// contains returns true if the given container contains the given value.
+// Strings contain their substrings, lists their elements and a null
+// container contains nothing. Any other container only contains itself.
+func (e *evaluator) contains(n *Binary, container, value interface{}) bool {
+	switch c := container.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, elem := range c {
+			if equals(value, elem) {
+				return true
+			}
+		}
+		return false
+	case string:
+		str, ok := value.(string)
+		if !ok {
+			e.fail(n, "cannot search %s in a string", typeName(value))
+		}
+		return strings.Contains(c, str)
+	}
+	return equals(value, container)
+}
+
+// arithmetic returns the result of the given arithmetic operation
+func (e *evaluator) arithmetic(n *Binary, x, y interface{}) interface{} {
+	switch xv := x.(type) {
+	case string:
+		if yv, ok := y.(string); ok && n.Op == "+" {
+			return xv + yv
+		}
+	case []interface{}:
+		if yv, ok := y.([]interface{}); ok && n.Op == "+" {
+			return append(append([]interface{}{}, xv...), yv...)
+		}
+	case time.Time:
+		switch yv := y.(type) {
+		case time.Duration:
+			switch n.Op {
+			case "+":
+				return xv.Add(yv)
+			case "-":
+				return xv.Add(-yv)
+			}
+		case time.Time:
+			if n.Op == "-" {
+				return xv.Sub(yv)
+			}
+		}
+	case time.Duration:
+		if yv, ok := y.(time.Duration); ok {
+			switch n.Op {
+			case "+":
+				return xv + yv
+			case "-":
+				return xv - yv
+			}
+		}
+	case int64:
+		if yv, ok := y.(int64); ok {
+			switch n.Op {
+			case "+":
+				return xv + yv
+			case "-":
+				return xv - yv
+			case "*":
+				return xv * yv
+			case "%":
+				if yv == 0 {
+					e.fail(n, "division by zero")
+				}
+				return xv % yv
+			}
+		}
+	}
+	xf, xok := toFloat(x)
+	yf, yok := toFloat(y)
+	if !xok || !yok {
+		e.fail(n, "unsupported operation %s between %s and %s", n.Op, typeName(x), typeName(y))
+	}
+	switch n.Op {
+	case "+":
+		return xf + yf
+	case "-":
+		return xf - yf
+	case "*":
+		return xf * yf
+	case "/":
+		if yf == 0 {
+			e.fail(n, "division by zero")
+		}
+		return xf / yf
+	}
+	if yf == 0 {
+		e.fail(n, "division by zero")
+	}
+	return math.Mod(xf, yf)
+}
+
+// Value returns the basic value of the given value used in expressions:
+//   - Valuer values are replaced by their ExprValue,
+//   - integers are converted to int64, floats to float64,
+//   - strings, booleans and times are converted to string, bool and time.Time,
+//   - slices are converted to []interface{} of basic values.
+//
+// Other values are returned unchanged.
+func Value(value interface{}) interface{} {
+	if valuer, ok := value.(Valuer); ok {
+		value = valuer.ExprValue()
+	}
+	switch value.(type) {
+	case nil, bool, int64, float64, string, time.Time, time.Duration, []interface{}:
+		return value
+	}
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(val.Uint())
+	case reflect.Float32, reflect.Float64:
+		return val.Float()
+	case reflect.String:
+		return val.String()
+	case reflect.Bool:
+		return val.Bool()
+	case reflect.Slice, reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return value
+		}
+		res := make([]interface{}, val.Len())
+		for i := range res {
+			res[i] = Value(val.Index(i).Interface())
+		}
+		return res
+	}
+	if val.Type().ConvertibleTo(timeType) {
+		return val.Convert(timeType).Interface()
+	}
+	return value
+}
+
+// Truth returns the truth value of the given basic value:
+// null, false, zero numbers, empty strings and lists and zero
+// times are false, any other value is true.
+func Truth(value interface{}) bool {
+	switch val := Value(value).(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case int64:
+		return val != 0
+	case float64:
+		return val != 0
+	case string:
+		return val != ""
+	case []interface{}:
+		return len(val) > 0
+	case time.Time:
+		return !val.IsZero()
+	case time.Duration:
+		return val != 0
+	}
+	return true
+}
+
+// equals returns true if both given basic values are equal.
+// Integers and floats are compared by value.
+func equals(x, y interface{}) bool {
+	if xl, ok := x.([]interface{}); ok {
+		yl, ok := y.([]interface{})
+		if !ok || len(xl) != len(yl) {
+			return false
+		}
+		for i := range xl {
+			if !equals(xl[i], yl[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if cmp, ok := compare(x, y); ok {
+		return cmp == 0
+	}
+	switch x.(type) {
+	case nil, bool:
+		return x == y
+	}
+	return false
+}
+
+// compare returns -1, 0 or 1 if x is respectively lower, equal or greater
+// than y. The second returned value is false if x and y cannot be ordered.
+func compare(x, y interface{}) (int, bool) {
+	switch xv := x.(type) {
+	case string:
+		yv, ok := y.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(xv, yv), true
+	case time.Time:
+		yv, ok := y.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case xv.Before(yv):
+			return -1, true
+		case xv.After(yv):
+			return 1, true
+		}
+		return 0, true
+	case time.Duration:
+		yv, ok := y.(time.Duration)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(float64(xv), float64(yv)), true
+	case int64:
+		if yv, ok := y.(int64); ok {
+			switch {
+			case xv < yv:
+				return -1, true
+			case xv > yv:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	xf, xok := toFloat(x)
+	yf, yok := toFloat(y)
+	if !xok || !yok {
+		return 0, false
+	}
+	return compareFloats(xf, yf), true
+}
+
+// compareFloats returns -1, 0 or 1 if x is respectively
+// lower, equal or greater than y.
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// toFloat returns the given basic value as a float64 if it is a number
+func toFloat(value interface{}) (float64, bool) {
+	switch val := value.(type) {
+	case int64:
+		return float64(val), true
+	case float64:
+		return val, true
+	}
+	return 0, false
+}
+
+// typeName returns the name of the type of the given
+// basic value for error messages.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case time.Time:
+		return "date"
+	case time.Duration:
+		return "duration"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package expr implements a small sandboxed expression language.
+
+Expressions are meant to be written in data files by functional users, for
+instance in record rules, automation conditions or view decorations. They
+can only read the values they are given and call a fixed set of functions,
+so that evaluating an expression can neither modify data nor run arbitrary
+code.
+
+The syntax is close to Python's:
+
+	state == 'done' and amount >= 1000
+	user.company_id.id in [1, 2] or not active
+	lower(name) != 'admin' and date_deadline < today() + days(7)
+
+Expressions are compiled once, which validates their syntax and the
+functions they call, and then evaluated as many times as needed against an
+Env which gives the values of the names they use.
+*/
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An Env gives the values of the names used in an expression
+type Env interface {
+	// Lookup returns the value of the given name and true,
+	// or false if the name is not defined.
+	Lookup(name string) (interface{}, bool)
+}
+
+// Vars is an Env defined by a map of names to values
+type Vars map[string]interface{}
+
+// Lookup returns the value of the given name and true,
+// or false if the name is not defined.
+func (v Vars) Lookup(name string) (interface{}, bool) {
+	val, ok := v[name]
+	return val, ok
+}
+
+// An Object is a value whose attributes can be accessed in expressions
+type Object interface {
+	// Attr returns the value of the attribute with the given name
+	// or an error if this object has no such attribute.
+	Attr(name string) (interface{}, error)
+}
+
+// A Valuer is a value which is converted to a basic value when it
+// is compared, computed or tested in an expression.
+type Valuer interface {
+	// ExprValue returns the basic value of this value
+	ExprValue() interface{}
+}
+
+// An Error is a compilation or evaluation error of an expression
+type Error struct {
+	Source string
+	Offset int
+	Msg    string
+}
+
+// Error returns the message of this error with its position
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d in '%s'", e.Msg, e.Offset+1, e.Source)
+}
+
+// newError returns a new Error at the given position of src
+func newError(src string, pos int, format string, args ...interface{}) *Error {
+	return &Error{Source: src, Offset: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// catchError calls fnct and returns the *Error it panics with, if any.
+// Other panics are propagated.
+func catchError(fnct func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			exprErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = exprErr
+		}
+	}()
+	fnct()
+	return nil
+}
+
+// A Program is a compiled expression
+type Program struct {
+	source string
+	root   Node
+}
+
+// Compile parses the given expression and returns its Program.
+// It returns an *Error if the expression is not valid.
+func Compile(src string) (*Program, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, newError(src, 0, "empty expression")
+	}
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: src, root: root}, nil
+}
+
+// MustCompile is the same as Compile but panics if the expression is not valid.
+func MustCompile(src string) *Program {
+	p, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// String returns the source of this Program
+func (p *Program) String() string {
+	return p.source
+}
+
+// Root returns the root node of the syntax tree of this Program
+func (p *Program) Root() Node {
+	return p.root
+}
+
+// Eval evaluates this Program in the given Env and returns its result.
+func (p *Program) Eval(env Env) (interface{}, error) {
+	return Eval(p.source, p.root, env)
+}
+
+// EvalBool evaluates this Program in the given Env and returns
+// the truth value of its result.
+func (p *Program) EvalBool(env Env) (bool, error) {
+	res, err := p.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	return Truth(res), nil
+}
+
+// Names returns the sorted list of the paths of names used in this Program,
+// such as "state" or "user.company_id", so that they can be checked before
+// evaluation.
+func (p *Program) Names() []string {
+	names := make(map[string]bool)
+	Walk(p.root, func(n Node) bool {
+		if path, ok := PathOf(n); ok {
+			names[path] = true
+			return false
+		}
+		return true
+	})
+	res := make([]string, 0, len(names))
+	for name := range names {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Walk calls fnct for the given node and, if fnct returns true,
+// recursively for each of its children.
+func Walk(node Node, fnct func(Node) bool) {
+	if !fnct(node) {
+		return
+	}
+	var children []Node
+	switch n := node.(type) {
+	case *Attr:
+		children = []Node{n.X}
+	case *List:
+		children = n.Elems
+	case *Call:
+		children = n.Args
+	case *Unary:
+		children = []Node{n.X}
+	case *Binary:
+		children = []Node{n.X, n.Y}
+	}
+	for _, child := range children {
+		Walk(child, fnct)
+	}
+}
+
+// PathOf returns the dotted path of the given node and true if it is a name
+// or a chain of attributes of a name, such as user.company_id.
+// It returns false for any other node.
+func PathOf(node Node) (string, bool) {
+	switch n := node.(type) {
+	case *Ident:
+		return n.Name, true
+	case *Attr:
+		path, ok := PathOf(n.X)
+		if !ok {
+			return "", false
+		}
+		return path + "." + n.Name, true
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package expr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testRecord struct {
+	id     int64
+	values map[string]interface{}
+}
+
+func (r testRecord) Attr(name string) (interface{}, error) {
+	val, ok := r.values[name]
+	if !ok {
+		return nil, errors.New("unknown field " + name)
+	}
+	return val, nil
+}
+
+func (r testRecord) ExprValue() interface{} {
+	return r.id
+}
+
+func mustEval(src string, env Env) interface{} {
+	res, err := MustCompile(src).Eval(env)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func TestExpressions(t *testing.T) {
+	company := testRecord{id: 7, values: map[string]interface{}{"name": "ACME"}}
+	env := Vars{
+		"state":  "done",
+		"amount": 1500,
+		"active": false,
+		"ids":    []int64{1, 7},
+		"user":   testRecord{id: 3, values: map[string]interface{}{"company_id": company, "parent_id": nil}},
+	}
+	Convey("Testing expressions compilation", t, func() {
+		p, err := Compile("state == 'done' and (amount >= 1000 or not active)")
+		So(err, ShouldBeNil)
+		So(p.Root().String(), ShouldEqual, `((state == "done") and ((amount >= 1000) or not active))`)
+		So(p.Names(), ShouldResemble, []string{"active", "amount", "state"})
+		So(MustCompile("user.company_id.name != lower(state)").Names(), ShouldResemble, []string{"state", "user.company_id.name"})
+		for _, src := range []string{"", "1 +", "1 < 2 < 3", "foo(1)", "len(1, 2)", "'abc", "a.and", "a ! b", "[1, 2"} {
+			_, err = Compile(src)
+			So(err, ShouldNotBeNil)
+		}
+		_, err = Compile("state == unknown(1)")
+		So(err, ShouldResemble, &Error{Source: "state == unknown(1)", Offset: 9, Msg: "unknown function 'unknown'"})
+	})
+	Convey("Testing expressions evaluation", t, func() {
+		So(mustEval("state == 'done' and amount >= 1000", env), ShouldEqual, true)
+		So(mustEval("amount * 2 - 1", env), ShouldEqual, 2999)
+		So(mustEval("-amount / 4", env), ShouldEqual, -375.0)
+		So(mustEval("'Mr ' + upper(state)", env), ShouldEqual, "Mr DONE")
+		So(mustEval("[1, 2] + [3]", env), ShouldResemble, []interface{}{int64(1), int64(2), int64(3)})
+		So(mustEval("'on' in 'done' and 3 not in [1, 2]", env), ShouldEqual, true)
+		So(mustEval("1 == 1.0 and 'a' != 1 and null == None", env), ShouldEqual, true)
+		So(mustEval("max(1, 2.5, 2) + min([4, 3])", env), ShouldEqual, 5.5)
+		So(mustEval("round(2.675, 2)", env), ShouldEqual, 2.68)
+		So(mustEval("len(ids) + len('été')", env), ShouldEqual, 5)
+		So(mustEval("date('2017-01-31') + days(1) == date('2017-02-01')", env), ShouldEqual, true)
+		So(mustEval("today() <= now()", env), ShouldEqual, true)
+		So(mustEval("date('2017-03-01') - date('2017-02-28')", env), ShouldEqual, 24*time.Hour)
+	})
+	Convey("Testing objects in expressions", t, func() {
+		So(mustEval("user.company_id.name", env), ShouldEqual, "ACME")
+		So(mustEval("user.company_id == 7 and user.company_id in ids", env), ShouldEqual, true)
+		So(mustEval("user.parent_id.name", env), ShouldBeNil)
+		So(mustEval("not user.parent_id and user", env), ShouldEqual, true)
+		_, err := MustCompile("user.login").Eval(env)
+		So(err, ShouldResemble, &Error{Source: "user.login", Offset: 5, Msg: "unknown field login"})
+		_, err = MustCompile("state.name").Eval(env)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing evaluation errors", t, func() {
+		for _, src := range []string{"unknown", "amount % 0", "amount / 0", "state < 1", "-state", "int('abc')", "state - 1"} {
+			_, err := MustCompile(src).Eval(env)
+			So(err, ShouldHaveSameTypeAs, &Error{})
+		}
+	})
+}
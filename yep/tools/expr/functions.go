@@ -0,0 +1,242 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A function is one of the functions that can be called in expressions.
+// Its arguments are basic values (see Value) and their count is checked
+// against minArgs and maxArgs at compile time. maxArgs is -1 for
+// variadic functions.
+type function struct {
+	minArgs int
+	maxArgs int
+	fnct    func(args []interface{}) (interface{}, error)
+}
+
+// functions are the functions that can be called in expressions
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"len":        {minArgs: 1, maxArgs: 1, fnct: lenFunc},
+		"lower":      {minArgs: 1, maxArgs: 1, fnct: stringFunc(strings.ToLower)},
+		"upper":      {minArgs: 1, maxArgs: 1, fnct: stringFunc(strings.ToUpper)},
+		"trim":       {minArgs: 1, maxArgs: 1, fnct: stringFunc(strings.TrimSpace)},
+		"startswith": {minArgs: 2, maxArgs: 2, fnct: stringPredicateFunc(strings.HasPrefix)},
+		"endswith":   {minArgs: 2, maxArgs: 2, fnct: stringPredicateFunc(strings.HasSuffix)},
+		"str":        {minArgs: 1, maxArgs: 1, fnct: strFunc},
+		"int":        {minArgs: 1, maxArgs: 1, fnct: intFunc},
+		"float":      {minArgs: 1, maxArgs: 1, fnct: floatFunc},
+		"abs":        {minArgs: 1, maxArgs: 1, fnct: absFunc},
+		"round":      {minArgs: 1, maxArgs: 2, fnct: roundFunc},
+		"min":        {minArgs: 1, maxArgs: -1, fnct: extremumFunc(-1)},
+		"max":        {minArgs: 1, maxArgs: -1, fnct: extremumFunc(1)},
+		"now":        {minArgs: 0, maxArgs: 0, fnct: nowFunc},
+		"today":      {minArgs: 0, maxArgs: 0, fnct: todayFunc},
+		"date":       {minArgs: 1, maxArgs: 1, fnct: dateFunc},
+		"days":       {minArgs: 1, maxArgs: 1, fnct: durationFunc(24 * time.Hour)},
+		"hours":      {minArgs: 1, maxArgs: 1, fnct: durationFunc(time.Hour)},
+		"minutes":    {minArgs: 1, maxArgs: 1, fnct: durationFunc(time.Minute)},
+	}
+}
+
+// lenFunc returns the number of characters of a string or elements of a list.
+// The length of null is 0.
+func lenFunc(args []interface{}) (interface{}, error) {
+	switch val := args[0].(type) {
+	case nil:
+		return int64(0), nil
+	case string:
+		return int64(utf8.RuneCountInString(val)), nil
+	case []interface{}:
+		return int64(len(val)), nil
+	}
+	return nil, fmt.Errorf("%s has no length", typeName(args[0]))
+}
+
+// stringFunc returns a function applying fnct to a string argument.
+// A null argument returns null.
+func stringFunc(fnct func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		switch val := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return fnct(val), nil
+		}
+		return nil, fmt.Errorf("expected string, got %s", typeName(args[0]))
+	}
+}
+
+// stringPredicateFunc returns a function applying fnct to two string arguments.
+// A null first argument returns false.
+func stringPredicateFunc(fnct func(string, string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return false, nil
+		}
+		str, ok1 := args[0].(string)
+		arg, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("expected strings")
+		}
+		return fnct(str, arg), nil
+	}
+}
+
+// strFunc returns the string representation of its argument.
+// Null is represented by an empty string and dates as in ISO 8601.
+func strFunc(args []interface{}) (interface{}, error) {
+	switch val := args[0].(type) {
+	case nil:
+		return "", nil
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05"), nil
+	}
+	return fmt.Sprint(args[0]), nil
+}
+
+// intFunc converts its argument to an integer.
+// Floats are truncated and strings are parsed.
+func intFunc(args []interface{}) (interface{}, error) {
+	switch val := args[0].(type) {
+	case nil:
+		return int64(0), nil
+	case bool:
+		if val {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case int64:
+		return val, nil
+	case float64:
+		return int64(val), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	}
+	return nil, fmt.Errorf("cannot convert %s to integer", typeName(args[0]))
+}
+
+// floatFunc converts its argument to a float. Strings are parsed.
+func floatFunc(args []interface{}) (interface{}, error) {
+	switch val := args[0].(type) {
+	case nil:
+		return float64(0), nil
+	case int64:
+		return float64(val), nil
+	case float64:
+		return val, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(val), 64)
+	}
+	return nil, fmt.Errorf("cannot convert %s to float", typeName(args[0]))
+}
+
+// absFunc returns the absolute value of its number argument
+func absFunc(args []interface{}) (interface{}, error) {
+	switch val := args[0].(type) {
+	case int64:
+		if val < 0 {
+			return -val, nil
+		}
+		return val, nil
+	case float64:
+		return math.Abs(val), nil
+	}
+	return nil, fmt.Errorf("expected number, got %s", typeName(args[0]))
+}
+
+// roundFunc rounds its first argument half away from zero
+// to the number of decimals given by its second argument, 0 by default.
+func roundFunc(args []interface{}) (interface{}, error) {
+	val, ok := toFloat(args[0])
+	if !ok {
+		return nil, fmt.Errorf("expected number, got %s", typeName(args[0]))
+	}
+	var digits int64
+	if len(args) > 1 {
+		if digits, ok = args[1].(int64); !ok {
+			return nil, fmt.Errorf("expected integer, got %s", typeName(args[1]))
+		}
+	}
+	factor := math.Pow(10, float64(digits))
+	rounded := val * factor
+	if rounded < 0 {
+		rounded = math.Ceil(rounded - 0.5)
+	} else {
+		rounded = math.Floor(rounded + 0.5)
+	}
+	return rounded / factor, nil
+}
+
+// extremumFunc returns a function returning the minimum (sign = -1)
+// or the maximum (sign = 1) of its arguments, or of the elements of
+// its single list argument.
+func extremumFunc(sign int) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if list, ok := args[0].([]interface{}); ok && len(args) == 1 {
+			args = list
+		}
+		if len(args) == 0 {
+			return nil, errors.New("empty list")
+		}
+		res := args[0]
+		for _, arg := range args[1:] {
+			cmp, ok := compare(arg, res)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %s and %s", typeName(arg), typeName(res))
+			}
+			if cmp*sign > 0 {
+				res = arg
+			}
+		}
+		return res, nil
+	}
+}
+
+// nowFunc returns the current time in UTC
+func nowFunc(args []interface{}) (interface{}, error) {
+	return time.Now().UTC(), nil
+}
+
+// todayFunc returns the current date in UTC at midnight
+func todayFunc(args []interface{}) (interface{}, error) {
+	return time.Now().UTC().Truncate(24 * time.Hour), nil
+}
+
+// dateFunc parses its string argument as a date (YYYY-MM-DD)
+// or a date and time (YYYY-MM-DD HH:MM:SS) in UTC.
+func dateFunc(args []interface{}) (interface{}, error) {
+	str, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string, got %s", typeName(args[0]))
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05"} {
+		if res, err := time.Parse(layout, str); err == nil {
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid date '%s'", str)
+}
+
+// durationFunc returns a function returning the duration
+// of the given number of units.
+func durationFunc(unit time.Duration) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		val, ok := toFloat(args[0])
+		if !ok {
+			return nil, fmt.Errorf("expected number, got %s", typeName(args[0]))
+		}
+		return time.Duration(val * float64(unit)), nil
+	}
+}
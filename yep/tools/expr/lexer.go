@@ -0,0 +1,154 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package expr
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a lexical token
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenPunct
+)
+
+// A token is a lexical token of an expression
+type token struct {
+	kind  tokenKind
+	pos   int
+	text  string
+	value interface{}
+}
+
+// punctuations are the operators and delimiters of the language,
+// two characters ones first so that they are matched first.
+var punctuations = []string{"==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "."}
+
+// tokenize splits the given source into tokens.
+// The last token is always a tokenEOF.
+func tokenize(src string) ([]token, error) {
+	var res []token
+	pos := 0
+	for pos < len(src) {
+		c := rune(src[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c >= '0' && c <= '9':
+			tok, err := lexNumber(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, tok)
+			pos += len(tok.text)
+		case c == '\'' || c == '"':
+			tok, err := lexString(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, tok)
+			pos += len(tok.text)
+		case isIdentStart(c):
+			end := pos + 1
+			for end < len(src) && (isIdentStart(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			res = append(res, token{kind: tokenIdent, pos: pos, text: src[pos:end]})
+			pos = end
+		default:
+			punct := matchPunctuation(src[pos:])
+			if punct == "" {
+				return nil, newError(src, pos, "unexpected character %q", c)
+			}
+			res = append(res, token{kind: tokenPunct, pos: pos, text: punct})
+			pos += len(punct)
+		}
+	}
+	return append(res, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// isIdentStart returns true if c can start an identifier.
+// Identifiers are made of ASCII letters, digits and underscores.
+func isIdentStart(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// matchPunctuation returns the punctuation at the start of
+// the given string or an empty string if there is none.
+func matchPunctuation(s string) string {
+	for _, p := range punctuations {
+		if strings.HasPrefix(s, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// lexNumber reads the integer or float literal starting at pos in src
+func lexNumber(src string, pos int) (token, error) {
+	end := pos
+	isFloat := false
+	for end < len(src) {
+		c := src[end]
+		if c == '.' && !isFloat && end+1 < len(src) && src[end+1] >= '0' && src[end+1] <= '9' {
+			isFloat = true
+			end++
+			continue
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		end++
+	}
+	text := src[pos:end]
+	if isFloat {
+		val, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return token{}, newError(src, pos, "invalid number %s", text)
+		}
+		return token{kind: tokenNumber, pos: pos, text: text, value: val}, nil
+	}
+	val, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return token{}, newError(src, pos, "invalid number %s", text)
+	}
+	return token{kind: tokenNumber, pos: pos, text: text, value: val}, nil
+}
+
+// lexString reads the quoted string literal starting at pos in src.
+// Backslashes escape the next character.
+func lexString(src string, pos int) (token, error) {
+	quote := src[pos]
+	var val bytes.Buffer
+	for end := pos + 1; end < len(src); end++ {
+		switch src[end] {
+		case '\\':
+			end++
+			if end == len(src) {
+				break
+			}
+			switch src[end] {
+			case 'n':
+				val.WriteByte('\n')
+			case 't':
+				val.WriteByte('\t')
+			default:
+				val.WriteByte(src[end])
+			}
+		case quote:
+			return token{kind: tokenString, pos: pos, text: src[pos : end+1], value: val.String()}, nil
+		default:
+			val.WriteByte(src[end])
+		}
+	}
+	return token{}, newError(src, pos, "unterminated string")
+}
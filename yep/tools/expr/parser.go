@@ -0,0 +1,420 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDepth is the maximum nesting depth of expressions
+const maxDepth = 64
+
+// A Node is a node of the syntax tree of an expression
+type Node interface {
+	// Pos returns the byte offset of the node in the expression source
+	Pos() int
+	// String returns the canonical source of the node
+	String() string
+}
+
+// A Literal is a number, string, boolean or null constant
+type Literal struct {
+	Offset int
+	Value  interface{}
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Literal) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Literal) String() string {
+	switch val := n.Value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", val)
+	}
+	return fmt.Sprint(n.Value)
+}
+
+// An Ident is a variable or a field of the record
+type Ident struct {
+	Offset int
+	Name   string
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Ident) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Ident) String() string { return n.Name }
+
+// An Attr is the access to an attribute of a value, such as x.name
+type Attr struct {
+	Offset int
+	X      Node
+	Name   string
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Attr) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Attr) String() string { return fmt.Sprintf("%s.%s", n.X, n.Name) }
+
+// A List is a list of expressions between brackets
+type List struct {
+	Offset int
+	Elems  []Node
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *List) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *List) String() string { return fmt.Sprintf("[%s]", joinNodes(n.Elems)) }
+
+// A Call is a call to one of the functions of the language
+type Call struct {
+	Offset int
+	Func   string
+	Args   []Node
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Call) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Call) String() string { return fmt.Sprintf("%s(%s)", n.Func, joinNodes(n.Args)) }
+
+// A Unary is an operation on a single operand, i.e. "not" or "-"
+type Unary struct {
+	Offset int
+	Op     string
+	X      Node
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Unary) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Unary) String() string {
+	if n.Op == "not" {
+		return fmt.Sprintf("not %s", n.X)
+	}
+	return fmt.Sprintf("%s%s", n.Op, n.X)
+}
+
+// A Binary is an operation on two operands, such as "and", "==" or "+"
+type Binary struct {
+	Offset int
+	Op     string
+	X, Y   Node
+}
+
+// Pos returns the byte offset of the node in the expression source
+func (n *Binary) Pos() int { return n.Offset }
+
+// String returns the canonical source of the node
+func (n *Binary) String() string { return fmt.Sprintf("(%s %s %s)", n.X, n.Op, n.Y) }
+
+// joinNodes returns the sources of the given nodes separated by commas
+func joinNodes(nodes []Node) string {
+	strs := make([]string, len(nodes))
+	for i, n := range nodes {
+		strs[i] = n.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// keywordLiterals are the identifiers that are literal values
+var keywordLiterals = map[string]interface{}{
+	"true":  true,
+	"false": false,
+	"null":  nil,
+	"True":  true,
+	"False": false,
+	"None":  nil,
+}
+
+// reservedWords are the identifiers that cannot be used as names
+var reservedWords = map[string]bool{
+	"and": true,
+	"or":  true,
+	"not": true,
+	"in":  true,
+}
+
+// comparisonOperators are the binary operators returning a boolean
+var comparisonOperators = map[string]bool{
+	"==":     true,
+	"!=":     true,
+	"<":      true,
+	"<=":     true,
+	">":      true,
+	">=":     true,
+	"in":     true,
+	"not in": true,
+}
+
+// A parser builds the syntax tree of an expression from its tokens
+// by recursive descent, one function per precedence level.
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// parse returns the syntax tree of the given source
+func parse(src string) (Node, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{src: src, tokens: tokens}
+	var node Node
+	err = catchError(func() {
+		node = p.parseOr()
+		if tok := p.peek(); tok.kind != tokenEOF {
+			p.fail(tok.pos, "unexpected %s", describeToken(tok))
+		}
+	})
+	return node, err
+}
+
+// peek returns the current token
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next returns the current token and moves to the next one
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isPunct returns true if the current token is the given punctuation
+func (p *parser) isPunct(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokenPunct && tok.text == text
+}
+
+// isKeyword returns true if the current token is the given keyword
+func (p *parser) isKeyword(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && tok.text == text
+}
+
+// expect consumes the current token which must be the given punctuation
+func (p *parser) expect(text string) {
+	if !p.isPunct(text) {
+		tok := p.peek()
+		p.fail(tok.pos, "expected '%s', got %s", text, describeToken(tok))
+	}
+	p.next()
+}
+
+// fail aborts parsing with an error at the given position
+func (p *parser) fail(pos int, format string, args ...interface{}) {
+	panic(newError(p.src, pos, format, args...))
+}
+
+// enter increments the nesting depth and fails if it is too deep
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxDepth {
+		p.fail(p.peek().pos, "expression is nested too deeply")
+	}
+}
+
+// leave decrements the nesting depth
+func (p *parser) leave() {
+	p.depth--
+}
+
+// parseOr parses "x or y"
+func (p *parser) parseOr() Node {
+	node := p.parseAnd()
+	for p.isKeyword("or") {
+		tok := p.next()
+		node = &Binary{Offset: tok.pos, Op: "or", X: node, Y: p.parseAnd()}
+	}
+	return node
+}
+
+// parseAnd parses "x and y"
+func (p *parser) parseAnd() Node {
+	node := p.parseNot()
+	for p.isKeyword("and") {
+		tok := p.next()
+		node = &Binary{Offset: tok.pos, Op: "and", X: node, Y: p.parseNot()}
+	}
+	return node
+}
+
+// parseNot parses "not x"
+func (p *parser) parseNot() Node {
+	if !p.isKeyword("not") {
+		return p.parseComparison()
+	}
+	tok := p.next()
+	p.enter()
+	defer p.leave()
+	return &Unary{Offset: tok.pos, Op: "not", X: p.parseNot()}
+}
+
+// parseComparison parses "x == y" and other comparisons,
+// which cannot be chained.
+func (p *parser) parseComparison() Node {
+	node := p.parseAdditive()
+	op, pos := p.comparisonOperator()
+	if op == "" {
+		return node
+	}
+	node = &Binary{Offset: pos, Op: op, X: node, Y: p.parseAdditive()}
+	if op, pos = p.comparisonOperator(); op != "" {
+		p.fail(pos, "comparisons cannot be chained")
+	}
+	return node
+}
+
+// comparisonOperator consumes and returns the comparison operator at the
+// current position with its position, or returns an empty string if there
+// is none.
+func (p *parser) comparisonOperator() (string, int) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokenPunct && comparisonOperators[tok.text]:
+		p.next()
+		return tok.text, tok.pos
+	case p.isKeyword("in"):
+		p.next()
+		return "in", tok.pos
+	case p.isKeyword("not") && p.tokens[p.pos+1].kind == tokenIdent && p.tokens[p.pos+1].text == "in":
+		p.next()
+		p.next()
+		return "not in", tok.pos
+	}
+	return "", 0
+}
+
+// parseAdditive parses "x + y" and "x - y"
+func (p *parser) parseAdditive() Node {
+	node := p.parseMultiplicative()
+	for p.isPunct("+") || p.isPunct("-") {
+		tok := p.next()
+		node = &Binary{Offset: tok.pos, Op: tok.text, X: node, Y: p.parseMultiplicative()}
+	}
+	return node
+}
+
+// parseMultiplicative parses "x * y", "x / y" and "x % y"
+func (p *parser) parseMultiplicative() Node {
+	node := p.parseUnary()
+	for p.isPunct("*") || p.isPunct("/") || p.isPunct("%") {
+		tok := p.next()
+		node = &Binary{Offset: tok.pos, Op: tok.text, X: node, Y: p.parseUnary()}
+	}
+	return node
+}
+
+// parseUnary parses "-x"
+func (p *parser) parseUnary() Node {
+	if !p.isPunct("-") {
+		return p.parsePostfix()
+	}
+	tok := p.next()
+	p.enter()
+	defer p.leave()
+	return &Unary{Offset: tok.pos, Op: "-", X: p.parseUnary()}
+}
+
+// parsePostfix parses attribute accesses "x.name"
+func (p *parser) parsePostfix() Node {
+	node := p.parsePrimary()
+	for p.isPunct(".") {
+		p.next()
+		tok := p.next()
+		if tok.kind != tokenIdent || reservedWords[tok.text] {
+			p.fail(tok.pos, "expected attribute name, got %s", describeToken(tok))
+		}
+		node = &Attr{Offset: tok.pos, X: node, Name: tok.text}
+	}
+	return node
+}
+
+// parsePrimary parses literals, names, function calls,
+// lists and expressions between parentheses.
+func (p *parser) parsePrimary() Node {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber, tokenString:
+		return &Literal{Offset: tok.pos, Value: tok.value}
+	case tokenIdent:
+		if val, ok := keywordLiterals[tok.text]; ok {
+			return &Literal{Offset: tok.pos, Value: val}
+		}
+		if reservedWords[tok.text] {
+			p.fail(tok.pos, "unexpected '%s'", tok.text)
+		}
+		if !p.isPunct("(") {
+			return &Ident{Offset: tok.pos, Name: tok.text}
+		}
+		fnct, ok := functions[tok.text]
+		if !ok {
+			p.fail(tok.pos, "unknown function '%s'", tok.text)
+		}
+		p.next()
+		p.enter()
+		defer p.leave()
+		args := p.parseNodes(")")
+		if len(args) < fnct.minArgs || (fnct.maxArgs >= 0 && len(args) > fnct.maxArgs) {
+			p.fail(tok.pos, "wrong number of arguments for function '%s'", tok.text)
+		}
+		return &Call{Offset: tok.pos, Func: tok.text, Args: args}
+	case tokenPunct:
+		switch tok.text {
+		case "(":
+			p.enter()
+			defer p.leave()
+			node := p.parseOr()
+			p.expect(")")
+			return node
+		case "[":
+			p.enter()
+			defer p.leave()
+			return &List{Offset: tok.pos, Elems: p.parseNodes("]")}
+		}
+	}
+	p.fail(tok.pos, "unexpected %s", describeToken(tok))
+	return nil
+}
+
+// parseNodes parses a comma separated list of expressions
+// up to the given closing punctuation, which is consumed.
+func (p *parser) parseNodes(closing string) []Node {
+	var res []Node
+	for !p.isPunct(closing) {
+		res = append(res, p.parseOr())
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	p.expect(closing)
+	return res
+}
+
+// describeToken returns a description of the given token for error messages
+func describeToken(tok token) string {
+	if tok.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", tok.text)
+}
@@ -40,6 +40,9 @@ type methodData struct {
 	Returns        string
 	ReturnString   string
 	Call           string
+	CallParams     string
+	ZeroVars       string
+	ZeroReturns    string
 }
 
 // an operatorDef defines an operator func
@@ -126,12 +129,16 @@ func addMethodsToModelData(modelsASTData map[string]ModelASTData, modelData *mod
 		if specificMethods[methodName] {
 			continue
 		}
-		var params, paramsWithType, call, returns, returnAsserts, returnString string
+		var params, paramsWithType, callParams, call, returns, returnAsserts, returnString string
+		var returnTypes []string
 		for _, astParam := range methodASTData.Params {
 			paramType := astParam.Type.Type
+			callParam := astParam.Name
 			if astParam.Variadic {
 				paramType = fmt.Sprintf("...%s", paramType)
+				callParam += "..."
 			}
+			callParams += fmt.Sprintf("%s,", callParam)
 			p := fmt.Sprintf("%s,", astParam.Name)
 			if isRS, isRC := isRecordSetType(astParam.Type.Type, modelsASTData); isRS {
 				p = fmt.Sprintf("%s.RecordCollection,", astParam.Name)
@@ -157,6 +164,7 @@ func addMethodsToModelData(modelsASTData map[string]ModelASTData, modelData *mod
 				returns = fmt.Sprintf("%s{RecordCollection: resTyped}", typ)
 			}
 			returnString = typ
+			returnTypes = append(returnTypes, typ)
 		} else if len(methodASTData.Returns) > 1 {
 			for i, ret := range methodASTData.Returns {
 				call = "CallMulti"
@@ -169,13 +177,22 @@ func addMethodsToModelData(modelsASTData map[string]ModelASTData, modelData *mod
 					returnAsserts += fmt.Sprintf("resTyped%d := res[%d].(models.RecordSet).Collection()\n", i, i)
 					returns += fmt.Sprintf("%s{RecordCollection: resTyped%d},", retType, i)
 					returnString += fmt.Sprintf("%s,", retType)
+					returnTypes = append(returnTypes, retType)
 				} else {
 					returnAsserts += fmt.Sprintf("resTyped%d, _ := res[%d].(%s)\n", i, i, ret.Type)
 					returns += fmt.Sprintf("resTyped%d,", i)
 					returnString += fmt.Sprintf("%s,", ret.Type)
+					returnTypes = append(returnTypes, ret.Type)
 				}
 			}
 		}
+		// Zero values of the return types for mocks. Types are taken one by
+		// one since they may contain commas, e.g. func(a, b int) error.
+		var zeroVars, zeroReturns string
+		for i, retType := range returnTypes {
+			zeroVars += fmt.Sprintf("var r%d %s\n", i, retType)
+			zeroReturns += fmt.Sprintf("r%d,", i)
+		}
 		modelData.Methods = append(modelData.Methods, methodData{
 			Name:           methodName,
 			Doc:            methodASTData.Doc,
@@ -185,6 +202,9 @@ func addMethodsToModelData(modelsASTData map[string]ModelASTData, modelData *mod
 			Returns:        strings.TrimSuffix(returns, ","),
 			ReturnString:   strings.TrimSuffix(returnString, ","),
 			Call:           call,
+			CallParams:     strings.TrimRight(callParams, ","),
+			ZeroVars:       strings.TrimSuffix(zeroVars, "\n"),
+			ZeroReturns:    strings.TrimSuffix(zeroReturns, ","),
 		})
 	}
 }
@@ -225,7 +245,7 @@ func addFieldTypesToModelData(mData *modelData) {
 				{Name: "Equals"}, {Name: "NotEquals"}, {Name: "Greater"}, {Name: "GreaterOrEqual"}, {Name: "Lower"},
 				{Name: "LowerOrEqual"}, {Name: "LikePattern"}, {Name: "Like"}, {Name: "NotLike"}, {Name: "ILike"},
 				{Name: "NotILike"}, {Name: "ILikePattern"}, {Name: "In", Multi: true}, {Name: "NotIn", Multi: true},
-				{Name: "ChildOf"},
+				{Name: "ChildOf"}, {Name: "ParentOf"},
 			},
 		})
 	}
@@ -299,6 +319,18 @@ func (m {{ .Name }}Model) Create(env models.Environment, data interface{}) {{ .N
 	}
 }
 
+// CreateMulti creates a new {{ .Name }} record for each of the given data
+// in a single query and returns the created records in the order of data.
+func (m {{ .Name }}Model) CreateMulti(env models.Environment, data []{{ .Name }}Data) {{ .Name }}Set {
+	fMaps := make([]models.FieldMap, len(data))
+	for i, d := range data {
+		fMaps[i] = d.FieldMap()
+	}
+	return {{ .Name }}Set{
+		RecordCollection: m.Model.CreateMulti(env, fMaps),
+	}
+}
+
 // Search searches the database and returns a new {{ .Name }}Set instance
 // with the records found.
 func (m {{ .Name }}Model) Search(env models.Environment, cond {{ .Name }}Condition) {{ .Name }}Set {
@@ -307,6 +339,15 @@ func (m {{ .Name }}Model) Search(env models.Environment, cond {{ .Name }}Conditi
 	}
 }
 
+// ActiveRecords returns the {{ .Name }} records on which the action
+// being executed by rs has been launched, typically the records a wizard
+// has been opened on. It panics if the active records are of another model.
+func (m {{ .Name }}Model) ActiveRecords(rs models.RecordSet) {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: rs.Collection().ActiveRecordsOf("{{ .Name }}"),
+	}
+}
+
 // Fields returns the Field Collection of the {{ .Name }} Model
 func (m {{ .Name }}Model) Fields() {{ .Name }}FieldsCollection {
 	return {{ .Name }}FieldsCollection {
@@ -524,6 +565,50 @@ func (s {{ .Name }}Set) Records() []{{ .Name }}Set {
 	return res
 }
 
+// Record returns the i-th record of this RecordSet as a singleton {{ .Name }}Set.
+// It panics if i is out of range.
+func (s {{ .Name }}Set) Record(i int) {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: s.RecordCollection.Record(i),
+	}
+}
+
+// FirstRecord returns the first record of this RecordSet as a singleton
+// {{ .Name }}Set, or an empty {{ .Name }}Set if this RecordSet is empty.
+func (s {{ .Name }}Set) FirstRecord() {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: s.RecordCollection.FirstRecord(),
+	}
+}
+
+// LastRecord returns the last record of this RecordSet as a singleton
+// {{ .Name }}Set, or an empty {{ .Name }}Set if this RecordSet is empty.
+func (s {{ .Name }}Set) LastRecord() {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: s.RecordCollection.LastRecord(),
+	}
+}
+
+// Filtered returns a new {{ .Name }}Set with the records of this RecordSet
+// for which fnct returns true.
+func (s {{ .Name }}Set) Filtered(fnct func({{ .Name }}Set) bool) {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: s.RecordCollection.Filtered(func(rc models.RecordCollection) bool {
+			return fnct({{ .Name }}Set{RecordCollection: rc})
+		}),
+	}
+}
+
+// Sorted returns a new {{ .Name }}Set with the records of this RecordSet
+// sorted according to the given less function. The sort is stable.
+func (s {{ .Name }}Set) Sorted(less func(rs1, rs2 {{ .Name }}Set) bool) {{ .Name }}Set {
+	return {{ .Name }}Set{
+		RecordCollection: s.RecordCollection.Sorted(func(rc1, rc2 models.RecordCollection) bool {
+			return less({{ .Name }}Set{RecordCollection: rc1}, {{ .Name }}Set{RecordCollection: rc2})
+		}),
+	}
+}
+
 // Search returns a new {{ $.Name }}Set filtering on the current one with the
 // additional given Condition
 func (s {{ $.Name }}Set) Search(condition {{ .Name }}Condition) {{ .Name }}Set {
@@ -597,5 +682,97 @@ func (s {{ $.Name }}Set) {{ .Name }}({{ .ParamsWithType }}) ({{ .ReturnString }}
 {{- end }}
 }
 
+{{ end }}
+
+// ------- INTERFACE ---------
+
+// {{ .Name }}Interface is the interface of {{ .Name }}Set accessors and methods.
+//
+// Business logic that only depends on {{ .Name }}Interface instead of {{ .Name }}Set
+// can be unit tested with a {{ .Name }}Mock, without database nor registry.
+type {{ .Name }}Interface interface {
+	First() {{ .Name }}Data
+	All() []{{ .Name }}Data
+{{- range .Fields }}
+	{{ .Name }}() {{ .Type }}
+	Set{{ .Name }}(value {{ .Type }})
+{{- end }}
+{{- range .Methods }}
+	{{ .Name }}({{ .ParamsWithType }}) ({{ .ReturnString }})
+{{- end }}
+}
+
+var _ {{ .Name }}Interface = {{ .Name }}Set{}
+
+// ------- MOCK ---------
+
+// {{ .Name }}Mock is a mock implementation of {{ .Name }}Interface.
+//
+// Each method of {{ .Name }}Mock calls the function of the corresponding
+// field (e.g. FirstFunc for First) if it is set, and returns the Go zero
+// values otherwise.
+type {{ .Name }}Mock struct {
+	FirstFunc func() {{ .Name }}Data
+	AllFunc func() []{{ .Name }}Data
+{{- range .Fields }}
+	{{ .Name }}Func func() {{ .Type }}
+	Set{{ .Name }}Func func(value {{ .Type }})
+{{- end }}
+{{- range .Methods }}
+	{{ .Name }}Func func({{ .ParamsWithType }}) ({{ .ReturnString }})
+{{- end }}
+}
+
+var _ {{ .Name }}Interface = new({{ .Name }}Mock)
+
+// First calls FirstFunc if set or returns an empty {{ .Name }}Data
+func (mock *{{ .Name }}Mock) First() {{ .Name }}Data {
+	if mock.FirstFunc != nil {
+		return mock.FirstFunc()
+	}
+	return {{ .Name }}Data{}
+}
+
+// All calls AllFunc if set or returns nil
+func (mock *{{ .Name }}Mock) All() []{{ .Name }}Data {
+	if mock.AllFunc != nil {
+		return mock.AllFunc()
+	}
+	return nil
+}
+
+{{ range .Fields }}
+// {{ .Name }} calls {{ .Name }}Func if set or returns the Go zero value
+func (mock *{{ $.Name }}Mock) {{ .Name }}() {{ .Type }} {
+	if mock.{{ .Name }}Func != nil {
+		return mock.{{ .Name }}Func()
+	}
+	var res {{ .Type }}
+	return res
+}
+
+// Set{{ .Name }} calls Set{{ .Name }}Func if set
+func (mock *{{ $.Name }}Mock) Set{{ .Name }}(value {{ .Type }}) {
+	if mock.Set{{ .Name }}Func != nil {
+		mock.Set{{ .Name }}Func(value)
+	}
+}
+{{ end }}
+
+{{ range .Methods }}
+// {{ .Name }} calls {{ .Name }}Func if set or returns the Go zero values
+func (mock *{{ $.Name }}Mock) {{ .Name }}({{ .ParamsWithType }}) ({{ .ReturnString }}) {
+{{- if eq .Returns "" }}
+	if mock.{{ .Name }}Func != nil {
+		mock.{{ .Name }}Func({{ .CallParams }})
+	}
+{{- else }}
+	if mock.{{ .Name }}Func != nil {
+		return mock.{{ .Name }}Func({{ .CallParams }})
+	}
+	{{ .ZeroVars }}
+	return {{ .ZeroReturns }}
+{{- end }}
+}
 {{ end }}
 `))
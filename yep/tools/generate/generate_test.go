@@ -0,0 +1,95 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package generate
+
+import (
+	"go/ast"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/tools/go/loader"
+)
+
+var methodsSrc = `
+package models
+
+type RecordCollection struct{}
+
+func ComputeTotal(rs RecordCollection, values map[string]int, names ...string) (check func(a, b int) error, counts map[string]int, n, m int64) {
+	return nil, nil, 0, 0
+}
+
+func Reset(rs RecordCollection) {}
+`
+
+// loadTestMethods returns the MethodASTData of the functions of methodsSrc
+func loadTestMethods() map[string]MethodASTData {
+	conf := loader.Config{}
+	file, err := conf.ParseFile("methods.go", methodsSrc)
+	So(err, ShouldBeNil)
+	conf.CreateFromFiles("models", file)
+	program, err := conf.Load()
+	So(err, ShouldBeNil)
+	currentFileSet = program.Fset
+	modInfo := NewModuleInfo(program.Created[0], Base)
+	res := make(map[string]MethodASTData)
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		res[fd.Name.Name] = MethodASTData{
+			Name:    fd.Name.Name,
+			Params:  extractParams(fd.Type, modInfo),
+			Returns: extractReturnType(fd.Type, modInfo),
+		}
+	}
+	return res
+}
+
+func TestMethodsGeneration(t *testing.T) {
+	Convey("Parsing method signatures", t, func() {
+		methods := loadTestMethods()
+		computeTotal := methods["ComputeTotal"]
+		So(computeTotal.Params, ShouldHaveLength, 2)
+		So(computeTotal.Params[0].Type.Type, ShouldEqual, "map[string]int")
+		So(computeTotal.Params[1].Variadic, ShouldBeTrue)
+		So(computeTotal.Params[1].Type.Type, ShouldEqual, "string")
+		So(computeTotal.Returns, ShouldHaveLength, 4)
+		So(computeTotal.Returns[0].Type, ShouldEqual, "func(a int, b int) error")
+		So(computeTotal.Returns[1].Type, ShouldEqual, "map[string]int")
+		So(computeTotal.Returns[2].Type, ShouldEqual, "int64")
+		So(computeTotal.Returns[3].Type, ShouldEqual, "int64")
+		So(methods["Reset"].Returns, ShouldBeEmpty)
+	})
+	Convey("Generating mock methods data", t, func() {
+		modelsASTData := map[string]ModelASTData{
+			"Partner": {
+				Name:    "Partner",
+				Methods: loadTestMethods(),
+			},
+		}
+		mData := modelData{Name: "Partner"}
+		depsMap := make(map[string]bool)
+		addMethodsToModelData(modelsASTData, &mData, &depsMap)
+		methods := make(map[string]methodData)
+		for _, m := range mData.Methods {
+			methods[m.Name] = m
+		}
+		computeTotal := methods["ComputeTotal"]
+		So(computeTotal.Call, ShouldEqual, "CallMulti")
+		So(computeTotal.ParamsWithType, ShouldEqual, "values map[string]int,names ...string")
+		So(computeTotal.CallParams, ShouldEqual, "values,names...")
+		So(computeTotal.ReturnString, ShouldEqual, "func(a int, b int) error,map[string]int,int64,int64")
+		So(computeTotal.ZeroVars, ShouldEqual, `var r0 func(a int, b int) error
+var r1 map[string]int
+var r2 int64
+var r3 int64`)
+		So(computeTotal.ZeroReturns, ShouldEqual, "r0,r1,r2,r3")
+		reset := methods["Reset"]
+		So(reset.Call, ShouldBeEmpty)
+		So(reset.ZeroVars, ShouldBeEmpty)
+		So(reset.ZeroReturns, ShouldBeEmpty)
+	})
+}
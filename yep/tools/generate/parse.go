@@ -192,6 +192,8 @@ func GetModelsASTDataForModules(modInfos []*ModuleInfo) map[string]ModelASTData
 						parseAddMethod(node, modInfo, &modelsData)
 					case fnctName == "InheritModel":
 						parseMixInModel(node, &modelsData)
+					case fnctName == "AddActiveField":
+						parseAddActiveField(node, &modelsData)
 					case strings.HasPrefix(fnctName, "Add") && strings.HasSuffix(fnctName, "Field"):
 						parseAddField(node, modInfo, &modelsData)
 					case strings.HasPrefix(fnctName, "New") && strings.HasSuffix(fnctName, "Model"):
@@ -322,6 +324,24 @@ func parseAddField(node *ast.CallExpr, modInfo *ModuleInfo, modelsData *map[stri
 	(*modelsData)[modelName].Fields[fieldName] = fData
 }
 
+// parseAddActiveField parses the given node which is an AddActiveField function
+func parseAddActiveField(node *ast.CallExpr, modelsData *map[string]ModelASTData) {
+	fNode := node.Fun.(*ast.SelectorExpr)
+	modelName, err := extractModel(fNode.X)
+	if err != nil {
+		log.Panic("Unable to extract model while visiting AST", "error", err)
+	}
+	if _, exists := (*modelsData)[modelName]; !exists {
+		(*modelsData)[modelName] = newModelASTData(modelName)
+	}
+	(*modelsData)[modelName].Fields["Active"] = FieldASTData{
+		Name: "Active",
+		Type: TypeData{
+			Type: "bool",
+		},
+	}
+}
+
 // parseAddMethod parses the given node which is an AddMethod function
 func parseAddMethod(node *ast.CallExpr, modInfo *ModuleInfo, modelsData *map[string]ModelASTData) {
 	fNode := node.Fun.(*ast.SelectorExpr)
@@ -477,13 +497,16 @@ func getTypeData(typ ast.Expr, modInfo *ModuleInfo) TypeData {
 	}
 }
 
-// extractReturnType returns the return type of the first returned value
-// of the given FuncType as a string and an import path if needed.
+// extractReturnType returns the types of the returned values of the
+// given FuncType with their import path if needed.
 func extractReturnType(ft *ast.FuncType, modInfo *ModuleInfo) []TypeData {
 	var res []TypeData
 	if ft.Results != nil {
 		for _, l := range ft.Results.List {
-			res = append(res, getTypeData(l.Type, modInfo))
+			// Named results may share their type, e.g. (a, b int)
+			for i := 0; i == 0 || i < len(l.Names); i++ {
+				res = append(res, getTypeData(l.Type, modInfo))
+			}
 		}
 	}
 	return res
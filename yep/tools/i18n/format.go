@@ -0,0 +1,209 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package i18n
+
+import (
+	"bytes"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/npiganeau/yep/yep/tools"
+)
+
+// A SymbolPosition defines whether a currency symbol
+// is written before or after the amount.
+type SymbolPosition string
+
+const (
+	// SymbolBefore writes the currency symbol before the amount
+	SymbolBefore SymbolPosition = "before"
+	// SymbolAfter writes the currency symbol after the amount
+	SymbolAfter SymbolPosition = "after"
+)
+
+// symbolSep separates a currency symbol from the amount
+const symbolSep = " "
+
+// strftimeToGo maps strftime directives to Go time layout elements
+var strftimeToGo = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'B': "January", 'b': "Jan",
+	'A': "Monday", 'a': "Mon", 'H': "15", 'I': "03", 'M': "04", 'S': "05",
+	'p': "PM", '%': "%",
+}
+
+// strftimeToExcel maps strftime directives to Excel number format elements
+var strftimeToExcel = map[byte]string{
+	'Y': "yyyy", 'y': "yy", 'm': "mm", 'd': "dd", 'B': "mmmm", 'b': "mmm",
+	'A': "dddd", 'a': "ddd", 'H': "hh", 'I': "hh", 'M': "mm", 'S': "ss",
+	'p': "AM/PM", '%': "%",
+}
+
+// A Formatter formats numbers, amounts and dates according
+// to the parameters of a language.
+type Formatter struct {
+	Params tools.LangParameters
+}
+
+// Formatter returns a Formatter for the language with the given code.
+// Unknown languages are formatted with left-to-right default parameters.
+func (tc *Collection) Formatter(lang string) Formatter {
+	return Formatter{Params: tc.LangParameters(lang)}
+}
+
+// Number returns value formatted with the given number of digits after the
+// decimal point, with the decimal point and thousands separator of the language.
+func (f Formatter) Number(value float64, digits int) string {
+	if digits < 0 {
+		digits = 0
+	}
+	str := strconv.FormatFloat(math.Abs(value), 'f', digits, 64)
+	intPart, fracPart := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		intPart, fracPart = str[:i], str[i+1:]
+	}
+	var res bytes.Buffer
+	if value < 0 && strings.Trim(str, "0.") != "" {
+		res.WriteString("-")
+	}
+	res.WriteString(groupDigits(intPart, f.grouping(), f.Params.ThousandsSep))
+	if fracPart != "" {
+		decimalPoint := f.Params.DecimalPoint
+		if decimalPoint == "" {
+			decimalPoint = defaultLangParameters.DecimalPoint
+		}
+		res.WriteString(decimalPoint)
+		res.WriteString(fracPart)
+	}
+	return res.String()
+}
+
+// Amount returns value formatted as Number with the given currency symbol
+// written at the given position. If position is empty, SymbolAfter is used.
+func (f Formatter) Amount(value float64, digits int, symbol string, position SymbolPosition) string {
+	res := f.Number(value, digits)
+	switch {
+	case symbol == "":
+		return res
+	case position == SymbolBefore:
+		return symbol + symbolSep + res
+	default:
+		return res + symbolSep + symbol
+	}
+}
+
+// Date returns the date part of t in the date format of the language
+func (f Formatter) Date(t time.Time) string {
+	return t.Format(f.DateLayout())
+}
+
+// DateTime returns t in the date and time formats of the language
+func (f Formatter) DateTime(t time.Time) string {
+	return t.Format(f.DateTimeLayout())
+}
+
+// DateLayout returns the date format of the language as a Go time layout
+func (f Formatter) DateLayout() string {
+	return convertStrftime(f.dateFormat(), strftimeToGo)
+}
+
+// DateTimeLayout returns the date and time formats of the
+// language as a Go time layout
+func (f Formatter) DateTimeLayout() string {
+	return convertStrftime(f.dateFormat()+" "+f.timeFormat(), strftimeToGo)
+}
+
+// ExcelDateFormat returns the date format of the language as an Excel
+// number format, to be set on the date cells of spreadsheet documents.
+func (f Formatter) ExcelDateFormat() string {
+	return convertStrftime(f.dateFormat(), strftimeToExcel)
+}
+
+// ExcelDateTimeFormat returns the date and time formats of the
+// language as an Excel number format.
+func (f Formatter) ExcelDateTimeFormat() string {
+	return convertStrftime(f.dateFormat()+" "+f.timeFormat(), strftimeToExcel)
+}
+
+// FuncMap returns the formatting functions of this Formatter to be used in
+// templates as formatNumber, formatAmount, formatDate and formatDateTime.
+func (f Formatter) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"formatNumber": f.Number,
+		"formatAmount": func(value float64, digits int, symbol string, position string) string {
+			return f.Amount(value, digits, symbol, SymbolPosition(position))
+		},
+		"formatDate":     f.Date,
+		"formatDateTime": f.DateTime,
+	}
+}
+
+// dateFormat returns the strftime date format of the language
+func (f Formatter) dateFormat() string {
+	if f.Params.DateFormat == "" {
+		return defaultLangParameters.DateFormat
+	}
+	return f.Params.DateFormat
+}
+
+// timeFormat returns the strftime time format of the language
+func (f Formatter) timeFormat() string {
+	if f.Params.TimeFormat == "" {
+		return defaultLangParameters.TimeFormat
+	}
+	return f.Params.TimeFormat
+}
+
+// grouping returns the sizes of the digit groups of the language,
+// parsed from its Grouping parameter such as "[3,0]".
+func (f Formatter) grouping() []int {
+	var res []int
+	for _, tok := range strings.Split(strings.Trim(f.Params.Grouping, "[] "), ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(tok))
+		if err != nil {
+			continue
+		}
+		res = append(res, size)
+	}
+	return res
+}
+
+// groupDigits inserts sep between the groups of digits of intPart.
+// grouping gives the sizes of the groups from the right: a 0 repeats the
+// previous size for all remaining digits and a negative value stops grouping.
+func groupDigits(intPart string, grouping []int, sep string) string {
+	if sep == "" || len(grouping) == 0 {
+		return intPart
+	}
+	var groups []string
+	size := 0
+	for i := 0; len(intPart) > 0; i++ {
+		if i < len(grouping) && grouping[i] != 0 {
+			size = grouping[i]
+		}
+		if size <= 0 || size >= len(intPart) {
+			break
+		}
+		groups = append([]string{intPart[len(intPart)-size:]}, groups...)
+		intPart = intPart[:len(intPart)-size]
+	}
+	return strings.Join(append([]string{intPart}, groups...), sep)
+}
+
+// convertStrftime converts the given strftime format with the given
+// directives mapping. Unknown directives are dropped.
+func convertStrftime(format string, directives map[byte]string) string {
+	var res bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			res.WriteByte(format[i])
+			continue
+		}
+		i++
+		res.WriteString(directives[format[i]])
+	}
+	return res.String()
+}
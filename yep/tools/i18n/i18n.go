@@ -0,0 +1,185 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package i18n holds the translations of the static strings of the application,
+such as the labels of the views, by language, and the metadata of the languages
+such as their direction and their number and date formats.
+*/
+package i18n
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/npiganeau/yep/yep/tools"
+)
+
+// Registry is the translations registry of the application
+var Registry *Collection
+
+// A Collection holds the translations of source strings by language
+type Collection struct {
+	sync.RWMutex
+	translations map[string]map[string]string
+	languages    map[string]Language
+	generation   int64
+	pseudo       bool
+}
+
+// NewCollection returns a pointer to a new Collection instance
+func NewCollection() *Collection {
+	return &Collection{
+		translations: make(map[string]map[string]string),
+		languages:    make(map[string]Language),
+	}
+}
+
+// Add registers translation as the translation of source in the given
+// language, replacing any previous translation.
+func (tc *Collection) Add(lang, source, translation string) {
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.translations[lang] == nil {
+		tc.translations[lang] = make(map[string]string)
+	}
+	tc.translations[lang][source] = translation
+	tc.generation++
+}
+
+// Load registers the given translations of source strings in the
+// given language, replacing any previous translation of these strings.
+func (tc *Collection) Load(lang string, translations map[string]string) {
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.translations[lang] == nil {
+		tc.translations[lang] = make(map[string]string)
+	}
+	for source, translation := range translations {
+		tc.translations[lang][source] = translation
+	}
+	tc.generation++
+}
+
+// Translate returns the translation of source in the given language,
+// or source itself if it has no translation in this language.
+//
+// If the pseudo language is enabled and lang is PseudoLanguage,
+// the pseudo-localized source is returned.
+func (tc *Collection) Translate(lang, source string) string {
+	tc.RLock()
+	defer tc.RUnlock()
+	if tc.pseudo && lang == PseudoLanguage {
+		return Pseudolocalize(source)
+	}
+	if translation, ok := tc.translations[lang][source]; ok && translation != "" {
+		return translation
+	}
+	return source
+}
+
+// Generation returns a number that changes each time translations are
+// added to this Collection. It allows to invalidate values computed from
+// translations.
+func (tc *Collection) Generation() int64 {
+	tc.RLock()
+	defer tc.RUnlock()
+	return tc.generation
+}
+
+// A Language holds the metadata of a language
+type Language struct {
+	// Code is the locale code of the language, e.g. "fr_FR"
+	Code   string
+	Name   string
+	Params tools.LangParameters
+}
+
+// IsRTL returns true if this language is written from right to left
+func (l Language) IsRTL() bool {
+	return l.Params.Direction == tools.LangDirectionRTL
+}
+
+// defaultLangParameters are the parameters of languages
+// that have not been registered.
+var defaultLangParameters = tools.LangParameters{
+	DateFormat:   "%m/%d/%Y",
+	TimeFormat:   "%H:%M:%S",
+	Direction:    tools.LangDirectionLTR,
+	DecimalPoint: ".",
+	ThousandsSep: ",",
+	Grouping:     "[3,0]",
+}
+
+// AddLanguage registers the given language, replacing any
+// previously registered language with the same code.
+func (tc *Collection) AddLanguage(lang Language) {
+	tc.Lock()
+	defer tc.Unlock()
+	if lang.Params.Direction == "" {
+		lang.Params.Direction = tools.LangDirectionLTR
+	}
+	tc.languages[lang.Code] = lang
+}
+
+// GetLanguage returns the language with the given code. If there is none,
+// it returns a registered language with the same language part of the code,
+// e.g. "ar_SY" for "ar". The second returned value is false if no language
+// is found.
+func (tc *Collection) GetLanguage(code string) (Language, bool) {
+	tc.RLock()
+	defer tc.RUnlock()
+	if lang, ok := tc.languages[code]; ok {
+		return lang, true
+	}
+	prefix := strings.Split(code, "_")[0]
+	var res Language
+	for langCode, lang := range tc.languages {
+		if strings.Split(langCode, "_")[0] != prefix {
+			continue
+		}
+		if res.Code == "" || langCode < res.Code {
+			res = lang
+		}
+	}
+	return res, res.Code != ""
+}
+
+// LangParameters returns the direction and the number and date formats of
+// the language with the given code, or default left-to-right parameters if
+// the language is unknown.
+func (tc *Collection) LangParameters(code string) tools.LangParameters {
+	if lang, ok := tc.GetLanguage(code); ok {
+		return lang.Params
+	}
+	return defaultLangParameters
+}
+
+func init() {
+	Registry = NewCollection()
+	Registry.AddLanguage(Language{Code: "en_US", Name: "English (US)", Params: defaultLangParameters})
+	Registry.AddLanguage(Language{Code: "fr_FR", Name: "Français", Params: tools.LangParameters{
+		DateFormat:   "%d/%m/%Y",
+		TimeFormat:   "%H:%M:%S",
+		Direction:    tools.LangDirectionLTR,
+		DecimalPoint: ",",
+		ThousandsSep: "\u00a0",
+		Grouping:     "[3,0]",
+	}})
+	Registry.AddLanguage(Language{Code: "ar_SY", Name: "العربية", Params: tools.LangParameters{
+		DateFormat:   "%d/%m/%Y",
+		TimeFormat:   "%H:%M:%S",
+		Direction:    tools.LangDirectionRTL,
+		DecimalPoint: "٫",
+		ThousandsSep: "٬",
+		Grouping:     "[3,0]",
+	}})
+	Registry.AddLanguage(Language{Code: "he_IL", Name: "עברית", Params: tools.LangParameters{
+		DateFormat:   "%d/%m/%Y",
+		TimeFormat:   "%H:%M:%S",
+		Direction:    tools.LangDirectionRTL,
+		DecimalPoint: ".",
+		ThousandsSep: ",",
+		Grouping:     "[3,0]",
+	}})
+}
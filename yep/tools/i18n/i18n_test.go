@@ -0,0 +1,92 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package i18n
+
+import (
+	"bytes"
+	"html/template"
+	"testing"
+	"time"
+
+	"github.com/npiganeau/yep/yep/tools"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLanguages(t *testing.T) {
+	Convey("Testing language metadata", t, func() {
+		So(Registry.LangParameters("en_US").Direction, ShouldEqual, tools.LangDirectionLTR)
+		So(Registry.LangParameters("he_IL").Direction, ShouldEqual, tools.LangDirectionRTL)
+		So(Registry.LangParameters("fr_FR").DecimalPoint, ShouldEqual, ",")
+		So(Registry.LangParameters("xx_XX"), ShouldResemble, defaultLangParameters)
+	})
+	Convey("Testing language lookup by prefix", t, func() {
+		lang, ok := Registry.GetLanguage("ar")
+		So(ok, ShouldBeTrue)
+		So(lang.Code, ShouldEqual, "ar_SY")
+		So(lang.IsRTL(), ShouldBeTrue)
+		_, ok = Registry.GetLanguage("xx")
+		So(ok, ShouldBeFalse)
+	})
+	Convey("Testing registered languages", t, func() {
+		collection := NewCollection()
+		collection.AddLanguage(Language{Code: "fa_IR", Name: "فارسی", Params: tools.LangParameters{Direction: tools.LangDirectionRTL}})
+		collection.AddLanguage(Language{Code: "de_DE", Name: "Deutsch"})
+		So(collection.LangParameters("fa_IR").Direction, ShouldEqual, tools.LangDirectionRTL)
+		So(collection.LangParameters("de_DE").Direction, ShouldEqual, tools.LangDirectionLTR)
+	})
+}
+
+func TestPseudoLocalization(t *testing.T) {
+	Convey("Testing pseudo-localization", t, func() {
+		collection := NewCollection()
+		So(collection.Translate(PseudoLanguage, "Name"), ShouldEqual, "Name")
+		collection.EnablePseudoLanguage()
+		_, ok := collection.GetLanguage(PseudoLanguage)
+		So(ok, ShouldBeTrue)
+		So(collection.Translate(PseudoLanguage, "Name"), ShouldEqual, Pseudolocalize("Name"))
+		So(Pseudolocalize("Name"), ShouldEqual, "[!! Ñámé ~ !!]")
+		So(Pseudolocalize("Total: %d items"), ShouldEqual, "[!! Ţöţáĺ: %d íţémš ~~~~~~ !!]")
+		So(Pseudolocalize(""), ShouldBeEmpty)
+		So(collection.Translate("fr_FR", "Name"), ShouldEqual, "Name")
+	})
+}
+
+func TestFormatting(t *testing.T) {
+	Convey("Testing locale-aware formatting", t, func() {
+		en := Registry.Formatter("en_US")
+		fr := Registry.Formatter("fr_FR")
+		Convey("Numbers should be grouped and use the decimal point of the language", func() {
+			So(en.Number(1234567.891, 2), ShouldEqual, "1,234,567.89")
+			So(fr.Number(1234567.891, 2), ShouldEqual, "1\u00a0234\u00a0567,89")
+			So(en.Number(-999.5, 0), ShouldEqual, "-1,000")
+			So(en.Number(-0.001, 2), ShouldEqual, "0.00")
+			in := Formatter{Params: tools.LangParameters{DecimalPoint: ".", ThousandsSep: ",", Grouping: "[3,2,0]"}}
+			So(in.Number(12345678, 0), ShouldEqual, "1,23,45,678")
+		})
+		Convey("Amounts should have their currency symbol at the given position", func() {
+			So(en.Amount(1500, 2, "$", SymbolBefore), ShouldEqual, "$\u00a01,500.00")
+			So(fr.Amount(1500, 2, "€", SymbolAfter), ShouldEqual, "1\u00a0500,00\u00a0€")
+			So(fr.Amount(1500, 2, "", SymbolAfter), ShouldEqual, "1\u00a0500,00")
+		})
+		Convey("Dates should be formatted in the language's format", func() {
+			date := time.Date(2017, 3, 8, 14, 5, 9, 0, time.UTC)
+			So(en.Date(date), ShouldEqual, "03/08/2017")
+			So(fr.Date(date), ShouldEqual, "08/03/2017")
+			So(fr.DateTime(date), ShouldEqual, "08/03/2017 14:05:09")
+			So(fr.ExcelDateFormat(), ShouldEqual, "dd/mm/yyyy")
+			So(en.ExcelDateTimeFormat(), ShouldEqual, "mm/dd/yyyy hh:mm:ss")
+		})
+		Convey("Formatting functions should be usable in templates", func() {
+			tmpl := template.Must(template.New("report").Funcs(fr.FuncMap()).Parse(
+				`{{ formatAmount .Total 2 "€" "after" }} - {{ formatDate .Date }}`))
+			var buf bytes.Buffer
+			err := tmpl.Execute(&buf, map[string]interface{}{
+				"Total": 42.5,
+				"Date":  time.Date(2017, 3, 8, 0, 0, 0, 0, time.UTC),
+			})
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual, "42,50\u00a0€ - 08/03/2017")
+		})
+	})
+}
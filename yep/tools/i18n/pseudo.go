@@ -0,0 +1,78 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package i18n
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// PseudoLanguage is the code of the pseudo-localization language. In this
+// language, all the strings that go through the translation registry are
+// pseudo-localized, so that strings that are not translatable stand out.
+const PseudoLanguage = "x_PSEUDO"
+
+const (
+	// pseudoStartMarker and pseudoEndMarker surround pseudo-localized strings
+	pseudoStartMarker = "[!! "
+	pseudoEndMarker   = " !!]"
+	// pseudoExpansion is the length expansion of pseudo-localized
+	// strings in percent, to reveal layouts too narrow for translations
+	pseudoExpansion = 40
+)
+
+// pseudoChars are the accented characters with which letters
+// are replaced in pseudo-localized strings.
+var pseudoChars = map[rune]rune{
+	'a': 'á', 'b': 'ƀ', 'c': 'ç', 'd': 'ď', 'e': 'é', 'f': 'ƒ', 'g': 'ĝ', 'h': 'ĥ', 'i': 'í',
+	'j': 'ĵ', 'k': 'ķ', 'l': 'ĺ', 'n': 'ñ', 'o': 'ö', 'r': 'ŕ', 's': 'š', 't': 'ţ', 'u': 'û',
+	'w': 'ŵ', 'y': 'ý', 'z': 'ž', 'A': 'Å', 'C': 'Ç', 'D': 'Ď', 'E': 'É', 'G': 'Ĝ', 'H': 'Ĥ',
+	'I': 'Î', 'J': 'Ĵ', 'L': 'Ĺ', 'N': 'Ñ', 'O': 'Ö', 'R': 'Ŕ', 'S': 'Š', 'T': 'Ţ', 'U': 'Û',
+	'W': 'Ŵ', 'Y': 'Ý', 'Z': 'Ž',
+}
+
+// Pseudolocalize returns the given string with its letters accented,
+// expanded and surrounded by markers. Printf verbs such as %s are kept
+// as is. Empty strings are returned unchanged.
+func Pseudolocalize(source string) string {
+	if source == "" {
+		return source
+	}
+	var buf bytes.Buffer
+	buf.WriteString(pseudoStartMarker)
+	var inVerb bool
+	for _, r := range source {
+		switch {
+		case inVerb:
+			inVerb = false
+		case r == '%':
+			inVerb = true
+		default:
+			if pr, ok := pseudoChars[r]; ok {
+				r = pr
+			}
+		}
+		buf.WriteRune(r)
+	}
+	expansion := utf8.RuneCountInString(source) * pseudoExpansion / 100
+	if expansion < 1 {
+		expansion = 1
+	}
+	buf.WriteString(" ")
+	buf.WriteString(strings.Repeat("~", expansion))
+	buf.WriteString(pseudoEndMarker)
+	return buf.String()
+}
+
+// EnablePseudoLanguage registers the PseudoLanguage in this Collection and
+// enables the pseudo-localization of strings translated in this language.
+// It is meant to be used in development mode only.
+func (tc *Collection) EnablePseudoLanguage() {
+	tc.AddLanguage(Language{Code: PseudoLanguage, Name: "Pseudo-localization", Params: defaultLangParameters})
+	tc.Lock()
+	defer tc.Unlock()
+	tc.pseudo = true
+	tc.generation++
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package nbutils
+
+import (
+	"math"
+
+	"github.com/npiganeau/yep/yep/tools/logging"
+)
+
+var log *logging.Logger
+
+// A RoundingMethod defines how a value is rounded when it falls
+// between two representable values at the requested scale.
+type RoundingMethod string
+
+const (
+	// RoundHalfUp rounds to the nearest value, ties going away from zero
+	RoundHalfUp RoundingMethod = "HALF-UP"
+	// RoundHalfEven rounds to the nearest value, ties going to the even neighbour
+	// (a.k.a. banker's rounding)
+	RoundHalfEven RoundingMethod = "HALF-EVEN"
+	// RoundUp always rounds away from zero
+	RoundUp RoundingMethod = "UP"
+	// RoundDown always rounds towards zero
+	RoundDown RoundingMethod = "DOWN"
+)
+
+// noiseScale is used to remove binary representation noise of
+// normalized values before applying the rounding method
+// (e.g. 2.675 * 100 = 267.49999999999997).
+const noiseScale = 1e6
+
+// A RoundingPolicy defines how amounts must be rounded.
+// Scale is the number of digits to the right of the decimal point.
+type RoundingPolicy struct {
+	Scale  int8
+	Method RoundingMethod
+}
+
+// DefaultRoundingPolicy is the policy used when neither
+// the currency nor the company define one.
+var DefaultRoundingPolicy = RoundingPolicy{
+	Scale:  2,
+	Method: RoundHalfUp,
+}
+
+// SelectPolicy returns the first non nil policy of the given list or
+// DefaultRoundingPolicy if all are nil. Policies should be given by order
+// of precedence, typically the currency's, then the company's.
+func SelectPolicy(policies ...*RoundingPolicy) RoundingPolicy {
+	for _, p := range policies {
+		if p != nil {
+			return *p
+		}
+	}
+	return DefaultRoundingPolicy
+}
+
+// Round returns value rounded according to this policy
+func (rp RoundingPolicy) Round(value float64) float64 {
+	return Round(value, rp.Scale, rp.Method)
+}
+
+// Compare compares the given amounts once rounded according to this policy.
+// It returns -1 if a < b, 0 if a == b and 1 if a > b.
+func (rp RoundingPolicy) Compare(a, b float64) int {
+	return compare(rp.Round(a)-rp.Round(b), rp.Scale)
+}
+
+// IsZero returns true if the given value is zero once rounded according to this policy.
+func (rp RoundingPolicy) IsZero(value float64) bool {
+	return rp.Round(value) == 0
+}
+
+// Round returns value rounded with scale digits after the decimal point
+// using the given method. If method is empty, RoundHalfUp is used.
+func Round(value float64, scale int8, method RoundingMethod) float64 {
+	factor := math.Pow10(int(scale))
+	normalized := math.Round(value*factor*noiseScale) / noiseScale
+	sign := 1.0
+	if normalized < 0 {
+		sign = -1.0
+		normalized = -normalized
+	}
+	var res float64
+	switch method {
+	case RoundHalfEven:
+		res = math.RoundToEven(normalized)
+	case RoundUp:
+		res = math.Ceil(normalized)
+	case RoundDown:
+		res = math.Floor(normalized)
+	case RoundHalfUp, "":
+		res = math.Floor(normalized + 0.5)
+	default:
+		log.Panic("Unknown rounding method", "method", method)
+	}
+	return sign * res / factor
+}
+
+// CompareAmounts compares a and b once rounded to scale digits with the half-up
+// method. It returns -1 if a < b, 0 if a == b and 1 if a > b.
+func CompareAmounts(a, b float64, scale int8) int {
+	return compare(Round(a, scale, RoundHalfUp)-Round(b, scale, RoundHalfUp), scale)
+}
+
+// compare returns the sign of the difference diff of two rounded amounts,
+// or 0 if it is zero at the given scale.
+func compare(diff float64, scale int8) int {
+	switch {
+	case IsZero(diff, scale):
+		return 0
+	case diff < 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// IsZero returns true if value is zero once rounded to scale digits, i.e.
+// if its absolute value is lower than half a unit of the last digit.
+func IsZero(value float64, scale int8) bool {
+	return Round(value, scale, RoundHalfUp) == 0
+}
+
+func init() {
+	log = logging.GetLogger("nbutils")
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package nbutils
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRounding(t *testing.T) {
+	Convey("Testing rounding methods", t, func() {
+		So(Round(2.675, 2, RoundHalfUp), ShouldEqual, 2.68)
+		So(Round(-1.005, 2, RoundHalfUp), ShouldEqual, -1.01)
+		So(Round(2.665, 2, RoundHalfEven), ShouldEqual, 2.66)
+		So(Round(2.675, 2, RoundHalfEven), ShouldEqual, 2.68)
+		So(Round(1.001, 2, RoundUp), ShouldEqual, 1.01)
+		So(Round(-1.009, 2, RoundDown), ShouldEqual, -1.00)
+	})
+	Convey("Testing amounts comparison", t, func() {
+		So(CompareAmounts(1.004, 1.0, 2), ShouldEqual, 0)
+		So(CompareAmounts(1.006, 1.0, 2), ShouldEqual, 1)
+		So(CompareAmounts(0.994, 1.0, 2), ShouldEqual, -1)
+		So(IsZero(0.004, 2), ShouldBeTrue)
+		So(IsZero(0.005, 2), ShouldBeFalse)
+	})
+	Convey("Testing policy precedence", t, func() {
+		company := &RoundingPolicy{Scale: 3, Method: RoundDown}
+		currency := &RoundingPolicy{Scale: 0, Method: RoundHalfEven}
+		So(SelectPolicy(currency, company), ShouldResemble, *currency)
+		So(SelectPolicy(nil, company), ShouldResemble, *company)
+		So(SelectPolicy(nil, nil), ShouldResemble, DefaultRoundingPolicy)
+		So(SelectPolicy(currency, company).Round(2.5), ShouldEqual, 2)
+	})
+	Convey("Testing policy comparisons with their rounding method", t, func() {
+		down := RoundingPolicy{Scale: 2, Method: RoundDown}
+		up := RoundingPolicy{Scale: 2, Method: RoundUp}
+		So(down.Compare(1.009, 1.0), ShouldEqual, 0)
+		So(up.Compare(1.001, 1.0), ShouldEqual, 1)
+		So(DefaultRoundingPolicy.Compare(1.004, 1.0), ShouldEqual, 0)
+		So(down.IsZero(0.009), ShouldBeTrue)
+		So(up.IsZero(0.001), ShouldBeFalse)
+	})
+}
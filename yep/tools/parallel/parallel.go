@@ -0,0 +1,65 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package parallel provides helpers to run independent tasks concurrently.
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Run calls fnct once for each index of [0, n) concurrently, using at most
+// runtime.GOMAXPROCS(0) goroutines, and returns when all calls are done.
+//
+// If fnct panics, the remaining indexes are not processed and the panic is
+// raised again in the calling goroutine, so that callers can recover from it
+// as if fnct had been called sequentially.
+func Run(n int, fnct func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		next      int
+		panicked  bool
+		panicData interface{}
+	)
+	// nextIndex returns the next index to process, or -1 if there are
+	// no more indexes to process or if a call has panicked.
+	nextIndex := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if panicked || next >= n {
+			return -1
+		}
+		next++
+		return next - 1
+	}
+	worker := func() {
+		defer wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				mu.Lock()
+				if !panicked {
+					panicked = true
+					panicData = r
+				}
+				mu.Unlock()
+			}
+		}()
+		for i := nextIndex(); i >= 0; i = nextIndex() {
+			fnct(i)
+		}
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go worker()
+	}
+	wg.Wait()
+	if panicked {
+		panic(panicData)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package parallel
+
+import (
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRun(t *testing.T) {
+	Convey("Testing parallel runs", t, func() {
+		Convey("All indexes should be processed once", func() {
+			var mu sync.Mutex
+			counts := make(map[int]int)
+			Run(100, func(i int) {
+				mu.Lock()
+				defer mu.Unlock()
+				counts[i]++
+			})
+			So(counts, ShouldHaveLength, 100)
+			for i := 0; i < 100; i++ {
+				So(counts[i], ShouldEqual, 1)
+			}
+		})
+		Convey("Running no task should not block", func() {
+			So(func() { Run(0, func(i int) { panic("should not be called") }) }, ShouldNotPanic)
+		})
+		Convey("Panics should be raised in the calling goroutine", func() {
+			So(func() {
+				Run(10, func(i int) {
+					if i == 5 {
+						panic("task failed")
+					}
+				})
+			}, ShouldPanicWith, "task failed")
+		})
+	})
+}
@@ -0,0 +1,479 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package rrule parses and expands the recurrence rules of RFC 5545, such as
+
+	FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10
+	FREQ=MONTHLY;BYDAY=-1FR;UNTIL=20181231T235959Z
+
+The FREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY, BYMONTH and WKST parts
+are supported. Weeks start on Monday. Occurrences are computed in the
+location of the start date of the recurrence and keep its time of the day.
+*/
+package rrule
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Frequency is the period on which a rule is based
+type Frequency string
+
+// Frequencies of rules
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	Yearly  Frequency = "YEARLY"
+)
+
+// maxEmptyPeriods is the number of consecutive periods without occurrence
+// after which a rule is considered to have no more occurrences, so that
+// impossible rules such as the 30th of February do not loop forever.
+const maxEmptyPeriods = 10000
+
+// untilLayouts are the accepted layouts of the UNTIL part
+var untilLayouts = []string{"20060102T150405Z", "20060102T150405", "20060102"}
+
+// weekdays are the two letters codes of the days of the week
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// A WeekdayNum is a day of the week in the BYDAY part of a rule. If N is not
+// zero, it is the N-th such day of the month (or of the year), counted from
+// the end if it is negative, e.g. -1FR is the last Friday.
+type WeekdayNum struct {
+	Day time.Weekday
+	N   int
+}
+
+// String returns the representation of this day in a rule, e.g. "-1FR"
+func (w WeekdayNum) String() string {
+	day := strings.ToUpper(w.Day.String()[:2])
+	if w.N == 0 {
+		return day
+	}
+	return fmt.Sprintf("%d%s", w.N, day)
+}
+
+// A Rule is a recurrence rule
+type Rule struct {
+	Freq     Frequency
+	Interval int
+	// Count is the number of occurrences of the rule, or 0 if not limited
+	Count int
+	// Until is the date after which there is no occurrence, or the zero
+	// time if not limited
+	Until      time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+}
+
+// Parse returns the rule given in the RFC 5545 format,
+// with or without the "RRULE:" prefix.
+func Parse(src string) (Rule, error) {
+	var rule Rule
+	src = strings.TrimPrefix(strings.TrimSpace(src), "RRULE:")
+	for _, part := range strings.Split(src, ";") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return Rule{}, fmt.Errorf("invalid rule part '%s'", part)
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch key {
+		case "FREQ":
+			rule.Freq = Frequency(value)
+			switch rule.Freq {
+			case Daily, Weekly, Monthly, Yearly:
+			default:
+				err = fmt.Errorf("unsupported frequency '%s'", value)
+			}
+		case "INTERVAL":
+			rule.Interval, err = parsePositive(value)
+		case "COUNT":
+			rule.Count, err = parsePositive(value)
+		case "UNTIL":
+			rule.Until, err = parseUntil(value)
+		case "BYDAY":
+			rule.ByDay, err = parseByDay(value)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseIntList(value, 31, false)
+		case "BYMONTH":
+			var months []int
+			months, err = parseIntList(value, 12, true)
+			for _, month := range months {
+				rule.ByMonth = append(rule.ByMonth, time.Month(month))
+			}
+		case "WKST":
+			if value != "MO" {
+				err = fmt.Errorf("unsupported week start '%s'", value)
+			}
+		default:
+			err = fmt.Errorf("unsupported rule part '%s'", key)
+		}
+		if err != nil {
+			return Rule{}, err
+		}
+	}
+	if rule.Freq == "" {
+		return Rule{}, fmt.Errorf("missing frequency in rule '%s'", src)
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return Rule{}, fmt.Errorf("COUNT and UNTIL cannot be both set")
+	}
+	if rule.Interval == 0 {
+		rule.Interval = 1
+	}
+	return rule, nil
+}
+
+// parsePositive parses the given strictly positive integer
+func parsePositive(value string) (int, error) {
+	res, err := strconv.Atoi(value)
+	if err != nil || res <= 0 {
+		return 0, fmt.Errorf("invalid positive integer '%s'", value)
+	}
+	return res, nil
+}
+
+// parseUntil parses the value of the UNTIL part
+func parseUntil(value string) (time.Time, error) {
+	for _, layout := range untilLayouts {
+		if res, err := time.Parse(layout, value); err == nil {
+			return res, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s'", value)
+}
+
+// parseIntList parses a comma separated list of integers between 1 and max,
+// or also between -max and -1 if positive is false.
+func parseIntList(value string, max int, positive bool) ([]int, error) {
+	var res []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(item)
+		if err != nil || n == 0 || n > max || n < -max || (positive && n < 0) {
+			return nil, fmt.Errorf("invalid value '%s'", item)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// parseByDay parses the value of the BYDAY part
+func parseByDay(value string) ([]WeekdayNum, error) {
+	var res []WeekdayNum
+	for _, item := range strings.Split(value, ",") {
+		if len(item) < 2 {
+			return nil, fmt.Errorf("invalid day '%s'", item)
+		}
+		day, ok := weekdays[item[len(item)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("invalid day '%s'", item)
+		}
+		wdn := WeekdayNum{Day: day}
+		if len(item) > 2 {
+			n, err := strconv.Atoi(item[:len(item)-2])
+			if err != nil || n == 0 || n > 53 || n < -53 {
+				return nil, fmt.Errorf("invalid day '%s'", item)
+			}
+			wdn.N = n
+		}
+		res = append(res, wdn)
+	}
+	return res, nil
+}
+
+// String returns this rule in the RFC 5545 format, without the "RRULE:" prefix
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilLayouts[0]))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, day := range r.ByDay {
+			days[i] = day.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, day := range r.ByMonthDay {
+			days[i] = strconv.Itoa(day)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		months := make([]string, len(r.ByMonth))
+		for i, month := range r.ByMonth {
+			months[i] = strconv.Itoa(int(month))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Iterate calls fnct with each occurrence of this rule starting at dtstart,
+// in chronological order, until fnct returns false or the rule ends. The
+// start date is an occurrence only if it satisfies the rule.
+func (r Rule) Iterate(dtstart time.Time, fnct func(time.Time) bool) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 1
+	}
+	var count, empty int
+	for period := r.periodStart(dtstart); empty < maxEmptyPeriods; period = r.nextPeriod(period, interval) {
+		candidates := r.candidates(period, dtstart)
+		if len(candidates) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+		for _, occurrence := range candidates {
+			if occurrence.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && occurrence.After(r.Until) {
+				return
+			}
+			if !fnct(occurrence) {
+				return
+			}
+			count++
+			if r.Count > 0 && count >= r.Count {
+				return
+			}
+		}
+	}
+}
+
+// Between returns the occurrences of this rule starting at dtstart
+// that are in the [from, to) interval.
+func (r Rule) Between(dtstart, from, to time.Time) []time.Time {
+	var res []time.Time
+	r.Iterate(dtstart, func(occurrence time.Time) bool {
+		if !occurrence.Before(to) {
+			return false
+		}
+		if !occurrence.Before(from) {
+			res = append(res, occurrence)
+		}
+		return true
+	})
+	return res
+}
+
+// All returns the first limit occurrences of this rule starting at dtstart.
+func (r Rule) All(dtstart time.Time, limit int) []time.Time {
+	var res []time.Time
+	if limit <= 0 {
+		return res
+	}
+	r.Iterate(dtstart, func(occurrence time.Time) bool {
+		res = append(res, occurrence)
+		return len(res) < limit
+	})
+	return res
+}
+
+// periodStart returns the start of the period of the rule holding t
+func (r Rule) periodStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch r.Freq {
+	case Weekly:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case Monthly:
+		return day.AddDate(0, 0, 1-day.Day())
+	case Yearly:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+	return day
+}
+
+// nextPeriod returns the start of the period interval periods after period
+func (r Rule) nextPeriod(period time.Time, interval int) time.Time {
+	switch r.Freq {
+	case Weekly:
+		return period.AddDate(0, 0, 7*interval)
+	case Monthly:
+		return period.AddDate(0, interval, 0)
+	case Yearly:
+		return period.AddDate(interval, 0, 0)
+	}
+	return period.AddDate(0, 0, interval)
+}
+
+// candidates returns the sorted occurrences of the rule in the
+// period starting at period, at the time of the day of dtstart.
+func (r Rule) candidates(period, dtstart time.Time) []time.Time {
+	var days []time.Time
+	switch r.Freq {
+	case Daily:
+		days = []time.Time{period}
+	case Weekly:
+		for i := 0; i < 7; i++ {
+			days = append(days, period.AddDate(0, 0, i))
+		}
+		if len(r.ByDay) == 0 {
+			days = filterDays(days, func(day time.Time) bool { return day.Weekday() == dtstart.Weekday() })
+		}
+	case Monthly:
+		days = r.monthDays(period, dtstart)
+	case Yearly:
+		months := r.ByMonth
+		if len(months) == 0 && len(r.ByDay) > 0 && len(r.ByMonthDay) == 0 {
+			days = r.expandByDay(daysBetween(period, period.AddDate(1, 0, 0)))
+			break
+		}
+		if len(months) == 0 {
+			months = []time.Month{dtstart.Month()}
+			if len(r.ByMonthDay) > 0 {
+				months = []time.Month{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+			}
+		}
+		for _, month := range months {
+			monthStart := time.Date(period.Year(), month, 1, 0, 0, 0, 0, period.Location())
+			days = append(days, r.monthDays(monthStart, dtstart)...)
+		}
+	}
+	days = filterDays(days, r.matchesFilters)
+	res := make([]time.Time, len(days))
+	for i, day := range days {
+		res[i] = time.Date(day.Year(), day.Month(), day.Day(), dtstart.Hour(), dtstart.Minute(), dtstart.Second(),
+			dtstart.Nanosecond(), dtstart.Location())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Before(res[j]) })
+	return res
+}
+
+// monthDays returns the days of the month starting at monthStart that
+// satisfy the BYMONTHDAY and BYDAY parts of the rule, or the day of the
+// month of dtstart if they are not set.
+func (r Rule) monthDays(monthStart, dtstart time.Time) []time.Time {
+	all := daysBetween(monthStart, monthStart.AddDate(0, 1, 0))
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		if dtstart.Day() > len(all) {
+			return nil
+		}
+		return []time.Time{all[dtstart.Day()-1]}
+	}
+	days := all
+	if len(r.ByDay) > 0 {
+		days = r.expandByDay(all)
+	}
+	if len(r.ByMonthDay) > 0 {
+		days = filterDays(days, func(day time.Time) bool {
+			for _, n := range r.ByMonthDay {
+				if n == day.Day() || n == day.Day()-len(all)-1 {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	return days
+}
+
+// expandByDay returns the days of the given consecutive days that satisfy
+// the BYDAY part of the rule, ordinals being counted within these days.
+func (r Rule) expandByDay(days []time.Time) []time.Time {
+	var res []time.Time
+	for _, wdn := range r.ByDay {
+		var matching []time.Time
+		for _, day := range days {
+			if day.Weekday() == wdn.Day {
+				matching = append(matching, day)
+			}
+		}
+		switch {
+		case wdn.N == 0:
+			res = append(res, matching...)
+		case wdn.N > 0 && wdn.N <= len(matching):
+			res = append(res, matching[wdn.N-1])
+		case wdn.N < 0 && -wdn.N <= len(matching):
+			res = append(res, matching[len(matching)+wdn.N])
+		}
+	}
+	return res
+}
+
+// matchesFilters returns true if the given day satisfies the BYMONTH part
+// of the rule, and its BYDAY and BYMONTHDAY parts for daily rules.
+func (r Rule) matchesFilters(day time.Time) bool {
+	if len(r.ByMonth) > 0 {
+		var ok bool
+		for _, month := range r.ByMonth {
+			ok = ok || day.Month() == month
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.Freq == Monthly || r.Freq == Yearly {
+		return true
+	}
+	if len(r.ByDay) > 0 {
+		var ok bool
+		for _, wdn := range r.ByDay {
+			ok = ok || day.Weekday() == wdn.Day
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ByMonthDay) > 0 {
+		monthLength := day.AddDate(0, 1, -day.Day()).Day()
+		var ok bool
+		for _, n := range r.ByMonthDay {
+			ok = ok || n == day.Day() || n == day.Day()-monthLength-1
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// daysBetween returns the days from start included to end excluded
+func daysBetween(start, end time.Time) []time.Time {
+	var res []time.Time
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		res = append(res, day)
+	}
+	return res
+}
+
+// filterDays returns the days that satisfy the given predicate
+func filterDays(days []time.Time, predicate func(time.Time) bool) []time.Time {
+	var res []time.Time
+	for _, day := range days {
+		if predicate(day) {
+			res = append(res, day)
+		}
+	}
+	return res
+}
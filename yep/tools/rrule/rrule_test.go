@@ -0,0 +1,83 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package rrule
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dates returns the given days of 2017 at 10:00 UTC, as "MM-DD" strings
+func dates(days ...string) []time.Time {
+	res := make([]time.Time, len(days))
+	for i, day := range days {
+		date, _ := time.Parse("2006-01-02 15:04", "2017-"+day+" 10:00")
+		res[i] = date
+	}
+	return res
+}
+
+func TestParse(t *testing.T) {
+	Convey("Testing the parsing of rules", t, func() {
+		rule, err := Parse("RRULE:FREQ=MONTHLY;INTERVAL=2;BYDAY=-1FR,2MO;COUNT=4")
+		So(err, ShouldBeNil)
+		So(rule.Freq, ShouldEqual, Monthly)
+		So(rule.Interval, ShouldEqual, 2)
+		So(rule.Count, ShouldEqual, 4)
+		So(rule.ByDay, ShouldResemble, []WeekdayNum{{Day: time.Friday, N: -1}, {Day: time.Monday, N: 2}})
+		So(rule.String(), ShouldEqual, "FREQ=MONTHLY;INTERVAL=2;COUNT=4;BYDAY=-1FR,2MO")
+		rule, err = Parse("FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1;UNTIL=20201231")
+		So(err, ShouldBeNil)
+		So(rule.Interval, ShouldEqual, 1)
+		So(rule.String(), ShouldEqual, "FREQ=YEARLY;UNTIL=20201231T000000Z;BYMONTHDAY=-1;BYMONTH=2")
+		for _, invalid := range []string{"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=DAILY;BYDAY=XX", "FREQ=DAILY;COUNT=0",
+			"FREQ=DAILY;BYMONTH=13", "FREQ=DAILY;COUNT=2;UNTIL=20170101", "FREQ=DAILY;BYSETPOS=1", "FREQ"} {
+			_, err = Parse(invalid)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestExpansion(t *testing.T) {
+	Convey("Testing the expansion of rules", t, func() {
+		start := dates("06-14")[0]
+		expand := func(src string, limit int) []time.Time {
+			rule, err := Parse(src)
+			So(err, ShouldBeNil)
+			return rule.All(start, limit)
+		}
+		Convey("Daily rules", func() {
+			So(expand("FREQ=DAILY;INTERVAL=2;COUNT=3", 10), ShouldResemble, dates("06-14", "06-16", "06-18"))
+			So(expand("FREQ=DAILY;BYDAY=MO,FR", 3), ShouldResemble, dates("06-16", "06-19", "06-23"))
+			So(expand("FREQ=DAILY;UNTIL=20170616T100000Z", 10), ShouldResemble, dates("06-14", "06-15", "06-16"))
+		})
+		Convey("Weekly rules", func() {
+			So(expand("FREQ=WEEKLY;COUNT=2", 10), ShouldResemble, dates("06-14", "06-21"))
+			So(expand("FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE", 4), ShouldResemble, dates("06-14", "06-26", "06-28", "07-10"))
+		})
+		Convey("Monthly rules", func() {
+			So(expand("FREQ=MONTHLY;BYDAY=-1FR", 3), ShouldResemble, dates("06-30", "07-28", "08-25"))
+			So(expand("FREQ=MONTHLY;BYMONTHDAY=1,-1", 3), ShouldResemble, dates("06-30", "07-01", "07-31"))
+			So(expand("FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13", 1), ShouldResemble, dates("10-13"))
+			rule, _ := Parse("FREQ=MONTHLY;COUNT=3")
+			So(rule.All(dates("01-31")[0], 10), ShouldResemble, dates("01-31", "03-31", "05-31"))
+		})
+		Convey("Yearly rules", func() {
+			rule, _ := Parse("FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=29")
+			leapDays := rule.All(start, 2)
+			So(leapDays[0].Format("2006-01-02"), ShouldEqual, "2020-02-29")
+			So(leapDays[1].Format("2006-01-02"), ShouldEqual, "2024-02-29")
+			rule, _ = Parse("FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30")
+			So(rule.All(start, 1), ShouldBeEmpty)
+			So(expand("FREQ=YEARLY;BYDAY=-1SU", 1)[0].Format("2006-01-02"), ShouldEqual, "2017-12-31")
+		})
+		Convey("Occurrences in a date range", func() {
+			rule, _ := Parse("FREQ=WEEKLY")
+			So(rule.Between(start, dates("06-20")[0], dates("07-05")[0]), ShouldResemble, dates("06-21", "06-28"))
+			So(rule.Between(start, dates("06-14")[0], dates("06-21")[0]), ShouldResemble, dates("06-14"))
+		})
+	})
+}
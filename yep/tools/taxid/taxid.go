@@ -0,0 +1,329 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+/*
+Package taxid validates tax identification numbers, such as European VAT
+numbers, with the checksum algorithm of their country, and verifies them
+online with a Verifier such as the VIES service of the European Commission.
+
+Tax ids are given with the ISO 3166-1 alpha-2 code of their country as prefix
+(EL for Greece), e.g. "FR40303265045". Numbers of countries without known
+checksum are only checked to be alphanumeric.
+*/
+package taxid
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedCountry is returned by verifiers for
+// the tax ids of countries that they cannot verify.
+var ErrUnsupportedCountry = errors.New("country not supported by the verifier")
+
+// A Verifier checks online that tax ids are registered
+type Verifier interface {
+	// Verify returns true if the given normalized tax id is registered
+	Verify(taxID string) (bool, error)
+}
+
+// separators are the characters removed from tax ids by Normalize
+var separators = strings.NewReplacer(" ", "", ".", "", "-", "", "/", "", ",", "")
+
+var (
+	// genericNumber is the format of the numbers of countries without known checksum
+	genericNumber = regexp.MustCompile(`^[0-9A-Z+*]{2,12}$`)
+	// frenchKey is the format of the keys of French numbers
+	frenchKey = regexp.MustCompile(`^[0-9A-HJ-NP-Z]{2}$`)
+)
+
+// A checker returns true if the given number (without country prefix) is valid
+type checker func(number string) bool
+
+// checkers are the checksum algorithms of the numbers by country
+var checkers = map[string]checker{
+	"AT": checkAT,
+	"BE": checkBE,
+	"DE": checkDE,
+	"DK": checkDK,
+	"EL": checkEL,
+	"ES": checkES,
+	"FI": checkFI,
+	"FR": checkFR,
+	"GB": checkGB,
+	"IT": checkIT,
+	"LU": checkLU,
+	"NL": checkNL,
+	"PL": checkPL,
+	"PT": checkPT,
+	"SE": checkSE,
+}
+
+// Normalize returns the given tax id in upper case without separators
+func Normalize(taxID string) string {
+	return separators.Replace(strings.ToUpper(strings.TrimSpace(taxID)))
+}
+
+// Split returns the country code and the number of the given tax id
+func Split(taxID string) (string, string) {
+	taxID = Normalize(taxID)
+	if len(taxID) < 2 {
+		return "", taxID
+	}
+	return taxID[:2], taxID[2:]
+}
+
+// Validate returns an error if the given tax id does not have a country
+// prefix or if its number is invalid for this country.
+func Validate(taxID string) error {
+	country, number := Split(taxID)
+	if country == "" || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+		return fmt.Errorf("tax id '%s' does not start with a country code", taxID)
+	}
+	check, ok := checkers[country]
+	if !ok {
+		check = genericNumber.MatchString
+	}
+	if !check(number) {
+		return fmt.Errorf("invalid tax id '%s'", taxID)
+	}
+	return nil
+}
+
+// digits returns the digits of the given number, or
+// false if it is not made of n digits.
+func digits(number string, n int) ([]int, bool) {
+	if len(number) != n {
+		return nil, false
+	}
+	res := make([]int, n)
+	for i, c := range number {
+		if c < '0' || c > '9' {
+			return nil, false
+		}
+		res[i] = int(c - '0')
+	}
+	return res, true
+}
+
+// weightedSum returns the sum of the given digits multiplied by the given weights
+func weightedSum(ds []int, weights ...int) int {
+	var sum int
+	for i, w := range weights {
+		sum += ds[i] * w
+	}
+	return sum
+}
+
+// luhn returns true if the given digits satisfy the Luhn algorithm
+func luhn(ds []int) bool {
+	var sum int
+	for i := range ds {
+		d := ds[len(ds)-1-i]
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// mod97 returns the remainder of the division of the given decimal number by 97
+func mod97(number string) int {
+	var res int
+	for _, c := range number {
+		res = (res*10 + int(c-'0')) % 97
+	}
+	return res
+}
+
+func checkAT(number string) bool {
+	if !strings.HasPrefix(number, "U") {
+		return false
+	}
+	ds, ok := digits(number[1:], 8)
+	if !ok {
+		return false
+	}
+	var sum int
+	for i, d := range ds[:7] {
+		if i%2 == 1 {
+			d = d*2/10 + d*2%10
+		}
+		sum += d
+	}
+	return (10-(sum+4)%10)%10 == ds[7]
+}
+
+func checkBE(number string) bool {
+	if len(number) == 9 {
+		number = "0" + number
+	}
+	if _, ok := digits(number, 10); !ok || number[0] > '1' {
+		return false
+	}
+	first, _ := strconv.Atoi(number[:8])
+	last, _ := strconv.Atoi(number[8:])
+	return 97-first%97 == last
+}
+
+func checkDE(number string) bool {
+	ds, ok := digits(number, 9)
+	if !ok {
+		return false
+	}
+	product := 10
+	for _, d := range ds[:8] {
+		sum := (d + product) % 10
+		if sum == 0 {
+			sum = 10
+		}
+		product = sum * 2 % 11
+	}
+	return (11-product)%10 == ds[8]
+}
+
+func checkDK(number string) bool {
+	ds, ok := digits(number, 8)
+	return ok && ds[0] != 0 && weightedSum(ds, 2, 7, 6, 5, 4, 3, 2, 1)%11 == 0
+}
+
+func checkEL(number string) bool {
+	ds, ok := digits(number, 9)
+	return ok && weightedSum(ds, 256, 128, 64, 32, 16, 8, 4, 2)%11%10 == ds[8]
+}
+
+func checkES(number string) bool {
+	if len(number) != 9 {
+		return false
+	}
+	const dniLetters = "TRWAGMYFPDXBNJZSQVHLCKE"
+	switch first := number[0]; {
+	case first >= '0' && first <= '9', first == 'X', first == 'Y', first == 'Z':
+		// Personal numbers (DNI or NIE)
+		numeric := strings.NewReplacer("X", "0", "Y", "1", "Z", "2").Replace(number[:1]) + number[1:8]
+		if _, ok := digits(numeric, 8); !ok {
+			return false
+		}
+		n, _ := strconv.Atoi(numeric)
+		return number[8] == dniLetters[n%23]
+	case first >= 'A' && first <= 'W':
+		// Legal entities (CIF)
+		ds, ok := digits(number[1:8], 7)
+		if !ok {
+			return false
+		}
+		var sum int
+		for i, d := range ds {
+			if i%2 == 0 {
+				d = d*2/10 + d*2%10
+			}
+			sum += d
+		}
+		check := (10 - sum%10) % 10
+		return number[8] == byte('0'+check) || number[8] == "JABCDEFGHI"[check]
+	}
+	return false
+}
+
+func checkFI(number string) bool {
+	ds, ok := digits(number, 8)
+	if !ok {
+		return false
+	}
+	check := 11 - weightedSum(ds, 7, 9, 10, 5, 8, 4, 2)%11
+	if check == 11 {
+		check = 0
+	}
+	return check == ds[7]
+}
+
+func checkFR(number string) bool {
+	if len(number) != 11 {
+		return false
+	}
+	if _, ok := digits(number[2:], 9); !ok {
+		return false
+	}
+	key, err := strconv.Atoi(number[:2])
+	if err != nil {
+		// New style keys with letters have no published checksum
+		return frenchKey.MatchString(number[:2])
+	}
+	siren, _ := strconv.Atoi(number[2:])
+	return (12+3*(siren%97))%97 == key
+}
+
+func checkGB(number string) bool {
+	if len(number) == 12 {
+		// Branch traders have a 3 digits suffix
+		number = number[:9]
+	}
+	ds, ok := digits(number, 9)
+	if !ok {
+		return false
+	}
+	total := weightedSum(ds, 8, 7, 6, 5, 4, 3, 2) + ds[7]*10 + ds[8]
+	return total%97 == 0 || (total+55)%97 == 0
+}
+
+func checkIT(number string) bool {
+	ds, ok := digits(number, 11)
+	return ok && luhn(ds)
+}
+
+func checkLU(number string) bool {
+	if _, ok := digits(number, 8); !ok {
+		return false
+	}
+	first, _ := strconv.Atoi(number[:6])
+	last, _ := strconv.Atoi(number[6:])
+	return first%89 == last
+}
+
+func checkNL(number string) bool {
+	if len(number) != 12 || number[9] != 'B' {
+		return false
+	}
+	ds, ok := digits(number[:9], 9)
+	if !ok {
+		return false
+	}
+	if _, ok = digits(number[10:], 2); !ok {
+		return false
+	}
+	if (weightedSum(ds, 9, 8, 7, 6, 5, 4, 3, 2)-ds[8])%11 == 0 {
+		return true
+	}
+	// Numbers issued since 2020 are checked with ISO 7064 mod 97-10 on the
+	// whole tax id, letters being replaced by their position plus 9.
+	return mod97("2321"+number[:9]+"11"+number[10:]) == 1
+}
+
+func checkPL(number string) bool {
+	ds, ok := digits(number, 10)
+	return ok && weightedSum(ds, 6, 5, 7, 2, 3, 4, 5, 6, 7)%11 == ds[9]
+}
+
+func checkPT(number string) bool {
+	ds, ok := digits(number, 9)
+	if !ok {
+		return false
+	}
+	check := 11 - weightedSum(ds, 9, 8, 7, 6, 5, 4, 3, 2)%11
+	if check > 9 {
+		check = 0
+	}
+	return check == ds[8]
+}
+
+func checkSE(number string) bool {
+	ds, ok := digits(number, 12)
+	return ok && number[10:] == "01" && luhn(ds[:10])
+}
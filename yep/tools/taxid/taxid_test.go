@@ -0,0 +1,107 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package taxid
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type countingVerifier struct {
+	calls int
+	err   error
+}
+
+func (cv *countingVerifier) Verify(taxID string) (bool, error) {
+	cv.calls++
+	return taxID == "FR40303265045", cv.err
+}
+
+func TestTaxIDs(t *testing.T) {
+	Convey("Testing tax ids", t, func() {
+		Convey("Tax ids should be normalized", func() {
+			So(Normalize(" fr 40-303.265.045 "), ShouldEqual, "FR40303265045")
+			country, number := Split("nl 4495.445.B01")
+			So(country, ShouldEqual, "NL")
+			So(number, ShouldEqual, "4495445B01")
+		})
+		Convey("Valid tax ids should pass their country checksum", func() {
+			for _, vat := range []string{"ATU13585627", "BE0403019261", "BE403019261", "DE136695976",
+				"DK13585628", "EL094259216", "ESA13585625", "ES54362315K", "ESX2482300W", "FI20774740",
+				"FR40303265045", "GB980780684", "IT00743110157", "LU15027442", "NL004495445B01",
+				"PL8567346215", "PT501964843", "SE123456789701", "CHE123456789"} {
+				So(Validate(vat), ShouldBeNil)
+			}
+		})
+		Convey("Invalid tax ids should be rejected", func() {
+			for _, vat := range []string{"ATU13585626", "BE0403019262", "DE136695978", "DK13585627",
+				"EL094259217", "ESA13585626", "ES54362315L", "FI20774741", "FR41303265045",
+				"GB980780685", "IT00743110158", "LU15027443", "NL004495445A01", "PL8567346216",
+				"PT501964842", "SE123456789702", "FR", "12345678", "CH"} {
+				So(Validate(vat), ShouldNotBeNil)
+			}
+		})
+		Convey("VIES should be queried for member states", func() {
+			var request string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				request = string(body)
+				valid := strings.Contains(request, "303265045")
+				fmt.Fprintf(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<ns2:checkVatResponse xmlns:ns2="urn:ec.europa.eu:taxud:vies:services:checkVat:types">
+<ns2:countryCode>FR</ns2:countryCode><ns2:valid>%t</ns2:valid></ns2:checkVatResponse></soap:Body></soap:Envelope>`, valid)
+			}))
+			defer server.Close()
+			vies := VIES{URL: server.URL}
+			valid, err := vies.Verify("FR 40303265045")
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+			So(request, ShouldContainSubstring, "<urn:countryCode>FR</urn:countryCode>")
+			So(request, ShouldContainSubstring, "<urn:vatNumber>40303265045</urn:vatNumber>")
+			valid, err = vies.Verify("FR12345678901")
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeFalse)
+			_, err = vies.Verify("CHE123456789")
+			So(err, ShouldEqual, ErrUnsupportedCountry)
+		})
+		Convey("VIES faults should be returned as errors", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<soap:Fault><faultcode>soap:Server</faultcode><faultstring>MS_UNAVAILABLE</faultstring></soap:Fault></soap:Body></soap:Envelope>`)
+			}))
+			defer server.Close()
+			_, err := VIES{URL: server.URL}.Verify("FR40303265045")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "MS_UNAVAILABLE")
+		})
+		Convey("Cached verifiers should only call the verifier once per tax id", func() {
+			cv := new(countingVerifier)
+			verifier := NewCache(cv, time.Hour)
+			valid, err := verifier.Verify("FR40303265045")
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+			valid, _ = verifier.Verify("fr 40303265045")
+			So(valid, ShouldBeTrue)
+			So(cv.calls, ShouldEqual, 1)
+			valid, _ = verifier.Verify("DE136695976")
+			So(valid, ShouldBeFalse)
+			So(cv.calls, ShouldEqual, 2)
+			Convey("Expired results and errors should not be kept", func() {
+				cv := &countingVerifier{err: ErrUnsupportedCountry}
+				verifier := NewCache(cv, 0)
+				verifier.Verify("FR40303265045")
+				verifier.Verify("FR40303265045")
+				So(cv.calls, ShouldEqual, 2)
+			})
+		})
+	})
+}
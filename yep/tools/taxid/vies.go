@@ -0,0 +1,126 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package taxid
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// VIESURL is the default endpoint of the VIES service
+const VIESURL = "https://ec.europa.eu/taxation_customs/vies/services/checkVatService"
+
+// viesCountries are the country prefixes of the tax ids known to VIES
+var viesCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true,
+	"EE": true, "EL": true, "ES": true, "FI": true, "FR": true, "HR": true, "HU": true,
+	"IE": true, "IT": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true, "XI": true,
+}
+
+// viesRequest is the SOAP envelope of checkVat requests
+const viesRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:urn="urn:ec.europa.eu:taxud:vies:services:checkVat:types">
+<soapenv:Body><urn:checkVat><urn:countryCode>%s</urn:countryCode><urn:vatNumber>%s</urn:vatNumber></urn:checkVat></soapenv:Body>
+</soapenv:Envelope>`
+
+// viesResponse is the SOAP envelope of checkVat responses
+type viesResponse struct {
+	Body struct {
+		Response struct {
+			Valid bool `xml:"valid"`
+		} `xml:"checkVatResponse"`
+		Fault *struct {
+			String string `xml:"faultstring"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// VIES is a Verifier querying the VAT Information Exchange System
+// of the European Commission. It only verifies the tax ids of the
+// member states and returns ErrUnsupportedCountry for the others.
+type VIES struct {
+	// URL is the endpoint of the service. VIESURL is used if empty.
+	URL string
+	// Timeout is the maximum duration of requests. No timeout if 0.
+	Timeout time.Duration
+}
+
+// Verify returns true if the given tax id is registered in VIES
+func (v VIES) Verify(taxID string) (bool, error) {
+	country, number := Split(taxID)
+	if !viesCountries[country] {
+		return false, ErrUnsupportedCountry
+	}
+	url := v.URL
+	if url == "" {
+		url = VIESURL
+	}
+	body := fmt.Sprintf(viesRequest, country, number)
+	client := http.Client{Timeout: v.Timeout}
+	resp, err := client.Post(url, "text/xml; charset=utf-8", bytes.NewBufferString(body))
+	if err != nil {
+		return false, fmt.Errorf("unable to reach VIES: %s", err)
+	}
+	defer resp.Body.Close()
+	var res viesResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, fmt.Errorf("invalid VIES response (%s): %s", resp.Status, err)
+	}
+	if res.Body.Fault != nil {
+		return false, fmt.Errorf("VIES error: %s", res.Body.Fault.String)
+	}
+	return res.Body.Response.Valid, nil
+}
+
+var _ Verifier = VIES{}
+
+// A cachedResult is the result of a verification kept by a cache
+type cachedResult struct {
+	valid   bool
+	expires time.Time
+}
+
+// A cache is a Verifier keeping the results of another Verifier
+type cache struct {
+	sync.Mutex
+	verifier Verifier
+	ttl      time.Duration
+	results  map[string]cachedResult
+}
+
+// Verify returns the cached result of the given tax id if it has not
+// expired, or verifies it and caches the result otherwise. Errors are
+// not cached.
+func (c *cache) Verify(taxID string) (bool, error) {
+	taxID = Normalize(taxID)
+	c.Lock()
+	res, ok := c.results[taxID]
+	c.Unlock()
+	if ok && time.Now().Before(res.expires) {
+		return res.valid, nil
+	}
+	valid, err := c.verifier.Verify(taxID)
+	if err != nil {
+		return false, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.results[taxID] = cachedResult{valid: valid, expires: time.Now().Add(c.ttl)}
+	return valid, nil
+}
+
+// NewCache returns a Verifier that caches the results of the
+// given verifier for the given duration.
+func NewCache(verifier Verifier, ttl time.Duration) Verifier {
+	return &cache{
+		verifier: verifier,
+		ttl:      ttl,
+		results:  make(map[string]cachedResult),
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package views
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/tools/expr"
+	"github.com/npiganeau/yep/yep/tools/xmlutils"
+)
+
+// CheckRegistry checks all the views of the Registry and returns a report
+// of the problems found: views of unknown models, fields unknown in the
+// view's model, invalid decoration expressions and unknown groups.
+//
+// CheckRegistry can be called before models.BootStrap. Fields of the sub
+// views of relation fields are not checked.
+func CheckRegistry() models.RegistryReport {
+	var report models.RegistryReport
+	for _, v := range Registry.views {
+		object := "view " + v.ID
+		for _, groupID := range v.groupIDs {
+			if security.Registry.GetGroup(groupID) == nil {
+				report.Add(object, "unknown group '%s'", groupID)
+			}
+		}
+		archElem := xmlutils.XMLToElement(v.Arch)
+		programs, err := viewExpressions(archElem)
+		if err != nil {
+			report.Add(object, "%s", err)
+		}
+		model, ok := models.Registry.Get(v.Model)
+		if !ok {
+			report.Add(object, "unknown model '%s'", v.Model)
+			continue
+		}
+		for _, program := range programs {
+			if err := model.CheckExpr(program); err != nil {
+				report.Add(object, "%s", err)
+			}
+		}
+		for _, name := range viewFieldNames(archElem) {
+			if name == "" {
+				report.Add(object, "field element without name")
+				continue
+			}
+			if !model.DeclaresField(name) {
+				report.Add(object, "unknown field '%s' in model '%s'", name, v.Model)
+			}
+		}
+	}
+	return report
+}
+
+// viewExpressions compiles and returns the expressions of the decoration-*
+// attributes of the given arch element and of its descendants. It returns
+// an error for the first invalid expression.
+func viewExpressions(element *etree.Element) ([]*expr.Program, error) {
+	var res []*expr.Program
+	for _, elem := range append([]*etree.Element{element}, element.FindElements("//*")...) {
+		for _, attr := range elem.Attr {
+			if !strings.HasPrefix(attr.Key, "decoration-") {
+				continue
+			}
+			program, err := expr.Compile(attr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s attribute: %s", attr.Key, err)
+			}
+			res = append(res, program)
+		}
+	}
+	return res, nil
+}
+
+// viewFieldNames returns the names of the field elements of the given arch
+// element, excluding those of the sub views of field elements.
+func viewFieldNames(element *etree.Element) []string {
+	var res []string
+	for _, child := range element.ChildElements() {
+		if child.Tag != "field" {
+			res = append(res, viewFieldNames(child)...)
+			continue
+		}
+		res = append(res, child.SelectAttrValue("name", ""))
+	}
+	return res
+}
@@ -4,8 +4,12 @@
 package views
 
 import (
+	"time"
+
 	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/tools/logging"
+	"github.com/npiganeau/yep/yep/tools/parallel"
 	"github.com/npiganeau/yep/yep/tools/xmlutils"
 )
 
@@ -14,18 +18,68 @@ var log *logging.Logger
 //BootStrap makes the necessary updates to view definitions. In particular:
 //- sets the type of the view from the arch root.
 //- populates the fields map from the views arch.
+//- checks the expressions of decoration attributes.
+//- resolves the groups allowed to see the view.
+//- sets the on_change attribute of fields with an OnChange method.
+//
+// Views are bootstrapped concurrently since each of them is updated independently.
 func BootStrap() {
+	start := time.Now()
+	allViews := make([]*View, 0, len(Registry.views))
 	for _, v := range Registry.views {
-		archElem := xmlutils.XMLToElement(v.Arch)
+		allViews = append(allViews, v)
+	}
+	parallel.Run(len(allViews), func(i int) {
+		bootStrapView(allViews[i])
+	})
+	log.Debug("Views bootstrapped", "views", len(allViews), "duration", time.Since(start))
+}
+
+// bootStrapView makes the necessary updates to the given view definition.
+func bootStrapView(v *View) {
+	archElem := xmlutils.XMLToElement(v.Arch)
 
-		// Set view type
-		v.Type = ViewType(archElem.Tag)
+	// Set view type
+	v.Type = ViewType(archElem.Tag)
 
-		// Populate fields map
-		fieldElems := archElem.FindElements("//field")
+	// Populate fields map
+	fieldElems := archElem.FindElements("//field")
+	for _, f := range fieldElems {
+		v.Fields = append(v.Fields, models.FieldName(f.SelectAttr("name").Value))
+	}
+
+	// Check decoration expressions
+	programs, err := viewExpressions(archElem)
+	if err != nil {
+		log.Panic("Invalid expression in view", "view", v.ID, "error", err)
+	}
+	if model, ok := models.Registry.Get(v.Model); ok {
+		for _, program := range programs {
+			if err := model.CheckExpr(program); err != nil {
+				log.Panic("Invalid expression in view", "view", v.ID, "error", err)
+			}
+		}
+	}
+
+	// Set on_change attributes
+	if model, ok := models.Registry.Get(v.Model); ok {
 		for _, f := range fieldElems {
-			v.Fields = append(v.Fields, models.FieldName(f.SelectAttr("name").Value))
+			fi, exists := model.Fields().Get(f.SelectAttr("name").Value)
+			if exists && fi.HasOnChange() {
+				f.CreateAttr("on_change", "1")
+			}
+		}
+		v.Arch = xmlutils.ElementToXML(archElem)
+	}
+
+	// Set groups
+	v.Groups = nil
+	for _, groupID := range v.groupIDs {
+		group := security.Registry.GetGroup(groupID)
+		if group == nil {
+			log.Panic("Unknown group in view", "view", v.ID, "group", groupID)
 		}
+		v.Groups = append(v.Groups, group)
 	}
 }
 
@@ -0,0 +1,222 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package views
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/tools/expr"
+	"github.com/npiganeau/yep/yep/tools/xmlutils"
+)
+
+// SampleRecord returns a record of the given model with a sample value for
+// each of its fields, keyed by field JSON names. It is meant to preview views
+// without a database, so that values only give an idea of the field types.
+func SampleRecord(modelName string) models.FieldMap {
+	res := make(models.FieldMap)
+	for _, fi := range models.InspectModel(modelName).Fields {
+		res[fi.JSON] = sampleValue(fi)
+	}
+	return res
+}
+
+// sampleValue returns a sample value of the given field
+func sampleValue(fi models.FieldInspection) interface{} {
+	switch fi.Type {
+	case fieldtype.Boolean:
+		return true
+	case fieldtype.Integer:
+		return 42
+	case fieldtype.Float, fieldtype.Monetary:
+		return 1234.56
+	case fieldtype.Date:
+		return "2017-01-31"
+	case fieldtype.DateTime:
+		return "2017-01-31 12:30:00"
+	case fieldtype.Binary:
+		return "<binary data>"
+	case fieldtype.Many2One, fieldtype.One2One:
+		return fmt.Sprintf("%s record", fi.Relation)
+	case fieldtype.One2Many, fieldtype.Many2Many:
+		return []string{fmt.Sprintf("%s record 1", fi.Relation), fmt.Sprintf("%s record 2", fi.Relation)}
+	}
+	return fmt.Sprintf("Sample %s", fi.Name)
+}
+
+// RenderHTML returns a basic HTML rendering of the arch of this view
+// displaying the values of the given record, keyed by field JSON names.
+//
+// It is meant to help view authors check the layout of their views: widgets,
+// attrs and client side behaviours are ignored. Elements that are always
+// invisible are not rendered and the decorations of list rows are added as
+// classes.
+func (v *View) RenderHTML(record models.FieldMap) string {
+	archElem := xmlutils.XMLToElement(v.Arch)
+	r := htmlRenderer{
+		record: record,
+	}
+	if model, ok := models.Registry.Get(v.Model); ok {
+		r.model = model
+	}
+	fmt.Fprintf(&r.buf, "<div class=\"yep-view yep-%s\" data-view=\"%s\">\n", archElem.Tag, html.EscapeString(v.ID))
+	switch ViewType(archElem.Tag) {
+	case VIEW_TYPE_TREE, VIEW_TYPE_LIST:
+		r.renderList(archElem)
+	default:
+		r.renderChildren(archElem, 1)
+	}
+	r.buf.WriteString("</div>\n")
+	return r.buf.String()
+}
+
+// An htmlRenderer writes the HTML rendering of a view arch for a record
+type htmlRenderer struct {
+	buf    bytes.Buffer
+	model  *models.Model
+	record models.FieldMap
+}
+
+// renderChildren renders the child elements of the given element
+func (r *htmlRenderer) renderChildren(elem *etree.Element, depth int) {
+	for _, child := range elem.ChildElements() {
+		r.renderElement(child, depth)
+	}
+}
+
+// renderElement renders the given arch element and its children
+// with the given indentation depth.
+func (r *htmlRenderer) renderElement(elem *etree.Element, depth int) {
+	if isAlwaysInvisible(elem) {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	switch elem.Tag {
+	case "field":
+		name := elem.SelectAttrValue("name", "")
+		fmt.Fprintf(&r.buf, "%s<div class=\"yep-field\" data-field=\"%s\">", indent, html.EscapeString(name))
+		if elem.SelectAttrValue("nolabel", "") != "1" {
+			fmt.Fprintf(&r.buf, "<label>%s</label> ", html.EscapeString(r.fieldLabel(elem)))
+		}
+		fmt.Fprintf(&r.buf, "<span>%s</span></div>\n", html.EscapeString(r.fieldValue(name)))
+	case "button":
+		fmt.Fprintf(&r.buf, "%s<button type=\"button\" name=\"%s\">%s</button>\n", indent,
+			html.EscapeString(elem.SelectAttrValue("name", "")), html.EscapeString(elem.SelectAttrValue("string", "")))
+	case "separator":
+		fmt.Fprintf(&r.buf, "%s<h3>%s</h3>\n", indent, html.EscapeString(elem.SelectAttrValue("string", "")))
+	case "label":
+		fmt.Fprintf(&r.buf, "%s<label>%s</label>\n", indent, html.EscapeString(elem.SelectAttrValue("string", elem.Text())))
+	case "page":
+		fmt.Fprintf(&r.buf, "%s<section class=\"yep-page\">\n%s  <h2>%s</h2>\n", indent, indent,
+			html.EscapeString(elem.SelectAttrValue("string", "")))
+		r.renderChildren(elem, depth+1)
+		fmt.Fprintf(&r.buf, "%s</section>\n", indent)
+	case "h1", "h2", "h3", "p", "span":
+		fmt.Fprintf(&r.buf, "%s<%s>%s\n", indent, elem.Tag, html.EscapeString(strings.TrimSpace(elem.Text())))
+		r.renderChildren(elem, depth+1)
+		fmt.Fprintf(&r.buf, "%s</%s>\n", indent, elem.Tag)
+	default:
+		fmt.Fprintf(&r.buf, "%s<div class=\"yep-%s\">\n", indent, html.EscapeString(elem.Tag))
+		r.renderChildren(elem, depth+1)
+		fmt.Fprintf(&r.buf, "%s</div>\n", indent)
+	}
+}
+
+// renderList renders the given tree arch element as a table
+// with a header row and a row for the record.
+func (r *htmlRenderer) renderList(elem *etree.Element) {
+	var fields []*etree.Element
+	for _, child := range elem.SelectElements("field") {
+		if !isAlwaysInvisible(child) {
+			fields = append(fields, child)
+		}
+	}
+	r.buf.WriteString("  <table>\n    <tr>")
+	for _, f := range fields {
+		fmt.Fprintf(&r.buf, "<th>%s</th>", html.EscapeString(r.fieldLabel(f)))
+	}
+	r.buf.WriteString("</tr>\n    <tr")
+	if classes := r.decorations(elem); len(classes) > 0 {
+		fmt.Fprintf(&r.buf, " class=\"%s\"", strings.Join(classes, " "))
+	}
+	r.buf.WriteString(">")
+	for _, f := range fields {
+		fmt.Fprintf(&r.buf, "<td>%s</td>", html.EscapeString(r.fieldValue(f.SelectAttrValue("name", ""))))
+	}
+	r.buf.WriteString("</tr>\n  </table>\n")
+}
+
+// decorations returns the decoration-* attributes of the given element whose
+// expression is true for the rendered record. Expressions that cannot be
+// evaluated, for instance on sample data, are ignored.
+func (r *htmlRenderer) decorations(elem *etree.Element) []string {
+	var res []string
+	for _, attr := range elem.Attr {
+		if !strings.HasPrefix(attr.Key, "decoration-") {
+			continue
+		}
+		program, err := expr.Compile(attr.Value)
+		if err != nil {
+			continue
+		}
+		if ok, err := program.EvalBool(r); err == nil && ok {
+			res = append(res, attr.Key)
+		}
+	}
+	return res
+}
+
+// Lookup returns the value of the field with the given name in the rendered
+// record, so that expressions can be evaluated on it.
+func (r *htmlRenderer) Lookup(name string) (interface{}, bool) {
+	value, ok := r.record[r.jsonName(name)]
+	return value, ok
+}
+
+// fieldLabel returns the label of the given field element, which is its
+// string attribute if any or the name of the field otherwise.
+func (r *htmlRenderer) fieldLabel(elem *etree.Element) string {
+	return elem.SelectAttrValue("string", elem.SelectAttrValue("name", ""))
+}
+
+// fieldValue returns the string representation of the
+// value of the given field in the rendered record.
+func (r *htmlRenderer) fieldValue(name string) string {
+	value, ok := r.record[r.jsonName(name)]
+	if !ok {
+		return ""
+	}
+	switch val := value.(type) {
+	case nil:
+		return ""
+	case models.RecordSet:
+		return fmt.Sprint(val.Ids())
+	case []string:
+		return strings.Join(val, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// jsonName returns the JSON name of the given field if it exists
+// in the model of the view, or the given name otherwise.
+func (r *htmlRenderer) jsonName(name string) string {
+	if r.model != nil {
+		if _, exists := r.model.Fields().Get(name); exists {
+			return r.model.JSONizeFieldName(name)
+		}
+	}
+	return name
+}
+
+// isAlwaysInvisible returns true if the given arch element
+// has an invisible attribute set to true.
+func isAlwaysInvisible(elem *etree.Element) bool {
+	value := elem.SelectAttrValue("invisible", "")
+	return value == "1" || strings.ToLower(value) == "true"
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package views
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/tools"
+	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/tools/xmlutils"
+)
+
+// modifierAttrs are the node attributes that are exported
+// as modifiers in a FormNode.
+var modifierAttrs = []string{"invisible", "readonly", "required"}
+
+// A FormNode is a node of the JSON specification of a form view.
+//
+// Field nodes have their Field metadata set and button nodes their
+// ButtonType. All other attributes of the arch node are kept in Attrs.
+type FormNode struct {
+	Tag        string                 `json:"tag"`
+	Name       string                 `json:"name,omitempty"`
+	String     string                 `json:"string,omitempty"`
+	Text       string                 `json:"text,omitempty"`
+	ButtonType string                 `json:"button_type,omitempty"`
+	Field      *models.FieldInfo      `json:"field,omitempty"`
+	Modifiers  map[string]interface{} `json:"modifiers,omitempty"`
+	Attrs      map[string]string      `json:"attrs,omitempty"`
+	Children   []*FormNode            `json:"children,omitempty"`
+}
+
+// A FormSpec is a structured representation of a form view that
+// can be rendered by clients without parsing the XML arch.
+type FormSpec struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	Model string    `json:"model"`
+	Root  *FormNode `json:"root"`
+	// Direction is the writing direction of the language
+	// in which the form is served.
+	Direction tools.LangDirection `json:"direction"`
+}
+
+// FormSpec returns the JSON specification of this form view.
+// fInfos are the fields metadata of the view's model as returned
+// by FieldsGet, keyed by field JSON names.
+//
+// It panics if this view is not a form view.
+func (v *View) FormSpec(fInfos map[string]*models.FieldInfo) *FormSpec {
+	archElem := xmlutils.XMLToElement(v.Arch)
+	if ViewType(archElem.Tag) != VIEW_TYPE_FORM {
+		log.Panic("View is not a form view", "view", v.ID, "type", archElem.Tag)
+	}
+	return &FormSpec{
+		ID:    v.ID,
+		Name:  v.Name,
+		Model: v.Model,
+		Root:  newFormNode(archElem, models.Registry.MustGet(v.Model), fInfos),
+	}
+}
+
+// newFormNode returns the FormNode of the given arch element of a view
+// of model and of all its children recursively.
+func newFormNode(elem *etree.Element, model *models.Model, fInfos map[string]*models.FieldInfo) *FormNode {
+	node := FormNode{
+		Tag:       elem.Tag,
+		Text:      strings.TrimSpace(elem.Text()),
+		Modifiers: make(map[string]interface{}),
+		Attrs:     make(map[string]string),
+	}
+	for _, attr := range elem.Attr {
+		switch attr.Key {
+		case "name":
+			node.Name = attr.Value
+		case "string":
+			node.String = attr.Value
+		case "modifiers":
+			if err := json.Unmarshal([]byte(attr.Value), &node.Modifiers); err != nil {
+				log.Panic("Unable to read modifiers", "error", err, "modifiers", attr.Value)
+			}
+		default:
+			node.Attrs[attr.Key] = attr.Value
+		}
+	}
+	for _, modifier := range modifierAttrs {
+		value, exists := node.Attrs[modifier]
+		if !exists {
+			continue
+		}
+		if _, set := node.Modifiers[modifier]; !set {
+			node.Modifiers[modifier] = value == "1" || strings.ToLower(value) == "true"
+		}
+		delete(node.Attrs, modifier)
+	}
+	switch elem.Tag {
+	case "field":
+		node.Field = fInfos[model.JSONizeFieldName(node.Name)]
+	case "button":
+		node.ButtonType = node.Attrs["type"]
+		delete(node.Attrs, "type")
+	}
+	for _, child := range elem.ChildElements() {
+		node.Children = append(node.Children, newFormNode(child, model, fInfos))
+	}
+	return &node
+}
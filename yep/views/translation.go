@@ -0,0 +1,91 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package views
+
+import (
+	"sync"
+
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/tools/etree"
+	"github.com/npiganeau/yep/yep/tools/i18n"
+	"github.com/npiganeau/yep/yep/tools/xmlutils"
+)
+
+// translatableAttrs are the arch attributes that are
+// translated when a view is served to a user.
+var translatableAttrs = []string{"string", "help", "placeholder"}
+
+// An archCacheKey identifies a translated arch in the cache
+type archCacheKey struct {
+	viewID string
+	lang   string
+}
+
+// A translatedArch is a translated arch in the cache with the source arch and
+// the generation of the i18n registry it has been computed from.
+type translatedArch struct {
+	source     string
+	generation int64
+	arch       string
+}
+
+// translatedArchs caches the translated archs of views per language
+var translatedArchs = struct {
+	sync.RWMutex
+	archs map[archCacheKey]translatedArch
+}{
+	archs: make(map[archCacheKey]translatedArch),
+}
+
+// Translated returns a copy of this view in which the string, help and
+// placeholder attributes of the arch are translated in the given language
+// through the i18n registry. The view is returned as is if lang is empty or
+// is the models.SourceLanguage.
+//
+// Translated archs are cached per view and language until the view or the
+// translations of the i18n registry change.
+func (v *View) Translated(lang string) *View {
+	if lang == "" || lang == models.SourceLanguage {
+		return v
+	}
+	key := archCacheKey{viewID: v.ID, lang: lang}
+	generation := i18n.Registry.Generation()
+	translatedArchs.RLock()
+	cached, ok := translatedArchs.archs[key]
+	translatedArchs.RUnlock()
+	if !ok || cached.source != v.Arch || cached.generation != generation {
+		cached = translatedArch{
+			source:     v.Arch,
+			generation: generation,
+			arch:       translateArch(v.Arch, lang),
+		}
+		translatedArchs.Lock()
+		translatedArchs.archs[key] = cached
+		translatedArchs.Unlock()
+	}
+	res := *v
+	res.Arch = cached.arch
+	return &res
+}
+
+// translateArch returns the given arch with its translatable
+// attributes translated in the given language.
+func translateArch(arch, lang string) string {
+	archElem := xmlutils.XMLToElement(arch)
+	translateElement(archElem, lang)
+	return xmlutils.ElementToXML(archElem)
+}
+
+// translateElement translates the translatable attributes of
+// elem and of all its descendants in the given language.
+func translateElement(elem *etree.Element, lang string) {
+	for _, attr := range translatableAttrs {
+		if source := elem.SelectAttrValue(attr, ""); source != "" {
+			elem.CreateAttr(attr, i18n.Registry.Translate(lang, source))
+		}
+	}
+	for _, child := range elem.ChildElements() {
+		translateElement(child, lang)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/security"
 	"github.com/npiganeau/yep/yep/tools/etree"
 	"github.com/npiganeau/yep/yep/tools/xmlutils"
 )
@@ -174,14 +175,122 @@ func (vc *Collection) GetByID(id string) *View {
 	return vc.views[id]
 }
 
-// GetFirstViewForModel returns the first view of type viewType for the given model
+// A Client is the user to whom views are served and the kind of client it uses.
+type Client struct {
+	UID    int64
+	Mobile bool
+}
+
+// GetByIDForUser returns the View with the given id if the user with the given
+// uid is allowed to see it. Otherwise, it returns the next view of the same model
+// and type by priority that this user is allowed to see.
+func (vc *Collection) GetByIDForUser(id string, uid int64) *View {
+	view := vc.GetByID(id)
+	if view == nil {
+		return nil
+	}
+	return vc.GetByIDForClient(id, Client{UID: uid, Mobile: view.Mobile})
+}
+
+// GetByIDForClient returns the View with the given id as served to the given
+// client. Mobile clients get the first mobile view of the same model and type
+// that the user is allowed to see if there is one. If the user is not allowed
+// to see the view, the next view of the same model and type by priority that
+// this user is allowed to see is returned instead.
+func (vc *Collection) GetByIDForClient(id string, client Client) *View {
+	view := vc.GetByID(id)
+	if view == nil {
+		return nil
+	}
+	if view.Mobile {
+		client.Mobile = true
+	}
+	if view.IsAllowed(client.UID) && (view.Mobile || !client.Mobile) {
+		return view
+	}
+	return vc.firstViewForClient(view.Model, view.Type, client)
+}
+
+// GetFirstViewForModel returns the first view of type viewType for the given model.
+// Mobile views are not returned by this function.
+//
+// Groups of the views are not checked. Use GetFirstViewForModelForClient
+// for views that are served to a user.
 func (vc *Collection) GetFirstViewForModel(model string, viewType ViewType) *View {
+	view := vc.firstView(model, viewType, func(v *View) bool {
+		return !v.Mobile
+	})
+	if view == nil {
+		log.Panic("No view of this type in model", "type", viewType, "model", model)
+	}
+	return view
+}
+
+// GetFirstViewForModelForUser returns the first view of type viewType for the
+// given model that the user with the given uid is allowed to see.
+// Mobile views are not returned by this function.
+func (vc *Collection) GetFirstViewForModelForUser(model string, viewType ViewType, uid int64) *View {
+	return vc.GetFirstViewForModelForClient(model, viewType, Client{UID: uid})
+}
+
+// GetFirstViewForModelForClient returns the first view of type viewType for
+// the given model that the user of the given client is allowed to see. Mobile
+// clients get the first mobile view if there is one.
+func (vc *Collection) GetFirstViewForModelForClient(model string, viewType ViewType, client Client) *View {
+	view := vc.firstViewForClient(model, viewType, client)
+	if view == nil {
+		log.Panic("No view of this type in model for this user", "type", viewType, "model", model,
+			"uid", client.UID)
+	}
+	return view
+}
+
+// GetFirstMobileViewForModel returns the first mobile view of type viewType for the
+// given model. It falls back to the first view of this type if the model has no
+// mobile view of this type.
+func (vc *Collection) GetFirstMobileViewForModel(model string, viewType ViewType) *View {
+	view := vc.firstView(model, viewType, func(v *View) bool {
+		return v.Mobile
+	})
+	if view == nil {
+		return vc.GetFirstViewForModel(model, viewType)
+	}
+	return view
+}
+
+// GetFirstMobileViewForModelForUser returns the first mobile view of type viewType
+// for the given model that the user with the given uid is allowed to see. It falls
+// back to the first view of this type that this user is allowed to see.
+func (vc *Collection) GetFirstMobileViewForModelForUser(model string, viewType ViewType, uid int64) *View {
+	return vc.GetFirstViewForModelForClient(model, viewType, Client{UID: uid, Mobile: true})
+}
+
+// firstViewForClient returns the first view by priority of type viewType
+// for the given model that the user of the given client is allowed to see,
+// or nil if there is none. Mobile views are returned first to mobile clients
+// and never to other clients.
+func (vc *Collection) firstViewForClient(model string, viewType ViewType, client Client) *View {
+	if client.Mobile {
+		view := vc.firstView(model, viewType, func(v *View) bool {
+			return v.Mobile && v.IsAllowed(client.UID)
+		})
+		if view != nil {
+			return view
+		}
+	}
+	return vc.firstView(model, viewType, func(v *View) bool {
+		return !v.Mobile && v.IsAllowed(client.UID)
+	})
+}
+
+// firstView returns the first view by priority of type viewType for the
+// given model for which accept returns true, or nil if there is none.
+func (vc *Collection) firstView(model string, viewType ViewType, accept func(*View) bool) *View {
 	for _, view := range vc.orderedViews[model] {
-		if view.Type == viewType {
+		if view.Type == viewType && accept(view) {
 			return view
 		}
 	}
-	log.Panic("No view of this type in model", "type", viewType, "model", model)
 	return nil
 }
 
@@ -205,8 +314,50 @@ type View struct {
 	Priority    uint8    `json:"priority"`
 	Arch        string   `json:"arch"`
 	FieldParent string   `json:"field_parent"`
+	Mobile      bool     `json:"mobile"`
 	//Toolbar     actions.Toolbar `json:"toolbar"`
-	Fields []models.FieldName
+	Fields   []models.FieldName
+	Groups   []*security.Group `json:"-"`
+	groupIDs []string
+}
+
+// IsAllowed returns true if the user with the given uid is allowed
+// to see this view, i.e. if the view has no groups, if the user is
+// a member of one of them or if the user is an administrator.
+func (v *View) IsAllowed(uid int64) bool {
+	if len(v.Groups) == 0 || security.Registry.HasMembership(uid, security.GroupAdmin) {
+		return true
+	}
+	for _, group := range v.Groups {
+		if security.Registry.HasMembership(uid, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// featureAttr is the arch attribute restricting an element
+// to the users for which a feature flag is enabled.
+const featureAttr = "feature"
+
+// WithFeatures returns a copy of this view in which the arch elements with a
+// feature attribute are removed if isEnabled returns false for this feature.
+// The feature attribute of the other elements is removed.
+//
+// isEnabled is typically the IsFeatureEnabled method of the Environment of
+// the user to whom the view is served.
+func (v *View) WithFeatures(isEnabled func(string) bool) *View {
+	archElem := xmlutils.XMLToElement(v.Arch)
+	for _, elem := range archElem.FindElements(fmt.Sprintf("//*[@%s]", featureAttr)) {
+		if !isEnabled(elem.SelectAttrValue(featureAttr, "")) && elem != archElem {
+			elem.Parent().RemoveChild(elem)
+			continue
+		}
+		elem.RemoveAttr(featureAttr)
+	}
+	res := *v
+	res.Arch = xmlutils.ElementToXML(archElem)
+	return &res
 }
 
 // ViewXML is used to unmarshal the XML definition of a View
@@ -218,6 +369,8 @@ type ViewXML struct {
 	Arch        string `xml:",innerxml"`
 	InheritID   string `xml:"inherit_id,attr"`
 	FieldParent string `xml:"field_parent,attr"`
+	Mobile      bool   `xml:"mobile,attr"`
+	Groups      string `xml:"groups,attr"`
 }
 
 // LoadFromEtree reads the view given etree.Element, creates or updates the view
@@ -262,6 +415,12 @@ func createNewViewFromXML(viewXML ViewXML) {
 		Priority:    priority,
 		Arch:        arch,
 		FieldParent: viewXML.FieldParent,
+		Mobile:      viewXML.Mobile,
+	}
+	for _, groupID := range strings.Split(viewXML.Groups, ",") {
+		if groupID = strings.TrimSpace(groupID); groupID != "" {
+			view.groupIDs = append(view.groupIDs, groupID)
+		}
 	}
 	Registry.Add(&view)
 }
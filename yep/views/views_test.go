@@ -15,8 +15,13 @@
 package views
 
 import (
+	"encoding/json"
 	"testing"
 
+	"github.com/npiganeau/yep/yep/models"
+	"github.com/npiganeau/yep/yep/models/fieldtype"
+	"github.com/npiganeau/yep/yep/models/security"
+	"github.com/npiganeau/yep/yep/tools/i18n"
 	"github.com/npiganeau/yep/yep/tools/xmlutils"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -89,6 +94,23 @@ var viewDef6 string = `
 </view>
 `
 
+var viewDef7 string = `
+<view id="my_mobile_id" model="Test__User" priority="1" mobile="1">
+	<form>
+		<field name="UserName"/>
+	</form>
+</view>
+`
+
+var viewDef8 string = `
+<view id="my_accounting_id" model="Test__User" priority="2" groups="accounting">
+	<form>
+		<field name="UserName"/>
+		<field name="Salary"/>
+	</form>
+</view>
+`
+
 func TestViews(t *testing.T) {
 	Convey("Creating View 1", t, func() {
 		LoadFromEtree(xmlutils.XMLToElement(viewDef1))
@@ -227,4 +249,175 @@ func TestViews(t *testing.T) {
 		So(view2.Type, ShouldEqual, VIEW_TYPE_FORM)
 		So(view3.Type, ShouldEqual, VIEW_TYPE_TREE)
 	})
+	Convey("Mobile views", t, func() {
+		LoadFromEtree(xmlutils.XMLToElement(viewDef7))
+		BootStrap()
+		mobileView := Registry.GetByID("my_mobile_id")
+		So(mobileView, ShouldNotBeNil)
+		So(mobileView.Mobile, ShouldBeTrue)
+		So(Registry.GetFirstViewForModel("Test__User", VIEW_TYPE_FORM).ID, ShouldEqual, "my_id")
+		So(Registry.GetFirstMobileViewForModel("Test__User", VIEW_TYPE_FORM).ID, ShouldEqual, "my_mobile_id")
+		So(Registry.GetFirstMobileViewForModel("Test__User", VIEW_TYPE_TREE).ID, ShouldEqual, "my_tree_id")
+	})
+	Convey("Views restricted to groups", t, func() {
+		accounting := security.Registry.NewGroup("accounting", "Accounting")
+		security.Registry.AddMembership(2, accounting)
+		LoadFromEtree(xmlutils.XMLToElement(viewDef8))
+		BootStrap()
+		accountingView := Registry.GetByID("my_accounting_id")
+		So(accountingView.Groups, ShouldHaveLength, 1)
+		So(accountingView.IsAllowed(security.SuperUserID), ShouldBeTrue)
+		So(accountingView.IsAllowed(2), ShouldBeTrue)
+		So(accountingView.IsAllowed(3), ShouldBeFalse)
+		So(Registry.GetFirstViewForModelForUser("Test__User", VIEW_TYPE_FORM, 2).ID, ShouldEqual, "my_accounting_id")
+		So(Registry.GetFirstViewForModelForUser("Test__User", VIEW_TYPE_FORM, 3).ID, ShouldEqual, "my_id")
+		So(Registry.GetByIDForUser("my_accounting_id", 2).ID, ShouldEqual, "my_accounting_id")
+		So(Registry.GetByIDForUser("my_accounting_id", 3).ID, ShouldEqual, "my_id")
+		So(Registry.GetByIDForClient("my_accounting_id", Client{UID: 2}).ID, ShouldEqual, "my_accounting_id")
+		So(Registry.GetByIDForClient("my_accounting_id", Client{UID: 3}).ID, ShouldEqual, "my_id")
+		So(Registry.GetByIDForClient("my_id", Client{UID: 3, Mobile: true}).ID, ShouldEqual, "my_mobile_id")
+		So(Registry.GetByIDForClient("my_tree_id", Client{UID: 3, Mobile: true}).ID, ShouldEqual, "my_tree_id")
+		So(Registry.GetByIDForClient("my_mobile_id", Client{UID: 3}).ID, ShouldEqual, "my_mobile_id")
+		So(Registry.GetFirstViewForModelForClient("Test__User", VIEW_TYPE_FORM, Client{UID: 3, Mobile: true}).ID,
+			ShouldEqual, "my_mobile_id")
+		So(Registry.GetFirstViewForModelForClient("Test__User", VIEW_TYPE_FORM, Client{UID: 2}).ID,
+			ShouldEqual, "my_accounting_id")
+	})
+	Convey("JSON specification of form views", t, func() {
+		contact := models.NewModel("Test__Contact")
+		contact.AddCharField("Name", models.StringFieldParams{})
+		contact.AddCharField("Email", models.StringFieldParams{})
+		fInfos := map[string]*models.FieldInfo{
+			"name":  {String: "Name", Type: fieldtype.Char, Required: true},
+			"email": {String: "Email", Type: fieldtype.Char},
+		}
+		view := &View{
+			ID:    "my_contact_id",
+			Name:  "Contact Form",
+			Model: "Test__Contact",
+			Arch: `<form string="Contact">
+	<p> Fill in the contact </p>
+	<group name="main" col="2">
+		<field name="Name" required="1" placeholder="Name"/>
+		<field name="Email" readonly="True" invisible="1" modifiers='{"invisible": [["name", "=", false]]}'/>
+	</group>
+	<button name="SendInvitation" type="object" string="Send" class="oe_highlight"/>
+</form>`,
+		}
+		spec := view.FormSpec(fInfos)
+		So(spec.ID, ShouldEqual, "my_contact_id")
+		So(spec.Name, ShouldEqual, "Contact Form")
+		So(spec.Model, ShouldEqual, "Test__Contact")
+		So(spec.Root.Tag, ShouldEqual, "form")
+		So(spec.Root.String, ShouldEqual, "Contact")
+		So(spec.Root.Children, ShouldHaveLength, 3)
+		text, group, button := spec.Root.Children[0], spec.Root.Children[1], spec.Root.Children[2]
+		So(text.Tag, ShouldEqual, "p")
+		So(text.Text, ShouldEqual, "Fill in the contact")
+		So(group.Name, ShouldEqual, "main")
+		So(group.Attrs, ShouldResemble, map[string]string{"col": "2"})
+		So(group.Field, ShouldBeNil)
+		So(group.Children, ShouldHaveLength, 2)
+		name, email := group.Children[0], group.Children[1]
+		So(name.Field, ShouldEqual, fInfos["name"])
+		So(name.Modifiers, ShouldResemble, map[string]interface{}{"required": true})
+		So(name.Attrs, ShouldResemble, map[string]string{"placeholder": "Name"})
+		So(email.Field, ShouldEqual, fInfos["email"])
+		So(email.Modifiers["readonly"], ShouldEqual, true)
+		So(email.Modifiers["invisible"], ShouldResemble, []interface{}{[]interface{}{"name", "=", false}})
+		So(email.Attrs, ShouldBeEmpty)
+		So(button.Name, ShouldEqual, "SendInvitation")
+		So(button.String, ShouldEqual, "Send")
+		So(button.ButtonType, ShouldEqual, "object")
+		So(button.Attrs, ShouldResemble, map[string]string{"class": "oe_highlight"})
+		data, err := json.Marshal(spec)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldStartWith, `{"id":"my_contact_id","name":"Contact Form","model":"Test__Contact","root":{"tag":"form","string":"Contact","children":[`)
+		So(string(data), ShouldContainSubstring, `{"tag":"button","name":"SendInvitation","string":"Send","button_type":"object","attrs":{"class":"oe_highlight"}}`)
+		So(string(data), ShouldContainSubstring, `"modifiers":{"required":true}`)
+		So(string(data), ShouldContainSubstring, `"field":{`)
+		list := &View{ID: "my_contact_list_id", Model: "Test__Contact", Arch: `<tree><field name="Name"/></tree>`}
+		So(func() { list.FormSpec(fInfos) }, ShouldPanic)
+	})
+	Convey("Views with feature flags", t, func() {
+		view := &View{
+			ID:   "my_feature_id",
+			Arch: `<form><field name="UserName"/><group feature="new_ui"><field name="Age"/></group><field name="Salary" feature="payroll"/></form>`,
+		}
+		featView := view.WithFeatures(func(feature string) bool {
+			return feature == "new_ui"
+		})
+		So(featView.Arch, ShouldContainSubstring, "<group>")
+		So(featView.Arch, ShouldContainSubstring, `name="Age"`)
+		So(featView.Arch, ShouldNotContainSubstring, "Salary")
+		So(featView.Arch, ShouldNotContainSubstring, "feature")
+		So(view.Arch, ShouldContainSubstring, "Salary")
+	})
+	Convey("Translated views", t, func() {
+		view := &View{
+			ID:   "my_translated_id",
+			Arch: `<form string="User"><field name="UserName" string="Name" placeholder="Your name"/><field name="Age" help="Age in years"/></form>`,
+		}
+		i18n.Registry.Load("fr_FR", map[string]string{
+			"User":      "Utilisateur",
+			"Name":      "Nom",
+			"Your name": "Votre nom",
+		})
+		frView := view.Translated("fr_FR")
+		So(frView.Arch, ShouldContainSubstring, `string="Utilisateur"`)
+		So(frView.Arch, ShouldContainSubstring, `string="Nom"`)
+		So(frView.Arch, ShouldContainSubstring, `placeholder="Votre nom"`)
+		So(frView.Arch, ShouldContainSubstring, `help="Age in years"`)
+		So(view.Arch, ShouldContainSubstring, `string="Name"`)
+		So(view.Translated("").Arch, ShouldEqual, view.Arch)
+		So(view.Translated("de_DE").Arch, ShouldContainSubstring, `string="Name"`)
+		i18n.Registry.Add("fr_FR", "Age in years", "Âge en années")
+		So(view.Translated("fr_FR").Arch, ShouldContainSubstring, `help="Âge en années"`)
+	})
+	Convey("Rendering views in HTML", t, func() {
+		form := &View{
+			ID:    "my_preview_id",
+			Model: "Test__User",
+			Arch:  `<form><group><field name="UserName" string="Name"/><field name="Age" invisible="1"/></group><notebook><page string="Tags"><field name="Tags"/></page></notebook></form>`,
+		}
+		html := form.RenderHTML(models.FieldMap{"UserName": "John <Smith>", "Age": 24, "Tags": []string{"A", "B"}})
+		So(html, ShouldContainSubstring, `<div class="yep-view yep-form" data-view="my_preview_id">`)
+		So(html, ShouldContainSubstring, `<label>Name</label> <span>John &lt;Smith&gt;</span>`)
+		So(html, ShouldContainSubstring, "<h2>Tags</h2>")
+		So(html, ShouldContainSubstring, "<span>A, B</span>")
+		So(html, ShouldNotContainSubstring, "Age")
+		list := &View{
+			ID:   "my_list_preview_id",
+			Arch: `<tree><field name="UserName"/><field name="Age"/></tree>`,
+		}
+		html = list.RenderHTML(models.FieldMap{"UserName": "John", "Age": 24})
+		So(html, ShouldContainSubstring, "<tr><th>UserName</th><th>Age</th></tr>")
+		So(html, ShouldContainSubstring, "<tr><td>John</td><td>24</td></tr>")
+		decorated := &View{
+			ID:   "my_decorated_preview_id",
+			Arch: `<tree decoration-danger="Age &lt; 18" decoration-info="UserName == 'John'"><field name="UserName"/></tree>`,
+		}
+		html = decorated.RenderHTML(models.FieldMap{"UserName": "John", "Age": 24})
+		So(html, ShouldContainSubstring, `<tr class="decoration-info"><td>John</td></tr>`)
+	})
+	Convey("Checking views registry", t, func() {
+		Registry.Add(&View{
+			ID:       "my_broken_id",
+			Model:    "Test__User",
+			Arch:     `<form><field name="UserName"/></form>`,
+			groupIDs: []string{"unknown_group"},
+		})
+		Registry.Add(&View{
+			ID:    "my_broken_decoration_id",
+			Model: "Test__User",
+			Arch:  `<tree decoration-muted="Age &gt;"><field name="UserName"/></tree>`,
+		})
+		report := CheckRegistry().String()
+		// Test models are not declared in this package
+		So(report, ShouldContainSubstring, "view my_id: unknown model 'Test__User'")
+		So(report, ShouldContainSubstring, "view my_other_id: unknown model 'Test__Partner'")
+		So(report, ShouldContainSubstring, "view my_broken_id: unknown group 'unknown_group'")
+		So(report, ShouldNotContainSubstring, "my_accounting_id: unknown group")
+		So(report, ShouldContainSubstring, "view my_broken_decoration_id: invalid decoration-muted attribute")
+	})
 }